@@ -90,12 +90,16 @@ func (s *Server) initKubeRegistry(serviceControllers *aggregate.Controller, args
 	args.Config.ControllerOptions.Metrics = s.environment
 	args.Config.ControllerOptions.XDSUpdater = s.EnvoyXdsServer
 	args.Config.ControllerOptions.NetworksWatcher = s.environment.NetworksWatcher
+	args.Config.ControllerOptions.MeshWatcher = s.environment.Watcher
 	if features.EnableEndpointSliceController {
 		args.Config.ControllerOptions.EndpointMode = kubecontroller.EndpointSliceOnly
 	} else {
 		args.Config.ControllerOptions.EndpointMode = kubecontroller.EndpointsOnly
 	}
-	kubeRegistry := kubecontroller.NewController(s.kubeClient, s.metadataClient, args.Config.ControllerOptions)
+	kubeRegistry, err := kubecontroller.NewControllerE(s.kubeClient, s.metadataClient, args.Config.ControllerOptions)
+	if err != nil {
+		return err
+	}
 	s.kubeRegistry = kubeRegistry
 	serviceControllers.AddRegistry(kubeRegistry)
 	return
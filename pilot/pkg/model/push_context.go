@@ -173,7 +173,8 @@ type XDSUpdater interface {
 	// name.
 	EDSUpdate(shard, hostname string, namespace string, entry []*IstioEndpoint) error
 
-	// SvcUpdate is called when a service definition is updated/deleted.
+	// SvcUpdate is called when a service definition is updated/deleted. The hostname is the one
+	// the registry converted the service to, as passed to EDSUpdate.
 	SvcUpdate(shard, hostname string, namespace string, event Event)
 
 	// ConfigUpdate is called to notify the XDS server of config updates and request a push.
@@ -186,6 +187,21 @@ type XDSUpdater interface {
 	ProxyUpdate(clusterID, ip string)
 }
 
+// EDSBatchUpdater is implemented by XDSUpdaters that can apply the endpoints of many services with
+// a single push, which registries use when they have the endpoints of many services at once, such
+// as during their initial sync.
+type EDSBatchUpdater interface {
+	// EDSBatchUpdate is equivalent to an EDSUpdate of each entry, but requests one push for all.
+	EDSBatchUpdate(shard string, entries []EDSUpdateEntry) error
+}
+
+// EDSUpdateEntry is the full list of active endpoints of a service, see XDSUpdater.EDSUpdate.
+type EDSUpdateEntry struct {
+	Hostname  string
+	Namespace string
+	Endpoints []*IstioEndpoint
+}
+
 // PushRequest defines a request to push to proxies
 // It is used to send updates to the config update debouncer and pass to the PushQueue.
 type PushRequest struct {
@@ -329,6 +345,14 @@ var (
 		"Pods not found in the endpoint table, possibly invalid.",
 	)
 
+	// ProxyStatusServiceLookupFailed represents proxies whose services could not all be resolved,
+	// unlike ProxyStatusNoService which is only updated when the lookup found no service.
+	// Updated by GetProxyServiceInstances
+	ProxyStatusServiceLookupFailed = monitoring.NewGauge(
+		"pilot_service_lookup_failed",
+		"Proxies whose service instances could not all be resolved.",
+	)
+
 	// ProxyStatusEndpointNotReady represents proxies found not be ready.
 	// Updated by GetProxyServiceInstances. Normal condition when starting
 	// an app with readiness, error if it doesn't change to 0.
@@ -413,6 +437,7 @@ var (
 	metrics = []monitoring.Metric{
 		EndpointNoPod,
 		ProxyStatusNoService,
+		ProxyStatusServiceLookupFailed,
 		ProxyStatusEndpointNotReady,
 		ProxyStatusConflictOutboundListenerTCPOverHTTP,
 		ProxyStatusConflictOutboundListenerTCPOverTCP,
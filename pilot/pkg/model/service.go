@@ -341,6 +341,30 @@ type IstioEndpoint struct {
 
 	// TLSMode endpoint is injected with istio sidecar and ready to configure Istio mTLS
 	TLSMode string
+
+	// ClusterLocal is true if the endpoint belongs to a cluster-local service and must not be
+	// merged with endpoints of the same service from other clusters.
+	ClusterLocal bool
+
+	// ControlPlane is true if the endpoint belongs to a service of the control plane itself, such
+	// as istiod. Such endpoints must not be used to route proxy traffic through the mesh.
+	ControlPlane bool
+
+	// WorkloadName is the name of the workload (e.g. Deployment or StatefulSet) backing the endpoint.
+	WorkloadName string
+
+	// Namespace is the namespace of the workload backing the endpoint. It differs from the namespace
+	// of the service when the endpoints of the service reference workloads of other namespaces.
+	Namespace string
+
+	// HostName is the DNS name of the endpoint within its service, such as the stable name of a
+	// StatefulSet pod behind a headless service (pod-0.svc.ns.svc.cluster.local). Empty if the
+	// endpoint has no name of its own.
+	HostName string
+
+	// NodeName is the name of the node the endpoint runs on, for topology aware features such as
+	// preferring endpoints of the same node. Empty if unknown.
+	NodeName string
 }
 
 // ServiceAttributes represents a group of custom attributes of the service.
@@ -365,6 +389,14 @@ type ServiceAttributes struct {
 
 	// For Kubernetes platform
 
+	// Labels are the labels of the Kubernetes service object itself, as opposed to the labels of
+	// the workloads it selects. Features keyed on the service, such as istio.io/rev, read them.
+	Labels map[string]string
+
+	// MCSDerived indicates that the Kubernetes service was derived from a ServiceImport of the
+	// multi-cluster services API, its endpoints coming from the clusters of the cluster set.
+	MCSDerived bool
+
 	// ClusterExternalAddresses is a mapping between a cluster name and the external
 	// address(es) to access the service from outside the cluster.
 	// Used by the aggregator to aggregate the Attributes.ClusterExternalAddresses
@@ -377,6 +409,39 @@ type ServiceAttributes struct {
 	// The port that the user provides in the meshNetworks config is the service port.
 	// We translate that to the appropriate node port here.
 	ClusterExternalPorts map[string]map[uint32]uint32
+
+	// ClusterExternalIPs is a mapping between a cluster name and the external IPs of the service
+	// in that cluster (spec.externalIPs), on which the service is reachable at its service ports.
+	// Listener builders can use them to associate traffic to these IPs with the service.
+	ClusterExternalIPs map[string][]string
+
+	// ClusterLocal indicates that the service is only reachable from within its own cluster, so
+	// endpoints discovered in other clusters are never merged with it.
+	ClusterLocal bool
+
+	// SessionAffinityClientIP indicates that the platform routes the connections of a client IP to
+	// the same endpoint (Kubernetes sessionAffinity ClientIP), which load balancers of the service
+	// may want to preserve.
+	SessionAffinityClientIP bool
+
+	// ExternalTrafficPolicyLocal indicates that traffic entering the service from outside the
+	// cluster is only delivered to endpoints on the node that received it (Kubernetes
+	// externalTrafficPolicy Local), so only nodes hosting an endpoint are worth sending it to.
+	ExternalTrafficPolicyLocal bool
+
+	// PortConfigs are the settings of the ports of the service declared by its owner, keyed by
+	// service port number, for consumers reading the services without a sidecar, such as gateways.
+	PortConfigs map[int]PortConfig
+}
+
+// PortConfig are the settings of a port of a service declared by its owner, such as with the
+// networking.istio.io/port-config annotation of Kubernetes services.
+type PortConfig struct {
+	// AppTLS indicates that the application terminates TLS on the port.
+	AppTLS bool `json:"appTLS,omitempty"`
+	// MinTLSVersion is the lowest TLS version the application accepts on the port, one of
+	// TLSv1_0, TLSv1_1, TLSv1_2 and TLSv1_3. Empty when unknown.
+	MinTLSVersion string `json:"minTLSVersion,omitempty"`
 }
 
 // ServiceDiscovery enumerates Istio service instances.
@@ -577,6 +642,9 @@ func GetServiceAccounts(svc *Service, ports []int, discovery ServiceDiscovery) [
 // TODO : See if there is any efficient alternative to this function - copystructure can not be used as is because
 // Service has sync.RWMutex that can not be copied.
 func (s *Service) DeepCopy() *Service {
+	// Attributes and ClusterVIPs are updated by the registries under the mutex.
+	s.Mutex.RLock()
+	defer s.Mutex.RUnlock()
 	attrs := copyInternal(s.Attributes)
 	ports := copyInternal(s.Ports)
 	accounts := copyInternal(s.ServiceAccounts)
@@ -262,9 +262,9 @@ func buildLocalityLbEndpoints(proxy *model.Proxy, push *model.PushContext, proxy
 			// Endpoint's network doesn't match the set of networks that the proxy wants to see.
 			continue
 		}
-		// If the downstream service is configured as cluster-local, only include endpoints that
-		// reside in the same cluster.
-		if isClusterLocal && (proxy.Metadata.ClusterID != instance.Endpoint.Locality.ClusterID) {
+		// If the downstream service is configured as cluster-local, by the mesh config or by its
+		// registry, only include endpoints that reside in the same cluster.
+		if (isClusterLocal || instance.Endpoint.ClusterLocal) && (proxy.Metadata.ClusterID != instance.Endpoint.Locality.ClusterID) {
 			continue
 		}
 		addr := util.BuildAddress(instance.Endpoint.Address, instance.Endpoint.EndpointPort)
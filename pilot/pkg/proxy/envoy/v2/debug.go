@@ -15,13 +15,16 @@
 package v2
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/pprof"
 	"sort"
+	"strconv"
 	"strings"
 
 	"istio.io/istio/pkg/config/schema/collection"
@@ -31,14 +34,17 @@ import (
 	"istio.io/istio/pilot/pkg/features"
 
 	adminapi "github.com/envoyproxy/go-control-plane/envoy/admin/v3"
+	"github.com/ghodss/yaml"
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/any"
+	v1 "k8s.io/api/core/v1"
 
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/networking/util"
 	"istio.io/istio/pilot/pkg/serviceregistry"
 	"istio.io/istio/pilot/pkg/serviceregistry/aggregate"
+	kubecontroller "istio.io/istio/pilot/pkg/serviceregistry/kube/controller"
 	"istio.io/istio/pkg/config/host"
 )
 
@@ -119,6 +125,19 @@ func (s *DiscoveryServer) InitDebug(mux *http.ServeMux, sctl *aggregate.Controll
 	s.addDebugHandler(mux, "/debug/config_distribution", "Version status of all Envoys connected to this Pilot instance", s.distributedVersions)
 
 	s.addDebugHandler(mux, "/debug/registryz", "Debug support for registry", s.registryz)
+	s.addDebugHandler(mux, "/debug/rejectedservicez", "Kubernetes services left out of the registry", s.rejectedServicez)
+	s.addDebugHandler(mux, "/debug/serviceversionz", "Versions of the Kubernetes objects services were built from", s.serviceVersionz)
+	s.addDebugHandler(mux, "/debug/foreigninstancez", "Why foreign instances were not selected for Kubernetes services", s.foreignInstancez)
+	s.addDebugHandler(mux, "/debug/foreigninstancestatez", "Kubernetes services selecting foreign instances and their endpoints", s.foreignInstanceStatez)
+	s.addDebugHandler(mux, "/debug/endpointportz", "Ports of Kubernetes endpoints unknown to their service", s.endpointPortz)
+	s.addDebugHandler(mux, "/debug/proxynoinstancez", "Recent proxies without Kubernetes service instances, with the reason", s.proxyNoInstancez)
+	s.addDebugHandler(mux, "/debug/podcachez", "Pod cache stats and pods pending IP assignment of the Kubernetes registries", s.podCachez)
+	s.addDebugHandler(mux, "/debug/consistencyz", "Discrepancies between the state of the Kubernetes registries and their sources, "+
+		"listing the services of the API servers with live=true", s.consistencyz)
+	s.addDebugHandler(mux, "/debug/registryoptionsz", "Options the Kubernetes registries were built with, and their effective resync periods", s.registryOptionsz)
+	s.addDebugHandler(mux, "/debug/servicepreviewz", "Previews the service built from a POSTed Kubernetes Service", s.servicePreviewz)
+	s.addDebugHandler(mux, "/debug/serviceendpointz", "Endpoints the Kubernetes registries attribute to the service of the hostname "+
+		"parameter, by cluster", s.serviceEndpointz)
 	s.addDebugHandler(mux, "/debug/endpointz", "Debug support for endpoints", s.endpointz)
 	s.addDebugHandler(mux, "/debug/endpointShardz", "Info about the endpoint shards", s.endpointShardz)
 	s.addDebugHandler(mux, "/debug/configz", "Debug support for config", s.configz)
@@ -208,6 +227,330 @@ func (s *DiscoveryServer) registryz(w http.ResponseWriter, req *http.Request) {
 	_, _ = fmt.Fprintln(w, "{}]")
 }
 
+// rejectedServicesLister is implemented by the Kubernetes registries.
+type rejectedServicesLister interface {
+	RejectedServices() []kubecontroller.ServiceRejectedError
+}
+
+// rejectedServicez dumps the Kubernetes services that the registries left out because they
+// cannot be used to generate configuration.
+func (s *DiscoveryServer) rejectedServicez(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	rejected := make([]kubecontroller.ServiceRejectedError, 0)
+	if sctl, ok := s.Env.ServiceDiscovery.(*aggregate.Controller); ok {
+		for _, r := range sctl.GetRegistries() {
+			if l, ok := r.(rejectedServicesLister); ok {
+				rejected = append(rejected, l.RejectedServices()...)
+			}
+		}
+	}
+	out, _ := json.MarshalIndent(rejected, " ", " ")
+	_, _ = w.Write(out)
+}
+
+// serviceVersionsLister is implemented by the Kubernetes registries.
+type serviceVersionsLister interface {
+	ServiceVersions() []kubecontroller.ServiceVersion
+}
+
+// serviceVersionz dumps the versions of the Kubernetes Services and endpoints the services of the
+// registries were last built from.
+func (s *DiscoveryServer) serviceVersionz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	versions := make([]kubecontroller.ServiceVersion, 0)
+	if sctl, ok := s.Env.ServiceDiscovery.(*aggregate.Controller); ok {
+		for _, r := range sctl.GetRegistries() {
+			if l, ok := r.(serviceVersionsLister); ok {
+				versions = append(versions, l.ServiceVersions()...)
+			}
+		}
+	}
+	out, _ := json.MarshalIndent(versions, " ", " ")
+	_, _ = w.Write(out)
+}
+
+// foreignInstancesDiagnoser is implemented by the Kubernetes registries.
+type foreignInstancesDiagnoser interface {
+	ForeignInstancesDiagnostics() []kubecontroller.ForeignInstancesDiagnostic
+}
+
+// foreignInstancez dumps why the Kubernetes registries found no foreign instances, such as
+// workload entries, for services.
+func (s *DiscoveryServer) foreignInstancez(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	diagnostics := make([]kubecontroller.ForeignInstancesDiagnostic, 0)
+	if sctl, ok := s.Env.ServiceDiscovery.(*aggregate.Controller); ok {
+		for _, r := range sctl.GetRegistries() {
+			if d, ok := r.(foreignInstancesDiagnoser); ok {
+				diagnostics = append(diagnostics, d.ForeignInstancesDiagnostics()...)
+			}
+		}
+	}
+	out, _ := json.MarshalIndent(diagnostics, " ", " ")
+	_, _ = w.Write(out)
+}
+
+// foreignInstancesReporter is implemented by the Kubernetes registries.
+type foreignInstancesReporter interface {
+	ForeignInstances() []kubecontroller.ForeignInstance
+}
+
+// foreignInstanceStatez dumps the Kubernetes services selecting the foreign instances, such as
+// workload entries, and the endpoints built for them. The ip parameter restricts the dump to the
+// instances of an IP.
+func (s *DiscoveryServer) foreignInstanceStatez(w http.ResponseWriter, req *http.Request) {
+	_ = req.ParseForm()
+	ip := req.Form.Get("ip")
+	w.Header().Add("Content-Type", "application/json")
+	states := make([]kubecontroller.ForeignInstance, 0)
+	if sctl, ok := s.Env.ServiceDiscovery.(*aggregate.Controller); ok {
+		for _, r := range sctl.GetRegistries() {
+			if f, ok := r.(foreignInstancesReporter); ok {
+				for _, state := range f.ForeignInstances() {
+					if ip == "" || state.Address == ip {
+						states = append(states, state)
+					}
+				}
+			}
+		}
+	}
+	out, _ := json.MarshalIndent(states, " ", " ")
+	_, _ = w.Write(out)
+}
+
+// endpointPortDiagnoser is implemented by the Kubernetes registries.
+type endpointPortDiagnoser interface {
+	EndpointPortDiagnostics() []kubecontroller.EndpointPortDiagnostic
+}
+
+// endpointPortz dumps the ports of the Endpoints and EndpointSlices of services that the Kubernetes
+// registries left out because the services do not declare them.
+func (s *DiscoveryServer) endpointPortz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	diagnostics := make([]kubecontroller.EndpointPortDiagnostic, 0)
+	if sctl, ok := s.Env.ServiceDiscovery.(*aggregate.Controller); ok {
+		for _, r := range sctl.GetRegistries() {
+			if d, ok := r.(endpointPortDiagnoser); ok {
+				diagnostics = append(diagnostics, d.EndpointPortDiagnostics()...)
+			}
+		}
+	}
+	out, _ := json.MarshalIndent(diagnostics, " ", " ")
+	_, _ = w.Write(out)
+}
+
+// proxyNoInstancesReporter is implemented by the Kubernetes registries.
+type proxyNoInstancesReporter interface {
+	ProxyNoInstances() []kubecontroller.ProxyNoInstances
+}
+
+// proxyNoInstancez dumps the latest proxies for which the Kubernetes registries found no service
+// instances, with the reason, such as a network mismatch or no service selecting the pod.
+func (s *DiscoveryServer) proxyNoInstancez(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	records := make([]kubecontroller.ProxyNoInstances, 0)
+	if sctl, ok := s.Env.ServiceDiscovery.(*aggregate.Controller); ok {
+		for _, r := range sctl.GetRegistries() {
+			if p, ok := r.(proxyNoInstancesReporter); ok {
+				records = append(records, p.ProxyNoInstances()...)
+			}
+		}
+	}
+	out, _ := json.MarshalIndent(records, " ", " ")
+	_, _ = w.Write(out)
+}
+
+// podCacheReporter is implemented by the Kubernetes registries.
+type podCacheReporter interface {
+	PodCacheStatus() kubecontroller.PodCacheStatus
+}
+
+// podCachez dumps the stats of the pod caches of the Kubernetes registries, such as the pods
+// cached by IP and the stale entries, with the pods waiting for their IP, by cluster.
+func (s *DiscoveryServer) podCachez(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	statuses := make([]kubecontroller.PodCacheStatus, 0)
+	if sctl, ok := s.Env.ServiceDiscovery.(*aggregate.Controller); ok {
+		for _, r := range sctl.GetRegistries() {
+			if p, ok := r.(podCacheReporter); ok {
+				statuses = append(statuses, p.PodCacheStatus())
+			}
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Cluster < statuses[j].Cluster })
+	out, _ := json.MarshalIndent(statuses, " ", " ")
+	_, _ = w.Write(out)
+}
+
+// consistencyReporter is implemented by the Kubernetes registries.
+type consistencyReporter interface {
+	ConsistencyReport(ctx context.Context, liveCheck bool) (kubecontroller.ConsistencyReport, error)
+}
+
+// consistencyStatus is the consistency report of a registry, with the error of its live check.
+type consistencyStatus struct {
+	kubecontroller.ConsistencyReport
+	Error string `json:"error,omitempty"`
+}
+
+// consistencyz dumps the discrepancies between the state of the Kubernetes registries and their
+// informer caches. With live=true, the services of the API servers are listed too.
+func (s *DiscoveryServer) consistencyz(w http.ResponseWriter, req *http.Request) {
+	live, _ := strconv.ParseBool(req.URL.Query().Get("live"))
+	w.Header().Add("Content-Type", "application/json")
+	statuses := make([]consistencyStatus, 0)
+	if sctl, ok := s.Env.ServiceDiscovery.(*aggregate.Controller); ok {
+		for _, r := range sctl.GetRegistries() {
+			if c, ok := r.(consistencyReporter); ok {
+				report, err := c.ConsistencyReport(req.Context(), live)
+				status := consistencyStatus{ConsistencyReport: report}
+				if err != nil {
+					status.Error = err.Error()
+				}
+				statuses = append(statuses, status)
+			}
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Cluster < statuses[j].Cluster })
+	out, _ := json.MarshalIndent(statuses, " ", " ")
+	_, _ = w.Write(out)
+}
+
+// registryOptionsReporter is implemented by the Kubernetes registries.
+type registryOptionsReporter interface {
+	Options() kubecontroller.Options
+}
+
+// registryOptionsz dumps the options of the Kubernetes registries, such as their endpoint mode and
+// watched namespaces, by cluster. Secrets bearing options are left out.
+func (s *DiscoveryServer) registryOptionsz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	options := make([]kubecontroller.Options, 0)
+	if sctl, ok := s.Env.ServiceDiscovery.(*aggregate.Controller); ok {
+		for _, r := range sctl.GetRegistries() {
+			if o, ok := r.(registryOptionsReporter); ok {
+				options = append(options, o.Options())
+			}
+		}
+	}
+	sort.Slice(options, func(i, j int) bool { return options[i].ClusterID < options[j].ClusterID })
+	out, _ := json.MarshalIndent(options, " ", " ")
+	_, _ = w.Write(out)
+}
+
+// servicePreviewer is implemented by the Kubernetes registries.
+type servicePreviewer interface {
+	Cluster() string
+	PreviewService(svc *v1.Service) (*model.Service, []kubecontroller.Warning, error)
+}
+
+// servicePreview is the result of the preview of a Kubernetes Service by a registry.
+type servicePreview struct {
+	Cluster  string                   `json:"cluster"`
+	Service  *model.Service           `json:"service,omitempty"`
+	Warnings []kubecontroller.Warning `json:"warnings,omitempty"`
+	Error    string                   `json:"error,omitempty"`
+}
+
+// maxServicePreviewSize bounds the size of the Services accepted by servicePreviewz.
+const maxServicePreviewSize = 1 << 20
+
+// servicePreviewz dumps the services the Kubernetes registries would build from the Kubernetes
+// Service POSTed as YAML or JSON, without applying it. The cluster parameter restricts the preview
+// to the registry of a cluster.
+func (s *DiscoveryServer) servicePreviewz(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_, _ = fmt.Fprintf(w, "POST a Kubernetes Service to preview it")
+		return
+	}
+	_ = req.ParseForm()
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxServicePreviewSize+1))
+	if err == nil && len(body) > maxServicePreviewSize {
+		err = fmt.Errorf("more than %d bytes", maxServicePreviewSize)
+	}
+	svc := &v1.Service{}
+	if err == nil {
+		err = yaml.Unmarshal(body, svc)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprintf(w, "unable to read the service: %v", err)
+		return
+	}
+	if svc.Namespace == "" {
+		svc.Namespace = "default"
+	}
+
+	cluster := req.Form.Get("cluster")
+	previews := make([]servicePreview, 0)
+	if sctl, ok := s.Env.ServiceDiscovery.(*aggregate.Controller); ok {
+		for _, r := range sctl.GetRegistries() {
+			p, ok := r.(servicePreviewer)
+			if !ok || (cluster != "" && p.Cluster() != cluster) {
+				continue
+			}
+			preview := servicePreview{Cluster: p.Cluster()}
+			preview.Service, preview.Warnings, err = p.PreviewService(svc.DeepCopy())
+			if err != nil {
+				preview.Error = err.Error()
+			}
+			previews = append(previews, preview)
+		}
+	}
+	sort.Slice(previews, func(i, j int) bool { return previews[i].Cluster < previews[j].Cluster })
+	w.Header().Add("Content-Type", "application/json")
+	out, _ := json.MarshalIndent(previews, " ", " ")
+	_, _ = w.Write(out)
+}
+
+// serviceEndpointsReporter is implemented by the Kubernetes registries.
+type serviceEndpointsReporter interface {
+	Cluster() string
+	EndpointsForService(hostname host.Name) ([]*model.IstioEndpoint, error)
+}
+
+// serviceEndpoints are the endpoints a registry attributes to a service.
+type serviceEndpoints struct {
+	Cluster   string                 `json:"cluster"`
+	Endpoints []*model.IstioEndpoint `json:"endpoints"`
+	Error     string                 `json:"error,omitempty"`
+}
+
+// serviceEndpointz dumps the endpoints the Kubernetes registries attribute to the service of the
+// hostname parameter, including foreign and ExternalName instances, as last pushed rather than
+// from the XDS cache. The cluster parameter restricts the dump to the registry of a cluster.
+func (s *DiscoveryServer) serviceEndpointz(w http.ResponseWriter, req *http.Request) {
+	_ = req.ParseForm()
+	hostname := req.Form.Get("hostname")
+	if hostname == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprintf(w, "the hostname parameter is required")
+		return
+	}
+	cluster := req.Form.Get("cluster")
+	all := make([]serviceEndpoints, 0)
+	if sctl, ok := s.Env.ServiceDiscovery.(*aggregate.Controller); ok {
+		for _, r := range sctl.GetRegistries() {
+			e, ok := r.(serviceEndpointsReporter)
+			if !ok || (cluster != "" && e.Cluster() != cluster) {
+				continue
+			}
+			endpoints := serviceEndpoints{Cluster: e.Cluster()}
+			var err error
+			endpoints.Endpoints, err = e.EndpointsForService(host.Name(hostname))
+			if err != nil {
+				endpoints.Error = err.Error()
+			}
+			all = append(all, endpoints)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Cluster < all[j].Cluster })
+	w.Header().Add("Content-Type", "application/json")
+	out, _ := json.MarshalIndent(all, " ", " ")
+	_, _ = w.Write(out)
+}
+
 // Dumps info about the endpoint shards, tracked using the new direct interface.
 // Legacy registry provides are synced to the new data structure as well, during
 // the full push.
@@ -234,9 +577,9 @@ func (s *DiscoveryServer) endpointz(w http.ResponseWriter, req *http.Request) {
 					return
 				}
 				for _, svc := range all {
-					_, _ = fmt.Fprintf(w, "%s:%s %s:%d %v %s\n", ss.Hostname,
+					_, _ = fmt.Fprintf(w, "%s:%s %s:%d %v %s %s\n", ss.Hostname,
 						p.Name, svc.Endpoint.Address, svc.Endpoint.EndpointPort, svc.Endpoint.Labels,
-						svc.Endpoint.ServiceAccount)
+						svc.Endpoint.ServiceAccount, svc.Endpoint.NodeName)
 				}
 			}
 		}
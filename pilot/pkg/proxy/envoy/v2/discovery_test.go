@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -29,6 +30,7 @@ import (
 	"istio.io/istio/pkg/test/util/retry"
 
 	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
 )
 
 func createProxies(n int) []*XdsConnection {
@@ -308,3 +310,109 @@ func TestDebounce(t *testing.T) {
 		})
 	}
 }
+
+func TestEDSBatchUpdate(t *testing.T) {
+	s := NewDiscoveryServer(&model.Environment{}, []string{})
+	entries := func(sa string) []model.EDSUpdateEntry {
+		return []model.EDSUpdateEntry{
+			{Hostname: "a.ns.svc.cluster.local", Namespace: "ns", Endpoints: []*model.IstioEndpoint{{Address: "10.0.0.1", ServiceAccount: sa}}},
+			{Hostname: "b.ns.svc.cluster.local", Namespace: "ns", Endpoints: []*model.IstioEndpoint{{Address: "10.0.0.2"}}},
+		}
+	}
+	nextPush := func() *model.PushRequest {
+		t.Helper()
+		select {
+		case req := <-s.pushChannel:
+			select {
+			case extra := <-s.pushChannel:
+				t.Fatalf("expected a single push request, got another one %+v", extra)
+			default:
+			}
+			return req
+		case <-time.After(time.Second):
+			t.Fatal("expected a push request")
+		}
+		return nil
+	}
+
+	if err := s.EDSBatchUpdate("cluster1", entries("sa")); err != nil {
+		t.Fatal(err)
+	}
+	// The services are new, so a full push is needed.
+	if req := nextPush(); !req.Full || len(req.ConfigsUpdated) != 2 {
+		t.Fatalf("expected a full push of both services, got %+v", req)
+	}
+	if len(s.EndpointShardsByService) != 2 {
+		t.Fatalf("expected the shards of both services, got %v", s.EndpointShardsByService)
+	}
+
+	if err := s.EDSBatchUpdate("cluster1", entries("sa")); err != nil {
+		t.Fatal(err)
+	}
+	if req := nextPush(); req.Full || len(req.ConfigsUpdated) != 2 {
+		t.Fatalf("expected an incremental push of both services, got %+v", req)
+	}
+
+	// A change of the service accounts of any service makes the push full.
+	if err := s.EDSBatchUpdate("cluster1", entries("other")); err != nil {
+		t.Fatal(err)
+	}
+	if req := nextPush(); !req.Full {
+		t.Fatalf("expected a full push, got %+v", req)
+	}
+}
+
+func TestClusterLocalEndpointShards(t *testing.T) {
+	s := NewDiscoveryServer(&model.Environment{}, []string{})
+	port := &model.Port{Name: "tcp-port", Port: 8080}
+	endpoints := func(clusterLocal bool, addresses ...string) []*model.IstioEndpoint {
+		var out []*model.IstioEndpoint
+		for _, address := range addresses {
+			out = append(out, &model.IstioEndpoint{
+				Address:         address,
+				EndpointPort:    8080,
+				ServicePortName: port.Name,
+				ClusterLocal:    clusterLocal,
+			})
+		}
+		return out
+	}
+	addresses := func(clusterID, hostname string) []string {
+		t.Helper()
+		proxy := &model.Proxy{Metadata: &model.NodeMetadata{ClusterID: clusterID}}
+		svc := &model.Service{Hostname: host.Name(hostname), Ports: model.PortList{port}}
+		shards := s.EndpointShardsByService[hostname]["ns"]
+		var out []string
+		for _, locality := range buildLocalityLbEndpointsFromShards(proxy, shards, svc, port, nil, "cluster", model.NewPushContext()) {
+			for _, ep := range locality.LbEndpoints {
+				out = append(out, ep.GetEndpoint().Address.GetSocketAddress().Address)
+			}
+		}
+		sort.Strings(out)
+		return out
+	}
+
+	// The derived service of the multi-cluster services API lists the endpoints of the cluster set
+	// in each cluster, its registries declare it cluster-local.
+	derived := "derived-svc1.ns.svc.cluster.local"
+	_ = s.EDSUpdate("cluster1", derived, "ns", endpoints(true, "10.0.0.1", "10.1.0.1"))
+	_ = s.EDSUpdate("cluster2", derived, "ns", endpoints(true, "10.0.0.1", "10.1.0.1"))
+	// The endpoints of an ordinary service are merged across clusters.
+	ordinary := "svc2.ns.svc.cluster.local"
+	_ = s.EDSUpdate("cluster1", ordinary, "ns", endpoints(false, "10.0.0.2"))
+	_ = s.EDSUpdate("cluster2", ordinary, "ns", endpoints(false, "10.1.0.2"))
+
+	want := []string{"10.0.0.1", "10.1.0.1"}
+	for _, cluster := range []string{"cluster1", "cluster2"} {
+		if got := addresses(cluster, derived); !reflect.DeepEqual(got, want) {
+			t.Fatalf("got the endpoints %v of the derived service in %s, want %v, counted once", got, cluster, want)
+		}
+		if got := addresses(cluster, ordinary); !reflect.DeepEqual(got, []string{"10.0.0.2", "10.1.0.2"}) {
+			t.Fatalf("got the endpoints %v of the ordinary service in %s, want those of both clusters", got, cluster)
+		}
+	}
+	// A cluster without the derived service does not merge the cluster-local endpoints of others.
+	if got := addresses("cluster3", derived); len(got) != 0 {
+		t.Fatalf("got the endpoints %v of the derived service in cluster3, want none", got)
+	}
+}
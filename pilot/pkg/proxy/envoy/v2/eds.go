@@ -93,6 +93,17 @@ func buildEnvoyLbEndpoint(e *model.IstioEndpoint, push *model.PushContext) *endp
 	return ep
 }
 
+// hasClusterLocalEndpoint reports whether the registry of the endpoints declared them
+// cluster-local.
+func hasClusterLocalEndpoint(endpoints []*model.IstioEndpoint) bool {
+	for _, ep := range endpoints {
+		if ep.ClusterLocal {
+			return true
+		}
+	}
+	return false
+}
+
 // UpdateServiceShards will list the endpoints and create the shards.
 // This is used to reconcile and to support non-k8s registries (until they migrate).
 // Note that aggregated list is expensive (for large numbers) - we want to replace
@@ -176,6 +187,31 @@ func (s *DiscoveryServer) EDSUpdate(clusterID, serviceName string, namespace str
 	return nil
 }
 
+// EDSBatchUpdate updates the endpoints of all the entries, then triggers one push for all of them.
+// The push is full if any of the updates needs one.
+func (s *DiscoveryServer) EDSBatchUpdate(clusterID string, entries []model.EDSUpdateEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	req := &model.PushRequest{
+		ConfigsUpdated: make(map[model.ConfigKey]struct{}, len(entries)),
+		Reason:         []model.TriggerReason{model.EndpointUpdate},
+	}
+	for _, e := range entries {
+		inboundEDSUpdates.Increment()
+		if s.edsUpdate(clusterID, e.Hostname, e.Namespace, e.Endpoints) {
+			req.Full = true
+		}
+		req.ConfigsUpdated[model.ConfigKey{
+			Kind:      model.ServiceEntryKind,
+			Name:      e.Hostname,
+			Namespace: e.Namespace,
+		}] = struct{}{}
+	}
+	s.ConfigUpdate(req)
+	return nil
+}
+
 // edsUpdate updates EndpointShards data by clusterID, serviceName, IstioEndpoints.
 // It also tracks the changes to ServiceAccounts. It returns whether a full push
 // is needed or incremental push is sufficient.
@@ -547,12 +583,20 @@ func buildLocalityLbEndpointsFromShards(
 
 	shards.mutex.Lock()
 
+	// The registry of the proxy cluster may also declare the service cluster-local, such as the
+	// services derived by the multi-cluster services controllers, whose endpoints already span the
+	// clusters.
+	if !isClusterLocal {
+		isClusterLocal = hasClusterLocalEndpoint(shards.Shards[proxy.Metadata.ClusterID])
+	}
+
 	// The shards are updated independently, now need to filter and merge
 	// for this cluster
 	for clusterID, endpoints := range shards.Shards {
 		// If the downstream service is configured as cluster-local, only include endpoints that
-		// reside in the same cluster.
-		if isClusterLocal && (clusterID != proxy.Metadata.ClusterID) {
+		// reside in the same cluster. The cluster-local endpoints of other registries are not
+		// merged either.
+		if clusterID != proxy.Metadata.ClusterID && (isClusterLocal || hasClusterLocalEndpoint(endpoints)) {
 			continue
 		}
 
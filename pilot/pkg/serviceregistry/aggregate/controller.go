@@ -38,6 +38,20 @@ var (
 var _ model.ServiceDiscovery = &Controller{}
 var _ model.Controller = &Controller{}
 
+// servicesSnapshotter is implemented by registries that can list their services without copying.
+// The returned slice is shared and must not be modified.
+type servicesSnapshotter interface {
+	ServicesSnapshot() []*model.Service
+}
+
+// listServices lists the services of a registry, using its snapshot when it has one.
+func listServices(r serviceregistry.Instance) ([]*model.Service, error) {
+	if s, ok := r.(servicesSnapshotter); ok {
+		return s.ServicesSnapshot(), nil
+	}
+	return r.Services()
+}
+
 // Controller aggregates data across different registries and monitors for changes
 type Controller struct {
 	registries []serviceregistry.Instance
@@ -109,7 +123,7 @@ func (c *Controller) Services() ([]*model.Service, error) {
 	var errs error
 	// Locking Registries list while walking it to prevent inconsistent results
 	for _, r := range c.GetRegistries() {
-		svcs, err := r.Services()
+		svcs, err := listServices(r)
 		if err != nil {
 			errs = multierror.Append(errs, err)
 			continue
@@ -195,6 +209,13 @@ func (c *Controller) GetService(hostname host.Name) (*model.Service, error) {
 				}
 				out.Attributes.ClusterExternalPorts[r.Cluster()] = externalPorts
 			}
+			externalIPs := service.Attributes.ClusterExternalIPs[r.Cluster()]
+			if len(externalIPs) > 0 {
+				if out.Attributes.ClusterExternalIPs == nil {
+					out.Attributes.ClusterExternalIPs = make(map[string][]string)
+				}
+				out.Attributes.ClusterExternalIPs[r.Cluster()] = externalIPs
+			}
 			service.Mutex.RUnlock()
 		}
 	}
@@ -0,0 +1,278 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+	"istio.io/istio/pkg/config/protocol"
+)
+
+// maxExternalNameAliasDepth is the number of ExternalName services an alias may go through before
+// naming a service that is not one.
+const maxExternalNameAliasDepth = 5
+
+const (
+	// ExternalNameAliasCycle is the reason of aliases going back to a service of their chain.
+	ExternalNameAliasCycle = "cycle"
+	// ExternalNameAliasTooDeep is the reason of aliases going through more than
+	// maxExternalNameAliasDepth ExternalName services.
+	ExternalNameAliasTooDeep = "depth"
+)
+
+var externalNameAliasErrors = monitoring.NewSum(
+	"pilot_k8s_external_name_alias_errors",
+	"ExternalName services naming another service of the registry that could not be resolved as aliases.",
+	monitoring.WithLabels(reasonTag),
+)
+
+func init() {
+	monitoring.MustRegister(externalNameAliasErrors)
+}
+
+// externalNameAliasError is why an ExternalName service naming another service of the registry is
+// not resolved as an alias.
+type externalNameAliasError struct {
+	reason string
+	chain  []host.Name
+}
+
+func (e *externalNameAliasError) Error() string {
+	names := make([]string, 0, len(e.chain))
+	for _, hostname := range e.chain {
+		names = append(names, string(hostname))
+	}
+	if e.reason == ExternalNameAliasCycle {
+		return fmt.Sprintf("alias cycle %s", strings.Join(names, " -> "))
+	}
+	return fmt.Sprintf("alias chain %s is longer than %d", strings.Join(names, " -> "), maxExternalNameAliasDepth)
+}
+
+// normalizeExternalName returns the external name of the service as a hostname comparable to the
+// hostnames of the registry.
+func normalizeExternalName(svc *v1.Service) host.Name {
+	return host.Name(strings.TrimSuffix(strings.ToLower(svc.Spec.ExternalName), "."))
+}
+
+// setExternalNameTargetLocked records the external name of the service of the hostname, or
+// forgets it when empty, keeping externalNameAliases in step.
+func (c *Controller) setExternalNameTargetLocked(hostname, target host.Name) {
+	if prev, f := c.externalNameTargets[hostname]; f {
+		delete(c.externalNameAliases[prev], hostname)
+		if len(c.externalNameAliases[prev]) == 0 {
+			delete(c.externalNameAliases, prev)
+		}
+	}
+	if target == "" {
+		delete(c.externalNameTargets, hostname)
+		return
+	}
+	c.externalNameTargets[hostname] = target
+	aliases := c.externalNameAliases[target]
+	if aliases == nil {
+		aliases = make(map[host.Name]struct{})
+		c.externalNameAliases[target] = aliases
+	}
+	aliases[hostname] = struct{}{}
+}
+
+// updateExternalNameTargetLocked records the external name of an added or updated service, and
+// resolves it as an alias. The service of resolved aliases is load balanced on the endpoints of
+// its target, so it is converted like the headless services with the ClientSideLB resolution
+// override: in the mesh, with the ClientSideLB resolution at the unspecified address.
+func (c *Controller) updateExternalNameTargetLocked(svc *v1.Service, svcConv *model.Service) (*model.Service, error) {
+	if svc.Spec.Type != v1.ServiceTypeExternalName || svc.Spec.ExternalName == "" {
+		c.setExternalNameTargetLocked(svcConv.Hostname, "")
+		return nil, nil
+	}
+	c.setExternalNameTargetLocked(svcConv.Hostname, normalizeExternalName(svc))
+	target, _, err := c.resolveExternalNameAliasLocked(svcConv.Hostname)
+	if target != nil {
+		svcConv.Resolution = model.ClientSideLB
+		svcConv.MeshExternal = false
+	}
+	return target, err
+}
+
+// resolveExternalNameAliasLocked follows the external names from the hostname through the
+// services of the registry. It returns the first service that is not an ExternalName service,
+// and the hostnames it went through, or nil if the hostname is not an alias.
+func (c *Controller) resolveExternalNameAliasLocked(hostname host.Name) (*model.Service, []host.Name, error) {
+	chain := []host.Name{hostname}
+	current := hostname
+	for {
+		target, f := c.externalNameTargets[current]
+		if !f {
+			if current == hostname {
+				return nil, nil, nil
+			}
+			return c.servicesMap[current], chain, nil
+		}
+		if _, f := c.servicesMap[target]; !f && target != hostname {
+			// An external host, or a service that does not exist yet.
+			return nil, nil, nil
+		}
+		for _, seen := range chain {
+			if seen == target {
+				return nil, nil, &externalNameAliasError{reason: ExternalNameAliasCycle, chain: append(chain, target)}
+			}
+		}
+		chain = append(chain, target)
+		if len(chain) > maxExternalNameAliasDepth+1 {
+			return nil, nil, &externalNameAliasError{reason: ExternalNameAliasTooDeep, chain: chain}
+		}
+		current = target
+	}
+}
+
+// externalNameAliasTarget returns the service the service is an alias of, or nil if it is not one.
+func (c *Controller) externalNameAliasTarget(svc *model.Service) *model.Service {
+	c.RLock()
+	defer c.RUnlock()
+	if current, f := c.servicesMap[svc.Hostname]; !f || current.Attributes.Namespace != svc.Attributes.Namespace {
+		return nil
+	}
+	target, _, _ := c.resolveExternalNameAliasLocked(svc.Hostname)
+	return target
+}
+
+// aliasInstances returns the instances of the target of an alias for the port of the alias, which
+// is the target port of the same number, as the service of the alias.
+func (c *Controller) aliasInstances(svc *model.Service, svcPort *model.Port, target *model.Service,
+	labelsList labels.Collection) ([]*model.ServiceInstance, error) {
+	instances, err := c.InstancesByPort(target, svcPort.Port, labelsList)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*model.ServiceInstance, 0, len(instances))
+	for _, instance := range instances {
+		endpoint := *instance.Endpoint
+		endpoint.ServicePortName = svcPort.Name
+		out = append(out, &model.ServiceInstance{
+			Service:     svc,
+			ServicePort: svcPort,
+			Endpoint:    &endpoint,
+		})
+	}
+	return out, nil
+}
+
+// updateAliasEDS pushes the endpoints of the target of the alias as its endpoints.
+func (c *Controller) updateAliasEDS(svc *model.Service) {
+	endpoints := make([]*model.IstioEndpoint, 0)
+	for _, port := range svc.Ports {
+		if port.Protocol == protocol.UDP {
+			continue
+		}
+		instances, err := c.InstancesByPort(svc, port.Port, nil)
+		if err != nil {
+			log.Warnf("Handle EDS for alias %s: %v", svc.Hostname, err)
+			return
+		}
+		for _, instance := range instances {
+			endpoints = append(endpoints, instance.Endpoint)
+		}
+	}
+	c.pushEDS(svc.Hostname, svc.Attributes.Namespace, endpoints)
+}
+
+// updateAliasesEDS pushes the endpoints of the aliases going through the hostname, after the
+// endpoints of its service changed. They are found back along the external names naming it.
+func (c *Controller) updateAliasesEDS(hostname host.Name) {
+	var aliases []*model.Service
+	c.RLock()
+	visited := map[host.Name]struct{}{hostname: {}}
+	next := []host.Name{hostname}
+	for len(next) > 0 {
+		current := next[0]
+		next = next[1:]
+		for alias := range c.externalNameAliases[current] {
+			if _, f := visited[alias]; f {
+				continue
+			}
+			visited[alias] = struct{}{}
+			next = append(next, alias)
+			if target, _, _ := c.resolveExternalNameAliasLocked(alias); target == nil {
+				continue
+			}
+			if svc := c.servicesMap[alias]; svc != nil {
+				aliases = append(aliases, svc)
+			}
+		}
+	}
+	c.RUnlock()
+	for _, alias := range aliases {
+		c.updateAliasEDS(alias)
+	}
+}
+
+// refreshExternalNameAliases handles again the ExternalName services naming the hostname after an
+// event of its service, as they may start or stop being aliases. The endpoints of the ones that
+// remain aliases are pushed again, as the ports of the service may have changed.
+func (c *Controller) refreshExternalNameAliases(hostname host.Name) error {
+	var changed []*model.Service
+	var unchanged []*model.Service
+	c.RLock()
+	for alias := range c.externalNameAliases[hostname] {
+		if alias == hostname {
+			continue
+		}
+		svc := c.servicesMap[alias]
+		if svc == nil {
+			continue
+		}
+		resolved, _, _ := c.resolveExternalNameAliasLocked(alias)
+		if (resolved != nil) != (svc.Resolution == model.ClientSideLB) {
+			changed = append(changed, svc)
+		} else if resolved != nil {
+			unchanged = append(unchanged, svc)
+		}
+	}
+	c.RUnlock()
+	for _, svc := range unchanged {
+		c.updateAliasEDS(svc)
+	}
+	for _, svc := range changed {
+		k8sSvc, err := c.serviceLister.Services(svc.Attributes.Namespace).Get(svc.Attributes.Name)
+		if err != nil {
+			log.Debugf("Refresh alias %s: %v", svc.Hostname, err)
+			continue
+		}
+		if err := c.onServiceEvent(k8sSvc, model.EventUpdate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reportExternalNameAliasError records an ExternalName service that could not be resolved as an
+// alias. It keeps the DNS resolution of its external name.
+func (c *Controller) reportExternalNameAliasError(svc *v1.Service, err error) {
+	log.Warnf("ExternalName service %s/%s is not resolved as an alias: %v", svc.Namespace, svc.Name, err)
+	reason := ExternalNameAliasCycle
+	if aliasErr, ok := err.(*externalNameAliasError); ok {
+		reason = aliasErr.reason
+	}
+	externalNameAliasErrors.With(reasonTag.Value(reason)).Increment()
+}
@@ -0,0 +1,187 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+func createAliasService(t *testing.T, controller *Controller, name, namespace, externalName string) {
+	t.Helper()
+	service := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: coreV1.ServiceSpec{
+			Ports:        []coreV1.ServicePort{{Name: "http-alias", Port: 8080, Protocol: "TCP"}},
+			Type:         coreV1.ServiceTypeExternalName,
+			ExternalName: externalName,
+		},
+	}
+	if _, err := controller.client.CoreV1().Services(namespace).Create(context.TODO(), service, metaV1.CreateOptions{}); err != nil {
+		t.Fatalf("Cannot create service %s in namespace %s (error: %v)", name, namespace, err)
+	}
+}
+
+func TestExternalNameAliases(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: mode})
+			defer controller.Stop()
+
+			expectService := func(name string, resolution model.Resolution) *model.Service {
+				t.Helper()
+				var svc *model.Service
+				retry.UntilSuccessOrFail(t, func() error {
+					svc, _ = controller.GetService(kube.ServiceHostname(name, "nsa", domainSuffix))
+					if svc == nil {
+						return fmt.Errorf("service %s not found", name)
+					}
+					if svc.Resolution != resolution {
+						return fmt.Errorf("service %s has resolution %v, want %v", name, svc.Resolution, resolution)
+					}
+					return nil
+				}, retry.Timeout(5*time.Second))
+				return svc
+			}
+			expectAddresses := func(svc *model.Service, want ...string) {
+				t.Helper()
+				retry.UntilSuccessOrFail(t, func() error {
+					instances, err := controller.InstancesByPort(svc, 8080, nil)
+					if err != nil {
+						return err
+					}
+					var got []string
+					for _, si := range instances {
+						if si.Service.Hostname != svc.Hostname || si.Endpoint.ServicePortName != "http-alias" {
+							return fmt.Errorf("instance %s is not mapped to the alias", si.Endpoint.Address)
+						}
+						got = append(got, si.Endpoint.Address)
+					}
+					sort.Strings(got)
+					if fmt.Sprint(got) != fmt.Sprint(want) {
+						return fmt.Errorf("got addresses %v, want %v", got, want)
+					}
+					return nil
+				}, retry.Timeout(5*time.Second))
+			}
+			waitForAliasEDS := func(endpoints int) {
+				t.Helper()
+				hostname := string(kube.ServiceHostname("alias", "nsa", domainSuffix))
+				for {
+					ev := fx.Wait("eds")
+					if ev == nil {
+						t.Fatalf("Timeout waiting for %d endpoints of the alias", endpoints)
+					}
+					if ev.ID == hostname && len(ev.Endpoints) == endpoints {
+						return
+					}
+				}
+			}
+
+			createService(controller, "svc1", "nsa", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+			createEndpoints(controller, "svc1", "nsa", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+
+			// Alias to a ClusterIP service.
+			createAliasService(t, controller, "alias", "nsa", string(kube.ServiceHostname("svc1", "nsa", domainSuffix))+".")
+			alias := expectService("alias", model.ClientSideLB)
+			if alias.MeshExternal {
+				t.Fatal("expected the alias to be in the mesh")
+			}
+			expectAddresses(alias, "128.0.0.1")
+			waitForAliasEDS(1)
+
+			// Endpoints updates of the target refresh the alias.
+			updateEndpoints(controller, "svc1", "nsa", []string{"tcp-port"}, []string{"128.0.0.1", "128.0.0.2"}, t)
+			waitForAliasEDS(2)
+			expectAddresses(alias, "128.0.0.1", "128.0.0.2")
+
+			// The alias stops being one when its target is deleted.
+			if err := controller.client.CoreV1().Services("nsa").Delete(context.TODO(), "svc1", metaV1.DeleteOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			alias = expectService("alias", model.DNSLB)
+			expectAddresses(alias, string(kube.ServiceHostname("svc1", "nsa", domainSuffix))+".")
+
+			// Alias to a missing service.
+			missing := string(kube.ServiceHostname("missing", "nsa", domainSuffix))
+			createAliasService(t, controller, "dangling", "nsa", missing)
+			expectAddresses(expectService("dangling", model.DNSLB), missing)
+
+			// Alias cycle.
+			createAliasService(t, controller, "cycle-a", "nsa", string(kube.ServiceHostname("cycle-b", "nsa", domainSuffix)))
+			expectService("cycle-a", model.DNSLB)
+			createAliasService(t, controller, "cycle-b", "nsa", string(kube.ServiceHostname("cycle-a", "nsa", domainSuffix)))
+			cycleB := expectService("cycle-b", model.DNSLB)
+			expectService("cycle-a", model.DNSLB)
+			controller.RLock()
+			_, _, err := controller.resolveExternalNameAliasLocked(cycleB.Hostname)
+			controller.RUnlock()
+			if aliasErr, ok := err.(*externalNameAliasError); !ok || aliasErr.reason != ExternalNameAliasCycle {
+				t.Fatalf("got error %v, want an alias cycle", err)
+			}
+		})
+	}
+}
+
+func TestExternalNameAliasIndex(t *testing.T) {
+	c := &Controller{
+		externalNameTargets: make(map[host.Name]host.Name),
+		externalNameAliases: make(map[host.Name]map[host.Name]struct{}),
+	}
+	assertAliases := func(want map[host.Name][]host.Name) {
+		t.Helper()
+		got := make(map[host.Name][]host.Name)
+		for target, aliases := range c.externalNameAliases {
+			for alias := range aliases {
+				got[target] = append(got[target], alias)
+			}
+			sort.Slice(got[target], func(i, j int) bool { return got[target][i] < got[target][j] })
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got aliases %v, want %v", got, want)
+		}
+	}
+
+	c.setExternalNameTargetLocked("a", "svc")
+	c.setExternalNameTargetLocked("b", "svc")
+	c.setExternalNameTargetLocked("c", "a")
+	assertAliases(map[host.Name][]host.Name{"svc": {"a", "b"}, "a": {"c"}})
+
+	// Changing the external name moves the alias.
+	c.setExternalNameTargetLocked("b", "a")
+	assertAliases(map[host.Name][]host.Name{"svc": {"a"}, "a": {"b", "c"}})
+
+	c.setExternalNameTargetLocked("a", "")
+	assertAliases(map[host.Name][]host.Name{"a": {"b", "c"}})
+	c.setExternalNameTargetLocked("b", "")
+	c.setExternalNameTargetLocked("c", "")
+	assertAliases(map[host.Name][]host.Name{})
+	if len(c.externalNameTargets) != 0 {
+		t.Fatalf("expected no external names left, got %v", c.externalNameTargets)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sort"
+
+	"istio.io/pkg/log"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+// trackPushedEndpoints records the endpoints of the last EDS update of the service.
+func (c *Controller) trackPushedEndpoints(hostname host.Name, namespace string, endpoints []*model.IstioEndpoint) {
+	c.pushedEDSMutex.Lock()
+	defer c.pushedEDSMutex.Unlock()
+	if len(endpoints) > 0 {
+		c.pushedEDS[hostname] = namespace
+		c.pushedEndpoints[hostname] = endpoints
+	} else {
+		delete(c.pushedEDS, hostname)
+		delete(c.pushedEndpoints, hostname)
+	}
+}
+
+// Cleanup withdraws what the controller pushed to the XDS updater for its cluster: the endpoints
+// of every service are cleared with empty EDS updates, then the services are deleted with
+// SvcUpdate. It is meant for a controller being removed, such as the controller of a remote
+// cluster whose secret is deleted, and should be called once Run returned so that no event
+// pushes them again.
+func (c *Controller) Cleanup() {
+	if c.xdsUpdater == nil {
+		return
+	}
+	c.pushedEDSMutex.Lock()
+	pushed := c.pushedEDS
+	c.pushedEDS = make(map[host.Name]string)
+	c.pushedEndpoints = make(map[host.Name][]*model.IstioEndpoint)
+	c.pushedEDSMutex.Unlock()
+
+	hostnames := make([]host.Name, 0, len(pushed))
+	for hostname := range pushed {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Slice(hostnames, func(i, j int) bool { return hostnames[i] < hostnames[j] })
+	for _, hostname := range hostnames {
+		c.trackLocalEndpoints(hostname, "", "", false)
+		c.endpointMetrics.clear(hostname)
+		// The batcher is bypassed, as a window left open by a controller stopped before it synced
+		// would hold the updates forever. The debouncer drops the pending updates of the service.
+		c.edsDebouncer.update(string(hostname), pushed[hostname], nil)
+	}
+
+	services := c.ServicesSnapshot()
+	for _, svc := range services {
+		c.xdsUpdater.SvcUpdate(c.clusterID, string(svc.Hostname), svc.Attributes.Namespace, model.EventDelete)
+	}
+	log.Infof("Cleaned up the endpoints of %d and the %d services of cluster %s",
+		len(hostnames), len(services), c.clusterID)
+}
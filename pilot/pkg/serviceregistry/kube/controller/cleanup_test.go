@@ -0,0 +1,100 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+)
+
+// callRecorder records the EDS and service updates it is given.
+type callRecorder struct {
+	*FakeXdsUpdater
+	mu    sync.Mutex
+	calls []string
+}
+
+func (r *callRecorder) EDSUpdate(shard, hostname, _ string, endpoints []*model.IstioEndpoint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, fmt.Sprintf("eds %s %s %d", shard, hostname, len(endpoints)))
+	return nil
+}
+
+func (r *callRecorder) SvcUpdate(shard, hostname, _ string, event model.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, fmt.Sprintf("svc %s %s %s", shard, hostname, event))
+}
+
+func TestCleanup(t *testing.T) {
+	controller, fx := newFakeControllerWithOptions(fakeControllerOptions{clusterID: "cluster1"})
+	hostname1 := string(kube.ServiceHostname("svc1", "nsA", domainSuffix))
+	hostname2 := string(kube.ServiceHostname("svc2", "nsA", domainSuffix))
+	hostname3 := string(kube.ServiceHostname("svc3", "nsA", domainSuffix))
+
+	for _, name := range []string{"svc1", "svc2", "svc3"} {
+		createService(controller, name, "nsA", nil, []int32{8080}, map[string]string{"app": name}, t)
+		if ev := fx.Wait("service"); ev == nil {
+			t.Fatal("Timeout creating service")
+		}
+	}
+	for i, ip := range []string{"128.0.0.1", "128.0.0.2"} {
+		pod := generatePod(ip, fmt.Sprintf("pod%d", i+1), "nsA", "", "", map[string]string{"app": fmt.Sprintf("svc%d", i+1)}, nil)
+		addPods(t, controller, pod)
+		if err := waitForPod(controller, ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+	if ev := fx.Wait("eds"); ev == nil || ev.ID != hostname1 {
+		t.Fatalf("expected the endpoints of %s, got %+v", hostname1, ev)
+	}
+	createEndpoints(controller, "svc2", "nsA", []string{"tcp-port"}, []string{"128.0.0.2"}, t)
+	if ev := fx.Wait("eds"); ev == nil || ev.ID != hostname2 {
+		t.Fatalf("expected the endpoints of %s, got %+v", hostname2, ev)
+	}
+
+	controller.Stop()
+	recorder := &callRecorder{FakeXdsUpdater: fx}
+	controller.xdsUpdater = recorder
+	controller.Cleanup()
+
+	// The endpoints are cleared first, then the services are deleted. svc3 never had endpoints.
+	want := []string{
+		"eds cluster1 " + hostname1 + " 0",
+		"eds cluster1 " + hostname2 + " 0",
+		"svc cluster1 " + hostname1 + " " + model.EventDelete.String(),
+		"svc cluster1 " + hostname2 + " " + model.EventDelete.String(),
+		"svc cluster1 " + hostname3 + " " + model.EventDelete.String(),
+	}
+	if !reflect.DeepEqual(recorder.calls, want) {
+		t.Fatalf("got calls %v, want %v", recorder.calls, want)
+	}
+
+	// Nothing is left to clean up.
+	recorder.calls = nil
+	controller.Cleanup()
+	for _, call := range recorder.calls {
+		if call[:3] == "eds" {
+			t.Fatalf("expected no EDS update on a second cleanup, got %v", recorder.calls)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(0, 0)
+	clock := NewFakeClock(start)
+	var calls []string
+	record := func(name string) func() {
+		return func() {
+			calls = append(calls, name)
+		}
+	}
+
+	clock.AfterFunc(3*time.Second, record("3s"))
+	clock.AfterFunc(time.Second, func() {
+		calls = append(calls, "1s")
+		// Scheduled by a call, due within the same step.
+		clock.AfterFunc(time.Second, record("1s+1s"))
+	})
+	stopped := clock.AfterFunc(2*time.Second, record("stopped"))
+	if !stopped.Stop() || stopped.Stop() {
+		t.Fatal("expected only the first Stop to report the call pending")
+	}
+
+	clock.Step(2 * time.Second)
+	if want := []string{"1s", "1s+1s"}; !reflect.DeepEqual(calls, want) {
+		t.Fatalf("got calls %v, want %v", calls, want)
+	}
+	if got := clock.Now(); !got.Equal(start.Add(2 * time.Second)) {
+		t.Fatalf("got time %v, want %v", got, start.Add(2*time.Second))
+	}
+	if got := clock.PendingTimers(); got != 1 {
+		t.Fatalf("got %d pending timers, want 1", got)
+	}
+
+	clock.Step(time.Second)
+	if want := []string{"1s", "1s+1s", "3s"}; !reflect.DeepEqual(calls, want) {
+		t.Fatalf("got calls %v, want %v", calls, want)
+	}
+}
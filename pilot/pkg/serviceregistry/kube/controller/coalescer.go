@@ -0,0 +1,162 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sync"
+
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/pkg/log"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/queue"
+)
+
+// eventCoalescer keeps at most one pending queue task per object of an informer. Events arriving
+// while a task is pending are merged into it, and the task handles the latest state of the object
+// from the informer store, so a burst of updates to an object is handled once.
+type eventCoalescer struct {
+	queue   queue.Instance
+	store   cache.Store
+	handler func(interface{}, model.Event) error
+
+	mu      sync.Mutex
+	pending map[string]*pendingEvent
+}
+
+type pendingEvent struct {
+	event model.Event
+	// obj is the deleted object of a pending delete. Other events read the object from the store.
+	obj interface{}
+	// recreated is set when the object was added again after the pending delete.
+	recreated bool
+	// panics counts the panics of the handler on the event, which is dropped at maxTaskPanics.
+	panics int
+}
+
+func newEventCoalescer(q queue.Instance, store cache.Store, handler func(interface{}, model.Event) error) *eventCoalescer {
+	return &eventCoalescer{
+		queue:   q,
+		store:   store,
+		handler: handler,
+		pending: make(map[string]*pendingEvent),
+	}
+}
+
+// push queues the event, or merges it into the pending event of the object. An add stays an add
+// when followed by updates, and a delete replaces any pending add or update.
+func (e *eventCoalescer) push(obj interface{}, event model.Event) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		log.Errorf("failed to get key of %#v: %v", obj, err)
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if p, f := e.pending[key]; f {
+		switch {
+		case event == model.EventDelete:
+			p.event, p.obj, p.recreated = model.EventDelete, obj, false
+		case p.event == model.EventDelete:
+			p.recreated = true
+		}
+		return
+	}
+	p := &pendingEvent{event: event}
+	if event == model.EventDelete {
+		p.obj = obj
+	}
+	e.pending[key] = p
+	task := func() error {
+		return e.process(key)
+	}
+	if nq, ok := e.queue.(namespacedQueue); ok {
+		namespace, _, _ := cache.SplitMetaNamespaceKey(key)
+		nq.PushNamespaced(namespace, task)
+		return
+	}
+	e.queue.Push(task)
+}
+
+// process handles the pending event of the object. The queue retries it on error, so a failed
+// event is put back to be merged with any newer one.
+func (e *eventCoalescer) process(key string) error {
+	e.mu.Lock()
+	p, f := e.pending[key]
+	delete(e.pending, key)
+	e.mu.Unlock()
+	if !f {
+		// Already handled by an earlier task.
+		return nil
+	}
+
+	if p.event == model.EventDelete {
+		if err := e.call(key, p, p.obj, model.EventDelete); err != nil {
+			return err
+		}
+		if !p.recreated {
+			return nil
+		}
+		p = &pendingEvent{event: model.EventAdd}
+	}
+
+	obj, exists, err := e.store.GetByKey(key)
+	if err != nil || !exists {
+		// The object is gone, and its delete event is on its way.
+		return nil
+	}
+	return e.call(key, p, obj, p.event)
+}
+
+// call runs the handler on the pending event, and puts the event back when the handler fails or
+// panics, for the queue to retry it. The panic goes on to the recoveringQueue, which drops the
+// task at maxTaskPanics, so the event is dropped with it rather than left pending without a task.
+func (e *eventCoalescer) call(key string, p *pendingEvent, obj interface{}, event model.Event) error {
+	returned := false
+	defer func() {
+		if returned {
+			return
+		}
+		if p.panics++; p.panics < maxTaskPanics {
+			e.restore(key, p)
+		}
+	}()
+	err := e.handler(obj, event)
+	returned = true
+	if err != nil {
+		e.restore(key, p)
+	}
+	return err
+}
+
+func (e *eventCoalescer) restore(key string, p *pendingEvent) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	newer, f := e.pending[key]
+	if !f {
+		e.pending[key] = p
+		return
+	}
+	if newer.event == model.EventDelete {
+		return
+	}
+	if p.event == model.EventDelete {
+		newer.event, newer.obj, newer.recreated = model.EventDelete, p.obj, true
+	} else if p.event == model.EventAdd {
+		newer.event = model.EventAdd
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/queue"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+type handledEvent struct {
+	event   model.Event
+	version string
+}
+
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []handledEvent
+	// failures is the number of calls to fail before succeeding.
+	failures int
+}
+
+func (r *eventRecorder) handle(obj interface{}, event model.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failures > 0 {
+		r.failures--
+		return errors.New("not ready")
+	}
+	r.events = append(r.events, handledEvent{event, obj.(*coreV1.Endpoints).ResourceVersion})
+	return nil
+}
+
+func (r *eventRecorder) wait(t *testing.T, want ...handledEvent) {
+	t.Helper()
+	retry.UntilSuccessOrFail(t, func() error {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if fmt.Sprint(r.events) != fmt.Sprint(want) {
+			return fmt.Errorf("got events %v, want %v", r.events, want)
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+}
+
+func endpointsVersion(version string) *coreV1.Endpoints {
+	return &coreV1.Endpoints{ObjectMeta: metaV1.ObjectMeta{Name: "svc", Namespace: "nsA", ResourceVersion: version}}
+}
+
+func TestEventCoalescer(t *testing.T) {
+	cases := []struct {
+		name string
+		// events are pushed in order, with the store updated as an informer would
+		events []model.Event
+		want   []handledEvent
+	}{
+		{
+			name:   "updates collapse into the newest state",
+			events: []model.Event{model.EventUpdate, model.EventUpdate, model.EventUpdate, model.EventUpdate},
+			want:   []handledEvent{{model.EventUpdate, "4"}},
+		},
+		{
+			name:   "add stays an add",
+			events: []model.Event{model.EventAdd, model.EventUpdate, model.EventUpdate},
+			want:   []handledEvent{{model.EventAdd, "3"}},
+		},
+		{
+			name:   "delete wins over updates",
+			events: []model.Event{model.EventAdd, model.EventUpdate, model.EventDelete},
+			want:   []handledEvent{{model.EventDelete, "3"}},
+		},
+		{
+			name:   "recreated after delete",
+			events: []model.Event{model.EventUpdate, model.EventDelete, model.EventAdd, model.EventUpdate},
+			want:   []handledEvent{{model.EventDelete, "2"}, {model.EventAdd, "4"}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := queue.NewQueue(time.Millisecond)
+			store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+			recorder := &eventRecorder{}
+			coalescer := newEventCoalescer(q, store, recorder.handle)
+
+			for i, event := range tc.events {
+				ep := endpointsVersion(fmt.Sprint(i + 1))
+				if event == model.EventDelete {
+					_ = store.Delete(ep)
+				} else {
+					_ = store.Update(ep)
+				}
+				coalescer.push(ep, event)
+			}
+
+			stop := make(chan struct{})
+			defer close(stop)
+			go q.Run(stop)
+			recorder.wait(t, tc.want...)
+		})
+	}
+}
+
+func TestEventCoalescerRetry(t *testing.T) {
+	q := queue.NewQueue(10 * time.Millisecond)
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	recorder := &eventRecorder{failures: 2}
+	coalescer := newEventCoalescer(q, store, recorder.handle)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.Run(stop)
+
+	ep := endpointsVersion("1")
+	_ = store.Add(ep)
+	coalescer.push(ep, model.EventAdd)
+	recorder.wait(t, handledEvent{model.EventAdd, "1"})
+}
@@ -0,0 +1,181 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	klabels "k8s.io/apimachinery/pkg/labels"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/host"
+)
+
+const (
+	// consistencyPageSize is the number of services listed per request by a live check.
+	consistencyPageSize = 500
+	// consistencyMaxPages bounds the requests of a live check, which reports the services beyond
+	// as not checked.
+	consistencyMaxPages = 20
+	// consistencyPagesPerSecond limits the list requests of the live checks of a controller, so
+	// that repeated reports do not load the API server.
+	consistencyPagesPerSecond = 5
+)
+
+// ConsistencyIssueKind is the kind of a discrepancy found by ConsistencyReport.
+type ConsistencyIssueKind string
+
+const (
+	// ServiceNotInRegistry is a service of the informer cache, or of the API server, that is
+	// neither in the registry, nor skipped or rejected. Services whose events are still queued
+	// are reported too.
+	ServiceNotInRegistry ConsistencyIssueKind = "ServiceNotInRegistry"
+	// ServiceNotCached is a service listed from the API server missing from the informer cache.
+	ServiceNotCached ConsistencyIssueKind = "ServiceNotCached"
+	// EndpointsWithoutSource is a service whose local endpoints are pushed while its Endpoints or
+	// EndpointSlices are gone from the informer cache, which reconcileEDS clears.
+	EndpointsWithoutSource ConsistencyIssueKind = "EndpointsWithoutSource"
+	// PodIPWithoutPod is an IP of the pod cache whose pod is gone from the informer cache.
+	PodIPWithoutPod ConsistencyIssueKind = "PodIPWithoutPod"
+)
+
+// ConsistencyIssue is a discrepancy between the state of the controller and its sources.
+type ConsistencyIssue struct {
+	Kind ConsistencyIssueKind `json:"kind"`
+	// Object is the namespace/name of the Kubernetes object, the hostname of the service or the IP
+	// of the pod.
+	Object string `json:"object"`
+	// Detail is the other object involved, such as the endpoints of the service or the pod of the IP.
+	Detail string `json:"detail,omitempty"`
+}
+
+// ConsistencyReport lists the discrepancies between the informer caches, the state the controller
+// derived from them and, with a live check, the services of the API server, for support bundles.
+type ConsistencyReport struct {
+	Cluster string             `json:"cluster"`
+	Issues  []ConsistencyIssue `json:"issues"`
+	// LiveChecked reports whether the services were listed from the API server.
+	LiveChecked bool `json:"liveChecked"`
+	// LiveTruncated reports whether the live check stopped before listing all the services.
+	LiveTruncated bool `json:"liveTruncated,omitempty"`
+}
+
+func (r *ConsistencyReport) add(kind ConsistencyIssueKind, object, detail string) {
+	r.Issues = append(r.Issues, ConsistencyIssue{Kind: kind, Object: object, Detail: detail})
+}
+
+// ConsistencyReport compares the state of the controller with the informer caches and, when
+// liveCheck is set, lists the services of the API server to compare them with the cache and the
+// registry. The live check is paged, bounded and rate limited. The report of the caches is
+// returned with the error of a failed live check.
+func (c *Controller) ConsistencyReport(ctx context.Context, liveCheck bool) (ConsistencyReport, error) {
+	report := ConsistencyReport{Cluster: c.clusterID, Issues: make([]ConsistencyIssue, 0)}
+
+	services, err := c.serviceLister.List(klabels.Everything())
+	if err != nil {
+		return report, err
+	}
+	for _, svc := range services {
+		c.checkServiceInRegistry(svc, &report)
+	}
+
+	c.localEDSMutex.Lock()
+	refs := make(map[host.Name]serviceRef, len(c.localEDSServices))
+	for hostname, ref := range c.localEDSServices {
+		refs[hostname] = ref
+	}
+	c.localEDSMutex.Unlock()
+	for hostname, ref := range refs {
+		if c.endpointsController().isOrphaned(ref.name, ref.namespace) {
+			report.add(EndpointsWithoutSource, string(hostname), kube.KeyFunc(ref.name, ref.namespace))
+		}
+	}
+
+	for ip, key := range c.pods.staleIPs() {
+		report.add(PodIPWithoutPod, ip, key)
+	}
+
+	if liveCheck {
+		err = c.checkLiveServices(ctx, &report)
+	}
+	sort.Slice(report.Issues, func(i, j int) bool {
+		if report.Issues[i].Kind != report.Issues[j].Kind {
+			return report.Issues[i].Kind < report.Issues[j].Kind
+		}
+		return report.Issues[i].Object < report.Issues[j].Object
+	})
+	return report, err
+}
+
+// checkServiceInRegistry reports the service if it is missing from the registry, while neither
+// skipped, rejected nor converted on demand.
+func (c *Controller) checkServiceInRegistry(svc *v1.Service, report *ConsistencyReport) {
+	hostname := c.serviceHostname(svc.Name, svc.Namespace)
+	c.RLock()
+	_, known := c.servicesMap[hostname]
+	_, skipped := c.skippedServices[hostname]
+	_, rejected := c.rejectedServices[hostname]
+	_, pending := c.pendingConversions[hostname]
+	c.RUnlock()
+	if !known && !skipped && !rejected && !pending {
+		report.add(ServiceNotInRegistry, kube.KeyFunc(svc.Name, svc.Namespace), string(hostname))
+	}
+}
+
+// checkLiveServices lists the services of the watched namespaces from the API server, reporting
+// those missing from the informer cache, or from the registry.
+func (c *Controller) checkLiveServices(ctx context.Context, report *ConsistencyReport) error {
+	if c.client == nil {
+		return errors.New("the live check requires a Kubernetes client")
+	}
+	report.LiveChecked = true
+	pages := 0
+	for _, namespace := range strings.Split(c.options.WatchedNamespaces, ",") {
+		opts := metav1.ListOptions{Limit: consistencyPageSize}
+		for {
+			if pages == consistencyMaxPages {
+				report.LiveTruncated = true
+				return nil
+			}
+			if err := c.consistencyLimiter.Wait(ctx); err != nil {
+				return err
+			}
+			list, err := c.client.CoreV1().Services(namespace).List(ctx, opts)
+			if err != nil {
+				return err
+			}
+			pages++
+			for i := range list.Items {
+				svc := &list.Items[i]
+				// The services of the cache were compared with the registry already.
+				if _, err := c.serviceLister.Services(svc.Namespace).Get(svc.Name); err == nil {
+					continue
+				}
+				report.add(ServiceNotCached, kube.KeyFunc(svc.Name, svc.Namespace), "")
+				c.checkServiceInRegistry(svc, report)
+			}
+			if list.Continue == "" {
+				break
+			}
+			opts.Continue = list.Continue
+		}
+	}
+	return nil
+}
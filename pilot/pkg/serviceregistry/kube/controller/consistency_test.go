@@ -0,0 +1,115 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+)
+
+func TestConsistencyReport(t *testing.T) {
+	controller, _ := newFakeHarness(t, Options{ClusterID: "cluster1"})
+	defer controller.Stop()
+
+	selector := map[string]string{"app": "a"}
+	pod := generatePod("128.0.0.1", "pod1", "nsA", "", "", selector, nil)
+	addPodsSync(t, controller, pod)
+	for _, name := range []string{"svc1", "svc2"} {
+		name := name
+		do(t, controller, func() {
+			createService(controller.Controller, name, "nsA", nil, []int32{8080}, selector, t)
+		})
+		do(t, controller, func() {
+			createEndpoints(controller.Controller, name, "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+		})
+	}
+
+	report, err := controller.ConsistencyReport(context.TODO(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 0 || !report.LiveChecked {
+		t.Fatalf("expected a live checked report without issues, got %+v", report)
+	}
+
+	// Seed inconsistencies by changing the informer caches without handling the events.
+	svc2, err := controller.Client.CoreV1().Services("nsA").Get(context.TODO(), "svc2", metaV1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.serviceInformer.GetStore().Delete(svc2); err != nil {
+		t.Fatal(err)
+	}
+	svc3 := svc2.DeepCopy()
+	svc3.Name = "svc3"
+	if err := controller.serviceInformer.GetStore().Add(svc3); err != nil {
+		t.Fatal(err)
+	}
+	endpointsStore := controller.endpoints.(*endpointsController).informer.GetStore()
+	ep, _, _ := endpointsStore.GetByKey(kube.KeyFunc("svc1", "nsA"))
+	if err := endpointsStore.Delete(ep); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.pods.informer.GetStore().Delete(pod); err != nil {
+		t.Fatal(err)
+	}
+
+	cached := []ConsistencyIssue{
+		{Kind: EndpointsWithoutSource, Object: string(kube.ServiceHostname("svc1", "nsA", domainSuffix)), Detail: "nsA/svc1"},
+		{Kind: PodIPWithoutPod, Object: "128.0.0.1", Detail: "nsA/pod1"},
+		{Kind: ServiceNotInRegistry, Object: "nsA/svc3", Detail: string(kube.ServiceHostname("svc3", "nsA", domainSuffix))},
+	}
+	report, err = controller.ConsistencyReport(context.TODO(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Issues, cached) || report.LiveChecked {
+		t.Fatalf("got report %+v, want issues %+v", report, cached)
+	}
+
+	// Only the live check finds the services missing from the cache.
+	report, err = controller.ConsistencyReport(context.TODO(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live := []ConsistencyIssue{cached[0], cached[1], {Kind: ServiceNotCached, Object: "nsA/svc2"}, cached[2]}
+	if !reflect.DeepEqual(report.Issues, live) || !report.LiveChecked || report.LiveTruncated {
+		t.Fatalf("got report %+v, want issues %+v", report, live)
+	}
+}
+
+func TestConsistencyReportLiveCheckCanceled(t *testing.T) {
+	controller, _ := newFakeHarness(t, Options{})
+	defer controller.Stop()
+	do(t, controller, func() {
+		createService(controller.Controller, "svc1", "nsA", nil, []int32{8080}, nil, t)
+	})
+
+	// A canceled live check fails waiting for the rate limiter, with the report of the caches.
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	report, err := controller.ConsistencyReport(ctx, true)
+	if err == nil {
+		t.Fatal("expected the canceled live check to fail")
+	}
+	if len(report.Issues) != 0 {
+		t.Fatalf("expected the report of the caches, got %+v", report.Issues)
+	}
+}
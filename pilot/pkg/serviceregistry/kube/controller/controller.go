@@ -16,17 +16,19 @@ package controller
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/yl2chen/cidranger"
+	"golang.org/x/time/rate"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -41,6 +43,7 @@ import (
 	"k8s.io/client-go/metadata"
 	"k8s.io/client-go/metadata/metadatainformer"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 
 	"istio.io/pkg/log"
 	"istio.io/pkg/monitoring"
@@ -78,62 +81,263 @@ const (
 	PrometheusPath = "prometheus.io/path"
 	// PrometheusPathDefault is the default value for the PrometheusPath annotation
 	PrometheusPathDefault = "/metrics"
+	// DefaultNodeLabelPrefix is prepended to node labels copied onto endpoints when no prefix is configured
+	DefaultNodeLabelPrefix = "node."
+	// DefaultProxyContainerName is the name of the injected sidecar container
+	DefaultProxyContainerName = "istio-proxy"
 )
 
+// DefaultControlPlaneServices are the services of the system namespace backed by istiod.
+var DefaultControlPlaneServices = []string{"istiod", "istio-pilot"}
+
 var (
 	typeTag  = monitoring.MustCreateLabel("type")
 	eventTag = monitoring.MustCreateLabel("event")
 
 	k8sEvents = monitoring.NewSum(
 		"pilot_k8s_reg_events",
-		"Events from k8s registry.",
-		monitoring.WithLabels(typeTag, eventTag),
+		"Events from k8s registry. Labeled by namespace with Options.EventNamespaceMetrics.",
+		monitoring.WithLabels(typeTag, eventTag, namespaceTag),
 	)
 
 	endpointsWithNoPods = monitoring.NewSum(
 		"pilot_k8s_endpoints_with_no_pods",
 		"Endpoints that does not have any corresponding pods.")
+
+	invalidExternalAddresses = monitoring.NewSum(
+		"pilot_k8s_invalid_external_addresses",
+		"Entries of the external addresses annotation of gateway services that are neither IPs nor hostnames.")
 )
 
 func init() {
 	monitoring.MustRegister(k8sEvents)
 	monitoring.MustRegister(endpointsWithNoPods)
+	monitoring.MustRegister(invalidExternalAddresses)
 }
 
-func incrementEvent(kind, event string) {
+// incrementEvent counts an event of the kind, labeled with its namespace unless empty.
+func incrementEvent(kind, event, namespace string) {
+	if namespace != "" {
+		k8sEvents.With(typeTag.Value(kind), eventTag.Value(event), namespaceTag.Value(namespace)).Increment()
+		return
+	}
 	k8sEvents.With(typeTag.Value(kind), eventTag.Value(event)).Increment()
 }
 
 // Options stores the configurable attributes of a Controller.
 type Options struct {
-	// Namespace the controller watches. If set to meta_v1.NamespaceAll (""), controller watches all namespaces
+	// Namespace the controller watches. If set to meta_v1.NamespaceAll (""), controller watches all namespaces.
+	// A comma separated list watches several namespaces, see normalizeWatchedNamespaces.
 	WatchedNamespaces string
 	ResyncPeriod      time.Duration
 	DomainSuffix      string
 
+	// ResyncJitter spreads the resync periods of the informers of services, endpoints, pods,
+	// ReplicaSets, nodes and namespaces within ±ResyncJitter of ResyncPeriod, so that their resyncs
+	// do not align into periodic spikes of events and pushes, see newResyncPeriods. Defaults to
+	// DefaultResyncJitter, a negative value disables the jitter.
+	ResyncJitter float64
+
+	// ResyncPeriods is set by Controller.Options to the effective resync period of the informers
+	// of each resource type, for diagnostics. It is ignored by NewController.
+	ResyncPeriods map[string]time.Duration
+
+	// NamespaceDomainSuffixes maps namespaces to the domain suffix of the hostnames of their
+	// services, overriding DomainSuffix. A key ending with "*" matches the namespaces starting with
+	// the rest of the key. An exact namespace takes precedence, then the longest prefix.
+	NamespaceDomainSuffixes map[string]string
+
 	// ClusterID identifies the remote cluster in a multicluster env.
 	ClusterID string
 
 	// FetchCaRoot defines the function to get caRoot
-	FetchCaRoot func() map[string]string
+	FetchCaRoot func() map[string]string `json:"-"`
 
 	// Metrics for capturing node-based metrics.
-	Metrics model.Metrics
+	Metrics model.Metrics `json:"-"`
 
 	// XDSUpdater will push changes to the xDS server.
-	XDSUpdater model.XDSUpdater
+	XDSUpdater model.XDSUpdater `json:"-"`
 
 	// TrustDomain used in SPIFFE identity
 	TrustDomain string
 
 	// NetworksWatcher observes changes to the mesh networks config.
-	NetworksWatcher mesh.NetworksWatcher
+	NetworksWatcher mesh.NetworksWatcher `json:"-"`
 
 	// EndpointMode decides what source to use to get endpoint information
 	EndpointMode EndpointMode
 
 	//CABundlePath defines the caBundle path for istiod Server
 	CABundlePath string
+
+	// ClusterLocalHostnames lists the hostnames, optionally with a leading wildcard such as
+	// "*.kube-system.svc.cluster.local", of services whose endpoints must never be merged with
+	// endpoints from other clusters.
+	ClusterLocalHostnames []string
+
+	// MeshWatcher observes changes to the mesh config. Hosts marked cluster-local in the mesh
+	// service settings are treated the same as ClusterLocalHostnames.
+	MeshWatcher mesh.Watcher `json:"-"`
+
+	// NodeLabelsToCopy lists node labels whose values are copied onto the endpoints of pods
+	// scheduled on the node, for example a node pool or instance type label.
+	NodeLabelsToCopy []string
+
+	// NodeLabelPrefix is prepended to the copied node label keys so they do not collide with pod
+	// labels. Defaults to DefaultNodeLabelPrefix.
+	NodeLabelPrefix string
+
+	// EDSUpdateMinInterval is the minimum time between two EDS updates of the same service. Updates
+	// within the interval are coalesced into one carrying the latest endpoints. Zero disables it.
+	EDSUpdateMinInterval time.Duration
+
+	// ProxyContainerName is the name of the sidecar container whose readiness is tracked.
+	// Defaults to DefaultProxyContainerName.
+	ProxyContainerName string
+
+	// ExcludeProxyUnreadyEndpoints drops the endpoints of pods whose proxy container is not ready,
+	// the same way addresses Kubernetes reports as not ready are dropped.
+	ExcludeProxyUnreadyEndpoints bool
+
+	// UIDIncludesClusterID appends the cluster ID to the workload UIDs of endpoints, so that pods
+	// with the same name and namespace in different clusters can be told apart. See ParseUID.
+	UIDIncludesClusterID bool
+
+	// StrictPermissionCheck makes NewControllerWithValidation fail when the controller is not
+	// allowed to list and watch the resources it needs.
+	StrictPermissionCheck bool
+
+	// ServiceEndpointMetrics records the endpoint counts of each service, labeled by hostname, on
+	// top of the counts of each namespace. It adds a time series per service.
+	ServiceEndpointMetrics bool
+
+	// LegacyNodeSelectorParsing makes an invalid NodeSelectorAnnotation select every node, as it
+	// used to, instead of none. It is meant for the migration of gateways with invalid annotations.
+	LegacyNodeSelectorParsing bool
+
+	// TruncateLongHostnames shortens the name of the services whose hostname is longer than the 253
+	// characters of a DNS name, ending it with a hash of the name, instead of rejecting them. It
+	// also applies to the hostnames of their endpoints.
+	TruncateLongHostnames bool
+
+	// WriteLockHoldThreshold instruments the lock of the controller: the time its write lock is
+	// held is recorded, and holds longer than the threshold are logged with the function releasing
+	// it. It is meant for development, zero disables it.
+	WriteLockHoldThreshold time.Duration
+
+	// PermissiveEndpointPorts builds endpoints for every port of the Endpoints and EndpointSlices
+	// of a service, as it used to. By default, the ports the service does not declare are left
+	// out, as no cluster uses their endpoints, and reported by EndpointPortDiagnostics.
+	PermissiveEndpointPorts bool
+
+	// MaxEndpointsPerService bounds the endpoint addresses pushed for a service, protecting the
+	// proxies from services selecting far more pods than intended. The addresses kept are the first
+	// ones in sorted order. Zero means no limit.
+	MaxEndpointsPerService int
+
+	// EndpointLimitEvents creates a warning event on the services whose endpoints start being
+	// truncated to MaxEndpointsPerService.
+	EndpointLimitEvents bool
+
+	// MaxGatewayAddresses bounds the external addresses of a node port gateway service, which
+	// are pushed to every remote cluster, protecting them from a node selector matching far more
+	// nodes than intended. The addresses kept are the first ones, in sorted order for the addresses
+	// of the nodes. Zero means DefaultMaxGatewayAddresses, a negative value means no limit.
+	MaxGatewayAddresses int
+
+	// Clock is the source of time of the controller, the system clock by default. See
+	// NewFakeController for tests.
+	Clock Clock `json:"-"`
+
+	// EventNamespaceMetrics labels the event metrics of namespaced objects with their namespace.
+	// It is off by default, as the number of namespaces of a cluster is unbounded.
+	EventNamespaceMetrics bool
+
+	// FairQueueing handles the events of each namespace in turn, so that a namespace with many
+	// events cannot delay the events of the others. Events are then only handled in order within
+	// a namespace.
+	FairQueueing bool
+
+	// SystemNamespace is the namespace of the control plane. Defaults to IstioNamespace.
+	SystemNamespace string
+
+	// ControlPlaneServices names the services of SystemNamespace whose endpoints are the control
+	// plane itself. They are flagged as such and not reported to instance handlers, while still
+	// being pushed so the services resolve. Defaults to DefaultControlPlaneServices.
+	ControlPlaneServices []string
+
+	// ServiceFilterFunc returns true for the services to skip, such as those of namespaces known to
+	// never be consumed. Skipped services and their endpoints are handled as if deleted. When set,
+	// namespaces are watched and the services of a namespace are evaluated again when its labels or
+	// annotations change.
+	ServiceFilterFunc func(*v1.Service) bool `json:"-"`
+
+	// DropForeignPodOverlaps drops the foreign instances, such as workload entries, at the IP of a
+	// pod of the cluster on the same network, so that the workload is not counted twice. The
+	// foreign instances of another network are kept. The endpoints of the pods of other clusters
+	// are not deduplicated: overlapping pod CIDRs of multi-primary meshes are told apart by the
+	// network, and the cluster ID, of the endpoints. Overlaps on the same network are counted by
+	// the pilot_k8s_foreign_pod_overlaps metric either way.
+	DropForeignPodOverlaps bool
+
+	// MCSMode decides how the services derived from a ServiceImport of the multi-cluster services
+	// API, recognized by MCSServiceNameLabel, are handled. Trusting their slices requires the
+	// EndpointSliceOnly mode, as the MCS controllers only manage endpoint slices.
+	MCSMode MCSMode
+
+	// ServiceProxyNames are the values of ServiceProxyNameLabel of the services to still model.
+	// Services with the label are handled by another proxy implementation, and ignored by
+	// kube-proxy: unless their value is listed, they are skipped like filtered out services.
+	ServiceProxyNames []string
+
+	// ReservedProxyPorts are the ports the sidecar listens on. The ports of endpoints of pods with a
+	// sidecar colliding with them are reported with the ReservedProxyPort reason by
+	// EndpointPortDiagnostics, and counted by the pilot_k8s_reserved_proxy_port_endpoints metric.
+	// Defaults to DefaultReservedProxyPorts, an empty list disables the check.
+	ReservedProxyPorts []int32
+
+	// ExcludeReservedProxyPorts leaves out the endpoints of the ports colliding with
+	// ReservedProxyPorts, rather than only reporting them.
+	ExcludeReservedProxyPorts bool
+
+	// ExternalEndpointSliceManagers are values of the endpointslice.kubernetes.io/managed-by label
+	// of EndpointSlices written by other controllers than Kubernetes, such as a controller writing
+	// the endpoints of externally discovered backends into services without selectors. In the
+	// EndpointsOnly mode, the endpoints of their slices are added to those of the Endpoints of the
+	// services, the Endpoints winning for the same address and port. The EndpointSliceOnly mode
+	// reads the slices of all managers anyway.
+	ExternalEndpointSliceManagers []string
+
+	// LocalityOrder is the order in which the locality of pods without an istio-locality label is
+	// looked up, the first source with a region, zone or subzone label wins. Defaults to
+	// DefaultLocalityOrder, the labels of the pod before the labels of its node; an empty list
+	// only honors the istio-locality label.
+	LocalityOrder []LocalitySource
+
+	// AllowedEndpointCIDRs restricts the addresses of the endpoints, of pods and of the workloads of
+	// other registries, to the listed CIDRs, such as the pod CIDR of the cluster and the approved VM
+	// ranges. DeniedEndpointCIDRs drops the addresses of the listed CIDRs. The most specific CIDR
+	// containing an address decides, a CIDR both allowed and denied is denied. The dropped addresses
+	// are reported by RejectedEndpoints and counted by the pilot_k8s_rejected_endpoint_addresses
+	// metric. Empty lists allow every address.
+	AllowedEndpointCIDRs []string
+	DeniedEndpointCIDRs  []string
+
+	// HonorWorkloadIdentityAnnotation builds the endpoints of pods with the SPIFFE ID of their
+	// WorkloadIdentityAnnotation, rather than the identity derived from their service account.
+	// Anyone able to annotate pods chooses the identity authorization policies see, so only enable
+	// it when the annotation is controlled by the platform. IDs outside of TrustDomain are ignored.
+	HonorWorkloadIdentityAnnotation bool
+
+	// CrossNamespaceEndpointNamespaces lists the namespaces whose Endpoints and EndpointSlices may
+	// reference pods of other namespaces, giving their proxies the instances of the services, and
+	// so the inbound listeners, of the listed namespace. Anyone able to write the endpoints of a
+	// listed namespace can then make the proxies of every namespace serve its services, so only
+	// list namespaces controlled by the platform; "*" lists every namespace. By default, proxies
+	// only get the instances of the services of their own namespace. The endpoints themselves are
+	// pushed to the clients of the services either way.
+	CrossNamespaceEndpointNamespaces []string
 }
 
 // EndpointMode decides what source to use to get endpoint information
@@ -160,8 +364,21 @@ func (m EndpointMode) String() string {
 	return EndpointModeNames[m]
 }
 
+// MarshalText renders the mode by name in the debug dumps.
+func (m EndpointMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
 var _ serviceregistry.Instance = &Controller{}
 
+// nodeHandler is a handler registered through AppendNodeHandler, with the addresses it was last
+// called with.
+type nodeHandler struct {
+	selector  nodeSelector
+	handler   func(addresses []string)
+	addresses []string
+}
+
 // kubernetesNode represents a kubernetes node that is reachable externally
 type kubernetesNode struct {
 	address string
@@ -173,10 +390,34 @@ type kubernetesNode struct {
 type Controller struct {
 	client          kubernetes.Interface
 	metadataClient  metadata.Interface
+	nodeLookup      *nodeLookup
+	edsDebouncer    *edsDebouncer
+	edsBatcher      *edsBatcher
+	endpointMetrics *endpointMetrics
+	ipFamilies      *serviceIPFamilies
+	// eventBroadcaster records the events of eventRecorder, see recordServiceWarning. Both are nil
+	// without client.
+	eventBroadcaster record.EventBroadcaster
+	eventRecorder    record.EventRecorder
+	// serviceAccounts are the service accounts of the endpoints of each service.
+	serviceAccounts *serviceAccounts
+	// hostnames maps the hostnames of the services to their Kubernetes Service and back.
+	hostnames       *hostnameIndex
 	queue           queue.Instance
+	clock           Clock
 	serviceInformer cache.SharedIndexInformer
 	serviceLister   listerv1.ServiceLister
-	endpoints       kubeEndpointsController
+
+	// endpointsMutex protects the source of the endpoints, which SetEndpointMode replaces, and
+	// runStop, the stop channel of Run once running. endpoints is read through
+	// endpointsController. endpointModeSwitchMutex serializes the switches.
+	endpointsMutex          sync.RWMutex
+	endpoints               kubeEndpointsController
+	runStop                 <-chan struct{}
+	endpointModeSwitchMutex sync.Mutex
+	// endpointsDispatchers are the handlers added to the injected endpoints informers, see
+	// registerEndpointsHandlers. They are only used by the constructor and SetEndpointMode.
+	endpointsDispatchers map[cache.SharedIndexInformer]*endpointsDispatcher
 
 	// For k8s >=1.15
 	nodeMetadataInformer cache.SharedIndexInformer
@@ -189,112 +430,361 @@ type Controller struct {
 	pods                 *PodCache
 	metrics              model.Metrics
 	networksWatcher      mesh.NetworksWatcher
+	meshWatcher          mesh.Watcher
 	xdsUpdater           model.XDSUpdater
-	domainSuffix         string
+	domainSuffixes       *namespaceDomainSuffixes
 	clusterID            string
+	// options are the options the controller was built with, see Options.
+	options Options
+
+	// namespaceInformer is only used with a service filter, to evaluate services again when their
+	// namespace changes.
+	namespaceInformer cache.SharedIndexInformer
+	// systemNamespaceInformer watches the system namespace for its network label.
+	systemNamespaceInformer cache.SharedIndexInformer
 
 	serviceHandlers  []func(*model.Service, model.Event)
 	instanceHandlers []func(*model.ServiceInstance, model.Event)
 
+	// nodeHandlersMutex serializes the node handlers, which may be registered while node events
+	// are being handled.
+	nodeHandlersMutex sync.Mutex
+	nodeHandlers      []*nodeHandler
+
+	// endpointOptions decide how the endpoints are built.
+	endpointOptions endpointOptions
+	// rejectedIdentities stores the workload identity last rejected for each pod.
+	rejectedIdentitiesMutex sync.Mutex
+	rejectedIdentities      map[string]string
+
+	// consistencyLimiter limits the API requests of the live checks of ConsistencyReport.
+	consistencyLimiter *rate.Limiter
+
+	// targetPortConflictsMutex protects targetPortConflicts, the protocol conflicts between
+	// services already reported, see reportTargetPortConflict.
+	targetPortConflictsMutex sync.Mutex
+	targetPortConflicts      map[string]struct{}
+
+	// localityBackfill tracks the services whose endpoints were built without the locality of
+	// their pods.
+	localityBackfill *localityBackfill
+
+	// gatewayHandlersMutex serializes the gateway handlers, and protects gatewayAddresses, the
+	// external addresses last delivered to them for each gateway service.
+	gatewayHandlersMutex sync.Mutex
+	gatewayHandlers      []func(hostname host.Name, addresses []string)
+	gatewayAddresses     map[host.Name][]string
+
+	// localEDSMutex protects localEDSServices, which maps the hostnames whose last EDS update had
+	// local endpoints to their service, so reconcileEDS can find pushes left without objects.
+	localEDSMutex    sync.Mutex
+	localEDSServices map[host.Name]serviceRef
+	// resyncPeriods are the jittered resync periods of the informers, see informerResyncPeriod.
+	resyncPeriods map[string]time.Duration
+
+	// pushedEDSMutex protects pushedEDS, which maps the hostnames whose last EDS update had
+	// endpoints, local or foreign, to their namespace, so Cleanup can clear them, and
+	// pushedEndpoints, which holds these endpoints for EndpointsForService.
+	pushedEDSMutex  sync.Mutex
+	pushedEDS       map[host.Name]string
+	pushedEndpoints map[host.Name][]*model.IstioEndpoint
+
+	// synced is closed once the initial state of the informers has been handled, see Synced.
+	synced chan struct{}
+	// terminated is closed when Run returns.
+	terminated chan struct{}
+
 	// This is only used for test
 	stop chan struct{}
 
-	sync.RWMutex
+	// The write lock hold times are recorded when Options.WriteLockHoldThreshold is set.
+	timedRWMutex
 	// servicesMap stores hostname ==> service, it is used to reduce convertService calls.
 	servicesMap map[host.Name]*model.Service
-	// nodeSelectorsForServices stores hostname => label selectors that can be used to
-	// refine the set of node port IPs for a service.
-	nodeSelectorsForServices map[host.Name]labels.Instance
+	// serviceVersions and endpointsVersions store hostname ==> version of the Service and of the
+	// endpoints the entry of servicesMap was last built from, see GetServiceVersion.
+	serviceVersions   map[host.Name]objectVersion
+	endpointsVersions map[host.Name]objectVersion
+	// servicesVersion is bumped on every change to servicesMap.
+	servicesVersion uint64
+	// servicesSnapshot is the sorted content of servicesMap at servicesSnapshotVersion.
+	servicesSnapshot        []*model.Service
+	servicesSnapshotVersion uint64
+	// gateways are the node port gateway services, guarded by the controller lock.
+	gateways nodePortGateways
+	// invalidPortConfigs stores hostname => value of the port config annotation of the services
+	// whose annotation has invalid entries, so that they are reported once per value.
+	invalidPortConfigs map[host.Name]string
+	// serviceOptions decide which services are modeled, and how.
+	serviceOptions serviceOptions
+	// skippedServices stores the hostnames of the services filtered out, see isFilteredOut.
+	skippedServices map[host.Name]struct{}
+	// pendingConversions stores the hostnames of the services converted on demand for a proxy, whose
+	// handling is queued.
+	pendingConversions map[host.Name]struct{}
+	// skippedEndpoints stores the hostnames whose endpoints events were skipped, or whose
+	// endpoints were cleared with their service, while the service was not in servicesMap. Their
+	// endpoints are built when the service is added, see takeSkippedEndpoints.
+	skippedEndpoints map[host.Name]struct{}
+	// prometheusScrapes stores hostname => Prometheus scrape settings of the services annotated
+	// with them, which label the endpoints of their pods without their own.
+	prometheusScrapes map[host.Name]*prometheusScrape
+	// rejectedServices stores hostname => reason of services left out of servicesMap because they
+	// failed validateConvertedService.
+	rejectedServices map[host.Name]*ServiceRejectedError
+	// foreignDiagnostics records why lookups of foreign instances found none.
+	foreignDiagnostics *foreignDiagnostics
+	// recentProxyNoInstances records the latest proxies whose service instances lookup found none.
+	recentProxyNoInstances *recentProxyNoInstances
+	// proxyNegativeCache caches the lookups of proxies without pod that found no service instance.
+	proxyNegativeCache *proxyNegativeCache
+	// endpointPortDiagnostics records the ports of endpoints left out as unknown to their service,
+	// or colliding with the ports of the sidecar.
+	endpointPortDiagnostics *endpointPortDiagnostics
+	// endpointCIDRs restricts the addresses of the endpoints, the addresses it drops are recorded
+	// in rejectedEndpoints.
+	endpointCIDRs     *endpointCIDRs
+	rejectedEndpoints *rejectedEndpoints
+	// endpointLimiter truncates the endpoints of services to Options.MaxEndpointsPerService.
+	endpointLimiter *endpointLimiter
+	// gatewayAddressLimiter truncates the addresses of gateways to Options.MaxGatewayAddresses.
+	gatewayAddressLimiter *gatewayAddressLimiter
+	// selectors caches the compiled label selectors of the services.
+	selectors *selectorCache
 	// map of node name and its address+labels - this is the only thing we need from nodes
 	// for vm to k8s or cross cluster. When node port services select specific nodes by labels,
 	// we run through the label selectors here to pick only ones that we need.
 	nodeInfoMap map[string]kubernetesNode
 	// externalNameSvcInstanceMap stores hostname ==> instance, is used to store instances for ExternalName k8s services
 	externalNameSvcInstanceMap map[host.Name][]*model.ServiceInstance
-
-	// CIDR ranger based on path-compressed prefix trie
-	ranger cidranger.Ranger
-
-	// Network name for the registry as specified by the MeshNetworks configmap
-	networkForRegistry string
+	// externalNameTargets maps the hostname of ExternalName services to their normalized external
+	// name, so that the ones naming another service of the registry can be resolved as aliases.
+	externalNameTargets map[host.Name]host.Name
+	// externalNameAliases is the reverse of externalNameTargets: the hostnames of the ExternalName
+	// services naming each name, so that the aliases of a service are found without a scan.
+	externalNameAliases map[host.Name]map[host.Name]struct{}
+
+	// network holds the *networkLookup the networks of the endpoints are read from, it is replaced
+	// whole by setRegistryNetwork.
+	network atomic.Value
+	// networkSources are the sources of the network lookup.
+	networkSources networkSources
 
 	// service instances from workload entries  - map of ip -> service instance
 	foreignRegistryInstancesByIP map[string]*model.ServiceInstance
+	// foreignInstances maps the IP of the foreign instances to the services selecting them and the
+	// endpoints built for them, as of their last event, see ForeignInstanceState.
+	foreignInstances map[string]ForeignInstance
+
+	// clusterLocalHosts holds Options.ClusterLocalHostnames merged with the cluster-local hosts of
+	// the mesh config.
+	clusterLocalHosts host.Names
+
+	// systemNamespace is the namespace of the control plane, see isControlPlaneService.
+	systemNamespace string
+
+	// injected are the informers the controller was built on, see NewControllerWithInformers, nil
+	// when it creates its own.
+	injected *Informers
+	// ownedInformers are the informers created by the controller, which Run runs.
+	ownedInformers []cache.SharedIndexInformer
+	// detached is closed once Run stops, for the handlers of the injected informers to ignore the
+	// events.
+	detached chan struct{}
 }
 
 // NewController creates a new Kubernetes controller
 // Created by bootstrap and multicluster (see secretcontroler).
 func NewController(client kubernetes.Interface, metadataClient metadata.Interface, options Options) *Controller {
+	return newController(client, metadataClient, options, newQueue(&options))
+}
+
+// newQueue creates the queue of the controller, defaulting the clock of the options.
+func newQueue(options *Options) queue.Instance {
+	if options.Clock == nil {
+		options.Clock = realClock{}
+	}
+	// The queue requires a time duration for a retry delay after a handler error
+	if options.FairQueueing {
+		return newFairQueue(1*time.Second, options.Clock, options.ClusterID)
+	}
+	return queue.NewQueue(1 * time.Second)
+}
+
+// newController creates a controller handling its events on the queue, with informers of its own.
+func newController(client kubernetes.Interface, metadataClient metadata.Interface, options Options, q queue.Instance) *Controller {
+	return newControllerWithInformers(client, metadataClient, nil, options, q)
+}
+
+// newControllerWithInformers creates a controller handling its events on the queue. It is built on
+// the informers when set, the clients are then not used to watch, and may be nil. Otherwise the
+// controller creates its informers from the clients.
+func newControllerWithInformers(client kubernetes.Interface, metadataClient metadata.Interface, informers *Informers,
+	options Options, q queue.Instance) *Controller {
+	if normalized := normalizeWatchedNamespaces(options.WatchedNamespaces); normalized != options.WatchedNamespaces {
+		log.Warnf("Watched namespaces %q normalized to %q", options.WatchedNamespaces, normalized)
+		options.WatchedNamespaces = normalized
+	}
 	log.Infof("Service controller watching namespace %q for services, endpoints, nodes and pods, refresh %s",
 		options.WatchedNamespaces, options.ResyncPeriod)
 
 	watchedNamespaceList := strings.Split(options.WatchedNamespaces, ",")
 
-	// The queue requires a time duration for a retry delay after a handler error
 	c := &Controller{
-		domainSuffix:                 options.DomainSuffix,
+		options:                      options.sanitized(),
+		domainSuffixes:               newNamespaceDomainSuffixes(options.DomainSuffix, options.NamespaceDomainSuffixes),
 		client:                       client,
 		metadataClient:               metadataClient,
-		queue:                        queue.NewQueue(1 * time.Second),
+		nodeLookup:                   newNodeLookup(metadataClient, options.Clock),
+		queue:                        newRecoveringQueue(q),
+		clock:                        options.Clock,
 		clusterID:                    options.ClusterID,
 		xdsUpdater:                   options.XDSUpdater,
 		servicesMap:                  make(map[host.Name]*model.Service),
-		nodeSelectorsForServices:     make(map[host.Name]labels.Instance),
+		serviceVersions:              make(map[host.Name]objectVersion),
+		endpointsVersions:            make(map[host.Name]objectVersion),
+		invalidPortConfigs:           make(map[host.Name]string),
+		skippedServices:              make(map[host.Name]struct{}),
+		skippedEndpoints:             make(map[host.Name]struct{}),
+		pendingConversions:           make(map[host.Name]struct{}),
+		prometheusScrapes:            make(map[host.Name]*prometheusScrape),
+		rejectedServices:             make(map[host.Name]*ServiceRejectedError),
+		foreignDiagnostics:           newForeignDiagnostics(foreignDiagnosticsInterval, options.Clock),
+		recentProxyNoInstances:       newRecentProxyNoInstances(maxRecentProxyNoInstances),
+		proxyNegativeCache:           newProxyNegativeCache(proxyNegativeCacheTTL, maxProxyNegativeCacheEntries, options.Clock),
+		endpointPortDiagnostics:      newEndpointPortDiagnostics(),
+		rejectedEndpoints:            newRejectedEndpoints(),
+		endpointLimiter:              newEndpointLimiter(options.ClusterID, options.MaxEndpointsPerService),
+		gatewayAddressLimiter:        newGatewayAddressLimiter(options.ClusterID, options.MaxGatewayAddresses),
+		selectors:                    newSelectorCache(),
+		gateways:                     newNodePortGateways(options.LegacyNodeSelectorParsing),
+		endpointOptions:              newEndpointOptions(options),
+		serviceOptions:               newServiceOptions(options),
+		endpointMetrics:              newEndpointMetrics(options.ClusterID, options.ServiceEndpointMetrics),
+		ipFamilies:                   newServiceIPFamilies(options.ClusterID),
+		serviceAccounts:              newServiceAccounts(),
+		localityBackfill:             newLocalityBackfill(options.ClusterID),
+		consistencyLimiter:           rate.NewLimiter(consistencyPagesPerSecond, 1),
+		rejectedIdentities:           make(map[string]string),
+		targetPortConflicts:          make(map[string]struct{}),
+		hostnames:                    newHostnameIndex(),
 		nodeInfoMap:                  make(map[string]kubernetesNode),
+		gatewayAddresses:             make(map[host.Name][]string),
 		externalNameSvcInstanceMap:   make(map[host.Name][]*model.ServiceInstance),
+		externalNameTargets:          make(map[host.Name]host.Name),
+		externalNameAliases:          make(map[host.Name]map[host.Name]struct{}),
 		foreignRegistryInstancesByIP: make(map[string]*model.ServiceInstance),
+		foreignInstances:             make(map[string]ForeignInstance),
+		localEDSServices:             make(map[host.Name]serviceRef),
+		pushedEDS:                    make(map[host.Name]string),
+		pushedEndpoints:              make(map[host.Name][]*model.IstioEndpoint),
+		resyncPeriods:                newResyncPeriods(options.ResyncPeriod, options.ResyncJitter, rand.Float64),
 		networksWatcher:              options.NetworksWatcher,
+		meshWatcher:                  options.MeshWatcher,
 		metrics:                      options.Metrics,
-	}
-
-	svcMlw := listwatch.MultiNamespaceListerWatcher(watchedNamespaceList, func(namespace string) cache.ListerWatcher {
-		return &cache.ListWatch{
-			ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
-				return client.CoreV1().Services(namespace).List(context.TODO(), opts)
-			},
-			WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
-				return client.CoreV1().Services(namespace).Watch(context.TODO(), opts)
-			},
-		}
+		systemNamespace:              options.SystemNamespace,
+		synced:                       make(chan struct{}),
+		terminated:                   make(chan struct{}),
+		injected:                     informers,
+		detached:                     make(chan struct{}),
+	}
+	c.eventBroadcaster, c.eventRecorder = newServiceEventRecorder(client)
+	if c.systemNamespace == "" {
+		c.systemNamespace = IstioNamespace
+	}
+	if options.WriteLockHoldThreshold > 0 {
+		c.instrument(options.WriteLockHoldThreshold)
+	}
+	var cidrErrs []error
+	c.endpointCIDRs, cidrErrs = newEndpointCIDRs(options.AllowedEndpointCIDRs, options.DeniedEndpointCIDRs)
+	for _, err := range cidrErrs {
+		log.Errorf("Rejecting every endpoint address until the endpoint CIDRs are fixed: %v", err)
+	}
+	c.edsDebouncer = newEDSDebouncer(options.EDSUpdateMinInterval, c.clock, func(hostname, namespace string, endpoints []*model.IstioEndpoint) {
+		_ = c.xdsUpdater.EDSUpdate(c.clusterID, hostname, namespace, endpoints)
 	})
+	c.edsBatcher = newEDSBatcher(c.xdsUpdater, c.clusterID, c.edsDebouncer.update, c.edsDebouncer.batched)
+	c.initClusterLocalHosts()
 
-	c.serviceInformer = cache.NewSharedIndexInformer(svcMlw, &v1.Service{}, options.ResyncPeriod,
-		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	if informers != nil {
+		c.serviceInformer = informers.Services
+	} else {
+		svcMlw := listwatch.MultiNamespaceListerWatcher(watchedNamespaceList, func(namespace string) cache.ListerWatcher {
+			return &cache.ListWatch{
+				ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+					return client.CoreV1().Services(namespace).List(context.TODO(), opts)
+				},
+				WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+					return client.CoreV1().Services(namespace).Watch(context.TODO(), opts)
+				},
+			}
+		})
+		c.serviceInformer = c.ownInformer(cache.NewSharedIndexInformer(svcMlw, &v1.Service{}, c.informerResyncPeriod(resyncServices),
+			cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}))
+	}
 	c.serviceLister = listerv1.NewServiceLister(c.serviceInformer.GetIndexer())
-	registerHandlers(c.serviceInformer, c.queue, "Services", c.onServiceEvent)
+	c.registerHandlers(c.serviceInformer, "Services", c.onServiceEvent, serviceUpdateEqual)
 
-	switch options.EndpointMode {
-	case EndpointsOnly:
-		c.endpoints = newEndpointsController(c, options)
-	case EndpointSliceOnly:
-		c.endpoints = newEndpointSliceController(c, options)
-	}
+	c.endpoints = newKubeEndpointsController(c, options.EndpointMode, options)
 
-	// check k8s apiserver version, only apply metadata informer when version >= 1.15
-	// https://github.com/kubernetes/kubernetes/issues/91582
-	k8sVersion, _ := client.Discovery().ServerVersion()
-	if k8sVersion != nil && k8sVersion.Major != "" {
-		if k8sVersion.Major < "1" || (k8sVersion.Major == "1" && k8sVersion.Minor < "15") {
-			c.nodeInformer = coreinformers.NewNodeInformer(client, options.ResyncPeriod, cache.Indexers{})
+	if informers != nil {
+		// The injected nodes serve both the locality of the pods and the node port gateways.
+		c.nodeInformer = informers.Nodes
+		c.filteredNodeInformer = informers.Nodes
+	} else {
+		// check k8s apiserver version, only apply metadata informer when version >= 1.15
+		// https://github.com/kubernetes/kubernetes/issues/91582
+		k8sVersion, _ := client.Discovery().ServerVersion()
+		if k8sVersion != nil && k8sVersion.Major != "" {
+			if k8sVersion.Major < "1" || (k8sVersion.Major == "1" && k8sVersion.Minor < "15") {
+				c.nodeInformer = c.ownInformer(coreinformers.NewNodeInformer(client, c.informerResyncPeriod(resyncNodes), cache.Indexers{}))
+			}
 		}
-	}
 
-	if c.nodeInformer == nil {
-		// This is for getting the pod to node mapping, so that we can get the pod's locality.
-		metadataSharedInformer := metadatainformer.NewSharedInformerFactory(metadataClient, options.ResyncPeriod)
-		nodeResource := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "nodes"}
-		c.nodeMetadataInformer = metadataSharedInformer.ForResource(nodeResource).Informer()
-	}
+		if c.nodeInformer == nil {
+			// This is for getting the pod to node mapping, so that we can get the pod's locality.
+			metadataSharedInformer := metadatainformer.NewSharedInformerFactory(metadataClient, c.informerResyncPeriod(resyncNodes))
+			nodeResource := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "nodes"}
+			c.nodeMetadataInformer = c.ownInformer(metadataSharedInformer.ForResource(nodeResource).Informer())
+		}
 
-	// This is for getting the node IPs of a selected set of nodes
-	// TODO(hzxuzhonghu): optimize don't list-watch all nodes.
-	c.filteredNodeInformer = coreinformers.NewFilteredNodeInformer(client, options.ResyncPeriod,
-		cache.Indexers{},
-		func(options *metav1.ListOptions) {})
-	registerHandlers(c.filteredNodeInformer, c.queue, "Nodes", c.onNodeEvent)
+		// This is for getting the node IPs of a selected set of nodes
+		// TODO(hzxuzhonghu): optimize don't list-watch all nodes.
+		c.filteredNodeInformer = c.ownInformer(coreinformers.NewFilteredNodeInformer(client, c.informerResyncPeriod(resyncNodes),
+			cache.Indexers{},
+			func(options *metav1.ListOptions) {}))
+	}
+	if len(c.endpointOptions.nodeLabelsToCopy) > 0 {
+		c.registerNodeLabelHandler()
+	}
+	c.registerLocalityBackfillHandler()
+	c.registerHandlers(c.filteredNodeInformer, "Nodes", c.onNodeEvent, nodeUpdateEqual)
 
 	c.pods = newPodCache(c, options)
-	registerHandlers(c.pods.informer, c.queue, "Pods", c.pods.onEvent)
+	c.registerHandlers(c.pods.informer, "Pods", c.pods.onEvent, c.pods.updateEqual)
+
+	if informers != nil {
+		// The injected informer watches every namespace, the events of the others are dropped
+		// before they are queued.
+		c.systemNamespaceInformer = informers.Namespaces
+		c.addEventHandler(c.systemNamespaceInformer, cache.FilteringResourceEventHandler{
+			FilterFunc: c.isSystemNamespace,
+			Handler: newEventHandler(c.queue, c.systemNamespaceInformer.GetStore(), "Namespaces",
+				c.onSystemNamespaceEvent, systemNamespaceUpdateEqual, c.options.EventNamespaceMetrics),
+		})
+	} else {
+		c.systemNamespaceInformer = c.ownInformer(newSystemNamespaceInformer(client, c.informerResyncPeriod(resyncNamespaces), c.systemNamespace))
+		c.registerHandlers(c.systemNamespaceInformer, "Namespaces", c.onSystemNamespaceEvent, systemNamespaceUpdateEqual)
+	}
+
+	if c.serviceOptions.filter != nil {
+		if informers != nil {
+			c.namespaceInformer = informers.Namespaces
+		} else {
+			c.namespaceInformer = c.ownInformer(coreinformers.NewNamespaceInformer(client, c.informerResyncPeriod(resyncNamespaces), cache.Indexers{}))
+		}
+		c.registerHandlers(c.namespaceInformer, "Namespaces", c.onNamespaceEvent, namespaceUpdateEqual)
+	}
 
 	return c
 }
@@ -307,86 +797,272 @@ func (c *Controller) Cluster() string {
 	return c.clusterID
 }
 
-func (c *Controller) checkReadyForEvents() error {
-	if !c.HasSynced() {
-		return errors.New("waiting till full synchronization")
-	}
-	return nil
-}
-
 func (c *Controller) onServiceEvent(curr interface{}, event model.Event) error {
-	if err := c.checkReadyForEvents(); err != nil {
+	if err := c.checkServicesReady(); err != nil {
 		return err
 	}
 
-	svc, ok := curr.(*v1.Service)
-	if !ok {
-		tombstone, ok := curr.(cache.DeletedFinalStateUnknown)
-		if !ok {
-			log.Errorf("Couldn't get object from tombstone %#v", curr)
-			return nil
-		}
-		svc, ok = tombstone.Obj.(*v1.Service)
-		if !ok {
-			log.Errorf("Tombstone contained object that is not a service %#v", curr)
-			return nil
-		}
+	svc := serviceFromEvent(curr)
+	if svc == nil {
+		return nil
 	}
 
 	log.Debugf("Handle event %s for service %s in namespace %s", event, svc.Name, svc.Namespace)
 
-	svcConv := kube.ConvertService(*svc, c.domainSuffix, c.clusterID)
+	svcConv, event, handled := c.admitService(svc, event)
+	if !handled {
+		return nil
+	}
+
 	switch event {
 	case model.EventDelete:
-		c.Lock()
-		delete(c.servicesMap, svcConv.Hostname)
-		delete(c.nodeSelectorsForServices, svcConv.Hostname)
-		delete(c.externalNameSvcInstanceMap, svcConv.Hostname)
-		c.Unlock()
+		svcConv = c.deleteService(svc, svcConv)
 	default:
-		// instance conversion is only required when service is added/updated.
-		instances := kube.ExternalNameServiceInstances(*svc, svcConv)
-		if isNodePortGatewayService(svc) {
-			// We need to know which services are using node selectors because during node events,
-			// we have to update all the node port services accordingly.
-			nodeSelector := getNodeSelectorsForService(*svc)
-			c.Lock()
-			// only add when it is nodePort gateway service
-			c.nodeSelectorsForServices[svcConv.Hostname] = nodeSelector
-			c.Unlock()
-			c.updateServiceExternalAddr(svcConv)
-		}
-		c.Lock()
-		c.servicesMap[svcConv.Hostname] = svcConv
-		if len(instances) > 0 {
-			c.externalNameSvcInstanceMap[svcConv.Hostname] = instances
-		}
-		c.Unlock()
+		c.updateService(svc, svcConv)
 	}
 
-	c.xdsUpdater.SvcUpdate(c.clusterID, svc.Name, svc.Namespace, event)
+	log.Debugf("Handled event %s for service %s in namespace %s at resourceVersion %s",
+		event, svc.Name, svc.Namespace, svc.ResourceVersion)
+	c.xdsUpdater.SvcUpdate(c.clusterID, string(svcConv.Hostname), svc.Namespace, event)
 	// Notify service handlers.
 	for _, f := range c.serviceHandlers {
 		f(svcConv, event)
 	}
 
-	return nil
+	return c.refreshExternalNameAliases(svcConv.Hostname)
 }
 
-func getNodeSelectorsForService(svc v1.Service) labels.Instance {
-	if nodeSelector := svc.Annotations[kube.NodeSelectorAnnotation]; nodeSelector != "" {
-		var nodeSelectorKV map[string]string
-		if err := json.Unmarshal([]byte(nodeSelector), &nodeSelectorKV); err != nil {
-			log.Debugf("failed to unmarshal node selector annotation value for service %s.%s: %v",
-				svc.Name, svc.Namespace, err)
+// serviceFromEvent returns the service of an event, or of its tombstone, nil for other objects.
+func serviceFromEvent(curr interface{}) *v1.Service {
+	if svc, ok := curr.(*v1.Service); ok {
+		return svc
+	}
+	tombstone, ok := curr.(cache.DeletedFinalStateUnknown)
+	if !ok {
+		log.Errorf("Couldn't get object from tombstone %#v", curr)
+		return nil
+	}
+	svc, ok := tombstone.Obj.(*v1.Service)
+	if !ok {
+		log.Errorf("Tombstone contained object that is not a service %#v", curr)
+		return nil
+	}
+	return svc
+}
+
+// admitService converts the service of the event and decides how it is handled: services that are
+// skipped or rejected by validateConvertedService are handled as deleted if they were in the
+// registry, and ignored otherwise.
+func (c *Controller) admitService(svc *v1.Service, event model.Event) (*model.Service, model.Event, bool) {
+	skipped := c.updateSkippedService(svc, event)
+	if skipped {
+		if !c.isKnownService(svc) {
+			return nil, event, false
 		}
-		return nodeSelectorKV
+		// The service was not skipped before, remove it as if it were deleted.
+		event = model.EventDelete
 	}
-	return nil
+
+	svcConv := c.convertService(svc)
+
+	var rejection *ServiceRejectedError
+	if event != model.EventDelete {
+		rejection = validateConvertedService(svcConv)
+	}
+	c.Lock()
+	if rejection != nil {
+		c.rejectedServices[svcConv.Hostname] = rejection
+	} else {
+		delete(c.rejectedServices, svcConv.Hostname)
+	}
+	_, known := c.servicesMap[svcConv.Hostname]
+	c.Unlock()
+	if rejection != nil {
+		log.Warnf("Handle event %s for service %s in namespace %s: %v", event, svc.Name, svc.Namespace, rejection)
+		rejectedServices.With(reasonTag.Value(rejection.Reason)).Increment()
+		if !known {
+			return nil, event, false
+		}
+		// The service was usable before this change, remove it until it is fixed.
+		event = model.EventDelete
+	}
+	return svcConv, event, true
+}
+
+// deleteService removes the service and the state derived from it, and returns the service as it
+// was stored.
+func (c *Controller) deleteService(svc *v1.Service, svcConv *model.Service) *model.Service {
+	svcConv = c.storedService(svc, svcConv)
+	c.Lock()
+	delete(c.servicesMap, svcConv.Hostname)
+	c.servicesVersion++
+	delete(c.serviceVersions, svcConv.Hostname)
+	delete(c.endpointsVersions, svcConv.Hostname)
+	c.deleteGatewayLocked(svcConv.Hostname)
+	delete(c.invalidPortConfigs, svcConv.Hostname)
+	delete(c.prometheusScrapes, svcConv.Hostname)
+	delete(c.externalNameSvcInstanceMap, svcConv.Hostname)
+	c.setExternalNameTargetLocked(svcConv.Hostname, "")
+	c.Unlock()
+	// Every delete event ends up here, including those of skipped and rejected services.
+	c.selectors.delete(svc)
+	// The endpoints are cleared here rather than left to the delete of the Endpoints, which may
+	// be handled first, or never for aliases and for skipped or rejected services, which keep
+	// their Endpoints. Those are built again if the service comes back.
+	if c.hasLocalEndpoints(svcConv.Hostname) {
+		c.skipEndpoints(svcConv.Hostname)
+	}
+	c.clearPushedEndpoints(svcConv.Hostname)
+	c.endpointMetrics.clear(svcConv.Hostname)
+	c.ipFamilies.clear(svcConv.Hostname)
+	c.serviceAccounts.clear(svcConv.Hostname)
+	c.hostnames.delete(ServiceRef{ClusterID: c.clusterID, Namespace: svc.Namespace, Name: svc.Name})
+	c.foreignDiagnostics.clear(svcConv.Hostname)
+	c.endpointPortDiagnostics.clear(svcConv.Hostname)
+	c.rejectedEndpoints.clear(svcConv.Hostname)
+	c.endpointLimiter.clear(svcConv.Hostname)
+	c.gatewayAddressLimiter.clear(svcConv.Hostname)
+	c.notifyGatewayHandlers(svcConv.Hostname, nil)
+	return svcConv
+}
+
+// updateService stores the added or updated service, updates the state derived from it, and
+// pushes what its changes require.
+func (c *Controller) updateService(svc *v1.Service, svcConv *model.Service) {
+	// instance conversion is only required when service is added/updated.
+	instances := kube.ExternalNameServiceInstances(*svc, svcConv, c.clusterID)
+	gateway := c.newGatewayUpdate(svc)
+	scrape := servicePrometheusScrape(svc)
+
+	// The gateway state is written along with the service, so that a node event racing with this
+	// one always sees the current service and selector.
+	c.Lock()
+	c.updateGatewayLocked(svc, svcConv, &gateway)
+	prevScrape := c.prometheusScrapes[svcConv.Hostname]
+	if scrape != nil {
+		c.prometheusScrapes[svcConv.Hostname] = scrape
+	} else {
+		delete(c.prometheusScrapes, svcConv.Hostname)
+	}
+	aliasTarget, aliasErr := c.updateExternalNameTargetLocked(svc, svcConv)
+	prev := c.storeServiceLocked(svc, svcConv, instances)
+	c.Unlock()
+	c.selectors.update(svc, svcConv)
+	c.ipFamilies.set(svcConv.Hostname, svc)
+	c.hostnames.set(svcConv.Hostname, ServiceRef{ClusterID: c.clusterID, Namespace: svc.Namespace, Name: svc.Name})
+	c.checkPortConfig(svc, svcConv.Hostname)
+	c.pushGatewayUpdate(svc, svcConv, gateway)
+
+	c.updateServiceEndpoints(svc, prev, svcConv, !reflect.DeepEqual(prevScrape, scrape), aliasTarget != nil)
+	if aliasErr != nil {
+		c.reportExternalNameAliasError(svc, aliasErr)
+	}
+	c.pushServiceConfigUpdate(prev, svcConv)
+}
+
+// pushServiceConfigUpdate requests a push when the changes of the updated service from prev
+// change its listeners or port configs: listeners are built for the external IPs of services,
+// and the consumers of the port configs read them during pushes. The push of a resolution change
+// is requested by onResolutionChange.
+func (c *Controller) pushServiceConfigUpdate(prev, svcConv *model.Service) {
+	if prev == nil || prev.Resolution != svcConv.Resolution {
+		return
+	}
+	if reflect.DeepEqual(prev.Attributes.ClusterExternalIPs, svcConv.Attributes.ClusterExternalIPs) &&
+		reflect.DeepEqual(prev.Attributes.PortConfigs, svcConv.Attributes.PortConfigs) {
+		return
+	}
+	c.xdsUpdater.ConfigUpdate(&model.PushRequest{
+		Full: true,
+		ConfigsUpdated: map[model.ConfigKey]struct{}{{
+			Kind:      model.ServiceEntryKind,
+			Name:      string(svcConv.Hostname),
+			Namespace: svcConv.Attributes.Namespace,
+		}: {}},
+		Reason: []model.TriggerReason{model.ServiceUpdate},
+	})
+}
+
+// storeServiceLocked stores the converted service and the ExternalName instances built for it, and
+// returns the service it replaces, if any. The caller holds the controller lock.
+func (c *Controller) storeServiceLocked(svc *v1.Service, svcConv *model.Service, instances []*model.ServiceInstance) *model.Service {
+	prev := c.servicesMap[svcConv.Hostname]
+	c.servicesMap[svcConv.Hostname] = svcConv
+	c.servicesVersion++
+	c.serviceVersions[svcConv.Hostname] = objectVersion{
+		resourceVersion: svc.ResourceVersion,
+		generation:      svc.Generation,
+		handledAt:       c.clock.Now(),
+	}
+	if len(instances) > 0 {
+		c.externalNameSvcInstanceMap[svcConv.Hostname] = instances
+	} else {
+		// The service may have stopped being an ExternalName service.
+		delete(c.externalNameSvcInstanceMap, svcConv.Hostname)
+	}
+	return prev
+}
+
+// updateServiceEndpoints builds the endpoints of the updated service again when its changes from
+// prev affect them, scrapeChanged telling whether its Prometheus scrape settings changed.
+func (c *Controller) updateServiceEndpoints(svc *v1.Service, prev, svcConv *model.Service, scrapeChanged, alias bool) {
+	// Endpoints are tagged with the cluster-local status of their service, so they have to be
+	// rebuilt when it flips. The endpoints of passthrough services are not pushed through EDS,
+	// so they have to be pushed when a service starts being load balanced. The endpoints are also
+	// labeled with the Prometheus scrape settings of the service, and only built for its ports.
+	if prev != nil && prev.Resolution != svcConv.Resolution {
+		c.onResolutionChange(prev, svcConv, !alias)
+	} else if prev != nil && !alias && (prev.Attributes.ClusterLocal != svcConv.Attributes.ClusterLocal || scrapeChanged ||
+		(!c.endpointOptions.permissiveEndpointPorts && !reflect.DeepEqual(prev.Ports, svcConv.Ports))) {
+		c.endpointsController().UpdateServiceEDS(c, svcConv)
+	}
+	// The endpoints of aliases are those of their target, they are cleared when the service
+	// stops being one.
+	if alias {
+		c.updateAliasEDS(svcConv)
+	} else if svc.Spec.Type == v1.ServiceTypeExternalName {
+		c.clearPushedEndpoints(svcConv.Hostname)
+	}
+	// The endpoints events of a missing, skipped or rejected service were ignored, and the
+	// endpoints of a deleted service were cleared, while its Endpoints may have outlived it.
+	if c.takeSkippedEndpoints(svcConv.Hostname) {
+		c.endpointsController().UpdateServiceEDS(c, svcConv)
+	}
+}
+
+// getExternalAddressesForService returns the valid entries of the external addresses annotation
+// of the service, or nil if there are none.
+func getExternalAddressesForService(svc v1.Service) []string {
+	value := svc.Annotations[kube.ExternalAddressesAnnotation]
+	if value == "" {
+		return nil
+	}
+	var addresses []string
+	for _, addr := range strings.Split(value, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if !isValidExternalAddress(addr) {
+			log.Warnf("ignoring invalid external address %q of service %s.%s", addr, svc.Name, svc.Namespace)
+			invalidExternalAddresses.Increment()
+			continue
+		}
+		addresses = append(addresses, addr)
+	}
+	return addresses
+}
+
+// isValidExternalAddress reports whether addr is an IP or a DNS hostname.
+func isValidExternalAddress(addr string) bool {
+	if net.ParseIP(addr) != nil {
+		return true
+	}
+	return isValidDNSName(addr)
 }
 
 func (c *Controller) onNodeEvent(obj interface{}, event model.Event) error {
-	if err := c.checkReadyForEvents(); err != nil {
+	if err := c.checkNodesReady(); err != nil {
 		return err
 	}
 	node, ok := obj.(*v1.Node)
@@ -403,10 +1079,13 @@ func (c *Controller) onNodeEvent(obj interface{}, event model.Event) error {
 		}
 	}
 	var updatedNeeded bool
+	// The gateways selecting the node before or after the event, whose addresses may change.
+	var gateways []*model.Service
 	if event == model.EventDelete {
 		updatedNeeded = true
 		c.Lock()
 		delete(c.nodeInfoMap, node.Name)
+		gateways = c.gatewayServicesLocked(c.indexNodeLocked(node.Name))
 		c.Unlock()
 	} else {
 		k8sNode := kubernetesNode{labels: node.Labels}
@@ -416,26 +1095,40 @@ func (c *Controller) onNodeEvent(obj interface{}, event model.Event) error {
 				break
 			}
 		}
-		if k8sNode.address == "" {
-			return nil
-		}
 
 		c.Lock()
 		// check if the node exists as this add event could be due to controller resync
 		// if the stored object changes, then fire an update event. Otherwise, ignore this event.
 		currentNode, exists := c.nodeInfoMap[node.Name]
-		if !exists || !reflect.DeepEqual(currentNode, k8sNode) {
+		if k8sNode.address == "" {
+			// The node is not reachable externally (any more), drop its stale address.
+			if exists {
+				delete(c.nodeInfoMap, node.Name)
+				updatedNeeded = true
+			}
+		} else if !exists || !reflect.DeepEqual(currentNode, k8sNode) {
 			c.nodeInfoMap[node.Name] = k8sNode
 			updatedNeeded = true
 		}
+		if updatedNeeded {
+			gateways = c.gatewayServicesLocked(c.indexNodeLocked(node.Name))
+		}
 		c.Unlock()
 	}
 
-	// update all related services
-	if updatedNeeded && c.updateServiceExternalAddr() {
-		c.xdsUpdater.ConfigUpdate(&model.PushRequest{
-			Full: true,
-		})
+	if updatedNeeded {
+		c.notifyNodeHandlers()
+	}
+
+	// update the gateways selecting the node, pushing only those whose addresses changed
+	if len(gateways) > 0 {
+		if changed := c.updateServiceExternalAddr(gateways...); len(changed) > 0 {
+			c.xdsUpdater.ConfigUpdate(&model.PushRequest{
+				Full:           true,
+				ConfigsUpdated: changed,
+				Reason:         []model.TriggerReason{model.ServiceUpdate},
+			})
+		}
 	}
 	return nil
 }
@@ -445,120 +1138,446 @@ func isNodePortGatewayService(svc *v1.Service) bool {
 	return ok && svc.Spec.Type == v1.ServiceTypeNodePort
 }
 
-func registerHandlers(informer cache.SharedIndexInformer, q queue.Instance, otype string,
-	handler func(interface{}, model.Event) error) {
+// registerHandlers queues the handler for every add and delete, and for updates that equal reports
+// as changed. equal should compare only the fields the handler reads, so that updates which only
+// bump the resource version never enter the queue. Events of an object are coalesced while queued,
+// and the handler gets the latest state of the object, see eventCoalescer.
+func (c *Controller) registerHandlers(informer cache.SharedIndexInformer, otype string,
+	handler func(interface{}, model.Event) error, equal func(old, cur interface{}) bool) {
+	c.addEventHandler(informer, newEventHandler(c.queue, informer.GetStore(), otype, handler, equal, c.options.EventNamespaceMetrics))
+}
 
-	informer.AddEventHandler(
-		cache.ResourceEventHandlerFuncs{
-			// TODO: filtering functions to skip over un-referenced resources (perf)
-			AddFunc: func(obj interface{}) {
-				incrementEvent(otype, "add")
-				q.Push(func() error {
-					return handler(obj, model.EventAdd)
-				})
-			},
-			UpdateFunc: func(old, cur interface{}) {
-				if !reflect.DeepEqual(old, cur) {
-					incrementEvent(otype, "update")
-					q.Push(func() error {
-						return handler(cur, model.EventUpdate)
-					})
-				} else {
-					incrementEvent(otype, "updatesame")
-				}
-			},
-			DeleteFunc: func(obj interface{}) {
-				incrementEvent(otype, "delete")
-				q.Push(func() error {
-					return handler(obj, model.EventDelete)
-				})
-			},
-		})
+// newEventHandler queues the events of an informer for the handler, which is instrumented by
+// instrumentHandler. The queue is expected to recover panics, see recoveringQueue.
+func newEventHandler(q queue.Instance, store cache.Store, otype string,
+	handler func(interface{}, model.Event) error, equal func(old, cur interface{}) bool,
+	namespaceMetrics bool) cache.ResourceEventHandlerFuncs {
+	coalescer := newEventCoalescer(q, store, instrumentHandler(otype, handler, namespaceMetrics))
+	observer, _ := q.(eventObserver)
+	delivered := func() {
+		if observer != nil {
+			observer.eventDelivered()
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		// TODO: filtering functions to skip over un-referenced resources (perf)
+		AddFunc: func(obj interface{}) {
+			incrementEvent(otype, "add", eventNamespace(obj, namespaceMetrics))
+			coalescer.push(obj, model.EventAdd)
+			delivered()
+		},
+		UpdateFunc: func(old, cur interface{}) {
+			// Checking the resource versions is O(1), unlike equal which may compare large objects.
+			if !resyncedTypes[otype] && isResync(old, cur) {
+				incrementEvent(otype, "resync", eventNamespace(cur, namespaceMetrics))
+				delivered()
+				return
+			}
+			if !equal(old, cur) {
+				incrementEvent(otype, "update", eventNamespace(cur, namespaceMetrics))
+				coalescer.push(cur, model.EventUpdate)
+			} else {
+				incrementEvent(otype, "updatesame", eventNamespace(cur, namespaceMetrics))
+			}
+			delivered()
+		},
+		DeleteFunc: func(obj interface{}) {
+			incrementEvent(otype, "delete", eventNamespace(obj, namespaceMetrics))
+			coalescer.push(obj, model.EventDelete)
+			delivered()
+		},
+	}
+}
+
+// resyncedTypes are the types whose handlers still get the updates delivered by the periodic
+// resyncs of the informers, for their equal function to compare them. The status of the Services
+// is polled this way.
+var resyncedTypes = map[string]bool{"Services": true}
+
+// isResync reports whether an update was delivered by a periodic resync of the informer, which
+// delivers the objects of its store at the resource version they already had.
+func isResync(old, cur interface{}) bool {
+	oldMeta, err := meta.Accessor(old)
+	if err != nil {
+		return false
+	}
+	curMeta, err := meta.Accessor(cur)
+	if err != nil {
+		return false
+	}
+	return oldMeta.GetResourceVersion() != "" && oldMeta.GetResourceVersion() == curMeta.GetResourceVersion()
+}
+
+// serviceUpdateEqual ignores changes to the resource version and other bookkeeping metadata.
+// The status is compared as the LoadBalancer ingress is used for gateway addresses.
+func serviceUpdateEqual(old, cur interface{}) bool {
+	oldSvc, ok := old.(*v1.Service)
+	if !ok {
+		return false
+	}
+	curSvc, ok := cur.(*v1.Service)
+	if !ok {
+		return false
+	}
+	return reflect.DeepEqual(oldSvc.Labels, curSvc.Labels) &&
+		reflect.DeepEqual(oldSvc.Annotations, curSvc.Annotations) &&
+		reflect.DeepEqual(oldSvc.Spec, curSvc.Spec) &&
+		reflect.DeepEqual(oldSvc.Status, curSvc.Status)
+}
+
+// nodeUpdateEqual compares the node labels and addresses, the only node fields onNodeEvent reads.
+// Nodes report their status every few seconds, so ignoring the rest of it avoids most updates.
+func nodeUpdateEqual(old, cur interface{}) bool {
+	oldNode, ok := old.(*v1.Node)
+	if !ok {
+		return false
+	}
+	curNode, ok := cur.(*v1.Node)
+	if !ok {
+		return false
+	}
+	return reflect.DeepEqual(oldNode.Labels, curNode.Labels) &&
+		reflect.DeepEqual(oldNode.Status.Addresses, curNode.Status.Addresses)
+}
+
+// endpointsUpdateEqual avoids pushes if only the resource version or annotations changed
+// (kube-scheduler, cluster-autoscaler leader election, etc).
+func endpointsUpdateEqual(old, cur interface{}) bool {
+	oldE, ok := old.(*v1.Endpoints)
+	if !ok {
+		return false
+	}
+	curE, ok := cur.(*v1.Endpoints)
+	if !ok {
+		return false
+	}
+	return compareEndpoints(oldE, curE)
 }
 
 // compareEndpoints returns true if the two endpoints are the same in aspects Pilot cares about
-// This currently means only looking at "Ready" endpoints
+// This currently means only looking at "Ready" endpoints, regardless of the order of the subsets
 func compareEndpoints(a, b *v1.Endpoints) bool {
 	if len(a.Subsets) != len(b.Subsets) {
 		return false
 	}
-	for i := range a.Subsets {
-		if !reflect.DeepEqual(a.Subsets[i].Ports, b.Subsets[i].Ports) {
+	// Resyncs and most updates list the subsets in the same order, they are compared in place
+	// before paying for the copies and sorts of canonicalSubsets.
+	if subsetsEqual(a.Subsets, b.Subsets) {
+		return true
+	}
+	return subsetsEqual(canonicalSubsets(a.Subsets), canonicalSubsets(b.Subsets))
+}
+
+// subsetsEqual compares the ports and ready addresses of the subsets, in order. It compares the
+// fields directly, which must be kept in line with those of v1.EndpointPort and v1.EndpointAddress.
+func subsetsEqual(a, b []v1.EndpointSubset) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !endpointPortsEqual(a[i].Ports, b[i].Ports) || !endpointAddressesEqual(a[i].Addresses, b[i].Addresses) {
+			return false
+		}
+	}
+	return true
+}
+
+func endpointPortsEqual(a, b []v1.EndpointPort) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		pa, pb := &a[i], &b[i]
+		if pa.Name != pb.Name || pa.Port != pb.Port || pa.Protocol != pb.Protocol ||
+			!stringPtrEqual(pa.AppProtocol, pb.AppProtocol) {
+			return false
+		}
+	}
+	return true
+}
+
+func endpointAddressesEqual(a, b []v1.EndpointAddress) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		ea, eb := &a[i], &b[i]
+		if ea.IP != eb.IP || ea.Hostname != eb.Hostname || !stringPtrEqual(ea.NodeName, eb.NodeName) {
 			return false
 		}
-		if !reflect.DeepEqual(a.Subsets[i].Addresses, b.Subsets[i].Addresses) {
+		if ea.TargetRef == nil || eb.TargetRef == nil {
+			if ea.TargetRef != eb.TargetRef {
+				return false
+			}
+		} else if *ea.TargetRef != *eb.TargetRef {
 			return false
 		}
 	}
 	return true
 }
 
-// HasSynced returns true after the initial state synchronization
+func stringPtrEqual(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// canonicalSubsets returns the ports and ready addresses of each subset, sorted so that the result
+// does not depend on the order the endpoints controller listed them in. The endpoints controller
+// regroups subsets when pod readiness changes, which can reorder otherwise identical content.
+func canonicalSubsets(subsets []v1.EndpointSubset) []v1.EndpointSubset {
+	type keyedSubset struct {
+		key    string
+		subset v1.EndpointSubset
+	}
+	keyed := make([]keyedSubset, 0, len(subsets))
+	for _, ss := range subsets {
+		var ports []v1.EndpointPort
+		if len(ss.Ports) > 0 {
+			ports = append(ports, ss.Ports...)
+			sort.Slice(ports, func(i, j int) bool {
+				if ports[i].Name != ports[j].Name {
+					return ports[i].Name < ports[j].Name
+				}
+				if ports[i].Port != ports[j].Port {
+					return ports[i].Port < ports[j].Port
+				}
+				return ports[i].Protocol < ports[j].Protocol
+			})
+		}
+		var addresses []v1.EndpointAddress
+		if len(ss.Addresses) > 0 {
+			addresses = append(addresses, ss.Addresses...)
+			sort.Slice(addresses, func(i, j int) bool {
+				if addresses[i].IP != addresses[j].IP {
+					return addresses[i].IP < addresses[j].IP
+				}
+				return addresses[i].Hostname < addresses[j].Hostname
+			})
+		}
+
+		var key strings.Builder
+		for _, p := range ports {
+			key.WriteString(p.Name + "/" + strconv.Itoa(int(p.Port)) + "/" + string(p.Protocol) + ",")
+		}
+		key.WriteString("|")
+		for _, a := range addresses {
+			key.WriteString(a.IP + "/" + a.Hostname + ",")
+		}
+		keyed = append(keyed, keyedSubset{key: key.String(), subset: v1.EndpointSubset{Addresses: addresses, Ports: ports}})
+	}
+	sort.SliceStable(keyed, func(i, j int) bool { return keyed[i].key < keyed[j].key })
+
+	out := make([]v1.EndpointSubset, 0, len(keyed))
+	for _, k := range keyed {
+		out = append(out, k.subset)
+	}
+	return out
+}
+
+// HasSynced returns true after the initial state synchronization. The ReplicaSets, which only name
+// the workloads of pods and istiod may not be allowed to list, are not waited for. With
+// FairQueueing, the events of the initial listing of every namespace must also have been handled.
 func (c *Controller) HasSynced() bool {
+	if !c.informersSynced() {
+		return false
+	}
+	if _, fair := c.queue.(namespacedQueue); !fair {
+		return true
+	}
+	// With FairQueueing, the events of the initial listing may still be queued for their
+	// namespace once the informers synced, Synced is closed behind them.
+	select {
+	case <-c.synced:
+		return true
+	default:
+		return false
+	}
+}
+
+// informersSynced reports whether the informers of the controller have synced.
+func (c *Controller) informersSynced() bool {
 	nodeInformer := c.nodeMetadataInformer
 	if nodeInformer == nil {
 		nodeInformer = c.nodeInformer
 	}
 	if !c.serviceInformer.HasSynced() ||
-		!c.endpoints.HasSynced() ||
+		!c.endpointsController().HasSynced() ||
 		!c.pods.informer.HasSynced() ||
 		!nodeInformer.HasSynced() ||
-		!c.filteredNodeInformer.HasSynced() {
+		!c.filteredNodeInformer.HasSynced() ||
+		!c.systemNamespaceInformer.HasSynced() ||
+		(c.namespaceInformer != nil && !c.namespaceInformer.HasSynced()) {
 		return false
 	}
 	return true
 }
 
-// Run all controllers until a signal is received
+// Synced returns a channel closed once the informers have synced and the events of their
+// initial listing have been handled, so the services and endpoints of the cluster are known.
+func (c *Controller) Synced() <-chan struct{} {
+	return c.synced
+}
+
+// pushBarrier pushes a task handled once the tasks pushed before it are: with FairQueueing, those
+// of every namespace.
+func (c *Controller) pushBarrier(task queue.Task) {
+	if nq, ok := c.queue.(namespacedQueue); ok {
+		nq.PushBarrier(task)
+		return
+	}
+	c.queue.Push(task)
+}
+
+// detachableHandler wraps a handler registered on a watcher shared with other registries.
+// The watchers have no way to remove a handler, so it is detached instead once the controller
+// stops, to neither call into nor retain a terminated controller.
+type detachableHandler struct {
+	mu sync.RWMutex
+	f  func()
+}
+
+func (h *detachableHandler) call() {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.f != nil {
+		h.f()
+	}
+}
+
+func (h *detachableHandler) detach() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.f = nil
+}
+
+// Run all controllers until a signal is received. Once signaled, Run detaches the handlers it
+// registered on the networks and mesh watchers and handles the queued events before returning.
 func (c *Controller) Run(stop <-chan struct{}) {
+	defer close(c.terminated)
+	c.endpointsMutex.Lock()
+	c.runStop = stop
+	c.endpointsMutex.Unlock()
+
+	var handlers []*detachableHandler
 	if c.networksWatcher != nil {
-		c.networksWatcher.AddNetworksHandler(c.initNetworkLookup)
+		h := &detachableHandler{f: c.initNetworkLookup}
+		handlers = append(handlers, h)
+		c.networksWatcher.AddNetworksHandler(h.call)
 		c.initNetworkLookup()
 	}
+	if c.meshWatcher != nil {
+		h := &detachableHandler{f: c.onMeshConfigChange}
+		handlers = append(handlers, h)
+		c.meshWatcher.AddMeshHandler(h.call)
+	}
 
+	// The endpoints of the initial listing are submitted in one batch once it is handled. The
+	// queue, and the batch, only wait for the informers the endpoints are built from: the handlers
+	// of the other kinds wait for their own informers, see checkSynced.
+	start := c.clock.Now()
+	c.edsBatcher.open()
+	queueDone := make(chan struct{})
 	go func() {
-		cache.WaitForCacheSync(stop, c.HasSynced)
+		defer close(queueDone)
+		if c.waitForInitialEndpoints(stop) {
+			// Queued behind the events of the initial listing.
+			c.pushBarrier(func() error {
+				n := c.edsBatcher.close()
+				elapsed := c.clock.Now().Sub(start)
+				initialEDSBatchLatency.With(clusterTag.Value(c.clusterID)).Record(elapsed.Seconds())
+				if n > 0 {
+					log.Infof("Initial sync of cluster %s: submitted the endpoints of %d services in one batch after %v",
+						c.clusterID, n, elapsed)
+				}
+				return nil
+			})
+			go func() {
+				if cache.WaitForCacheSync(stop, c.informersSynced) {
+					c.pushBarrier(func() error {
+						close(c.synced)
+						return nil
+					})
+				}
+			}()
+		}
 		c.queue.Run(stop)
 	}()
 
-	nodeInformer := c.nodeMetadataInformer
-	if nodeInformer == nil {
-		nodeInformer = c.nodeInformer
+	if c.eventBroadcaster != nil {
+		// Only the sink is stopped with Run: the broadcaster belongs to the controller, see
+		// newServiceEventRecorder.
+		defer c.eventBroadcaster.StartRecordingToSink(namespacedEventSink{client: c.client}).Stop()
+	}
+
+	// The injected informers are run by their owner.
+	for _, informer := range c.ownedInformers {
+		go informer.Run(stop)
 	}
-	go c.serviceInformer.Run(stop)
-	go c.pods.informer.Run(stop)
-	go nodeInformer.Run(stop)
-	go c.filteredNodeInformer.Run(stop)
 
-	// To avoid endpoints without labels or ports, wait for sync.
-	cache.WaitForCacheSync(stop, nodeInformer.HasSynced, c.filteredNodeInformer.HasSynced,
-		c.pods.informer.HasSynced,
-		c.serviceInformer.HasSynced)
+	// To avoid endpoints without labels or ports, wait for sync. The nodes are not waited for,
+	// neither here nor by the initial EDS batch, see waitForInitialEndpoints: the locality of the
+	// endpoints built before they sync is filled in afterwards.
+	go c.reconcileNodeLocality(stop)
+	cache.WaitForCacheSync(stop, c.podsSynced, c.servicesSynced)
 
-	go c.endpoints.Run(stop)
+	go c.endpointsController().Run(stop)
+	go c.runEDSReconciler(stop)
 
 	<-stop
+	for _, h := range handlers {
+		h.detach()
+	}
+	close(c.detached)
+	<-queueDone
 	log.Infof("Controller terminated")
 }
 
-// Stop the controller. Only for tests, to simplify the code (defer c.Stop())
+// Stop the controller and wait for Run to return.
+// Only for tests, to simplify the code (defer c.Stop())
 func (c *Controller) Stop() {
 	if c.stop != nil {
 		close(c.stop)
+		<-c.terminated
 	}
 }
 
-// Services implements a service catalog operation
+// Services implements a service catalog operation. The returned slice is a copy the caller may
+// modify; callers that only read it should use ServicesSnapshot.
 func (c *Controller) Services() ([]*model.Service, error) {
+	snapshot := c.ServicesSnapshot()
+	out := make([]*model.Service, len(snapshot))
+	copy(out, snapshot)
+	return out, nil
+}
+
+// ServicesSnapshot returns the services sorted by hostname. The slice is shared between callers
+// and only rebuilt when a service changes, so it must not be modified.
+func (c *Controller) ServicesSnapshot() []*model.Service {
 	c.RLock()
+	if c.servicesSnapshot != nil && c.servicesSnapshotVersion == c.servicesVersion {
+		out := c.servicesSnapshot
+		c.RUnlock()
+		return out
+	}
 	out := make([]*model.Service, 0, len(c.servicesMap))
 	for _, svc := range c.servicesMap {
 		out = append(out, svc)
 	}
+	version := c.servicesVersion
 	c.RUnlock()
+	// Sorted without the lock, which is only taken to publish the snapshot.
 	sort.Slice(out, func(i, j int) bool { return out[i].Hostname < out[j].Hostname })
 
-	return out, nil
+	c.Lock()
+	defer c.Unlock()
+	// Another caller may have published a snapshot in the meantime, keep the most recent one.
+	if c.servicesSnapshot == nil || c.servicesSnapshotVersion < version {
+		c.servicesSnapshot = out
+		c.servicesSnapshotVersion = version
+	}
+	return out
 }
 
 // GetService implements a service catalog operation by hostname specified.
@@ -573,8 +1592,8 @@ func (c *Controller) GetService(hostname host.Name) (*model.Service, error) {
 func (c *Controller) getNodePortGatewayServices() []*model.Service {
 	c.RLock()
 	defer c.RUnlock()
-	out := make([]*model.Service, 0, len(c.nodeSelectorsForServices))
-	for hostname := range c.nodeSelectorsForServices {
+	out := make([]*model.Service, 0, len(c.gateways.nodeSelectors))
+	for hostname := range c.gateways.nodeSelectors {
 		svc := c.servicesMap[hostname]
 		if svc != nil {
 			out = append(out, svc)
@@ -584,61 +1603,195 @@ func (c *Controller) getNodePortGatewayServices() []*model.Service {
 	return out
 }
 
-// updateServiceExternalAddr updates ClusterExternalAddresses for ingress gateway service of nodePort type
-func (c *Controller) updateServiceExternalAddr(svcs ...*model.Service) bool {
+// updateServiceExternalAddr updates ClusterExternalAddresses for ingress gateway service of nodePort type.
+// It returns the config keys of the services whose addresses changed.
+//
+// The addresses are read from the controller state before svc.Mutex is taken: the controller lock
+// must never be acquired while holding the mutex of a service.
+func (c *Controller) updateServiceExternalAddr(svcs ...*model.Service) map[model.ConfigKey]struct{} {
 	// node event, update all nodePort gateway services
 	if len(svcs) == 0 {
 		svcs = c.getNodePortGatewayServices()
 	}
-	// no nodePort gateway service found, no update
-	if len(svcs) == 0 {
-		return false
-	}
+	changed := make(map[model.ConfigKey]struct{})
 	for _, svc := range svcs {
-		c.RLock()
-		nodeSelector := c.nodeSelectorsForServices[svc.Hostname]
-		c.RUnlock()
-		// update external address
+		addresses := c.limitGatewayAddresses(svc.Hostname, c.serviceExternalAddresses(svc.Hostname))
 		svc.Mutex.Lock()
-		if nodeSelector == nil {
-			var extAddresses []string
-			for _, n := range c.nodeInfoMap {
-				extAddresses = append(extAddresses, n.address)
-			}
-			svc.Attributes.ClusterExternalAddresses = map[string][]string{c.clusterID: extAddresses}
-		} else {
-			var nodeAddresses []string
-			for _, n := range c.nodeInfoMap {
-				if nodeSelector.SubsetOf(n.labels) {
-					nodeAddresses = append(nodeAddresses, n.address)
-				}
-			}
-			svc.Attributes.ClusterExternalAddresses = map[string][]string{c.clusterID: nodeAddresses}
-		}
+		prev := svc.Attributes.ClusterExternalAddresses[c.clusterID]
+		svc.Attributes.ClusterExternalAddresses = map[string][]string{c.clusterID: addresses}
 		svc.Mutex.Unlock()
+		c.notifyGatewayHandlers(svc.Hostname, addresses)
+		if !reflect.DeepEqual(prev, addresses) {
+			changed[model.ConfigKey{
+				Kind:      model.ServiceEntryKind,
+				Name:      string(svc.Hostname),
+				Namespace: svc.Attributes.Namespace,
+			}] = struct{}{}
+		}
+	}
+	return changed
+}
+
+// serviceExternalAddresses returns the external addresses of a node port gateway service,
+// preferring the addresses pinned by the service to those of the nodes it selects, narrowed to the
+// nodes hosting a ready gateway pod with the Local external traffic policy. Everything is read in a
+// single snapshot of the controller state.
+func (c *Controller) serviceExternalAddresses(hostname host.Name) []string {
+	c.RLock()
+	defer c.RUnlock()
+	if pinned := c.gateways.externalAddresses[hostname]; len(pinned) > 0 {
+		return append([]string(nil), pinned...)
+	}
+	if _, invalid := c.gateways.invalidNodeSelectors[hostname]; invalid && !c.gateways.legacyNodeSelectors {
+		return nil
+	}
+	if _, local := c.gateways.local[hostname]; local {
+		return c.localGatewayAddressesLocked(hostname)
+	}
+	return c.gatewayNodeAddressesLocked(hostname)
+}
+
+// NodeAddressesForSelector returns the sorted external addresses of the nodes whose labels match
+// the selector. A nil or empty selector matches every node.
+func (c *Controller) NodeAddressesForSelector(selector labels.Instance) []string {
+	return c.nodeAddressesForSelector(newNodeSelector(selector))
+}
+
+func (c *Controller) nodeAddressesForSelector(selector nodeSelector) []string {
+	c.RLock()
+	defer c.RUnlock()
+	var addresses []string
+	for _, n := range c.nodeInfoMap {
+		if selector.matches(n.labels) {
+			addresses = append(addresses, n.address)
+		}
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// AppendNodeHandler registers a handler called with the new node addresses whenever the answer of
+// NodeAddressesForSelector for the selector changes. Handlers are called from the controller queue.
+func (c *Controller) AppendNodeHandler(selector labels.Instance, f func(addresses []string)) error {
+	// The current addresses are read under the lock so that a concurrent node event is either
+	// already reflected in them or notified to the new handler.
+	c.nodeHandlersMutex.Lock()
+	defer c.nodeHandlersMutex.Unlock()
+	compiled := newNodeSelector(selector)
+	c.nodeHandlers = append(c.nodeHandlers, &nodeHandler{
+		selector:  compiled,
+		handler:   f,
+		addresses: c.nodeAddressesForSelector(compiled),
+	})
+	return nil
+}
+
+// notifyNodeHandlers calls the node handlers whose selected node addresses changed.
+func (c *Controller) notifyNodeHandlers() {
+	c.nodeHandlersMutex.Lock()
+	defer c.nodeHandlersMutex.Unlock()
+	for _, h := range c.nodeHandlers {
+		addresses := c.nodeAddressesForSelector(h.selector)
+		if reflect.DeepEqual(addresses, h.addresses) {
+			continue
+		}
+		h.addresses = addresses
+		h.handler(addresses)
+	}
+}
+
+// AppendGatewayHandler registers a handler called with the external addresses of a gateway
+// service, a node port gateway or a LoadBalancer service, whenever they change. The handler only
+// sees the changes made after its registration. It is called from the controller queue, outside
+// the controller locks, with a copy of the addresses, which are nil once the service is deleted or
+// stopped being a gateway.
+func (c *Controller) AppendGatewayHandler(f func(hostname host.Name, addresses []string)) error {
+	c.gatewayHandlersMutex.Lock()
+	defer c.gatewayHandlersMutex.Unlock()
+	c.gatewayHandlers = append(c.gatewayHandlers, f)
+	return nil
+}
+
+// notifyGatewayHandlers calls the gateway handlers if the addresses of the service differ from
+// the ones last delivered. It must not be called with the controller lock held.
+func (c *Controller) notifyGatewayHandlers(hostname host.Name, addresses []string) {
+	c.gatewayHandlersMutex.Lock()
+	defer c.gatewayHandlersMutex.Unlock()
+	prev := c.gatewayAddresses[hostname]
+	if (len(prev) == 0 && len(addresses) == 0) || reflect.DeepEqual(prev, addresses) {
+		return
+	}
+	if len(addresses) == 0 {
+		delete(c.gatewayAddresses, hostname)
+	} else {
+		c.gatewayAddresses[hostname] = append([]string(nil), addresses...)
+	}
+	for _, f := range c.gatewayHandlers {
+		var delivered []string
+		if len(addresses) > 0 {
+			delivered = append([]string(nil), addresses...)
+		}
+		f(hostname, delivered)
 	}
-	return true
 }
 
 // getPodLocality retrieves the locality for a pod.
 func (c *Controller) getPodLocality(pod *v1.Pod) string {
 	// if pod has `istio-locality` label, skip below ops
-	if len(pod.Labels[model.LocalityLabel]) > 0 {
-		return model.GetLocalityLabelOrDefault(pod.Labels[model.LocalityLabel], "")
+	if locality, found := podLocalityLabel(pod); found {
+		return locality
 	}
 
+	for _, source := range c.endpointOptions.localityOrder {
+		switch source {
+		case LocalityFromPodLabels:
+			// Changes to these labels of a running pod do not build its endpoints again, they are
+			// expected to be set once, when the pod is scheduled.
+			if locality := topologyLocality(pod); locality != "" {
+				return locality
+			}
+		case LocalityFromNode:
+			if nodeMeta := c.getPodNode(pod); nodeMeta != nil {
+				if locality := topologyLocality(nodeMeta); locality != "" {
+					return locality
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// localLocality returns the locality of a workload discovered in this cluster. Every endpoint the
+// controller builds for its own workloads must use it, so that locality failover can tell the
+// clusters apart. Endpoints of foreign instances keep the locality of their source instead.
+func (c *Controller) localLocality(label string) model.Locality {
+	return model.Locality{
+		Label:     label,
+		ClusterID: c.clusterID,
+	}
+}
+
+// getPodNode returns the metadata of the node the pod is scheduled on, or nil if it is unknown.
+func (c *Controller) getPodNode(pod *v1.Pod) metav1.Object {
 	// NodeName is set by the scheduler after the pod is created
 	// https://github.com/kubernetes/community/blob/master/contributors/devel/api-conventions.md#late-initialization
+	if !c.nodesSynced() {
+		// Rather than looking up every node, the endpoints are built again once the nodes synced.
+		c.localityBackfill.nodeMissing(pod.Spec.NodeName)
+		return nil
+	}
 	var obj interface{}
 	if c.nodeMetadataInformer != nil {
 		raw, exists, err := c.nodeMetadataInformer.GetStore().GetByKey(pod.Spec.NodeName)
 		if !exists || err != nil {
 			log.Warnf("unable to get node %q for pod %q from cache: %v", pod.Spec.NodeName, pod.Name, err)
-			nodeResource := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "nodes"}
-			raw, err = c.metadataClient.Resource(nodeResource).Get(context.TODO(), pod.Spec.NodeName, metav1.GetOptions{})
+			raw, err = c.nodeLookup.get(pod.Spec.NodeName)
 			if err != nil {
-				log.Warnf("unable to get node %q for pod %q: %v", pod.Spec.NodeName, pod.Name, err)
-				return ""
+				if err != errNodeLookupSkipped {
+					log.Warnf("unable to get node %q for pod %q: %v", pod.Spec.NodeName, pod.Name, err)
+				}
+				c.localityBackfill.nodeMissing(pod.Spec.NodeName)
+				return nil
 			}
 		}
 		obj = raw
@@ -646,7 +1799,8 @@ func (c *Controller) getPodLocality(pod *v1.Pod) string {
 		node, exists, err := c.nodeInformer.GetStore().GetByKey(pod.Spec.NodeName)
 		if !exists || err != nil {
 			log.Warnf("unable to get node %q for pod %q from cache: %v", pod.Spec.NodeName, pod.Name, err)
-			return ""
+			c.localityBackfill.nodeMissing(pod.Spec.NodeName)
+			return nil
 		}
 		obj = node
 	}
@@ -654,40 +1808,151 @@ func (c *Controller) getPodLocality(pod *v1.Pod) string {
 	nodeMeta, err := meta.Accessor(obj)
 	if err != nil {
 		log.Warnf("unable to get node meta: %v", nodeMeta)
-		return ""
+		return nil
+	}
+	return nodeMeta
+}
+
+// getPodNodeLabels returns the configured node labels of the pod's node, with their keys prefixed
+// by nodeLabelPrefix.
+func (c *Controller) getPodNodeLabels(pod *v1.Pod) labels.Instance {
+	if len(c.endpointOptions.nodeLabelsToCopy) == 0 {
+		return nil
+	}
+	nodeMeta := c.getPodNode(pod)
+	if nodeMeta == nil {
+		return nil
 	}
+	return c.copiedNodeLabels(nodeMeta.GetLabels())
+}
 
-	region := getLabelValue(nodeMeta, NodeRegionLabel, NodeRegionLabelGA)
-	zone := getLabelValue(nodeMeta, NodeZoneLabel, NodeZoneLabelGA)
-	subzone := getLabelValue(nodeMeta, IstioSubzoneLabel, "")
+func (c *Controller) copiedNodeLabels(nodeLabels map[string]string) labels.Instance {
+	out := make(labels.Instance, len(c.endpointOptions.nodeLabelsToCopy))
+	for _, key := range c.endpointOptions.nodeLabelsToCopy {
+		if value, f := nodeLabels[key]; f {
+			out[c.endpointOptions.nodeLabelPrefix+key] = value
+		}
+	}
+	return out
+}
 
-	if region == "" && zone == "" && subzone == "" {
-		return ""
+// registerNodeLabelHandler rebuilds the endpoints of pods on a node when one of the copied node
+// labels changes. It watches the same node informer used for pod locality.
+func (c *Controller) registerNodeLabelHandler() {
+	nodeInformer := c.nodeMetadataInformer
+	if nodeInformer == nil {
+		nodeInformer = c.nodeInformer
 	}
+	c.addEventHandler(nodeInformer, cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, cur interface{}) {
+			oldMeta, err := meta.Accessor(old)
+			if err != nil {
+				return
+			}
+			curMeta, err := meta.Accessor(cur)
+			if err != nil {
+				return
+			}
+			if reflect.DeepEqual(c.copiedNodeLabels(oldMeta.GetLabels()), c.copiedNodeLabels(curMeta.GetLabels())) {
+				return
+			}
+			nodeName := curMeta.GetName()
+			c.queue.Push(func() error {
+				return c.updateNodeEndpoints(nodeName)
+			})
+		},
+	})
+}
 
-	return region + "/" + zone + "/" + subzone // Format: "%s/%s/%s"
+// updateNodeEndpoints rebuilds EDS for every service selecting a pod scheduled on the node.
+func (c *Controller) updateNodeEndpoints(nodeName string) error {
+	updated := make(map[host.Name]struct{})
+	for _, obj := range c.pods.informer.GetStore().List() {
+		pod, ok := obj.(*v1.Pod)
+		if !ok || pod.Spec.NodeName != nodeName {
+			continue
+		}
+		services, err := c.getPodServices(pod)
+		if err != nil {
+			return err
+		}
+		for _, svc := range services {
+			hostname := c.serviceHostname(svc.Name, svc.Namespace)
+			if _, f := updated[hostname]; f {
+				continue
+			}
+			updated[hostname] = struct{}{}
+			c.RLock()
+			modelService, f := c.servicesMap[hostname]
+			c.RUnlock()
+			if f {
+				c.endpointsController().UpdateServiceEDS(c, modelService)
+			}
+		}
+	}
+	return nil
 }
 
 // InstancesByPort implements a service catalog operation
 func (c *Controller) InstancesByPort(svc *model.Service, reqSvcPort int,
 	labelsList labels.Collection) ([]*model.ServiceInstance, error) {
+	svcPort, exists := svc.Ports.GetByPort(reqSvcPort)
+	if !exists {
+		if c.hasForeignInstances() {
+			c.foreignDiagnostics.record(svc.Hostname, reqSvcPort, ForeignPortNotFound,
+				"port %d is not declared by the service, ports are %v", reqSvcPort, svc.Ports.GetNames())
+		}
+		return nil, nil
+	}
+	if target := c.externalNameAliasTarget(svc); target != nil {
+		return c.aliasInstances(svc, svcPort, target, labelsList)
+	}
 	// First get k8s standard service instances and the workload entry instances
-	outInstances, err := c.endpoints.InstancesByPort(c, svc, reqSvcPort, labelsList)
-	outInstances = append(outInstances, c.getForeignServiceInstancesByPort(svc, reqSvcPort)...)
+	outInstances, err := c.endpointsController().InstancesByPort(c, svc, reqSvcPort, labelsList)
+	return c.appendForeignAndExternalNameInstances(outInstances, err, svc, svcPort)
+}
+
+// InstancesByPortName is like InstancesByPort, but selects the service port by name. This avoids
+// resolving a port number back to a name, which is ambiguous when several ports share a number.
+func (c *Controller) InstancesByPortName(svc *model.Service, portName string,
+	labelsList labels.Collection) ([]*model.ServiceInstance, error) {
+	svcPort, exists := svc.Ports.Get(portName)
+	if !exists {
+		if c.hasForeignInstances() {
+			c.foreignDiagnostics.record(svc.Hostname, 0, ForeignPortNotFound,
+				"port %q is not declared by the service, ports are %v", portName, svc.Ports.GetNames())
+		}
+		return nil, nil
+	}
+	if target := c.externalNameAliasTarget(svc); target != nil {
+		return c.aliasInstances(svc, svcPort, target, labelsList)
+	}
+	outInstances, err := c.endpointsController().InstancesByPortName(c, svc, portName, labelsList)
+	return c.appendForeignAndExternalNameInstances(outInstances, err, svc, svcPort)
+}
+
+func (c *Controller) appendForeignAndExternalNameInstances(outInstances []*model.ServiceInstance, err error,
+	svc *model.Service, svcPort *model.Port) ([]*model.ServiceInstance, error) {
+	outInstances = append(outInstances, c.getForeignServiceInstancesByPort(svc, svcPort, true)...)
 
 	// return when instances found or an error occurs
 	if len(outInstances) > 0 || err != nil {
 		return outInstances, err
 	}
 
-	// Fall back to external name service since we did not find any instances of normal services
+	// Fall back to external name service since we did not find any instances of normal services.
+	// Instances left behind by a service whose delete was missed are not served.
 	c.RLock()
-	externalNameInstances := c.externalNameSvcInstanceMap[svc.Hostname]
+	var externalNameInstances []*model.ServiceInstance
+	if current, f := c.servicesMap[svc.Hostname]; f && current.Attributes.Namespace == svc.Attributes.Namespace {
+		externalNameInstances = c.externalNameSvcInstanceMap[svc.Hostname]
+	}
 	c.RUnlock()
 	if externalNameInstances != nil {
 		inScopeInstances := make([]*model.ServiceInstance, 0)
 		for _, i := range externalNameInstances {
-			if i.Service.Attributes.Namespace == svc.Attributes.Namespace && i.ServicePort.Port == reqSvcPort {
+			if i.Service.Attributes.Namespace == svc.Attributes.Namespace &&
+				i.ServicePort.Port == svcPort.Port && i.ServicePort.Name == svcPort.Name {
 				inScopeInstances = append(inScopeInstances, i)
 			}
 		}
@@ -696,50 +1961,38 @@ func (c *Controller) InstancesByPort(svc *model.Service, reqSvcPort int,
 	return nil, nil
 }
 
-func (c *Controller) getForeignServiceInstancesByPort(svc *model.Service, reqSvcPort int) []*model.ServiceInstance {
+// getForeignServiceInstancesByPort returns the foreign instances selected by the service, for the
+// port. When diagnose is set, lookups finding none although some exist are recorded.
+func (c *Controller) getForeignServiceInstancesByPort(svc *model.Service, servicePort *model.Port,
+	diagnose bool) []*model.ServiceInstance {
 	// Run through all the foreign instances, select ones that match the service labels
 	// only if this is a kubernetes internal service and of ClientSideLB (eds) type
 	// as InstancesByPort is called by the aggregate controller. We dont want to include
 	// foreign instances for any other registry
-	var foreignInstancesExist bool
-	c.RLock()
-	foreignInstancesExist = len(c.foreignRegistryInstancesByIP) > 0
-	c.RUnlock()
-
-	if !foreignInstancesExist || svc.Attributes.ServiceRegistry != string(serviceregistry.Kubernetes) ||
+	if !c.hasForeignInstances() || svc.Attributes.ServiceRegistry != string(serviceregistry.Kubernetes) ||
 		svc.MeshExternal || svc.Resolution != model.ClientSideLB {
 		return nil
 	}
 
-	selector := labels.Instance(svc.Attributes.LabelSelectors)
-
-	// Get the service port name so that we can construct the service instance
-	var servicePort *model.Port
-	for _, p := range svc.Ports {
-		if p.Port == reqSvcPort {
-			servicePort = p
-			break
-		}
-	}
-	if servicePort == nil {
-		return nil
-	}
+	selector := c.selectors.forConvertedService(svc)
 
 	out := make([]*model.ServiceInstance, 0)
+	inNamespace := 0
 
 	c.RLock()
 	for _, fi := range c.foreignRegistryInstancesByIP {
 		if fi.Service.Attributes.Namespace != svc.Attributes.Namespace {
 			continue
 		}
-		if selector.SubsetOf(fi.Endpoint.Labels) {
+		inNamespace++
+		if selector.Matches(klabels.Set(fi.Endpoint.Labels)) {
 			// create an instance with endpoint whose service port name matches
 			// TODO(rshriram): we currently ignore the workload entry (endpoint) ports and setup 1-1 mapping
 			// from service port to endpoint port. Need to figure out a way to map workload entry port to
 			// appropriate k8s service port
 			istioEndpoint := *fi.Endpoint
-			// BUG: reqSvcPort is the Service port - it should instead be the TargetPort
-			istioEndpoint.EndpointPort = uint32(reqSvcPort)
+			// BUG: servicePort.Port is the Service port - it should instead be the TargetPort
+			istioEndpoint.EndpointPort = uint32(servicePort.Port)
 			istioEndpoint.ServicePortName = servicePort.Name
 			out = append(out, &model.ServiceInstance{
 				Service:     svc,
@@ -749,7 +2002,24 @@ func (c *Controller) getForeignServiceInstancesByPort(svc *model.Service, reqSvc
 		}
 	}
 	c.RUnlock()
-	return out
+
+	if diagnose && len(out) == 0 {
+		if inNamespace == 0 {
+			c.foreignDiagnostics.record(svc.Hostname, servicePort.Port, ForeignNamespaceMismatch,
+				"no foreign instance is in namespace %s", svc.Attributes.Namespace)
+		} else {
+			c.foreignDiagnostics.record(svc.Hostname, servicePort.Port, ForeignSelectorMismatch,
+				"none of the %d foreign instances in namespace %s match the selector %v",
+				inNamespace, svc.Attributes.Namespace, selector)
+		}
+	}
+	return c.filterForeignPodOverlaps(svc, out)
+}
+
+func (c *Controller) hasForeignInstances() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.foreignRegistryInstancesByIP) > 0
 }
 
 // convenience function to collect all workload entry endpoints in updateEDS calls.
@@ -763,11 +2033,12 @@ func (c *Controller) collectAllForeignEndpoints(svc *model.Service) []*model.Ist
 		return nil
 	}
 
-	instances := c.getForeignServiceInstancesByPort(svc, svc.Ports[0].Port)
+	instances := c.getForeignServiceInstancesByPort(svc, svc.Ports[0], false)
 	endpoints := make([]*model.IstioEndpoint, 0)
 
 	// all endpoints for ports[0]
 	for _, instance := range instances {
+		instance.Endpoint.ClusterLocal = svc.Attributes.ClusterLocal
 		endpoints = append(endpoints, instance.Endpoint)
 	}
 
@@ -783,63 +2054,137 @@ func (c *Controller) collectAllForeignEndpoints(svc *model.Service) []*model.Ist
 	return endpoints
 }
 
-// GetProxyServiceInstances returns service instances co-located with a given proxy
-// TODO: this code does not return k8s service instances when the proxy's IP is a workload entry
-// To tackle this, we need a ip2instance map like what we have in service entry.
-func (c *Controller) GetProxyServiceInstances(proxy *model.Proxy) ([]*model.ServiceInstance, error) {
-
-	out := make([]*model.ServiceInstance, 0)
-	if len(proxy.IPAddresses) > 0 {
-		// only need to fetch the corresponding pod through the first IP, although there are multiple IP scenarios,
-		// because multiple ips belong to the same pod
-		proxyIP := proxy.IPAddresses[0]
-
-		pod := c.pods.getPodByIP(proxyIP)
-		if foreign, f := c.foreignRegistryInstancesByIP[proxyIP]; f {
-			var err error
-			out, err = c.hydrateForeignServiceInstance(foreign)
-			if err != nil {
-				log.Warnf("hydrateForeignServiceInstance for %v failed: %v", proxy.ID, err)
+// initClusterLocalHosts rebuilds the set of cluster-local hosts from the controller options
+// and the mesh config.
+func (c *Controller) initClusterLocalHosts() {
+	hosts := make(host.Names, 0, len(c.options.ClusterLocalHostnames))
+	for _, h := range c.options.ClusterLocalHostnames {
+		hosts = append(hosts, host.Name(h))
+	}
+	if c.meshWatcher != nil && c.meshWatcher.Mesh() != nil {
+		for _, serviceSettings := range c.meshWatcher.Mesh().ServiceSettings {
+			if !serviceSettings.GetSettings().GetClusterLocal() {
+				continue
 			}
-		} else if pod != nil {
-			// for split horizon EDS k8s multi cluster, in case there are pods of the same ip across clusters,
-			// which can happen when multi clusters using same pod cidr.
-			// As we have proxy Network meta, compare it with the network which endpoint belongs to,
-			// if they are not same, ignore the pod, because the pod is in another cluster.
-			if proxy.Metadata.Network != c.endpointNetwork(proxyIP) {
-				return out, nil
+			for _, h := range serviceSettings.Hosts {
+				hosts = append(hosts, host.Name(h))
 			}
-			// 1. find proxy service by label selector, if not any, there may exist headless service without selector
-			// failover to 2
-			if services, err := getPodServices(c.serviceLister, pod); err == nil && len(services) > 0 {
-				for _, svc := range services {
-					out = append(out, c.getProxyServiceInstancesByPod(pod, svc, proxy)...)
-				}
-				return out, nil
+		}
+	}
+
+	c.Lock()
+	c.clusterLocalHosts = hosts
+	c.Unlock()
+}
+
+// normalizeWatchedNamespaces trims and deduplicates a comma separated namespace list, so that no
+// namespace is watched twice. Empty entries left by trailing commas are dropped, any other empty
+// entry stands for all namespaces and makes the rest redundant.
+func normalizeWatchedNamespaces(namespaces string) string {
+	tokens := strings.Split(namespaces, ",")
+	for i := range tokens {
+		tokens[i] = strings.TrimSpace(tokens[i])
+	}
+	for len(tokens) > 1 && tokens[len(tokens)-1] == "" {
+		tokens = tokens[:len(tokens)-1]
+	}
+	seen := make(map[string]struct{}, len(tokens))
+	out := make([]string, 0, len(tokens))
+	for _, ns := range tokens {
+		if ns == metav1.NamespaceAll {
+			return metav1.NamespaceAll
+		}
+		if _, f := seen[ns]; f {
+			continue
+		}
+		seen[ns] = struct{}{}
+		out = append(out, ns)
+	}
+	return strings.Join(out, ",")
+}
+
+// isControlPlaneService returns true if the service is one of the control plane services.
+func (c *Controller) isControlPlaneService(svc *model.Service) bool {
+	if svc.Attributes.Namespace != c.systemNamespace {
+		return false
+	}
+	_, ok := c.serviceOptions.controlPlaneServices[svc.Attributes.Name]
+	return ok
+}
+
+// isClusterLocal returns true if the hostname matches any of the cluster-local hosts.
+func (c *Controller) isClusterLocal(hostname host.Name) bool {
+	c.RLock()
+	defer c.RUnlock()
+	_, ok := model.MostSpecificHostMatch(hostname, c.clusterLocalHosts)
+	return ok
+}
+
+// onMeshConfigChange refreshes the cluster-local hosts and re-converts the services whose
+// cluster-local status changed as a result.
+func (c *Controller) onMeshConfigChange() {
+	c.initClusterLocalHosts()
+	c.queue.Push(func() error {
+		services, _ := c.Services()
+		for _, svc := range services {
+			if svc.Attributes.ClusterLocal == c.isClusterLocalService(svc) {
+				continue
 			}
-			// 2. Headless service without selector
-			out = c.endpoints.GetProxyServiceInstances(c, proxy)
-		} else {
-			var err error
-			// 3. The pod is not present when this is called
-			// due to eventual consistency issues. However, we have a lot of information about the pod from the proxy
-			// metadata already. Because of this, we can still get most of the information we need.
-			// If we cannot accurately construct ServiceInstances from just the metadata, this will return an error and we can
-			// attempt to read the real pod.
-			out, err = c.getProxyServiceInstancesFromMetadata(proxy)
+			k8sSvc, err := c.serviceLister.Services(svc.Attributes.Namespace).Get(svc.Attributes.Name)
 			if err != nil {
-				log.Warnf("getProxyServiceInstancesFromMetadata for %v failed: %v", proxy.ID, err)
+				log.Warnf("failed to get service %s/%s for cluster-local update: %v",
+					svc.Attributes.Namespace, svc.Attributes.Name, err)
+				continue
+			}
+			if err := c.onServiceEvent(k8sSvc, model.EventUpdate); err != nil {
+				return err
 			}
 		}
+		return nil
+	})
+}
+
+// updatePodEndpoints rebuilds EDS for every service selecting the pod. It is used when a pod
+// attribute that is copied onto its endpoints changes without the Endpoints object changing.
+func (c *Controller) updatePodEndpoints(pod *v1.Pod) error {
+	services, err := c.getPodServices(pod)
+	if err != nil {
+		return err
+	}
+	for _, svc := range services {
+		hostname := c.serviceHostname(svc.Name, svc.Namespace)
+		c.RLock()
+		modelService, f := c.servicesMap[hostname]
+		c.RUnlock()
+		if !f {
+			continue
+		}
+		c.endpointsController().UpdateServiceEDS(c, modelService)
 	}
-	if len(out) == 0 {
+	return nil
+}
+
+// GetProxyServiceInstances returns service instances co-located with a given proxy
+// TODO: this code does not return k8s service instances when the proxy's IP is a workload entry
+// To tackle this, we need a ip2instance map like what we have in service entry.
+func (c *Controller) GetProxyServiceInstances(proxy *model.Proxy) ([]*model.ServiceInstance, error) {
+	result := c.ResolveProxyServiceInstances(proxy)
+	if result.Degraded() {
+		log.Warnf("service instances lookup for %v (%s path) failed: %v", proxy.ID, result.Path, result.Error())
+		if c.metrics != nil {
+			c.metrics.AddMetric(model.ProxyStatusServiceLookupFailed, proxy.ID, proxy, result.Error())
+		}
+	} else if len(result.Instances) == 0 {
 		if c.metrics != nil {
 			c.metrics.AddMetric(model.ProxyStatusNoService, proxy.ID, proxy, "")
 		} else {
-			log.Infof("Missing metrics env, empty list of services for pod %s", proxy.ID)
+			log.Infof("Missing metrics env, empty list of services for pod %s (%s)", proxy.ID, result.NoInstancesReason)
 		}
 	}
-	return out, nil
+	if len(result.Instances) == 0 {
+		c.recordProxyNoInstances(proxy.ID, result)
+	}
+	return result.Instances, nil
 }
 
 func (c *Controller) hydrateForeignServiceInstance(si *model.ServiceInstance) ([]*model.ServiceInstance, error) {
@@ -851,11 +2196,11 @@ func (c *Controller) hydrateForeignServiceInstance(si *model.ServiceInstance) ([
 	}
 
 	// find the services that map to this workload entry, fire off eds updates if the service is of type client-side lb
-	if k8sServices, err := getPodServices(listerv1.NewServiceLister(c.serviceInformer.GetIndexer()), dummyPod); err == nil && len(k8sServices) > 0 {
+	if k8sServices, err := c.getPodServices(dummyPod); err == nil && len(k8sServices) > 0 {
 		for _, k8sSvc := range k8sServices {
 			var service *model.Service
 			c.RLock()
-			service = c.servicesMap[kube.ServiceHostname(k8sSvc.Name, k8sSvc.Namespace, c.domainSuffix)]
+			service = c.servicesMap[c.serviceHostname(k8sSvc.Name, k8sSvc.Namespace)]
 			c.RUnlock()
 			// Note that this cannot be an external service because k8s external services do not have label selectors.
 			if service == nil || service.Resolution != model.ClientSideLB {
@@ -868,7 +2213,7 @@ func (c *Controller) hydrateForeignServiceInstance(si *model.ServiceInstance) ([
 					continue
 				}
 				// Similar code as UpdateServiceShards in eds.go
-				instances, err := c.InstancesByPort(service, port.Port, labels.Collection{})
+				instances, err := c.InstancesByPortName(service, port.Name, labels.Collection{})
 				if err != nil {
 					return nil, err
 				}
@@ -886,6 +2231,12 @@ func (c *Controller) ForeignServiceInstanceHandler(si *model.ServiceInstance, ev
 	if si.Service == nil || si.Service.Attributes.Namespace == "" || len(si.Endpoint.Labels) == 0 {
 		return
 	}
+	// Workloads outside the endpoint CIDRs, such as spoofed workload entries, are dropped.
+	rejected := event != model.EventDelete && !c.endpointCIDRs.allows(si.Endpoint.Address)
+	c.rejectedEndpoints.update(c.clusterID, si.Service.Hostname, foreignInstanceSource(si), si.Endpoint.Address, rejected)
+	if rejected {
+		return
+	}
 
 	// this is from a workload entry. Store it in separate map so that
 	// the InstancesByPort can use these as well as the k8s pods.
@@ -904,47 +2255,82 @@ func (c *Controller) ForeignServiceInstanceHandler(si *model.ServiceInstance, ev
 		ObjectMeta: metav1.ObjectMeta{Namespace: si.Service.Attributes.Namespace, Labels: si.Endpoint.Labels},
 	}
 
+	// The services selecting the instance and its endpoints are recorded for debugging.
+	var state *ForeignInstance
+	if event != model.EventDelete {
+		state = &ForeignInstance{
+			Cluster:   c.clusterID,
+			Address:   si.Endpoint.Address,
+			Namespace: si.Service.Attributes.Namespace,
+			Labels:    si.Endpoint.Labels,
+		}
+	}
+	defer c.setForeignInstance(si.Endpoint.Address, state)
+
 	// find the services that map to this workload entry, fire off eds updates if the service is of type client-side lb
-	if k8sServices, err := getPodServices(listerv1.NewServiceLister(c.serviceInformer.GetIndexer()), dummyPod); err == nil && len(k8sServices) > 0 {
+	if k8sServices, err := c.getPodServices(dummyPod); err == nil && len(k8sServices) > 0 {
 		for _, k8sSvc := range k8sServices {
 			var service *model.Service
+			hostname := c.serviceHostname(k8sSvc.Name, k8sSvc.Namespace)
 			c.RLock()
-			service = c.servicesMap[kube.ServiceHostname(k8sSvc.Name, k8sSvc.Namespace, c.domainSuffix)]
+			service = c.servicesMap[hostname]
 			c.RUnlock()
+			var selecting *ForeignInstanceService
+			if state != nil {
+				state.Services = append(state.Services, ForeignInstanceService{Hostname: hostname, Registered: service != nil})
+				selecting = &state.Services[len(state.Services)-1]
+			}
 			// Note that this cannot be an external service because k8s external services do not have label selectors.
 			if service == nil || service.Resolution != model.ClientSideLB {
 				// may be a headless service
 				continue
 			}
 
-			// Get the updated list of endpoints that includes k8s pods and the workload entries for this service
-			// and then notify the EDS server that endpoints for this service have changed.
-			// We need one endpoint object for each service port
-			endpoints := make([]*model.IstioEndpoint, 0)
-			for _, port := range service.Ports {
-				if port.Protocol == protocol.UDP {
-					continue
-				}
-				// Similar code as UpdateServiceShards in eds.go
-				instances, err := c.InstancesByPort(service, port.Port, labels.Collection{})
-				if err != nil {
-					log.Debugf("Failed to get endpoints for service %s on port %d, in response to foreign instance: %v",
-						service.Hostname, port.Port, err)
-					continue
-				}
-
-				for _, inst := range instances {
-					endpoints = append(endpoints, inst.Endpoint)
-				}
+			if selecting != nil {
+				selecting.Endpoints = c.foreignInstanceEndpoints(service, si.Endpoint.Address)
 			}
 			// fire off eds update
-			_ = c.xdsUpdater.EDSUpdate(c.clusterID, string(service.Hostname), service.Attributes.Namespace, endpoints)
+			c.updateForeignEDS(service)
+		}
+	}
+}
+
+// updateForeignEDS builds the endpoints of the service again after a change of its foreign
+// instances, and pushes them. The endpoints of the pods are built by the current endpoints source as
+// for its own events, so that they are decorated and filtered the same way, and the foreign
+// endpoints are added to them; a service without endpoints objects gets its foreign endpoints alone.
+func (c *Controller) updateForeignEDS(svc *model.Service) {
+	e := c.endpointsController()
+	if e.isOrphaned(svc.Attributes.Name, svc.Attributes.Namespace) {
+		c.edsUpdate(svc.Hostname, svc.Attributes.Namespace, c.collectAllForeignEndpoints(svc))
+		return
+	}
+	e.UpdateServiceEDS(c, svc)
+}
+
+// foreignInstanceEndpoints returns the endpoints built for the foreign instance of the address on
+// the ports of the service.
+func (c *Controller) foreignInstanceEndpoints(svc *model.Service, address string) []ForeignInstanceEndpoint {
+	var out []ForeignInstanceEndpoint
+	for _, port := range svc.Ports {
+		if port.Protocol == protocol.UDP {
+			continue
+		}
+		for _, inst := range c.getForeignServiceInstancesByPort(svc, port, false) {
+			if inst.Endpoint.Address == address {
+				out = append(out, ForeignInstanceEndpoint{
+					ServicePort:  port.Port,
+					PortName:     port.Name,
+					EndpointPort: inst.Endpoint.EndpointPort,
+				})
+			}
 		}
 	}
+	return out
 }
 
-func getPodServices(s listerv1.ServiceLister, pod *v1.Pod) ([]*v1.Service, error) {
-	allServices, err := s.Services(pod.Namespace).List(klabels.Everything())
+func (c *Controller) getPodServices(pod *v1.Pod) ([]*v1.Service, error) {
+	allServices, err := c.serviceLister.Services(pod.Namespace).List(klabels.Everything())
 	if err != nil {
 		return nil, err
 	}
@@ -955,11 +2341,11 @@ func getPodServices(s listerv1.ServiceLister, pod *v1.Pod) ([]*v1.Service, error
 			// services with nil selectors match nothing, not everything.
 			continue
 		}
-		selector := klabels.Set(service.Spec.Selector).AsSelectorPreValidated()
-		if selector.Matches(klabels.Set(pod.Labels)) {
+		if c.selectors.forService(service).Matches(klabels.Set(pod.Labels)) {
 			services = append(services, service)
 		}
 	}
+	sortServicesByPrecedence(services)
 
 	return services, nil
 }
@@ -967,13 +2353,17 @@ func getPodServices(s listerv1.ServiceLister, pod *v1.Pod) ([]*v1.Service, error
 // getProxyServiceInstancesFromMetadata retrieves ServiceInstances using proxy Metadata rather than
 // from the Pod. This allows retrieving Instances immediately, regardless of delays in Kubernetes.
 // If the proxy doesn't have enough metadata, an error is returned
-func (c *Controller) getProxyServiceInstancesFromMetadata(proxy *model.Proxy) ([]*model.ServiceInstance, error) {
+//
+// The services that cannot be resolved are reported in serviceErrors by hostname, and left out of
+// the instances returned for the others.
+func (c *Controller) getProxyServiceInstancesFromMetadata(proxy *model.Proxy) (
+	out []*model.ServiceInstance, serviceErrors map[host.Name]error, err error) {
 	if len(proxy.Metadata.Labels) == 0 {
-		return nil, fmt.Errorf("no workload labels found")
+		return nil, nil, fmt.Errorf("no workload labels found")
 	}
 
 	if proxy.Metadata.ClusterID != c.clusterID {
-		return nil, fmt.Errorf("proxy is in cluster %v, but controller is for cluster %v", proxy.Metadata.ClusterID, c.clusterID)
+		return nil, nil, fmt.Errorf("proxy is in cluster %v, but controller is for cluster %v", proxy.Metadata.ClusterID, c.clusterID)
 	}
 
 	// Create a pod with just the information needed to find the associated Services
@@ -985,35 +2375,40 @@ func (c *Controller) getProxyServiceInstancesFromMetadata(proxy *model.Proxy) ([
 	}
 
 	// Find the Service associated with the pod.
-	services, err := getPodServices(c.serviceLister, dummyPod)
+	services, err := c.getPodServices(dummyPod)
 	if err != nil {
-		return nil, fmt.Errorf("error getting instances for %s: %v", proxy.ID, err)
+		return nil, nil, fmt.Errorf("error getting instances for %s: %v", proxy.ID, err)
 
 	}
 	if len(services) == 0 {
-		return nil, fmt.Errorf("no instances found for %s: %v", proxy.ID, err)
+		return nil, nil, fmt.Errorf("no instances found for %s: %v", proxy.ID, err)
 	}
 
-	out := make([]*model.ServiceInstance, 0)
+	out = make([]*model.ServiceInstance, 0)
 	for _, svc := range services {
 		svcAccount := proxy.Metadata.ServiceAccount
-		hostname := kube.ServiceHostname(svc.Name, svc.Namespace, c.domainSuffix)
+		hostname := c.serviceHostname(svc.Name, svc.Namespace)
 		c.RLock()
 		modelService, f := c.servicesMap[hostname]
 		c.RUnlock()
 		if !f {
-			return nil, fmt.Errorf("failed to find model service for %v", hostname)
+			serviceErrors = addServiceError(serviceErrors, hostname, fmt.Errorf("failed to find model service for %v", hostname))
+			continue
 		}
 
 		tps := make(map[model.Port]*model.Port)
+		var targetPorts []model.Port
+		var portErr error
 		for _, port := range svc.Spec.Ports {
 			svcPort, f := modelService.Ports.Get(port.Name)
 			if !f {
-				return nil, fmt.Errorf("failed to get svc port for %v", port.Name)
+				portErr = fmt.Errorf("failed to get svc port for %v", port.Name)
+				break
 			}
 			portNum, err := findPortFromMetadata(port, proxy.Metadata.PodPorts)
 			if err != nil {
-				return nil, fmt.Errorf("failed to find target port for %v: %v", proxy.ID, err)
+				portErr = fmt.Errorf("failed to find target port for %v: %v", proxy.ID, err)
+				break
 			}
 			// Dedupe the target ports here - Service might have configured multiple ports to the same target port,
 			// we will have to create only one ingress listener per port and protocol so that we do not endup
@@ -1024,10 +2419,17 @@ func (c *Controller) getProxyServiceInstancesFromMetadata(proxy *model.Proxy) ([
 			}
 			if _, exists := tps[targetPort]; !exists {
 				tps[targetPort] = svcPort
+				targetPorts = append(targetPorts, targetPort)
 			}
 		}
+		if portErr != nil {
+			serviceErrors = addServiceError(serviceErrors, hostname, portErr)
+			continue
+		}
 
-		for tp, svcPort := range tps {
+		// In the declaration order of the ports, which decides the winner of protocol conflicts.
+		for _, tp := range targetPorts {
+			svcPort := tps[tp]
 			// consider multiple IP scenarios
 			for _, ip := range proxy.IPAddresses {
 				// Construct the ServiceInstance
@@ -1042,16 +2444,13 @@ func (c *Controller) getProxyServiceInstancesFromMetadata(proxy *model.Proxy) ([
 						Labels:         proxy.Metadata.Labels,
 						ServiceAccount: svcAccount,
 						Network:        c.endpointNetwork(ip),
-						Locality: model.Locality{
-							Label:     util.LocalityToString(proxy.Locality),
-							ClusterID: c.clusterID,
-						},
+						Locality:       c.localLocality(util.LocalityToString(proxy.Locality)),
 					},
 				})
 			}
 		}
 	}
-	return out, nil
+	return c.resolveTargetPortConflicts(out), serviceErrors, nil
 }
 
 // findPortFromMetadata resolves the TargetPort of a Service Port, by reading the Pod spec.
@@ -1077,16 +2476,20 @@ func findPortFromMetadata(svcPort v1.ServicePort, podPorts []model.PodPort) (int
 func (c *Controller) getProxyServiceInstancesByPod(pod *v1.Pod, service *v1.Service, proxy *model.Proxy) []*model.ServiceInstance {
 	out := make([]*model.ServiceInstance, 0)
 
-	hostname := kube.ServiceHostname(service.Name, service.Namespace, c.domainSuffix)
+	hostname := c.serviceHostname(service.Name, service.Namespace)
 	c.RLock()
 	svc := c.servicesMap[hostname]
 	c.RUnlock()
 
 	if svc == nil {
-		return out
+		// The service may not be handled yet, such as right after a restart.
+		if svc = c.convertServiceOnDemand(service, hostname); svc == nil {
+			return out
+		}
 	}
 
 	tps := make(map[model.Port]*model.Port)
+	var targetPorts []model.Port
 	for _, port := range service.Spec.Ports {
 		svcPort, exists := svc.Ports.Get(port.Name)
 		if !exists {
@@ -1107,11 +2510,14 @@ func (c *Controller) getProxyServiceInstancesByPod(pod *v1.Pod, service *v1.Serv
 		}
 		if _, exists = tps[targetPort]; !exists {
 			tps[targetPort] = svcPort
+			targetPorts = append(targetPorts, targetPort)
 		}
 	}
 
 	builder := NewEndpointBuilder(c, pod)
-	for tp, svcPort := range tps {
+	// In the declaration order of the ports, which decides the winner of protocol conflicts.
+	for _, tp := range targetPorts {
+		svcPort := tps[tp]
 		// consider multiple IP scenarios
 		for _, ip := range proxy.IPAddresses {
 			istioEndpoint := builder.buildIstioEndpoint(ip, int32(tp.Port), svcPort.Name)
@@ -1125,11 +2531,64 @@ func (c *Controller) getProxyServiceInstancesByPod(pod *v1.Pod, service *v1.Serv
 	return out
 }
 
-func (c *Controller) GetProxyWorkloadLabels(proxy *model.Proxy) (labels.Collection, error) {
-	// There is only one IP for kube registry
-	proxyIP := proxy.IPAddresses[0]
+// getForeignServiceInstanceByProxy returns the workload entry instance registered for the first
+// proxy IP that has one.
+func (c *Controller) getForeignServiceInstanceByProxy(proxy *model.Proxy) *model.ServiceInstance {
+	c.RLock()
+	defer c.RUnlock()
+	for _, ip := range proxy.IPAddresses {
+		if foreign, f := c.foreignRegistryInstancesByIP[ip]; f {
+			return foreign
+		}
+	}
+	return nil
+}
+
+// getProxyPod maps a proxy to its backing pod using, in order, the pod cache by proxy IP, the pod
+// name parsed from the proxy ID and the pod hostname index. The pods found from the ID must have
+// an address of the proxy. The returned IP is the proxy IP that matched.
+func (c *Controller) getProxyPod(proxy *model.Proxy) (*v1.Pod, string) {
+	if pod, ip := c.pods.getPodByProxy(proxy); pod != nil {
+		return pod, ip
+	}
+	// Pod names are only unique within a cluster.
+	if proxy.ID == "" || proxy.Metadata == nil || proxy.Metadata.ClusterID != c.clusterID {
+		return nil, ""
+	}
+	namespace := proxy.Metadata.Namespace
+	if namespace == "" {
+		namespace = proxy.ConfigNamespace
+	}
+	pod := c.pods.getPodByProxyID(proxy.ID, namespace)
+	if pod == nil {
+		return nil, ""
+	}
+	// The ID is only trusted for the pods the proxy has an address of, such as the addresses
+	// besides the first of a dual stack pod, which are not in the pod cache.
+	ip := podProxyIP(pod, proxy)
+	if ip == "" {
+		return nil, ""
+	}
+	return pod, ip
+}
+
+// podProxyIP returns the first address of the proxy that is an address of the pod, if any.
+func podProxyIP(pod *v1.Pod, proxy *model.Proxy) string {
+	for _, ip := range proxy.IPAddresses {
+		if ip == pod.Status.PodIP {
+			return ip
+		}
+		for _, podIP := range pod.Status.PodIPs {
+			if ip == podIP.IP {
+				return ip
+			}
+		}
+	}
+	return ""
+}
 
-	pod := c.pods.getPodByIP(proxyIP)
+func (c *Controller) GetProxyWorkloadLabels(proxy *model.Proxy) (labels.Collection, error) {
+	pod, _ := c.getProxyPod(proxy)
 	if pod != nil {
 		return labels.Collection{pod.Labels}, nil
 	}
@@ -1141,7 +2600,7 @@ func (c *Controller) GetProxyWorkloadLabels(proxy *model.Proxy) (labels.Collecti
 // For example, a service account named "bar" in namespace "foo" is encoded as
 // "spiffe://cluster.local/ns/foo/sa/bar".
 func (c *Controller) GetIstioServiceAccounts(svc *model.Service, ports []int) []string {
-	return model.GetServiceAccounts(svc, ports, c)
+	return c.serviceAccounts.get(svc, ports)
 }
 
 // AppendServiceHandler implements a service catalog operation
@@ -1156,57 +2615,122 @@ func (c *Controller) AppendInstanceHandler(f func(*model.ServiceInstance, model.
 	return nil
 }
 
+// edsUpdate pushes the endpoints of a service, rate limited by Options.EDSUpdateMinInterval, or
+// batched with the others during the initial sync and EDS reconciles. All EDS updates of the
+// controller go through it, so that a delayed update never overwrites a newer one.
+func (c *Controller) edsUpdate(hostname host.Name, namespace string, endpoints []*model.IstioEndpoint) {
+	c.pushEDS(hostname, namespace, endpoints)
+	c.updateAliasesEDS(hostname)
+}
+
+// pushEDS is edsUpdate without refreshing the endpoints of the aliases of the service.
+func (c *Controller) pushEDS(hostname host.Name, namespace string, endpoints []*model.IstioEndpoint) {
+	c.endpointMetrics.record(hostname, c.countEndpoints(namespace, endpoints))
+	// The accounts of all the endpoints are accepted, including those beyond the limit.
+	accountsChanged := c.serviceAccounts.record(hostname, endpoints)
+	c.localityBackfill.record(hostname, endpoints)
+	endpoints = c.limitEndpoints(hostname, endpoints)
+	c.trackPushedEndpoints(hostname, namespace, endpoints)
+	c.edsBatcher.update(string(hostname), namespace, endpoints)
+	if accountsChanged {
+		c.onServiceAccountsChange(hostname, namespace)
+	}
+}
+
+// isProxyUnreadyEndpoint reports whether the endpoints of the pod are dropped because its proxy
+// container is not ready.
+func (c *Controller) isProxyUnreadyEndpoint(pod *v1.Pod) bool {
+	return c.endpointOptions.excludeProxyUnready && pod != nil && isProxyUnready(pod, c.endpointOptions.proxyContainerName)
+}
+
 // TODO: This code will return only the k8s pods but we actually need to return k8s pods and workload entries
 func (c *Controller) updateEDS(ep *v1.Endpoints, event model.Event) {
-	hostname := kube.ServiceHostname(ep.Name, ep.Namespace, c.domainSuffix)
+	hostname := c.endpointsHostname(ep.Name, ep.Namespace)
 
-	c.RLock()
-	svc := c.servicesMap[hostname]
-	c.RUnlock()
+	svc := c.endpointsService(hostname, event)
 	if svc == nil {
-		log.Infof("Handle EDS endpoints: skip updating, service %s/%s has not been populated", ep.Name, ep.Namespace)
+		if event == model.EventDelete {
+			// The service was deleted first and its endpoints were cleared with it, this only
+			// makes sure that none are left for the hostname.
+			c.takeSkippedEndpoints(hostname)
+			c.clearPushedEndpoints(hostname)
+			return
+		}
+		if !c.isSkippedService(hostname) {
+			log.Infof("Handle EDS endpoints: skip updating, service %s/%s has not been populated", ep.Name, ep.Namespace)
+		}
 		return
 	}
+	controlPlane := c.isControlPlaneService(svc)
 	endpoints := make([]*model.IstioEndpoint, 0)
+	notReady := 0
 	if event != model.EventDelete {
-		for _, ss := range ep.Subsets {
-			for _, ea := range ss.Addresses {
-				pod := c.pods.getPodByIP(ea.IP)
-				if pod == nil {
-					// This means, the endpoint event has arrived before pod event. This might happen because
-					// PodCache is eventually consistent. We should try to get the pod from kube-api server.
-					if ea.TargetRef != nil && ea.TargetRef.Kind == "Pod" {
-						pod = c.pods.getPod(ea.TargetRef.Name, ea.TargetRef.Namespace)
-						if pod == nil {
-							// If pod is still not available, this an unusual case.
-							endpointsWithNoPods.Increment()
-							log.Errorf("Endpoint without pod %s %s.%s", ea.IP, ep.Name, ep.Namespace)
-							if c.metrics != nil {
-								c.metrics.AddMetric(model.EndpointNoPod, string(hostname), nil, ea.IP)
-							}
-							continue
-						}
-					}
-				}
-
-				builder := NewEndpointBuilder(c, pod)
-
-				// EDS and ServiceEntry use name for service port - ADS will need to
-				// map to numbers.
-				for _, port := range ss.Ports {
-					istioEndpoint := builder.buildIstioEndpoint(ea.IP, port.Port, port.Name)
-					endpoints = append(endpoints, istioEndpoint)
-				}
-			}
-		}
+		endpoints, notReady = c.buildEndpoints(ep, svc, controlPlane)
+	} else {
+		c.endpointPortDiagnostics.set(hostname, ep.Name, nil)
+		c.rejectedEndpoints.set(c.clusterID, hostname, endpointsSource(ep), nil)
 	}
 
 	log.Debugf("Handle EDS: %d endpoints for %s in namespace %s", len(endpoints), ep.Name, ep.Namespace)
 
 	fep := c.collectAllForeignEndpoints(svc)
 
-	_ = c.xdsUpdater.EDSUpdate(c.clusterID, string(hostname), ep.Namespace, append(endpoints, fep...))
+	// The endpoints of the external EndpointSlices of the service are added to those of its Endpoints.
+	local := endpoints
+	if external := c.externalEndpointSlices(); external != nil {
+		local = external.merge(hostname, endpoints)
+		notReady += external.endpointCache.NotReady(hostname)
+	}
+	c.recordEndpointsVersion(hostname, ep.ResourceVersion)
+	c.trackLocalEndpoints(hostname, ep.Name, ep.Namespace, len(local) > 0)
+	c.endpointMetrics.setNotReady(hostname, notReady)
+	c.edsUpdate(hostname, ep.Namespace, append(local, fep...))
+	if controlPlane {
+		// Instance handlers could route traffic to the control plane through the mesh.
+		return
+	}
 	// fire instance handles for k8s endpoints only
+	c.fireInstanceHandlers(svc, endpoints, event)
+}
+
+// endpointsService returns the service of the hostname of an endpoints event. When the service is
+// not in servicesMap, the hostname of an event other than a delete is recorded as skipped, in the
+// same critical section as the lookup, so that the add of the service cannot miss it.
+func (c *Controller) endpointsService(hostname host.Name, event model.Event) *model.Service {
+	c.RLock()
+	svc := c.servicesMap[hostname]
+	c.RUnlock()
+	if svc != nil || event == model.EventDelete {
+		return svc
+	}
+	c.Lock()
+	defer c.Unlock()
+	svc = c.servicesMap[hostname]
+	if svc == nil {
+		c.skippedEndpoints[hostname] = struct{}{}
+	}
+	return svc
+}
+
+// skipEndpoints records that the endpoints of the hostname have to be built when its service is
+// added.
+func (c *Controller) skipEndpoints(hostname host.Name) {
+	c.Lock()
+	defer c.Unlock()
+	c.skippedEndpoints[hostname] = struct{}{}
+}
+
+// takeSkippedEndpoints reports whether the endpoints of the hostname were skipped, and forgets it.
+func (c *Controller) takeSkippedEndpoints(hostname host.Name) bool {
+	c.Lock()
+	defer c.Unlock()
+	_, f := c.skippedEndpoints[hostname]
+	delete(c.skippedEndpoints, hostname)
+	return f
+}
+
+// fireInstanceHandlers calls the instance handlers with the endpoints of the service.
+func (c *Controller) fireInstanceHandlers(svc *model.Service, endpoints []*model.IstioEndpoint, event model.Event) {
 	for _, handler := range c.instanceHandlers {
 		for _, ep := range endpoints {
 			si := &model.ServiceInstance{
@@ -1219,6 +2743,63 @@ func (c *Controller) updateEDS(ep *v1.Endpoints, event model.Event) {
 	}
 }
 
+// buildEndpoints converts the ready addresses of the endpoints of the service, returning them and
+// the number of addresses left out as not ready.
+func (c *Controller) buildEndpoints(ep *v1.Endpoints, svc *model.Service,
+	controlPlane bool) (endpoints []*model.IstioEndpoint, notReady int) {
+	hostname := svc.Hostname
+	size := 0
+	for _, ss := range ep.Subsets {
+		size += len(ss.Addresses) * len(ss.Ports)
+	}
+	endpoints = make([]*model.IstioEndpoint, 0, size)
+	// A pod is listed once per subset of its ports, its metadata is only derived once.
+	builders := newEndpointBuilders(c, c.getServicePrometheusScrape(hostname))
+	ports := c.newEndpointPortChecker(svc, ep.Name)
+	defer c.recordEndpointPorts(ports)
+	addresses := c.newEndpointAddressFilter(hostname, endpointsSource(ep))
+	defer addresses.record()
+	for _, ss := range ep.Subsets {
+		notReady += len(ss.NotReadyAddresses)
+		for _, ea := range ss.Addresses {
+			if !addresses.accept(ea.IP) {
+				continue
+			}
+			// The endpoint event may arrive before the pod event, the pod is then looked up by reference.
+			pod, missing := c.getEndpointPod(ea.IP, ea.TargetRef)
+			if missing {
+				// If pod is still not available, this an unusual case.
+				endpointsWithNoPods.Increment()
+				log.Errorf("Endpoint without pod %s %s.%s", ea.IP, ep.Name, ep.Namespace)
+				if c.metrics != nil {
+					c.metrics.AddMetric(model.EndpointNoPod, string(hostname), nil, ea.IP)
+				}
+				continue
+			}
+			if c.isProxyUnreadyEndpoint(pod) {
+				notReady++
+				continue
+			}
+
+			builder := builders.forPod(pod)
+
+			// EDS and ServiceEntry use name for service port - ADS will need to
+			// map to numbers.
+			for _, port := range ss.Ports {
+				if !ports.accept(port.Name, port.Port) || !ports.acceptReserved(pod, port.Name, port.Port) {
+					continue
+				}
+				istioEndpoint := builder.buildIstioEndpoint(ea.IP, port.Port, port.Name)
+				istioEndpoint.HostName = endpointHostName(ea.Hostname, svc)
+				istioEndpoint.ClusterLocal = svc.Attributes.ClusterLocal
+				istioEndpoint.ControlPlane = controlPlane
+				endpoints = append(endpoints, istioEndpoint)
+			}
+		}
+	}
+	return endpoints, notReady
+}
+
 // namedRangerEntry for holding network's CIDR and name
 type namedRangerEntry struct {
 	name    string
@@ -1235,11 +2816,17 @@ func (n namedRangerEntry) Network() net.IPNet {
 func (c *Controller) initNetworkLookup() {
 	meshNetworks := c.networksWatcher.Networks()
 	if meshNetworks == nil || len(meshNetworks.Networks) == 0 {
+		// Without mesh networks, the network label of the system namespace applies.
+		c.setRegistryNetwork(func() {
+			c.networkSources.meshNetworkForRegistry = ""
+			c.networkSources.meshNetworkRanger = nil
+		})
 		return
 	}
 
-	c.ranger = cidranger.NewPCTrieRanger()
+	ranger := cidranger.NewPCTrieRanger()
 
+	registryNetwork := ""
 	for n, v := range meshNetworks.Networks {
 		for _, ep := range v.Endpoints {
 			if ep.GetFromCidr() != "" {
@@ -1252,41 +2839,22 @@ func (c *Controller) initNetworkLookup() {
 					name:    n,
 					network: *network,
 				}
-				_ = c.ranger.Insert(rangerEntry)
+				_ = ranger.Insert(rangerEntry)
 			}
 			if ep.GetFromRegistry() != "" && ep.GetFromRegistry() == c.clusterID {
-				c.networkForRegistry = n
+				registryNetwork = n
 			}
 		}
 	}
+	c.setRegistryNetwork(func() {
+		c.networkSources.meshNetworkForRegistry = registryNetwork
+		c.networkSources.meshNetworkRanger = ranger
+	})
 }
 
 // return the mesh network for the endpoint IP. Empty string if not found.
 func (c *Controller) endpointNetwork(endpointIP string) string {
-	// If networkForRegistry is set then all endpoints discovered by this registry
-	// belong to the configured network so simply return it
-	if len(c.networkForRegistry) != 0 {
-		return c.networkForRegistry
-	}
-
-	// Try to determine the network by checking whether the endpoint IP belongs
-	// to any of the configure networks' CIDR ranges
-	if c.ranger == nil {
-		return ""
-	}
-	entries, err := c.ranger.ContainingNetworks(net.ParseIP(endpointIP))
-	if err != nil {
-		log.Errora(err)
-		return ""
-	}
-	if len(entries) == 0 {
-		return ""
-	}
-	if len(entries) > 1 {
-		log.Warnf("Found multiple networks CIDRs matching the endpoint IP: %s. Using the first match.", endpointIP)
-	}
-
-	return (entries[0].(namedRangerEntry)).name
+	return c.networkLookup().endpointNetwork(endpointIP)
 }
 
 // Forked from Kubernetes k8s.io/kubernetes/pkg/api/v1/pod
@@ -1313,6 +2881,44 @@ func FindPort(pod *v1.Pod, svcPort *v1.ServicePort) (int, error) {
 	return 0, fmt.Errorf("no suitable port for manifest: %s", pod.UID)
 }
 
-func createUID(podName, namespace string) string {
-	return "kubernetes://" + podName + "." + namespace
+const uidPrefix = "kubernetes://"
+
+// createUID returns the workload UID of a pod, "kubernetes://<pod>.<namespace>", followed by
+// "/<cluster>" when clusterID is set.
+func createUID(podName, namespace, clusterID string) string {
+	uid := uidPrefix + podName + "." + namespace
+	if clusterID != "" {
+		uid += "/" + clusterID
+	}
+	return uid
+}
+
+// ParseUID splits a workload UID built by the controller into the pod name, namespace and cluster
+// ID. The cluster ID is empty for UIDs built without one.
+func ParseUID(uid string) (podName, namespace, clusterID string, err error) {
+	if !strings.HasPrefix(uid, uidPrefix) {
+		return "", "", "", fmt.Errorf("invalid workload UID %q: missing %q prefix", uid, uidPrefix)
+	}
+	rest := strings.TrimPrefix(uid, uidPrefix)
+	if i := strings.Index(rest, "/"); i >= 0 {
+		rest, clusterID = rest[:i], rest[i+1:]
+		if clusterID == "" {
+			return "", "", "", fmt.Errorf("invalid workload UID %q: empty cluster ID", uid)
+		}
+	}
+	// Namespaces cannot contain dots, pod names can.
+	i := strings.LastIndex(rest, ".")
+	if i <= 0 || i == len(rest)-1 {
+		return "", "", "", fmt.Errorf("invalid workload UID %q: expected <pod>.<namespace>", uid)
+	}
+	return rest[:i], rest[i+1:], clusterID, nil
+}
+
+// podUID returns the workload UID of the pod, including the cluster ID if configured.
+func (c *Controller) podUID(pod *v1.Pod) string {
+	clusterID := ""
+	if c.endpointOptions.uidIncludesClusterID {
+		clusterID = c.clusterID
+	}
+	return createUID(pod.Name, pod.Namespace, clusterID)
 }
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"reflect"
 	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -42,11 +43,15 @@ import (
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/serviceregistry"
 	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/constants"
+	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/labels"
 	"istio.io/istio/pkg/config/mesh"
 	"istio.io/istio/pkg/config/protocol"
+	"istio.io/istio/pkg/queue"
 	"istio.io/istio/pkg/spiffe"
 	"istio.io/istio/pkg/test"
+	"istio.io/istio/pkg/test/util/retry"
 )
 
 const (
@@ -55,9 +60,9 @@ const (
 	domainSuffix = "company.com"
 )
 
-func (fx *FakeXdsUpdater) ConfigUpdate(*model.PushRequest) {
+func (fx *FakeXdsUpdater) ConfigUpdate(req *model.PushRequest) {
 	select {
-	case fx.Events <- XdsEvent{Type: "xds"}:
+	case fx.Events <- XdsEvent{Type: "xds", ConfigsUpdated: req.ConfigsUpdated}:
 	default:
 	}
 }
@@ -73,6 +78,11 @@ func (fx *FakeXdsUpdater) ProxyUpdate(_, _ string) {
 type FakeXdsUpdater struct {
 	// Events tracks notifications received by the updater
 	Events chan XdsEvent
+
+	// mu protects endpoints, the endpoints of the last EDS update of each hostname, including the
+	// empty updates, which are not sent to Events.
+	mu        sync.Mutex
+	endpoints map[string][]*model.IstioEndpoint
 }
 
 // XdsEvent is used to watch XdsEvents
@@ -85,16 +95,24 @@ type XdsEvent struct {
 
 	// The endpoints associated with an EDS push if any
 	Endpoints []*model.IstioEndpoint
+
+	// The configs updated by a full push if any
+	ConfigsUpdated map[model.ConfigKey]struct{}
+
+	// Batched is set for the EDS updates submitted by EDSBatchUpdate
+	Batched bool
 }
 
 // NewFakeXDS creates a XdsUpdater reporting events via a channel.
 func NewFakeXDS() *FakeXdsUpdater {
 	return &FakeXdsUpdater{
-		Events: make(chan XdsEvent, 100),
+		Events:    make(chan XdsEvent, 100),
+		endpoints: make(map[string][]*model.IstioEndpoint),
 	}
 }
 
 func (fx *FakeXdsUpdater) EDSUpdate(_, hostname string, _ string, entry []*model.IstioEndpoint) error {
+	fx.recordEDS(hostname, entry)
 	if len(entry) > 0 {
 		select {
 		case fx.Events <- XdsEvent{Type: "eds", ID: hostname, Endpoints: entry}:
@@ -105,6 +123,34 @@ func (fx *FakeXdsUpdater) EDSUpdate(_, hostname string, _ string, entry []*model
 	return nil
 }
 
+// EDSBatchUpdate reports each entry as an EDS update.
+func (fx *FakeXdsUpdater) EDSBatchUpdate(_ string, entries []model.EDSUpdateEntry) error {
+	for _, e := range entries {
+		fx.recordEDS(e.Hostname, e.Endpoints)
+		if len(e.Endpoints) > 0 {
+			select {
+			case fx.Events <- XdsEvent{Type: "eds", ID: e.Hostname, Endpoints: e.Endpoints, Batched: true}:
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+func (fx *FakeXdsUpdater) recordEDS(hostname string, endpoints []*model.IstioEndpoint) {
+	fx.mu.Lock()
+	defer fx.mu.Unlock()
+	fx.endpoints[hostname] = endpoints
+}
+
+// LastEDS returns the endpoints of the last EDS update of the hostname, and whether it had one.
+func (fx *FakeXdsUpdater) LastEDS(hostname string) ([]*model.IstioEndpoint, bool) {
+	fx.mu.Lock()
+	defer fx.mu.Unlock()
+	endpoints, f := fx.endpoints[hostname]
+	return endpoints, f
+}
+
 // SvcUpdate is called when a service port mapping definition is updated.
 // This interface is WIP - labels, annotations and other changes to service may be
 // updated to force a EDS and CDS recomputation and incremental push, as it doesn't affect
@@ -149,12 +195,35 @@ type fakeControllerOptions struct {
 	mode              EndpointMode
 	clusterID         string
 	watchedNamespaces string
+
+	clusterLocalHostnames []string
+	meshWatcher           mesh.Watcher
+	nodeLabelsToCopy      []string
+	excludeProxyUnready   bool
+	uidIncludesClusterID  bool
+	fairQueueing          bool
+	domainSuffixes        map[string]string
+	endpointMetrics       bool
+	legacyNodeSelectors   bool
+	truncateHostnames     bool
+	writeLockThreshold    time.Duration
+	permissivePorts       bool
+	maxEndpoints          int
+	maxGatewayAddresses   int
+	endpointLimitEvents   bool
+	eventNamespaceMetrics bool
+	serviceFilter         func(*coreV1.Service) bool
+	mcsMode               MCSMode
+	// crossNamespaceEndpoints is Options.CrossNamespaceEndpointNamespaces.
+	crossNamespaceEndpoints []string
+	// objects are created in the fake client before the controller starts.
+	objects []runtime.Object
 }
 
 func newFakeControllerWithOptions(opts fakeControllerOptions) (*Controller, *FakeXdsUpdater) {
 	fx := NewFakeXDS()
 
-	clientSet := fake.NewSimpleClientset()
+	clientSet := fake.NewSimpleClientset(opts.objects...)
 	scheme := runtime.NewScheme()
 	metaV1.AddMetaToScheme(scheme)
 	metadataClient := metafake.NewSimpleMetadataClient(scheme)
@@ -168,6 +237,28 @@ func newFakeControllerWithOptions(opts fakeControllerOptions) (*Controller, *Fak
 		NetworksWatcher:   opts.networksWatcher,
 		EndpointMode:      opts.mode,
 		ClusterID:         opts.clusterID,
+
+		ClusterLocalHostnames: opts.clusterLocalHostnames,
+		MeshWatcher:           opts.meshWatcher,
+		NodeLabelsToCopy:      opts.nodeLabelsToCopy,
+
+		ExcludeProxyUnreadyEndpoints: opts.excludeProxyUnready,
+		UIDIncludesClusterID:         opts.uidIncludesClusterID,
+		FairQueueing:                 opts.fairQueueing,
+		NamespaceDomainSuffixes:      opts.domainSuffixes,
+		ServiceEndpointMetrics:       opts.endpointMetrics,
+		LegacyNodeSelectorParsing:    opts.legacyNodeSelectors,
+		TruncateLongHostnames:        opts.truncateHostnames,
+		WriteLockHoldThreshold:       opts.writeLockThreshold,
+		PermissiveEndpointPorts:      opts.permissivePorts,
+		MaxEndpointsPerService:       opts.maxEndpoints,
+		MaxGatewayAddresses:          opts.maxGatewayAddresses,
+		EndpointLimitEvents:          opts.endpointLimitEvents,
+		EventNamespaceMetrics:        opts.eventNamespaceMetrics,
+		ServiceFilterFunc:            opts.serviceFilter,
+		MCSMode:                      opts.mcsMode,
+
+		CrossNamespaceEndpointNamespaces: opts.crossNamespaceEndpoints,
 	})
 
 	if opts.instanceHandler != nil {
@@ -181,7 +272,7 @@ func newFakeControllerWithOptions(opts fakeControllerOptions) (*Controller, *Fak
 	// TODO: fix it, so we can remove `stop` channel
 	go c.Run(c.stop)
 	// Wait for the caches to sync, otherwise we may hit race conditions where events are dropped
-	cache.WaitForCacheSync(c.stop, c.nodeMetadataInformer.HasSynced, c.pods.informer.HasSynced,
+	cache.WaitForCacheSync(c.stop, c.nodesSynced, c.pods.informer.HasSynced,
 		c.serviceInformer.HasSynced)
 	return c, fx
 }
@@ -636,6 +727,9 @@ func TestGetProxyServiceInstances(t *testing.T) {
 					Labels:         labels.Instance{"app": "prod-app"},
 					ServiceAccount: "spiffe://cluster.local/ns/nsa/sa/svcaccount",
 					TLSMode:        model.DisabledTLSModeLabel, UID: "kubernetes://pod2.nsa",
+					WorkloadName: "pod2",
+					Namespace:    "nsa",
+					NodeName:     "node1",
 				},
 			}
 			if len(podServices) != 1 {
@@ -696,6 +790,9 @@ func TestGetProxyServiceInstances(t *testing.T) {
 					ServiceAccount: "spiffe://cluster.local/ns/nsa/sa/svcaccount",
 					TLSMode:        model.DisabledTLSModeLabel,
 					UID:            "kubernetes://pod3.nsa",
+					WorkloadName:   "pod3",
+					Namespace:      "nsa",
+					NodeName:       "node1",
 				},
 			}
 			if len(podServices) != 1 {
@@ -1195,17 +1292,21 @@ func TestController_ExternalNameService(t *testing.T) {
 	}
 }
 
-func TestCompareEndpoints(t *testing.T) {
+type compareEndpointsCase struct {
+	name string
+	a    *coreV1.Endpoints
+	b    *coreV1.Endpoints
+	want bool
+}
+
+// compareEndpointsCorpus returns the cases of TestCompareEndpoints, which
+// TestCompareEndpointsReflect also checks against the comparison by reflection.
+func compareEndpointsCorpus() []compareEndpointsCase {
 	addressA := coreV1.EndpointAddress{IP: "1.2.3.4", Hostname: "a"}
 	addressB := coreV1.EndpointAddress{IP: "1.2.3.4", Hostname: "b"}
 	portA := coreV1.EndpointPort{Name: "a"}
 	portB := coreV1.EndpointPort{Name: "b"}
-	cases := []struct {
-		name string
-		a    *coreV1.Endpoints
-		b    *coreV1.Endpoints
-		want bool
-	}{
+	return []compareEndpointsCase{
 		{"both empty", &coreV1.Endpoints{}, &coreV1.Endpoints{}, true},
 		{
 			"just not ready endpoints",
@@ -1258,8 +1359,157 @@ func TestCompareEndpoints(t *testing.T) {
 			}},
 			false,
 		},
+		{
+			"reordered subsets",
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{addressA}, Ports: []coreV1.EndpointPort{portA}},
+				{Addresses: []coreV1.EndpointAddress{addressB}, Ports: []coreV1.EndpointPort{portB}},
+			}},
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{addressB}, Ports: []coreV1.EndpointPort{portB}},
+				{Addresses: []coreV1.EndpointAddress{addressA}, Ports: []coreV1.EndpointPort{portA}},
+			}},
+			true,
+		},
+		{
+			"reordered addresses and ports",
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{addressA, addressB}, Ports: []coreV1.EndpointPort{portA, portB}},
+			}},
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{addressB, addressA}, Ports: []coreV1.EndpointPort{portB, portA}},
+			}},
+			true,
+		},
+		{
+			"reordered subsets with different ports",
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{addressA}, Ports: []coreV1.EndpointPort{portA}},
+				{Addresses: []coreV1.EndpointAddress{addressB}, Ports: []coreV1.EndpointPort{portB}},
+			}},
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{addressA}, Ports: []coreV1.EndpointPort{portB}},
+				{Addresses: []coreV1.EndpointAddress{addressB}, Ports: []coreV1.EndpointPort{portA}},
+			}},
+			false,
+		},
+		{
+			"different node names",
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{withNodeName(addressA, "node1")}},
+			}},
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{withNodeName(addressA, "node2")}},
+			}},
+			false,
+		},
+		{
+			"same node names",
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{withNodeName(addressA, "node1")}},
+			}},
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{withNodeName(addressA, "node1")}},
+			}},
+			true,
+		},
+		{
+			"different target refs",
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{withTargetRef(addressA, "pod1", "1")}},
+			}},
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{withTargetRef(addressA, "pod2", "1")}},
+			}},
+			false,
+		},
+		{
+			"target ref resource version",
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{withTargetRef(addressA, "pod1", "1")}},
+			}},
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{withTargetRef(addressA, "pod1", "2")}},
+			}},
+			false,
+		},
+		{
+			"missing target ref",
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{withTargetRef(addressA, "pod1", "1")}},
+			}},
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{addressA}},
+			}},
+			false,
+		},
+		{
+			"reordered addresses with target refs",
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{withTargetRef(addressA, "pod1", "1"), withTargetRef(addressB, "pod2", "1")}},
+			}},
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{withTargetRef(addressB, "pod2", "1"), withTargetRef(addressA, "pod1", "1")}},
+			}},
+			true,
+		},
+		{
+			"different app protocols",
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{addressA}, Ports: []coreV1.EndpointPort{withAppProtocol(portA, "http")}},
+			}},
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{addressA}, Ports: []coreV1.EndpointPort{portA}},
+			}},
+			false,
+		},
+		{
+			"different port protocols",
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{addressA}, Ports: []coreV1.EndpointPort{{Name: "a", Protocol: coreV1.ProtocolUDP}}},
+			}},
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{addressA}, Ports: []coreV1.EndpointPort{{Name: "a", Protocol: coreV1.ProtocolTCP}}},
+			}},
+			false,
+		},
+		{
+			"empty and nil addresses",
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{
+				{Addresses: []coreV1.EndpointAddress{}, Ports: []coreV1.EndpointPort{}},
+			}},
+			&coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{{}}},
+			true,
+		},
 	}
-	for _, tt := range cases {
+}
+
+func withNodeName(address coreV1.EndpointAddress, node string) coreV1.EndpointAddress {
+	address.NodeName = &node
+	return address
+}
+
+func withTargetRef(address coreV1.EndpointAddress, pod, resourceVersion string) coreV1.EndpointAddress {
+	address.TargetRef = &coreV1.ObjectReference{Kind: "Pod", Namespace: "nsA", Name: pod, ResourceVersion: resourceVersion}
+	return address
+}
+
+func withAppProtocol(port coreV1.EndpointPort, appProtocol string) coreV1.EndpointPort {
+	port.AppProtocol = &appProtocol
+	return port
+}
+
+// compareEndpointsReflect is the comparison of compareEndpoints by reflection, which it must
+// agree with.
+func compareEndpointsReflect(a, b *coreV1.Endpoints) bool {
+	if len(a.Subsets) != len(b.Subsets) {
+		return false
+	}
+	return reflect.DeepEqual(canonicalSubsets(a.Subsets), canonicalSubsets(b.Subsets))
+}
+
+func TestCompareEndpoints(t *testing.T) {
+	for _, tt := range compareEndpointsCorpus() {
 		t.Run(tt.name, func(t *testing.T) {
 			got := compareEndpoints(tt.a, tt.b)
 			inverse := compareEndpoints(tt.b, tt.a)
@@ -1273,6 +1523,64 @@ func TestCompareEndpoints(t *testing.T) {
 	}
 }
 
+func TestCompareEndpointsReflect(t *testing.T) {
+	corpus := compareEndpointsCorpus()
+	// Every pair of the corpus is compared, not only the pairs of the cases.
+	var all []*coreV1.Endpoints
+	for _, tt := range corpus {
+		all = append(all, tt.a, tt.b)
+	}
+	for i, a := range all {
+		for j, b := range all {
+			if got, want := compareEndpoints(a, b), compareEndpointsReflect(a, b); got != want {
+				t.Fatalf("compareEndpoints(%s, %s) = %v, the comparison by reflection gives %v",
+					corpus[i/2].name, corpus[j/2].name, got, want)
+			}
+		}
+	}
+}
+
+func BenchmarkCompareEndpoints(b *testing.B) {
+	addresses := make([]coreV1.EndpointAddress, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		addresses = append(addresses, withTargetRef(
+			withNodeName(coreV1.EndpointAddress{IP: fmt.Sprintf("10.0.%d.%d", i/256, i%256)}, fmt.Sprintf("node%d", i%10)),
+			fmt.Sprintf("pod%d", i), "1"))
+	}
+	old := &coreV1.Endpoints{Subsets: []coreV1.EndpointSubset{{
+		Addresses: addresses,
+		Ports:     []coreV1.EndpointPort{{Name: "http", Port: 8080}, {Name: "grpc", Port: 9090}},
+	}}}
+	reordered := old.DeepCopy()
+	reordered.Subsets[0].Addresses[0], reordered.Subsets[0].Addresses[999] = reordered.Subsets[0].Addresses[999], reordered.Subsets[0].Addresses[0]
+	changed := old.DeepCopy()
+	changed.Subsets[0].Addresses[500].IP = "10.1.0.0"
+
+	for _, bc := range []struct {
+		name string
+		cur  *coreV1.Endpoints
+	}{
+		{"resync", old.DeepCopy()},
+		{"reordered", reordered},
+		{"changed", changed},
+	} {
+		for _, cmp := range []struct {
+			name    string
+			compare func(a, b *coreV1.Endpoints) bool
+		}{
+			{"reflect", compareEndpointsReflect},
+			{"fields", compareEndpoints},
+		} {
+			b.Run(bc.name+"/"+cmp.name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					_ = cmp.compare(old, bc.cur)
+				}
+			})
+		}
+	}
+}
+
 func createEndpoints(controller *Controller, name, namespace string, portNames, ips []string, t *testing.T) {
 	var portNum int32 = 1001
 	eas := make([]coreV1.EndpointAddress, 0)
@@ -1600,25 +1908,21 @@ func TestEndpointUpdate(t *testing.T) {
 	for mode, name := range EndpointModeNames {
 		mode := mode
 		t.Run(name, func(t *testing.T) {
-			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: mode})
+			controller, fx := newFakeHarness(t, Options{EndpointMode: mode})
 			defer controller.Stop()
 
 			pod1 := generatePod("128.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "prod-app"}, map[string]string{})
-			pods := []*coreV1.Pod{pod1}
-			addPods(t, controller, pods...)
-			for _, pod := range pods {
-				if err := waitForPod(controller, pod.Status.PodIP); err != nil {
-					t.Fatalf("wait for pod err: %v", err)
-				}
-				// pod first time occur will trigger proxy push
-				if ev := fx.Wait("proxy"); ev == nil {
-					t.Fatal("Timeout creating service")
-				}
+			addPodsSync(t, controller, pod1)
+			// pod first time occur will trigger proxy push
+			if ev := fx.Wait("proxy"); ev == nil {
+				t.Fatal("Timeout creating service")
 			}
 
 			// 1. incremental eds for normal service endpoint update
-			createService(controller, "svc1", "nsa", nil,
-				[]int32{8080}, map[string]string{"app": "prod-app"}, t)
+			do(t, controller, func() {
+				createService(controller.Controller, "svc1", "nsa", nil,
+					[]int32{8080}, map[string]string{"app": "prod-app"}, t)
+			})
 			if ev := fx.Wait("service"); ev == nil {
 				t.Fatal("Timeout creating service")
 			}
@@ -1628,16 +1932,20 @@ func TestEndpointUpdate(t *testing.T) {
 			svc1Ips := []string{"128.0.0.1"}
 			portNames := []string{"tcp-port"}
 			// Create 1 endpoint that refers to a pod in the same namespace.
-			createEndpoints(controller, "svc1", "nsa", portNames, svc1Ips, t)
+			do(t, controller, func() {
+				createEndpoints(controller.Controller, "svc1", "nsa", portNames, svc1Ips, t)
+			})
 			if ev := fx.Wait("eds"); ev == nil {
 				t.Fatalf("Timeout incremental eds")
 			}
 
 			// delete normal service
-			err := controller.client.CoreV1().Services("nsa").Delete(context.TODO(), "svc1", metaV1.DeleteOptions{})
-			if err != nil {
-				t.Fatalf("Cannot delete service (error: %v)", err)
-			}
+			do(t, controller, func() {
+				err := controller.Client.CoreV1().Services("nsa").Delete(context.TODO(), "svc1", metaV1.DeleteOptions{})
+				if err != nil {
+					t.Fatalf("Cannot delete service (error: %v)", err)
+				}
+			})
 			if ev := fx.Wait("service"); ev == nil {
 				t.Fatalf("Timeout deleting service")
 			}
@@ -1645,15 +1953,19 @@ func TestEndpointUpdate(t *testing.T) {
 			// 2. full xds push request for headless service endpoint update
 
 			// create a headless service
-			createServiceWithoutClusterIP(controller, "svc1", "nsa", nil,
-				[]int32{8080}, map[string]string{"app": "prod-app"}, t)
+			do(t, controller, func() {
+				createServiceWithoutClusterIP(controller.Controller, "svc1", "nsa", nil,
+					[]int32{8080}, map[string]string{"app": "prod-app"}, t)
+			})
 			if ev := fx.Wait("service"); ev == nil {
 				t.Fatalf("Timeout creating service")
 			}
 
 			// Create 1 endpoint that refers to a pod in the same namespace.
 			svc1Ips = append(svc1Ips, "128.0.0.2")
-			updateEndpoints(controller, "svc1", "nsa", portNames, svc1Ips, t)
+			do(t, controller, func() {
+				updateEndpoints(controller.Controller, "svc1", "nsa", portNames, svc1Ips, t)
+			})
 			if ev := fx.Wait("xds"); ev == nil {
 				t.Fatalf("Timeout xds push")
 			}
@@ -1830,3 +2142,2552 @@ func TestForeignServiceInstanceHandlerMultipleEndpoints(t *testing.T) {
 		}
 	}
 }
+
+// fakeMeshWatcher is a mesh.Watcher whose config can be replaced by tests.
+type fakeMeshWatcher struct {
+	mu       sync.Mutex
+	mesh     *meshconfig.MeshConfig
+	handlers []func()
+}
+
+func (w *fakeMeshWatcher) Mesh() *meshconfig.MeshConfig {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.mesh
+}
+
+func (w *fakeMeshWatcher) AddMeshHandler(h func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.handlers = append(w.handlers, h)
+}
+
+func (w *fakeMeshWatcher) setMesh(m *meshconfig.MeshConfig) {
+	w.mu.Lock()
+	w.mesh = m
+	handlers := append([]func(){}, w.handlers...)
+	w.mu.Unlock()
+	for _, h := range handlers {
+		h()
+	}
+}
+
+func clusterLocalMesh(hosts ...string) *meshconfig.MeshConfig {
+	return &meshconfig.MeshConfig{
+		ServiceSettings: []*meshconfig.MeshConfig_ServiceSettings{
+			{
+				Settings: &meshconfig.MeshConfig_ServiceSettings_Settings{
+					ClusterLocal: true,
+				},
+				Hosts: hosts,
+			},
+		},
+	}
+}
+
+func TestClusterLocalServices(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			meshWatcher := &fakeMeshWatcher{mesh: clusterLocalMesh()}
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{
+				mode:                  mode,
+				clusterLocalHostnames: []string{"*.nsA.svc.company.com"},
+				meshWatcher:           meshWatcher,
+			})
+			defer controller.Stop()
+
+			pod := generatePod("128.0.0.1", "pod1", "nsB", "", "node1", map[string]string{"app": "prod-app"}, map[string]string{})
+			addPods(t, controller, pod)
+			if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+				t.Fatalf("wait for pod err: %v", err)
+			}
+
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createService(controller, "svc2", "nsB", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createEndpoints(controller, "svc2", "nsB", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+			ev := fx.Wait("eds")
+			if ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+			if ev.Endpoints[0].ClusterLocal {
+				t.Fatalf("expected endpoint of svc2 not to be cluster-local")
+			}
+
+			assertClusterLocal := func(hostname string, want bool) {
+				t.Helper()
+				retry.UntilSuccessOrFail(t, func() error {
+					svc, _ := controller.GetService(host.Name(hostname))
+					if svc == nil {
+						return fmt.Errorf("service %s not found", hostname)
+					}
+					if svc.Attributes.ClusterLocal != want {
+						return fmt.Errorf("service %s: got cluster-local %v, want %v", hostname, svc.Attributes.ClusterLocal, want)
+					}
+					return nil
+				}, retry.Timeout(5*time.Second))
+			}
+			assertClusterLocal("svc1.nsA.svc.company.com", true)
+			assertClusterLocal("svc2.nsB.svc.company.com", false)
+
+			// Mark svc2 cluster-local through the mesh config; it should be re-converted and its
+			// endpoints re-pushed with the new tag.
+			fx.Clear()
+			meshWatcher.setMesh(clusterLocalMesh("svc2.nsB.svc.company.com"))
+			assertClusterLocal("svc2.nsB.svc.company.com", true)
+			if ev := fx.Wait("eds"); ev == nil || !ev.Endpoints[0].ClusterLocal {
+				t.Fatalf("expected cluster-local endpoints for svc2, got %v", ev)
+			}
+
+			// And flip it back.
+			meshWatcher.setMesh(clusterLocalMesh())
+			assertClusterLocal("svc2.nsB.svc.company.com", false)
+			assertClusterLocal("svc1.nsA.svc.company.com", true)
+		})
+	}
+}
+
+func TestClusterLocalServiceForeignInstance(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{
+				mode:                  mode,
+				clusterLocalHostnames: []string{"*.nsA.svc.company.com"},
+			})
+			defer controller.Stop()
+
+			pod := generatePod("128.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "prod-app"}, map[string]string{})
+			addPods(t, controller, pod)
+			if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+				t.Fatalf("wait for pod err: %v", err)
+			}
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+			if ev := fx.Wait("eds"); ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+
+			// The endpoints pushed for a workload entry keep the cluster-local tag of the service,
+			// for the endpoints of the other clusters not to be merged in.
+			fx.Clear()
+			controller.ForeignServiceInstanceHandler(&model.ServiceInstance{
+				Service: &model.Service{
+					Attributes: model.ServiceAttributes{Namespace: "nsA"},
+				},
+				Endpoint: &model.IstioEndpoint{Labels: labels.Instance{"app": "prod-app"},
+					Address:      "2.2.2.2",
+					EndpointPort: 8080,
+				},
+			}, model.EventAdd)
+			ev := fx.Wait("eds")
+			if ev == nil {
+				t.Fatal("Did not get eds event when workload entry was added")
+			}
+			if len(ev.Endpoints) != 2 {
+				t.Fatalf("got endpoints %v, want the pod and the workload entry", ev.Endpoints)
+			}
+			for _, ep := range ev.Endpoints {
+				if !ep.ClusterLocal {
+					t.Fatalf("endpoint %s of cluster-local service svc1 is not cluster-local", ep.Address)
+				}
+			}
+		})
+	}
+}
+
+func TestNodePortGatewayTransitions(t *testing.T) {
+	const clusterID = "cluster1"
+	nodePortGateway := func(svc *coreV1.Service) {
+		svc.Spec.Type = coreV1.ServiceTypeNodePort
+		svc.Annotations = map[string]string{kube.NodeSelectorAnnotation: "{}"}
+	}
+	clusterIP := func(svc *coreV1.Service) {
+		svc.Spec.Type = coreV1.ServiceTypeClusterIP
+	}
+	loadBalancer := func(svc *coreV1.Service) {
+		svc.Spec.Type = coreV1.ServiceTypeLoadBalancer
+		svc.Status.LoadBalancer.Ingress = []coreV1.LoadBalancerIngress{{IP: "5.5.5.5"}}
+	}
+
+	cases := []struct {
+		name      string
+		from      func(*coreV1.Service)
+		to        func(*coreV1.Service)
+		wantAddrs []string
+	}{
+		{"ClusterIP to NodePort gateway", clusterIP, nodePortGateway, []string{"1.2.3.4"}},
+		{"NodePort gateway to ClusterIP", nodePortGateway, clusterIP, nil},
+		{"LoadBalancer to NodePort gateway", loadBalancer, nodePortGateway, []string{"1.2.3.4"}},
+		{"NodePort gateway to LoadBalancer", nodePortGateway, loadBalancer, []string{"5.5.5.5"}},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{clusterID: clusterID})
+			defer controller.Stop()
+
+			node := &coreV1.Node{
+				ObjectMeta: metaV1.ObjectMeta{Name: "node1"},
+				Status: coreV1.NodeStatus{
+					Addresses: []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: "1.2.3.4"}},
+				},
+			}
+			if _, err := controller.client.CoreV1().Nodes().Create(context.TODO(), node, metaV1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			retry.UntilSuccessOrFail(t, func() error {
+				controller.RLock()
+				defer controller.RUnlock()
+				if _, f := controller.nodeInfoMap["node1"]; !f {
+					return fmt.Errorf("node not synced")
+				}
+				return nil
+			}, retry.Timeout(5*time.Second))
+
+			svc := &coreV1.Service{
+				ObjectMeta: metaV1.ObjectMeta{Name: "gateway", Namespace: "nsA"},
+				Spec: coreV1.ServiceSpec{
+					ClusterIP: "10.0.0.1",
+					Ports:     []coreV1.ServicePort{{Name: "tcp-port", Port: 8080, NodePort: 30080}},
+				},
+			}
+			tt.from(svc)
+			if _, err := controller.client.CoreV1().Services("nsA").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			fx.Clear()
+
+			svc = svc.DeepCopy()
+			svc.Annotations = nil
+			svc.Status = coreV1.ServiceStatus{}
+			tt.to(svc)
+			if _, err := controller.client.CoreV1().Services("nsA").Update(context.TODO(), svc, metaV1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			// Moving in or out of being a node port gateway triggers a full push.
+			if ev := fx.Wait("xds"); ev == nil {
+				t.Fatal("Timeout waiting for push")
+			}
+
+			hostname := kube.ServiceHostname("gateway", "nsA", domainSuffix)
+			retry.UntilSuccessOrFail(t, func() error {
+				converted, _ := controller.GetService(hostname)
+				if converted == nil {
+					return fmt.Errorf("service not found")
+				}
+				converted.Mutex.RLock()
+				got := converted.Attributes.ClusterExternalAddresses[clusterID]
+				converted.Mutex.RUnlock()
+				if !reflect.DeepEqual(got, tt.wantAddrs) {
+					return fmt.Errorf("got external addresses %v, want %v", got, tt.wantAddrs)
+				}
+				return nil
+			}, retry.Timeout(5*time.Second))
+
+			controller.RLock()
+			_, isGateway := controller.gateways.nodeSelectors[hostname]
+			controller.RUnlock()
+			if wantGateway := len(svc.Annotations) > 0; isGateway != wantGateway {
+				t.Fatalf("got node port gateway %v, want %v", isGateway, wantGateway)
+			}
+		})
+	}
+}
+
+func TestInstancesByPortName(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: mode})
+			defer controller.Stop()
+
+			// A single unnamed port.
+			createServiceWithTargetPorts(controller, "unnamed", "nsA", nil,
+				[]coreV1.ServicePort{{Port: 8080, Protocol: coreV1.ProtocolTCP}}, map[string]string{"app": "unnamed"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createEndpoints(controller, "unnamed", "nsA", []string{""}, []string{"10.1.1.1"}, t)
+
+			// Two ports sharing the same number.
+			createServiceWithTargetPorts(controller, "dns", "nsA", nil,
+				[]coreV1.ServicePort{
+					{Name: "dns-tcp", Port: 53, Protocol: coreV1.ProtocolTCP},
+					{Name: "dns-udp", Port: 53, Protocol: coreV1.ProtocolUDP},
+				}, map[string]string{"app": "dns"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createEndpoints(controller, "dns", "nsA", []string{"dns-tcp", "dns-udp"}, []string{"10.1.1.2"}, t)
+
+			getService := func(name string) *model.Service {
+				svc, _ := controller.GetService(kube.ServiceHostname(name, "nsA", domainSuffix))
+				if svc == nil {
+					t.Fatalf("service %s not found", name)
+				}
+				return svc
+			}
+			portNames := func(instances []*model.ServiceInstance) []string {
+				var out []string
+				for _, i := range instances {
+					out = append(out, i.ServicePort.Name)
+				}
+				return out
+			}
+
+			unnamed := getService("unnamed")
+			retry.UntilSuccessOrFail(t, func() error {
+				byName, _ := controller.InstancesByPortName(unnamed, "", labels.Collection{})
+				byPort, _ := controller.InstancesByPort(unnamed, 8080, labels.Collection{})
+				if len(byName) != 1 || len(byPort) != 1 {
+					return fmt.Errorf("got %d instances by name and %d by port, want 1", len(byName), len(byPort))
+				}
+				return nil
+			}, retry.Timeout(5*time.Second))
+
+			dns := getService("dns")
+			retry.UntilSuccessOrFail(t, func() error {
+				udp, _ := controller.InstancesByPortName(dns, "dns-udp", labels.Collection{})
+				if got := portNames(udp); !reflect.DeepEqual(got, []string{"dns-udp"}) {
+					return fmt.Errorf("got ports %v for dns-udp", got)
+				}
+				tcp, _ := controller.InstancesByPortName(dns, "dns-tcp", labels.Collection{})
+				if got := portNames(tcp); !reflect.DeepEqual(got, []string{"dns-tcp"}) {
+					return fmt.Errorf("got ports %v for dns-tcp", got)
+				}
+				return nil
+			}, retry.Timeout(5*time.Second))
+
+			if instances, _ := controller.InstancesByPortName(dns, "missing", labels.Collection{}); len(instances) != 0 {
+				t.Fatalf("expected no instances for unknown port name, got %v", instances)
+			}
+		})
+	}
+}
+
+func TestEndpointTLSMode(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: mode})
+			defer controller.Stop()
+
+			injected := map[string]string{annotation.SidecarStatus.Name: "{}"}
+			pod1 := generatePod("128.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "prod-app"}, injected)
+			pod2 := generatePod("128.0.0.2", "pod2", "nsA", "", "node1", map[string]string{"app": "prod-app"}, map[string]string{})
+			addPods(t, controller, pod1, pod2)
+			for _, pod := range []*coreV1.Pod{pod1, pod2} {
+				if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+					t.Fatalf("wait for pod err: %v", err)
+				}
+			}
+
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1", "128.0.0.2"}, t)
+
+			assertTLSModes := func(want map[string]string) {
+				t.Helper()
+				ev := fx.Wait("eds")
+				if ev == nil {
+					t.Fatal("Timeout incremental eds")
+				}
+				got := make(map[string]string)
+				for _, ep := range ev.Endpoints {
+					got[ep.Address] = ep.TLSMode
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("got endpoint tls modes %v, want %v", got, want)
+				}
+			}
+			assertTLSModes(map[string]string{
+				"128.0.0.1": model.IstioMutualTLSModeLabel,
+				"128.0.0.2": model.DisabledTLSModeLabel,
+			})
+
+			// Injecting the second pod changes its TLS mode without touching the endpoints object,
+			// so the rebuild has to come from the pod update.
+			fx.Clear()
+			pod2.Annotations = injected
+			addPods(t, controller, pod2)
+			assertTLSModes(map[string]string{
+				"128.0.0.1": model.IstioMutualTLSModeLabel,
+				"128.0.0.2": model.IstioMutualTLSModeLabel,
+			})
+		})
+	}
+}
+
+func TestEndpointNodeLabels(t *testing.T) {
+	const poolLabel = "cloud.google.com/gke-nodepool"
+	const endpointPoolLabel = DefaultNodeLabelPrefix + poolLabel
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{
+				mode:             mode,
+				nodeLabelsToCopy: []string{poolLabel},
+			})
+			defer controller.Stop()
+
+			node1 := generateNode("node1", map[string]string{poolLabel: "pool-a"})
+			node2 := generateNode("node2", map[string]string{poolLabel: "pool-b"})
+			addNodes(t, controller, node1, node2)
+			retry.UntilSuccessOrFail(t, func() error {
+				for _, n := range []string{"node1", "node2"} {
+					if _, exists, _ := controller.nodeMetadataInformer.GetStore().GetByKey(n); !exists {
+						return fmt.Errorf("node %s not synced", n)
+					}
+				}
+				return nil
+			}, retry.Timeout(5*time.Second))
+
+			pod1 := generatePod("128.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "prod-app"}, map[string]string{})
+			addPods(t, controller, pod1)
+			if err := waitForPod(controller, pod1.Status.PodIP); err != nil {
+				t.Fatalf("wait for pod err: %v", err)
+			}
+
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+
+			assertPool := func(want string) {
+				t.Helper()
+				ev := fx.Wait("eds")
+				if ev == nil {
+					t.Fatal("Timeout incremental eds")
+				}
+				if len(ev.Endpoints) != 1 {
+					t.Fatalf("expected 1 endpoint, got %v", ev.Endpoints)
+				}
+				ep := ev.Endpoints[0]
+				if got := ep.Labels[endpointPoolLabel]; got != want {
+					t.Fatalf("got node pool %q, want %q", got, want)
+				}
+				if ep.Labels["app"] != "prod-app" {
+					t.Fatalf("expected pod labels to be kept, got %v", ep.Labels)
+				}
+			}
+
+			createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+			assertPool("pool-a")
+			if _, f := pod1.Labels[endpointPoolLabel]; f {
+				t.Fatal("node labels must not be written to the pod labels")
+			}
+
+			// The pod is rescheduled onto a node in another pool.
+			fx.Clear()
+			pod2 := generatePod("128.0.0.2", "pod2", "nsA", "", "node2", map[string]string{"app": "prod-app"}, map[string]string{})
+			addPods(t, controller, pod2)
+			if err := waitForPod(controller, pod2.Status.PodIP); err != nil {
+				t.Fatalf("wait for pod err: %v", err)
+			}
+			updateEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.2"}, t)
+			assertPool("pool-b")
+
+			// Relabelling the node rebuilds the endpoints of its pods.
+			fx.Clear()
+			nodeResource := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "nodes"}
+			node2.Labels = map[string]string{poolLabel: "pool-c"}
+			_, err := controller.metadataClient.(*metafake.FakeMetadataClient).Resource(nodeResource).(metafake.MetadataClient).
+				UpdateFake(&metaV1.PartialObjectMetadata{TypeMeta: node2.TypeMeta, ObjectMeta: node2.ObjectMeta}, metaV1.UpdateOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertPool("pool-c")
+		})
+	}
+}
+
+func TestServiceLabels(t *testing.T) {
+	updates := make(chan map[string]string, 10)
+	controller, fx := newFakeControllerWithOptions(fakeControllerOptions{
+		serviceHandler: func(svc *model.Service, e model.Event) {
+			if e == model.EventUpdate {
+				updates <- svc.Attributes.Labels
+			}
+		},
+	})
+	defer controller.Stop()
+
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	svc, err := controller.client.CoreV1().Services("nsA").Get(context.TODO(), "svc1", metaV1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []map[string]string{
+		{"istio.io/rev": "canary"},
+		{"istio.io/rev": "stable", "group": "payments"},
+		nil,
+	} {
+		svc = svc.DeepCopy()
+		svc.Labels = want
+		if svc, err = controller.client.CoreV1().Services("nsA").Update(context.TODO(), svc, metaV1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-updates:
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got labels %v, want %v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout waiting for the update of labels %v", want)
+		}
+		svcConv, _ := controller.GetService(kube.ServiceHostname("svc1", "nsA", domainSuffix))
+		if svcConv == nil || !reflect.DeepEqual(svcConv.Attributes.Labels, want) {
+			t.Fatalf("got service %v, want labels %v", svcConv, want)
+		}
+	}
+	select {
+	case got := <-updates:
+		t.Fatalf("unexpected update with labels %v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestUpdateEqual(t *testing.T) {
+	svc := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{Name: "svc", Namespace: "nsA", ResourceVersion: "1"},
+		Spec:       coreV1.ServiceSpec{Type: coreV1.ServiceTypeLoadBalancer},
+	}
+	svcResynced := svc.DeepCopy()
+	svcResynced.ResourceVersion = "2"
+	svcIngress := svcResynced.DeepCopy()
+	svcIngress.Status.LoadBalancer.Ingress = []coreV1.LoadBalancerIngress{{IP: "5.5.5.5"}}
+	svcRelabelled := svcResynced.DeepCopy()
+	svcRelabelled.Labels = map[string]string{"istio.io/rev": "canary"}
+
+	node := &coreV1.Node{
+		ObjectMeta: metaV1.ObjectMeta{Name: "node1", ResourceVersion: "1"},
+		Status:     coreV1.NodeStatus{Addresses: []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: "1.2.3.4"}}},
+	}
+	nodeHeartbeat := node.DeepCopy()
+	nodeHeartbeat.ResourceVersion = "2"
+	nodeHeartbeat.Status.Conditions = []coreV1.NodeCondition{{Type: coreV1.NodeReady, LastHeartbeatTime: metaV1.Now()}}
+	nodeAddress := nodeHeartbeat.DeepCopy()
+	nodeAddress.Status.Addresses[0].Address = "5.6.7.8"
+
+	pod := generatePod("128.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "prod-app"}, map[string]string{})
+	podReady := pod.DeepCopy()
+	podReady.ResourceVersion = "2"
+	podReady.Status.Conditions = []coreV1.PodCondition{{Type: coreV1.PodReady, Status: coreV1.ConditionTrue}}
+	podRelabelled := podReady.DeepCopy()
+	podRelabelled.Labels = map[string]string{"app": "other-app"}
+
+	ep := &coreV1.Endpoints{
+		ObjectMeta: metaV1.ObjectMeta{Name: "svc", Namespace: "nsA", ResourceVersion: "1"},
+		Subsets:    []coreV1.EndpointSubset{{Addresses: []coreV1.EndpointAddress{{IP: "128.0.0.1"}}}},
+	}
+	epLeaderElection := ep.DeepCopy()
+	epLeaderElection.ResourceVersion = "2"
+	epLeaderElection.Annotations = map[string]string{"control-plane.alpha.kubernetes.io/leader": "holder"}
+
+	slice := &discoveryv1alpha1.EndpointSlice{
+		ObjectMeta: metaV1.ObjectMeta{Name: "svc", Namespace: "nsA", ResourceVersion: "1"},
+		Endpoints:  []discoveryv1alpha1.Endpoint{{Addresses: []string{"128.0.0.1"}}},
+	}
+	sliceResynced := slice.DeepCopy()
+	sliceResynced.ResourceVersion = "2"
+	sliceChanged := sliceResynced.DeepCopy()
+	sliceChanged.Endpoints[0].Addresses = []string{"128.0.0.2"}
+
+	cases := []struct {
+		name  string
+		equal func(old, cur interface{}) bool
+		old   interface{}
+		cur   interface{}
+		want  bool
+	}{
+		{"service resource version", serviceUpdateEqual, svc, svcResynced, true},
+		{"service load balancer status", serviceUpdateEqual, svcResynced, svcIngress, false},
+		{"service labels", serviceUpdateEqual, svcResynced, svcRelabelled, false},
+		{"node heartbeat", nodeUpdateEqual, node, nodeHeartbeat, true},
+		{"node address", nodeUpdateEqual, nodeHeartbeat, nodeAddress, false},
+		{"pod readiness", podUpdateEqual, pod, podReady, true},
+		{"pod labels", podUpdateEqual, podReady, podRelabelled, false},
+		{"endpoints annotations", endpointsUpdateEqual, ep, epLeaderElection, true},
+		{"endpoint slice resource version", endpointSliceUpdateEqual, slice, sliceResynced, true},
+		{"endpoint slice addresses", endpointSliceUpdateEqual, sliceResynced, sliceChanged, false},
+		{"tombstone", podUpdateEqual, pod, cache.DeletedFinalStateUnknown{Obj: pod}, false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.equal(tt.old, tt.cur); got != tt.want {
+				t.Fatalf("got equal %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// countingQueue counts pushed tasks without running them.
+type countingQueue struct {
+	pushes int
+}
+
+func (q *countingQueue) Push(queue.Task) {
+	q.pushes++
+}
+
+func (q *countingQueue) Run(<-chan struct{}) {}
+
+// BenchmarkEndpointsResync replays a resync of a large Endpoints object whose only change is the
+// resource version, reporting how many tasks reach the queue.
+func BenchmarkEndpointsResync(b *testing.B) {
+	addresses := make([]coreV1.EndpointAddress, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		addresses = append(addresses, coreV1.EndpointAddress{IP: fmt.Sprintf("10.0.%d.%d", i/256, i%256)})
+	}
+	old := &coreV1.Endpoints{
+		ObjectMeta: metaV1.ObjectMeta{Name: "svc", Namespace: "nsA", ResourceVersion: "1"},
+		Subsets: []coreV1.EndpointSubset{{
+			Addresses: addresses,
+			Ports:     []coreV1.EndpointPort{{Name: "http", Port: 8080}},
+		}},
+	}
+	cur := old.DeepCopy()
+	cur.ResourceVersion = "2"
+
+	handler := func(interface{}, model.Event) error { return nil }
+	for _, bc := range []struct {
+		name  string
+		equal func(old, cur interface{}) bool
+	}{
+		{"deepequal", reflect.DeepEqual},
+		{"semantic", endpointsUpdateEqual},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			q := &countingQueue{}
+			h := newEventHandler(q, cache.NewStore(cache.MetaNamespaceKeyFunc), "Endpoints", handler, bc.equal, false)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h.OnUpdate(old, cur)
+			}
+			b.ReportMetric(float64(q.pushes)/float64(b.N), "pushes/op")
+		})
+	}
+}
+
+func TestEventHandlerResync(t *testing.T) {
+	old := &coreV1.Endpoints{ObjectMeta: metaV1.ObjectMeta{Name: "svc", Namespace: "nsA", ResourceVersion: "1"}}
+	resynced := old.DeepCopy()
+	updated := old.DeepCopy()
+	updated.ResourceVersion = "2"
+	unversioned := &coreV1.Endpoints{ObjectMeta: metaV1.ObjectMeta{Name: "svc", Namespace: "nsA"}}
+
+	handler := func(interface{}, model.Event) error { return nil }
+	neverEqual := func(interface{}, interface{}) bool { return false }
+	cases := []struct {
+		name     string
+		otype    string
+		old, cur interface{}
+		pushes   int
+	}{
+		{"resync", "Endpoints", old, resynced, 0},
+		{"same object", "Endpoints", old, old, 0},
+		{"update", "Endpoints", old, updated, 1},
+		{"no resource version", "Endpoints", unversioned, unversioned.DeepCopy(), 1},
+		{"resynced type", "Services", old, resynced, 1},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &countingQueue{}
+			h := newEventHandler(q, cache.NewStore(cache.MetaNamespaceKeyFunc), tt.otype, handler, neverEqual, false)
+			h.OnUpdate(tt.old, tt.cur)
+			if q.pushes != tt.pushes {
+				t.Fatalf("got %d pushes, want %d", q.pushes, tt.pushes)
+			}
+		})
+	}
+}
+
+// BenchmarkEndpointsPeriodicResync replays a periodic resync of 10k Endpoints objects, which are
+// delivered at the resource version they already had, and an update of all of them for comparison.
+func BenchmarkEndpointsPeriodicResync(b *testing.B) {
+	const objects = 10000
+	olds := make([]*coreV1.Endpoints, 0, objects)
+	for i := 0; i < objects; i++ {
+		addresses := make([]coreV1.EndpointAddress, 0, 20)
+		for j := 0; j < 20; j++ {
+			addresses = append(addresses, coreV1.EndpointAddress{IP: fmt.Sprintf("10.%d.%d.%d", i/256, i%256, j)})
+		}
+		olds = append(olds, &coreV1.Endpoints{
+			ObjectMeta: metaV1.ObjectMeta{Name: fmt.Sprintf("svc%d", i), Namespace: "nsA", ResourceVersion: "1"},
+			Subsets: []coreV1.EndpointSubset{{
+				Addresses: addresses,
+				Ports:     []coreV1.EndpointPort{{Name: "http", Port: 8080}},
+			}},
+		})
+	}
+
+	handler := func(interface{}, model.Event) error { return nil }
+	for _, bc := range []struct {
+		name            string
+		resourceVersion string
+	}{
+		{"resync", "1"},
+		{"update", "2"},
+	} {
+		curs := make([]*coreV1.Endpoints, 0, objects)
+		for _, old := range olds {
+			cur := old.DeepCopy()
+			cur.ResourceVersion = bc.resourceVersion
+			curs = append(curs, cur)
+		}
+		b.Run(bc.name, func(b *testing.B) {
+			q := &countingQueue{}
+			h := newEventHandler(q, cache.NewStore(cache.MetaNamespaceKeyFunc), "Endpoints", handler, endpointsUpdateEqual, false)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := range olds {
+					h.OnUpdate(olds[j], curs[j])
+				}
+			}
+			b.ReportMetric(float64(q.pushes)/float64(b.N), "pushes/op")
+		})
+	}
+}
+
+func TestGetProxyWithMultipleIPs(t *testing.T) {
+	networksWatcher := mesh.NewFixedNetworksWatcher(&meshconfig.MeshNetworks{
+		Networks: map[string]*meshconfig.Network{
+			"network1": {
+				Endpoints: []*meshconfig.Network_NetworkEndpoints{
+					{
+						Ne: &meshconfig.Network_NetworkEndpoints_FromCidr{
+							FromCidr: "10.10.1.1/24",
+						},
+					},
+				},
+			},
+		},
+	})
+
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{networksWatcher: networksWatcher, mode: mode})
+			defer controller.Stop()
+
+			pod := generatePod("10.10.1.5", "pod1", "nsA", "", "node1", map[string]string{"app": "prod-app"}, map[string]string{})
+			addPods(t, controller, pod)
+			if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+				t.Fatalf("wait for pod err: %v", err)
+			}
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"10.10.1.5", "2.2.2.2"}, t)
+			if ev := fx.Wait("eds"); ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+
+			// Only the second IP of the proxy belongs to the pod, and only it is in the proxy's network.
+			podProxy := &model.Proxy{
+				IPAddresses: []string{"192.168.0.9", "10.10.1.5"},
+				Metadata:    &model.NodeMetadata{Namespace: "nsA", Network: "network1"},
+			}
+			workloadLabels, err := controller.GetProxyWorkloadLabels(podProxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(workloadLabels) != 1 || workloadLabels[0]["app"] != "prod-app" {
+				t.Fatalf("expected labels of pod1, got %v", workloadLabels)
+			}
+			instances, err := controller.GetProxyServiceInstances(podProxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(instances) == 0 {
+				t.Fatal("expected service instances for the pod behind the second proxy IP")
+			}
+			for _, si := range instances {
+				if si.Service.Hostname != kube.ServiceHostname("svc1", "nsA", domainSuffix) {
+					t.Fatalf("unexpected service %s", si.Service.Hostname)
+				}
+			}
+
+			// Likewise for a workload entry registered under the second IP.
+			controller.ForeignServiceInstanceHandler(&model.ServiceInstance{
+				Service: &model.Service{
+					Attributes: model.ServiceAttributes{Namespace: "nsA"},
+				},
+				Endpoint: &model.IstioEndpoint{
+					Labels:       labels.Instance{"app": "prod-app"},
+					Address:      "2.2.2.2",
+					EndpointPort: 8080,
+				},
+			}, model.EventAdd)
+			instances, err = controller.GetProxyServiceInstances(&model.Proxy{
+				IPAddresses: []string{"3.3.3.3", "2.2.2.2"},
+				Metadata:    &model.NodeMetadata{Namespace: "nsA"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := false
+			for _, si := range instances {
+				if si.Endpoint.Address == "2.2.2.2" {
+					found = true
+				}
+			}
+			if !found {
+				t.Fatalf("expected the workload entry instance, got %v", instances)
+			}
+		})
+	}
+}
+
+func TestGetProxyWithCustomHostname(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: mode, clusterID: "cluster1"})
+			defer controller.Stop()
+
+			pod := generatePod("128.0.0.1", "db-0", "nsA", "", "node1", map[string]string{"app": "db"}, map[string]string{})
+			pod.Spec.Hostname = "primary"
+			pod.Spec.Subdomain = "db"
+			// Only the first address of the dual stack pod is in the pod cache.
+			pod.Status.PodIPs = []coreV1.PodIP{{IP: "128.0.0.1"}, {IP: "fd00::1"}}
+			addPods(t, controller, pod)
+			if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+				t.Fatalf("wait for pod err: %v", err)
+			}
+			createService(controller, "db", "nsA", nil, []int32{5432}, map[string]string{"app": "db"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+
+			// The proxy reports an address of the pod unknown to the pod cache and an ID built from
+			// the hostname.
+			proxy := &model.Proxy{
+				ID:          "primary.db.nsA",
+				IPAddresses: []string{"fd00::1"},
+				Metadata:    &model.NodeMetadata{Namespace: "nsA", ClusterID: "cluster1"},
+			}
+			workloadLabels, err := controller.GetProxyWorkloadLabels(proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(workloadLabels) != 1 || workloadLabels[0]["app"] != "db" {
+				t.Fatalf("expected labels of db-0, got %v", workloadLabels)
+			}
+			instances, err := controller.GetProxyServiceInstances(proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(instances) != 1 || instances[0].Service.Hostname != kube.ServiceHostname("db", "nsA", domainSuffix) {
+				t.Fatalf("expected an instance of the db service, got %v", instances)
+			}
+
+			// The same ID with an address that is not the pod's must not be associated with the pod.
+			other := &model.Proxy{
+				ID:          "primary.db.nsA",
+				IPAddresses: []string{"10.1.1.1"},
+				Metadata:    &model.NodeMetadata{Namespace: "nsA", ClusterID: "cluster1"},
+			}
+			if workloadLabels, _ := controller.GetProxyWorkloadLabels(other); len(workloadLabels) != 0 {
+				t.Fatalf("expected no labels for a proxy without an address of the pod, got %v", workloadLabels)
+			}
+			if instances, _ := controller.GetProxyServiceInstances(other); len(instances) != 0 {
+				t.Fatalf("expected no instances for a proxy without an address of the pod, got %v", instances)
+			}
+
+			// Nor from another cluster.
+			proxy.Metadata.ClusterID = "cluster2"
+			if workloadLabels, _ := controller.GetProxyWorkloadLabels(proxy); len(workloadLabels) != 0 {
+				t.Fatalf("expected no labels for a proxy in another cluster, got %v", workloadLabels)
+			}
+		})
+	}
+}
+
+func TestServicesSnapshot(t *testing.T) {
+	controller, fx := newFakeControllerWithOptions(fakeControllerOptions{})
+	defer controller.Stop()
+
+	createService(controller, "svc2", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+
+	first := controller.ServicesSnapshot()
+	if len(first) != 2 || first[0].Hostname != "svc1.nsA.svc.company.com" {
+		t.Fatalf("expected 2 services sorted by hostname, got %v", first)
+	}
+	if second := controller.ServicesSnapshot(); &second[0] != &first[0] {
+		t.Fatal("expected the snapshot to be reused while services are unchanged")
+	}
+	copied, _ := controller.Services()
+	if &copied[0] == &first[0] {
+		t.Fatal("expected Services to return a copy of the snapshot")
+	}
+	copied[0] = nil
+	if controller.ServicesSnapshot()[0] == nil {
+		t.Fatal("modifying the result of Services must not affect the snapshot")
+	}
+
+	createService(controller, "svc3", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	if updated := controller.ServicesSnapshot(); len(updated) != 3 {
+		t.Fatalf("expected the snapshot to be rebuilt with 3 services, got %v", updated)
+	}
+}
+
+// BenchmarkServices lists a large registry repeatedly without any service changes.
+func BenchmarkServices(b *testing.B) {
+	c := &Controller{servicesMap: make(map[host.Name]*model.Service)}
+	for i := 0; i < 30000; i++ {
+		hostname := host.Name(fmt.Sprintf("svc%d.ns.svc.company.com", i))
+		c.servicesMap[hostname] = &model.Service{Hostname: hostname}
+	}
+	b.Run("Services", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = c.Services()
+		}
+	})
+	b.Run("ServicesSnapshot", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = c.ServicesSnapshot()
+		}
+	})
+}
+
+func TestEndpointsSubsetReorder(t *testing.T) {
+	controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: EndpointsOnly})
+	defer controller.Stop()
+
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+
+	subsetA := coreV1.EndpointSubset{
+		Addresses: []coreV1.EndpointAddress{{IP: "10.0.0.1"}},
+		Ports:     []coreV1.EndpointPort{{Name: "tcp-port", Port: 8080}},
+	}
+	subsetB := coreV1.EndpointSubset{
+		Addresses: []coreV1.EndpointAddress{{IP: "10.0.0.2"}},
+		Ports:     []coreV1.EndpointPort{{Name: "tcp-port", Port: 9090}},
+	}
+	setSubsets := func(create bool, subsets ...coreV1.EndpointSubset) {
+		t.Helper()
+		ep := &coreV1.Endpoints{
+			ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA"},
+			Subsets:    subsets,
+		}
+		var err error
+		if create {
+			_, err = controller.client.CoreV1().Endpoints("nsA").Create(context.TODO(), ep, metaV1.CreateOptions{})
+		} else {
+			_, err = controller.client.CoreV1().Endpoints("nsA").Update(context.TODO(), ep, metaV1.UpdateOptions{})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	setSubsets(true, subsetA, subsetB)
+	if ev := fx.Wait("eds"); ev == nil {
+		t.Fatal("Timeout incremental eds")
+	}
+
+	// Reordering the subsets must not push. Follow it with a real change: since events are handled
+	// in order, the next EDS update seen must be the one for the real change.
+	setSubsets(false, subsetB, subsetA)
+	subsetC := coreV1.EndpointSubset{
+		Addresses: []coreV1.EndpointAddress{{IP: "10.0.0.3"}},
+		Ports:     []coreV1.EndpointPort{{Name: "tcp-port", Port: 8080}},
+	}
+	setSubsets(false, subsetB, subsetA, subsetC)
+	ev := fx.Wait("eds")
+	if ev == nil {
+		t.Fatal("Timeout incremental eds")
+	}
+	if len(ev.Endpoints) != 3 {
+		t.Fatalf("expected the reordered subsets not to be pushed, got eds update with %d endpoints", len(ev.Endpoints))
+	}
+}
+
+func TestEndpointClusterID(t *testing.T) {
+	const clusterID = "cluster1"
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: mode, clusterID: clusterID})
+			defer controller.Stop()
+
+			assertClusterID := func(path string, instances []*model.ServiceInstance, want string) {
+				t.Helper()
+				if len(instances) == 0 {
+					t.Fatalf("%s: expected instances", path)
+				}
+				for _, si := range instances {
+					if si.Endpoint.Locality.ClusterID != want {
+						t.Fatalf("%s: endpoint %s has cluster ID %q, want %q", path, si.Endpoint.Address, si.Endpoint.Locality.ClusterID, want)
+					}
+				}
+			}
+
+			pod := generatePod("128.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "prod-app"}, map[string]string{})
+			addPods(t, controller, pod)
+			if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+				t.Fatalf("wait for pod err: %v", err)
+			}
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+
+			// EDS built from Endpoints or EndpointSlices.
+			ev := fx.Wait("eds")
+			if ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+			for _, ep := range ev.Endpoints {
+				if ep.Locality.ClusterID != clusterID {
+					t.Fatalf("eds: endpoint %s has cluster ID %q, want %q", ep.Address, ep.Locality.ClusterID, clusterID)
+				}
+			}
+
+			svc, _ := controller.GetService(kube.ServiceHostname("svc1", "nsA", domainSuffix))
+			instances, err := controller.InstancesByPort(svc, 8080, labels.Collection{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertClusterID("InstancesByPort", instances, clusterID)
+
+			// Proxy backed by a pod.
+			instances, err = controller.GetProxyServiceInstances(&model.Proxy{
+				IPAddresses: []string{"128.0.0.1"},
+				Metadata:    &model.NodeMetadata{Namespace: "nsA", ClusterID: clusterID},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertClusterID("GetProxyServiceInstances by pod", instances, clusterID)
+
+			// Proxy whose pod is not known yet, built from its metadata.
+			instances, _, err = controller.getProxyServiceInstancesFromMetadata(&model.Proxy{
+				IPAddresses:     []string{"128.0.0.9"},
+				ConfigNamespace: "nsA",
+				Metadata: &model.NodeMetadata{
+					ClusterID: clusterID,
+					Labels:    map[string]string{"app": "prod-app"},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertClusterID("metadata", instances, clusterID)
+
+			// ExternalName service.
+			createExternalNameService(controller, "ext", "nsA", []int32{80}, "foo.co", t, fx.Events)
+			var extSvc *model.Service
+			retry.UntilSuccessOrFail(t, func() error {
+				extSvc, _ = controller.GetService(kube.ServiceHostname("ext", "nsA", domainSuffix))
+				if extSvc == nil {
+					return fmt.Errorf("service ext not found")
+				}
+				return nil
+			}, retry.Timeout(5*time.Second))
+			instances, err = controller.InstancesByPort(extSvc, 80, labels.Collection{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertClusterID("ExternalName", instances, clusterID)
+
+			// Workload entries keep the cluster ID of their source.
+			fx.Clear()
+			controller.ForeignServiceInstanceHandler(&model.ServiceInstance{
+				Service: &model.Service{
+					Attributes: model.ServiceAttributes{Namespace: "nsA"},
+				},
+				Endpoint: &model.IstioEndpoint{
+					Labels:       labels.Instance{"app": "prod-app"},
+					Address:      "2.2.2.2",
+					EndpointPort: 8080,
+					Locality:     model.Locality{ClusterID: "remote"},
+				},
+			}, model.EventAdd)
+			if ev := fx.Wait("eds"); ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+			instances, err = controller.InstancesByPort(svc, 8080, labels.Collection{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, si := range instances {
+				want := clusterID
+				if si.Endpoint.Address == "2.2.2.2" {
+					want = "remote"
+				}
+				if si.Endpoint.Locality.ClusterID != want {
+					t.Fatalf("endpoint %s has cluster ID %q, want %q", si.Endpoint.Address, si.Endpoint.Locality.ClusterID, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNodeAddressesForSelector(t *testing.T) {
+	controller, _ := newFakeControllerWithOptions(fakeControllerOptions{})
+	defer controller.Stop()
+
+	updates := make(chan []string, 10)
+	if err := controller.AppendNodeHandler(labels.Instance{"pool": "gateway"}, func(addresses []string) {
+		updates <- addresses
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdate := func(want ...string) {
+		t.Helper()
+		select {
+		case got := <-updates:
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got node addresses %v, want %v", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for node addresses %v", want)
+		}
+	}
+
+	node := func(name, pool, address string) *coreV1.Node {
+		return &coreV1.Node{
+			ObjectMeta: metaV1.ObjectMeta{Name: name, Labels: map[string]string{"pool": pool}},
+			Status: coreV1.NodeStatus{
+				Addresses: []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: address}},
+			},
+		}
+	}
+	nodes := controller.client.CoreV1().Nodes()
+	if _, err := nodes.Create(context.TODO(), node("node1", "gateway", "1.1.1.1"), metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdate("1.1.1.1")
+	if _, err := nodes.Create(context.TODO(), node("node2", "default", "2.2.2.2"), metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		if got := controller.NodeAddressesForSelector(nil); !reflect.DeepEqual(got, []string{"1.1.1.1", "2.2.2.2"}) {
+			return fmt.Errorf("got all node addresses %v", got)
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+	if got := controller.NodeAddressesForSelector(labels.Instance{"pool": "gateway"}); !reflect.DeepEqual(got, []string{"1.1.1.1"}) {
+		t.Fatalf("got gateway node addresses %v", got)
+	}
+	select {
+	case got := <-updates:
+		t.Fatalf("unexpected handler call with %v for a node outside the selector", got)
+	default:
+	}
+
+	if _, err := nodes.Update(context.TODO(), node("node2", "gateway", "2.2.2.2"), metaV1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdate("1.1.1.1", "2.2.2.2")
+	if err := nodes.Delete(context.TODO(), "node1", metaV1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expectUpdate("2.2.2.2")
+}
+
+func TestNodeAddressesConcurrency(t *testing.T) {
+	controller, _ := newFakeControllerWithOptions(fakeControllerOptions{})
+	defer controller.Stop()
+
+	const nodeCount = 20
+	var wg sync.WaitGroup
+	for i := 0; i < nodeCount; i++ {
+		i := i
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			node := &coreV1.Node{
+				ObjectMeta: metaV1.ObjectMeta{Name: fmt.Sprintf("node%d", i), Labels: map[string]string{"pool": "gateway"}},
+				Status: coreV1.NodeStatus{
+					Addresses: []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: fmt.Sprintf("10.0.0.%d", i)}},
+				},
+			}
+			if err := controller.onNodeEvent(node, model.EventAdd); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			_ = controller.NodeAddressesForSelector(labels.Instance{"pool": "gateway"})
+		}()
+		go func() {
+			defer wg.Done()
+			_ = controller.AppendNodeHandler(labels.Instance{"pool": "gateway"}, func([]string) {})
+		}()
+	}
+	wg.Wait()
+
+	if got := controller.NodeAddressesForSelector(labels.Instance{"pool": "gateway"}); len(got) != nodeCount {
+		t.Fatalf("expected %d node addresses, got %v", nodeCount, got)
+	}
+	controller.nodeHandlersMutex.Lock()
+	defer controller.nodeHandlersMutex.Unlock()
+	for _, h := range controller.nodeHandlers {
+		// Every handler either saw all nodes at registration or was notified of the later ones.
+		if len(h.addresses) != nodeCount {
+			t.Fatalf("handler last saw %d addresses, want %d", len(h.addresses), nodeCount)
+		}
+	}
+}
+
+// TestServiceExternalAddressesConcurrency is meant to be run with the race detector.
+func TestServiceExternalAddressesConcurrency(t *testing.T) {
+	const clusterID = "cluster1"
+	controller, fx := newFakeControllerWithOptions(fakeControllerOptions{clusterID: clusterID})
+	defer controller.Stop()
+
+	svc := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:        "gateway",
+			Namespace:   "nsA",
+			Annotations: map[string]string{kube.NodeSelectorAnnotation: `{"pool": "gateway"}`},
+		},
+		Spec: coreV1.ServiceSpec{
+			Type:      coreV1.ServiceTypeNodePort,
+			ClusterIP: "10.0.0.1",
+			Ports:     []coreV1.ServicePort{{Name: "tcp-port", Port: 8080, NodePort: 30080}},
+		},
+	}
+	if _, err := controller.client.CoreV1().Services("nsA").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	converted, _ := controller.GetService(kube.ServiceHostname("gateway", "nsA", domainSuffix))
+	if converted == nil {
+		t.Fatal("service not found")
+	}
+
+	const nodeCount = 20
+	var wg sync.WaitGroup
+	for i := 0; i < nodeCount; i++ {
+		i := i
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			node := &coreV1.Node{
+				ObjectMeta: metaV1.ObjectMeta{Name: fmt.Sprintf("node%d", i), Labels: map[string]string{"pool": "gateway"}},
+				Status: coreV1.NodeStatus{
+					Addresses: []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: fmt.Sprintf("10.0.1.%d", i)}},
+				},
+			}
+			if err := controller.onNodeEvent(node, model.EventAdd); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			_ = controller.updateServiceExternalAddr(converted)
+		}()
+		go func() {
+			defer wg.Done()
+			_ = converted.DeepCopy()
+		}()
+	}
+	wg.Wait()
+
+	_ = controller.updateServiceExternalAddr(converted)
+	converted.Mutex.RLock()
+	defer converted.Mutex.RUnlock()
+	if got := converted.Attributes.ClusterExternalAddresses[clusterID]; len(got) != nodeCount {
+		t.Fatalf("expected %d external addresses, got %v", nodeCount, got)
+	}
+}
+
+func TestNodeLosesExternalAddress(t *testing.T) {
+	const clusterID = "cluster1"
+	controller, fx := newFakeControllerWithOptions(fakeControllerOptions{clusterID: clusterID})
+	defer controller.Stop()
+
+	node := &coreV1.Node{
+		ObjectMeta: metaV1.ObjectMeta{Name: "node1"},
+		Status: coreV1.NodeStatus{
+			Addresses: []coreV1.NodeAddress{
+				{Type: coreV1.NodeInternalIP, Address: "10.0.0.1"},
+				{Type: coreV1.NodeExternalIP, Address: "1.2.3.4"},
+			},
+		},
+	}
+	if _, err := controller.client.CoreV1().Nodes().Create(context.TODO(), node, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	svc := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:        "gateway",
+			Namespace:   "nsA",
+			Annotations: map[string]string{kube.NodeSelectorAnnotation: "{}"},
+		},
+		Spec: coreV1.ServiceSpec{
+			Type:      coreV1.ServiceTypeNodePort,
+			ClusterIP: "10.0.0.1",
+			Ports:     []coreV1.ServicePort{{Name: "tcp-port", Port: 8080, NodePort: 30080}},
+		},
+	}
+	if _, err := controller.client.CoreV1().Services("nsA").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	hostname := kube.ServiceHostname("gateway", "nsA", domainSuffix)
+	assertExternalAddresses := func(want []string) {
+		t.Helper()
+		retry.UntilSuccessOrFail(t, func() error {
+			converted, _ := controller.GetService(hostname)
+			if converted == nil {
+				return fmt.Errorf("service not found")
+			}
+			converted.Mutex.RLock()
+			defer converted.Mutex.RUnlock()
+			if got := converted.Attributes.ClusterExternalAddresses[clusterID]; !reflect.DeepEqual(got, want) {
+				return fmt.Errorf("got external addresses %v, want %v", got, want)
+			}
+			return nil
+		}, retry.Timeout(5*time.Second))
+	}
+	assertExternalAddresses([]string{"1.2.3.4"})
+
+	// The node keeps only its internal address.
+	fx.Clear()
+	node.Status.Addresses = node.Status.Addresses[:1]
+	if _, err := controller.client.CoreV1().Nodes().Update(context.TODO(), node, metaV1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("xds"); ev == nil {
+		t.Fatal("Timeout waiting for push")
+	}
+	assertExternalAddresses(nil)
+	controller.RLock()
+	_, f := controller.nodeInfoMap["node1"]
+	controller.RUnlock()
+	if f {
+		t.Fatal("expected node without an external address to be removed from nodeInfoMap")
+	}
+}
+
+func TestNodeEventScopedPush(t *testing.T) {
+	controller, fx := newFakeHarness(t, Options{ClusterID: "cluster1"})
+	defer controller.Stop()
+
+	node := func(name, pool, address string) *coreV1.Node {
+		return &coreV1.Node{
+			ObjectMeta: metaV1.ObjectMeta{Name: name, Labels: map[string]string{"pool": pool}},
+			Status: coreV1.NodeStatus{
+				Addresses: []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: address}},
+			},
+		}
+	}
+	nodes := controller.Client.CoreV1().Nodes()
+	for _, n := range []*coreV1.Node{node("node1", "gateway1", "1.1.1.1"), node("node2", "gateway2", "2.2.2.2")} {
+		do(t, controller, func() {
+			if _, err := nodes.Create(context.TODO(), n, metaV1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	for _, name := range []string{"gateway1", "gateway2"} {
+		svc := &coreV1.Service{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name:        name,
+				Namespace:   "nsA",
+				Annotations: map[string]string{kube.NodeSelectorAnnotation: fmt.Sprintf(`{"pool": %q}`, name)},
+			},
+			Spec: coreV1.ServiceSpec{
+				Type:      coreV1.ServiceTypeNodePort,
+				ClusterIP: "10.0.0.1",
+				Ports:     []coreV1.ServicePort{{Name: "tcp-port", Port: 8080, NodePort: 30080}},
+			},
+		}
+		do(t, controller, func() {
+			if _, err := controller.Client.CoreV1().Services("nsA").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	if len(controller.getNodePortGatewayServices()) != 2 {
+		t.Fatal("gateway services not found")
+	}
+
+	// Only the gateway selecting the changed node is part of the push.
+	fx.Clear()
+	do(t, controller, func() {
+		if _, err := nodes.Update(context.TODO(), node("node1", "gateway1", "3.3.3.3"), metaV1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	ev := fx.Wait("xds")
+	if ev == nil {
+		t.Fatal("Timeout waiting for push")
+	}
+	want := map[model.ConfigKey]struct{}{{
+		Kind:      model.ServiceEntryKind,
+		Name:      string(kube.ServiceHostname("gateway1", "nsA", domainSuffix)),
+		Namespace: "nsA",
+	}: {}}
+	if !reflect.DeepEqual(ev.ConfigsUpdated, want) {
+		t.Fatalf("got configs updated %v, want %v", ev.ConfigsUpdated, want)
+	}
+}
+
+func TestGatewayHandler(t *testing.T) {
+	controller, _ := newFakeHarness(t, Options{ClusterID: "cluster1"})
+	defer controller.Stop()
+
+	type call struct {
+		hostname  host.Name
+		addresses []string
+	}
+	// The handlers are called by Flush, on the test goroutine.
+	var calls []call
+	_ = controller.AppendGatewayHandler(func(hostname host.Name, addresses []string) {
+		calls = append(calls, call{hostname, addresses})
+	})
+	expectCalls := func(step string, want ...call) {
+		t.Helper()
+		if !reflect.DeepEqual(calls, want) {
+			t.Fatalf("%s: got gateway handler calls %v, want %v", step, calls, want)
+		}
+		calls = nil
+	}
+
+	node := func(name, pool, address string) *coreV1.Node {
+		return &coreV1.Node{
+			ObjectMeta: metaV1.ObjectMeta{Name: name, Labels: map[string]string{"pool": pool}},
+			Status: coreV1.NodeStatus{
+				Addresses: []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: address}},
+			},
+		}
+	}
+	nodes := controller.Client.CoreV1().Nodes()
+	services := controller.Client.CoreV1().Services("nsA")
+	do(t, controller, func() {
+		if _, err := nodes.Create(context.TODO(), node("node1", "a", "1.1.1.1"), metaV1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	expectCalls("node without gateway")
+
+	gateway := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:        "gateway",
+			Namespace:   "nsA",
+			Annotations: map[string]string{kube.NodeSelectorAnnotation: `{"pool": "a"}`},
+		},
+		Spec: coreV1.ServiceSpec{
+			Type:      coreV1.ServiceTypeNodePort,
+			ClusterIP: "10.0.0.1",
+			Ports:     []coreV1.ServicePort{{Name: "tcp-port", Port: 8080, NodePort: 30080}},
+		},
+	}
+	do(t, controller, func() {
+		if _, err := services.Create(context.TODO(), gateway, metaV1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	hostname := kube.ServiceHostname("gateway", "nsA", domainSuffix)
+	expectCalls("gateway added", call{hostname, []string{"1.1.1.1"}})
+
+	do(t, controller, func() {
+		if _, err := nodes.Create(context.TODO(), node("node2", "a", "2.2.2.2"), metaV1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	expectCalls("node added", call{hostname, []string{"1.1.1.1", "2.2.2.2"}})
+
+	do(t, controller, func() {
+		if _, err := nodes.Create(context.TODO(), node("node3", "b", "3.3.3.3"), metaV1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	expectCalls("unselected node added")
+
+	gateway.Labels = map[string]string{"app": "gateway"}
+	do(t, controller, func() {
+		if _, err := services.Update(context.TODO(), gateway, metaV1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	expectCalls("gateway labels updated")
+
+	gateway.Annotations = map[string]string{kube.NodeSelectorAnnotation: `{"pool": "b"}`}
+	do(t, controller, func() {
+		if _, err := services.Update(context.TODO(), gateway, metaV1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	expectCalls("selector changed", call{hostname, []string{"3.3.3.3"}})
+
+	do(t, controller, func() {
+		if err := nodes.Delete(context.TODO(), "node3", metaV1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	expectCalls("node deleted", call{hostname, nil})
+
+	// The addresses of LoadBalancer services are those of their ingress.
+	lb := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{Name: "lb", Namespace: "nsA"},
+		Spec: coreV1.ServiceSpec{
+			Type:      coreV1.ServiceTypeLoadBalancer,
+			ClusterIP: "10.0.0.2",
+			Ports:     []coreV1.ServicePort{{Name: "tcp-port", Port: 8080, NodePort: 30081}},
+		},
+	}
+	do(t, controller, func() {
+		if _, err := services.Create(context.TODO(), lb, metaV1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	expectCalls("load balancer without ingress")
+
+	lb.Status.LoadBalancer.Ingress = []coreV1.LoadBalancerIngress{{IP: "5.5.5.5"}}
+	do(t, controller, func() {
+		if _, err := services.UpdateStatus(context.TODO(), lb, metaV1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	lbHostname := kube.ServiceHostname("lb", "nsA", domainSuffix)
+	expectCalls("load balancer ingress assigned", call{lbHostname, []string{"5.5.5.5"}})
+
+	do(t, controller, func() {
+		if err := services.Delete(context.TODO(), "lb", metaV1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	expectCalls("load balancer deleted", call{lbHostname, nil})
+}
+
+func TestServiceExternalAddressesAnnotation(t *testing.T) {
+	const clusterID = "cluster1"
+	controller, fx := newFakeControllerWithOptions(fakeControllerOptions{clusterID: clusterID})
+	defer controller.Stop()
+
+	node := &coreV1.Node{
+		ObjectMeta: metaV1.ObjectMeta{Name: "node1"},
+		Status: coreV1.NodeStatus{
+			Addresses: []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: "1.2.3.4"}},
+		},
+	}
+	if _, err := controller.client.CoreV1().Nodes().Create(context.TODO(), node, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	svc := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      "gateway",
+			Namespace: "nsA",
+			Annotations: map[string]string{
+				kube.NodeSelectorAnnotation:      "{}",
+				kube.ExternalAddressesAnnotation: "203.0.113.10, gw.example.com,not_a_host!",
+			},
+		},
+		Spec: coreV1.ServiceSpec{
+			Type:      coreV1.ServiceTypeNodePort,
+			ClusterIP: "10.0.0.1",
+			Ports:     []coreV1.ServicePort{{Name: "tcp-port", Port: 8080, NodePort: 30080}},
+		},
+	}
+	if _, err := controller.client.CoreV1().Services("nsA").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	hostname := kube.ServiceHostname("gateway", "nsA", domainSuffix)
+	assertExternalAddresses := func(want []string) {
+		t.Helper()
+		retry.UntilSuccessOrFail(t, func() error {
+			converted, _ := controller.GetService(hostname)
+			if converted == nil {
+				return fmt.Errorf("service not found")
+			}
+			converted.Mutex.RLock()
+			defer converted.Mutex.RUnlock()
+			if got := converted.Attributes.ClusterExternalAddresses[clusterID]; !reflect.DeepEqual(got, want) {
+				return fmt.Errorf("got external addresses %v, want %v", got, want)
+			}
+			return nil
+		}, retry.Timeout(5*time.Second))
+	}
+	// The pinned addresses take precedence over the node, invalid entries are dropped.
+	assertExternalAddresses([]string{"203.0.113.10", "gw.example.com"})
+
+	// Node changes do not affect the pinned addresses.
+	node.Status.Addresses = []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: "5.6.7.8"}}
+	if _, err := controller.client.CoreV1().Nodes().Update(context.TODO(), node, metaV1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	assertExternalAddresses([]string{"203.0.113.10", "gw.example.com"})
+
+	// Removing the annotation falls back to the node addresses and triggers a push.
+	fx.Clear()
+	delete(svc.Annotations, kube.ExternalAddressesAnnotation)
+	if _, err := controller.client.CoreV1().Services("nsA").Update(context.TODO(), svc, metaV1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("xds"); ev == nil {
+		t.Fatal("Timeout waiting for push")
+	}
+	assertExternalAddresses([]string{"5.6.7.8"})
+}
+
+func TestIsValidExternalAddress(t *testing.T) {
+	cases := map[string]bool{
+		"203.0.113.10":   true,
+		"2001:db8::1":    true,
+		"gw.example.com": true,
+		"gateway":        true,
+		"not_a_host!":    false,
+		"gw..example":    false,
+		"-gw.example":    false,
+	}
+	for addr, want := range cases {
+		if got := isValidExternalAddress(addr); got != want {
+			t.Errorf("isValidExternalAddress(%q) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestEndpointProxyUnready(t *testing.T) {
+	setContainerReadiness := func(t *testing.T, controller *Controller, pod *coreV1.Pod, proxyReady bool) {
+		t.Helper()
+		pod.Status.ContainerStatuses = []coreV1.ContainerStatus{
+			{Name: "app", Ready: true},
+			{Name: DefaultProxyContainerName, Ready: proxyReady},
+		}
+		if _, err := controller.client.CoreV1().Pods(pod.Namespace).UpdateStatus(context.TODO(), pod, metaV1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertUnreadyCount := func(t *testing.T, controller *Controller, want int) {
+		t.Helper()
+		retry.UntilSuccessOrFail(t, func() error {
+			controller.pods.RLock()
+			defer controller.pods.RUnlock()
+			if got := controller.pods.proxyUnreadyCount["nsA"]; got != want {
+				return fmt.Errorf("got %d pods with an unready proxy, want %d", got, want)
+			}
+			return nil
+		}, retry.Timeout(5*time.Second))
+	}
+
+	for mode, name := range EndpointModeNames {
+		for _, exclude := range []bool{false, true} {
+			mode, exclude := mode, exclude
+			t.Run(fmt.Sprintf("%s/exclude=%v", name, exclude), func(t *testing.T) {
+				controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: mode, excludeProxyUnready: exclude})
+				defer controller.Stop()
+
+				pod1 := generatePod("128.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "prod-app"}, map[string]string{})
+				pod2 := generatePod("128.0.0.2", "pod2", "nsA", "", "node1", map[string]string{"app": "prod-app"}, map[string]string{})
+				addPods(t, controller, pod1, pod2)
+				for _, pod := range []*coreV1.Pod{pod1, pod2} {
+					if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+						t.Fatalf("wait for pod err: %v", err)
+					}
+				}
+				pod1, _ = controller.client.CoreV1().Pods("nsA").Get(context.TODO(), "pod1", metaV1.GetOptions{})
+				pod2, _ = controller.client.CoreV1().Pods("nsA").Get(context.TODO(), "pod2", metaV1.GetOptions{})
+				// The application containers are ready, but only the proxy of the second pod is.
+				setContainerReadiness(t, controller, pod1, false)
+				setContainerReadiness(t, controller, pod2, true)
+				assertUnreadyCount(t, controller, 1)
+
+				createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+				if ev := fx.Wait("service"); ev == nil {
+					t.Fatal("Timeout creating service")
+				}
+				createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1", "128.0.0.2"}, t)
+
+				assertEndpoints := func(want []string) {
+					t.Helper()
+					ev := fx.Wait("eds")
+					if ev == nil {
+						t.Fatal("Timeout incremental eds")
+					}
+					var got []string
+					for _, ep := range ev.Endpoints {
+						got = append(got, ep.Address)
+					}
+					sort.Strings(got)
+					if !reflect.DeepEqual(got, want) {
+						t.Fatalf("got endpoints %v, want %v", got, want)
+					}
+				}
+				if exclude {
+					assertEndpoints([]string{"128.0.0.2"})
+				} else {
+					assertEndpoints([]string{"128.0.0.1", "128.0.0.2"})
+				}
+
+				// The proxy becoming ready is not reported through the endpoints object.
+				fx.Clear()
+				setContainerReadiness(t, controller, pod1, true)
+				assertUnreadyCount(t, controller, 0)
+				if exclude {
+					assertEndpoints([]string{"128.0.0.1", "128.0.0.2"})
+				}
+			})
+		}
+	}
+}
+
+func TestIsProxyUnready(t *testing.T) {
+	pod := &coreV1.Pod{Status: coreV1.PodStatus{ContainerStatuses: []coreV1.ContainerStatus{
+		{Name: "app", Ready: true},
+		{Name: "sidecar", Ready: false},
+	}}}
+	if isProxyUnready(pod, DefaultProxyContainerName) {
+		t.Error("expected a pod without the proxy container not to be reported")
+	}
+	if !isProxyUnready(pod, "sidecar") {
+		t.Error("expected the configured proxy container to be checked")
+	}
+}
+
+func TestReconcileEDSOrphans(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: mode})
+			defer controller.Stop()
+
+			pod := generatePod("128.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "prod-app"}, map[string]string{})
+			addPods(t, controller, pod)
+			if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+				t.Fatalf("wait for pod err: %v", err)
+			}
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+			if ev := fx.Wait("eds"); ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+
+			// svc2 had endpoints pushed, but its objects vanished without a delete event.
+			svc1 := kube.ServiceHostname("svc1", "nsA", domainSuffix)
+			svc2 := kube.ServiceHostname("svc2", "nsA", domainSuffix)
+			controller.trackLocalEndpoints(svc2, "svc2", "nsA", true)
+			if esc, ok := controller.endpoints.(*endpointSliceController); ok {
+				esc.endpointCache.Update(svc2, "svc2-abc", []*model.IstioEndpoint{{Address: "128.0.0.2"}})
+			}
+
+			if err := controller.reconcileEDS(); err != nil {
+				t.Fatal(err)
+			}
+			controller.localEDSMutex.Lock()
+			_, svc1Tracked := controller.localEDSServices[svc1]
+			_, svc2Tracked := controller.localEDSServices[svc2]
+			controller.localEDSMutex.Unlock()
+			if !svc1Tracked {
+				t.Fatal("expected a service backed by endpoints to be kept")
+			}
+			if svc2Tracked {
+				t.Fatal("expected the orphaned service to be cleared")
+			}
+			if esc, ok := controller.endpoints.(*endpointSliceController); ok {
+				if eps := esc.endpointCache.Get(svc2); len(eps) != 0 {
+					t.Fatalf("expected the slice cache of the orphaned service to be cleared, got %v", eps)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileExternalNameOrphans(t *testing.T) {
+	controller, fx := newFakeControllerWithOptions(fakeControllerOptions{})
+	defer controller.Stop()
+
+	createExternalNameService(controller, "svc1", "nsA", []int32{80}, "foo.co", t, fx.Events)
+	createExternalNameService(controller, "svc2", "nsA", []int32{80}, "bar.co", t, fx.Events)
+	svc1, _ := controller.GetService(kube.ServiceHostname("svc1", "nsA", domainSuffix))
+	svc2, _ := controller.GetService(kube.ServiceHostname("svc2", "nsA", domainSuffix))
+	if svc1 == nil || svc2 == nil {
+		t.Fatal("expected the ExternalName services")
+	}
+
+	// A service of the same hostname in another namespace does not get the instances.
+	other := svc1.DeepCopy()
+	other.Attributes.Namespace = "nsB"
+	if instances, _ := controller.InstancesByPort(other, 80, labels.Collection{}); len(instances) != 0 {
+		t.Fatalf("expected no instances for another namespace, got %v", instances)
+	}
+
+	// svc1 vanished without a delete event.
+	controller.Lock()
+	delete(controller.servicesMap, svc1.Hostname)
+	controller.Unlock()
+	if instances, _ := controller.InstancesByPort(svc1, 80, labels.Collection{}); len(instances) != 0 {
+		t.Fatalf("expected no instances for a service that no longer exists, got %v", instances)
+	}
+	if err := controller.reconcileExternalNameInstances(); err != nil {
+		t.Fatal(err)
+	}
+	controller.RLock()
+	_, svc1Kept := controller.externalNameSvcInstanceMap[svc1.Hostname]
+	_, svc2Kept := controller.externalNameSvcInstanceMap[svc2.Hostname]
+	controller.RUnlock()
+	if svc1Kept {
+		t.Fatal("expected the orphaned instances to be removed")
+	}
+	if !svc2Kept {
+		t.Fatal("expected the instances of an existing service to be kept")
+	}
+	if instances, _ := controller.InstancesByPort(svc2, 80, labels.Collection{}); len(instances) != 1 {
+		t.Fatalf("expected the instance of svc2, got %v", instances)
+	}
+
+	// The instances are dropped when the service stops being an ExternalName service.
+	k8sSvc, err := controller.client.CoreV1().Services("nsA").Get(context.TODO(), "svc2", metaV1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k8sSvc.Spec.Type = coreV1.ServiceTypeClusterIP
+	k8sSvc.Spec.ExternalName = ""
+	k8sSvc.Spec.ClusterIP = "10.0.0.2"
+	if _, err := controller.client.CoreV1().Services("nsA").Update(context.TODO(), k8sSvc, metaV1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout updating service")
+	}
+	controller.RLock()
+	_, svc2Kept = controller.externalNameSvcInstanceMap[svc2.Hostname]
+	controller.RUnlock()
+	if svc2Kept {
+		t.Fatal("expected the instances to be dropped with the ExternalName type")
+	}
+}
+
+func TestParseUID(t *testing.T) {
+	cases := []struct {
+		podName   string
+		namespace string
+		clusterID string
+	}{
+		{"pod1", "nsA", ""},
+		{"pod1", "nsA", "cluster1"},
+		{"web-0.web", "nsA", "cluster1"},
+	}
+	for _, c := range cases {
+		uid := createUID(c.podName, c.namespace, c.clusterID)
+		podName, namespace, clusterID, err := ParseUID(uid)
+		if err != nil {
+			t.Fatalf("ParseUID(%q) failed: %v", uid, err)
+		}
+		if podName != c.podName || namespace != c.namespace || clusterID != c.clusterID {
+			t.Errorf("ParseUID(%q) = %q, %q, %q, want %q, %q, %q",
+				uid, podName, namespace, clusterID, c.podName, c.namespace, c.clusterID)
+		}
+	}
+
+	// UIDs built before the cluster ID was added still parse.
+	if podName, namespace, clusterID, err := ParseUID("kubernetes://pod2.nsa"); err != nil ||
+		podName != "pod2" || namespace != "nsa" || clusterID != "" {
+		t.Errorf("failed to parse old format UID: %q, %q, %q, %v", podName, namespace, clusterID, err)
+	}
+
+	for _, invalid := range []string{"", "pod1.nsA", "kubernetes://pod1", "kubernetes://pod1.", "kubernetes://.nsA", "kubernetes://pod1.nsA/"} {
+		if _, _, _, err := ParseUID(invalid); err == nil {
+			t.Errorf("expected ParseUID(%q) to fail", invalid)
+		}
+	}
+}
+
+func TestEndpointUIDClusterID(t *testing.T) {
+	for _, include := range []bool{false, true} {
+		controller, _ := newFakeControllerWithOptions(fakeControllerOptions{clusterID: "cluster1", uidIncludesClusterID: include})
+		pod := generatePod("128.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "prod-app"}, map[string]string{})
+		want := "kubernetes://pod1.nsA"
+		if include {
+			want += "/cluster1"
+		}
+		if got := NewEndpointBuilder(controller, pod).buildIstioEndpoint("128.0.0.1", 8080, "tcp-port").UID; got != want {
+			t.Errorf("got endpoint UID %q, want %q", got, want)
+		}
+		controller.Stop()
+	}
+}
+
+func TestServiceExternalIPsUpdate(t *testing.T) {
+	const clusterID = "cluster1"
+	controller, fx := newFakeControllerWithOptions(fakeControllerOptions{clusterID: clusterID})
+	defer controller.Stop()
+
+	svc := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA"},
+		Spec: coreV1.ServiceSpec{
+			ClusterIP:   "10.0.0.1",
+			Ports:       []coreV1.ServicePort{{Name: "tcp-port", Port: 8080}},
+			ExternalIPs: []string{"203.0.113.10"},
+		},
+	}
+	if _, err := controller.client.CoreV1().Services("nsA").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+
+	hostname := kube.ServiceHostname("svc1", "nsA", domainSuffix)
+	assertExternalIPs := func(want []string) {
+		t.Helper()
+		converted, _ := controller.GetService(hostname)
+		if converted == nil {
+			t.Fatal("service not found")
+		}
+		if got := converted.Attributes.ClusterExternalIPs[clusterID]; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got external IPs %v, want %v", got, want)
+		}
+	}
+	assertExternalIPs([]string{"203.0.113.10"})
+
+	fx.Clear()
+	svc.Spec.ExternalIPs = []string{"203.0.113.10", "203.0.113.11"}
+	if _, err := controller.client.CoreV1().Services("nsA").Update(context.TODO(), svc, metaV1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("xds"); ev == nil {
+		t.Fatal("Timeout waiting for push")
+	}
+	assertExternalIPs([]string{"203.0.113.10", "203.0.113.11"})
+}
+
+func TestServiceResolutionOverride(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: mode})
+			defer controller.Stop()
+
+			pod := generatePod("128.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "a"}, map[string]string{})
+			addPods(t, controller, pod)
+			if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+				t.Fatalf("wait for pod err: %v", err)
+			}
+
+			svc := &coreV1.Service{
+				ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA", Annotations: map[string]string{}},
+				Spec: coreV1.ServiceSpec{
+					ClusterIP: coreV1.ClusterIPNone,
+					Selector:  map[string]string{"app": "a"},
+					Ports:     []coreV1.ServicePort{{Name: "tcp-port", Port: 8080}},
+				},
+			}
+			services := controller.client.CoreV1().Services("nsA")
+			if _, err := services.Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			// The endpoints of headless services trigger full pushes instead of EDS updates.
+			createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+			if ev := fx.Wait("xds"); ev == nil {
+				t.Fatal("Timeout waiting for push")
+			}
+
+			hostname := kube.ServiceHostname("svc1", "nsA", domainSuffix)
+			assertResolution := func(want model.Resolution) {
+				t.Helper()
+				converted, _ := controller.GetService(hostname)
+				if converted == nil || converted.Resolution != want {
+					t.Fatalf("got service %v, want resolution %v", converted, want)
+				}
+			}
+
+			// Load balancing the headless service pushes its endpoints, at the unspecified address.
+			fx.Clear()
+			svc.Annotations[kube.ResolutionAnnotation] = "ClientSideLB"
+			if _, err := services.Update(context.TODO(), svc, metaV1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if ev := fx.Wait("eds"); ev == nil || len(ev.Endpoints) != 1 {
+				t.Fatalf("expected the endpoints to be pushed, got %v", ev)
+			}
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout updating service")
+			}
+			assertResolution(model.ClientSideLB)
+			if converted, _ := controller.GetService(hostname); converted.Address != constants.UnspecifiedIP {
+				t.Fatalf("got address %s, want the unspecified address", converted.Address)
+			}
+			// Its endpoints are then pushed through EDS.
+			fx.Clear()
+			updateEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1", "128.0.0.2"}, t)
+			if ev := fx.Wait("eds"); ev == nil || len(ev.Endpoints) != 2 {
+				t.Fatalf("expected the endpoints to be pushed, got %v", ev)
+			}
+
+			// Dropping the override makes it passthrough again, with a full push.
+			fx.Clear()
+			delete(svc.Annotations, kube.ResolutionAnnotation)
+			if _, err := services.Update(context.TODO(), svc, metaV1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if ev := fx.Wait("xds"); ev == nil {
+				t.Fatal("Timeout waiting for push")
+			}
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout updating service")
+			}
+			assertResolution(model.Passthrough)
+
+			// Forcing passthrough on a service with a cluster IP pushes the service, and its endpoints
+			// trigger full pushes from then on.
+			svc2 := &coreV1.Service{
+				ObjectMeta: metaV1.ObjectMeta{Name: "svc2", Namespace: "nsA", Annotations: map[string]string{}},
+				Spec: coreV1.ServiceSpec{
+					ClusterIP: "10.0.0.2",
+					Selector:  map[string]string{"app": "a"},
+					Ports:     []coreV1.ServicePort{{Name: "tcp-port", Port: 8080}},
+				},
+			}
+			if _, err := services.Create(context.TODO(), svc2, metaV1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createEndpoints(controller, "svc2", "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+			if ev := fx.Wait("eds"); ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+
+			fx.Clear()
+			svc2.Annotations[kube.ResolutionAnnotation] = "Passthrough"
+			if _, err := services.Update(context.TODO(), svc2, metaV1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if ev := fx.Wait("xds"); ev == nil {
+				t.Fatal("Timeout waiting for push")
+			}
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout updating service")
+			}
+			hostname = kube.ServiceHostname("svc2", "nsA", domainSuffix)
+			assertResolution(model.Passthrough)
+
+			fx.Clear()
+			updateEndpoints(controller, "svc2", "nsA", []string{"tcp-port"}, []string{"128.0.0.1", "128.0.0.2"}, t)
+			ev := fx.Wait("xds")
+			if ev == nil {
+				t.Fatal("Timeout waiting for push")
+			}
+			if ev.ConfigsUpdated == nil {
+				t.Fatal("expected a full push of the passthrough service")
+			}
+		})
+	}
+}
+
+// setStatefulSetEndpoints creates or updates the endpoints of a headless service with one named
+// address per StatefulSet pod, in both Endpoints and EndpointSlice form.
+func setStatefulSetEndpoints(t *testing.T, controller *Controller, name, namespace string, ips []string, create bool) {
+	t.Helper()
+	var portNum int32 = 8080
+	portName := "tcp-port"
+	ep := &coreV1.Endpoints{
+		ObjectMeta: metaV1.ObjectMeta{Name: name, Namespace: namespace},
+		Subsets:    []coreV1.EndpointSubset{{Ports: []coreV1.EndpointPort{{Name: portName, Port: portNum}}}},
+	}
+	slice := &discoveryv1alpha1.EndpointSlice{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{discoveryv1alpha1.LabelServiceName: name},
+		},
+		Ports: []discoveryv1alpha1.EndpointPort{{Name: &portName, Port: &portNum}},
+	}
+	for i, ip := range ips {
+		hostname := fmt.Sprintf("%s-%d", name, i)
+		ep.Subsets[0].Addresses = append(ep.Subsets[0].Addresses, coreV1.EndpointAddress{IP: ip, Hostname: hostname})
+		slice.Endpoints = append(slice.Endpoints, discoveryv1alpha1.Endpoint{Addresses: []string{ip}, Hostname: &hostname})
+	}
+	var err error
+	if create {
+		if _, err = controller.client.CoreV1().Endpoints(namespace).Create(context.TODO(), ep, metaV1.CreateOptions{}); err == nil {
+			_, err = controller.client.DiscoveryV1alpha1().EndpointSlices(namespace).Create(context.TODO(), slice, metaV1.CreateOptions{})
+		}
+	} else {
+		if _, err = controller.client.CoreV1().Endpoints(namespace).Update(context.TODO(), ep, metaV1.UpdateOptions{}); err == nil {
+			_, err = controller.client.DiscoveryV1alpha1().EndpointSlices(namespace).Update(context.TODO(), slice, metaV1.UpdateOptions{})
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStatefulSetEndpointHostNames(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: mode})
+			defer controller.Stop()
+
+			ips := []string{"128.0.0.1", "128.0.0.2", "128.0.0.3"}
+			for i, ip := range ips {
+				addPods(t, controller, generatePod(ip, fmt.Sprintf("web-%d", i), "nsA", "", "node1", map[string]string{"app": "web"}, map[string]string{}))
+				if err := waitForPod(controller, ip); err != nil {
+					t.Fatalf("wait for pod err: %v", err)
+				}
+			}
+			svc := &coreV1.Service{
+				ObjectMeta: metaV1.ObjectMeta{Name: "web", Namespace: "nsA"},
+				Spec: coreV1.ServiceSpec{
+					ClusterIP: coreV1.ClusterIPNone,
+					Selector:  map[string]string{"app": "web"},
+					Ports:     []coreV1.ServicePort{{Name: "tcp-port", Port: 8080}},
+				},
+			}
+			if _, err := controller.client.CoreV1().Services("nsA").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+
+			hostname := kube.ServiceHostname("web", "nsA", domainSuffix)
+			assertHostNames := func(want map[string]string) {
+				t.Helper()
+				retry.UntilSuccessOrFail(t, func() error {
+					converted, _ := controller.GetService(hostname)
+					if converted == nil {
+						return fmt.Errorf("service not found")
+					}
+					instances, err := controller.InstancesByPort(converted, 8080, nil)
+					if err != nil {
+						return err
+					}
+					got := make(map[string]string)
+					for _, si := range instances {
+						got[si.Endpoint.Address] = si.Endpoint.HostName
+					}
+					if !reflect.DeepEqual(got, want) {
+						return fmt.Errorf("got endpoint host names %v, want %v", got, want)
+					}
+					return nil
+				}, retry.Timeout(5*time.Second))
+			}
+
+			setStatefulSetEndpoints(t, controller, "web", "nsA", ips, true)
+			if ev := fx.Wait("xds"); ev == nil {
+				t.Fatal("Timeout waiting for push")
+			}
+			assertHostNames(map[string]string{
+				"128.0.0.1": "web-0." + string(hostname),
+				"128.0.0.2": "web-1." + string(hostname),
+				"128.0.0.3": "web-2." + string(hostname),
+			})
+
+			// web-1 is rescheduled with a new address and keeps its name.
+			fx.Clear()
+			addPods(t, controller, generatePod("128.0.0.4", "web-1", "nsA", "", "node1", map[string]string{"app": "web"}, map[string]string{}))
+			if err := waitForPod(controller, "128.0.0.4"); err != nil {
+				t.Fatalf("wait for pod err: %v", err)
+			}
+			setStatefulSetEndpoints(t, controller, "web", "nsA", []string{"128.0.0.1", "128.0.0.4", "128.0.0.3"}, false)
+			if ev := fx.Wait("xds"); ev == nil {
+				t.Fatal("Timeout waiting for push")
+			}
+			assertHostNames(map[string]string{
+				"128.0.0.1": "web-0." + string(hostname),
+				"128.0.0.4": "web-1." + string(hostname),
+				"128.0.0.3": "web-2." + string(hostname),
+			})
+		})
+	}
+}
+
+func TestControlPlaneEndpoints(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			handled := make(map[string]int)
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{
+				mode: mode,
+				instanceHandler: func(si *model.ServiceInstance, _ model.Event) {
+					mu.Lock()
+					defer mu.Unlock()
+					handled[si.Service.Attributes.Name]++
+				},
+			})
+			defer controller.Stop()
+
+			pod := generatePod("128.0.0.1", "istiod-abc", IstioNamespace, "", "node1", map[string]string{"app": "istiod"}, map[string]string{})
+			addPods(t, controller, pod)
+			if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+				t.Fatalf("wait for pod err: %v", err)
+			}
+
+			for _, svcName := range []string{"istiod", "other"} {
+				createService(controller, svcName, IstioNamespace, nil, []int32{15012}, map[string]string{"app": "istiod"}, t)
+				if ev := fx.Wait("service"); ev == nil {
+					t.Fatal("Timeout creating service")
+				}
+				createEndpoints(controller, svcName, IstioNamespace, []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+				ev := fx.Wait("eds")
+				if ev == nil {
+					t.Fatal("Timeout incremental eds")
+				}
+				wantControlPlane := svcName == "istiod"
+				for _, ep := range ev.Endpoints {
+					if ep.ControlPlane != wantControlPlane {
+						t.Fatalf("got control plane flag %v for endpoint of %s, want %v", ep.ControlPlane, svcName, wantControlPlane)
+					}
+				}
+			}
+
+			// Handlers run after the push, so wait for those of the last service.
+			retry.UntilSuccessOrFail(t, func() error {
+				mu.Lock()
+				defer mu.Unlock()
+				if handled["other"] == 0 {
+					return fmt.Errorf("expected endpoints of other services to reach instance handlers")
+				}
+				return nil
+			}, retry.Timeout(5*time.Second))
+			mu.Lock()
+			defer mu.Unlock()
+			if handled["istiod"] != 0 {
+				t.Fatalf("expected control plane endpoints not to reach instance handlers, got %d", handled["istiod"])
+			}
+		})
+	}
+}
+
+func TestRejectedServices(t *testing.T) {
+	controller, fx := newFakeControllerWithOptions(fakeControllerOptions{})
+	defer controller.Stop()
+
+	assertRejected := func(want map[string]string) {
+		t.Helper()
+		retry.UntilSuccessOrFail(t, func() error {
+			got := make(map[string]string)
+			for _, r := range controller.RejectedServices() {
+				got[r.Name] = r.Reason
+			}
+			if !reflect.DeepEqual(got, want) {
+				return fmt.Errorf("got rejected services %v, want %v", got, want)
+			}
+			return nil
+		}, retry.Timeout(5*time.Second))
+	}
+	getService := func(name string) *model.Service {
+		svc, _ := controller.GetService(kube.ServiceHostname(name, "nsA", domainSuffix))
+		return svc
+	}
+
+	udpOnly := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{Name: "syslog", Namespace: "nsA"},
+		Spec: coreV1.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+			Ports:     []coreV1.ServicePort{{Name: "syslog", Port: 514, Protocol: coreV1.ProtocolUDP}},
+		},
+	}
+	overlong := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{Name: strings.Repeat("a", 64), Namespace: "nsA"},
+		Spec: coreV1.ServiceSpec{
+			ClusterIP: "10.0.0.2",
+			Ports:     []coreV1.ServicePort{{Name: "tcp-port", Port: 8080}},
+		},
+	}
+	for _, svc := range []*coreV1.Service{udpOnly, overlong} {
+		if _, err := controller.client.CoreV1().Services("nsA").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertRejected(map[string]string{
+		"syslog":                RejectedNoUsablePorts,
+		strings.Repeat("a", 64): RejectedInvalidHostname,
+	})
+	if getService("syslog") != nil || getService(strings.Repeat("a", 64)) != nil {
+		t.Fatal("expected rejected services not to be registered")
+	}
+
+	// Fixing the service admits it.
+	udpOnly.Spec.Ports = append(udpOnly.Spec.Ports, coreV1.ServicePort{Name: "tcp-syslog", Port: 601, Protocol: coreV1.ProtocolTCP})
+	if _, err := controller.client.CoreV1().Services("nsA").Update(context.TODO(), udpOnly, metaV1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout updating service")
+	}
+	assertRejected(map[string]string{strings.Repeat("a", 64): RejectedInvalidHostname})
+	if getService("syslog") == nil {
+		t.Fatal("expected the fixed service to be registered")
+	}
+
+	// Breaking it again removes it.
+	udpOnly.Spec.Ports = udpOnly.Spec.Ports[:1]
+	if _, err := controller.client.CoreV1().Services("nsA").Update(context.TODO(), udpOnly, metaV1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout deleting service")
+	}
+	if getService("syslog") != nil {
+		t.Fatal("expected the broken service to be removed")
+	}
+	assertRejected(map[string]string{
+		"syslog":                RejectedNoUsablePorts,
+		strings.Repeat("a", 64): RejectedInvalidHostname,
+	})
+}
+
+func TestNormalizeWatchedNamespaces(t *testing.T) {
+	cases := map[string]string{
+		"":                      "",
+		"nsA":                   "nsA",
+		"nsA,nsB":               "nsA,nsB",
+		",istio-system":         "",
+		"istio-system,,nsA":     "",
+		" ,nsA":                 "",
+		"nsA,":                  "nsA",
+		"nsA,,":                 "nsA",
+		"nsA, ,":                "nsA",
+		",":                     "",
+		" , ":                   "",
+		" nsA , nsB ,nsA":       "nsA,nsB",
+		"istio-system,nsA,nsA,": "istio-system,nsA",
+	}
+	for in, want := range cases {
+		if got := normalizeWatchedNamespaces(in); got != want {
+			t.Errorf("normalizeWatchedNamespaces(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestOverlappingWatchedNamespaces(t *testing.T) {
+	controller, fx := newFakeControllerWithOptions(fakeControllerOptions{watchedNamespaces: ",nsA,nsA"})
+	defer controller.Stop()
+
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	// Overlapping watches would deliver the service a second time.
+	timeout := time.After(500 * time.Millisecond)
+	for {
+		select {
+		case ev := <-fx.Events:
+			if ev.Type == "service" {
+				t.Fatalf("got a duplicate service event %v", ev)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func TestSvcUpdateHostname(t *testing.T) {
+	controller, fx := newFakeControllerWithOptions(fakeControllerOptions{
+		domainSuffixes: map[string]string{"nsB": "mesh-b.local"},
+	})
+	defer controller.Stop()
+
+	for _, ns := range []string{"nsA", "nsB"} {
+		createService(controller, "svc1", ns, nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+		ev := fx.Wait("service")
+		if ev == nil {
+			t.Fatal("Timeout creating service")
+		}
+		want := kube.ServiceHostname("svc1", ns, controller.domainSuffix(ns))
+		if ev.ID != string(want) {
+			t.Fatalf("service update of %s got hostname %s, want %s", ns, ev.ID, want)
+		}
+		controller.RLock()
+		_, f := controller.servicesMap[host.Name(ev.ID)]
+		controller.RUnlock()
+		if !f {
+			t.Fatalf("service update hostname %s is not a key of the services", ev.ID)
+		}
+
+		if err := controller.client.CoreV1().Services(ns).Delete(context.TODO(), "svc1", metaV1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if ev := fx.Wait("service"); ev == nil || ev.ID != string(want) {
+			t.Fatalf("service delete of %s got %v, want hostname %s", ns, ev, want)
+		}
+	}
+}
+
+func TestServiceAndEndpointsDeleteOrder(t *testing.T) {
+	deleteService := func(t *testing.T, controller *Controller) {
+		t.Helper()
+		if err := controller.client.CoreV1().Services("nsA").Delete(context.TODO(), "svc1", metaV1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleteEndpoints := func(t *testing.T, controller *Controller) {
+		t.Helper()
+		if err := controller.client.CoreV1().Endpoints("nsA").Delete(context.TODO(), "svc1", metaV1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := controller.client.DiscoveryV1alpha1().EndpointSlices("nsA").Delete(context.TODO(), "svc1", metaV1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hostname := kube.ServiceHostname("svc1", "nsA", domainSuffix)
+
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			setup := func(t *testing.T) (*Controller, *FakeXdsUpdater) {
+				controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: mode})
+				pod := generatePod("128.0.0.1", "pod1", "nsA", "", "", map[string]string{"app": "prod-app"}, nil)
+				addPods(t, controller, pod)
+				if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+					t.Fatal(err)
+				}
+				createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+				if ev := fx.Wait("service"); ev == nil {
+					t.Fatal("Timeout creating service")
+				}
+				createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+				if ev := fx.Wait("eds"); ev == nil {
+					t.Fatal("Timeout incremental eds")
+				}
+				return controller, fx
+			}
+			// waitForEDS waits for the last EDS update of the service to have n endpoints.
+			waitForEDS := func(t *testing.T, fx *FakeXdsUpdater, n int) {
+				t.Helper()
+				retry.UntilSuccessOrFail(t, func() error {
+					endpoints, f := fx.LastEDS(string(hostname))
+					if !f || len(endpoints) != n {
+						return fmt.Errorf("got the last EDS update %v (found %v), want %d endpoints", endpoints, f, n)
+					}
+					return nil
+				}, retry.Timeout(5*time.Second))
+			}
+			waitForServiceDelete := func(t *testing.T, controller *Controller) {
+				t.Helper()
+				retry.UntilSuccessOrFail(t, func() error {
+					if svc, _ := controller.GetService(hostname); svc != nil {
+						return fmt.Errorf("service %s not deleted", hostname)
+					}
+					return nil
+				}, retry.Timeout(5*time.Second))
+			}
+
+			t.Run("service first", func(t *testing.T) {
+				controller, fx := setup(t)
+				defer controller.Stop()
+				deleteService(t, controller)
+				waitForServiceDelete(t, controller)
+				waitForEDS(t, fx, 0)
+				// The delete of the Endpoints of the deleted service pushes nothing more.
+				deleteEndpoints(t, controller)
+				waitForEDS(t, fx, 0)
+			})
+
+			t.Run("endpoints first", func(t *testing.T) {
+				controller, fx := setup(t)
+				defer controller.Stop()
+				deleteEndpoints(t, controller)
+				waitForEDS(t, fx, 0)
+				deleteService(t, controller)
+				waitForServiceDelete(t, controller)
+				waitForEDS(t, fx, 0)
+			})
+
+			t.Run("service recreated", func(t *testing.T) {
+				// The Endpoints outlive the service, whose endpoints are pushed again when it is
+				// created again.
+				controller, fx := setup(t)
+				defer controller.Stop()
+				deleteService(t, controller)
+				waitForServiceDelete(t, controller)
+				waitForEDS(t, fx, 0)
+				createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+				waitForEDS(t, fx, 1)
+			})
+		})
+	}
+}
+
+func TestServiceAddBuildsSkippedEndpoints(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: mode})
+			defer controller.Stop()
+			pod := generatePod("128.0.0.1", "pod1", "nsA", "", "", map[string]string{"app": "prod-app"}, nil)
+			addPods(t, controller, pod)
+			if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+				t.Fatal(err)
+			}
+
+			// No endpoints event of svc1 was skipped, its add builds no endpoints.
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			if endpoints, f := fx.LastEDS(string(kube.ServiceHostname("svc1", "nsA", domainSuffix))); f {
+				t.Fatalf("expected no EDS update for svc1, got %v", endpoints)
+			}
+
+			// The Endpoints of svc2 come before it, they are built when it is added.
+			hostname := kube.ServiceHostname("svc2", "nsA", domainSuffix)
+			createEndpoints(controller, "svc2", "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+			retry.UntilSuccessOrFail(t, func() error {
+				controller.RLock()
+				defer controller.RUnlock()
+				if _, f := controller.skippedEndpoints[hostname]; !f {
+					return fmt.Errorf("expected the endpoints of %s to be skipped", hostname)
+				}
+				return nil
+			}, retry.Timeout(5*time.Second))
+			createService(controller, "svc2", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+			retry.UntilSuccessOrFail(t, func() error {
+				endpoints, f := fx.LastEDS(string(hostname))
+				if !f || len(endpoints) != 1 {
+					return fmt.Errorf("got the last EDS update %v (found %v), want 1 endpoint", endpoints, f)
+				}
+				return nil
+			}, retry.Timeout(5*time.Second))
+			if controller.takeSkippedEndpoints(hostname) {
+				t.Fatalf("expected the skipped endpoints of %s to be forgotten", hostname)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sort"
+	"strings"
+)
+
+// namespaceDomainSuffixes resolves the domain suffix of the hostnames of the services of a
+// namespace, see Options.NamespaceDomainSuffixes.
+type namespaceDomainSuffixes struct {
+	defaultSuffix string
+	exact         map[string]string
+	// prefixes are the namespace prefixes of the wildcard entries, longest first.
+	prefixes []namespacePrefixSuffix
+}
+
+type namespacePrefixSuffix struct {
+	prefix string
+	suffix string
+}
+
+func newNamespaceDomainSuffixes(defaultSuffix string, suffixes map[string]string) *namespaceDomainSuffixes {
+	s := &namespaceDomainSuffixes{
+		defaultSuffix: defaultSuffix,
+		exact:         make(map[string]string),
+	}
+	for namespace, suffix := range suffixes {
+		if strings.HasSuffix(namespace, "*") {
+			s.prefixes = append(s.prefixes, namespacePrefixSuffix{prefix: strings.TrimSuffix(namespace, "*"), suffix: suffix})
+		} else {
+			s.exact[namespace] = suffix
+		}
+	}
+	sort.Slice(s.prefixes, func(i, j int) bool { return len(s.prefixes[i].prefix) > len(s.prefixes[j].prefix) })
+	return s
+}
+
+// forNamespace returns the suffix of the namespace: that of the namespace itself, else that of
+// the longest matching prefix, else the default suffix.
+func (s *namespaceDomainSuffixes) forNamespace(namespace string) string {
+	if suffix, f := s.exact[namespace]; f {
+		return suffix
+	}
+	for _, p := range s.prefixes {
+		if strings.HasPrefix(namespace, p.prefix) {
+			return p.suffix
+		}
+	}
+	return s.defaultSuffix
+}
+
+// domainSuffix returns the domain suffix of the hostnames of the services of the namespace.
+func (c *Controller) domainSuffix(namespace string) string {
+	return c.domainSuffixes.forNamespace(namespace)
+}
@@ -0,0 +1,126 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+)
+
+func TestNamespaceDomainSuffixes(t *testing.T) {
+	suffixes := newNamespaceDomainSuffixes("cluster.local", map[string]string{
+		"tenant-b":   "exact.local",
+		"tenant-*":   "tenant.local",
+		"tenant-b-*": "mesh-b.local",
+	})
+	cases := map[string]string{
+		"default":    "cluster.local",
+		"tenant-a":   "tenant.local",
+		"tenant-b":   "exact.local",
+		"tenant-b-1": "mesh-b.local",
+		"tenant":     "cluster.local",
+	}
+	for namespace, want := range cases {
+		if got := suffixes.forNamespace(namespace); got != want {
+			t.Errorf("suffix of namespace %s: got %s, want %s", namespace, got, want)
+		}
+	}
+}
+
+func TestNamespaceDomainSuffixServices(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{
+				mode:           mode,
+				domainSuffixes: map[string]string{"tenant-b-*": "mesh-b.local"},
+			})
+			defer controller.Stop()
+
+			hostnameA := kube.ServiceHostname("svc1", "nsA", domainSuffix)
+			hostnameB := kube.ServiceHostname("svc1", "tenant-b-1", "mesh-b.local")
+			waitForEDS := func(hostname host.Name) *XdsEvent {
+				t.Helper()
+				for {
+					ev := fx.Wait("eds")
+					if ev == nil {
+						t.Fatalf("Timeout waiting for the endpoints of %s", hostname)
+					}
+					if ev.ID == string(hostname) {
+						return ev
+					}
+				}
+			}
+
+			for _, p := range []struct {
+				ip, namespace string
+				hostname      host.Name
+			}{
+				{"128.0.0.1", "nsA", hostnameA},
+				{"128.0.0.2", "tenant-b-1", hostnameB},
+			} {
+				pod := generatePod(p.ip, "pod1", p.namespace, "sa", "node1", map[string]string{"app": "a"}, map[string]string{})
+				addPods(t, controller, pod)
+				if err := waitForPod(controller, p.ip); err != nil {
+					t.Fatalf("wait for pod err: %v", err)
+				}
+				createService(controller, "svc1", p.namespace, nil, []int32{8080}, map[string]string{"app": "a"}, t)
+				if ev := fx.Wait("service"); ev == nil {
+					t.Fatal("Timeout creating service")
+				}
+				createEndpoints(controller, "svc1", p.namespace, []string{"tcp-port"}, []string{p.ip}, t)
+				waitForEDS(p.hostname)
+			}
+
+			for _, hostname := range []host.Name{hostnameA, hostnameB} {
+				if svc, err := controller.GetService(hostname); err != nil || svc == nil {
+					t.Fatalf("expected service %s, got %v", hostname, err)
+				}
+			}
+
+			instances, err := controller.GetProxyServiceInstances(&model.Proxy{
+				Type:        model.SidecarProxy,
+				IPAddresses: []string{"128.0.0.2"},
+				ID:          "pod1.tenant-b-1",
+				Metadata:    &model.NodeMetadata{Namespace: "tenant-b-1"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(instances) != 1 || instances[0].Service.Hostname != hostnameB {
+				t.Fatalf("expected one instance of %s, got %v", hostnameB, instances)
+			}
+
+			// Updating the endpoints of one service leaves the other one alone.
+			updateEndpoints(controller, "svc1", "tenant-b-1", []string{"tcp-port"}, []string{"128.0.0.3"}, t)
+			ev := waitForEDS(hostnameB)
+			if len(ev.Endpoints) != 1 || ev.Endpoints[0].Address != "128.0.0.3" {
+				t.Fatalf("expected the updated endpoint of %s, got %v", hostnameB, ev.Endpoints)
+			}
+			svcA, _ := controller.GetService(hostnameA)
+			instances, err = controller.InstancesByPort(svcA, 8080, labels.Collection{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(instances) != 1 || instances[0].Endpoint.Address != "128.0.0.1" {
+				t.Fatalf("expected the endpoint of %s to be unchanged, got %v", hostnameA, instances)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+var (
+	edsBatchedUpdates = monitoring.NewSum(
+		"pilot_k8s_eds_batched_updates",
+		"EDS updates submitted in a batch, during the initial sync or an EDS reconcile.")
+
+	initialEDSBatchLatency = monitoring.NewGauge(
+		"pilot_k8s_initial_eds_batch_seconds",
+		"Seconds from the start of the controller to the submission of the endpoints of its initial sync.",
+		monitoring.WithLabels(clusterTag),
+	)
+)
+
+func init() {
+	monitoring.MustRegister(edsBatchedUpdates, initialEDSBatchLatency)
+}
+
+// initialEDSBatchTimeout bounds the wait of the initial EDS batch for the informers the endpoints
+// are built from, after which the endpoints built so far are submitted and the later ones pushed
+// as they are built.
+const initialEDSBatchTimeout = 30 * time.Second
+
+// waitForInitialEndpoints waits for the informers the endpoints are built from to sync, or for
+// initialEDSBatchTimeout to elapse. The other informers, such as those of the nodes, are not
+// waited for: they may take long to list, or never sync when istiod may not list them. It returns
+// false if stopped first.
+func (c *Controller) waitForInitialEndpoints(stop <-chan struct{}) bool {
+	timedOut := make(chan struct{})
+	timer := c.clock.AfterFunc(initialEDSBatchTimeout, func() { close(timedOut) })
+	defer timer.Stop()
+	poll := time.NewTicker(100 * time.Millisecond)
+	defer poll.Stop()
+	for {
+		if c.endpointsSynced() {
+			return true
+		}
+		select {
+		case <-stop:
+			return false
+		case <-timedOut:
+			log.Warnf("Initial sync of cluster %s: the services, pods and endpoints did not sync within %v, "+
+				"their endpoints are pushed as they are built", c.clusterID, initialEDSBatchTimeout)
+			return true
+		case <-poll.C:
+		}
+	}
+}
+
+// edsBatcher collects the EDS updates made within batch windows, such as the initial sync, and
+// submits them with a single EDSBatchUpdate when the last open window closes. Outside of the
+// windows, or when the XDS updater cannot take batches, updates go straight through.
+type edsBatcher struct {
+	updater model.EDSBatchUpdater
+	shard   string
+	// push is used for the updates made outside of the windows.
+	push func(hostname, namespace string, endpoints []*model.IstioEndpoint)
+	// batched is called with each update of a batch before submitting it, so that an older update
+	// still held by push is not pushed after the batch. It may be nil.
+	batched func(hostname string, endpoints []*model.IstioEndpoint)
+
+	mu sync.Mutex
+	// windows is the number of open batch windows.
+	windows int
+	// pending is the latest update of each service in the current windows, in the order the
+	// services were first updated.
+	pending map[string]int
+	entries []model.EDSUpdateEntry
+}
+
+func newEDSBatcher(xdsUpdater model.XDSUpdater, shard string,
+	push func(hostname, namespace string, endpoints []*model.IstioEndpoint),
+	batched func(hostname string, endpoints []*model.IstioEndpoint)) *edsBatcher {
+	updater, _ := xdsUpdater.(model.EDSBatchUpdater)
+	return &edsBatcher{
+		updater: updater,
+		shard:   shard,
+		push:    push,
+		batched: batched,
+		pending: make(map[string]int),
+	}
+}
+
+// open opens a batch window, which must be closed with close.
+func (b *edsBatcher) open() {
+	if b.updater == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.windows++
+}
+
+// close closes a window opened by open, submitting the batch when no other window is open.
+// It returns the number of services submitted.
+func (b *edsBatcher) close() int {
+	if b.updater == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.windows--
+	if b.windows > 0 || len(b.entries) == 0 {
+		return 0
+	}
+	entries := b.entries
+	b.entries = nil
+	b.pending = make(map[string]int)
+	edsBatchedUpdates.Record(float64(len(entries)))
+	if b.batched != nil {
+		for _, e := range entries {
+			b.batched(e.Hostname, e.Endpoints)
+		}
+	}
+	// Submitted under the lock, so that updates made after the window are never pushed before it.
+	_ = b.updater.EDSBatchUpdate(b.shard, entries)
+	return len(entries)
+}
+
+// update adds the update to the batch if a window is open, and pushes it otherwise.
+func (b *edsBatcher) update(hostname, namespace string, endpoints []*model.IstioEndpoint) {
+	if b.updater != nil {
+		b.mu.Lock()
+		if b.windows > 0 {
+			entry := model.EDSUpdateEntry{Hostname: hostname, Namespace: namespace, Endpoints: endpoints}
+			if i, f := b.pending[hostname]; f {
+				b.entries[i] = entry
+			} else {
+				b.pending[hostname] = len(b.entries)
+				b.entries = append(b.entries, entry)
+			}
+			b.mu.Unlock()
+			return
+		}
+		b.mu.Unlock()
+	}
+	b.push(hostname, namespace, endpoints)
+}
@@ -0,0 +1,295 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	discoveryv1alpha1 "k8s.io/api/discovery/v1alpha1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	metafake "k8s.io/client-go/metadata/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+// recordingBatchUpdater records the batches it is given.
+type recordingBatchUpdater struct {
+	*FakeXdsUpdater
+	batches [][]model.EDSUpdateEntry
+}
+
+func (r *recordingBatchUpdater) EDSBatchUpdate(_ string, entries []model.EDSUpdateEntry) error {
+	r.batches = append(r.batches, entries)
+	return nil
+}
+
+func TestEDSBatcherWindows(t *testing.T) {
+	updater := &recordingBatchUpdater{FakeXdsUpdater: NewFakeXDS()}
+	var pushed []string
+	b := newEDSBatcher(updater, "cluster1", func(hostname, _ string, _ []*model.IstioEndpoint) {
+		pushed = append(pushed, hostname)
+	}, nil)
+	endpoints := func(address string) []*model.IstioEndpoint {
+		return []*model.IstioEndpoint{{Address: address}}
+	}
+
+	// Outside of a window, updates go straight through.
+	b.update("a", "ns", endpoints("10.0.0.1"))
+	if !reflect.DeepEqual(pushed, []string{"a"}) || len(updater.batches) != 0 {
+		t.Fatalf("expected a direct push, got pushes %v and batches %v", pushed, updater.batches)
+	}
+
+	b.open()
+	b.update("a", "ns", endpoints("10.0.0.1"))
+	b.open()
+	b.update("b", "ns", endpoints("10.0.0.2"))
+	b.update("a", "ns", endpoints("10.0.0.3"))
+	if n := b.close(); n != 0 || len(updater.batches) != 0 {
+		t.Fatalf("expected no batch while a window is open, got %d services", n)
+	}
+	if n := b.close(); n != 2 {
+		t.Fatalf("expected a batch of 2 services, got %d", n)
+	}
+	want := []model.EDSUpdateEntry{
+		{Hostname: "a", Namespace: "ns", Endpoints: endpoints("10.0.0.3")},
+		{Hostname: "b", Namespace: "ns", Endpoints: endpoints("10.0.0.2")},
+	}
+	if len(updater.batches) != 1 || !reflect.DeepEqual(updater.batches[0], want) {
+		t.Fatalf("got batches %v, want %v", updater.batches, want)
+	}
+	if len(pushed) != 1 {
+		t.Fatalf("expected no direct push within the windows, got %v", pushed)
+	}
+
+	// Empty windows submit nothing, and the batcher is back to direct pushes.
+	b.open()
+	if n := b.close(); n != 0 || len(updater.batches) != 1 {
+		t.Fatalf("expected no batch for an empty window, got %d services", n)
+	}
+	b.update("c", "ns", endpoints("10.0.0.4"))
+	if !reflect.DeepEqual(pushed, []string{"a", "c"}) {
+		t.Fatalf("expected a direct push after the windows, got %v", pushed)
+	}
+}
+
+func TestEDSBatcherDropsDebouncedUpdates(t *testing.T) {
+	updater := &recordingBatchUpdater{FakeXdsUpdater: NewFakeXDS()}
+	recorder := &pushRecorder{}
+	clock := NewFakeClock(time.Unix(0, 0))
+	d := newEDSDebouncer(time.Second, clock, recorder.push)
+	b := newEDSBatcher(updater, "cluster1", d.update, d.batched)
+
+	// The first update is pushed, the second one is held by the debouncer.
+	b.update("a", "ns", endpointsWithAddress("10.0.0.1"))
+	b.update("a", "ns", endpointsWithAddress("10.0.0.2"))
+	b.update("b", "ns", endpointsWithAddress("10.0.0.3"))
+	b.update("b", "ns", endpointsWithAddress("10.0.0.4"))
+
+	b.open()
+	b.update("a", "ns", endpointsWithAddress("10.0.0.5"))
+	b.update("b", "ns", nil)
+	if n := b.close(); n != 2 {
+		t.Fatalf("expected a batch of 2 services, got %d", n)
+	}
+
+	// The held updates are older than the batch, and never pushed.
+	clock.Step(2 * time.Second)
+	if pushes := recorder.get(); len(pushes) != 2 {
+		t.Fatalf("expected only the first updates to be pushed directly, got %v", pushes)
+	}
+
+	// The batch counts as the last push of the services it updated.
+	b.update("a", "ns", endpointsWithAddress("10.0.0.6"))
+	if pushes := recorder.get(); len(pushes) != 3 || pushes[2].endpoints[0].Address != "10.0.0.6" {
+		t.Fatalf("expected the update after the interval to be pushed, got %v", pushes)
+	}
+	b.update("a", "ns", endpointsWithAddress("10.0.0.7"))
+	if pushes := recorder.get(); len(pushes) != 3 {
+		t.Fatalf("expected the next update to be held, got %v", pushes)
+	}
+}
+
+func TestEDSBatcherWithoutBatchUpdater(t *testing.T) {
+	var pushed []string
+	// Only the methods of the XDSUpdater interface are promoted, hiding EDSBatchUpdate.
+	updater := struct{ model.XDSUpdater }{NewFakeXDS()}
+	b := newEDSBatcher(updater, "cluster1", func(hostname, _ string, _ []*model.IstioEndpoint) {
+		pushed = append(pushed, hostname)
+	}, nil)
+	b.open()
+	b.update("a", "ns", []*model.IstioEndpoint{{Address: "10.0.0.1"}})
+	b.close()
+	if !reflect.DeepEqual(pushed, []string{"a"}) {
+		t.Fatalf("expected updates to go straight through, got %v", pushed)
+	}
+}
+
+// initialSyncObjects returns a service with endpoints, both as Endpoints and an EndpointSlice.
+func initialSyncObjects() []runtime.Object {
+	portName := "tcp-port"
+	var port int32 = 1001
+	return []runtime.Object{
+		&coreV1.Service{
+			ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA"},
+			Spec: coreV1.ServiceSpec{
+				ClusterIP: "10.0.0.1",
+				Ports:     []coreV1.ServicePort{{Name: portName, Port: 8080}},
+				Selector:  map[string]string{"app": "a"},
+			},
+		},
+		&coreV1.Endpoints{
+			ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA"},
+			Subsets: []coreV1.EndpointSubset{{
+				Addresses: []coreV1.EndpointAddress{{IP: "128.0.0.1"}},
+				Ports:     []coreV1.EndpointPort{{Name: portName, Port: port}},
+			}},
+		},
+		&discoveryv1alpha1.EndpointSlice{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name:      "svc1",
+				Namespace: "nsA",
+				Labels:    map[string]string{discoveryv1alpha1.LabelServiceName: "svc1"},
+			},
+			Endpoints: []discoveryv1alpha1.Endpoint{{Addresses: []string{"128.0.0.1"}}},
+			Ports:     []discoveryv1alpha1.EndpointPort{{Name: &portName, Port: &port}},
+		},
+	}
+}
+
+func TestEDSBatchInitialSync(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: mode, objects: initialSyncObjects()})
+			defer controller.Stop()
+			hostname := string(kube.ServiceHostname("svc1", "nsA", domainSuffix))
+
+			// The endpoints of the initial listing are batched.
+			ev := fx.Wait("eds")
+			if ev == nil || ev.ID != hostname || !ev.Batched {
+				t.Fatalf("expected a batched update of %s, got %+v", hostname, ev)
+			}
+			select {
+			case <-controller.Synced():
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the controller to sync")
+			}
+
+			// Later updates are not.
+			updateEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.2"}, t)
+			ev = fx.Wait("eds")
+			if ev == nil || ev.ID != hostname || ev.Batched {
+				t.Fatalf("expected a direct update of %s, got %+v", hostname, ev)
+			}
+		})
+	}
+}
+
+// newControllerForbidding runs a controller whose clients fail to list the resources.
+func newControllerForbidding(t *testing.T, options Options, objects []runtime.Object, resources ...string) *Controller {
+	t.Helper()
+	return newControllerWithListReactor(t, options, objects, func(resource string) k8stesting.ReactionFunc {
+		return func(k8stesting.Action) (bool, runtime.Object, error) {
+			return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: resource}, "", nil)
+		}
+	}, resources...)
+}
+
+// newControllerWithListReactor runs a controller whose lists of the resources go through the
+// reactor first.
+func newControllerWithListReactor(tb testing.TB, options Options, objects []runtime.Object,
+	reactor func(resource string) k8stesting.ReactionFunc, resources ...string) *Controller {
+	tb.Helper()
+	client := fake.NewSimpleClientset(objects...)
+	scheme := runtime.NewScheme()
+	if err := metaV1.AddMetaToScheme(scheme); err != nil {
+		tb.Fatal(err)
+	}
+	metadataClient := metafake.NewSimpleMetadataClient(scheme)
+	for _, resource := range resources {
+		client.PrependReactor("list", resource, reactor(resource))
+		metadataClient.PrependReactor("list", resource, reactor(resource))
+	}
+	options.DomainSuffix = domainSuffix
+	options.Metrics = &model.Environment{}
+	c := NewController(client, metadataClient, options)
+	c.stop = make(chan struct{})
+	go c.Run(c.stop)
+	return c
+}
+
+func TestEDSBatchWithoutNodes(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			fx := NewFakeXDS()
+			controller := newControllerForbidding(t, Options{XDSUpdater: fx, EndpointMode: mode}, initialSyncObjects(), "nodes")
+			defer controller.Stop()
+			hostname := string(kube.ServiceHostname("svc1", "nsA", domainSuffix))
+
+			// The endpoints are pushed although the nodes never sync.
+			ev := fx.Wait("eds")
+			if ev == nil || ev.ID != hostname || !ev.Batched {
+				t.Fatalf("expected a batched update of %s, got %+v", hostname, ev)
+			}
+			if controller.nodesSynced() {
+				t.Fatal("the nodes synced despite the forbidden list")
+			}
+			select {
+			case <-controller.Synced():
+				t.Fatal("the controller synced without the nodes")
+			default:
+			}
+		})
+	}
+}
+
+func TestEDSBatchTimeout(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	controller := newControllerForbidding(t, Options{XDSUpdater: NewFakeXDS(), EndpointMode: EndpointsOnly, Clock: clock},
+		nil, "endpoints")
+	defer controller.Stop()
+	windows := func() int {
+		controller.edsBatcher.mu.Lock()
+		defer controller.edsBatcher.mu.Unlock()
+		return controller.edsBatcher.windows
+	}
+
+	retry.UntilSuccessOrFail(t, func() error {
+		if n := windows(); n != 1 {
+			return fmt.Errorf("got %d open windows, want the window of the initial sync", n)
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+	// The window closes after the timeout, although the endpoints never sync.
+	retry.UntilSuccessOrFail(t, func() error {
+		clock.Step(initialEDSBatchTimeout)
+		if n := windows(); n != 0 {
+			return fmt.Errorf("got %d open windows, want none", n)
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+}
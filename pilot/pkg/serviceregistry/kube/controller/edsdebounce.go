@@ -0,0 +1,170 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+var edsCoalescedUpdates = monitoring.NewSum(
+	"pilot_k8s_eds_coalesced_updates",
+	"EDS updates replaced by a later update of the same service before being pushed.")
+
+func init() {
+	monitoring.MustRegister(edsCoalescedUpdates)
+}
+
+// edsDebouncer limits the EDS updates of each service to one per interval. Updates arriving
+// within the interval of the last push are coalesced into a single push of the latest endpoints
+// at the end of the interval. The first update of a service and updates removing all of its
+// endpoints are pushed immediately.
+type edsDebouncer struct {
+	interval time.Duration
+	clock    Clock
+	push     func(hostname, namespace string, endpoints []*model.IstioEndpoint)
+
+	// mu is held while pushing, so pushes of a service are never reordered.
+	mu       sync.Mutex
+	services map[string]*edsDebounceState
+}
+
+type edsDebounceState struct {
+	lastPush time.Time
+	// pending is the latest update not pushed yet, nil if there is none.
+	pending *edsPendingUpdate
+	timer   Timer
+}
+
+type edsPendingUpdate struct {
+	namespace string
+	endpoints []*model.IstioEndpoint
+}
+
+func newEDSDebouncer(interval time.Duration, clock Clock,
+	push func(hostname, namespace string, endpoints []*model.IstioEndpoint)) *edsDebouncer {
+	return &edsDebouncer{
+		interval: interval,
+		clock:    clock,
+		push:     push,
+		services: make(map[string]*edsDebounceState),
+	}
+}
+
+// update pushes the endpoints of the service now or at the end of the current interval.
+func (d *edsDebouncer) update(hostname, namespace string, endpoints []*model.IstioEndpoint) {
+	if d.interval <= 0 {
+		d.push(hostname, namespace, endpoints)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.clock.Now()
+	state, f := d.services[hostname]
+	if len(endpoints) == 0 {
+		// Deletes go through right away, dropping any update they supersede.
+		if f {
+			d.stop(state)
+			delete(d.services, hostname)
+		}
+		d.push(hostname, namespace, endpoints)
+		return
+	}
+	if !f {
+		d.services[hostname] = &edsDebounceState{lastPush: now}
+		d.push(hostname, namespace, endpoints)
+		return
+	}
+	if state.pending == nil && now.Sub(state.lastPush) >= d.interval {
+		state.lastPush = now
+		d.push(hostname, namespace, endpoints)
+		return
+	}
+
+	if state.pending != nil {
+		edsCoalescedUpdates.Increment()
+	}
+	state.pending = &edsPendingUpdate{namespace: namespace, endpoints: endpoints}
+	if state.timer == nil {
+		state.timer = d.clock.AfterFunc(state.lastPush.Add(d.interval).Sub(now), func() {
+			d.flush(hostname, state)
+		})
+	}
+}
+
+// flush pushes the pending update of the service, unless it was dropped in the meantime.
+func (d *edsDebouncer) flush(hostname string, state *edsDebounceState) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	state.timer = nil
+	if d.services[hostname] != state || state.pending == nil {
+		return
+	}
+	pending := state.pending
+	state.pending = nil
+	state.lastPush = d.clock.Now()
+	d.push(hostname, pending.namespace, pending.endpoints)
+}
+
+// batched records an update of the service pushed in an EDS batch, bypassing the debouncer. The
+// pending update of the service is older than the batch and is dropped, and the batch counts as
+// its last push.
+func (d *edsDebouncer) batched(hostname string, endpoints []*model.IstioEndpoint) {
+	if d.interval <= 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	state, f := d.services[hostname]
+	if f {
+		d.stop(state)
+	}
+	if len(endpoints) == 0 {
+		delete(d.services, hostname)
+		return
+	}
+	if !f {
+		state = &edsDebounceState{}
+		d.services[hostname] = state
+	}
+	state.lastPush = d.clock.Now()
+}
+
+// reset drops the pending update of the service and forgets its last push, so that its next
+// update is pushed immediately.
+func (d *edsDebouncer) reset(hostname string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if state, f := d.services[hostname]; f {
+		d.stop(state)
+		delete(d.services, hostname)
+	}
+}
+
+func (d *edsDebouncer) stop(state *edsDebounceState) {
+	if state.timer != nil {
+		state.timer.Stop()
+		state.timer = nil
+	}
+	if state.pending != nil {
+		edsCoalescedUpdates.Increment()
+		state.pending = nil
+	}
+}
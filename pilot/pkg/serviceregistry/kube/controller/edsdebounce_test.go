@@ -0,0 +1,121 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+type recordedPush struct {
+	hostname  string
+	endpoints []*model.IstioEndpoint
+}
+
+type pushRecorder struct {
+	mu     sync.Mutex
+	pushes []recordedPush
+}
+
+func (r *pushRecorder) push(hostname, _ string, endpoints []*model.IstioEndpoint) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pushes = append(r.pushes, recordedPush{hostname, endpoints})
+}
+
+func (r *pushRecorder) get() []recordedPush {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]recordedPush{}, r.pushes...)
+}
+
+func endpointsWithAddress(address string) []*model.IstioEndpoint {
+	return []*model.IstioEndpoint{{Address: address}}
+}
+
+func TestEDSDebouncerCoalesces(t *testing.T) {
+	recorder := &pushRecorder{}
+	clock := NewFakeClock(time.Unix(0, 0))
+	d := newEDSDebouncer(500*time.Millisecond, clock, recorder.push)
+
+	for i := 0; i < 50; i++ {
+		d.update("svc1", "nsA", endpointsWithAddress(fmt.Sprintf("10.0.0.%d", i)))
+		clock.Step(2 * time.Millisecond)
+	}
+	// The first update is pushed right away, the others are coalesced until the end of the interval.
+	if got := len(recorder.get()); got != 1 {
+		t.Fatalf("expected 1 push within the interval, got %d", got)
+	}
+	clock.Step(500 * time.Millisecond)
+
+	pushes := recorder.get()
+	if len(pushes) != 2 {
+		t.Fatalf("expected 2 pushes, got %d", len(pushes))
+	}
+	if got := pushes[1].endpoints[0].Address; got != "10.0.0.49" {
+		t.Fatalf("expected the last push to carry the final endpoints, got %s", got)
+	}
+
+	// Once the interval passed without update, the next one is pushed right away.
+	clock.Step(time.Second)
+	d.update("svc1", "nsA", endpointsWithAddress("10.0.0.50"))
+	if got := len(recorder.get()); got != 3 {
+		t.Fatalf("expected 3 pushes, got %d", got)
+	}
+}
+
+func TestEDSDebouncerImmediateUpdates(t *testing.T) {
+	recorder := &pushRecorder{}
+	d := newEDSDebouncer(time.Hour, realClock{}, recorder.push)
+
+	// The first update of each service is pushed immediately.
+	d.update("svc1", "nsA", endpointsWithAddress("10.0.0.1"))
+	d.update("svc2", "nsA", endpointsWithAddress("10.0.0.2"))
+	if got := len(recorder.get()); got != 2 {
+		t.Fatalf("expected 2 pushes, got %d", got)
+	}
+
+	// A later update is held back, and dropped by a delete which is pushed immediately.
+	d.update("svc1", "nsA", endpointsWithAddress("10.0.0.3"))
+	if got := len(recorder.get()); got != 2 {
+		t.Fatalf("expected the update to be delayed, got %d pushes", got)
+	}
+	d.update("svc1", "nsA", nil)
+	pushes := recorder.get()
+	if len(pushes) != 3 || len(pushes[2].endpoints) != 0 {
+		t.Fatalf("expected the delete to be pushed immediately, got %v", pushes)
+	}
+
+	// After a delete the service appears anew.
+	d.update("svc1", "nsA", endpointsWithAddress("10.0.0.4"))
+	if got := len(recorder.get()); got != 4 {
+		t.Fatalf("expected 4 pushes, got %d", got)
+	}
+}
+
+func TestEDSDebouncerDisabled(t *testing.T) {
+	recorder := &pushRecorder{}
+	d := newEDSDebouncer(0, realClock{}, recorder.push)
+	for i := 0; i < 10; i++ {
+		d.update("svc1", "nsA", endpointsWithAddress("10.0.0.1"))
+	}
+	if got := len(recorder.get()); got != 10 {
+		t.Fatalf("expected every update to be pushed, got %d", got)
+	}
+}
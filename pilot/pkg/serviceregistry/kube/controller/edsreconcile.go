@@ -0,0 +1,151 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+var (
+	edsReconciledOrphans = monitoring.NewSum(
+		"pilot_k8s_eds_reconciled_orphans",
+		"Services whose pushed endpoints were cleared because their Endpoints or EndpointSlices no longer exist.")
+
+	externalNameReconciledOrphans = monitoring.NewSum(
+		"pilot_k8s_external_name_reconciled_orphans",
+		"ExternalName service instances removed because their service no longer exists.")
+)
+
+func init() {
+	monitoring.MustRegister(edsReconciledOrphans, externalNameReconciledOrphans)
+}
+
+// serviceRef names the Kubernetes service backing a hostname.
+type serviceRef struct {
+	name      string
+	namespace string
+}
+
+// trackLocalEndpoints records whether the last EDS update of the service carried local endpoints.
+func (c *Controller) trackLocalEndpoints(hostname host.Name, name, namespace string, hasEndpoints bool) {
+	c.localEDSMutex.Lock()
+	defer c.localEDSMutex.Unlock()
+	if hasEndpoints {
+		c.localEDSServices[hostname] = serviceRef{name: name, namespace: namespace}
+	} else {
+		delete(c.localEDSServices, hostname)
+	}
+}
+
+// hasLocalEndpoints reports whether the last EDS update of the hostname had local endpoints.
+func (c *Controller) hasLocalEndpoints(hostname host.Name) bool {
+	c.localEDSMutex.Lock()
+	defer c.localEDSMutex.Unlock()
+	_, f := c.localEDSServices[hostname]
+	return f
+}
+
+// runEDSReconciler queues reconcileEDS and reconcileExternalNameInstances once per resync period,
+// after the informers re-listed.
+func (c *Controller) runEDSReconciler(stop <-chan struct{}) {
+	if c.options.ResyncPeriod <= 0 {
+		return
+	}
+	for {
+		tick := make(chan struct{})
+		timer := c.clock.AfterFunc(c.options.ResyncPeriod, func() {
+			close(tick)
+		})
+		select {
+		case <-tick:
+			c.queue.Push(c.reconcileEDS)
+			c.queue.Push(c.reconcileExternalNameInstances)
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// reconcileEDS clears the local endpoints of services whose Endpoints or EndpointSlices are gone
+// from the informer cache. Objects deleted while a watch was down are normally removed by a
+// synthesized delete, but when that is missed the pushed endpoints would otherwise stay forever.
+// The endpoints cleared are submitted in one batch.
+func (c *Controller) reconcileEDS() error {
+	c.edsBatcher.open()
+	defer c.edsBatcher.close()
+
+	c.localEDSMutex.Lock()
+	services := make(map[host.Name]serviceRef, len(c.localEDSServices))
+	for hostname, ref := range c.localEDSServices {
+		services[hostname] = ref
+	}
+	c.localEDSMutex.Unlock()
+
+	for hostname, ref := range services {
+		if !c.endpointsController().clearIfOrphaned(hostname, ref.name, ref.namespace) {
+			continue
+		}
+		log.Infof("Reconcile EDS: clearing endpoints of %s, its endpoints objects no longer exist", hostname)
+		edsReconciledOrphans.Increment()
+		c.trackLocalEndpoints(hostname, ref.name, ref.namespace, false)
+
+		endpoints := make([]*model.IstioEndpoint, 0)
+		c.RLock()
+		svc := c.servicesMap[hostname]
+		c.RUnlock()
+		if svc != nil {
+			endpoints = append(endpoints, c.collectAllForeignEndpoints(svc)...)
+		}
+		c.edsUpdate(hostname, ref.namespace, endpoints)
+	}
+	return nil
+}
+
+// reconcileExternalNameInstances removes the ExternalName service instances of services that no
+// longer exist, which a delete missed during a watch gap would otherwise leave behind.
+func (c *Controller) reconcileExternalNameInstances() error {
+	var orphans []host.Name
+	c.RLock()
+	for hostname := range c.externalNameSvcInstanceMap {
+		if _, f := c.servicesMap[hostname]; !f {
+			orphans = append(orphans, hostname)
+		}
+	}
+	c.RUnlock()
+	if len(orphans) == 0 {
+		return nil
+	}
+
+	var removed []host.Name
+	c.Lock()
+	for _, hostname := range orphans {
+		// The service may have been added since.
+		if _, f := c.servicesMap[hostname]; !f {
+			delete(c.externalNameSvcInstanceMap, hostname)
+			removed = append(removed, hostname)
+		}
+	}
+	c.Unlock()
+	for _, hostname := range removed {
+		log.Infof("Reconcile ExternalName instances: removing the instances of %s, its service no longer exists", hostname)
+		externalNameReconciledOrphans.Increment()
+	}
+	return nil
+}
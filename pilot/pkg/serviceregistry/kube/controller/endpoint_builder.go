@@ -16,12 +16,75 @@ package controller
 
 import (
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
 
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/serviceregistry/kube"
 	"istio.io/istio/pkg/config/labels"
 )
 
+// endpointOptions are the options deciding how the endpoints are built, with their defaults
+// applied. They are read from Options once, by newEndpointOptions.
+type endpointOptions struct {
+	// nodeLabelsToCopy are the node labels copied onto endpoints, prefixed with nodeLabelPrefix.
+	nodeLabelsToCopy []string
+	nodeLabelPrefix  string
+	// proxyContainerName is the sidecar container whose readiness is tracked by the pod cache.
+	// excludeProxyUnready drops the endpoints of pods whose proxy container is not ready.
+	proxyContainerName  string
+	excludeProxyUnready bool
+	// uidIncludesClusterID appends the cluster ID to workload UIDs.
+	uidIncludesClusterID bool
+	// honorWorkloadIdentity and trustDomain are Options.HonorWorkloadIdentityAnnotation and
+	// Options.TrustDomain.
+	honorWorkloadIdentity bool
+	trustDomain           string
+	// localityOrder are the sources of the locality of pods, see getPodLocality.
+	localityOrder []LocalitySource
+	// permissiveEndpointPorts builds the endpoints of the ports their service does not declare.
+	// reservedProxyPorts are the ports of the sidecar that the endpoints of its pods are checked
+	// against, the collisions are left out with excludeReservedProxyPorts.
+	permissiveEndpointPorts   bool
+	reservedProxyPorts        map[int32]struct{}
+	excludeReservedProxyPorts bool
+	// crossNamespaceEndpoints are the namespaces of Options.CrossNamespaceEndpointNamespaces.
+	crossNamespaceEndpoints map[string]struct{}
+	// dropForeignPodOverlaps drops the foreign instances overlapping a pod, see
+	// filterForeignPodOverlaps.
+	dropForeignPodOverlaps bool
+}
+
+func newEndpointOptions(options Options) endpointOptions {
+	out := endpointOptions{
+		nodeLabelsToCopy:          options.NodeLabelsToCopy,
+		nodeLabelPrefix:           options.NodeLabelPrefix,
+		proxyContainerName:        options.ProxyContainerName,
+		excludeProxyUnready:       options.ExcludeProxyUnreadyEndpoints,
+		uidIncludesClusterID:      options.UIDIncludesClusterID,
+		honorWorkloadIdentity:     options.HonorWorkloadIdentityAnnotation,
+		trustDomain:               options.TrustDomain,
+		localityOrder:             options.LocalityOrder,
+		permissiveEndpointPorts:   options.PermissiveEndpointPorts,
+		reservedProxyPorts:        newReservedProxyPorts(options.ReservedProxyPorts),
+		excludeReservedProxyPorts: options.ExcludeReservedProxyPorts,
+		crossNamespaceEndpoints:   make(map[string]struct{}, len(options.CrossNamespaceEndpointNamespaces)),
+		dropForeignPodOverlaps:    options.DropForeignPodOverlaps,
+	}
+	if out.nodeLabelPrefix == "" {
+		out.nodeLabelPrefix = DefaultNodeLabelPrefix
+	}
+	if out.proxyContainerName == "" {
+		out.proxyContainerName = DefaultProxyContainerName
+	}
+	if out.localityOrder == nil {
+		out.localityOrder = DefaultLocalityOrder
+	}
+	for _, namespace := range options.CrossNamespaceEndpointNamespaces {
+		out.crossNamespaceEndpoints[namespace] = struct{}{}
+	}
+	return out
+}
+
 // A stateful IstioEndpoint builder with metadata used to build IstioEndpoint
 type EndpointBuilder struct {
 	controller *Controller
@@ -31,16 +94,32 @@ type EndpointBuilder struct {
 	serviceAccount string
 	locality       model.Locality
 	tlsMode        string
+	workloadName   string
+	namespace      string
+	nodeName       string
 }
 
 func NewEndpointBuilder(c *Controller, pod *v1.Pod) *EndpointBuilder {
-	locality, sa, uid := "", "", ""
+	locality, sa, uid, workloadName, namespace, nodeName := "", "", "", "", "", ""
 	var podLabels labels.Instance
 	if pod != nil {
 		locality = c.getPodLocality(pod)
-		sa = kube.SecureNamingSAN(pod)
-		uid = createUID(pod.Name, pod.Namespace)
+		sa = c.workloadIdentity(pod)
+		uid = c.podUID(pod)
 		podLabels = pod.Labels
+		if nodeLabels := c.getPodNodeLabels(pod); len(nodeLabels) > 0 {
+			// Copy so the pod's own label map is not modified.
+			podLabels = make(labels.Instance, len(pod.Labels)+len(nodeLabels))
+			for k, v := range pod.Labels {
+				podLabels[k] = v
+			}
+			for k, v := range nodeLabels {
+				podLabels[k] = v
+			}
+		}
+		workloadName = c.pods.getWorkloadName(pod)
+		namespace = pod.Namespace
+		nodeName = pod.Spec.NodeName
 	}
 
 	return &EndpointBuilder{
@@ -48,12 +127,41 @@ func NewEndpointBuilder(c *Controller, pod *v1.Pod) *EndpointBuilder {
 		labels:         podLabels,
 		uid:            uid,
 		serviceAccount: sa,
-		locality: model.Locality{
-			Label:     locality,
-			ClusterID: c.clusterID,
-		},
-		tlsMode: kube.PodTLSMode(pod),
+		locality:       c.localLocality(locality),
+		tlsMode:        kube.PodTLSMode(pod),
+		workloadName:   workloadName,
+		namespace:      namespace,
+		nodeName:       nodeName,
+	}
+}
+
+// endpointBuilders reuses the EndpointBuilder of a pod while the endpoints of a service are built.
+type endpointBuilders struct {
+	controller *Controller
+	builders   map[types.UID]*EndpointBuilder
+	// scrape is the Prometheus scrape settings of the service, see withPrometheusScrape.
+	scrape *prometheusScrape
+}
+
+func newEndpointBuilders(c *Controller, scrape *prometheusScrape) *endpointBuilders {
+	return &endpointBuilders{controller: c, builders: make(map[types.UID]*EndpointBuilder), scrape: scrape}
+}
+
+// forPod returns the EndpointBuilder of the pod, which may be nil for addresses without pod.
+func (b *endpointBuilders) forPod(pod *v1.Pod) *EndpointBuilder {
+	var key types.UID
+	if pod != nil {
+		key = pod.UID
+		if key == "" {
+			key = types.UID(pod.Namespace + "/" + pod.Name)
+		}
+	}
+	builder, f := b.builders[key]
+	if !f {
+		builder = NewEndpointBuilder(b.controller, pod).withPrometheusScrape(pod, b.scrape)
+		b.builders[key] = builder
 	}
+	return builder
 }
 
 func (b *EndpointBuilder) buildIstioEndpoint(
@@ -74,5 +182,17 @@ func (b *EndpointBuilder) buildIstioEndpoint(
 		EndpointPort:    uint32(endpointPort),
 		ServicePortName: svcPortName,
 		Network:         b.controller.endpointNetwork(endpointAddress),
+		WorkloadName:    b.workloadName,
+		Namespace:       b.namespace,
+		NodeName:        b.nodeName,
+	}
+}
+
+// endpointHostName returns the DNS name of an endpoint within the service, given the hostname
+// Kubernetes reports for the endpoint, which it only does for the pods of headless services.
+func endpointHostName(hostname string, svc *model.Service) string {
+	if hostname == "" {
+		return ""
 	}
+	return hostname + "." + string(svc.Hostname)
 }
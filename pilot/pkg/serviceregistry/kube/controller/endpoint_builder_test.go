@@ -0,0 +1,228 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	discoveryv1alpha1 "k8s.io/api/discovery/v1alpha1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/protocol"
+)
+
+// buildEndpointsPerAddress builds the endpoints like buildEndpoints, but with an EndpointBuilder
+// per address.
+func buildEndpointsPerAddress(c *Controller, ep *coreV1.Endpoints, svc *model.Service) []*model.IstioEndpoint {
+	endpoints := make([]*model.IstioEndpoint, 0)
+	for _, ss := range ep.Subsets {
+		for _, ea := range ss.Addresses {
+			builder := NewEndpointBuilder(c, c.pods.getPodByIP(ea.IP))
+			for _, port := range ss.Ports {
+				istioEndpoint := builder.buildIstioEndpoint(ea.IP, port.Port, port.Name)
+				istioEndpoint.HostName = endpointHostName(ea.Hostname, svc)
+				istioEndpoint.ClusterLocal = svc.Attributes.ClusterLocal
+				endpoints = append(endpoints, istioEndpoint)
+			}
+		}
+	}
+	return endpoints
+}
+
+func TestBuildEndpointsReusesBuilders(t *testing.T) {
+	controller, _ := newFakeControllerWithOptions(fakeControllerOptions{})
+	defer controller.Stop()
+
+	pods := []*coreV1.Pod{
+		generatePod("128.0.0.1", "pod1", "nsA", "sa1", "node1", map[string]string{"app": "prod-app"}, map[string]string{}),
+		generatePod("128.0.0.2", "pod2", "nsA", "sa2", "node1", map[string]string{"app": "prod-app", "version": "v2"}, map[string]string{}),
+	}
+	addPods(t, controller, pods...)
+	for _, pod := range pods {
+		if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+			t.Fatalf("wait for pod err: %v", err)
+		}
+	}
+
+	svc := &model.Service{
+		Hostname: kube.ServiceHostname("svc1", "nsA", domainSuffix),
+		Ports: model.PortList{
+			{Name: "http", Port: 80, Protocol: protocol.HTTP},
+			{Name: "grpc", Port: 90, Protocol: protocol.GRPC},
+			{Name: "metrics", Port: 15090, Protocol: protocol.HTTP},
+		},
+	}
+	ep := &coreV1.Endpoints{
+		ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA"},
+		Subsets: []coreV1.EndpointSubset{
+			{
+				Addresses: []coreV1.EndpointAddress{{IP: "128.0.0.1", Hostname: "pod1"}, {IP: "128.0.0.2"}},
+				Ports:     []coreV1.EndpointPort{{Name: "http", Port: 8080}, {Name: "grpc", Port: 9090}},
+			},
+			{
+				// pod1 is listed again for the ports only it serves, next to an address without pod.
+				Addresses: []coreV1.EndpointAddress{{IP: "128.0.0.1"}, {IP: "128.0.0.3"}},
+				Ports:     []coreV1.EndpointPort{{Name: "metrics", Port: 15090}},
+			},
+		},
+	}
+
+	got, notReady := controller.buildEndpoints(ep, svc, false)
+	if notReady != 0 {
+		t.Fatalf("got %d not ready addresses, want none", notReady)
+	}
+	want := buildEndpointsPerAddress(controller, ep, svc)
+	if len(got) != 6 {
+		t.Fatalf("got %d endpoints, want 6", len(got))
+	}
+	for i := range want {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Fatalf("endpoint %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	builders := newEndpointBuilders(controller, nil)
+	if builders.forPod(pods[0]) != builders.forPod(pods[0]) {
+		t.Fatal("expected the builder of the pod to be reused")
+	}
+	if builders.forPod(pods[0]) == builders.forPod(pods[1]) {
+		t.Fatal("expected pods to have their own builder")
+	}
+}
+
+func TestEndpointNodeName(t *testing.T) {
+	nodes := make(map[EndpointMode]string)
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeHarness(t, Options{EndpointMode: mode})
+			defer controller.Stop()
+
+			addPodsSync(t, controller, generatePod("128.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "prod-app"}, nil))
+			do(t, controller, func() {
+				createService(controller.Controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+			})
+			portName := "tcp-port"
+			var portNum int32 = 1001
+			do(t, controller, func() {
+				ep := &coreV1.Endpoints{
+					ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA"},
+					Subsets: []coreV1.EndpointSubset{{
+						Addresses: []coreV1.EndpointAddress{{IP: "128.0.0.1"}},
+						Ports:     []coreV1.EndpointPort{{Name: portName, Port: portNum}},
+					}},
+				}
+				if _, err := controller.Client.CoreV1().Endpoints("nsA").Create(context.TODO(), ep, metaV1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+				slice := &discoveryv1alpha1.EndpointSlice{
+					ObjectMeta: metaV1.ObjectMeta{
+						Name:      "svc1",
+						Namespace: "nsA",
+						Labels:    map[string]string{discoveryv1alpha1.LabelServiceName: "svc1"},
+					},
+					Endpoints: []discoveryv1alpha1.Endpoint{{
+						Addresses: []string{"128.0.0.1"},
+						Topology:  map[string]string{coreV1.LabelHostname: "node1"},
+					}},
+					Ports: []discoveryv1alpha1.EndpointPort{{Name: &portName, Port: &portNum}},
+				}
+				if _, err := controller.Client.DiscoveryV1alpha1().EndpointSlices("nsA").Create(context.TODO(), slice, metaV1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			})
+			ev := fx.Wait("eds")
+			if ev == nil || len(ev.Endpoints) != 1 {
+				t.Fatalf("expected an endpoint, got %v", ev)
+			}
+			nodes[mode] = ev.Endpoints[0].NodeName
+		})
+	}
+	for mode, name := range EndpointModeNames {
+		if nodes[mode] != "node1" {
+			t.Errorf("%s: got node %q, want node1", name, nodes[mode])
+		}
+	}
+
+	// Slices report the node of endpoints without pod.
+	controller, _ := newFakeControllerWithOptions(fakeControllerOptions{mode: EndpointSliceOnly})
+	defer controller.Stop()
+	builder := controller.endpoints.(*endpointSliceController).newEndpointBuilder(nil, discoveryv1alpha1.Endpoint{Topology: map[string]string{coreV1.LabelHostname: "node2"}})
+	if got := builder.buildIstioEndpoint("128.0.0.9", 8080, "http").NodeName; got != "node2" {
+		t.Fatalf("got node %q, want node2", got)
+	}
+}
+
+// BenchmarkBuildEndpoints builds the endpoints of a service of 1000 pods and 4 ports, with the
+// ports in a single subset and with a subset per port, as when the ports are ready separately.
+func BenchmarkBuildEndpoints(b *testing.B) {
+	objects := make([]runtime.Object, 0, 1000)
+	addresses := make([]coreV1.EndpointAddress, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		objects = append(objects, generatePod(ip, fmt.Sprintf("pod%d", i), "nsA", "sa", "",
+			map[string]string{"app": "prod-app"}, map[string]string{}))
+		addresses = append(addresses, coreV1.EndpointAddress{IP: ip})
+	}
+	controller, _ := newFakeControllerWithOptions(fakeControllerOptions{objects: objects})
+	defer controller.Stop()
+	for _, address := range addresses {
+		if err := waitForPod(controller, address.IP); err != nil {
+			b.Fatalf("wait for pod err: %v", err)
+		}
+	}
+
+	ports := []coreV1.EndpointPort{{Name: "http", Port: 8080}, {Name: "grpc", Port: 9090},
+		{Name: "tcp", Port: 3306}, {Name: "metrics", Port: 15090}}
+	perPort := make([]coreV1.EndpointSubset, 0, len(ports))
+	for _, port := range ports {
+		perPort = append(perPort, coreV1.EndpointSubset{Addresses: addresses, Ports: []coreV1.EndpointPort{port}})
+	}
+	svc := &model.Service{Hostname: kube.ServiceHostname("svc1", "nsA", domainSuffix)}
+	for _, port := range ports {
+		svc.Ports = append(svc.Ports, &model.Port{Name: port.Name, Port: int(port.Port), Protocol: protocol.TCP})
+	}
+	for _, layout := range []struct {
+		name    string
+		subsets []coreV1.EndpointSubset
+	}{
+		{"single-subset", []coreV1.EndpointSubset{{Addresses: addresses, Ports: ports}}},
+		{"subset-per-port", perPort},
+	} {
+		ep := &coreV1.Endpoints{
+			ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA"},
+			Subsets:    layout.subsets,
+		}
+		b.Run(layout.name+"/per-address", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buildEndpointsPerAddress(controller, ep, svc)
+			}
+		})
+		b.Run(layout.name+"/per-pod", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				controller.buildEndpoints(ep, svc, false)
+			}
+		})
+	}
+}
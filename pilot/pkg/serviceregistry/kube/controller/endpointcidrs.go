@@ -0,0 +1,280 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/yl2chen/cidranger"
+	v1 "k8s.io/api/core/v1"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+)
+
+var rejectedEndpointAddresses = monitoring.NewSum(
+	"pilot_k8s_rejected_endpoint_addresses",
+	"Endpoint addresses dropped because they are outside the allowed endpoint CIDRs or in a denied one.",
+	monitoring.WithLabels(clusterTag),
+)
+
+func init() {
+	monitoring.MustRegister(rejectedEndpointAddresses)
+}
+
+// endpointCIDREntry is a rule of the endpoint CIDRs.
+type endpointCIDREntry struct {
+	network net.IPNet
+	allow   bool
+}
+
+func (e endpointCIDREntry) Network() net.IPNet {
+	return e.network
+}
+
+// endpointCIDRs restricts the addresses of the endpoints to Options.AllowedEndpointCIDRs and
+// Options.DeniedEndpointCIDRs. A nil endpointCIDRs allows every address.
+type endpointCIDRs struct {
+	ranger cidranger.Ranger
+	// restricted is set when a CIDR is allowed, the addresses in no CIDR are then denied.
+	restricted bool
+}
+
+// newEndpointCIDRs parses the allowed and denied CIDRs, returning nil when both are empty. A CIDR
+// both allowed and denied is denied. Invalid CIDRs are returned as errors, and the endpoint CIDRs
+// then deny every address: dropping an invalid CIDR could silently lift the restriction.
+func newEndpointCIDRs(allowed, denied []string) (*endpointCIDRs, []error) {
+	if len(allowed) == 0 && len(denied) == 0 {
+		return nil, nil
+	}
+	var errs []error
+	rules := make(map[string]endpointCIDREntry)
+	parse := func(cidrs []string, allow bool) {
+		for _, cidr := range cidrs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid endpoint CIDR %q: %v", cidr, err))
+				continue
+			}
+			if prev, f := rules[network.String()]; f && !prev.allow {
+				continue
+			}
+			rules[network.String()] = endpointCIDREntry{network: *network, allow: allow}
+		}
+	}
+	parse(allowed, true)
+	parse(denied, false)
+	if len(errs) > 0 {
+		return &endpointCIDRs{ranger: cidranger.NewPCTrieRanger(), restricted: true}, errs
+	}
+	out := &endpointCIDRs{ranger: cidranger.NewPCTrieRanger()}
+	for _, rule := range rules {
+		if rule.allow {
+			out.restricted = true
+		}
+		_ = out.ranger.Insert(rule)
+	}
+	return out, errs
+}
+
+// allows reports whether the address may be an endpoint. The most specific CIDR containing the
+// address decides, so that a range can be denied within an allowed one and the other way around.
+// Addresses in no CIDR, and addresses that are not IPs, are only allowed when no CIDR is allowed.
+func (e *endpointCIDRs) allows(address string) bool {
+	if e == nil {
+		return true
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return !e.restricted
+	}
+	entries, err := e.ranger.ContainingNetworks(ip)
+	if err != nil || len(entries) == 0 {
+		return !e.restricted
+	}
+	longest, allow := -1, false
+	for _, entry := range entries {
+		rule := entry.(endpointCIDREntry)
+		if ones, _ := rule.network.Mask.Size(); ones > longest {
+			longest, allow = ones, rule.allow
+		}
+	}
+	return allow
+}
+
+// RejectedEndpoint is an endpoint address dropped by Options.AllowedEndpointCIDRs or
+// Options.DeniedEndpointCIDRs.
+type RejectedEndpoint struct {
+	Hostname host.Name `json:"hostname"`
+	// Source names the object listing the address: an Endpoints, an EndpointSlice, or the service
+	// entry of a workload of another registry.
+	Source  string `json:"source"`
+	Address string `json:"address"`
+}
+
+// rejectedEndpoints keeps the addresses rejected by the endpoint CIDRs of each service, by source.
+type rejectedEndpoints struct {
+	mu     sync.Mutex
+	byHost map[host.Name]map[string][]string
+}
+
+func newRejectedEndpoints() *rejectedEndpoints {
+	return &rejectedEndpoints{byHost: make(map[host.Name]map[string][]string)}
+}
+
+// set replaces the addresses rejected from the source of the endpoints of the hostname. The
+// addresses that were not rejected before are logged and counted.
+func (r *rejectedEndpoints) set(clusterID string, hostname host.Name, source string, addresses []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.setLocked(clusterID, hostname, source, addresses)
+}
+
+// update adds or removes an address rejected from the source, for the instances of other
+// registries, which are handled one at a time.
+func (r *rejectedEndpoints) update(clusterID string, hostname host.Name, source, address string, rejected bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var addresses []string
+	for _, prev := range r.byHost[hostname][source] {
+		if prev != address {
+			addresses = append(addresses, prev)
+		}
+	}
+	if rejected {
+		addresses = append(addresses, address)
+	}
+	r.setLocked(clusterID, hostname, source, addresses)
+}
+
+func (r *rejectedEndpoints) setLocked(clusterID string, hostname host.Name, source string, addresses []string) {
+	sources := r.byHost[hostname]
+	prev := make(map[string]struct{}, len(sources[source]))
+	for _, address := range sources[source] {
+		prev[address] = struct{}{}
+	}
+	for _, address := range addresses {
+		if _, f := prev[address]; f {
+			continue
+		}
+		log.Warnf("%s of service %s: endpoint address %s is outside the allowed endpoint CIDRs or in a denied one, it is dropped",
+			source, hostname, address)
+		rejectedEndpointAddresses.With(clusterTag.Value(clusterID)).Increment()
+	}
+	if len(addresses) == 0 {
+		delete(sources, source)
+		if len(sources) == 0 {
+			delete(r.byHost, hostname)
+		}
+		return
+	}
+	if sources == nil {
+		sources = make(map[string][]string)
+		r.byHost[hostname] = sources
+	}
+	sources[source] = addresses
+}
+
+// clear drops the rejected addresses of a deleted service.
+func (r *rejectedEndpoints) clear(hostname host.Name) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.byHost, hostname)
+}
+
+// clearAll drops the rejected addresses of all services, when the source of the endpoints is
+// replaced.
+func (r *rejectedEndpoints) clearAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byHost = make(map[host.Name]map[string][]string)
+}
+
+func (r *rejectedEndpoints) list() []RejectedEndpoint {
+	r.mu.Lock()
+	var out []RejectedEndpoint
+	for hostname, sources := range r.byHost {
+		for source, addresses := range sources {
+			for _, address := range addresses {
+				out = append(out, RejectedEndpoint{Hostname: hostname, Source: source, Address: address})
+			}
+		}
+	}
+	r.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Hostname != out[j].Hostname {
+			return out[i].Hostname < out[j].Hostname
+		}
+		if out[i].Source != out[j].Source {
+			return out[i].Source < out[j].Source
+		}
+		return out[i].Address < out[j].Address
+	})
+	return out
+}
+
+// RejectedEndpoints returns the endpoint addresses dropped by Options.AllowedEndpointCIDRs and
+// Options.DeniedEndpointCIDRs, sorted by hostname, source and address.
+func (c *Controller) RejectedEndpoints() []RejectedEndpoint {
+	return c.rejectedEndpoints.list()
+}
+
+// endpointsSource names the Endpoints in the rejected endpoints.
+func endpointsSource(ep *v1.Endpoints) string {
+	return "Endpoints " + ep.Namespace + "/" + ep.Name
+}
+
+// foreignInstanceSource names the service entry of an instance of another registry in the
+// rejected endpoints.
+func foreignInstanceSource(si *model.ServiceInstance) string {
+	return "ServiceEntry " + si.Service.Attributes.Namespace + "/" + si.Service.Attributes.Name
+}
+
+// endpointAddressFilter checks the addresses of the endpoints of a service from a source against
+// the endpoint CIDRs while they are built, collecting the rejected ones.
+type endpointAddressFilter struct {
+	c        *Controller
+	hostname host.Name
+	source   string
+	rejected []string
+}
+
+func (c *Controller) newEndpointAddressFilter(hostname host.Name, source string) *endpointAddressFilter {
+	return &endpointAddressFilter{c: c, hostname: hostname, source: source}
+}
+
+// accept reports whether endpoints are built for the address.
+func (f *endpointAddressFilter) accept(address string) bool {
+	if f.c.endpointCIDRs.allows(address) {
+		return true
+	}
+	for _, rejected := range f.rejected {
+		if rejected == address {
+			return false
+		}
+	}
+	f.rejected = append(f.rejected, address)
+	return false
+}
+
+// record replaces the rejected addresses of the source with those of the build.
+func (f *endpointAddressFilter) record() {
+	f.c.rejectedEndpoints.set(f.c.clusterID, f.hostname, f.source, f.rejected)
+}
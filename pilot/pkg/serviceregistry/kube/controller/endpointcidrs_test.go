@@ -0,0 +1,214 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/labels"
+)
+
+func TestEndpointCIDRsAllows(t *testing.T) {
+	cases := []struct {
+		name    string
+		allowed []string
+		denied  []string
+		allows  map[string]bool
+	}{
+		{
+			name:   "empty",
+			allows: map[string]bool{"10.0.0.1": true, "2001:db8::1": true, "foo.example.com": true},
+		},
+		{
+			name:    "allow",
+			allowed: []string{"10.0.0.0/16", "2001:db8::/32"},
+			allows: map[string]bool{
+				"10.0.1.1": true, "2001:db8::1": true, "10.1.0.1": false, "2001:db9::1": false, "foo.example.com": false,
+			},
+		},
+		{
+			name:   "deny",
+			denied: []string{"169.254.0.0/16"},
+			allows: map[string]bool{"169.254.169.254": false, "10.0.0.1": true, "foo.example.com": true},
+		},
+		{
+			name:    "overlapping",
+			allowed: []string{"10.0.0.0/8", "10.1.2.0/24"},
+			denied:  []string{"10.1.0.0/16", "10.2.0.0/16"},
+			allows: map[string]bool{
+				"10.0.0.1": true,
+				// The most specific CIDR decides.
+				"10.1.0.1": false,
+				"10.1.2.3": true,
+				"10.2.2.3": false,
+				"11.0.0.1": false,
+			},
+		},
+		{
+			name:    "allowed and denied",
+			allowed: []string{"10.0.0.0/8", "10.1.0.0/16"},
+			denied:  []string{"10.1.0.0/16"},
+			allows:  map[string]bool{"10.0.0.1": true, "10.1.0.1": false},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cidrs, errs := newEndpointCIDRs(tt.allowed, tt.denied)
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			for address, want := range tt.allows {
+				if got := cidrs.allows(address); got != want {
+					t.Errorf("allows(%s) = %v, want %v", address, got, want)
+				}
+			}
+		})
+	}
+
+	// An invalid CIDR denies every address, rather than leaving out a restriction.
+	for _, cidrs := range [][2][]string{
+		{{"10.0.0.0/8", "10.0.0.1"}, nil},
+		{nil, {"169.254.0.0/16", "10.0.0.0/33"}},
+	} {
+		cidrs, errs := newEndpointCIDRs(cidrs[0], cidrs[1])
+		if len(errs) != 1 {
+			t.Fatalf("expected an error for the invalid CIDR, got %v", errs)
+		}
+		for _, address := range []string{"10.0.0.1", "10.0.0.2", "169.254.169.254", "192.168.0.1", "foo.example.com"} {
+			if cidrs.allows(address) {
+				t.Errorf("allows(%s) = true with an invalid CIDR, want false", address)
+			}
+		}
+	}
+}
+
+func TestEndpointCIDRs(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeHarness(t, Options{
+				ClusterID:            "cluster1",
+				EndpointMode:         mode,
+				AllowedEndpointCIDRs: []string{"128.0.0.0/24"},
+				DeniedEndpointCIDRs:  []string{"128.0.0.128/25"},
+			})
+			defer controller.Stop()
+
+			hostname := kube.ServiceHostname("svc1", "nsA", domainSuffix)
+			selector := map[string]string{"app": "a"}
+			addPodsSync(t, controller,
+				generatePod("128.0.0.1", "pod1", "nsA", "", "", selector, nil),
+				generatePod("128.0.0.200", "pod2", "nsA", "", "", selector, nil),
+				generatePod("10.0.0.5", "pod3", "nsA", "", "", selector, nil))
+			do(t, controller, func() {
+				createService(controller.Controller, "svc1", "nsA", nil, []int32{8080}, selector, t)
+			})
+			rejected := sumValue(t, "pilot_k8s_rejected_endpoint_addresses", map[string]string{"cluster": "cluster1"})
+			fx.Clear()
+			do(t, controller, func() {
+				createEndpoints(controller.Controller, "svc1", "nsA", []string{"tcp-port"},
+					[]string{"128.0.0.1", "128.0.0.200", "10.0.0.5"}, t)
+			})
+			ev := fx.Wait("eds")
+			if ev == nil || len(ev.Endpoints) != 1 || ev.Endpoints[0].Address != "128.0.0.1" {
+				t.Fatalf("expected the allowed endpoint only, got %+v", ev)
+			}
+
+			source := "Endpoints nsA/svc1"
+			if mode == EndpointSliceOnly {
+				source = "EndpointSlice nsA/svc1"
+			}
+			want := []RejectedEndpoint{
+				{Hostname: hostname, Source: source, Address: "10.0.0.5"},
+				{Hostname: hostname, Source: source, Address: "128.0.0.200"},
+			}
+			if got := controller.RejectedEndpoints(); !reflect.DeepEqual(got, want) {
+				t.Fatalf("got rejected endpoints %+v, want %+v", got, want)
+			}
+			if got := sumValue(t, "pilot_k8s_rejected_endpoint_addresses", map[string]string{"cluster": "cluster1"}) - rejected; got != 2 {
+				t.Fatalf("got %v rejected addresses, want 2", got)
+			}
+
+			// The instances of the service are filtered too.
+			svc, _ := controller.GetService(hostname)
+			if svc == nil {
+				t.Fatal("expected the service")
+			}
+			instances, err := controller.InstancesByPort(svc, 8080, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(instances) != 1 || instances[0].Endpoint.Address != "128.0.0.1" {
+				t.Fatalf("expected the allowed instance only, got %v", instances)
+			}
+
+			// Workload entries outside the CIDRs are dropped, and forgotten once deleted.
+			entry := &model.ServiceInstance{
+				Service: &model.Service{
+					Hostname:   "se.example.com",
+					Attributes: model.ServiceAttributes{Name: "se", Namespace: "nsA"},
+				},
+				Endpoint: &model.IstioEndpoint{
+					Labels:       labels.Instance{"app": "a"},
+					Address:      "192.168.0.1",
+					EndpointPort: 8080,
+				},
+			}
+			controller.ForeignServiceInstanceHandler(entry, model.EventAdd)
+			if controller.hasForeignInstances() {
+				t.Fatal("expected the workload entry to be dropped")
+			}
+			entryWant := append([]RejectedEndpoint{{Hostname: "se.example.com", Source: "ServiceEntry nsA/se", Address: "192.168.0.1"}}, want...)
+			if got := controller.RejectedEndpoints(); !reflect.DeepEqual(got, entryWant) {
+				t.Fatalf("got rejected endpoints %+v, want %+v", got, entryWant)
+			}
+			controller.ForeignServiceInstanceHandler(entry, model.EventDelete)
+			if got := controller.RejectedEndpoints(); !reflect.DeepEqual(got, want) {
+				t.Fatalf("got rejected endpoints %+v after the delete, want %+v", got, want)
+			}
+
+			// The proxies at rejected addresses get no instances, the others do.
+			for ip, want := range map[string]int{"128.0.0.1": 1, "128.0.0.200": 0, "10.0.0.5": 0} {
+				instances, err := controller.GetProxyServiceInstances(&model.Proxy{
+					Metadata:    &model.NodeMetadata{Namespace: "nsA"},
+					IPAddresses: []string{ip},
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(instances) != want {
+					t.Fatalf("proxy %s: got %d instances, want %d", ip, len(instances), want)
+				}
+			}
+			// Nor through the Endpoints of a service without selector.
+			do(t, controller, func() {
+				createService(controller.Controller, "svc2", "nsA", nil, []int32{8080}, nil, t)
+			})
+			do(t, controller, func() {
+				createEndpoints(controller.Controller, "svc2", "nsA", []string{"tcp-port"}, []string{"128.0.0.201"}, t)
+			})
+			instances = controller.endpointsController().GetProxyServiceInstances(controller.Controller, &model.Proxy{
+				Metadata:    &model.NodeMetadata{Namespace: "nsA"},
+				IPAddresses: []string{"128.0.0.201"},
+			})
+			if len(instances) != 0 {
+				t.Fatalf("expected no instances for the denied proxy, got %v", instances)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+// EndpointLimitExceededReason is the reason of the warning events of services whose endpoints are
+// truncated to Options.MaxEndpointsPerService.
+const EndpointLimitExceededReason = "EndpointLimitExceeded"
+
+var (
+	truncatedServiceEndpoints = monitoring.NewGauge(
+		"pilot_k8s_truncated_service_endpoints",
+		"Endpoint addresses of the services whose endpoints are truncated to Options.MaxEndpointsPerService, "+
+			"before truncation. Zero once a service is back under the limit.",
+		monitoring.WithLabels(clusterTag, hostnameTag),
+	)
+	endpointTruncations = monitoring.NewSum(
+		"pilot_k8s_endpoint_truncations",
+		"Services starting to have their endpoints truncated to Options.MaxEndpointsPerService.",
+	)
+)
+
+func init() {
+	monitoring.MustRegister(truncatedServiceEndpoints, endpointTruncations)
+}
+
+// endpointLimiter truncates the endpoints of services to a maximum number of addresses. The
+// addresses kept are the first ones in sorted order, so that rebuilding the same endpoints keeps
+// the same ones and proxies do not see churn.
+type endpointLimiter struct {
+	clusterID string
+	max       int
+
+	mu sync.Mutex
+	// truncated stores the number of addresses of the services currently truncated.
+	truncated map[host.Name]int
+}
+
+func newEndpointLimiter(clusterID string, maxAddresses int) *endpointLimiter {
+	return &endpointLimiter{clusterID: clusterID, max: maxAddresses, truncated: make(map[host.Name]int)}
+}
+
+// limit returns the endpoints of the addresses kept for the service, all of them when under the
+// limit, along with the number of distinct addresses and whether the service just started being
+// truncated.
+func (l *endpointLimiter) limit(hostname host.Name, endpoints []*model.IstioEndpoint) (
+	kept []*model.IstioEndpoint, addresses int, started bool) {
+	if l.max <= 0 {
+		return endpoints, 0, false
+	}
+	byAddress := make(map[string][]*model.IstioEndpoint)
+	for _, ep := range endpoints {
+		byAddress[ep.Address] = append(byAddress[ep.Address], ep)
+	}
+	addresses = len(byAddress)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	prev, wasTruncated := l.truncated[hostname]
+	if addresses <= l.max {
+		if wasTruncated {
+			delete(l.truncated, hostname)
+			truncatedServiceEndpoints.With(clusterTag.Value(l.clusterID), hostnameTag.Value(string(hostname))).Record(0)
+			log.Infof("Endpoints of %s no longer truncated, %d addresses", hostname, addresses)
+		}
+		return endpoints, addresses, false
+	}
+
+	sorted := make([]string, 0, addresses)
+	for address := range byAddress {
+		sorted = append(sorted, address)
+	}
+	sort.Strings(sorted)
+	// The endpoints of an address are kept in their order, so that all its ports are kept.
+	kept = make([]*model.IstioEndpoint, 0, l.max)
+	for _, address := range sorted[:l.max] {
+		kept = append(kept, byAddress[address]...)
+	}
+
+	l.truncated[hostname] = addresses
+	if prev != addresses {
+		truncatedServiceEndpoints.With(clusterTag.Value(l.clusterID), hostnameTag.Value(string(hostname))).
+			Record(float64(addresses))
+	}
+	return kept, addresses, !wasTruncated
+}
+
+// clear drops the state of a deleted service.
+func (l *endpointLimiter) clear(hostname host.Name) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, f := l.truncated[hostname]; f {
+		delete(l.truncated, hostname)
+		truncatedServiceEndpoints.With(clusterTag.Value(l.clusterID), hostnameTag.Value(string(hostname))).Record(0)
+	}
+}
+
+// limitEndpoints truncates the endpoints of the service to Options.MaxEndpointsPerService. It is
+// applied by pushEDS to every push, those built for workload entries included, so that the pushed
+// set does not change with the source of the update. Services starting to be truncated are logged
+// and, with Options.EndpointLimitEvents, get a warning event.
+func (c *Controller) limitEndpoints(hostname host.Name, endpoints []*model.IstioEndpoint) []*model.IstioEndpoint {
+	kept, addresses, started := c.endpointLimiter.limit(hostname, endpoints)
+	if !started {
+		return kept
+	}
+	endpointTruncations.Increment()
+	message := fmt.Sprintf("the service has %d endpoint addresses, more than the limit of %d, only the first %d in sorted order are pushed",
+		addresses, c.endpointLimiter.max, c.endpointLimiter.max)
+	log.Warnf("Endpoints of %s truncated: %s", hostname, message)
+	if c.options.EndpointLimitEvents {
+		c.RLock()
+		svc := c.servicesMap[hostname]
+		c.RUnlock()
+		if svc != nil {
+			if k8sSvc, err := c.serviceLister.Services(svc.Attributes.Namespace).Get(svc.Attributes.Name); err == nil {
+				c.recordServiceWarning(k8sSvc, EndpointLimitExceededReason, message)
+			}
+		}
+	}
+	return kept
+}
@@ -0,0 +1,174 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/labels"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+// endpointsOf returns the endpoints of the ports of each address.
+func endpointsOf(addresses []string, ports ...string) []*model.IstioEndpoint {
+	var out []*model.IstioEndpoint
+	for _, address := range addresses {
+		for _, port := range ports {
+			out = append(out, &model.IstioEndpoint{Address: address, ServicePortName: port})
+		}
+	}
+	return out
+}
+
+func endpointAddresses(endpoints []*model.IstioEndpoint) []string {
+	var out []string
+	for _, ep := range endpoints {
+		if len(out) == 0 || out[len(out)-1] != ep.Address {
+			out = append(out, ep.Address)
+		}
+	}
+	return out
+}
+
+func TestEndpointLimiter(t *testing.T) {
+	l := newEndpointLimiter("cluster1", 2)
+
+	// At the limit, the endpoints are pushed as they are.
+	endpoints := endpointsOf([]string{"10.0.0.2", "10.0.0.1"}, "http", "grpc")
+	kept, addresses, started := l.limit("svc1", endpoints)
+	if !reflect.DeepEqual(kept, endpoints) || addresses != 2 || started {
+		t.Fatalf("got %v (%d addresses, started %v), want the endpoints untouched", endpointAddresses(kept), addresses, started)
+	}
+
+	// Above it, the first addresses in sorted order are kept with all their ports.
+	kept, addresses, started = l.limit("svc1", endpointsOf([]string{"10.0.0.3", "10.0.0.10", "10.0.0.2"}, "http", "grpc"))
+	want := []string{"10.0.0.10", "10.0.0.2"}
+	if got := endpointAddresses(kept); !reflect.DeepEqual(got, want) || len(kept) != 4 || addresses != 3 || !started {
+		t.Fatalf("got %v (%d endpoints, %d addresses, started %v), want the endpoints of %v", got, len(kept), addresses, started, want)
+	}
+
+	// The same addresses in another order keep the same endpoints, and the truncation is only
+	// reported once.
+	kept, _, started = l.limit("svc1", endpointsOf([]string{"10.0.0.2", "10.0.0.3", "10.0.0.10"}, "http", "grpc"))
+	if got := endpointAddresses(kept); !reflect.DeepEqual(got, want) || started {
+		t.Fatalf("got %v (started %v), want the endpoints of %v", got, started, want)
+	}
+
+	// Back under the limit.
+	endpoints = endpointsOf([]string{"10.0.0.3"}, "http")
+	if kept, _, _ = l.limit("svc1", endpoints); !reflect.DeepEqual(kept, endpoints) {
+		t.Fatalf("got %v, want the endpoints untouched", endpointAddresses(kept))
+	}
+	if _, f := l.truncated["svc1"]; f {
+		t.Fatal("expected the service to no longer be truncated")
+	}
+
+	// No limit.
+	endpoints = endpointsOf([]string{"10.0.0.3", "10.0.0.2", "10.0.0.1"}, "http")
+	if kept, _, _ = newEndpointLimiter("cluster1", 0).limit("svc1", endpoints); !reflect.DeepEqual(kept, endpoints) {
+		t.Fatalf("got %v, want the endpoints untouched without limit", endpointAddresses(kept))
+	}
+}
+
+func TestMaxEndpointsPerService(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{
+				mode:                mode,
+				maxEndpoints:        2,
+				endpointLimitEvents: true,
+			})
+			defer controller.Stop()
+
+			ips := []string{"128.0.0.3", "128.0.0.1", "128.0.0.2"}
+			for i, ip := range ips {
+				pod := generatePod(ip, fmt.Sprintf("pod%d", i), "nsA", "", "", map[string]string{"app": "prod-app"}, nil)
+				addPods(t, controller, pod)
+				if err := waitForPod(controller, ip); err != nil {
+					t.Fatal(err)
+				}
+			}
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			hostname := string(kube.ServiceHostname("svc1", "nsA", domainSuffix))
+			expectAddresses := func(want ...string) {
+				t.Helper()
+				var got []string
+				for {
+					ev := fx.Wait("eds")
+					if ev == nil {
+						t.Fatalf("Timeout waiting for endpoints %v, last got %v", want, got)
+					}
+					if ev.ID != hostname {
+						continue
+					}
+					if got = endpointAddresses(ev.Endpoints); reflect.DeepEqual(got, want) {
+						return
+					}
+				}
+			}
+
+			// At the boundary.
+			createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, ips[:2], t)
+			expectAddresses(ips[:2]...)
+
+			// Above it.
+			updateEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, ips, t)
+			expectAddresses("128.0.0.1", "128.0.0.2")
+			retry.UntilSuccessOrFail(t, func() error {
+				events, err := controller.client.CoreV1().Events("nsA").List(context.TODO(), metaV1.ListOptions{})
+				if err != nil {
+					return err
+				}
+				for _, event := range events.Items {
+					if event.Reason == EndpointLimitExceededReason && event.InvolvedObject.Name == "svc1" {
+						return nil
+					}
+				}
+				return fmt.Errorf("no %s event on svc1", EndpointLimitExceededReason)
+			}, retry.Timeout(5*time.Second))
+
+			// The endpoints pushed for a workload entry are truncated as well.
+			fx.Clear()
+			controller.ForeignServiceInstanceHandler(&model.ServiceInstance{
+				Service: &model.Service{
+					Attributes: model.ServiceAttributes{Namespace: "nsA"},
+				},
+				Endpoint: &model.IstioEndpoint{Labels: labels.Instance{"app": "prod-app"},
+					Address:      "1.1.1.1",
+					EndpointPort: 8080,
+				},
+			}, model.EventAdd)
+			ev := fx.Wait("eds")
+			if ev == nil {
+				t.Fatal("Did not get eds event when workload entry was added")
+			}
+			if got, want := endpointAddresses(ev.Endpoints), []string{"1.1.1.1", "128.0.0.1"}; ev.ID != hostname || !reflect.DeepEqual(got, want) {
+				t.Fatalf("got endpoints %v of %s, want %v", got, ev.ID, want)
+			}
+		})
+	}
+}
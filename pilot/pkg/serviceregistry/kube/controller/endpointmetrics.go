@@ -0,0 +1,214 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sync"
+
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+const (
+	// endpointSourceKubernetes labels the endpoints of pods.
+	endpointSourceKubernetes = "kubernetes"
+	// endpointSourceForeign labels the endpoints of foreign instances, such as workload entries.
+	endpointSourceForeign = "foreign"
+)
+
+var (
+	clusterTag  = monitoring.MustCreateLabel("cluster")
+	hostnameTag = monitoring.MustCreateLabel("hostname")
+	readyTag    = monitoring.MustCreateLabel("ready")
+	sourceTag   = monitoring.MustCreateLabel("source")
+
+	namespaceEndpoints = monitoring.NewGauge(
+		"pilot_k8s_namespace_endpoints",
+		"Endpoint addresses of the services of a namespace, by readiness and source.",
+		monitoring.WithLabels(clusterTag, namespaceTag, readyTag, sourceTag),
+	)
+
+	serviceEndpoints = monitoring.NewGauge(
+		"pilot_k8s_service_endpoints",
+		"Endpoint addresses of a service, by readiness and source. Only recorded with Options.ServiceEndpointMetrics.",
+		monitoring.WithLabels(clusterTag, hostnameTag, readyTag, sourceTag),
+	)
+
+	crossNamespaceEndpoints = monitoring.NewGauge(
+		"pilot_k8s_cross_namespace_endpoints",
+		"Endpoint addresses of the services of a namespace backed by pods of other namespaces.",
+		monitoring.WithLabels(clusterTag, namespaceTag),
+	)
+)
+
+func init() {
+	monitoring.MustRegister(namespaceEndpoints, serviceEndpoints, crossNamespaceEndpoints)
+}
+
+// endpointCounts counts the distinct endpoint addresses of a service.
+type endpointCounts struct {
+	namespace string
+	ready     int
+	notReady  int
+	foreign   int
+	// crossNamespace counts the ready addresses whose pod is in another namespace than the service.
+	crossNamespace int
+}
+
+// endpointMetrics maintains the endpoint gauges from the endpoints of each service.
+type endpointMetrics struct {
+	clusterID  string
+	perService bool
+
+	mu       sync.Mutex
+	services map[host.Name]endpointCounts
+	// notReady is the number of not ready addresses of each service, as last reported by the
+	// endpoints controller. They are left out of the EDS updates, so they cannot be counted there.
+	notReady   map[host.Name]int
+	namespaces map[string]endpointCounts
+}
+
+func newEndpointMetrics(clusterID string, perService bool) *endpointMetrics {
+	return &endpointMetrics{
+		clusterID:  clusterID,
+		perService: perService,
+		services:   make(map[host.Name]endpointCounts),
+		notReady:   make(map[host.Name]int),
+		namespaces: make(map[string]endpointCounts),
+	}
+}
+
+// setNotReady records the not ready addresses of the service, counted by the next record.
+func (m *endpointMetrics) setNotReady(hostname host.Name, notReady int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if notReady == 0 {
+		delete(m.notReady, hostname)
+	} else {
+		m.notReady[hostname] = notReady
+	}
+}
+
+// addNotReady changes the not ready addresses of the service by delta and updates its gauges. It
+// serves the Endpoints updates that only change the not ready addresses, which are not pushed.
+func (m *endpointMetrics) addNotReady(hostname host.Name, delta int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	notReady := m.notReady[hostname] + delta
+	if notReady <= 0 {
+		delete(m.notReady, hostname)
+		notReady = 0
+	} else {
+		m.notReady[hostname] = notReady
+	}
+	prev, f := m.services[hostname]
+	if !f {
+		return
+	}
+	counts := prev
+	counts.notReady = notReady
+	m.services[hostname] = counts
+	m.addNamespaceLocked(prev, -1)
+	m.addNamespaceLocked(counts, 1)
+	if m.perService {
+		recordEndpointCounts(serviceEndpoints.With(clusterTag.Value(m.clusterID), hostnameTag.Value(string(hostname))), counts)
+	}
+}
+
+// record updates the gauges with the counts of the service.
+func (m *endpointMetrics) record(hostname host.Name, counts endpointCounts) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counts.notReady = m.notReady[hostname]
+	prev := m.services[hostname]
+	m.services[hostname] = counts
+	m.addNamespaceLocked(prev, -1)
+	m.addNamespaceLocked(counts, 1)
+	if m.perService {
+		recordEndpointCounts(serviceEndpoints.With(clusterTag.Value(m.clusterID), hostnameTag.Value(string(hostname))), counts)
+	}
+}
+
+// clear drops the counts of a deleted service.
+func (m *endpointMetrics) clear(hostname host.Name) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev, f := m.services[hostname]
+	delete(m.notReady, hostname)
+	if !f {
+		return
+	}
+	delete(m.services, hostname)
+	m.addNamespaceLocked(prev, -1)
+	if m.perService {
+		recordEndpointCounts(serviceEndpoints.With(clusterTag.Value(m.clusterID), hostnameTag.Value(string(hostname))),
+			endpointCounts{})
+	}
+}
+
+func (m *endpointMetrics) addNamespaceLocked(counts endpointCounts, sign int) {
+	if counts.namespace == "" {
+		return
+	}
+	total := m.namespaces[counts.namespace]
+	total.namespace = counts.namespace
+	total.ready += sign * counts.ready
+	total.notReady += sign * counts.notReady
+	total.foreign += sign * counts.foreign
+	total.crossNamespace += sign * counts.crossNamespace
+	if total == (endpointCounts{namespace: counts.namespace}) {
+		delete(m.namespaces, counts.namespace)
+	} else {
+		m.namespaces[counts.namespace] = total
+	}
+	recordEndpointCounts(namespaceEndpoints.With(clusterTag.Value(m.clusterID), namespaceTag.Value(counts.namespace)), total)
+	crossNamespaceEndpoints.With(clusterTag.Value(m.clusterID), namespaceTag.Value(counts.namespace)).
+		Record(float64(total.crossNamespace))
+}
+
+func recordEndpointCounts(metric monitoring.Metric, counts endpointCounts) {
+	metric.With(readyTag.Value("true"), sourceTag.Value(endpointSourceKubernetes)).
+		Record(float64(counts.ready))
+	metric.With(readyTag.Value("false"), sourceTag.Value(endpointSourceKubernetes)).
+		Record(float64(counts.notReady))
+	metric.With(readyTag.Value("true"), sourceTag.Value(endpointSourceForeign)).
+		Record(float64(counts.foreign))
+}
+
+// countEndpoints counts the distinct addresses of the endpoints of a service, telling apart those
+// of foreign instances and counting those of pods of other namespaces.
+func (c *Controller) countEndpoints(namespace string, endpoints []*model.IstioEndpoint) endpointCounts {
+	counts := endpointCounts{namespace: namespace}
+	seen := make(map[string]struct{}, len(endpoints))
+	c.RLock()
+	defer c.RUnlock()
+	for _, ep := range endpoints {
+		if _, f := seen[ep.Address]; f {
+			continue
+		}
+		seen[ep.Address] = struct{}{}
+		if _, foreign := c.foreignRegistryInstancesByIP[ep.Address]; foreign {
+			counts.foreign++
+		} else {
+			counts.ready++
+			if ep.Namespace != "" && ep.Namespace != namespace {
+				counts.crossNamespace++
+			}
+		}
+	}
+	return counts
+}
@@ -0,0 +1,221 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats/view"
+	coreV1 "k8s.io/api/core/v1"
+	discoveryv1alpha1 "k8s.io/api/discovery/v1alpha1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+// gaugeValue returns the value of the gauge with the given labels.
+func gaugeValue(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+	rows, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatalf("failed to get gauge %s: %v", name, err)
+	}
+	for _, row := range rows {
+		matched := 0
+		for _, tag := range row.Tags {
+			if v, f := labels[tag.Key.Name()]; f && v == tag.Value {
+				matched++
+			}
+		}
+		if matched == len(labels) {
+			return row.Data.(*view.LastValueData).Value
+		}
+	}
+	t.Fatalf("no value of gauge %s with labels %v", name, labels)
+	return 0
+}
+
+// setMetricsEndpoints writes the Endpoints and EndpointSlice of svc1 in nsA.
+func setMetricsEndpoints(t *testing.T, controller *Controller, create bool, ready, notReady []string) {
+	t.Helper()
+	portName := "tcp-port"
+	var port int32 = 1001
+	subset := coreV1.EndpointSubset{Ports: []coreV1.EndpointPort{{Name: portName, Port: port}}}
+	var sliceEndpoints []discoveryv1alpha1.Endpoint
+	for _, ip := range ready {
+		subset.Addresses = append(subset.Addresses, coreV1.EndpointAddress{IP: ip})
+		sliceEndpoints = append(sliceEndpoints, discoveryv1alpha1.Endpoint{Addresses: []string{ip}})
+	}
+	isReady := false
+	for _, ip := range notReady {
+		subset.NotReadyAddresses = append(subset.NotReadyAddresses, coreV1.EndpointAddress{IP: ip})
+		sliceEndpoints = append(sliceEndpoints, discoveryv1alpha1.Endpoint{
+			Addresses:  []string{ip},
+			Conditions: discoveryv1alpha1.EndpointConditions{Ready: &isReady},
+		})
+	}
+	meta := metaV1.ObjectMeta{
+		Name:      "svc1",
+		Namespace: "nsA",
+		Labels:    map[string]string{discoveryv1alpha1.LabelServiceName: "svc1"},
+	}
+	endpoints := &coreV1.Endpoints{ObjectMeta: meta, Subsets: []coreV1.EndpointSubset{subset}}
+	slice := &discoveryv1alpha1.EndpointSlice{
+		ObjectMeta: meta,
+		Endpoints:  sliceEndpoints,
+		Ports:      []discoveryv1alpha1.EndpointPort{{Name: &portName, Port: &port}},
+	}
+	var err error
+	if create {
+		_, err = controller.client.CoreV1().Endpoints("nsA").Create(context.TODO(), endpoints, metaV1.CreateOptions{})
+		if err == nil {
+			_, err = controller.client.DiscoveryV1alpha1().EndpointSlices("nsA").Create(context.TODO(), slice, metaV1.CreateOptions{})
+		}
+	} else {
+		_, err = controller.client.CoreV1().Endpoints("nsA").Update(context.TODO(), endpoints, metaV1.UpdateOptions{})
+		if err == nil {
+			_, err = controller.client.DiscoveryV1alpha1().EndpointSlices("nsA").Update(context.TODO(), slice, metaV1.UpdateOptions{})
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEndpointMetrics(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			clusterID := "endpoint-metrics-" + name
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{
+				mode:            mode,
+				clusterID:       clusterID,
+				endpointMetrics: true,
+			})
+			defer controller.Stop()
+			hostname := string(kube.ServiceHostname("svc1", "nsA", domainSuffix))
+
+			expect := func(ready, notReady float64) {
+				t.Helper()
+				for _, labels := range []map[string]string{
+					{"cluster": clusterID, "hostname": hostname},
+					{"cluster": clusterID, "namespace": "nsA"},
+				} {
+					name := "pilot_k8s_service_endpoints"
+					if labels["namespace"] != "" {
+						name = "pilot_k8s_namespace_endpoints"
+					}
+					for _, c := range []struct {
+						ready, source string
+						want          float64
+					}{
+						{"true", endpointSourceKubernetes, ready},
+						{"false", endpointSourceKubernetes, notReady},
+						{"true", endpointSourceForeign, 0},
+					} {
+						labels["ready"], labels["source"] = c.ready, c.source
+						if got := gaugeValue(t, name, labels); got != c.want {
+							t.Fatalf("%s %v: got %v, want %v", name, labels, got, c.want)
+						}
+					}
+				}
+			}
+			waitForEDS := func() {
+				t.Helper()
+				for {
+					ev := fx.Wait("eds")
+					if ev == nil {
+						t.Fatal("Timeout waiting for the endpoints")
+					}
+					if ev.ID == hostname {
+						return
+					}
+				}
+			}
+
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			setMetricsEndpoints(t, controller, true, []string{"10.0.0.1"}, []string{"10.0.0.2"})
+			waitForEDS()
+			expect(1, 1)
+
+			// Scale up, with all the endpoints becoming ready.
+			setMetricsEndpoints(t, controller, false, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, nil)
+			waitForEDS()
+			expect(3, 0)
+
+			// Scale down.
+			setMetricsEndpoints(t, controller, false, []string{"10.0.0.3"}, []string{"10.0.0.4"})
+			waitForEDS()
+			expect(1, 1)
+
+			// A pod becomes not ready: with Endpoints, the gauges follow without an EDS update.
+			fx.Clear()
+			setMetricsEndpoints(t, controller, false, []string{"10.0.0.3"}, []string{"10.0.0.4", "10.0.0.5"})
+			if mode == EndpointsOnly {
+				notReady := map[string]string{"cluster": clusterID, "hostname": hostname, "ready": "false", "source": endpointSourceKubernetes}
+				retry.UntilSuccessOrFail(t, func() error {
+					if got := gaugeValue(t, "pilot_k8s_service_endpoints", notReady); got != 2 {
+						return fmt.Errorf("got %v not ready endpoints, want 2", got)
+					}
+					return nil
+				}, retry.Timeout(5*time.Second))
+				for _, ev := range pendingEvents(fx) {
+					if ev.Type == "eds" && ev.ID == hostname {
+						t.Fatalf("expected no EDS update for the not ready addresses, got %+v", ev)
+					}
+				}
+			} else {
+				waitForEDS()
+			}
+			expect(1, 2)
+
+			if err := controller.client.CoreV1().Services("nsA").Delete(context.TODO(), "svc1", metaV1.DeleteOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout deleting service")
+			}
+			expect(0, 0)
+		})
+	}
+}
+
+func TestCountEndpoints(t *testing.T) {
+	controller, _ := newFakeControllerWithOptions(fakeControllerOptions{})
+	defer controller.Stop()
+
+	controller.Lock()
+	controller.foreignRegistryInstancesByIP["2.2.2.2"] = &model.ServiceInstance{}
+	controller.Unlock()
+
+	// Addresses are counted once for all their ports.
+	got := controller.countEndpoints("nsA", []*model.IstioEndpoint{
+		{Address: "1.1.1.1", EndpointPort: 80},
+		{Address: "1.1.1.1", EndpointPort: 90},
+		{Address: "1.1.1.2", EndpointPort: 80},
+		{Address: "2.2.2.2", EndpointPort: 80},
+	})
+	if want := (endpointCounts{namespace: "nsA", ready: 2, foreign: 1}); got != want {
+		t.Fatalf("got counts %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"sync"
+
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+var endpointModeSwitches = monitoring.NewSum(
+	"pilot_k8s_endpoint_mode_switches",
+	"Switches of the source of the endpoints of the registry by SetEndpointMode.",
+	monitoring.WithLabels(clusterTag),
+)
+
+func init() {
+	monitoring.MustRegister(endpointModeSwitches)
+}
+
+// newKubeEndpointsController creates the endpoints controller of the mode. An unknown mode falls
+// back to EndpointsOnly, as a nil endpoints controller would panic on the first event.
+func newKubeEndpointsController(c *Controller, mode EndpointMode, options Options) kubeEndpointsController {
+	switch mode {
+	case EndpointsOnly:
+		return newEndpointsController(c, options)
+	case EndpointSliceOnly:
+		return newEndpointSliceController(c, options)
+	default:
+		log.Warnf("Unknown endpoint mode %d, defaulting to %s", mode, EndpointsOnly)
+		return newEndpointsController(c, options)
+	}
+}
+
+// endpointsDispatcher passes the events of an injected endpoints informer to the handlers of the
+// last source of the endpoints built on it.
+type endpointsDispatcher struct {
+	mu      sync.RWMutex
+	handler func(interface{}, model.Event) error
+	equal   func(old, cur interface{}) bool
+}
+
+func (d *endpointsDispatcher) set(handler func(interface{}, model.Event) error, equal func(old, cur interface{}) bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.handler = handler
+	d.equal = equal
+}
+
+func (d *endpointsDispatcher) onEvent(obj interface{}, event model.Event) error {
+	d.mu.RLock()
+	handler := d.handler
+	d.mu.RUnlock()
+	return handler(obj, event)
+}
+
+func (d *endpointsDispatcher) updateEqual(old, cur interface{}) bool {
+	d.mu.RLock()
+	equal := d.equal
+	d.mu.RUnlock()
+	return equal(old, cur)
+}
+
+// registerEndpointsHandlers registers the handlers of a source of the endpoints on its informer.
+// The handlers added to injected informers cannot be removed, so a single dispatcher is added to
+// each of them, and the sources built again by SetEndpointMode replace its handlers rather than
+// adding more: the events are not queued once per source built on the informer.
+func (c *Controller) registerEndpointsHandlers(informer cache.SharedIndexInformer, otype string,
+	handler func(interface{}, model.Event) error, equal func(old, cur interface{}) bool) {
+	if c.injected == nil {
+		// The informers of the controller are created with each source.
+		c.registerHandlers(informer, otype, handler, equal)
+		return
+	}
+	if d, f := c.endpointsDispatchers[informer]; f {
+		d.set(handler, equal)
+		return
+	}
+	d := &endpointsDispatcher{handler: handler, equal: equal}
+	if c.endpointsDispatchers == nil {
+		c.endpointsDispatchers = make(map[cache.SharedIndexInformer]*endpointsDispatcher)
+	}
+	c.endpointsDispatchers[informer] = d
+	c.registerHandlers(informer, otype, d.onEvent, d.updateEqual)
+}
+
+// endpointsController returns the current source of the endpoints. SetEndpointMode may replace it
+// at any time, so callers get it again for each use rather than keeping it.
+func (c *Controller) endpointsController() kubeEndpointsController {
+	c.endpointsMutex.RLock()
+	defer c.endpointsMutex.RUnlock()
+	return c.endpoints
+}
+
+// isCurrentEndpoints reports whether e is the current source of the endpoints. The events of the
+// source being synced by SetEndpointMode, and of the source it replaced, are dropped.
+func (c *Controller) isCurrentEndpoints(e kubeEndpointsController) bool {
+	return c.endpointsController() == e
+}
+
+// EndpointMode returns the source of the endpoints of the controller.
+func (c *Controller) EndpointMode() EndpointMode {
+	return c.endpointsController().mode()
+}
+
+// SetEndpointMode switches the source of the endpoints of a running controller, such as to migrate
+// to EndpointSlices without a restart. The informer of the new source is synced first, while the
+// current one keeps serving. The sources are then swapped on the queue, behind the events already
+// queued, the informer of the previous source is stopped, and the endpoints of all services are
+// built again from the new source and submitted in one batch, so that no endpoint is lost or
+// pushed twice during the switch. It returns once the new source synced; EndpointMode reports
+// the new mode once the swap is handled.
+func (c *Controller) SetEndpointMode(mode EndpointMode) error {
+	if _, f := EndpointModeNames[mode]; !f {
+		return fmt.Errorf("unknown endpoint mode %d", mode)
+	}
+	// Switches are made one at a time.
+	c.endpointModeSwitchMutex.Lock()
+	defer c.endpointModeSwitchMutex.Unlock()
+	c.endpointsMutex.RLock()
+	current, stop := c.endpoints.mode(), c.runStop
+	c.endpointsMutex.RUnlock()
+	if current == mode {
+		return nil
+	}
+	if c.injected != nil && c.injected.endpointsInformer(mode) == nil {
+		return fmt.Errorf("no injected informer for the %s endpoints", mode)
+	}
+
+	next := newKubeEndpointsController(c, mode, c.options)
+	if stop == nil {
+		// Run starts the current source.
+		c.swapEndpoints(next).stop()
+		return nil
+	}
+	go next.Run(stop)
+	if !cache.WaitForCacheSync(stop, next.HasSynced) {
+		next.stop()
+		return fmt.Errorf("controller stopped before the %s endpoints synced", mode)
+	}
+	c.queue.Push(func() error {
+		c.swapEndpoints(next).stop()
+		c.endpointPortDiagnostics.clearAll()
+		c.rejectedEndpoints.clearAll()
+		log.Infof("Endpoints of cluster %s switched from %s to %s, building the endpoints of all services again",
+			c.clusterID, current, mode)
+		c.edsBatcher.open()
+		defer c.edsBatcher.close()
+		return c.rebuildAllEDS()
+	})
+	return nil
+}
+
+// swapEndpoints makes next the current source of the endpoints, returning the previous one.
+func (c *Controller) swapEndpoints(next kubeEndpointsController) kubeEndpointsController {
+	c.endpointsMutex.Lock()
+	defer c.endpointsMutex.Unlock()
+	prev := c.endpoints
+	c.endpoints = next
+	endpointModeSwitches.With(clusterTag.Value(c.clusterID)).Increment()
+	return prev
+}
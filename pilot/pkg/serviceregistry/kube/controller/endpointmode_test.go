@@ -0,0 +1,147 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+)
+
+// endpointsStopped returns the channel closed when the source is stopped.
+func endpointsStopped(e kubeEndpointsController) <-chan struct{} {
+	switch e := e.(type) {
+	case *endpointsController:
+		return e.stopped
+	case *endpointSliceController:
+		return e.stopped
+	}
+	return nil
+}
+
+func TestSetEndpointMode(t *testing.T) {
+	controller, fx := newFakeHarness(t, Options{ClusterID: "cluster1", EndpointMode: EndpointsOnly})
+	defer controller.Stop()
+
+	hostname := kube.ServiceHostname("svc1", "nsA", domainSuffix)
+	selector := map[string]string{"app": "a"}
+	addPodsSync(t, controller,
+		generatePod("128.0.0.1", "pod1", "nsA", "", "", selector, nil),
+		generatePod("128.0.0.2", "pod2", "nsA", "", "", selector, nil))
+	do(t, controller, func() {
+		createService(controller.Controller, "svc1", "nsA", nil, []int32{8080}, selector, t)
+	})
+	// The Endpoints and the EndpointSlice of the service are both created.
+	do(t, controller, func() {
+		createEndpoints(controller.Controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1", "128.0.0.2"}, t)
+	})
+	svc, _ := controller.GetService(hostname)
+	if svc == nil {
+		t.Fatal("expected the service")
+	}
+	fx.Clear()
+
+	// The instances are looked up while the mode switches, they must never be missing.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var lookups, missing int32
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				instances, err := controller.InstancesByPort(svc, 8080, nil)
+				atomic.AddInt32(&lookups, 1)
+				if err != nil || len(instances) != 2 {
+					atomic.AddInt32(&missing, 1)
+				}
+			}
+		}()
+	}
+
+	switches := sumValue(t, "pilot_k8s_endpoint_mode_switches", map[string]string{"cluster": "cluster1"})
+	for _, mode := range []EndpointMode{EndpointSliceOnly, EndpointsOnly} {
+		prev := controller.endpointsController()
+		if err := controller.SetEndpointMode(mode); err != nil {
+			t.Fatal(err)
+		}
+		controller.Flush()
+		if controller.EndpointMode() != mode || controller.Options().EndpointMode != mode {
+			t.Fatalf("expected the %s mode, got %s", mode, controller.EndpointMode())
+		}
+		select {
+		case <-endpointsStopped(prev):
+		default:
+			t.Fatalf("expected the informer of the previous source to be stopped")
+		}
+
+		// The endpoints are built again from the new source, with all their addresses.
+		ev := fx.Wait("eds")
+		if ev == nil || ev.ID != string(hostname) || !ev.Batched {
+			t.Fatalf("expected a batched EDS update of %s, got %+v", hostname, ev)
+		}
+		for ev != nil {
+			if len(ev.Endpoints) != 2 {
+				t.Fatalf("expected the 2 endpoints of the service in every update, got %d", len(ev.Endpoints))
+			}
+			select {
+			case e := <-fx.Events:
+				if e.Type != "eds" {
+					continue
+				}
+				ev = &e
+			default:
+				ev = nil
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if lookups == 0 || missing != 0 {
+		t.Fatalf("expected the instances in all %d lookups, %d missed", lookups, missing)
+	}
+	if got := sumValue(t, "pilot_k8s_endpoint_mode_switches", map[string]string{"cluster": "cluster1"}) - switches; got != 2 {
+		t.Fatalf("got %v switches, want 2", got)
+	}
+
+	// Switching to the current mode does nothing.
+	prev := controller.endpointsController()
+	if err := controller.SetEndpointMode(EndpointsOnly); err != nil {
+		t.Fatal(err)
+	}
+	if controller.endpointsController() != prev {
+		t.Fatal("expected the source to be kept")
+	}
+	if err := controller.SetEndpointMode(EndpointMode(42)); err == nil {
+		t.Fatal("expected an error for an unknown mode")
+	}
+}
+
+func TestSetEndpointModeBeforeRun(t *testing.T) {
+	c, _, _ := newUnstartedController(t)
+	if err := c.SetEndpointMode(EndpointSliceOnly); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.endpointsController().(*endpointSliceController); !ok || c.EndpointMode() != EndpointSliceOnly {
+		t.Fatalf("expected the source to be swapped at once, got %T", c.endpointsController())
+	}
+}
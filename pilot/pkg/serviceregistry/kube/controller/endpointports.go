@@ -0,0 +1,193 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sort"
+	"sync"
+
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+// UnknownServicePort is the reason for the ports of endpoints that the service does not declare,
+// such as after a port of the service is renamed while its Endpoints are managed by hand.
+const UnknownServicePort = "UnknownServicePort"
+
+var unmatchedEndpointPorts = monitoring.NewSum(
+	"pilot_k8s_unmatched_endpoint_ports",
+	"Ports of the endpoints of services left out because the service does not declare them.",
+)
+
+func init() {
+	monitoring.MustRegister(unmatchedEndpointPorts)
+}
+
+// EndpointPortDiagnostic describes a port of the endpoints of a service that was left out, or, with
+// the ReservedProxyPort reason, that collides with a port of the sidecar.
+type EndpointPortDiagnostic struct {
+	Hostname host.Name `json:"hostname"`
+	// Source is the name of the Endpoints or EndpointSlice listing the port.
+	Source   string `json:"source"`
+	Reason   string `json:"reason"`
+	PortName string `json:"portName"`
+	Port     int32  `json:"port"`
+}
+
+// endpointPortDiagnostics keeps the ports left out of the endpoints of each service, by source.
+type endpointPortDiagnostics struct {
+	mu     sync.Mutex
+	byHost map[host.Name]map[string][]EndpointPortDiagnostic
+}
+
+func newEndpointPortDiagnostics() *endpointPortDiagnostics {
+	return &endpointPortDiagnostics{byHost: make(map[host.Name]map[string][]EndpointPortDiagnostic)}
+}
+
+// set replaces the diagnostics of the source of the endpoints of the hostname. The ports that were
+// not reported before are logged and counted.
+func (d *endpointPortDiagnostics) set(hostname host.Name, source string, diags []EndpointPortDiagnostic) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sources := d.byHost[hostname]
+	prev := make(map[EndpointPortDiagnostic]struct{}, len(sources[source]))
+	for _, diag := range sources[source] {
+		prev[diag] = struct{}{}
+	}
+	for _, diag := range diags {
+		if _, f := prev[diag]; f {
+			continue
+		}
+		if diag.Reason == ReservedProxyPort {
+			log.Warnf("Endpoints %s of service %s: port %q (%d) collides with a port reserved by the sidecar of the pods",
+				source, hostname, diag.PortName, diag.Port)
+			reservedProxyPortEndpoints.Increment()
+			continue
+		}
+		log.Warnf("Endpoints %s of service %s: port %q (%d) is not a port of the service, its endpoints are left out",
+			source, hostname, diag.PortName, diag.Port)
+		unmatchedEndpointPorts.Increment()
+	}
+	if len(diags) == 0 {
+		delete(sources, source)
+		if len(sources) == 0 {
+			delete(d.byHost, hostname)
+		}
+		return
+	}
+	if sources == nil {
+		sources = make(map[string][]EndpointPortDiagnostic)
+		d.byHost[hostname] = sources
+	}
+	sources[source] = diags
+}
+
+// clearAll drops the diagnostics of all services, when the source of the endpoints is replaced.
+func (d *endpointPortDiagnostics) clearAll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.byHost = make(map[host.Name]map[string][]EndpointPortDiagnostic)
+}
+
+// clear drops the diagnostics of a deleted service.
+func (d *endpointPortDiagnostics) clear(hostname host.Name) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.byHost, hostname)
+}
+
+func (d *endpointPortDiagnostics) list() []EndpointPortDiagnostic {
+	d.mu.Lock()
+	out := make([]EndpointPortDiagnostic, 0, len(d.byHost))
+	for _, sources := range d.byHost {
+		for _, diags := range sources {
+			out = append(out, diags...)
+		}
+	}
+	d.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Hostname != out[j].Hostname {
+			return out[i].Hostname < out[j].Hostname
+		}
+		if out[i].Source != out[j].Source {
+			return out[i].Source < out[j].Source
+		}
+		if out[i].PortName != out[j].PortName {
+			return out[i].PortName < out[j].PortName
+		}
+		return out[i].Reason < out[j].Reason
+	})
+	return out
+}
+
+// EndpointPortDiagnostics returns the ports of the endpoints of services that were left out or
+// collide with a port of the sidecar, sorted by hostname, source, port name and reason.
+func (c *Controller) EndpointPortDiagnostics() []EndpointPortDiagnostic {
+	return c.endpointPortDiagnostics.list()
+}
+
+// endpointPortChecker checks the ports of the endpoints of a service against the ports of the
+// service, and the ports reserved by the sidecar, while its endpoints are built, collecting the
+// ports left out or colliding.
+type endpointPortChecker struct {
+	svc             *model.Service
+	source          string
+	permissive      bool
+	reserved        map[int32]struct{}
+	excludeReserved bool
+	diags           []EndpointPortDiagnostic
+}
+
+func (c *Controller) newEndpointPortChecker(svc *model.Service, source string) *endpointPortChecker {
+	return &endpointPortChecker{
+		svc:             svc,
+		source:          source,
+		permissive:      c.endpointOptions.permissiveEndpointPorts,
+		reserved:        c.endpointOptions.reservedProxyPorts,
+		excludeReserved: c.endpointOptions.excludeReservedProxyPorts,
+	}
+}
+
+// accept reports whether endpoints are built for the port. The service must declare a port of the
+// name, unless Options.PermissiveEndpointPorts is set. Each port is only recorded once.
+func (pc *endpointPortChecker) accept(name string, port int32) bool {
+	if pc.permissive {
+		return true
+	}
+	if _, f := pc.svc.Ports.Get(name); f {
+		return true
+	}
+	for _, diag := range pc.diags {
+		if diag.Reason == UnknownServicePort && diag.PortName == name {
+			return false
+		}
+	}
+	pc.diags = append(pc.diags, EndpointPortDiagnostic{
+		Hostname: pc.svc.Hostname,
+		Source:   pc.source,
+		Reason:   UnknownServicePort,
+		PortName: name,
+		Port:     port,
+	})
+	return false
+}
+
+// recordEndpointPorts replaces the diagnostics of the source with the ports reported by the build.
+func (c *Controller) recordEndpointPorts(pc *endpointPortChecker) {
+	c.endpointPortDiagnostics.set(pc.svc.Hostname, pc.source, pc.diags)
+}
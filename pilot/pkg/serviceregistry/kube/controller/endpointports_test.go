@@ -0,0 +1,189 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+// waitForEndpointPorts waits for an EDS update of the hostname with endpoints for the port names.
+// Without port names, it waits for the endpoints to be cleared, which the fake reports no event for.
+func waitForEndpointPorts(t *testing.T, fx *FakeXdsUpdater, hostname string, want ...string) {
+	t.Helper()
+	if len(want) == 0 {
+		retry.UntilSuccessOrFail(t, func() error {
+			if endpoints, f := fx.LastEDS(hostname); !f || len(endpoints) != 0 {
+				return fmt.Errorf("got endpoints %v, want none", endpoints)
+			}
+			return nil
+		}, retry.Timeout(5*time.Second))
+		return
+	}
+	sort.Strings(want)
+	var got []string
+	for {
+		ev := fx.Wait("eds")
+		if ev == nil {
+			t.Fatalf("Timeout waiting for endpoints of ports %v, last got %v", want, got)
+		}
+		if ev.ID != hostname {
+			continue
+		}
+		seen := map[string]struct{}{}
+		got = nil
+		for _, ep := range ev.Endpoints {
+			if _, f := seen[ep.ServicePortName]; !f {
+				seen[ep.ServicePortName] = struct{}{}
+				got = append(got, ep.ServicePortName)
+			}
+		}
+		sort.Strings(got)
+		if reflect.DeepEqual(got, want) {
+			return
+		}
+	}
+}
+
+// expectEndpointPortDiagnostics waits for the controller to report the port names as unknown.
+func expectEndpointPortDiagnostics(t *testing.T, controller *Controller, want ...string) {
+	t.Helper()
+	retry.UntilSuccessOrFail(t, func() error {
+		var got []string
+		for _, diag := range controller.EndpointPortDiagnostics() {
+			if diag.Reason != UnknownServicePort || diag.Source != "svc1" {
+				return fmt.Errorf("unexpected diagnostic %+v", diag)
+			}
+			got = append(got, diag.PortName)
+		}
+		if !reflect.DeepEqual(got, want) {
+			return fmt.Errorf("got unknown ports %v, want %v", got, want)
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+}
+
+func TestEndpointPortValidation(t *testing.T) {
+	hostname := string(kube.ServiceHostname("svc1", "nsA", domainSuffix))
+	newController := func(t *testing.T, opts fakeControllerOptions) (*Controller, *FakeXdsUpdater) {
+		controller, fx := newFakeControllerWithOptions(opts)
+		pod := generatePod("128.0.0.1", "pod1", "nsA", "", "", map[string]string{"app": "prod-app"}, nil)
+		addPods(t, controller, pod)
+		if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+			t.Fatal(err)
+		}
+		return controller, fx
+	}
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			t.Run("renamed port", func(t *testing.T) {
+				controller, fx := newController(t, fakeControllerOptions{mode: mode})
+				defer controller.Stop()
+
+				createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+				if ev := fx.Wait("service"); ev == nil {
+					t.Fatal("Timeout creating service")
+				}
+				createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+				waitForEndpointPorts(t, fx, hostname, "tcp-port")
+				expectEndpointPortDiagnostics(t, controller)
+
+				// The Endpoints are managed by hand and still list the old name of the port.
+				svc, err := controller.client.CoreV1().Services("nsA").Get(context.TODO(), "svc1", metaV1.GetOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				svc = svc.DeepCopy()
+				svc.Spec.Ports[0].Name = "tcp-renamed"
+				if _, err := controller.client.CoreV1().Services("nsA").Update(context.TODO(), svc, metaV1.UpdateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+				expectEndpointPortDiagnostics(t, controller, "tcp-port")
+				waitForEndpointPorts(t, fx, hostname)
+
+				updateEndpoints(controller, "svc1", "nsA", []string{"tcp-renamed"}, []string{"128.0.0.1"}, t)
+				waitForEndpointPorts(t, fx, hostname, "tcp-renamed")
+				expectEndpointPortDiagnostics(t, controller)
+			})
+
+			t.Run("manually managed endpoints", func(t *testing.T) {
+				controller, fx := newController(t, fakeControllerOptions{mode: mode})
+				defer controller.Stop()
+
+				createService(controller, "svc1", "nsA", nil, []int32{8080}, nil, t)
+				if ev := fx.Wait("service"); ev == nil {
+					t.Fatal("Timeout creating service")
+				}
+				createEndpoints(controller, "svc1", "nsA", []string{"tcp-port", "metrics"}, []string{"128.0.0.1"}, t)
+				waitForEndpointPorts(t, fx, hostname, "tcp-port")
+				expectEndpointPortDiagnostics(t, controller, "metrics")
+
+				// The diagnostics go away with the service.
+				if err := controller.client.CoreV1().Services("nsA").Delete(context.TODO(), "svc1", metaV1.DeleteOptions{}); err != nil {
+					t.Fatal(err)
+				}
+				expectEndpointPortDiagnostics(t, controller)
+			})
+
+			t.Run("permissive", func(t *testing.T) {
+				controller, fx := newController(t, fakeControllerOptions{mode: mode, permissivePorts: true})
+				defer controller.Stop()
+
+				createService(controller, "svc1", "nsA", nil, []int32{8080}, nil, t)
+				if ev := fx.Wait("service"); ev == nil {
+					t.Fatal("Timeout creating service")
+				}
+				createEndpoints(controller, "svc1", "nsA", []string{"tcp-port", "metrics"}, []string{"128.0.0.1"}, t)
+				waitForEndpointPorts(t, fx, hostname, "tcp-port", "metrics")
+				if diags := controller.EndpointPortDiagnostics(); len(diags) != 0 {
+					t.Fatalf("got diagnostics %v, want none in permissive mode", diags)
+				}
+			})
+		})
+	}
+}
+
+func TestEndpointPortDiagnostics(t *testing.T) {
+	d := newEndpointPortDiagnostics()
+	diag := func(source, port string) EndpointPortDiagnostic {
+		return EndpointPortDiagnostic{Hostname: "svc1.nsA", Source: source, Reason: UnknownServicePort, PortName: port}
+	}
+	d.set("svc1.nsA", "slice-b", []EndpointPortDiagnostic{diag("slice-b", "http")})
+	d.set("svc1.nsA", "slice-a", []EndpointPortDiagnostic{diag("slice-a", "metrics"), diag("slice-a", "admin")})
+	want := []EndpointPortDiagnostic{diag("slice-a", "admin"), diag("slice-a", "metrics"), diag("slice-b", "http")}
+	if got := d.list(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// A source without unknown ports drops its diagnostics, leaving those of the other sources.
+	d.set("svc1.nsA", "slice-a", nil)
+	if got := d.list(); !reflect.DeepEqual(got, want[2:]) {
+		t.Fatalf("got %v, want %v", got, want[2:])
+	}
+	d.clear("svc1.nsA")
+	if got := d.list(); len(got) != 0 {
+		t.Fatalf("got %v, want no diagnostics", got)
+	}
+}
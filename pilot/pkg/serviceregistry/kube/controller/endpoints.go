@@ -30,17 +30,129 @@ import (
 
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/labels"
 	"istio.io/istio/pkg/listwatch"
 )
 
 type endpointsController struct {
 	kubeEndpoints
+	// external consumes the EndpointSlices of Options.ExternalEndpointSliceManagers, it is nil
+	// without managers.
+	external *externalEndpointSlices
+}
+
+// endpointsTargetNamespaceIndex indexes Endpoints and EndpointSlices by the namespaces of the pods
+// they reference in other namespaces than their own, which are only found through their target
+// reference.
+const endpointsTargetNamespaceIndex = "targetNamespace"
+
+func endpointsTargetNamespaceIndexFunc(obj interface{}) ([]string, error) {
+	ep, ok := obj.(*v1.Endpoints)
+	if !ok {
+		return nil, nil
+	}
+	var namespaces []string
+	seen := make(map[string]struct{})
+	for _, ss := range ep.Subsets {
+		for _, addresses := range [][]v1.EndpointAddress{ss.Addresses, ss.NotReadyAddresses} {
+			for _, ea := range addresses {
+				namespace, cross := crossNamespaceTarget(ep, ea)
+				if _, f := seen[namespace]; cross && !f {
+					seen[namespace] = struct{}{}
+					namespaces = append(namespaces, namespace)
+				}
+			}
+		}
+	}
+	return namespaces, nil
+}
+
+// crossNamespaceTarget returns the namespace of the pod referenced by the address, and whether it
+// is another namespace than that of the endpoints.
+func crossNamespaceTarget(ep *v1.Endpoints, ea v1.EndpointAddress) (string, bool) {
+	if ea.TargetRef == nil || ea.TargetRef.Kind != "Pod" || ea.TargetRef.Namespace == "" {
+		return "", false
+	}
+	return ea.TargetRef.Namespace, ea.TargetRef.Namespace != ep.Namespace
+}
+
+// crossNamespaceEndpointsAllowed reports whether the endpoints of the namespace may give the
+// proxies of pods of other namespaces the instances of their services, see
+// Options.CrossNamespaceEndpointNamespaces.
+func (c *Controller) crossNamespaceEndpointsAllowed(namespace string) bool {
+	if _, f := c.endpointOptions.crossNamespaceEndpoints["*"]; f {
+		return true
+	}
+	_, f := c.endpointOptions.crossNamespaceEndpoints[namespace]
+	return f
+}
+
+// crossNamespaceProxyEndpoints returns the objects of the informer, Endpoints or EndpointSlices,
+// referencing pods of the namespace of the proxy from the namespaces allowed to.
+func (c *Controller) crossNamespaceProxyEndpoints(informer cache.SharedIndexInformer, proxy *model.Proxy) []metav1.Object {
+	if len(c.endpointOptions.crossNamespaceEndpoints) == 0 {
+		return nil
+	}
+	items, err := informer.GetIndexer().ByIndex(endpointsTargetNamespaceIndex, proxy.Metadata.Namespace)
+	if err != nil {
+		log.Errorf("Get endpoints by target namespace failed: %v", err)
+		return nil
+	}
+	var out []metav1.Object
+	for _, item := range items {
+		if obj, ok := item.(metav1.Object); ok && c.crossNamespaceEndpointsAllowed(obj.GetNamespace()) {
+			out = append(out, obj)
+		}
+	}
+	return out
 }
 
 var _ kubeEndpointsController = &endpointsController{}
 
 func newEndpointsController(c *Controller, options Options) *endpointsController {
+	var informer cache.SharedIndexInformer
+	if c.injected != nil {
+		informer = c.injected.Endpoints
+	} else {
+		informer = newEndpointsInformer(c, options)
+	}
+
+	out := &endpointsController{
+		kubeEndpoints: newKubeEndpoints(c, informer),
+	}
+	out.external = newExternalEndpointSlices(c, options, out)
+	c.registerEndpointsHandlers(informer, "Endpoints", out.onEvent, out.updateEqual)
+	return out
+}
+
+// updateEqual is endpointsUpdateEqual, which only compares the ready addresses. The updates it
+// drops may still change the not ready addresses, which only the gauges count: they are updated
+// here rather than with a push.
+func (e *endpointsController) updateEqual(old, cur interface{}) bool {
+	if !endpointsUpdateEqual(old, cur) {
+		return false
+	}
+	oldE, curE := old.(*v1.Endpoints), cur.(*v1.Endpoints)
+	if delta := countNotReadyAddresses(curE) - countNotReadyAddresses(oldE); delta != 0 {
+		e.c.endpointMetrics.addNotReady(e.c.endpointsHostname(curE.Name, curE.Namespace), delta)
+	}
+	return true
+}
+
+func countNotReadyAddresses(ep *v1.Endpoints) int {
+	n := 0
+	for _, ss := range ep.Subsets {
+		n += len(ss.NotReadyAddresses)
+	}
+	return n
+}
+
+// newEndpointsInformer creates an informer of the Endpoints of the watched namespaces.
+// The initial list is not paged: the reflector gathers every page into a single list before it
+// replaces the store, and the watch cache ignores Limit for ResourceVersion "0", so paging would
+// only move the list to etcd without lowering the memory held during the initial sync.
+func newEndpointsInformer(c *Controller, options Options) cache.SharedIndexInformer {
 	namespaces := strings.Split(options.WatchedNamespaces, ",")
 
 	mlw := listwatch.MultiNamespaceListerWatcher(namespaces, func(namespace string) cache.ListerWatcher {
@@ -54,54 +166,33 @@ func newEndpointsController(c *Controller, options Options) *endpointsController
 		}
 	})
 
-	informer := cache.NewSharedIndexInformer(mlw, &v1.Endpoints{}, options.ResyncPeriod,
-		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	return cache.NewSharedIndexInformer(mlw, &v1.Endpoints{}, c.informerResyncPeriod(resyncEndpoints),
+		cache.Indexers{
+			cache.NamespaceIndex:          cache.MetaNamespaceIndexFunc,
+			endpointsTargetNamespaceIndex: endpointsTargetNamespaceIndexFunc,
+		})
+}
 
-	out := &endpointsController{
-		kubeEndpoints: kubeEndpoints{
-			c:        c,
-			informer: informer,
-		},
+func (e *endpointsController) mode() EndpointMode {
+	return EndpointsOnly
+}
+
+func (e *endpointsController) HasSynced() bool {
+	return e.kubeEndpoints.HasSynced() && (e.external == nil || e.external.HasSynced())
+}
+
+func (e *endpointsController) Run(stopCh <-chan struct{}) {
+	if e.external != nil {
+		go e.external.Run(stopCh)
 	}
-	out.registerEndpointsHandler()
-	return out
+	e.kubeEndpoints.Run(stopCh)
 }
 
-func (e *endpointsController) registerEndpointsHandler() {
-	e.informer.AddEventHandler(
-		cache.ResourceEventHandlerFuncs{
-			// TODO: filtering functions to skip over un-referenced resources (perf)
-			AddFunc: func(obj interface{}) {
-				incrementEvent("Endpoints", "add")
-				e.c.queue.Push(func() error {
-					return e.onEvent(obj, model.EventAdd)
-				})
-			},
-			UpdateFunc: func(old, cur interface{}) {
-				// Avoid pushes if only resource version changed (kube-scheduller, cluster-autoscaller, etc)
-				oldE := old.(*v1.Endpoints)
-				curE := cur.(*v1.Endpoints)
-
-				if !compareEndpoints(oldE, curE) {
-					incrementEvent("Endpoints", "update")
-					e.c.queue.Push(func() error {
-						return e.onEvent(cur, model.EventUpdate)
-					})
-				} else {
-					incrementEvent("Endpoints", "updatesame")
-				}
-			},
-			DeleteFunc: func(obj interface{}) {
-				incrementEvent("Endpoints", "delete")
-				// Deleting the endpoints results in an empty set from EDS perspective - only
-				// deleting the service should delete the resources. The full sync replaces the
-				// maps.
-				// c.updateEDS(obj.(*v1.Endpoints))
-				e.c.queue.Push(func() error {
-					return e.onEvent(obj, model.EventDelete)
-				})
-			},
-		})
+func (e *endpointsController) stop() {
+	if e.external != nil {
+		e.external.stop()
+	}
+	e.kubeEndpoints.stop()
 }
 
 func (e *endpointsController) GetProxyServiceInstances(c *Controller, proxy *model.Proxy) []*model.ServiceInstance {
@@ -110,6 +201,10 @@ func (e *endpointsController) GetProxyServiceInstances(c *Controller, proxy *mod
 		log.Errorf("Get endpoints by index failed: %v", err)
 		return nil
 	}
+	// The pod of the proxy may also back the Endpoints of services of other namespaces.
+	for _, item := range c.crossNamespaceProxyEndpoints(e.informer, proxy) {
+		eps = append(eps, item.(*v1.Endpoints))
+	}
 	out := make([]*model.ServiceInstance, 0)
 	for _, ep := range eps {
 		instances := e.proxyServiceInstances(c, ep, proxy)
@@ -122,14 +217,13 @@ func (e *endpointsController) GetProxyServiceInstances(c *Controller, proxy *mod
 func (e *endpointsController) proxyServiceInstances(c *Controller, endpoints *v1.Endpoints, proxy *model.Proxy) []*model.ServiceInstance {
 	out := make([]*model.ServiceInstance, 0)
 
-	hostname := kube.ServiceHostname(endpoints.Name, endpoints.Namespace, c.domainSuffix)
+	hostname := c.endpointsHostname(endpoints.Name, endpoints.Namespace)
 	c.RLock()
 	svc := c.servicesMap[hostname]
 	c.RUnlock()
 
 	if svc != nil {
-		podIP := proxy.IPAddresses[0]
-		pod := c.pods.getPodByIP(podIP)
+		pod, _ := c.getProxyPod(proxy)
 		builder := NewEndpointBuilder(c, pod)
 
 		for _, ss := range endpoints.Subsets {
@@ -141,6 +235,10 @@ func (e *endpointsController) proxyServiceInstances(c *Controller, endpoints *v1
 
 				// consider multiple IP scenarios
 				for _, ip := range proxy.IPAddresses {
+					// Like the endpoints, the proxy addresses outside the endpoint CIDRs get no instances.
+					if !c.endpointCIDRs.allows(ip) {
+						continue
+					}
 					if hasProxyIP(ss.Addresses, ip) || hasProxyIP(ss.NotReadyAddresses, ip) {
 						istioEndpoint := builder.buildIstioEndpoint(ip, port.Port, svcPort.Name)
 						out = append(out, &model.ServiceInstance{
@@ -165,26 +263,58 @@ func (e *endpointsController) proxyServiceInstances(c *Controller, endpoints *v1
 
 func (e *endpointsController) InstancesByPort(c *Controller, svc *model.Service, reqSvcPort int,
 	labelsList labels.Collection) ([]*model.ServiceInstance, error) {
-	item, exists, err := e.informer.GetStore().GetByKey(kube.KeyFunc(svc.Attributes.Name, svc.Attributes.Namespace))
-	if err != nil {
-		log.Infof("get endpoints(%s, %s) => error %v", svc.Attributes.Name, svc.Attributes.Namespace, err)
+	// Locate all ports in the actual service
+	svcPort, exists := svc.Ports.GetByPort(reqSvcPort)
+	if !exists {
 		return nil, nil
 	}
+	return e.mergedInstancesByServicePort(c, svc, svcPort, labelsList)
+}
+
+func (e *endpointsController) InstancesByPortName(c *Controller, svc *model.Service, portName string,
+	labelsList labels.Collection) ([]*model.ServiceInstance, error) {
+	svcPort, exists := svc.Ports.Get(portName)
 	if !exists {
 		return nil, nil
 	}
+	return e.mergedInstancesByServicePort(c, svc, svcPort, labelsList)
+}
 
-	// Locate all ports in the actual service
-	svcPort, exists := svc.Ports.GetByPort(reqSvcPort)
+// mergedInstancesByServicePort adds the instances of the external EndpointSlices of the service
+// to those of its Endpoints, see externalEndpointSlices.merge.
+func (e *endpointsController) mergedInstancesByServicePort(c *Controller, svc *model.Service, svcPort *model.Port,
+	labelsList labels.Collection) ([]*model.ServiceInstance, error) {
+	out, err := e.instancesByServicePort(c, svc, svcPort, labelsList)
+	if e.external == nil || err != nil {
+		return out, err
+	}
+	external, err := e.external.instancesByServicePort(c, svc, svcPort, labelsList)
+	if err != nil {
+		return out, err
+	}
+	return mergeInstances(out, external), nil
+}
+
+func (e *endpointsController) instancesByServicePort(c *Controller, svc *model.Service, svcPort *model.Port,
+	labelsList labels.Collection) ([]*model.ServiceInstance, error) {
+	item, exists, err := e.informer.GetStore().GetByKey(kube.KeyFunc(svc.Attributes.Name, svc.Attributes.Namespace))
+	if err != nil {
+		log.Infof("get endpoints(%s, %s) => error %v", svc.Attributes.Name, svc.Attributes.Namespace, err)
+		return nil, nil
+	}
 	if !exists {
 		return nil, nil
 	}
+
 	ep := item.(*v1.Endpoints)
 	var out []*model.ServiceInstance
 	for _, ss := range ep.Subsets {
 		for _, ea := range ss.Addresses {
+			if !c.endpointCIDRs.allows(ea.IP) {
+				continue
+			}
 			var podLabels labels.Instance
-			pod := c.pods.getPodByIP(ea.IP)
+			pod, _ := c.getEndpointPod(ea.IP, ea.TargetRef)
 			if pod != nil {
 				podLabels = pod.Labels
 			}
@@ -201,6 +331,7 @@ func (e *endpointsController) InstancesByPort(c *Controller, svc *model.Service,
 				if port.Name == "" || // 'name optional if single port is defined'
 					svcPort.Name == port.Name {
 					istioEndpoint := builder.buildIstioEndpoint(ea.IP, port.Port, svcPort.Name)
+					istioEndpoint.HostName = endpointHostName(ea.Hostname, svc)
 					out = append(out, &model.ServiceInstance{
 						Endpoint:    istioEndpoint,
 						ServicePort: svcPort,
@@ -214,8 +345,64 @@ func (e *endpointsController) InstancesByPort(c *Controller, svc *model.Service,
 	return out, nil
 }
 
+// getEndpointPod returns the pod of the address of an Endpoints or EndpointSlice endpoint, looked
+// up by IP and then by the target reference of the endpoint, as the pod cache is eventually
+// consistent. The pod may be in another namespace than the endpoints: the endpoint is then built
+// with the identity of the pod, its labels, service account, locality and namespace, while the
+// service keeps its own namespace. missing reports whether the endpoint references a pod that
+// could not be found.
+func (c *Controller) getEndpointPod(ip string, ref *v1.ObjectReference) (pod *v1.Pod, missing bool) {
+	if pod = c.pods.getPodByIP(ip); pod != nil {
+		return pod, false
+	}
+	if ref == nil || ref.Kind != "Pod" {
+		return nil, false
+	}
+	pod = c.pods.getPod(ref.Name, ref.Namespace)
+	return pod, pod == nil
+}
+
+func (e *endpointsController) UpdateServiceEDS(c *Controller, svc *model.Service) {
+	if e.external != nil {
+		e.external.rebuild(svc)
+	}
+	e.pushServiceEDS(c, svc, false)
+}
+
+// pushServiceEDS builds the endpoints of the service from its Endpoints, merged with those of its
+// external EndpointSlices, and pushes them. Services with neither are only pushed with force, for
+// their endpoints to be cleared.
+func (e *endpointsController) pushServiceEDS(c *Controller, svc *model.Service, force bool) {
+	item, exists, err := e.informer.GetStore().GetByKey(kube.KeyFunc(svc.Attributes.Name, svc.Attributes.Namespace))
+	if err == nil && exists {
+		c.updateEDS(item.(*v1.Endpoints), model.EventUpdate)
+		return
+	}
+	if e.external != nil && (force || e.external.has(svc.Hostname)) {
+		c.pushExternalEndpoints(svc, e.external)
+	}
+}
+
+func (e *endpointsController) isOrphaned(name, namespace string) bool {
+	_, exists, err := e.informer.GetStore().GetByKey(kube.KeyFunc(name, namespace))
+	return err == nil && !exists && (e.external == nil || e.external.isOrphaned(name, namespace))
+}
+
+func (e *endpointsController) clearIfOrphaned(hostname host.Name, name, namespace string) bool {
+	if !e.isOrphaned(name, namespace) {
+		return false
+	}
+	if e.external != nil {
+		e.external.endpointCache.Delete(hostname)
+	}
+	return true
+}
+
 func (e *endpointsController) onEvent(curr interface{}, event model.Event) error {
-	if err := e.c.checkReadyForEvents(); err != nil {
+	if !e.c.isCurrentEndpoints(e) {
+		return nil
+	}
+	if err := e.c.checkEndpointsReady(); err != nil {
 		return err
 	}
 
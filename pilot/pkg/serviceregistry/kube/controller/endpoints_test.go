@@ -0,0 +1,180 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/spiffe"
+)
+
+func TestCrossNamespaceEndpoints(t *testing.T) {
+	controller, fx := newFakeControllerWithOptions(fakeControllerOptions{
+		mode:                    EndpointsOnly,
+		crossNamespaceEndpoints: []string{"nsA"},
+	})
+	defer controller.Stop()
+
+	pod := generatePod("128.0.0.1", "pod1", "nsB", "account", "", map[string]string{"app": "backend"}, nil)
+	addPods(t, controller, pod)
+	if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+		t.Fatal(err)
+	}
+	// The service has no selector, its Endpoints are managed by hand and reference a pod of nsB.
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, nil, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	endpoints := &coreV1.Endpoints{
+		ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA"},
+		Subsets: []coreV1.EndpointSubset{{
+			Addresses: []coreV1.EndpointAddress{{
+				IP:        "128.0.0.1",
+				TargetRef: &coreV1.ObjectReference{Kind: "Pod", Name: "pod1", Namespace: "nsB"},
+			}},
+			Ports: []coreV1.EndpointPort{{Name: "tcp-port", Port: 1001}},
+		}},
+	}
+	if _, err := controller.client.CoreV1().Endpoints("nsA").Create(context.TODO(), endpoints, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	hostname := kube.ServiceHostname("svc1", "nsA", domainSuffix)
+	ev := fx.Wait("eds")
+	if ev == nil {
+		t.Fatal("Timeout waiting for the endpoints of svc1")
+	}
+	if ev.ID != string(hostname) || len(ev.Endpoints) != 1 {
+		t.Fatalf("got EDS event %+v, want the endpoint of pod1 for %s", ev, hostname)
+	}
+	// The endpoint has the identity of the pod in its own namespace.
+	ep := ev.Endpoints[0]
+	wantSA := spiffe.MustGenSpiffeURI("nsB", "account")
+	if ep.Namespace != "nsB" || ep.ServiceAccount != wantSA || ep.Labels["app"] != "backend" {
+		t.Fatalf("got endpoint %+v, want the namespace, service account and labels of pod1", ep)
+	}
+	counts := controller.countEndpoints("nsA", ev.Endpoints)
+	if counts.ready != 1 || counts.crossNamespace != 1 {
+		t.Fatalf("got counts %+v, want 1 cross namespace endpoint", counts)
+	}
+
+	// The pod is an instance of the service, which keeps its namespace, as nsA may reference the
+	// pods of other namespaces.
+	instances, err := controller.GetProxyServiceInstances(&model.Proxy{
+		IPAddresses: []string{"128.0.0.1"},
+		Metadata:    &model.NodeMetadata{Namespace: "nsB"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 {
+		t.Fatalf("got instances %v, want the instance of svc1", instances)
+	}
+	instance := instances[0]
+	if instance.Service.Hostname != hostname || instance.Service.Attributes.Namespace != "nsA" ||
+		instance.Endpoint.Namespace != "nsB" || instance.Endpoint.ServiceAccount != wantSA {
+		t.Fatalf("got instance of %s in %s with endpoint %+v, want the instance of svc1 in nsA with the identity of pod1",
+			instance.Service.Hostname, instance.Service.Attributes.Namespace, instance.Endpoint)
+	}
+
+	// The instances of the service are built from the pod as well.
+	svc, _ := controller.GetService(hostname)
+	byPort, err := controller.InstancesByPort(svc, 8080, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(byPort) != 1 || byPort[0].Endpoint.Namespace != "nsB" || byPort[0].Endpoint.Labels["app"] != "backend" {
+		t.Fatalf("got instances %v, want the instance of pod1", byPort)
+	}
+}
+
+func TestCrossNamespaceEndpointsNotAllowed(t *testing.T) {
+	for _, allowed := range [][]string{nil, {"nsC"}} {
+		controller, fx := newFakeControllerWithOptions(fakeControllerOptions{
+			mode:                    EndpointsOnly,
+			crossNamespaceEndpoints: allowed,
+		})
+
+		pod := generatePod("128.0.0.1", "pod1", "nsB", "account", "", map[string]string{"app": "backend"}, nil)
+		addPods(t, controller, pod)
+		if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+			t.Fatal(err)
+		}
+		createService(controller, "svc1", "nsA", nil, []int32{8080}, nil, t)
+		if ev := fx.Wait("service"); ev == nil {
+			t.Fatal("Timeout creating service")
+		}
+		endpoints := &coreV1.Endpoints{
+			ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA"},
+			Subsets: []coreV1.EndpointSubset{{
+				Addresses: []coreV1.EndpointAddress{{
+					IP:        "128.0.0.1",
+					TargetRef: &coreV1.ObjectReference{Kind: "Pod", Name: "pod1", Namespace: "nsB"},
+				}},
+				Ports: []coreV1.EndpointPort{{Name: "tcp-port", Port: 1001}},
+			}},
+		}
+		if _, err := controller.client.CoreV1().Endpoints("nsA").Create(context.TODO(), endpoints, metaV1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		// The endpoint is still pushed to the clients of the service.
+		if ev := fx.Wait("eds"); ev == nil || len(ev.Endpoints) != 1 {
+			t.Fatalf("got EDS event %+v, want the endpoint of pod1", ev)
+		}
+
+		// The Endpoints of nsA cannot make the proxy of nsB serve svc1.
+		instances, err := controller.GetProxyServiceInstances(&model.Proxy{
+			IPAddresses: []string{"128.0.0.1"},
+			Metadata:    &model.NodeMetadata{Namespace: "nsB"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(instances) != 0 {
+			t.Fatalf("allowing %v, got instances %v, want none", allowed, instances)
+		}
+		controller.Stop()
+	}
+}
+
+func TestEndpointsTargetNamespaceIndex(t *testing.T) {
+	ep := &coreV1.Endpoints{
+		ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA"},
+		Subsets: []coreV1.EndpointSubset{{
+			Addresses: []coreV1.EndpointAddress{
+				{IP: "1.1.1.1", TargetRef: &coreV1.ObjectReference{Kind: "Pod", Name: "pod1", Namespace: "nsA"}},
+				{IP: "1.1.1.2", TargetRef: &coreV1.ObjectReference{Kind: "Pod", Name: "pod2", Namespace: "nsB"}},
+				{IP: "1.1.1.3"},
+			},
+			NotReadyAddresses: []coreV1.EndpointAddress{
+				{IP: "1.1.1.4", TargetRef: &coreV1.ObjectReference{Kind: "Pod", Name: "pod4", Namespace: "nsB"}},
+				{IP: "1.1.1.5", TargetRef: &coreV1.ObjectReference{Kind: "Pod", Name: "pod5", Namespace: "nsC"}},
+			},
+		}},
+	}
+	got, err := endpointsTargetNamespaceIndexFunc(ep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != "nsB" || got[1] != "nsC" {
+		t.Fatalf("got namespaces %v, want [nsB nsC]", got)
+	}
+}
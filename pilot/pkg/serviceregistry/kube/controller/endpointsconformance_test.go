@@ -0,0 +1,380 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	discoveryv1alpha1 "k8s.io/api/discovery/v1alpha1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+// conformanceEndpoint is an endpoint of a service, created as both an Endpoints address and an
+// EndpointSlice endpoint, so that each source sees the same workloads.
+type conformanceEndpoint struct {
+	ip       string
+	notReady bool
+	// pod is the name of the pod the endpoint references, in podNamespace or the namespace of the
+	// service.
+	pod          string
+	podNamespace string
+}
+
+// conformancePort is the target port of the endpoints.
+const conformancePort = 1001
+
+func createConformanceService(t *testing.T, c *Controller, name, namespace, portName string,
+	selector map[string]string, headless bool) *model.Service {
+	t.Helper()
+	svc := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: coreV1.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+			Ports:     []coreV1.ServicePort{{Name: portName, Port: 8080, Protocol: "TCP"}},
+			Selector:  selector,
+		},
+	}
+	if headless {
+		svc.Spec.ClusterIP = coreV1.ClusterIPNone
+	}
+	if _, err := c.client.CoreV1().Services(namespace).Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	hostname := kube.ServiceHostname(name, namespace, domainSuffix)
+	var out *model.Service
+	retry.UntilSuccessOrFail(t, func() error {
+		out, _ = c.GetService(hostname)
+		if out == nil {
+			return fmt.Errorf("service %s not found", hostname)
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+	return out
+}
+
+func createConformanceEndpoints(t *testing.T, c *Controller, name, namespace, portName string, endpoints []conformanceEndpoint) {
+	t.Helper()
+	subset := coreV1.EndpointSubset{Ports: []coreV1.EndpointPort{{Name: portName, Port: conformancePort}}}
+	port := int32(conformancePort)
+	slicePort := discoveryv1alpha1.EndpointPort{Port: &port}
+	if portName != "" {
+		slicePort.Name = &portName
+	}
+	slice := &discoveryv1alpha1.EndpointSlice{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      name + "-abcde",
+			Namespace: namespace,
+			Labels:    map[string]string{discoveryv1alpha1.LabelServiceName: name},
+		},
+		AddressType: discoveryv1alpha1.AddressTypeIPv4,
+		Ports:       []discoveryv1alpha1.EndpointPort{slicePort},
+	}
+	for _, ep := range endpoints {
+		var ref *coreV1.ObjectReference
+		if ep.pod != "" {
+			podNamespace := ep.podNamespace
+			if podNamespace == "" {
+				podNamespace = namespace
+			}
+			ref = &coreV1.ObjectReference{Kind: "Pod", Name: ep.pod, Namespace: podNamespace}
+		}
+		address := coreV1.EndpointAddress{IP: ep.ip, TargetRef: ref}
+		if ep.notReady {
+			subset.NotReadyAddresses = append(subset.NotReadyAddresses, address)
+		} else {
+			subset.Addresses = append(subset.Addresses, address)
+		}
+		ready := !ep.notReady
+		slice.Endpoints = append(slice.Endpoints, discoveryv1alpha1.Endpoint{
+			Addresses:  []string{ep.ip},
+			Conditions: discoveryv1alpha1.EndpointConditions{Ready: &ready},
+			TargetRef:  ref,
+		})
+	}
+	eps := &coreV1.Endpoints{
+		ObjectMeta: metaV1.ObjectMeta{Name: name, Namespace: namespace},
+		Subsets:    []coreV1.EndpointSubset{subset},
+	}
+	if _, err := c.client.CoreV1().Endpoints(namespace).Create(context.TODO(), eps, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.client.DiscoveryV1alpha1().EndpointSlices(namespace).Create(context.TODO(), slice, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForPushedAddresses waits for the pushed endpoints of the service to have the addresses.
+func waitForPushedAddresses(t *testing.T, c *Controller, hostname host.Name, want ...string) []*model.IstioEndpoint {
+	t.Helper()
+	sort.Strings(want)
+	var endpoints []*model.IstioEndpoint
+	retry.UntilSuccessOrFail(t, func() error {
+		var err error
+		if endpoints, err = c.EndpointsForService(hostname); err != nil {
+			return err
+		}
+		got := make([]string, 0, len(endpoints))
+		for _, ep := range endpoints {
+			got = append(got, ep.Address)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) && (len(got) > 0 || len(want) > 0) {
+			return fmt.Errorf("got addresses %v for %s, want %v", got, hostname, want)
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+	return endpoints
+}
+
+// endpointsConformanceScenarios are run against each kubeEndpointsController implementation: both
+// must build the same endpoints and instances from the same workloads.
+var endpointsConformanceScenarios = []struct {
+	name string
+	run  func(t *testing.T, c *Controller, fx *FakeXdsUpdater)
+}{
+	{
+		name: "ready endpoints are pushed and are instances",
+		run: func(t *testing.T, c *Controller, _ *FakeXdsUpdater) {
+			pod := generatePod("128.0.0.1", "pod1", "nsA", "", "", map[string]string{"app": "a"}, nil)
+			addPods(t, c, pod)
+			if err := waitForPod(c, pod.Status.PodIP); err != nil {
+				t.Fatal(err)
+			}
+			svc := createConformanceService(t, c, "svc1", "nsA", "tcp-port", map[string]string{"app": "a"}, false)
+			createConformanceEndpoints(t, c, "svc1", "nsA", "tcp-port", []conformanceEndpoint{
+				{ip: "128.0.0.1", pod: "pod1"},
+				{ip: "128.0.0.2", notReady: true},
+			})
+
+			endpoints := waitForPushedAddresses(t, c, svc.Hostname, "128.0.0.1")
+			ep := endpoints[0]
+			if ep.EndpointPort != conformancePort || ep.ServicePortName != "tcp-port" || ep.Labels["app"] != "a" {
+				t.Fatalf("got endpoint %+v, want the endpoint of port tcp-port with the labels of pod1", ep)
+			}
+			instances, err := c.endpointsController().InstancesByPort(c, svc, 8080, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(instances) != 1 || instances[0].Endpoint.Address != "128.0.0.1" {
+				t.Fatalf("got instances %v, want the ready endpoint only", instances)
+			}
+		},
+	},
+	{
+		name: "pods are found by reference",
+		run: func(t *testing.T, c *Controller, _ *FakeXdsUpdater) {
+			// The pod has no IP yet, it is only found through the target reference.
+			pod := generatePod("", "pod1", "nsA", "", "", map[string]string{"app": "a"}, nil)
+			if _, err := c.client.CoreV1().Pods("nsA").Create(context.TODO(), pod, metaV1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			svc := createConformanceService(t, c, "svc1", "nsA", "tcp-port", map[string]string{"app": "a"}, false)
+			createConformanceEndpoints(t, c, "svc1", "nsA", "tcp-port", []conformanceEndpoint{{ip: "128.0.0.1", pod: "pod1"}})
+
+			endpoints := waitForPushedAddresses(t, c, svc.Hostname, "128.0.0.1")
+			if endpoints[0].Labels["app"] != "a" {
+				t.Fatalf("got endpoint %+v, want the labels of pod1", endpoints[0])
+			}
+			instances, err := c.endpointsController().InstancesByPort(c, svc, 8080, labels.Collection{{"app": "a"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(instances) != 1 {
+				t.Fatalf("got instances %v, want the instance of pod1", instances)
+			}
+		},
+	},
+	{
+		name: "endpoints of missing pods are rebuilt by UpdateServiceEDS",
+		run: func(t *testing.T, c *Controller, _ *FakeXdsUpdater) {
+			svc := createConformanceService(t, c, "svc1", "nsA", "tcp-port", map[string]string{"app": "a"}, false)
+			createConformanceEndpoints(t, c, "svc1", "nsA", "tcp-port", []conformanceEndpoint{
+				{ip: "128.0.0.1", pod: "pod1"},
+				{ip: "128.0.0.2"},
+			})
+			// The endpoint of the missing pod is left out.
+			waitForPushedAddresses(t, c, svc.Hostname, "128.0.0.2")
+
+			pod := generatePod("128.0.0.1", "pod1", "nsA", "", "", map[string]string{"app": "a"}, nil)
+			addPods(t, c, pod)
+			if err := waitForPod(c, pod.Status.PodIP); err != nil {
+				t.Fatal(err)
+			}
+			c.queue.Push(func() error {
+				c.endpointsController().UpdateServiceEDS(c, svc)
+				return nil
+			})
+			waitForPushedAddresses(t, c, svc.Hostname, "128.0.0.1", "128.0.0.2")
+		},
+	},
+	{
+		name: "proxies are instances of the services of the namespaces allowed to reference them",
+		run: func(t *testing.T, c *Controller, _ *FakeXdsUpdater) {
+			pod := generatePod("128.0.0.1", "pod1", "nsB", "", "", map[string]string{"app": "a"}, nil)
+			addPods(t, c, pod)
+			if err := waitForPod(c, pod.Status.PodIP); err != nil {
+				t.Fatal(err)
+			}
+			svc := createConformanceService(t, c, "svc1", "nsA", "tcp-port", nil, false)
+			createConformanceEndpoints(t, c, "svc1", "nsA", "tcp-port", []conformanceEndpoint{
+				{ip: "128.0.0.1", pod: "pod1", podNamespace: "nsB"},
+			})
+			waitForPushedAddresses(t, c, svc.Hostname, "128.0.0.1")
+			proxy := &model.Proxy{
+				IPAddresses: []string{"128.0.0.1"},
+				Metadata:    &model.NodeMetadata{Namespace: "nsB"},
+			}
+			if instances := c.endpointsController().GetProxyServiceInstances(c, proxy); len(instances) != 0 {
+				t.Fatalf("got instances %v, want none without allowing nsA", instances)
+			}
+
+			// As with Options.CrossNamespaceEndpointNamespaces.
+			c.endpointOptions.crossNamespaceEndpoints["nsA"] = struct{}{}
+			instances := c.endpointsController().GetProxyServiceInstances(c, proxy)
+			if len(instances) != 1 || instances[0].Service.Hostname != svc.Hostname {
+				t.Fatalf("got instances %v, want the instance of %s", instances, svc.Hostname)
+			}
+		},
+	},
+	{
+		name: "proxies are instances of unnamed ports",
+		run: func(t *testing.T, c *Controller, _ *FakeXdsUpdater) {
+			pod := generatePod("128.0.0.1", "pod1", "nsA", "", "", map[string]string{"app": "a"}, nil)
+			addPods(t, c, pod)
+			if err := waitForPod(c, pod.Status.PodIP); err != nil {
+				t.Fatal(err)
+			}
+			svc := createConformanceService(t, c, "svc1", "nsA", "", nil, false)
+			createConformanceEndpoints(t, c, "svc1", "nsA", "", []conformanceEndpoint{{ip: "128.0.0.1", pod: "pod1"}})
+			waitForPushedAddresses(t, c, svc.Hostname, "128.0.0.1")
+
+			instances := c.endpointsController().GetProxyServiceInstances(c, &model.Proxy{
+				IPAddresses: []string{"128.0.0.1"},
+				Metadata:    &model.NodeMetadata{Namespace: "nsA"},
+			})
+			if len(instances) != 1 || instances[0].ServicePort.Port != 8080 {
+				t.Fatalf("got instances %v, want the instance of port 8080", instances)
+			}
+		},
+	},
+	{
+		name: "instance handlers get the ready endpoints",
+		run: func(t *testing.T, c *Controller, _ *FakeXdsUpdater) {
+			var mu sync.Mutex
+			handled := make(map[string]model.Event)
+			_ = c.AppendInstanceHandler(func(si *model.ServiceInstance, event model.Event) {
+				mu.Lock()
+				defer mu.Unlock()
+				handled[si.Endpoint.Address] = event
+			})
+			pod := generatePod("128.0.0.1", "pod1", "nsA", "", "", map[string]string{"app": "a"}, nil)
+			addPods(t, c, pod)
+			if err := waitForPod(c, pod.Status.PodIP); err != nil {
+				t.Fatal(err)
+			}
+			createConformanceService(t, c, "svc1", "nsA", "tcp-port", map[string]string{"app": "a"}, false)
+			createConformanceEndpoints(t, c, "svc1", "nsA", "tcp-port", []conformanceEndpoint{
+				{ip: "128.0.0.1", pod: "pod1"},
+				{ip: "128.0.0.2", notReady: true},
+			})
+
+			retry.UntilSuccessOrFail(t, func() error {
+				mu.Lock()
+				defer mu.Unlock()
+				if want := map[string]model.Event{"128.0.0.1": model.EventAdd}; !reflect.DeepEqual(handled, want) {
+					return fmt.Errorf("got handled endpoints %v, want %v", handled, want)
+				}
+				return nil
+			}, retry.Timeout(5*time.Second))
+		},
+	},
+	{
+		name: "headless services get a full push",
+		run: func(t *testing.T, c *Controller, fx *FakeXdsUpdater) {
+			svc := createConformanceService(t, c, "svc1", "nsA", "tcp-port", nil, true)
+			fx.Clear()
+			createConformanceEndpoints(t, c, "svc1", "nsA", "tcp-port", []conformanceEndpoint{{ip: "128.0.0.1"}})
+
+			key := model.ConfigKey{Kind: model.ServiceEntryKind, Name: "svc1", Namespace: "nsA"}
+			for {
+				ev := fx.Wait("xds")
+				if ev == nil {
+					t.Fatal("timed out waiting for the full push of the headless service")
+				}
+				if _, f := ev.ConfigsUpdated[key]; f {
+					break
+				}
+			}
+			if endpoints, _ := c.EndpointsForService(svc.Hostname); len(endpoints) != 0 {
+				t.Fatalf("got pushed endpoints %v, want none for a headless service", endpoints)
+			}
+		},
+	},
+}
+
+func TestEndpointsConformance(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			for _, scenario := range endpointsConformanceScenarios {
+				scenario := scenario
+				t.Run(scenario.name, func(t *testing.T) {
+					controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: mode})
+					defer controller.Stop()
+					if got := controller.endpointsController().mode(); got != mode {
+						t.Fatalf("got the endpoints of mode %s, want %s", got, mode)
+					}
+					scenario.run(t, controller, fx)
+				})
+			}
+		})
+	}
+}
+
+func TestEndpointSliceTargetNamespaceIndex(t *testing.T) {
+	ref := func(name, namespace string) *coreV1.ObjectReference {
+		return &coreV1.ObjectReference{Kind: "Pod", Name: name, Namespace: namespace}
+	}
+	slice := &discoveryv1alpha1.EndpointSlice{
+		ObjectMeta: metaV1.ObjectMeta{Name: "svc1-abcde", Namespace: "nsA"},
+		Endpoints: []discoveryv1alpha1.Endpoint{
+			{Addresses: []string{"1.1.1.1"}, TargetRef: ref("pod1", "nsA")},
+			{Addresses: []string{"1.1.1.2"}, TargetRef: ref("pod2", "nsB")},
+			{Addresses: []string{"1.1.1.3"}},
+			{Addresses: []string{"1.1.1.4"}, TargetRef: ref("pod4", "nsB")},
+			{Addresses: []string{"1.1.1.5"}, TargetRef: ref("pod5", "nsC")},
+		},
+	}
+	got, err := endpointSliceTargetNamespaceIndexFunc(slice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"nsB", "nsC"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got namespaces %v, want %v", got, want)
+	}
+}
@@ -15,31 +15,58 @@
 package controller
 
 import (
-	v1 "k8s.io/api/core/v1"
+	"sync"
+
 	"k8s.io/client-go/tools/cache"
 
 	"istio.io/pkg/log"
 
 	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/labels"
 )
 
 // Pilot can get EDS information from Kubernetes from two mutually exclusive sources, Endpoints and
 // EndpointSlices. The kubeEndpointsController abstracts these details and provides a common interface that
-// both sources implement.
+// both sources implement. The implementations are interchangeable, SetEndpointMode switches from
+// one to the other, so they must build the same endpoints and instances from the same workloads:
+// TestEndpointsConformance runs the same scenarios against each of them.
 type kubeEndpointsController interface {
+	// mode returns the EndpointMode of the source.
+	mode() EndpointMode
 	HasSynced() bool
+	// Run runs the informer until stopCh is closed or stop is called. Only the first call runs it.
 	Run(stopCh <-chan struct{})
+	// stop stops the informer of a source replaced by SetEndpointMode.
+	stop()
 	InstancesByPort(c *Controller, svc *model.Service, reqSvcPort int,
 		labelsList labels.Collection) ([]*model.ServiceInstance, error)
+	InstancesByPortName(c *Controller, svc *model.Service, portName string,
+		labelsList labels.Collection) ([]*model.ServiceInstance, error)
 	GetProxyServiceInstances(c *Controller, proxy *model.Proxy) []*model.ServiceInstance
+	// UpdateServiceEDS rebuilds the endpoints of the service from the informer cache and pushes them.
+	UpdateServiceEDS(c *Controller, svc *model.Service)
+	// isOrphaned reports whether the informer cache holds no endpoints of the named service.
+	isOrphaned(name, namespace string) bool
+	// clearIfOrphaned is isOrphaned, dropping any endpoints kept for the service outside the cache
+	// when it is orphaned.
+	clearIfOrphaned(hostname host.Name, name, namespace string) bool
 }
 
 // kubeEndpoints abstracts the common behavior across endpoint and endpoint slices.
 type kubeEndpoints struct {
 	c        *Controller
 	informer cache.SharedIndexInformer
+
+	runOnce  sync.Once
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+func newKubeEndpoints(c *Controller, informer cache.SharedIndexInformer) kubeEndpoints {
+	return kubeEndpoints{c: c, informer: informer, stopped: make(chan struct{})}
 }
 
 // updateEdsFunc is called to send eds updates for endpoints/endpointslice.
@@ -50,7 +77,27 @@ func (e *kubeEndpoints) HasSynced() bool {
 }
 
 func (e *kubeEndpoints) Run(stopCh <-chan struct{}) {
-	e.informer.Run(stopCh)
+	if e.c.injected != nil {
+		// The injected informers are run by their owner.
+		return
+	}
+	e.runOnce.Do(func() {
+		stop := make(chan struct{})
+		go func() {
+			select {
+			case <-stopCh:
+			case <-e.stopped:
+			}
+			close(stop)
+		}()
+		e.informer.Run(stop)
+	})
+}
+
+func (e *kubeEndpoints) stop() {
+	e.stopOnce.Do(func() {
+		close(e.stopped)
+	})
 }
 
 // handleEvent processes the event.
@@ -60,8 +107,8 @@ func (e *kubeEndpoints) handleEvent(name string, namespace string, event model.E
 	// headless service cluster discovery type is ORIGINAL_DST, we do not need update EDS.
 	if features.EnableHeadlessService {
 		if svc, _ := e.c.serviceLister.Services(namespace).Get(name); svc != nil {
-			// if the service is headless service, trigger a full push.
-			if svc.Spec.ClusterIP == v1.ClusterIPNone {
+			// if the service is headless service, or resolved as one, trigger a full push.
+			if kube.ServiceResolution(svc) == model.Passthrough {
 				e.c.xdsUpdater.ConfigUpdate(&model.PushRequest{
 					Full: true,
 					// TODO: extend and set service instance type, so no need to re-init push context
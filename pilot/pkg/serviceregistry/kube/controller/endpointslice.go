@@ -16,6 +16,8 @@ package controller
 
 import (
 	"context"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
 
@@ -31,7 +33,6 @@ import (
 	"istio.io/pkg/log"
 
 	"istio.io/istio/pilot/pkg/model"
-	"istio.io/istio/pilot/pkg/serviceregistry/kube"
 	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/labels"
 	"istio.io/istio/pkg/listwatch"
@@ -45,73 +46,178 @@ type endpointSliceController struct {
 var _ kubeEndpointsController = &endpointSliceController{}
 
 func newEndpointSliceController(c *Controller, options Options) *endpointSliceController {
+	// TODO Endpoints has a special cache, to filter out irrelevant updates to kube-system
+	// Investigate if we need this, or if EndpointSlice is makes this not relevant
+	var informer cache.SharedIndexInformer
+	if c.injected != nil {
+		informer = c.injected.EndpointSlices
+	} else {
+		informer = newEndpointSliceInformer(c, options, "")
+	}
+	out := &endpointSliceController{
+		kubeEndpoints: newKubeEndpoints(c, informer),
+		endpointCache: newEndpointSliceCache(),
+	}
+	c.registerEndpointsHandlers(out.informer, "EndpointSlice", out.onEvent, endpointSliceUpdateEqual)
+	return out
+}
+
+// newEndpointSliceInformer creates an informer of the EndpointSlices of the watched namespaces,
+// restricted to those of the label selector unless it is empty.
+func newEndpointSliceInformer(c *Controller, options Options, labelSelector string) cache.SharedIndexInformer {
 	namespaces := strings.Split(options.WatchedNamespaces, ",")
 
 	mlw := listwatch.MultiNamespaceListerWatcher(namespaces, func(namespace string) cache.ListerWatcher {
 		return &cache.ListWatch{
 			ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+				opts.LabelSelector = labelSelector
 				return c.client.DiscoveryV1alpha1().EndpointSlices(namespace).List(context.TODO(), opts)
 			},
 			WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+				opts.LabelSelector = labelSelector
 				return c.client.DiscoveryV1alpha1().EndpointSlices(namespace).Watch(context.TODO(), opts)
 			},
 		}
 	})
 
-	informer := cache.NewSharedIndexInformer(mlw, &discoveryv1alpha1.EndpointSlice{}, options.ResyncPeriod,
-		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	return cache.NewSharedIndexInformer(mlw, &discoveryv1alpha1.EndpointSlice{}, c.informerResyncPeriod(resyncEndpoints),
+		cache.Indexers{
+			cache.NamespaceIndex:          cache.MetaNamespaceIndexFunc,
+			endpointsTargetNamespaceIndex: endpointSliceTargetNamespaceIndexFunc,
+		})
+}
 
-	// TODO Endpoints has a special cache, to filter out irrelevant updates to kube-system
-	// Investigate if we need this, or if EndpointSlice is makes this not relevant
-	out := &endpointSliceController{
-		kubeEndpoints: kubeEndpoints{
-			c:        c,
-			informer: informer,
-		},
-		endpointCache: newEndpointSliceCache(),
+// endpointSliceTargetNamespaceIndexFunc is the endpointsTargetNamespaceIndex of EndpointSlices.
+func endpointSliceTargetNamespaceIndexFunc(obj interface{}) ([]string, error) {
+	slice, ok := obj.(*discoveryv1alpha1.EndpointSlice)
+	if !ok {
+		return nil, nil
 	}
-	registerHandlers(informer, c.queue, "EndpointSlice", out.onEvent)
-	return out
+	var namespaces []string
+	seen := make(map[string]struct{})
+	for _, e := range slice.Endpoints {
+		ref := e.TargetRef
+		if ref == nil || ref.Kind != "Pod" || ref.Namespace == "" || ref.Namespace == slice.Namespace {
+			continue
+		}
+		if _, f := seen[ref.Namespace]; !f {
+			seen[ref.Namespace] = struct{}{}
+			namespaces = append(namespaces, ref.Namespace)
+		}
+	}
+	return namespaces, nil
+}
+
+func (esc *endpointSliceController) mode() EndpointMode {
+	return EndpointSliceOnly
 }
 
 func (esc *endpointSliceController) updateEDS(es interface{}, event model.Event) {
 	slice := es.(*discoveryv1alpha1.EndpointSlice)
 	svcName := slice.Labels[discoveryv1alpha1.LabelServiceName]
-	hostname := kube.ServiceHostname(svcName, slice.Namespace, esc.c.domainSuffix)
-
-	esc.c.RLock()
-	svc := esc.c.servicesMap[hostname]
-	esc.c.RUnlock()
+	hostname := esc.c.endpointsHostname(svcName, slice.Namespace)
 
+	svc := esc.c.endpointsService(hostname, event)
 	if svc == nil {
+		if event == model.EventDelete {
+			// The service was deleted first and its endpoints were cleared with it, this only
+			// makes sure that none are left for the hostname. The endpoints of the other slices
+			// are built again if the service comes back.
+			esc.endpointCache.Delete(hostname)
+			esc.c.clearPushedEndpoints(hostname)
+			return
+		}
+		if esc.c.isSkippedService(hostname) {
+			return
+		}
 		log.Infof("Handle EDS endpoint: skip updating, service %s/%s has mot been populated", svcName, slice.Namespace)
 		return
 	}
+	controlPlane := esc.c.isControlPlaneService(svc)
+	endpoints := esc.updateCache(slice, svc, event)
+
+	log.Debugf("Handle EDS endpoint %s in namespace %s", svcName, slice.Namespace)
+
+	fep := esc.c.collectAllForeignEndpoints(svc)
+
+	local := esc.endpointCache.Get(hostname)
+	esc.c.recordEndpointsVersion(hostname, slice.ResourceVersion)
+	esc.c.trackLocalEndpoints(hostname, svcName, slice.Namespace, len(local) > 0)
+	esc.c.endpointMetrics.setNotReady(hostname, esc.endpointCache.NotReady(hostname))
+	esc.c.edsUpdate(hostname, slice.Namespace, append(local, fep...))
+	if controlPlane {
+		// Instance handlers could route traffic to the control plane through the mesh.
+		return
+	}
+	// fire instance handles for k8s endpoints only
+	esc.c.fireInstanceHandlers(svc, endpoints, event)
+}
 
-	endpoints := make([]*model.IstioEndpoint, 0)
+// updateCache builds the endpoints of the slice of the service, or none if it is deleted, and
+// records them in the endpoint cache, returning them.
+func (esc *endpointSliceController) updateCache(slice *discoveryv1alpha1.EndpointSlice, svc *model.Service,
+	event model.Event) []*model.IstioEndpoint {
+	hostname := svc.Hostname
+	esc.c.RLock()
+	scrape := esc.c.prometheusScrapes[hostname]
+	esc.c.RUnlock()
+
+	controlPlane := esc.c.isControlPlaneService(svc)
+	// The slices of derived services list the endpoints of the other clusters of the cluster set,
+	// which have no local pod.
+	trusted := esc.c.trustsSlices(svc)
+	var sourceCluster string
+	if trusted {
+		sourceCluster = esc.c.sliceSourceCluster(slice)
+	}
+	svcName := slice.Labels[discoveryv1alpha1.LabelServiceName]
+
+	size := 0
+	if event != model.EventDelete {
+		for _, e := range slice.Endpoints {
+			size += len(e.Addresses) * len(slice.Ports)
+		}
+	}
+	endpoints := make([]*model.IstioEndpoint, 0, size)
+	notReady := 0
+	ports := esc.c.newEndpointPortChecker(svc, slice.Name)
+	addresses := esc.c.newEndpointAddressFilter(hostname, "EndpointSlice "+slice.Namespace+"/"+slice.Name)
 	if event != model.EventDelete {
 		for _, e := range slice.Endpoints {
 			if e.Conditions.Ready != nil && !*e.Conditions.Ready {
 				// Ignore not ready endpoints
+				notReady += len(e.Addresses)
 				continue
 			}
 			for _, a := range e.Addresses {
-				pod := esc.c.pods.getPodByIP(a)
-				if pod == nil {
-					// This can not happen in usual case
-					if e.TargetRef != nil && e.TargetRef.Kind == "Pod" {
+				if !addresses.accept(a) {
+					continue
+				}
+				var pod *v1.Pod
+				switch {
+				case !trusted:
+					// The endpoint event may arrive before the pod event, the pod is then looked up
+					// by reference. For service without selector, maybe there are no related pods.
+					var missing bool
+					if pod, missing = esc.c.getEndpointPod(a, e.TargetRef); missing {
+						// If pod is still not available, this an unusual case.
+						endpointsWithNoPods.Increment()
 						log.Warnf("Endpoint without pod %s %s.%s", a, svcName, slice.Namespace)
-
 						if esc.c.metrics != nil {
 							esc.c.metrics.AddMetric(model.EndpointNoPod, string(hostname), nil, a)
 						}
-						// TODO: keep them in a list, and check when pod events happen !
 						continue
 					}
-					// For service without selector, maybe there are no related pods
+				case sourceCluster == esc.c.clusterID:
+					// The endpoints imported from other clusters may reuse the IPs of local pods.
+					pod = esc.c.pods.getPodByIP(a)
+				}
+				if esc.c.isProxyUnreadyEndpoint(pod) {
+					notReady++
+					continue
 				}
 
-				builder := esc.newEndpointBuilder(pod, e)
+				builder := esc.newEndpointBuilder(pod, e).withPrometheusScrape(pod, scrape)
 				// EDS and ServiceEntry use name for service port - ADS will need to
 				// map to numbers.
 				for _, port := range slice.Ports {
@@ -123,57 +229,88 @@ func (esc *endpointSliceController) updateEDS(es interface{}, event model.Event)
 					if port.Name != nil {
 						portName = *port.Name
 					}
+					if !ports.accept(portName, portNum) || !ports.acceptReserved(pod, portName, portNum) {
+						continue
+					}
 
 					istioEndpoint := builder.buildIstioEndpoint(a, portNum, portName)
+					istioEndpoint.HostName = endpointHostName(sliceEndpointHostname(e), svc)
+					istioEndpoint.ClusterLocal = svc.Attributes.ClusterLocal
+					istioEndpoint.ControlPlane = controlPlane
+					if trusted {
+						istioEndpoint.Locality.ClusterID = sourceCluster
+					}
 					endpoints = append(endpoints, istioEndpoint)
 				}
 			}
 		}
 	}
 
+	esc.c.recordEndpointPorts(ports)
+	addresses.record()
 	esc.endpointCache.Update(hostname, slice.Name, endpoints)
+	esc.endpointCache.UpdateNotReady(hostname, slice.Name, notReady)
+	return endpoints
+}
 
-	log.Debugf("Handle EDS endpoint %s in namespace %s", svcName, slice.Namespace)
-
-	fep := esc.c.collectAllForeignEndpoints(svc)
+func sliceEndpointHostname(e discoveryv1alpha1.Endpoint) string {
+	if e.Hostname == nil {
+		return ""
+	}
+	return *e.Hostname
+}
 
-	_ = esc.c.xdsUpdater.EDSUpdate(esc.c.clusterID, string(hostname), slice.Namespace,
-		append(esc.endpointCache.Get(hostname), fep...))
-	// fire instance handles for k8s endpoints only
-	for _, handler := range esc.c.instanceHandlers {
-		for _, ep := range endpoints {
-			si := &model.ServiceInstance{
-				Service:     svc,
-				ServicePort: nil,
-				Endpoint:    ep,
-			}
-			handler(si, event)
-		}
+// endpointSliceUpdateEqual compares the slice contents, ignoring the resource version and other
+// bookkeeping metadata.
+func endpointSliceUpdateEqual(old, cur interface{}) bool {
+	oldSlice, ok := old.(*discoveryv1alpha1.EndpointSlice)
+	if !ok {
+		return false
+	}
+	curSlice, ok := cur.(*discoveryv1alpha1.EndpointSlice)
+	if !ok {
+		return false
 	}
+	return oldSlice.AddressType == curSlice.AddressType &&
+		reflect.DeepEqual(oldSlice.Labels, curSlice.Labels) &&
+		reflect.DeepEqual(oldSlice.Endpoints, curSlice.Endpoints) &&
+		reflect.DeepEqual(oldSlice.Ports, curSlice.Ports)
 }
 
 func (esc *endpointSliceController) onEvent(curr interface{}, event model.Event) error {
-	if err := esc.c.checkReadyForEvents(); err != nil {
+	if !esc.c.isCurrentEndpoints(esc) {
+		return nil
+	}
+	if err := esc.c.checkEndpointsReady(); err != nil {
 		return err
 	}
 
+	ep, ok := endpointSliceFromEvent(curr)
+	if !ok {
+		return nil
+	}
+
+	return esc.handleEvent(ep.Labels[discoveryv1alpha1.LabelServiceName], ep.Namespace, event, ep, func(obj interface{}, event model.Event) {
+		esc.updateEDS(obj, event)
+	})
+}
+
+// endpointSliceFromEvent returns the EndpointSlice of an informer event, which may be a tombstone.
+func endpointSliceFromEvent(curr interface{}) (*discoveryv1alpha1.EndpointSlice, bool) {
 	ep, ok := curr.(*discoveryv1alpha1.EndpointSlice)
 	if !ok {
 		tombstone, ok := curr.(cache.DeletedFinalStateUnknown)
 		if !ok {
 			log.Errorf("1 Couldn't get object from tombstone %#v", curr)
-			return nil
+			return nil, false
 		}
 		ep, ok = tombstone.Obj.(*discoveryv1alpha1.EndpointSlice)
 		if !ok {
 			log.Errorf("Tombstone contained an object that is not an endpoints slice %#v", curr)
-			return nil
+			return nil, false
 		}
 	}
-
-	return esc.handleEvent(ep.Labels[discoveryv1alpha1.LabelServiceName], ep.Namespace, event, curr, func(obj interface{}, event model.Event) {
-		esc.updateEDS(obj, event)
-	})
+	return ep, true
 }
 
 // GetProxyServiceInstances returns service instances co-located with a given proxy
@@ -185,6 +322,10 @@ func (esc *endpointSliceController) GetProxyServiceInstances(c *Controller, prox
 		log.Errorf("Get endpointslice by index failed: %v", err)
 		return nil
 	}
+	// The pod of the proxy may also back the EndpointSlices of services of other namespaces.
+	for _, item := range c.crossNamespaceProxyEndpoints(esc.informer, proxy) {
+		eps = append(eps, item.(*discoveryv1alpha1.EndpointSlice))
+	}
 	out := make([]*model.ServiceInstance, 0)
 	for _, ep := range eps {
 		instances := esc.proxyServiceInstances(c, ep, proxy)
@@ -197,7 +338,7 @@ func (esc *endpointSliceController) GetProxyServiceInstances(c *Controller, prox
 func (esc *endpointSliceController) proxyServiceInstances(c *Controller, ep *discoveryv1alpha1.EndpointSlice, proxy *model.Proxy) []*model.ServiceInstance {
 	out := make([]*model.ServiceInstance, 0)
 
-	hostname := kube.ServiceHostname(ep.Labels[discoveryv1alpha1.LabelServiceName], ep.Namespace, c.domainSuffix)
+	hostname := c.endpointsHostname(ep.Labels[discoveryv1alpha1.LabelServiceName], ep.Namespace)
 	c.RLock()
 	svc := c.servicesMap[hostname]
 	c.RUnlock()
@@ -206,21 +347,29 @@ func (esc *endpointSliceController) proxyServiceInstances(c *Controller, ep *dis
 		return out
 	}
 
-	podIP := proxy.IPAddresses[0]
-	pod := c.pods.getPodByIP(podIP)
+	pod, _ := c.getProxyPod(proxy)
 	builder := NewEndpointBuilder(c, pod)
 
 	for _, port := range ep.Ports {
-		if port.Name == nil || port.Port == nil {
+		if port.Port == nil {
 			continue
 		}
-		svcPort, exists := svc.Ports.Get(*port.Name)
+		// Like in Endpoints, the port of a service with a single port may have no name.
+		var portName string
+		if port.Name != nil {
+			portName = *port.Name
+		}
+		svcPort, exists := svc.Ports.Get(portName)
 		if !exists {
 			continue
 		}
 
 		// consider multiple IP scenarios
 		for _, ip := range proxy.IPAddresses {
+			// Like the endpoints, the proxy addresses outside the endpoint CIDRs get no instances.
+			if !c.endpointCIDRs.allows(ip) {
+				continue
+			}
 			for _, ep := range ep.Endpoints {
 				for _, a := range ep.Addresses {
 					if a == ip {
@@ -244,6 +393,25 @@ func (esc *endpointSliceController) proxyServiceInstances(c *Controller, ep *dis
 }
 
 func (esc *endpointSliceController) InstancesByPort(c *Controller, svc *model.Service, reqSvcPort int,
+	labelsList labels.Collection) ([]*model.ServiceInstance, error) {
+	// Locate all ports in the actual service
+	svcPort, exists := svc.Ports.GetByPort(reqSvcPort)
+	if !exists {
+		return nil, nil
+	}
+	return esc.instancesByServicePort(c, svc, svcPort, labelsList)
+}
+
+func (esc *endpointSliceController) InstancesByPortName(c *Controller, svc *model.Service, portName string,
+	labelsList labels.Collection) ([]*model.ServiceInstance, error) {
+	svcPort, exists := svc.Ports.Get(portName)
+	if !exists {
+		return nil, nil
+	}
+	return esc.instancesByServicePort(c, svc, svcPort, labelsList)
+}
+
+func (esc *endpointSliceController) instancesByServicePort(c *Controller, svc *model.Service, svcPort *model.Port,
 	labelsList labels.Collection) ([]*model.ServiceInstance, error) {
 	esLabelSelector := klabels.Set(map[string]string{discoveryv1alpha1.LabelServiceName: svc.Attributes.Name}).AsSelectorPreValidated()
 	slices, err := discoverylister.NewEndpointSliceLister(esc.informer.GetIndexer()).EndpointSlices(svc.Attributes.Namespace).List(esLabelSelector)
@@ -254,19 +422,22 @@ func (esc *endpointSliceController) InstancesByPort(c *Controller, svc *model.Se
 	if len(slices) == 0 {
 		return nil, nil
 	}
-
-	// Locate all ports in the actual service
-	svcPort, exists := svc.Ports.GetByPort(reqSvcPort)
-	if !exists {
-		return nil, nil
-	}
+	// The lister order is random, the instances follow the slice names like the cached endpoints.
+	sort.Slice(slices, func(i, j int) bool { return slices[i].Name < slices[j].Name })
 
 	var out []*model.ServiceInstance
 	for _, slice := range slices {
 		for _, e := range slice.Endpoints {
+			// Like the not ready addresses of Endpoints, not ready endpoints are no instances.
+			if e.Conditions.Ready != nil && !*e.Conditions.Ready {
+				continue
+			}
 			for _, a := range e.Addresses {
+				if !c.endpointCIDRs.allows(a) {
+					continue
+				}
 				var podLabels labels.Instance
-				pod := c.pods.getPodByIP(a)
+				pod, _ := c.getEndpointPod(a, e.TargetRef)
 				if pod != nil {
 					podLabels = pod.Labels
 				}
@@ -287,6 +458,7 @@ func (esc *endpointSliceController) InstancesByPort(c *Controller, svc *model.Se
 					if port.Name == nil ||
 						svcPort.Name == *port.Name {
 						istioEndpoint := builder.buildIstioEndpoint(a, portNum, svcPort.Name)
+						istioEndpoint.HostName = endpointHostName(sliceEndpointHostname(e), svc)
 						out = append(out, &model.ServiceInstance{
 							Endpoint:    istioEndpoint,
 							ServicePort: svcPort,
@@ -300,6 +472,32 @@ func (esc *endpointSliceController) InstancesByPort(c *Controller, svc *model.Se
 	return out, nil
 }
 
+func (esc *endpointSliceController) UpdateServiceEDS(c *Controller, svc *model.Service) {
+	esLabelSelector := klabels.Set(map[string]string{discoveryv1alpha1.LabelServiceName: svc.Attributes.Name}).AsSelectorPreValidated()
+	slices, err := discoverylister.NewEndpointSliceLister(esc.informer.GetIndexer()).EndpointSlices(svc.Attributes.Namespace).List(esLabelSelector)
+	if err != nil {
+		log.Infof("get endpoints(%s, %s) => error %v", svc.Attributes.Name, svc.Attributes.Namespace, err)
+		return
+	}
+	for _, slice := range slices {
+		esc.updateEDS(slice, model.EventUpdate)
+	}
+}
+
+func (esc *endpointSliceController) isOrphaned(name, namespace string) bool {
+	esLabelSelector := klabels.Set(map[string]string{discoveryv1alpha1.LabelServiceName: name}).AsSelectorPreValidated()
+	slices, err := discoverylister.NewEndpointSliceLister(esc.informer.GetIndexer()).EndpointSlices(namespace).List(esLabelSelector)
+	return err == nil && len(slices) == 0
+}
+
+func (esc *endpointSliceController) clearIfOrphaned(hostname host.Name, name, namespace string) bool {
+	if !esc.isOrphaned(name, namespace) {
+		return false
+	}
+	esc.endpointCache.Delete(hostname)
+	return true
+}
+
 func (esc *endpointSliceController) newEndpointBuilder(pod *v1.Pod, endpoint discoveryv1alpha1.Endpoint) *EndpointBuilder {
 	if pod != nil {
 		// Respect pod "istio-locality" label
@@ -310,7 +508,12 @@ func (esc *endpointSliceController) newEndpointBuilder(pod *v1.Pod, endpoint dis
 		}
 	}
 
-	return NewEndpointBuilder(esc.c, pod)
+	builder := NewEndpointBuilder(esc.c, pod)
+	// The slice reports the node of the endpoint itself, which is also known for endpoints without pod.
+	if nodeName := endpoint.Topology[v1.LabelHostname]; nodeName != "" {
+		builder.nodeName = nodeName
+	}
+	return builder
 }
 
 func getLocalityFromTopology(topology map[string]string) string {
@@ -327,11 +530,14 @@ func getLocalityFromTopology(topology map[string]string) string {
 type endpointSliceCache struct {
 	mu                         sync.RWMutex
 	endpointsByServiceAndSlice map[host.Name]map[string][]*model.IstioEndpoint
+	// notReadyByServiceAndSlice counts the addresses left out of the endpoints as not ready.
+	notReadyByServiceAndSlice map[host.Name]map[string]int
 }
 
 func newEndpointSliceCache() *endpointSliceCache {
 	out := &endpointSliceCache{
 		endpointsByServiceAndSlice: make(map[host.Name]map[string][]*model.IstioEndpoint),
+		notReadyByServiceAndSlice:  make(map[host.Name]map[string]int),
 	}
 	return out
 }
@@ -348,12 +554,52 @@ func (e *endpointSliceCache) Update(hostname host.Name, slice string, endpoints
 	e.endpointsByServiceAndSlice[hostname][slice] = endpoints
 }
 
+func (e *endpointSliceCache) UpdateNotReady(hostname host.Name, slice string, notReady int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if notReady == 0 {
+		delete(e.notReadyByServiceAndSlice[hostname], slice)
+		if len(e.notReadyByServiceAndSlice[hostname]) == 0 {
+			delete(e.notReadyByServiceAndSlice, hostname)
+		}
+		return
+	}
+	if _, f := e.notReadyByServiceAndSlice[hostname]; !f {
+		e.notReadyByServiceAndSlice[hostname] = make(map[string]int)
+	}
+	e.notReadyByServiceAndSlice[hostname][slice] = notReady
+}
+
+func (e *endpointSliceCache) Delete(hostname host.Name) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.endpointsByServiceAndSlice, hostname)
+	delete(e.notReadyByServiceAndSlice, hostname)
+}
+
+// NotReady returns the not ready addresses of all the slices of the service.
+func (e *endpointSliceCache) NotReady(hostname host.Name) int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	total := 0
+	for _, n := range e.notReadyByServiceAndSlice[hostname] {
+		total += n
+	}
+	return total
+}
+
+// Get returns the endpoints of all the slices of the service, in the order of the slice names.
 func (e *endpointSliceCache) Get(hostname host.Name) []*model.IstioEndpoint {
 	e.mu.RLock()
 	defer e.mu.RUnlock()
+	slices := make([]string, 0, len(e.endpointsByServiceAndSlice[hostname]))
+	for slice := range e.endpointsByServiceAndSlice[hostname] {
+		slices = append(slices, slice)
+	}
+	sort.Strings(slices)
 	var endpoints []*model.IstioEndpoint
-	for _, eps := range e.endpointsByServiceAndSlice[hostname] {
-		endpoints = append(endpoints, eps...)
+	for _, slice := range slices {
+		endpoints = append(endpoints, e.endpointsByServiceAndSlice[hostname][slice]...)
 	}
 	return endpoints
 }
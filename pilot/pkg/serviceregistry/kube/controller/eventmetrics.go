@@ -0,0 +1,103 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+const (
+	// eventOutcomeSuccess is the outcome of events handled without error.
+	eventOutcomeSuccess = "success"
+	// eventOutcomeRetry is the outcome of events whose handler failed, which the queue handles again.
+	eventOutcomeRetry = "retry"
+	// eventOutcomeError is the outcome of events whose handler panicked, which the queue recovers
+	// and retries until the task is dropped.
+	eventOutcomeError = "error"
+)
+
+var (
+	outcomeTag = monitoring.MustCreateLabel("outcome")
+
+	k8sEventOutcomes = monitoring.NewSum(
+		"pilot_k8s_reg_event_outcomes",
+		"Handler invocations for the events from k8s registry, by outcome. Labeled by namespace with Options.EventNamespaceMetrics.",
+		monitoring.WithLabels(typeTag, outcomeTag, namespaceTag),
+	)
+
+	k8sHandlerPanics = monitoring.NewSum(
+		"pilot_k8s_reg_handler_panics",
+		"Panics in the handlers of the events from k8s registry.",
+		monitoring.WithLabels(typeTag),
+	)
+)
+
+func init() {
+	monitoring.MustRegister(k8sEventOutcomes, k8sHandlerPanics)
+}
+
+// instrumentHandler records the outcome of each invocation of the handler. A panic is counted
+// and let through: the recoveringQueue running the handler recovers it.
+func instrumentHandler(otype string, handler func(interface{}, model.Event) error,
+	namespaceMetrics bool) func(interface{}, model.Event) error {
+	return func(obj interface{}, event model.Event) error {
+		outcome := eventOutcomeError
+		defer func() {
+			if outcome == eventOutcomeError {
+				log.Errorf("Handler of %s event %s panicked", otype, event)
+				k8sHandlerPanics.With(typeTag.Value(otype)).Increment()
+			}
+			recordEventOutcome(otype, outcome, eventNamespace(obj, namespaceMetrics))
+		}()
+		err := handler(obj, event)
+		if err != nil {
+			outcome = eventOutcomeRetry
+		} else {
+			outcome = eventOutcomeSuccess
+		}
+		return err
+	}
+}
+
+func recordEventOutcome(otype, outcome, namespace string) {
+	if namespace != "" {
+		k8sEventOutcomes.With(typeTag.Value(otype), outcomeTag.Value(outcome), namespaceTag.Value(namespace)).Increment()
+		return
+	}
+	k8sEventOutcomes.With(typeTag.Value(otype), outcomeTag.Value(outcome)).Increment()
+}
+
+// eventNamespace returns the namespace of the object of an event when enabled, and an empty
+// string otherwise or for cluster scoped objects.
+func eventNamespace(obj interface{}, enabled bool) string {
+	if !enabled {
+		return ""
+	}
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		namespace, _, _ := cache.SplitMetaNamespaceKey(tombstone.Key)
+		return namespace
+	}
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return ""
+	}
+	return accessor.GetNamespace()
+}
@@ -0,0 +1,129 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/queue"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+func TestEventHandlerPanicRecovered(t *testing.T) {
+	q := newRecoveringQueue(queue.NewQueue(time.Millisecond))
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.Run(stop)
+
+	handled := make(chan string, 10)
+	failed := false
+	handler := func(obj interface{}, _ model.Event) error {
+		pod := obj.(*coreV1.Pod)
+		switch pod.Name {
+		case "panicking":
+			panic("handler bug")
+		case "flaky":
+			if !failed {
+				failed = true
+				return errors.New("not yet")
+			}
+		}
+		handled <- pod.Name
+		return nil
+	}
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	h := newEventHandler(q, store, "PanicTest", handler, reflect.DeepEqual, true)
+
+	outcome := func(outcome string) float64 {
+		return sumValue(t, "pilot_k8s_reg_event_outcomes",
+			map[string]string{"type": "PanicTest", "outcome": outcome, "namespace": "nsA"})
+	}
+	panics := sumValue(t, "pilot_k8s_reg_handler_panics", map[string]string{"type": "PanicTest"})
+	drops := sumValue(t, "pilot_k8s_queue_task_drops", nil)
+	errorsBefore, retriesBefore, successesBefore := outcome(eventOutcomeError), outcome(eventOutcomeRetry), outcome(eventOutcomeSuccess)
+
+	for _, name := range []string{"panicking", "flaky", "healthy"} {
+		pod := &coreV1.Pod{ObjectMeta: metaV1.ObjectMeta{Name: name, Namespace: "nsA"}}
+		if err := store.Add(pod); err != nil {
+			t.Fatal(err)
+		}
+		h.OnAdd(pod)
+	}
+
+	// The queue survives the panic, and the failed events are handled again.
+	got := map[string]bool{}
+	for len(got) < 2 {
+		select {
+		case name := <-handled:
+			got[name] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the events after the panic, got %v", got)
+		}
+	}
+	if !got["flaky"] || !got["healthy"] {
+		t.Fatalf("got handled events %v, want flaky and healthy", got)
+	}
+
+	// The outcomes are recorded once the handler returns.
+	retry.UntilSuccessOrFail(t, func() error {
+		// The panicking event is retried until it is dropped.
+		if v := sumValue(t, "pilot_k8s_reg_handler_panics", map[string]string{"type": "PanicTest"}); v != panics+maxTaskPanics {
+			return fmt.Errorf("got %v panics, want %v", v, panics+maxTaskPanics)
+		}
+		if v := outcome(eventOutcomeError); v != errorsBefore+maxTaskPanics {
+			return fmt.Errorf("got %v error outcomes, want %v", v, errorsBefore+maxTaskPanics)
+		}
+		if v := sumValue(t, "pilot_k8s_queue_task_drops", nil); v != drops+1 {
+			return fmt.Errorf("got %v dropped tasks, want %v", v, drops+1)
+		}
+		if v := outcome(eventOutcomeRetry); v != retriesBefore+1 {
+			return fmt.Errorf("got %v retry outcomes, want %v", v, retriesBefore+1)
+		}
+		if v := outcome(eventOutcomeSuccess); v != successesBefore+2 {
+			return fmt.Errorf("got %v success outcomes, want %v", v, successesBefore+2)
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+}
+
+func TestEventNamespace(t *testing.T) {
+	pod := &coreV1.Pod{ObjectMeta: metaV1.ObjectMeta{Name: "pod1", Namespace: "nsA"}}
+	node := &coreV1.Node{ObjectMeta: metaV1.ObjectMeta{Name: "node1"}}
+	cases := []struct {
+		name    string
+		obj     interface{}
+		enabled bool
+		want    string
+	}{
+		{"disabled", pod, false, ""},
+		{"namespaced", pod, true, "nsA"},
+		{"tombstone", cache.DeletedFinalStateUnknown{Key: "nsA/pod1", Obj: pod}, true, "nsA"},
+		{"cluster scoped", node, true, ""},
+	}
+	for _, tc := range cases {
+		if got := eventNamespace(tc.obj, tc.enabled); got != tc.want {
+			t.Errorf("%s: got namespace %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
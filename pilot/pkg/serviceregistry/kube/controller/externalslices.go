@@ -0,0 +1,205 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	discoveryv1alpha1 "k8s.io/api/discovery/v1alpha1"
+	klabels "k8s.io/apimachinery/pkg/labels"
+	discoverylister "k8s.io/client-go/listers/discovery/v1alpha1"
+
+	"istio.io/pkg/log"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+// externalEndpointSlices consumes, in the EndpointsOnly mode, the EndpointSlices of the managers of
+// Options.ExternalEndpointSliceManagers, in addition to the Endpoints. The endpoints of the slices
+// are cached by service and slice, and merged into those of the Endpoints of the service by merge.
+type externalEndpointSlices struct {
+	*endpointSliceController
+	// owner is the endpoints controller the slices are consumed for, their events are dropped once
+	// SetEndpointMode replaced it.
+	owner *endpointsController
+	// selector selects the slices of the managers, it is checked again on events as the informer
+	// may not filter them, like the fake clients in tests.
+	selector klabels.Selector
+}
+
+// externalEndpointSliceSelector returns the label selector of the EndpointSlices of the managers.
+func externalEndpointSliceSelector(managers []string) (klabels.Selector, error) {
+	selector, err := klabels.Parse(fmt.Sprintf("%s in (%s)", discoveryv1alpha1.LabelManagedBy, strings.Join(managers, ",")))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ExternalEndpointSliceManagers %v: %v", managers, err)
+	}
+	return selector, nil
+}
+
+// newExternalEndpointSlices returns the consumer of the external EndpointSlices of the endpoints
+// controller, or nil without managers.
+func newExternalEndpointSlices(c *Controller, options Options, owner *endpointsController) *externalEndpointSlices {
+	if len(options.ExternalEndpointSliceManagers) == 0 {
+		return nil
+	}
+	selector, err := externalEndpointSliceSelector(options.ExternalEndpointSliceManagers)
+	if err != nil {
+		log.Errorf("Ignoring %v", err)
+		return nil
+	}
+	out := &externalEndpointSlices{
+		endpointSliceController: &endpointSliceController{
+			kubeEndpoints: newKubeEndpoints(c, newEndpointSliceInformer(c, options, selector.String())),
+			endpointCache: newEndpointSliceCache(),
+		},
+		owner:    owner,
+		selector: selector,
+	}
+	c.registerHandlers(out.informer, "ExternalEndpointSlice", out.onEvent, endpointSliceUpdateEqual)
+	return out
+}
+
+// externalEndpointSlices returns the consumer of the external EndpointSlices of the current source
+// of the endpoints, or nil.
+func (c *Controller) externalEndpointSlices() *externalEndpointSlices {
+	if e, ok := c.endpointsController().(*endpointsController); ok {
+		return e.external
+	}
+	return nil
+}
+
+func (x *externalEndpointSlices) onEvent(curr interface{}, event model.Event) error {
+	if !x.c.isCurrentEndpoints(x.owner) {
+		return nil
+	}
+	if err := x.c.checkEndpointsReady(); err != nil {
+		return err
+	}
+
+	slice, ok := endpointSliceFromEvent(curr)
+	if !ok || !x.selector.Matches(klabels.Set(slice.Labels)) {
+		return nil
+	}
+
+	return x.handleEvent(slice.Labels[discoveryv1alpha1.LabelServiceName], slice.Namespace, event, slice,
+		func(obj interface{}, event model.Event) {
+			x.updateEDS(obj.(*discoveryv1alpha1.EndpointSlice), event)
+		})
+}
+
+// updateEDS caches the endpoints of the slice, and pushes the endpoints of its service, merged
+// with those of its Endpoints.
+func (x *externalEndpointSlices) updateEDS(slice *discoveryv1alpha1.EndpointSlice, event model.Event) {
+	hostname := x.c.endpointsHostname(slice.Labels[discoveryv1alpha1.LabelServiceName], slice.Namespace)
+	svc := x.c.endpointsService(hostname, event)
+	if svc == nil {
+		return
+	}
+
+	endpoints := x.updateCache(slice, svc, event)
+	// A deleted slice may leave the service without endpoints, which must still be pushed.
+	x.owner.pushServiceEDS(x.c, svc, true)
+	if x.c.isControlPlaneService(svc) {
+		return
+	}
+	x.c.fireInstanceHandlers(svc, endpoints, event)
+}
+
+// rebuild builds the endpoints of the slices of the service again from the informer cache.
+func (x *externalEndpointSlices) rebuild(svc *model.Service) {
+	esLabelSelector := klabels.Set(map[string]string{discoveryv1alpha1.LabelServiceName: svc.Attributes.Name}).AsSelectorPreValidated()
+	slices, err := discoverylister.NewEndpointSliceLister(x.informer.GetIndexer()).EndpointSlices(svc.Attributes.Namespace).List(esLabelSelector)
+	if err != nil {
+		log.Infof("get external endpoint slices(%s, %s) => error %v", svc.Attributes.Name, svc.Attributes.Namespace, err)
+		return
+	}
+	x.endpointCache.Delete(svc.Hostname)
+	for _, slice := range slices {
+		if !x.selector.Matches(klabels.Set(slice.Labels)) {
+			continue
+		}
+		x.updateCache(slice, svc, model.EventUpdate)
+	}
+}
+
+// has reports whether endpoints of the service are cached.
+func (x *externalEndpointSlices) has(hostname host.Name) bool {
+	return len(x.endpointCache.Get(hostname)) > 0
+}
+
+// endpointKey identifies an endpoint by its address and port, for deduplication.
+type endpointKey struct {
+	address string
+	port    uint32
+}
+
+// merge returns the endpoints of the Endpoints of the service followed by those of its external
+// slices, in the order of the slice names, leaving out the addresses and ports already listed:
+// the Endpoints are authoritative. The merge only depends on the sources, so it is stable.
+func (x *externalEndpointSlices) merge(hostname host.Name, primary []*model.IstioEndpoint) []*model.IstioEndpoint {
+	external := x.endpointCache.Get(hostname)
+	if len(external) == 0 {
+		return primary
+	}
+	out := make([]*model.IstioEndpoint, 0, len(primary)+len(external))
+	seen := make(map[endpointKey]struct{}, len(primary)+len(external))
+	for _, ep := range primary {
+		seen[endpointKey{ep.Address, ep.EndpointPort}] = struct{}{}
+		out = append(out, ep)
+	}
+	for _, ep := range external {
+		key := endpointKey{ep.Address, ep.EndpointPort}
+		if _, f := seen[key]; f {
+			continue
+		}
+		seen[key] = struct{}{}
+		out = append(out, ep)
+	}
+	return out
+}
+
+// mergeInstances is merge for the instances of a port of the service.
+func mergeInstances(primary, external []*model.ServiceInstance) []*model.ServiceInstance {
+	if len(external) == 0 {
+		return primary
+	}
+	seen := make(map[endpointKey]struct{}, len(primary)+len(external))
+	for _, si := range primary {
+		seen[endpointKey{si.Endpoint.Address, si.Endpoint.EndpointPort}] = struct{}{}
+	}
+	out := primary
+	for _, si := range external {
+		key := endpointKey{si.Endpoint.Address, si.Endpoint.EndpointPort}
+		if _, f := seen[key]; f {
+			continue
+		}
+		seen[key] = struct{}{}
+		out = append(out, si)
+	}
+	return out
+}
+
+// pushExternalEndpoints pushes the endpoints of a service without Endpoints: those of its external
+// slices and its foreign instances.
+func (c *Controller) pushExternalEndpoints(svc *model.Service, x *externalEndpointSlices) {
+	hostname := svc.Hostname
+	local := x.endpointCache.Get(hostname)
+	fep := c.collectAllForeignEndpoints(svc)
+	c.trackLocalEndpoints(hostname, svc.Attributes.Name, svc.Attributes.Namespace, len(local) > 0)
+	c.endpointMetrics.setNotReady(hostname, x.endpointCache.NotReady(hostname))
+	c.edsUpdate(hostname, svc.Attributes.Namespace, append(local, fep...))
+}
@@ -0,0 +1,197 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	discoveryv1alpha1 "k8s.io/api/discovery/v1alpha1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+)
+
+const externalManager = "external-controller.example.com"
+
+func externalEndpointSlice(name, svcName, namespace, manager string, ips ...string) *discoveryv1alpha1.EndpointSlice {
+	portName := "tcp-port"
+	var portNum int32 = 1001
+	return &discoveryv1alpha1.EndpointSlice{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				discoveryv1alpha1.LabelServiceName: svcName,
+				discoveryv1alpha1.LabelManagedBy:   manager,
+			},
+		},
+		Endpoints: []discoveryv1alpha1.Endpoint{{Addresses: ips}},
+		Ports:     []discoveryv1alpha1.EndpointPort{{Name: &portName, Port: &portNum}},
+	}
+}
+
+func edsAddresses(ev *XdsEvent) []string {
+	if ev == nil {
+		return nil
+	}
+	out := make([]string, 0, len(ev.Endpoints))
+	for _, ep := range ev.Endpoints {
+		out = append(out, ep.Address)
+	}
+	return out
+}
+
+func TestExternalEndpointSlicesOnly(t *testing.T) {
+	controller, fx := newFakeHarness(t, Options{
+		ClusterID:                     "cluster1",
+		EndpointMode:                  EndpointsOnly,
+		ExternalEndpointSliceManagers: []string{externalManager},
+	})
+	defer controller.Stop()
+
+	hostname := kube.ServiceHostname("svc1", "nsA", domainSuffix)
+	do(t, controller, func() {
+		createService(controller.Controller, "svc1", "nsA", nil, []int32{8080}, nil, t)
+	})
+
+	fx.Clear()
+	slices := controller.Client.DiscoveryV1alpha1().EndpointSlices("nsA")
+	do(t, controller, func() {
+		if _, err := slices.Create(context.TODO(),
+			externalEndpointSlice("svc1-ext", "svc1", "nsA", externalManager, "10.10.0.1", "10.10.0.2"), metaV1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	ev := fx.Wait("eds")
+	if got := edsAddresses(ev); ev == nil || ev.ID != string(hostname) || len(got) != 2 || got[0] != "10.10.0.1" || got[1] != "10.10.0.2" {
+		t.Fatalf("expected the endpoints of the external slice, got %+v", ev)
+	}
+	instances, err := controller.InstancesByPort(controller.servicesMap[hostname], 8080, nil)
+	if err != nil || len(instances) != 2 {
+		t.Fatalf("expected the instances of the external slice, got %v, %v", instances, err)
+	}
+
+	// The slices of other managers are ignored.
+	do(t, controller, func() {
+		if _, err := slices.Create(context.TODO(),
+			externalEndpointSlice("svc1-other", "svc1", "nsA", "other.example.com", "10.10.0.3"), metaV1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if got, err := controller.EndpointsForService(hostname); err != nil || len(got) != 2 {
+		t.Fatalf("expected the slice of another manager to be ignored, got %v, %v", got, err)
+	}
+
+	do(t, controller, func() {
+		if err := slices.Delete(context.TODO(), "svc1-ext", metaV1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	// The updater is not notified of empty EDS updates.
+	if got, err := controller.EndpointsForService(hostname); err != nil || len(got) != 0 {
+		t.Fatalf("expected the endpoints to be cleared with the external slice, got %v, %v", got, err)
+	}
+}
+
+func TestExternalEndpointSlicesMerge(t *testing.T) {
+	controller, fx := newFakeHarness(t, Options{
+		ClusterID:                     "cluster1",
+		EndpointMode:                  EndpointsOnly,
+		ExternalEndpointSliceManagers: []string{externalManager},
+	})
+	defer controller.Stop()
+
+	hostname := kube.ServiceHostname("svc1", "nsA", domainSuffix)
+	selector := map[string]string{"app": "a"}
+	addPodsSync(t, controller, generatePod("128.0.0.1", "pod1", "nsA", "", "", selector, nil))
+	do(t, controller, func() {
+		createService(controller.Controller, "svc1", "nsA", nil, []int32{8080}, selector, t)
+	})
+	slices := controller.Client.DiscoveryV1alpha1().EndpointSlices("nsA")
+	// The slices are created in reverse order of their names.
+	for _, slice := range []*discoveryv1alpha1.EndpointSlice{
+		externalEndpointSlice("svc1-b", "svc1", "nsA", externalManager, "10.10.0.2"),
+		externalEndpointSlice("svc1-a", "svc1", "nsA", externalManager, "128.0.0.1", "10.10.0.1"),
+	} {
+		slice := slice
+		do(t, controller, func() {
+			if _, err := slices.Create(context.TODO(), slice, metaV1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	fx.Clear()
+	// Only the Endpoints are written: createEndpoints also writes an EndpointSlice, whose event
+	// could be the only one handled by do.
+	endpoints := &coreV1.Endpoints{
+		ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA"},
+		Subsets: []coreV1.EndpointSubset{{
+			Addresses: []coreV1.EndpointAddress{{IP: "128.0.0.1"}},
+			Ports:     []coreV1.EndpointPort{{Name: "tcp-port", Port: 1001}},
+		}},
+	}
+	do(t, controller, func() {
+		if _, err := controller.Client.CoreV1().Endpoints("nsA").Create(context.TODO(), endpoints, metaV1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	expectAddresses := func(want ...string) {
+		t.Helper()
+		ev := fx.Wait("eds")
+		got := edsAddresses(ev)
+		if ev == nil || ev.ID != string(hostname) || len(got) != len(want) {
+			t.Fatalf("expected an EDS update of %s with %v, got %+v", hostname, want, ev)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("expected an EDS update of %s with %v, got %v", hostname, want, got)
+			}
+		}
+	}
+	// The endpoints of the Endpoints come first, the external endpoints at the same address and
+	// port are left out, the others follow in the order of the slice names.
+	expectAddresses("128.0.0.1", "10.10.0.1", "10.10.0.2")
+	instances, err := controller.InstancesByPort(controller.servicesMap[hostname], 8080, nil)
+	if err != nil || len(instances) != 3 {
+		t.Fatalf("expected the merged instances, got %v, %v", instances, err)
+	}
+
+	// The external endpoints remain without the Endpoints.
+	fx.Clear()
+	do(t, controller, func() {
+		if err := controller.Client.CoreV1().Endpoints("nsA").Delete(context.TODO(), "svc1", metaV1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	expectAddresses("128.0.0.1", "10.10.0.1", "10.10.0.2")
+
+	fx.Clear()
+	controller.ForeignServiceInstanceHandler(&model.ServiceInstance{
+		Service: &model.Service{
+			Hostname:   "se.example.com",
+			Attributes: model.ServiceAttributes{Name: "se", Namespace: "nsA"},
+		},
+		Endpoint: &model.IstioEndpoint{
+			Labels:       selector,
+			Address:      "192.168.0.1",
+			EndpointPort: 8080,
+		},
+	}, model.EventAdd)
+	expectAddresses("128.0.0.1", "10.10.0.1", "10.10.0.2", "192.168.0.1")
+}
@@ -0,0 +1,136 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sort"
+	"sync/atomic"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+	"istio.io/pkg/log"
+)
+
+// setLocalGatewayLocked records whether the node port gateway has the Local external traffic
+// policy. The caller holds the controller lock.
+func (c *Controller) setLocalGatewayLocked(hostname host.Name, local bool) {
+	if local {
+		c.gateways.local[hostname] = struct{}{}
+	} else {
+		delete(c.gateways.local, hostname)
+	}
+	atomic.StoreInt32(&c.gateways.localCount, int32(len(c.gateways.local)))
+}
+
+// hasLocalGateways reports whether a node port gateway has the Local external traffic policy. It
+// does not take the controller lock, so that the pod handlers can call it under the pod cache lock.
+func (c *Controller) hasLocalGateways() bool {
+	return c != nil && atomic.LoadInt32(&c.gateways.localCount) > 0
+}
+
+// localGatewayAddressesLocked returns the addresses of the nodes selected by the gateway that host
+// one of its ready pods: with the Local external traffic policy, the other nodes drop the traffic
+// sent to the node port rather than forwarding it. The caller holds the controller lock.
+func (c *Controller) localGatewayAddressesLocked(hostname host.Name) []string {
+	svc := c.servicesMap[hostname]
+	if svc == nil || len(svc.Attributes.LabelSelectors) == 0 {
+		// The pods of a service without selector are unknown, all the selected nodes are kept.
+		return c.gatewayNodeAddressesLocked(hostname)
+	}
+	nodes := c.readyPodNodes(svc.Attributes.Namespace, svc.Attributes.LabelSelectors)
+	var addresses []string
+	for name := range c.gateways.nodesByGateway[hostname] {
+		if _, f := nodes[name]; f {
+			addresses = append(addresses, c.nodeInfoMap[name].address)
+		}
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// readyPodNodes returns the names of the nodes hosting a ready pod of the namespace matching the
+// selector.
+func (c *Controller) readyPodNodes(namespace string, selector labels.Instance) map[string]struct{} {
+	nodes := make(map[string]struct{})
+	if c.pods == nil {
+		return nodes
+	}
+	items, err := c.pods.informer.GetIndexer().ByIndex(cache.NamespaceIndex, namespace)
+	if err != nil {
+		log.Warnf("Failed to list the pods of namespace %s: %v", namespace, err)
+		return nodes
+	}
+	for _, item := range items {
+		pod, ok := item.(*v1.Pod)
+		if !ok || pod.Spec.NodeName == "" || !isPodReady(pod) || !selector.SubsetOf(pod.Labels) {
+			continue
+		}
+		nodes[pod.Spec.NodeName] = struct{}{}
+	}
+	return nodes
+}
+
+// isPodReady reports whether the pod is running, not being deleted, and has the Ready condition.
+func isPodReady(pod *v1.Pod) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.Phase != v1.PodRunning {
+		return false
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == v1.PodReady {
+			return cond.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// localGatewayUpdate queues the update of the addresses of the Local gateways of the namespace of
+// the pod, as the pod may have started or stopped being a ready gateway pod. It is queued because
+// the pod cache lock is held, under which the controller lock must not be taken.
+func (pc *PodCache) localGatewayUpdate(pod *v1.Pod) {
+	if !pc.c.hasLocalGateways() || pc.c.queue == nil {
+		return
+	}
+	pc.c.queue.Push(func() error {
+		pc.c.updateLocalGateways(pod.Namespace)
+		return nil
+	})
+}
+
+// updateLocalGateways updates the addresses of the Local gateways of the namespace, pushing those
+// whose addresses changed.
+func (c *Controller) updateLocalGateways(namespace string) {
+	c.RLock()
+	var svcs []*model.Service
+	for hostname := range c.gateways.local {
+		if svc := c.servicesMap[hostname]; svc != nil && svc.Attributes.Namespace == namespace {
+			svcs = append(svcs, svc)
+		}
+	}
+	c.RUnlock()
+	if len(svcs) == 0 {
+		return
+	}
+	if changed := c.updateServiceExternalAddr(svcs...); len(changed) > 0 {
+		c.xdsUpdater.ConfigUpdate(&model.PushRequest{
+			Full:           true,
+			ConfigsUpdated: changed,
+			Reason:         []model.TriggerReason{model.ServiceUpdate},
+		})
+	}
+}
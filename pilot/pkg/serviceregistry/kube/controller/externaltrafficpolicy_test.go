@@ -0,0 +1,177 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+)
+
+// readyGatewayPod returns a pod of the gateway on the node, with the Ready condition set to ready.
+func readyGatewayPod(ip, name, node string, ready bool) *coreV1.Pod {
+	pod := generatePod(ip, name, "nsA", "", node, map[string]string{"app": "gateway"}, nil)
+	status := coreV1.ConditionFalse
+	if ready {
+		status = coreV1.ConditionTrue
+	}
+	pod.Status.Conditions = []coreV1.PodCondition{{Type: coreV1.PodReady, Status: status}}
+	return pod
+}
+
+func TestLocalExternalTrafficPolicy(t *testing.T) {
+	const clusterID = "cluster1"
+	controller, fx := newFakeHarness(t, Options{ClusterID: clusterID})
+	defer controller.Stop()
+
+	for i := 1; i <= 5; i++ {
+		node := &coreV1.Node{
+			ObjectMeta: metaV1.ObjectMeta{Name: fmt.Sprintf("node%d", i), Labels: map[string]string{"pool": "gateway"}},
+			Status: coreV1.NodeStatus{
+				Addresses: []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: fmt.Sprintf("10.0.1.%d", i)}},
+			},
+		}
+		do(t, controller, func() {
+			if _, err := controller.Client.CoreV1().Nodes().Create(context.TODO(), node, metaV1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	// The gateway runs on 2 of the 5 nodes, a third pod is not ready yet.
+	addPodsSync(t, controller,
+		readyGatewayPod("128.0.0.1", "gateway1", "node1", true),
+		readyGatewayPod("128.0.0.3", "gateway3", "node3", true),
+		readyGatewayPod("128.0.0.4", "gateway4", "node4", false))
+
+	svc := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:        "gateway",
+			Namespace:   "nsA",
+			Annotations: map[string]string{kube.NodeSelectorAnnotation: `{"pool": "gateway"}`},
+		},
+		Spec: coreV1.ServiceSpec{
+			Type:                  coreV1.ServiceTypeNodePort,
+			ClusterIP:             "10.0.0.1",
+			Selector:              map[string]string{"app": "gateway"},
+			ExternalTrafficPolicy: coreV1.ServiceExternalTrafficPolicyTypeLocal,
+			SessionAffinity:       coreV1.ServiceAffinityClientIP,
+			Ports:                 []coreV1.ServicePort{{Name: "tcp-port", Port: 8080, NodePort: 30080}},
+		},
+	}
+	do(t, controller, func() {
+		if _, err := controller.Client.CoreV1().Services("nsA").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	hostname := kube.ServiceHostname("gateway", "nsA", domainSuffix)
+	addresses := func() []string {
+		t.Helper()
+		converted, _ := controller.GetService(hostname)
+		if converted == nil {
+			t.Fatal("service not found")
+		}
+		converted.Mutex.RLock()
+		defer converted.Mutex.RUnlock()
+		if !converted.Attributes.ExternalTrafficPolicyLocal || !converted.Attributes.SessionAffinityClientIP {
+			t.Fatalf("expected the policies of the service, got %+v", converted.Attributes)
+		}
+		return converted.Attributes.ClusterExternalAddresses[clusterID]
+	}
+	if got, want := addresses(), []string{"10.0.1.1", "10.0.1.3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got external addresses %v, want %v", got, want)
+	}
+
+	// The node of a pod becoming ready is added, and the gateway pushed.
+	fx.Clear()
+	pod := readyGatewayPod("128.0.0.4", "gateway4", "node4", true)
+	pod.Status.Phase = coreV1.PodRunning
+	do(t, controller, func() {
+		if _, err := controller.Client.CoreV1().Pods("nsA").UpdateStatus(context.TODO(), pod, metaV1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if got, want := addresses(), []string{"10.0.1.1", "10.0.1.3", "10.0.1.4"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got external addresses %v, want %v", got, want)
+	}
+	if ev := fx.Wait("xds"); ev == nil || len(ev.ConfigsUpdated) != 1 {
+		t.Fatalf("expected a push of the gateway, got %+v", ev)
+	}
+
+	// The node of a deleted pod is removed.
+	do(t, controller, func() {
+		if err := controller.Client.CoreV1().Pods("nsA").Delete(context.TODO(), "gateway1", metaV1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if got, want := addresses(), []string{"10.0.1.3", "10.0.1.4"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got external addresses %v, want %v", got, want)
+	}
+}
+
+func TestClusterExternalTrafficPolicy(t *testing.T) {
+	const clusterID = "cluster1"
+	controller, _ := newFakeHarness(t, Options{ClusterID: clusterID})
+	defer controller.Stop()
+
+	for i := 1; i <= 2; i++ {
+		node := &coreV1.Node{
+			ObjectMeta: metaV1.ObjectMeta{Name: fmt.Sprintf("node%d", i)},
+			Status: coreV1.NodeStatus{
+				Addresses: []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: fmt.Sprintf("10.0.1.%d", i)}},
+			},
+		}
+		do(t, controller, func() {
+			if _, err := controller.Client.CoreV1().Nodes().Create(context.TODO(), node, metaV1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	addPodsSync(t, controller, readyGatewayPod("128.0.0.1", "gateway1", "node1", true))
+	do(t, controller, func() {
+		svc := &coreV1.Service{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name:        "gateway",
+				Namespace:   "nsA",
+				Annotations: map[string]string{kube.NodeSelectorAnnotation: "{}"},
+			},
+			Spec: coreV1.ServiceSpec{
+				Type:      coreV1.ServiceTypeNodePort,
+				ClusterIP: "10.0.0.1",
+				Selector:  map[string]string{"app": "gateway"},
+				Ports:     []coreV1.ServicePort{{Name: "tcp-port", Port: 8080, NodePort: 30080}},
+			},
+		}
+		if _, err := controller.Client.CoreV1().Services("nsA").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	// Every node forwards the traffic to the gateway pods.
+	converted, _ := controller.GetService(kube.ServiceHostname("gateway", "nsA", domainSuffix))
+	if converted == nil {
+		t.Fatal("service not found")
+	}
+	if got, want := converted.Attributes.ClusterExternalAddresses[clusterID], []string{"10.0.1.1", "10.0.1.2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got external addresses %v, want %v", got, want)
+	}
+	if controller.hasLocalGateways() {
+		t.Fatal("expected no Local gateway")
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/metric/metricproducer"
+
+	"istio.io/pkg/log"
+
+	"istio.io/istio/pkg/queue"
+)
+
+// queueNamespaceBacklogName is the metric of the tasks waiting in the fair controller queues. The
+// gauges of istio.io/pkg/monitoring keep a series once it is recorded, and each short-lived
+// namespace would leave one behind: the backlog is read from the running queues when the metrics
+// are exported instead, so that only the namespaces with tasks queued have a series.
+const queueNamespaceBacklogName = "pilot_k8s_queue_namespace_backlog"
+
+// queueBacklogs are the running fair queues, exported by Read.
+var queueBacklogs = &fairQueueBacklogs{queues: make(map[*fairQueue]struct{})}
+
+func init() {
+	metricproducer.GlobalManager().AddProducer(queueBacklogs)
+}
+
+// fairQueueBacklogs is the metric producer of the backlog of the running fair queues.
+type fairQueueBacklogs struct {
+	mu     sync.Mutex
+	queues map[*fairQueue]struct{}
+}
+
+func (b *fairQueueBacklogs) add(q *fairQueue) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.queues[q] = struct{}{}
+}
+
+func (b *fairQueueBacklogs) remove(q *fairQueue) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.queues, q)
+}
+
+// Read returns the tasks waiting in each namespace with tasks, by cluster. Cluster scoped tasks
+// have no namespace.
+func (b *fairQueueBacklogs) Read() []*metricdata.Metric {
+	now := time.Now()
+	var series []*metricdata.TimeSeries
+	b.mu.Lock()
+	for q := range b.queues {
+		q.cond.L.Lock()
+		for namespace, tasks := range q.tasks {
+			series = append(series, &metricdata.TimeSeries{
+				LabelValues: []metricdata.LabelValue{metricdata.NewLabelValue(q.clusterID), metricdata.NewLabelValue(namespace)},
+				Points:      []metricdata.Point{metricdata.NewInt64Point(now, int64(len(tasks)))},
+			})
+		}
+		q.cond.L.Unlock()
+	}
+	b.mu.Unlock()
+	sort.Slice(series, func(i, j int) bool {
+		x, y := series[i].LabelValues, series[j].LabelValues
+		if x[0].Value != y[0].Value {
+			return x[0].Value < y[0].Value
+		}
+		return x[1].Value < y[1].Value
+	})
+	return []*metricdata.Metric{{
+		Descriptor: metricdata.Descriptor{
+			Name:        queueNamespaceBacklogName,
+			Description: "Tasks waiting in the fair controller queue, by cluster and namespace. Cluster scoped tasks have no namespace.",
+			Unit:        metricdata.UnitDimensionless,
+			Type:        metricdata.TypeGaugeInt64,
+			LabelKeys:   []metricdata.LabelKey{{Key: "cluster"}, {Key: "namespace"}},
+		},
+		TimeSeries: series,
+	}}
+}
+
+// namespacedQueue is a queue that is told the namespace of the tasks it schedules.
+type namespacedQueue interface {
+	queue.Instance
+	// PushNamespaced pushes a task handling an object of the namespace.
+	PushNamespaced(namespace string, task queue.Task)
+	// PushBarrier pushes a task handled once the tasks pushed before it, of every namespace, are.
+	PushBarrier(task queue.Task)
+}
+
+// fairQueue keeps a queue of tasks per namespace and takes one task of each namespace in turn, so
+// that a namespace with many events cannot delay those of the others. Tasks are only ordered
+// within their namespace, tasks pushed without a namespace are ordered among themselves.
+type fairQueue struct {
+	delay     time.Duration
+	clock     Clock
+	clusterID string
+
+	cond  *sync.Cond
+	tasks map[string][]queue.Task
+	// ready lists the namespaces with tasks, in the order they get their next turn.
+	ready   []string
+	closing bool
+}
+
+var _ namespacedQueue = &fairQueue{}
+
+func newFairQueue(errorDelay time.Duration, clock Clock, clusterID string) *fairQueue {
+	return &fairQueue{
+		delay:     errorDelay,
+		clock:     clock,
+		clusterID: clusterID,
+		cond:      sync.NewCond(&sync.Mutex{}),
+		tasks:     make(map[string][]queue.Task),
+	}
+}
+
+// Push pushes a task that is not specific to a namespace.
+func (q *fairQueue) Push(task queue.Task) {
+	q.PushNamespaced("", task)
+}
+
+func (q *fairQueue) PushNamespaced(namespace string, task queue.Task) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if q.closing {
+		return
+	}
+	pending := q.tasks[namespace]
+	if len(pending) == 0 {
+		q.ready = append(q.ready, namespace)
+	}
+	q.tasks[namespace] = append(pending, task)
+	q.cond.Signal()
+}
+
+// PushBarrier pushes a marker behind the tasks of every namespace with tasks, and of the tasks
+// without namespace. The task is handled by the last marker reached, and is retried by it on error.
+func (q *fairQueue) PushBarrier(task queue.Task) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if q.closing {
+		return
+	}
+	namespaces := []string{""}
+	for namespace := range q.tasks {
+		if namespace != "" {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	// The tasks are handled one at a time, by Run.
+	remaining := len(namespaces)
+	marker := func() error {
+		remaining--
+		if remaining > 0 {
+			return nil
+		}
+		return task()
+	}
+	for _, namespace := range namespaces {
+		pending := q.tasks[namespace]
+		if len(pending) == 0 {
+			q.ready = append(q.ready, namespace)
+		}
+		q.tasks[namespace] = append(pending, marker)
+	}
+	q.cond.Signal()
+}
+
+// Run handles the tasks until the stop channel is closed, then handles the remaining tasks and
+// returns. Failed tasks are pushed again to their namespace after the error delay.
+func (q *fairQueue) Run(stop <-chan struct{}) {
+	queueBacklogs.add(q)
+	defer queueBacklogs.remove(q)
+	go func() {
+		<-stop
+		q.cond.L.Lock()
+		q.closing = true
+		q.cond.Signal()
+		q.cond.L.Unlock()
+	}()
+
+	for {
+		q.cond.L.Lock()
+		for !q.closing && len(q.ready) == 0 {
+			q.cond.Wait()
+		}
+		if len(q.ready) == 0 {
+			q.cond.L.Unlock()
+			// We must be shutting down.
+			return
+		}
+
+		namespace := q.ready[0]
+		q.ready = q.ready[1:]
+		pending := q.tasks[namespace]
+		task := pending[0]
+		if len(pending) > 1 {
+			q.tasks[namespace] = pending[1:]
+			q.ready = append(q.ready, namespace)
+		} else {
+			delete(q.tasks, namespace)
+		}
+		q.cond.L.Unlock()
+
+		if err := task(); err != nil {
+			log.Infof("Work item of namespace %q handle failed (%v), retry after delay %v", namespace, err, q.delay)
+			q.clock.AfterFunc(q.delay, func() {
+				q.PushNamespaced(namespace, task)
+			})
+		}
+	}
+}
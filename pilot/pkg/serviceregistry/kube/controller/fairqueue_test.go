@@ -0,0 +1,264 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+func TestFairQueueFlood(t *testing.T) {
+	q := newFairQueue(time.Millisecond, realClock{}, "")
+	stop := make(chan struct{})
+	defer close(stop)
+	go q.Run(stop)
+
+	// The flood takes a second to handle in order.
+	const flood = 1000
+	for i := 0; i < flood; i++ {
+		q.PushNamespaced("nsA", func() error {
+			time.Sleep(time.Millisecond)
+			return nil
+		})
+	}
+	pushed := time.Now()
+	done := make(chan time.Duration, 1)
+	q.PushNamespaced("nsB", func() error {
+		done <- time.Since(pushed)
+		return nil
+	})
+
+	select {
+	case delay := <-done:
+		if delay > 200*time.Millisecond {
+			t.Fatalf("the task of nsB was delayed by %v", delay)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the task of nsB")
+	}
+}
+
+func TestFairQueueOrder(t *testing.T) {
+	q := newFairQueue(time.Millisecond, realClock{}, "")
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) func() error {
+		return func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, name)
+			return nil
+		}
+	}
+	for _, name := range []string{"a1", "a2", "a3"} {
+		q.PushNamespaced("nsA", record(name))
+	}
+	q.PushNamespaced("nsB", record("b1"))
+	q.Push(record("c1"))
+	failed := false
+	q.PushNamespaced("nsB", func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !failed {
+			failed = true
+			return errors.New("retry")
+		}
+		order = append(order, "b2")
+		return nil
+	})
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		q.Run(stop)
+		close(done)
+	}()
+	want := []string{"a1", "b1", "c1", "a2", "a3", "b2"}
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		mu.Lock()
+		got := append([]string{}, order...)
+		mu.Unlock()
+		if reflect.DeepEqual(got, want) {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("got order %v, want %v", got, want)
+		}
+	}
+
+	// Tasks queued when stopping are handled before Run returns.
+	q.PushNamespaced("nsA", record("a4"))
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the queue to stop")
+	}
+	if got := order[len(order)-1]; got != "a4" {
+		t.Fatalf("expected the queued task to be handled, got order %v", order)
+	}
+}
+
+func TestFairQueueBarrier(t *testing.T) {
+	q := newFairQueue(time.Millisecond, realClock{}, "")
+	stop := make(chan struct{})
+	defer close(stop)
+
+	var mu sync.Mutex
+	handled := map[string]int{}
+	for i := 0; i < 100; i++ {
+		q.PushNamespaced("nsA", func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			handled["nsA"]++
+			return nil
+		})
+	}
+	q.PushNamespaced("nsB", func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		handled["nsB"]++
+		return nil
+	})
+	q.Push(func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		handled[""]++
+		return nil
+	})
+	failed := false
+	done := make(chan map[string]int, 1)
+	q.PushBarrier(func() error {
+		if !failed {
+			// Retried like any task.
+			failed = true
+			return errors.New("barrier failed")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		seen := map[string]int{}
+		for namespace, n := range handled {
+			seen[namespace] = n
+		}
+		done <- seen
+		return nil
+	})
+	go q.Run(stop)
+
+	select {
+	case seen := <-done:
+		if want := map[string]int{"nsA": 100, "nsB": 1, "": 1}; !reflect.DeepEqual(seen, want) {
+			t.Fatalf("the barrier was handled after %v, want %v", seen, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the barrier")
+	}
+}
+
+// queueBacklog returns the backlog of each namespace of the cluster exported by queueBacklogs.
+func queueBacklog(t *testing.T, clusterID string) map[string]int64 {
+	t.Helper()
+	out := map[string]int64{}
+	for _, metric := range queueBacklogs.Read() {
+		if metric.Descriptor.Name != queueNamespaceBacklogName {
+			t.Fatalf("unexpected metric %s", metric.Descriptor.Name)
+		}
+		for _, ts := range metric.TimeSeries {
+			if ts.LabelValues[0].Value == clusterID {
+				out[ts.LabelValues[1].Value] = ts.Points[0].Value.(int64)
+			}
+		}
+	}
+	return out
+}
+
+func TestFairQueueBacklog(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+	release := make(chan struct{})
+	blocked := make(chan struct{}, 2)
+	block := func() error {
+		blocked <- struct{}{}
+		<-release
+		return nil
+	}
+	noop := func() error { return nil }
+
+	// The queues of the clusters are exported apart, with the tasks waiting behind those being
+	// handled.
+	q1, q2 := newFairQueue(time.Millisecond, realClock{}, "backlog1"), newFairQueue(time.Millisecond, realClock{}, "backlog2")
+	q1.PushNamespaced("nsA", block)
+	q1.PushNamespaced("nsA", noop)
+	q1.PushNamespaced("nsA", noop)
+	q1.Push(noop)
+	q2.PushNamespaced("nsA", block)
+	q2.PushNamespaced("nsA", noop)
+	if got := queueBacklog(t, "backlog1"); len(got) != 0 {
+		t.Fatalf("got backlog %v of a queue not running, want none", got)
+	}
+	go q1.Run(stop)
+	go q2.Run(stop)
+	<-blocked
+	<-blocked
+	if got, want := queueBacklog(t, "backlog1"), map[string]int64{"nsA": 2, "": 1}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got backlog %v, want %v", got, want)
+	}
+	if got, want := queueBacklog(t, "backlog2"), map[string]int64{"nsA": 1}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got backlog %v, want %v", got, want)
+	}
+
+	// The namespaces without tasks have no series.
+	close(release)
+	retry.UntilSuccessOrFail(t, func() error {
+		for _, clusterID := range []string{"backlog1", "backlog2"} {
+			if got := queueBacklog(t, clusterID); len(got) != 0 {
+				return fmt.Errorf("got backlog %v of %s, want none", got, clusterID)
+			}
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+}
+
+func TestFairQueueController(t *testing.T) {
+	controller, fx := newFakeControllerWithOptions(fakeControllerOptions{fairQueueing: true})
+	defer controller.Stop()
+
+	if _, ok := controller.queue.(namespacedQueue); !ok {
+		t.Fatalf("expected a fair queue, got %T", controller.queue)
+	}
+	// The controller is only synced once the events of every namespace were handled.
+	select {
+	case <-controller.Synced():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the controller to sync")
+	}
+	if !controller.HasSynced() {
+		t.Fatal("expected the controller to have synced")
+	}
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	createService(controller, "svc1", "nsB", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+}
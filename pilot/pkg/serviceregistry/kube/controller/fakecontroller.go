@@ -0,0 +1,205 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	metafake "k8s.io/client-go/metadata/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/pkg/log"
+
+	"istio.io/istio/pkg/queue"
+)
+
+// fakeEventTimeout bounds the wait for the informers of a FakeController to deliver an event.
+const fakeEventTimeout = 5 * time.Second
+
+// eventObserver is implemented by queues told of every informer event delivered to the handlers
+// of the controller, including events coalesced into a task already queued.
+type eventObserver interface {
+	eventDelivered()
+}
+
+// syncQueue holds the tasks until they are run by flush, on the calling goroutine. Failed tasks
+// are pushed again after the error delay of the clock.
+type syncQueue struct {
+	delay time.Duration
+	clock Clock
+
+	cond      *sync.Cond
+	tasks     []queue.Task
+	delivered int
+}
+
+var _ eventObserver = &syncQueue{}
+
+func newSyncQueue(errorDelay time.Duration, clock Clock) *syncQueue {
+	return &syncQueue{
+		delay: errorDelay,
+		clock: clock,
+		cond:  sync.NewCond(&sync.Mutex{}),
+	}
+}
+
+func (q *syncQueue) Push(task queue.Task) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.tasks = append(q.tasks, task)
+	q.cond.Broadcast()
+}
+
+// Run only waits for the stop channel, the tasks are run by flush.
+func (q *syncQueue) Run(stop <-chan struct{}) {
+	<-stop
+}
+
+func (q *syncQueue) eventDelivered() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.delivered++
+	q.cond.Broadcast()
+}
+
+// flush runs the queued tasks, and those they push, until none is left.
+func (q *syncQueue) flush() {
+	for {
+		q.cond.L.Lock()
+		if len(q.tasks) == 0 {
+			q.cond.L.Unlock()
+			return
+		}
+		task := q.tasks[0]
+		q.tasks = q.tasks[1:]
+		q.cond.L.Unlock()
+
+		if err := task(); err != nil {
+			log.Infof("Work item handle failed (%v), retry after delay %v", err, q.delay)
+			q.clock.AfterFunc(q.delay, func() {
+				q.Push(task)
+			})
+		}
+	}
+}
+
+func (q *syncQueue) deliveredEvents() int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.delivered
+}
+
+// waitFor waits until done holds, or the timeout elapsed. done is called with the lock held.
+func (q *syncQueue) waitFor(done func() bool, timeout time.Duration) bool {
+	timedOut := false
+	timer := time.AfterFunc(timeout, func() {
+		q.cond.L.Lock()
+		defer q.cond.L.Unlock()
+		timedOut = true
+		q.cond.Broadcast()
+	})
+	defer timer.Stop()
+
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	for !done() {
+		if timedOut {
+			return false
+		}
+		q.cond.Wait()
+	}
+	return true
+}
+
+// FakeController is a controller on fake clients for tests. Its tasks are only handled by Flush,
+// on the calling goroutine, and its time only moves with its FakeClock, so that tests run the
+// controller step by step rather than waiting for it.
+type FakeController struct {
+	*Controller
+	Client         *fake.Clientset
+	MetadataClient *metafake.FakeMetadataClient
+	Clock          *FakeClock
+
+	queue *syncQueue
+}
+
+// NewFakeController creates a controller with the options on fake clients holding the objects,
+// runs it and handles the initial listing. options.Clock is replaced by the FakeClock of the
+// controller. The controller is stopped with Stop.
+func NewFakeController(options Options, objects ...runtime.Object) (*FakeController, error) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	options.Clock = clock
+	scheme := runtime.NewScheme()
+	if err := metav1.AddMetaToScheme(scheme); err != nil {
+		return nil, err
+	}
+	f := &FakeController{
+		Client:         fake.NewSimpleClientset(objects...),
+		MetadataClient: metafake.NewSimpleMetadataClient(scheme),
+		Clock:          clock,
+		queue:          newSyncQueue(time.Second, clock),
+	}
+	f.Controller = newController(f.Client, f.MetadataClient, options, f.queue)
+	f.stop = make(chan struct{})
+	go f.Run(f.stop)
+
+	// Run queues the task closing Synced behind the initial listing once the informers synced.
+	if !cache.WaitForCacheSync(f.stop, f.HasSynced) {
+		return nil, fmt.Errorf("informers of the fake controller did not sync")
+	}
+	for {
+		f.Flush()
+		select {
+		case <-f.Synced():
+			return f, nil
+		default:
+		}
+		if !f.queue.waitFor(func() bool { return len(f.queue.tasks) > 0 }, fakeEventTimeout) {
+			f.Stop()
+			return nil, fmt.Errorf("timeout waiting for the initial listing to be handled")
+		}
+	}
+}
+
+// Flush handles the queued tasks, and those they queue, on the calling goroutine.
+func (f *FakeController) Flush() {
+	f.queue.flush()
+}
+
+// Do makes a write to the fake clients, waits for an informer to deliver its event and handles
+// the resulting tasks. Writes that no informer of the controller watches time out.
+func (f *FakeController) Do(write func() error) error {
+	delivered := f.queue.deliveredEvents()
+	if err := write(); err != nil {
+		return err
+	}
+	if !f.queue.waitFor(func() bool { return f.queue.delivered > delivered }, fakeEventTimeout) {
+		return fmt.Errorf("timeout waiting for the event of the write")
+	}
+	f.Flush()
+	return nil
+}
+
+// Step moves the clock forward by d, making the calls due by then, such as debounced pushes and
+// retries, and handles the resulting tasks.
+func (f *FakeController) Step(d time.Duration) {
+	f.Clock.Step(d)
+	f.Flush()
+}
@@ -0,0 +1,140 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// newFakeHarness creates a FakeController on the test defaults of the options.
+func newFakeHarness(t *testing.T, options Options, objects ...runtime.Object) (*FakeController, *FakeXdsUpdater) {
+	t.Helper()
+	fx := NewFakeXDS()
+	options.DomainSuffix = domainSuffix
+	options.XDSUpdater = fx
+	options.Metrics = &model.Environment{}
+	controller, err := NewFakeController(options, objects...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return controller, fx
+}
+
+// do makes the writes to the fake clients and handles their events.
+func do(t *testing.T, controller *FakeController, write func()) {
+	t.Helper()
+	if err := controller.Do(func() error {
+		write()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addPodsSync is addPods with the events of the pod creation and status update handled.
+func addPodsSync(t *testing.T, controller *FakeController, pods ...*coreV1.Pod) {
+	t.Helper()
+	for _, pod := range pods {
+		var created *coreV1.Pod
+		// Pods are created without IP, the status update sets it.
+		do(t, controller, func() {
+			var err error
+			if created, err = controller.Client.CoreV1().Pods(pod.Namespace).Create(context.TODO(), pod, metaV1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		})
+		created.Status.PodIP = pod.Status.PodIP
+		created.Status.Phase = coreV1.PodRunning
+		created.Status.Conditions = pod.Status.Conditions
+		do(t, controller, func() {
+			if _, err := controller.Client.CoreV1().Pods(pod.Namespace).UpdateStatus(context.TODO(), created, metaV1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSyncQueueRetry(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	q := newSyncQueue(time.Second, clock)
+	attempts := 0
+	q.Push(func() error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("not yet")
+		}
+		return nil
+	})
+
+	q.flush()
+	if attempts != 1 {
+		t.Fatalf("got %d attempts, want 1", attempts)
+	}
+	// The retry waits for the error delay.
+	clock.Step(999 * time.Millisecond)
+	q.flush()
+	if attempts != 1 {
+		t.Fatalf("got %d attempts before the delay, want 1", attempts)
+	}
+	clock.Step(time.Millisecond)
+	q.flush()
+	clock.Step(time.Second)
+	q.flush()
+	if attempts != 3 || clock.PendingTimers() != 0 {
+		t.Fatalf("got %d attempts and %d pending retries, want 3 and none", attempts, clock.PendingTimers())
+	}
+}
+
+func TestFakeControllerEDSDebounce(t *testing.T) {
+	controller, fx := newFakeHarness(t, Options{EDSUpdateMinInterval: time.Second})
+	defer controller.Stop()
+
+	addPodsSync(t, controller,
+		generatePod("128.0.0.1", "pod1", "nsA", "", "", map[string]string{"app": "prod-app"}, nil),
+		generatePod("128.0.0.2", "pod2", "nsA", "", "", map[string]string{"app": "prod-app"}, nil))
+	do(t, controller, func() {
+		createService(controller.Controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	})
+	do(t, controller, func() {
+		createEndpoints(controller.Controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+	})
+	if ev := fx.Wait("eds"); ev == nil || len(ev.Endpoints) != 1 {
+		t.Fatalf("expected the first update to be pushed right away, got %v", ev)
+	}
+
+	// The next update is held back until the end of the interval.
+	fx.Clear()
+	do(t, controller, func() {
+		updateEndpoints(controller.Controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1", "128.0.0.2"}, t)
+	})
+	select {
+	case ev := <-fx.Events:
+		t.Fatalf("expected the update to be delayed, got %v", ev)
+	default:
+	}
+	controller.Step(time.Second)
+	if ev := fx.Wait("eds"); ev == nil || len(ev.Endpoints) != 2 {
+		t.Fatalf("expected the update at the end of the interval, got %v", ev)
+	}
+}
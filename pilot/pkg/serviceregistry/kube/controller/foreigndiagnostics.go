@@ -0,0 +1,142 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pkg/config/host"
+)
+
+const (
+	// ForeignPortNotFound is the reason for lookups of a port the service does not declare.
+	ForeignPortNotFound = "PortNotFound"
+	// ForeignNamespaceMismatch is the reason for lookups where no foreign instance is in the
+	// namespace of the service.
+	ForeignNamespaceMismatch = "NamespaceMismatch"
+	// ForeignSelectorMismatch is the reason for lookups where the foreign instances in the
+	// namespace of the service do not match its selector.
+	ForeignSelectorMismatch = "SelectorMismatch"
+
+	// foreignDiagnosticsInterval is the minimum interval between refreshes of the message of a
+	// diagnostic, repeated misses in between are only counted.
+	foreignDiagnosticsInterval = 10 * time.Second
+)
+
+var foreignInstanceMisses = monitoring.NewSum(
+	"pilot_k8s_foreign_instance_misses",
+	"Lookups of foreign instances for a service that found none although some exist, by reason.",
+	monitoring.WithLabels(reasonTag),
+)
+
+func init() {
+	monitoring.MustRegister(foreignInstanceMisses)
+}
+
+// ForeignInstancesDiagnostic describes why the foreign instances, such as workload entries, were
+// not selected for a service.
+type ForeignInstancesDiagnostic struct {
+	Hostname host.Name `json:"hostname"`
+	Port     int       `json:"port"`
+	Reason   string    `json:"reason"`
+	Message  string    `json:"message"`
+	// Count is the number of misses for the reason, LastSeen the time of the latest one.
+	Count    int64     `json:"count"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// foreignDiagnostics keeps the latest diagnostic of each reason per hostname. Nothing is recorded
+// for lookups that find instances.
+type foreignDiagnostics struct {
+	interval time.Duration
+	clock    Clock
+
+	mu     sync.Mutex
+	byHost map[host.Name]map[string]*ForeignInstancesDiagnostic
+}
+
+func newForeignDiagnostics(interval time.Duration, clock Clock) *foreignDiagnostics {
+	return &foreignDiagnostics{
+		interval: interval,
+		clock:    clock,
+		byHost:   make(map[host.Name]map[string]*ForeignInstancesDiagnostic),
+	}
+}
+
+// record counts a miss for the hostname. The message is only formatted when the diagnostic is new
+// or was last refreshed more than an interval ago.
+func (d *foreignDiagnostics) record(hostname host.Name, port int, reason, format string, args ...interface{}) {
+	foreignInstanceMisses.With(reasonTag.Value(reason)).Increment()
+
+	now := d.clock.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	reasons := d.byHost[hostname]
+	if reasons == nil {
+		reasons = make(map[string]*ForeignInstancesDiagnostic)
+		d.byHost[hostname] = reasons
+	}
+	diag := reasons[reason]
+	if diag == nil {
+		diag = &ForeignInstancesDiagnostic{Hostname: hostname, Reason: reason}
+		reasons[reason] = diag
+	} else if now.Sub(diag.LastSeen) < d.interval {
+		diag.Count++
+		diag.LastSeen = now
+		return
+	}
+	diag.Port = port
+	diag.Message = fmt.Sprintf(format, args...)
+	diag.Count++
+	diag.LastSeen = now
+	log.Debugf("no foreign instances for %s port %d (%s): %s", hostname, port, reason, diag.Message)
+}
+
+// clear drops the diagnostics of a deleted service.
+func (d *foreignDiagnostics) clear(hostname host.Name) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.byHost, hostname)
+}
+
+func (d *foreignDiagnostics) list() []ForeignInstancesDiagnostic {
+	d.mu.Lock()
+	out := make([]ForeignInstancesDiagnostic, 0, len(d.byHost))
+	for _, reasons := range d.byHost {
+		for _, diag := range reasons {
+			out = append(out, *diag)
+		}
+	}
+	d.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Hostname != out[j].Hostname {
+			return out[i].Hostname < out[j].Hostname
+		}
+		return out[i].Reason < out[j].Reason
+	})
+	return out
+}
+
+// ForeignInstancesDiagnostics returns why the foreign instances were not selected for services,
+// sorted by hostname and reason.
+func (c *Controller) ForeignInstancesDiagnostics() []ForeignInstancesDiagnostic {
+	return c.foreignDiagnostics.list()
+}
@@ -0,0 +1,126 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+	"istio.io/istio/pkg/config/protocol"
+)
+
+func foreignTestService(name, namespace string, selector map[string]string) *model.Service {
+	return &model.Service{
+		Hostname:   host.Name(name + "." + namespace + ".svc." + domainSuffix),
+		Ports:      model.PortList{{Name: "http", Port: 80, Protocol: protocol.HTTP}},
+		Resolution: model.ClientSideLB,
+		Attributes: model.ServiceAttributes{
+			ServiceRegistry: string(serviceregistry.Kubernetes),
+			Name:            name,
+			Namespace:       namespace,
+			LabelSelectors:  selector,
+		},
+	}
+}
+
+func TestForeignInstancesDiagnostics(t *testing.T) {
+	controller, _ := newFakeControllerWithOptions(fakeControllerOptions{})
+	defer controller.Stop()
+
+	controller.Lock()
+	controller.foreignRegistryInstancesByIP["1.1.1.1"] = &model.ServiceInstance{
+		Service:  &model.Service{Attributes: model.ServiceAttributes{Namespace: "nsA"}},
+		Endpoint: &model.IstioEndpoint{Address: "1.1.1.1", Labels: labels.Instance{"app": "vm"}},
+	}
+	controller.Unlock()
+
+	cases := []struct {
+		name   string
+		svc    *model.Service
+		port   int
+		reason string
+	}{
+		{
+			name:   "port not found",
+			svc:    foreignTestService("port", "nsA", map[string]string{"app": "vm"}),
+			port:   81,
+			reason: ForeignPortNotFound,
+		},
+		{
+			name:   "namespace mismatch",
+			svc:    foreignTestService("namespace", "nsB", map[string]string{"app": "vm"}),
+			port:   80,
+			reason: ForeignNamespaceMismatch,
+		},
+		{
+			name:   "selector mismatch",
+			svc:    foreignTestService("selector", "nsA", map[string]string{"app": "other"}),
+			port:   80,
+			reason: ForeignSelectorMismatch,
+		},
+		{
+			name: "found",
+			svc:  foreignTestService("found", "nsA", map[string]string{"app": "vm"}),
+			port: 80,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			instances, err := controller.InstancesByPort(tt.svc, tt.port, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []ForeignInstancesDiagnostic
+			for _, d := range controller.ForeignInstancesDiagnostics() {
+				if d.Hostname == tt.svc.Hostname {
+					got = append(got, d)
+				}
+			}
+			if tt.reason == "" {
+				if len(instances) != 1 || len(got) != 0 {
+					t.Fatalf("expected the foreign instance without diagnostics, got %v and %v", instances, got)
+				}
+				return
+			}
+			if len(instances) != 0 {
+				t.Fatalf("expected no instances, got %v", instances)
+			}
+			if len(got) != 1 || got[0].Reason != tt.reason || got[0].Count != 1 || got[0].Message == "" {
+				t.Fatalf("expected one %s diagnostic, got %+v", tt.reason, got)
+			}
+		})
+	}
+
+	// Repeated misses are counted without refreshing the message.
+	svc := foreignTestService("selector", "nsA", map[string]string{"app": "other"})
+	if _, err := controller.InstancesByPort(svc, 80, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range controller.ForeignInstancesDiagnostics() {
+		if d.Hostname == svc.Hostname && d.Count != 2 {
+			t.Fatalf("expected the repeated miss to be counted, got %+v", d)
+		}
+	}
+
+	controller.foreignDiagnostics.clear(svc.Hostname)
+	for _, d := range controller.ForeignInstancesDiagnostics() {
+		if d.Hostname == svc.Hostname {
+			t.Fatalf("expected the diagnostics of %s to be cleared, got %+v", svc.Hostname, d)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sort"
+
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+)
+
+// ForeignInstance is the state of a foreign instance, such as a workload entry, as of its last
+// event: the Kubernetes services selecting it and the endpoints built for it.
+type ForeignInstance struct {
+	Cluster   string                   `json:"cluster"`
+	Address   string                   `json:"address"`
+	Namespace string                   `json:"namespace"`
+	Labels    labels.Instance          `json:"labels"`
+	Services  []ForeignInstanceService `json:"services"`
+}
+
+// ForeignInstanceService is a service selecting a foreign instance, services are sorted by hostname. Endpoints are only built for
+// the registered services resolved by the proxies, headless services have none.
+type ForeignInstanceService struct {
+	Hostname   host.Name                 `json:"hostname"`
+	Registered bool                      `json:"registered"`
+	Endpoints  []ForeignInstanceEndpoint `json:"endpoints,omitempty"`
+}
+
+// ForeignInstanceEndpoint is an endpoint built for a foreign instance on a port of a service.
+type ForeignInstanceEndpoint struct {
+	ServicePort  int    `json:"servicePort"`
+	PortName     string `json:"portName"`
+	EndpointPort uint32 `json:"endpointPort"`
+}
+
+// setForeignInstance records the state of a foreign instance, or drops it if state is nil.
+func (c *Controller) setForeignInstance(address string, state *ForeignInstance) {
+	if state != nil {
+		sort.Slice(state.Services, func(i, j int) bool { return state.Services[i].Hostname < state.Services[j].Hostname })
+	}
+	c.Lock()
+	defer c.Unlock()
+	if state == nil {
+		delete(c.foreignInstances, address)
+		return
+	}
+	c.foreignInstances[address] = *state
+}
+
+// ForeignInstanceState returns the state of the foreign instance of the IP, and whether there is
+// one, to tell which services select a workload entry and what endpoints were built for it.
+func (c *Controller) ForeignInstanceState(ip string) (ForeignInstance, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	state, f := c.foreignInstances[ip]
+	return state, f
+}
+
+// ForeignInstances returns the state of the foreign instances, sorted by address.
+func (c *Controller) ForeignInstances() []ForeignInstance {
+	c.RLock()
+	out := make([]ForeignInstance, 0, len(c.foreignInstances))
+	for _, state := range c.foreignInstances {
+		out = append(out, state)
+	}
+	c.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Address < out[j].Address })
+	return out
+}
@@ -0,0 +1,81 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/labels"
+)
+
+func TestForeignInstanceState(t *testing.T) {
+	controller, _ := newFakeHarness(t, Options{ClusterID: "cluster1"})
+	defer controller.Stop()
+
+	selector := map[string]string{"app": "vm"}
+	do(t, controller, func() {
+		createService(controller.Controller, "svc1", "nsA", nil, []int32{8080}, selector, t)
+	})
+	do(t, controller, func() {
+		createService(controller.Controller, "svc2", "nsA", nil, []int32{9090}, selector, t)
+	})
+	do(t, controller, func() {
+		createService(controller.Controller, "other", "nsA", nil, []int32{7070}, map[string]string{"app": "other"}, t)
+	})
+
+	entry := &model.ServiceInstance{
+		Service: &model.Service{Attributes: model.ServiceAttributes{Namespace: "nsA"}},
+		Endpoint: &model.IstioEndpoint{
+			Labels:       labels.Instance{"app": "vm"},
+			Address:      "2.2.2.2",
+			EndpointPort: 8080,
+		},
+	}
+	controller.ForeignServiceInstanceHandler(entry, model.EventAdd)
+
+	want := ForeignInstance{
+		Cluster:   "cluster1",
+		Address:   "2.2.2.2",
+		Namespace: "nsA",
+		Labels:    labels.Instance{"app": "vm"},
+		Services: []ForeignInstanceService{
+			{
+				Hostname:   kube.ServiceHostname("svc1", "nsA", domainSuffix),
+				Registered: true,
+				Endpoints:  []ForeignInstanceEndpoint{{ServicePort: 8080, PortName: "tcp-port", EndpointPort: 8080}},
+			},
+			{
+				Hostname:   kube.ServiceHostname("svc2", "nsA", domainSuffix),
+				Registered: true,
+				Endpoints:  []ForeignInstanceEndpoint{{ServicePort: 9090, PortName: "tcp-port", EndpointPort: 9090}},
+			},
+		},
+	}
+	got, f := controller.ForeignInstanceState("2.2.2.2")
+	if !f || !reflect.DeepEqual(got, want) {
+		t.Fatalf("got state %+v (found %v), want %+v", got, f, want)
+	}
+	if all := controller.ForeignInstances(); !reflect.DeepEqual(all, []ForeignInstance{want}) {
+		t.Fatalf("got states %+v, want %+v", all, []ForeignInstance{want})
+	}
+
+	controller.ForeignServiceInstanceHandler(entry, model.EventDelete)
+	if _, f := controller.ForeignInstanceState("2.2.2.2"); f {
+		t.Fatal("expected the state of the deleted instance to be dropped")
+	}
+}
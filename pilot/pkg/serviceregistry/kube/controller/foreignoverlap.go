@@ -0,0 +1,63 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+var foreignPodOverlaps = monitoring.NewSum(
+	"pilot_k8s_foreign_pod_overlaps",
+	"Foreign instances selected for a service at the IP of a pod of the cluster on the same network.",
+	monitoring.WithLabels(clusterTag),
+)
+
+func init() {
+	monitoring.MustRegister(foreignPodOverlaps)
+}
+
+// overlapsPod reports whether the foreign endpoint is at the IP of a pod of the cluster, on the
+// same network. Both then name the same workload, or the pod CIDRs of clusters sharing a network
+// overlap, which the proxies cannot route.
+func (c *Controller) overlapsPod(ep *model.IstioEndpoint) bool {
+	if c.pods.getPodByIP(ep.Address) == nil {
+		return false
+	}
+	return c.endpointNetwork(ep.Address) == ep.Network
+}
+
+// filterForeignPodOverlaps counts the foreign instances of the service overlapping a pod, dropping
+// them with Options.DropForeignPodOverlaps: the endpoints of the pod are built from Kubernetes. It
+// must not be called with the controller lock held.
+func (c *Controller) filterForeignPodOverlaps(svc *model.Service, instances []*model.ServiceInstance) []*model.ServiceInstance {
+	out := instances[:0]
+	for _, si := range instances {
+		if !c.overlapsPod(si.Endpoint) {
+			out = append(out, si)
+			continue
+		}
+		foreignPodOverlaps.With(clusterTag.Value(c.clusterID)).Increment()
+		if !c.endpointOptions.dropForeignPodOverlaps {
+			out = append(out, si)
+			continue
+		}
+		log.Debugf("dropping foreign instance %s of %s, a pod of cluster %s has its address",
+			si.Endpoint.Address, svc.Hostname, c.clusterID)
+	}
+	return out
+}
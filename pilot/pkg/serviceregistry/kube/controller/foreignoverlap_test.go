@@ -0,0 +1,83 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/labels"
+)
+
+func TestDropForeignPodOverlaps(t *testing.T) {
+	cases := []struct {
+		name     string
+		drop     bool
+		network  string
+		want     []string
+		overlaps float64
+	}{
+		{"kept by default", false, "", []string{"128.0.0.1", "128.0.0.1", "2.2.2.2"}, 1},
+		{"dropped", true, "", []string{"128.0.0.1", "2.2.2.2"}, 1},
+		{"other network", true, "vm-network", []string{"128.0.0.1", "128.0.0.1", "2.2.2.2"}, 0},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			controller, _ := newFakeHarness(t, Options{ClusterID: "cluster1", DropForeignPodOverlaps: tt.drop})
+			defer controller.Stop()
+
+			selector := map[string]string{"app": "prod-app"}
+			addPodsSync(t, controller, generatePod("128.0.0.1", "pod1", "nsA", "", "", selector, nil))
+			do(t, controller, func() {
+				createService(controller.Controller, "svc1", "nsA", nil, []int32{8080}, selector, t)
+			})
+			do(t, controller, func() {
+				createEndpoints(controller.Controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+			})
+			// A workload entry at the IP of the pod, and another one.
+			for _, address := range []string{"128.0.0.1", "2.2.2.2"} {
+				controller.ForeignServiceInstanceHandler(&model.ServiceInstance{
+					Service: &model.Service{Attributes: model.ServiceAttributes{Namespace: "nsA"}},
+					Endpoint: &model.IstioEndpoint{
+						Labels:  labels.Instance(selector),
+						Address: address,
+						Network: tt.network,
+					},
+				}, model.EventAdd)
+			}
+
+			overlaps := sumValue(t, "pilot_k8s_foreign_pod_overlaps", map[string]string{"cluster": "cluster1"})
+			svc, _ := controller.GetService(kube.ServiceHostname("svc1", "nsA", domainSuffix))
+			instances, err := controller.InstancesByPort(svc, 8080, labels.Collection{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, instance := range instances {
+				got = append(got, instance.Endpoint.Address)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got instances %v, want %v", got, tt.want)
+			}
+			if v := sumValue(t, "pilot_k8s_foreign_pod_overlaps", map[string]string{"cluster": "cluster1"}); v != overlaps+tt.overlaps {
+				t.Fatalf("got %v overlaps, want %v", v, overlaps+tt.overlaps)
+			}
+		})
+	}
+}
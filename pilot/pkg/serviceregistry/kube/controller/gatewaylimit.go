@@ -0,0 +1,124 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sync"
+
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pkg/config/host"
+)
+
+// DefaultMaxGatewayAddresses is the limit of the addresses of a node port gateway service when
+// Options.MaxGatewayAddresses is 0.
+const DefaultMaxGatewayAddresses = 50
+
+var (
+	gatewayAddresses = monitoring.NewGauge(
+		"pilot_k8s_gateway_addresses",
+		"External addresses published for each node port gateway service, after truncation to "+
+			"Options.MaxGatewayAddresses. Zero once the service is no longer a gateway.",
+		monitoring.WithLabels(clusterTag, hostnameTag),
+	)
+	gatewayAddressTruncations = monitoring.NewSum(
+		"pilot_k8s_gateway_address_truncations",
+		"Node port gateway services starting to have their addresses truncated to Options.MaxGatewayAddresses.",
+	)
+)
+
+func init() {
+	monitoring.MustRegister(gatewayAddresses, gatewayAddressTruncations)
+}
+
+// gatewayAddressLimiter truncates the external addresses of node port gateway services, which
+// select every node with an empty or, with LegacyNodeSelectorParsing, invalid node selector and
+// are pushed to every remote cluster. The addresses kept are the first ones, which are sorted for
+// the addresses of the nodes, so that the same nodes keep the same addresses.
+type gatewayAddressLimiter struct {
+	clusterID string
+	max       int
+
+	mu sync.Mutex
+	// published stores the number of addresses published for each gateway, and truncated the
+	// number of addresses of the gateways currently truncated, before truncation.
+	published map[host.Name]int
+	truncated map[host.Name]int
+}
+
+// newGatewayAddressLimiter returns a limiter of maxAddresses, DefaultMaxGatewayAddresses when 0.
+// A negative maxAddresses means no limit.
+func newGatewayAddressLimiter(clusterID string, maxAddresses int) *gatewayAddressLimiter {
+	if maxAddresses == 0 {
+		maxAddresses = DefaultMaxGatewayAddresses
+	}
+	return &gatewayAddressLimiter{
+		clusterID: clusterID,
+		max:       maxAddresses,
+		published: make(map[host.Name]int),
+		truncated: make(map[host.Name]int),
+	}
+}
+
+// limit returns the addresses kept for the gateway, all of them when under the limit, and whether
+// the gateway just started being truncated.
+func (l *gatewayAddressLimiter) limit(hostname host.Name, addresses []string) (kept []string, started bool) {
+	kept = addresses
+	if l.max > 0 && len(addresses) > l.max {
+		kept = addresses[:l.max:l.max]
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, wasTruncated := l.truncated[hostname]
+	switch {
+	case len(kept) < len(addresses):
+		l.truncated[hostname] = len(addresses)
+	case wasTruncated:
+		delete(l.truncated, hostname)
+		log.Infof("Addresses of gateway %s no longer truncated, %d addresses", hostname, len(addresses))
+	}
+	if prev, f := l.published[hostname]; !f || prev != len(kept) {
+		l.published[hostname] = len(kept)
+		gatewayAddresses.With(clusterTag.Value(l.clusterID), hostnameTag.Value(string(hostname))).Record(float64(len(kept)))
+	}
+	return kept, len(kept) < len(addresses) && !wasTruncated
+}
+
+// clear drops the state of a service that is no longer a gateway.
+func (l *gatewayAddressLimiter) clear(hostname host.Name) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.truncated, hostname)
+	if _, f := l.published[hostname]; f {
+		delete(l.published, hostname)
+		gatewayAddresses.With(clusterTag.Value(l.clusterID), hostnameTag.Value(string(hostname))).Record(0)
+	}
+}
+
+// limitGatewayAddresses truncates the external addresses of the gateway to
+// Options.MaxGatewayAddresses. Gateways starting to be truncated are logged, as they most likely
+// have a node selector matching far more nodes than intended.
+func (c *Controller) limitGatewayAddresses(hostname host.Name, addresses []string) []string {
+	kept, started := c.gatewayAddressLimiter.limit(hostname, addresses)
+	if started {
+		gatewayAddressTruncations.Increment()
+		log.Warnf("Addresses of gateway %s truncated: it has %d external addresses, more than the limit of %d, "+
+			"only the first %d are published, check its node selector", hostname, len(addresses),
+			c.gatewayAddressLimiter.max, c.gatewayAddressLimiter.max)
+	}
+	return kept
+}
@@ -0,0 +1,129 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+)
+
+func TestGatewayAddressLimiter(t *testing.T) {
+	if l := newGatewayAddressLimiter("cluster1", 0); l.max != DefaultMaxGatewayAddresses {
+		t.Fatalf("got a limit of %d, want the default %d", l.max, DefaultMaxGatewayAddresses)
+	}
+	unlimited := newGatewayAddressLimiter("cluster1", -1)
+	addresses := []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"}
+	if kept, started := unlimited.limit("gw", addresses); !reflect.DeepEqual(kept, addresses) || started {
+		t.Fatalf("got %v (started %v), want the addresses untouched", kept, started)
+	}
+
+	l := newGatewayAddressLimiter("cluster1", 2)
+	kept, started := l.limit("gw", addresses)
+	if want := addresses[:2]; !reflect.DeepEqual(kept, want) || !started {
+		t.Fatalf("got %v (started %v), want %v", kept, started, want)
+	}
+	// The truncation is only reported once.
+	if _, started = l.limit("gw", append(addresses, "4.4.4.4")); started {
+		t.Fatal("the truncation was reported again")
+	}
+	if kept, _ = l.limit("gw", addresses[:1]); !reflect.DeepEqual(kept, addresses[:1]) {
+		t.Fatalf("got %v, want the addresses untouched", kept)
+	}
+	if _, started = l.limit("gw", addresses); !started {
+		t.Fatal("the truncation was not reported after the gateway went back under the limit")
+	}
+}
+
+func TestGatewayAddressLimit(t *testing.T) {
+	const clusterID = "cluster1"
+	gw := kube.ServiceHostname("gw1", "nsA", domainSuffix)
+	labels := map[string]string{"cluster": clusterID, "hostname": string(gw)}
+	newController := func() *Controller {
+		controller, _ := newFakeControllerWithOptions(fakeControllerOptions{clusterID: clusterID, maxGatewayAddresses: 3})
+		return controller
+	}
+	addresses := func(controller *Controller) []string {
+		t.Helper()
+		svc, _ := controller.GetService(gw)
+		svc.Mutex.RLock()
+		defer svc.Mutex.RUnlock()
+		return svc.Attributes.ClusterExternalAddresses[clusterID]
+	}
+	want := []string{"10.0.0.1", "10.0.0.10", "10.0.0.2"}
+
+	// The same nodes, added in any order, keep the same addresses.
+	for _, order := range [][]int{{1, 2, 3, 4, 5, 10}, {10, 5, 4, 3, 2, 1}, {4, 10, 1, 5, 2, 3}} {
+		controller := newController()
+		// An empty node selector selects every node.
+		if err := controller.onServiceEvent(nodePortGatewayService("gw1", `{}`), model.EventAdd); err != nil {
+			t.Fatal(err)
+		}
+		for _, i := range order {
+			node := externalNode(fmt.Sprintf("node%d", i), "a", fmt.Sprintf("10.0.0.%d", i))
+			if err := controller.onNodeEvent(node, model.EventAdd); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := addresses(controller); !reflect.DeepEqual(got, want) {
+			t.Fatalf("got addresses %v for the nodes added in the order %v, want %v", got, order, want)
+		}
+		if got := gaugeValue(t, "pilot_k8s_gateway_addresses", labels); got != 3 {
+			t.Fatalf("got %v published addresses, want 3", got)
+		}
+		controller.Stop()
+	}
+
+	controller := newController()
+	defer controller.Stop()
+	truncations := sumValue(t, "pilot_k8s_gateway_address_truncations", nil)
+	if err := controller.onServiceEvent(nodePortGatewayService("gw1", `{"pool":"a"}`), model.EventAdd); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 4; i++ {
+		if err := controller.onNodeEvent(externalNode(fmt.Sprintf("node%d", i), "a", fmt.Sprintf("10.0.0.%d", i)), model.EventAdd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := sumValue(t, "pilot_k8s_gateway_address_truncations", nil); got != truncations+1 {
+		t.Fatalf("got %v truncations, want %v", got, truncations+1)
+	}
+
+	// A node leaving the pool brings the gateway back under the limit.
+	if err := controller.onNodeEvent(externalNode("node4", "b", "10.0.0.4"), model.EventUpdate); err != nil {
+		t.Fatal(err)
+	}
+	if got := addresses(controller); len(got) != 3 {
+		t.Fatalf("got addresses %v, want the 3 nodes of the pool", got)
+	}
+	if got := sumValue(t, "pilot_k8s_gateway_address_truncations", nil); got != truncations+1 {
+		t.Fatalf("got %v truncations, want %v", got, truncations+1)
+	}
+
+	// The gauge is reset once the service is no longer a gateway.
+	clusterIP := nodePortGatewayService("gw1", `{"pool":"a"}`)
+	clusterIP.Spec.Type = coreV1.ServiceTypeClusterIP
+	if err := controller.onServiceEvent(clusterIP, model.EventUpdate); err != nil {
+		t.Fatal(err)
+	}
+	if got := gaugeValue(t, "pilot_k8s_gateway_addresses", labels); got != 0 {
+		t.Fatalf("got %v published addresses, want 0", got)
+	}
+}
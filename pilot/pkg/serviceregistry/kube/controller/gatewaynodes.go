@@ -0,0 +1,270 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"reflect"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+)
+
+// nodePortGateways holds the state of the node port gateway services, whose addresses are those of
+// the nodes they select.
+type nodePortGateways struct {
+	// nodeSelectors stores hostname => label selectors that can be used to refine the set of node
+	// port IPs for a service.
+	nodeSelectors map[host.Name]nodeSelector
+	// byNode indexes the gateways of nodeSelectors by the nodes they select, and nodesByGateway
+	// the nodes by the gateways selecting them.
+	byNode         gatewayNodeIndex
+	nodesByGateway map[host.Name]map[string]struct{}
+	// invalidNodeSelectors stores hostname => value of the node selector annotation of the
+	// gateways whose annotation could not be parsed. Unless legacyNodeSelectors is set, they
+	// select no node.
+	invalidNodeSelectors map[host.Name]string
+	legacyNodeSelectors  bool
+	// local stores the hostnames of the gateways with the Local external traffic policy, whose
+	// addresses are those of the nodes hosting a ready pod of the gateway. localCount mirrors its
+	// size for the pod event handlers, see hasLocalGateways.
+	local      map[host.Name]struct{}
+	localCount int32
+	// externalAddresses stores hostname => addresses pinned by the external addresses annotation
+	// of the gateways, which take precedence over the node addresses.
+	externalAddresses map[host.Name][]string
+}
+
+func newNodePortGateways(legacyNodeSelectors bool) nodePortGateways {
+	return nodePortGateways{
+		nodeSelectors:        make(map[host.Name]nodeSelector),
+		byNode:               make(gatewayNodeIndex),
+		nodesByGateway:       make(map[host.Name]map[string]struct{}),
+		invalidNodeSelectors: make(map[host.Name]string),
+		legacyNodeSelectors:  legacyNodeSelectors,
+		local:                make(map[host.Name]struct{}),
+		externalAddresses:    make(map[host.Name][]string),
+	}
+}
+
+// gatewayNodeIndex maps the name of each node of nodeInfoMap to the hostnames of the node port
+// gateway services whose node selector matches its labels, so that a node event only recomputes
+// the addresses of the gateways selecting the node.
+type gatewayNodeIndex map[string]map[host.Name]struct{}
+
+// indexNodeLocked indexes the node of nodeInfoMap again, after it was added, updated or removed,
+// and returns the hostnames of the gateways selecting it before or after: the addresses of those
+// may have changed. The caller holds the controller lock.
+func (c *Controller) indexNodeLocked(name string) map[host.Name]struct{} {
+	previous := c.gateways.byNode[name]
+	affected := make(map[host.Name]struct{}, len(previous))
+	for hostname := range previous {
+		affected[hostname] = struct{}{}
+		c.unindexGatewayNodeLocked(hostname, name)
+	}
+	node, f := c.nodeInfoMap[name]
+	if !f {
+		return affected
+	}
+	for hostname, selector := range c.gateways.nodeSelectors {
+		if selector.matches(node.labels) {
+			c.indexGatewayNodeLocked(hostname, name)
+			affected[hostname] = struct{}{}
+		}
+	}
+	return affected
+}
+
+// indexGatewayLocked indexes the gateway of the hostname again, after its node selector was set,
+// changed or removed from the node selectors. The caller holds the controller lock.
+func (c *Controller) indexGatewayLocked(hostname host.Name) {
+	selector, gateway := c.gateways.nodeSelectors[hostname]
+	if !gateway {
+		for name := range c.gateways.nodesByGateway[hostname] {
+			c.unindexGatewayNodeLocked(hostname, name)
+		}
+		return
+	}
+	for name, node := range c.nodeInfoMap {
+		if selector.matches(node.labels) {
+			c.indexGatewayNodeLocked(hostname, name)
+		} else {
+			c.unindexGatewayNodeLocked(hostname, name)
+		}
+	}
+}
+
+// indexGatewayNodeLocked records that the gateway selects the node in both directions of the
+// index. The caller holds the controller lock.
+func (c *Controller) indexGatewayNodeLocked(hostname host.Name, name string) {
+	gateways := c.gateways.byNode[name]
+	if gateways == nil {
+		gateways = make(map[host.Name]struct{})
+		c.gateways.byNode[name] = gateways
+	}
+	gateways[hostname] = struct{}{}
+	nodes := c.gateways.nodesByGateway[hostname]
+	if nodes == nil {
+		nodes = make(map[string]struct{})
+		c.gateways.nodesByGateway[hostname] = nodes
+	}
+	nodes[name] = struct{}{}
+}
+
+// unindexGatewayNodeLocked drops the gateway selecting the node from both directions of the
+// index, if it was there. The caller holds the controller lock.
+func (c *Controller) unindexGatewayNodeLocked(hostname host.Name, name string) {
+	if gateways, f := c.gateways.byNode[name]; f {
+		delete(gateways, hostname)
+		if len(gateways) == 0 {
+			delete(c.gateways.byNode, name)
+		}
+	}
+	if nodes, f := c.gateways.nodesByGateway[hostname]; f {
+		delete(nodes, name)
+		if len(nodes) == 0 {
+			delete(c.gateways.nodesByGateway, hostname)
+		}
+	}
+}
+
+// gatewayNodeAddressesLocked returns the sorted external addresses of the nodes selected by the
+// gateway, read from the index rather than matching its selector against every node. The caller
+// holds the controller lock.
+func (c *Controller) gatewayNodeAddressesLocked(hostname host.Name) []string {
+	var addresses []string
+	for name := range c.gateways.nodesByGateway[hostname] {
+		addresses = append(addresses, c.nodeInfoMap[name].address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// gatewayServicesLocked returns the services of the gateway hostnames, leaving out the ones no
+// longer in the registry. The caller holds the controller lock.
+func (c *Controller) gatewayServicesLocked(hostnames map[host.Name]struct{}) []*model.Service {
+	out := make([]*model.Service, 0, len(hostnames))
+	for hostname := range hostnames {
+		if svc := c.servicesMap[hostname]; svc != nil {
+			out = append(out, svc)
+		}
+	}
+	return out
+}
+
+// gatewayUpdate is the node port gateway state of a service read for an update of the service,
+// along with what the update changed, as recorded by updateGatewayLocked.
+type gatewayUpdate struct {
+	isGateway         bool
+	selector          labels.Instance
+	nodeSelectorErr   error
+	externalAddresses []string
+
+	wasGateway            bool
+	prevExternalAddresses []string
+	// newInvalidNodeSelector is set when the node selector annotation is invalid, and was not, or
+	// had another value, before the update.
+	newInvalidNodeSelector bool
+}
+
+// newGatewayUpdate reads the node port gateway state of the service.
+func (c *Controller) newGatewayUpdate(svc *v1.Service) gatewayUpdate {
+	u := gatewayUpdate{isGateway: isNodePortGatewayService(svc)}
+	if u.isGateway {
+		u.selector, u.nodeSelectorErr = c.nodeSelectorForService(svc)
+		u.externalAddresses = getExternalAddressesForService(*svc)
+	}
+	return u
+}
+
+// updateGatewayLocked records the node port gateway state of the updated service, and what it
+// changed in u. The caller holds the controller lock.
+func (c *Controller) updateGatewayLocked(svc *v1.Service, svcConv *model.Service, u *gatewayUpdate) {
+	hostname := svcConv.Hostname
+	prevNodeSelector, wasGateway := c.gateways.nodeSelectors[hostname]
+	u.wasGateway = wasGateway
+	if u.isGateway {
+		// We need to know which services are using node selectors because during node events,
+		// we have to update the node port services selecting the nodes accordingly.
+		// The selector is only compiled again when it changed.
+		if !wasGateway || !prevNodeSelector.labels.Equals(u.selector) {
+			c.gateways.nodeSelectors[hostname] = newNodeSelector(u.selector)
+		}
+	} else {
+		delete(c.gateways.nodeSelectors, hostname)
+	}
+	if u.isGateway != wasGateway || !prevNodeSelector.labels.Equals(u.selector) {
+		c.indexGatewayLocked(hostname)
+	}
+	c.setLocalGatewayLocked(hostname, u.isGateway && svcConv.Attributes.ExternalTrafficPolicyLocal)
+	prevInvalidNodeSelector, wasInvalidNodeSelector := c.gateways.invalidNodeSelectors[hostname]
+	if u.nodeSelectorErr != nil {
+		value := svc.Annotations[kube.NodeSelectorAnnotation]
+		c.gateways.invalidNodeSelectors[hostname] = value
+		u.newInvalidNodeSelector = !wasInvalidNodeSelector || prevInvalidNodeSelector != value
+	} else {
+		delete(c.gateways.invalidNodeSelectors, hostname)
+	}
+	u.prevExternalAddresses = c.gateways.externalAddresses[hostname]
+	if len(u.externalAddresses) > 0 {
+		c.gateways.externalAddresses[hostname] = u.externalAddresses
+	} else {
+		delete(c.gateways.externalAddresses, hostname)
+	}
+}
+
+// deleteGatewayLocked drops the node port gateway state of a deleted service. The caller holds the
+// controller lock.
+func (c *Controller) deleteGatewayLocked(hostname host.Name) {
+	if _, wasGateway := c.gateways.nodeSelectors[hostname]; wasGateway {
+		delete(c.gateways.nodeSelectors, hostname)
+		c.indexGatewayLocked(hostname)
+	}
+	delete(c.gateways.invalidNodeSelectors, hostname)
+	c.setLocalGatewayLocked(hostname, false)
+	delete(c.gateways.externalAddresses, hostname)
+}
+
+// pushGatewayUpdate delivers the addresses of the updated service to the gateway handlers, and
+// requests the push its gateway changes need.
+func (c *Controller) pushGatewayUpdate(svc *v1.Service, svcConv *model.Service, u gatewayUpdate) {
+	// Reported once per invalid value, rather than on every update of the service.
+	if u.newInvalidNodeSelector {
+		c.reportInvalidNodeSelector(svc, u.nodeSelectorErr)
+	}
+	switch {
+	case u.isGateway:
+		// The gateway handlers are notified by updateServiceExternalAddr.
+		c.updateServiceExternalAddr(svcConv)
+	case svc.Spec.Type == v1.ServiceTypeLoadBalancer:
+		c.gatewayAddressLimiter.clear(svcConv.Hostname)
+		c.notifyGatewayHandlers(svcConv.Hostname, svcConv.Attributes.ClusterExternalAddresses[c.clusterID])
+	default:
+		c.gatewayAddressLimiter.clear(svcConv.Hostname)
+		c.notifyGatewayHandlers(svcConv.Hostname, nil)
+	}
+	// The gateway addresses of the mesh networks are computed during a full push, so a service
+	// becoming or ceasing to be a node port gateway, or changing its pinned addresses, needs one
+	// right away.
+	if u.isGateway != u.wasGateway || !reflect.DeepEqual(u.prevExternalAddresses, u.externalAddresses) {
+		c.xdsUpdater.ConfigUpdate(&model.PushRequest{
+			Full: true,
+		})
+	}
+}
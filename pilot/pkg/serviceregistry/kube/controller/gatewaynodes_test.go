@@ -0,0 +1,316 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+)
+
+func nodePortGatewayService(name, nodeSelector string) *coreV1.Service {
+	return &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:        name,
+			Namespace:   "nsA",
+			Annotations: map[string]string{kube.NodeSelectorAnnotation: nodeSelector},
+		},
+		Spec: coreV1.ServiceSpec{
+			Type:      coreV1.ServiceTypeNodePort,
+			ClusterIP: "10.0.0.1",
+			Ports:     []coreV1.ServicePort{{Name: "tcp-port", Port: 8080, NodePort: 30080}},
+		},
+	}
+}
+
+func externalNode(name, pool, address string) *coreV1.Node {
+	return &coreV1.Node{
+		ObjectMeta: metaV1.ObjectMeta{Name: name, Labels: map[string]string{"pool": pool}},
+		Status: coreV1.NodeStatus{
+			Addresses: []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: address}},
+		},
+	}
+}
+
+func TestGatewayNodeIndex(t *testing.T) {
+	const clusterID = "cluster1"
+	controller, _ := newFakeControllerWithOptions(fakeControllerOptions{clusterID: clusterID})
+	defer controller.Stop()
+
+	serviceEvent := func(svc *coreV1.Service, event model.Event) {
+		t.Helper()
+		if err := controller.onServiceEvent(svc, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nodeEvent := func(node *coreV1.Node, event model.Event) {
+		t.Helper()
+		if err := controller.onNodeEvent(node, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gw1 := kube.ServiceHostname("gw1", "nsA", domainSuffix)
+	gw2 := kube.ServiceHostname("gw2", "nsA", domainSuffix)
+	expect := func(index map[string][]host.Name, addresses map[host.Name][]string) {
+		t.Helper()
+		controller.RLock()
+		got := make(map[string][]host.Name, len(controller.gateways.byNode))
+		for node, hostnames := range controller.gateways.byNode {
+			for hostname := range hostnames {
+				got[node] = append(got[node], hostname)
+			}
+			sort.Slice(got[node], func(i, j int) bool { return got[node][i] < got[node][j] })
+		}
+		controller.RUnlock()
+		if !reflect.DeepEqual(got, index) {
+			t.Fatalf("got gateways by node %v, want %v", got, index)
+		}
+		for hostname, want := range addresses {
+			svc, _ := controller.GetService(hostname)
+			svc.Mutex.RLock()
+			got := svc.Attributes.ClusterExternalAddresses[clusterID]
+			svc.Mutex.RUnlock()
+			if len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+				t.Fatalf("got addresses %v for %s, want %v", got, hostname, want)
+			}
+		}
+	}
+
+	serviceEvent(nodePortGatewayService("gw1", `{"pool":"a"}`), model.EventAdd)
+	serviceEvent(nodePortGatewayService("gw2", `{"pool":"b"}`), model.EventAdd)
+	nodeEvent(externalNode("node1", "a", "1.1.1.1"), model.EventAdd)
+	nodeEvent(externalNode("node2", "b", "2.2.2.2"), model.EventAdd)
+	expect(map[string][]host.Name{"node1": {gw1}, "node2": {gw2}},
+		map[host.Name][]string{gw1: {"1.1.1.1"}, gw2: {"2.2.2.2"}})
+
+	// A node moving to another pool leaves the gateway selecting it before.
+	nodeEvent(externalNode("node1", "b", "1.1.1.1"), model.EventUpdate)
+	expect(map[string][]host.Name{"node1": {gw2}, "node2": {gw2}},
+		map[host.Name][]string{gw1: nil, gw2: {"1.1.1.1", "2.2.2.2"}})
+
+	// The index follows the changes of the node selector annotation.
+	serviceEvent(nodePortGatewayService("gw1", `{"pool":"b"}`), model.EventUpdate)
+	expect(map[string][]host.Name{"node1": {gw1, gw2}, "node2": {gw1, gw2}},
+		map[host.Name][]string{gw1: {"1.1.1.1", "2.2.2.2"}, gw2: {"1.1.1.1", "2.2.2.2"}})
+	serviceEvent(nodePortGatewayService("gw1", `{}`), model.EventUpdate)
+	nodeEvent(externalNode("node3", "c", "3.3.3.3"), model.EventAdd)
+	expect(map[string][]host.Name{"node1": {gw1, gw2}, "node2": {gw1, gw2}, "node3": {gw1}},
+		map[host.Name][]string{gw1: {"1.1.1.1", "2.2.2.2", "3.3.3.3"}, gw2: {"1.1.1.1", "2.2.2.2"}})
+
+	nodeEvent(externalNode("node2", "b", "2.2.2.2"), model.EventDelete)
+	expect(map[string][]host.Name{"node1": {gw1, gw2}, "node3": {gw1}},
+		map[host.Name][]string{gw1: {"1.1.1.1", "3.3.3.3"}, gw2: {"1.1.1.1"}})
+
+	// A node losing its external address is dropped like a deleted one.
+	nodeEvent(externalNode("node3", "c", ""), model.EventUpdate)
+	expect(map[string][]host.Name{"node1": {gw1, gw2}},
+		map[host.Name][]string{gw1: {"1.1.1.1"}, gw2: {"1.1.1.1"}})
+
+	// Services that are no longer gateways leave the index.
+	clusterIP := nodePortGatewayService("gw2", `{"pool":"b"}`)
+	clusterIP.Spec.Type = coreV1.ServiceTypeClusterIP
+	serviceEvent(clusterIP, model.EventUpdate)
+	expect(map[string][]host.Name{"node1": {gw1}}, nil)
+	serviceEvent(nodePortGatewayService("gw1", `{}`), model.EventDelete)
+	expect(map[string][]host.Name{}, nil)
+}
+
+func TestNodeSelectorMatches(t *testing.T) {
+	nodes := []labels.Instance{nil, {}, {"pool": "a"}, {"pool": "a", "zone": "z1"}, {"pool": ""}, {"zone": "z1"}}
+	for _, selector := range []labels.Instance{nil, {}, {"pool": "a"}, {"pool": "a", "zone": "z1"}, {"pool": ""}, {"pool": "b"}} {
+		compiled := newNodeSelector(selector)
+		for _, node := range nodes {
+			if got, want := compiled.matches(node), selector.SubsetOf(node); got != want {
+				t.Errorf("selector %v matches the node labels %v: got %v, want %v", selector, node, got, want)
+			}
+		}
+	}
+}
+
+// previousNodeAddresses returns the addresses of the nodes the way they were computed before the
+// node selectors were compiled and indexed, matching the labels of the selector against every node.
+func previousNodeAddresses(controller *Controller, selector labels.Instance) []string {
+	controller.RLock()
+	defer controller.RUnlock()
+	var addresses []string
+	for _, n := range controller.nodeInfoMap {
+		if selector.SubsetOf(n.labels) {
+			addresses = append(addresses, n.address)
+		}
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+func TestGatewayNodeAddressesGolden(t *testing.T) {
+	controller, _ := newFakeControllerWithOptions(fakeControllerOptions{clusterID: "cluster1", legacyNodeSelectors: true})
+	defer controller.Stop()
+
+	selectors := map[string]string{
+		"unset":   "",
+		"all":     `{}`,
+		"a":       `{"pool":"a"}`,
+		"a-z1":    `{"pool":"a","zone":"z1"}`,
+		"no-zone": `{"zone":""}`,
+		"none":    `{"pool":"c"}`,
+		// Invalid, it selects every node with LegacyNodeSelectorParsing.
+		"invalid": `{"pool":`,
+	}
+	for name, selector := range selectors {
+		if err := controller.onServiceEvent(nodePortGatewayService(name, selector), model.EventAdd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	node := func(name, address string, nodeLabels map[string]string) *coreV1.Node {
+		n := externalNode(name, "", address)
+		n.Labels = nodeLabels
+		return n
+	}
+	check := func(step string) map[string][]string {
+		t.Helper()
+		got := make(map[string][]string, len(selectors))
+		for name, annotation := range selectors {
+			selector, _, _ := kube.ParseNodeSelector(annotation)
+			want := previousNodeAddresses(controller, selector)
+			hostname := kube.ServiceHostname(name, "nsA", domainSuffix)
+			if addresses := controller.serviceExternalAddresses(hostname); !reflect.DeepEqual(addresses, want) {
+				t.Fatalf("%s: got addresses %v for the gateway %s, want %v", step, addresses, name, want)
+			}
+			if addresses := controller.NodeAddressesForSelector(selector); !reflect.DeepEqual(addresses, want) {
+				t.Fatalf("%s: got addresses %v for the selector %v, want %v", step, addresses, selector, want)
+			}
+			got[name] = want
+		}
+		return got
+	}
+
+	steps := []struct {
+		name  string
+		node  *coreV1.Node
+		event model.Event
+	}{
+		{"add node1", node("node1", "1.1.1.1", map[string]string{"pool": "a", "zone": "z1"}), model.EventAdd},
+		{"add node2", node("node2", "2.2.2.2", map[string]string{"pool": "a"}), model.EventAdd},
+		{"add node3", node("node3", "3.3.3.3", map[string]string{"pool": "b", "zone": ""}), model.EventAdd},
+		{"add node4", node("node4", "4.4.4.4", nil), model.EventAdd},
+		{"add node5", node("node5", "5.5.5.5", map[string]string{"pool": "b", "zone": "z2"}), model.EventAdd},
+		{"relabel node2", node("node2", "2.2.2.2", map[string]string{"pool": "a", "zone": "z1"}), model.EventUpdate},
+		{"relabel node5", node("node5", "5.5.5.5", map[string]string{"pool": "a"}), model.EventUpdate},
+		{"readdress node1", node("node1", "1.1.1.10", map[string]string{"pool": "a", "zone": "z1"}), model.EventUpdate},
+		{"unreachable node4", node("node4", "", nil), model.EventUpdate},
+		{"delete node3", node("node3", "3.3.3.3", nil), model.EventDelete},
+	}
+	for _, step := range steps {
+		if err := controller.onNodeEvent(step.node, step.event); err != nil {
+			t.Fatal(err)
+		}
+		check(step.name)
+	}
+
+	want := map[string][]string{
+		"unset":   {"1.1.1.10", "2.2.2.2", "5.5.5.5"},
+		"all":     {"1.1.1.10", "2.2.2.2", "5.5.5.5"},
+		"a":       {"1.1.1.10", "2.2.2.2", "5.5.5.5"},
+		"a-z1":    {"1.1.1.10", "2.2.2.2"},
+		"no-zone": {"5.5.5.5"},
+		"none":    nil,
+		"invalid": {"1.1.1.10", "2.2.2.2", "5.5.5.5"},
+	}
+	if got := check("golden"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got addresses %v, want %v", got, want)
+	}
+
+	// Changing the selector of a gateway moves it to the nodes of its new selector.
+	selectors["a"] = `{"zone":"z1"}`
+	if err := controller.onServiceEvent(nodePortGatewayService("a", selectors["a"]), model.EventUpdate); err != nil {
+		t.Fatal(err)
+	}
+	check("update selector")
+}
+
+// BenchmarkGatewayNodeLabelEvent moves a node between the pools of two of 20 node port gateways,
+// among 2000 nodes, so that the event changes the addresses of both gateways.
+func BenchmarkGatewayNodeLabelEvent(b *testing.B) {
+	const gateways, nodes = 20, 2000
+	controller, _ := newFakeControllerWithOptions(fakeControllerOptions{clusterID: "cluster1", maxGatewayAddresses: -1})
+	defer controller.Stop()
+	for i := 0; i < gateways; i++ {
+		svc := nodePortGatewayService(fmt.Sprintf("gw%d", i), fmt.Sprintf(`{"pool":"pool%d","role":"gateway"}`, i))
+		if err := controller.onServiceEvent(svc, model.EventAdd); err != nil {
+			b.Fatal(err)
+		}
+	}
+	node := func(i, pool int) *coreV1.Node {
+		n := externalNode(fmt.Sprintf("node%d", i), fmt.Sprintf("pool%d", pool), fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+		n.Labels["role"] = "gateway"
+		return n
+	}
+	for i := 0; i < nodes; i++ {
+		if err := controller.onNodeEvent(node(i, i%gateways), model.EventAdd); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		i := n % nodes
+		// Every other pass moves the nodes back to their own pool.
+		pool := i % gateways
+		if (n/nodes)%2 == 0 {
+			pool = (pool + 1) % gateways
+		}
+		if err := controller.onNodeEvent(node(i, pool), model.EventUpdate); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkGatewayNodeEvent updates the address of a node, selected by one of 50 node port
+// gateways, among 2000 nodes.
+func BenchmarkGatewayNodeEvent(b *testing.B) {
+	const gateways, nodes = 50, 2000
+	controller, _ := newFakeControllerWithOptions(fakeControllerOptions{clusterID: "cluster1"})
+	defer controller.Stop()
+	for i := 0; i < gateways; i++ {
+		svc := nodePortGatewayService(fmt.Sprintf("gw%d", i), fmt.Sprintf(`{"pool":"pool%d"}`, i))
+		if err := controller.onServiceEvent(svc, model.EventAdd); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for i := 0; i < nodes; i++ {
+		node := externalNode(fmt.Sprintf("node%d", i), fmt.Sprintf("pool%d", i%gateways), fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+		if err := controller.onNodeEvent(node, model.EventAdd); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		i := n % nodes
+		node := externalNode(fmt.Sprintf("node%d", i), fmt.Sprintf("pool%d", i%gateways), fmt.Sprintf("10.1.%d.%d", n%256, i%256))
+		if err := controller.onNodeEvent(node, model.EventUpdate); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+)
+
+// maxHostnameLength is the length of the longest DNS name in text form: 255 octets on the wire,
+// less the length octet of the first label and the root label.
+const maxHostnameLength = 253
+
+// serviceHostname returns the hostname of the service of the namespace. Every hostname of the
+// controller is built here, so that services, endpoints and proxies agree on it. Hostnames
+// longer than maxHostnameLength are shortened when truncateHostnames is set, and rejected by
+// validateConvertedService otherwise.
+func (c *Controller) serviceHostname(name, namespace string) host.Name {
+	suffix := c.domainSuffix(namespace)
+	hostname := kube.ServiceHostname(name, namespace, suffix)
+	if !c.serviceOptions.truncateHostnames || len(hostname) <= maxHostnameLength {
+		return hostname
+	}
+	return truncateServiceHostname(name, namespace, suffix)
+}
+
+// truncateServiceHostname shortens the service name in the hostname to fit maxHostnameLength,
+// ending it with a hash of the whole name so that the hostnames of the services of a namespace
+// stay distinct. The hostname is returned as is when the name cannot be shortened enough.
+func truncateServiceHostname(name, namespace, suffix string) host.Name {
+	hostname := kube.ServiceHostname(name, namespace, suffix)
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	hash := fmt.Sprintf("%08x", h.Sum32())
+	keep := len(name) - (len(hostname) - maxHostnameLength) - len(hash) - 1
+	if keep < 1 {
+		return hostname
+	}
+	return kube.ServiceHostname(strings.TrimRight(name[:keep], "-")+"-"+hash, namespace, suffix)
+}
+
+// validateHostname describes why the hostname is not a valid DNS name, or returns nil.
+func validateHostname(hostname host.Name) error {
+	if hostname == "" {
+		return fmt.Errorf("hostname is empty")
+	}
+	if len(hostname) > maxHostnameLength {
+		return fmt.Errorf("hostname %q is %d characters long, more than %d", hostname, len(hostname), maxHostnameLength)
+	}
+	for _, label := range strings.Split(string(hostname), ".") {
+		if !labels.IsDNS1123Label(label) {
+			return fmt.Errorf("label %q of hostname %q is not a valid DNS-1123 label", label, hostname)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+// longSuffix makes the hostnames of the services of nsA 253 characters long for names of 47
+// characters: 47 + len(".nsA.svc.") + 197.
+var longSuffix = strings.Repeat("a", 63) + "." + strings.Repeat("b", 63) + "." + strings.Repeat("c", 63) + ".local"
+
+func TestValidateHostname(t *testing.T) {
+	cases := []struct {
+		name     string
+		hostname host.Name
+		valid    bool
+	}{
+		{"253 characters", kube.ServiceHostname(strings.Repeat("s", 47), "nsA", longSuffix), true},
+		{"254 characters", kube.ServiceHostname(strings.Repeat("s", 48), "nsA", longSuffix), false},
+		{"underscore", "my_svc.nsA.svc.cluster.local", false},
+		{"label too long", host.Name(strings.Repeat("s", 64) + ".nsA.svc.cluster.local"), false},
+		{"empty label", "svc..svc.cluster.local", false},
+		{"empty", "", false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateHostname(tt.hostname); (err == nil) != tt.valid {
+				t.Fatalf("got error %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestServiceHostnameTruncation(t *testing.T) {
+	for _, truncate := range []bool{false, true} {
+		truncate := truncate
+		t.Run(fmt.Sprintf("truncate=%v", truncate), func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{
+				domainSuffixes:    map[string]string{"nsA": longSuffix},
+				truncateHostnames: truncate,
+			})
+			defer controller.Stop()
+
+			fits := strings.Repeat("s", 47)
+			if got := controller.serviceHostname(fits, "nsA"); got != kube.ServiceHostname(fits, "nsA", longSuffix) {
+				t.Fatalf("got hostname %s, want it unchanged", got)
+			}
+
+			long1, long2 := strings.Repeat("s", 59)+"-one", strings.Repeat("s", 59)+"-two"
+			hostname := controller.serviceHostname(long1, "nsA")
+			if !truncate {
+				if hostname != kube.ServiceHostname(long1, "nsA", longSuffix) {
+					t.Fatalf("got hostname %s, want it unchanged", hostname)
+				}
+				createService(controller, long1, "nsA", nil, []int32{8080}, nil, t)
+				retry.UntilSuccessOrFail(t, func() error {
+					rejected := controller.RejectedServices()
+					if len(rejected) != 1 || rejected[0].Reason != RejectedInvalidHostname ||
+						!strings.Contains(rejected[0].Message, "characters long") {
+						return fmt.Errorf("got rejected services %v, want %s rejected as too long", rejected, long1)
+					}
+					return nil
+				}, retry.Timeout(5*time.Second))
+				return
+			}
+
+			if len(hostname) != maxHostnameLength || validateHostname(hostname) != nil {
+				t.Fatalf("got hostname %s of %d characters, want a valid hostname of %d", hostname, len(hostname), maxHostnameLength)
+			}
+			if controller.serviceHostname(long1, "nsA") != hostname {
+				t.Fatal("expected the truncated hostname to be stable")
+			}
+			if controller.serviceHostname(long2, "nsA") == hostname {
+				t.Fatal("expected the truncated hostnames of distinct names to be distinct")
+			}
+			createService(controller, long1, "nsA", nil, []int32{8080}, nil, t)
+			if ev := fx.Wait("service"); ev == nil || ev.ID != string(hostname) {
+				t.Fatalf("got event %v, want the service %s", ev, hostname)
+			}
+			if svc, _ := controller.GetService(hostname); svc == nil {
+				t.Fatalf("service %s not found", hostname)
+			}
+		})
+	}
+}
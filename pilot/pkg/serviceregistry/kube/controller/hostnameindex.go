@@ -0,0 +1,149 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"strings"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+
+	"istio.io/pkg/log"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+// ServiceRef identifies the Kubernetes Service a hostname of the registry was built from.
+type ServiceRef struct {
+	ClusterID string `json:"cluster"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// hostnameIndex maps the hostnames of the services of the registry to their Kubernetes Service
+// and back. Hostnames cannot always be parsed back, as long names may have been truncated.
+type hostnameIndex struct {
+	mu        sync.RWMutex
+	refs      map[host.Name]ServiceRef
+	hostnames map[ServiceRef]host.Name
+}
+
+func newHostnameIndex() *hostnameIndex {
+	return &hostnameIndex{
+		refs:      make(map[host.Name]ServiceRef),
+		hostnames: make(map[ServiceRef]host.Name),
+	}
+}
+
+// set records the hostname of the service. When another service has the same hostname, the
+// latest one owns it, as in servicesMap.
+func (i *hostnameIndex) set(hostname host.Name, ref ServiceRef) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if prev, f := i.hostnames[ref]; f && prev != hostname && i.refs[prev] == ref {
+		delete(i.refs, prev)
+	}
+	if owner, f := i.refs[hostname]; f && owner != ref {
+		log.Warnf("Services %s/%s and %s/%s have the same hostname %s",
+			owner.Namespace, owner.Name, ref.Namespace, ref.Name, hostname)
+		delete(i.hostnames, owner)
+	}
+	i.refs[hostname] = ref
+	i.hostnames[ref] = hostname
+}
+
+// delete drops the hostname of the service, unless another service owns it now.
+func (i *hostnameIndex) delete(ref ServiceRef) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	hostname, f := i.hostnames[ref]
+	if !f {
+		return
+	}
+	delete(i.hostnames, ref)
+	if i.refs[hostname] == ref {
+		delete(i.refs, hostname)
+	}
+}
+
+func (i *hostnameIndex) service(hostname host.Name) (ServiceRef, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	ref, f := i.refs[hostname]
+	return ref, f
+}
+
+func (i *hostnameIndex) hostname(ref ServiceRef) (host.Name, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	hostname, f := i.hostnames[ref]
+	return hostname, f
+}
+
+// GetServiceRef returns the Kubernetes Service the hostname of a service of the registry was
+// built from.
+func (c *Controller) GetServiceRef(hostname host.Name) (ServiceRef, bool) {
+	return c.hostnames.service(hostname)
+}
+
+// ParseHostname splits a hostname built by the registry into the name and namespace of its
+// Service, checking its domain suffix against that of the namespace. Truncated hostnames are
+// not recognized, GetServiceRef resolves those of known services.
+func (c *Controller) ParseHostname(hostname host.Name) (name, namespace string, ok bool) {
+	parts := strings.SplitN(string(hostname), ".", 4)
+	if len(parts) != 4 || parts[0] == "" || parts[1] == "" || parts[2] != "svc" {
+		return "", "", false
+	}
+	if parts[3] != c.domainSuffix(parts[1]) {
+		return "", "", false
+	}
+	// Truncated hostnames are as long as allowed, and their first label is not the name of the
+	// service, unless the index tells otherwise.
+	if c.serviceOptions.truncateHostnames && len(hostname) == maxHostnameLength {
+		if ref, f := c.hostnames.service(hostname); !f || ref.Name != parts[0] {
+			return "", "", false
+		}
+	}
+	return parts[0], parts[1], true
+}
+
+// storedService returns the service stored for the Kubernetes Service, which a delete has to
+// remove even if the conversion of the deleted object, which may be a stale tombstone, yields
+// another hostname, such as after a change of the domain suffixes.
+func (c *Controller) storedService(svc *v1.Service, converted *model.Service) *model.Service {
+	hostname, f := c.hostnames.hostname(ServiceRef{ClusterID: c.clusterID, Namespace: svc.Namespace, Name: svc.Name})
+	if !f || hostname == converted.Hostname {
+		return converted
+	}
+	c.RLock()
+	stored := c.servicesMap[hostname]
+	c.RUnlock()
+	if stored == nil {
+		return converted
+	}
+	log.Warnf("Service %s/%s is stored with hostname %s, not %s as converted now, deleting the stored service",
+		svc.Namespace, svc.Name, hostname, converted.Hostname)
+	return stored
+}
+
+// endpointsHostname returns the hostname of the service of endpoints, from the index if the
+// service is known.
+func (c *Controller) endpointsHostname(name, namespace string) host.Name {
+	if hostname, f := c.hostnames.hostname(ServiceRef{ClusterID: c.clusterID, Namespace: namespace, Name: name}); f {
+		return hostname
+	}
+	return c.serviceHostname(name, namespace)
+}
@@ -0,0 +1,177 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/host"
+)
+
+func TestHostnameIndexCollision(t *testing.T) {
+	i := newHostnameIndex()
+	a := ServiceRef{ClusterID: "c1", Namespace: "nsA", Name: "a"}
+	b := ServiceRef{ClusterID: "c1", Namespace: "nsA", Name: "b"}
+
+	i.set("shared.nsA.svc.company.com", a)
+	i.set("shared.nsA.svc.company.com", b)
+	// The latest service owns the hostname, and the other one has none.
+	if ref, _ := i.service("shared.nsA.svc.company.com"); ref != b {
+		t.Fatalf("got owner %v, want %v", ref, b)
+	}
+	if _, f := i.hostname(a); f {
+		t.Fatal("expected the previous owner to lose the hostname")
+	}
+	// Deleting the previous owner does not drop the hostname of the new one.
+	i.delete(a)
+	if ref, f := i.service("shared.nsA.svc.company.com"); !f || ref != b {
+		t.Fatalf("got owner %v, want %v", ref, b)
+	}
+
+	// A service whose hostname changes releases the previous one.
+	i.set("b.nsA.svc.company.com", b)
+	if _, f := i.service("shared.nsA.svc.company.com"); f {
+		t.Fatal("expected the previous hostname to be released")
+	}
+	i.delete(b)
+	if _, f := i.service("b.nsA.svc.company.com"); f {
+		t.Fatal("expected the hostname to be dropped with its service")
+	}
+}
+
+func TestParseHostname(t *testing.T) {
+	controller, _ := newFakeControllerWithOptions(fakeControllerOptions{
+		domainSuffixes: map[string]string{"tenant-b-*": "mesh-b.local"},
+	})
+	defer controller.Stop()
+
+	cases := []struct {
+		hostname  host.Name
+		name      string
+		namespace string
+		ok        bool
+	}{
+		{kube.ServiceHostname("svc1", "nsA", domainSuffix), "svc1", "nsA", true},
+		{kube.ServiceHostname("svc1", "tenant-b-1", "mesh-b.local"), "svc1", "tenant-b-1", true},
+		// The suffix must be that of the namespace.
+		{kube.ServiceHostname("svc1", "tenant-b-1", domainSuffix), "", "", false},
+		{kube.ServiceHostname("svc1", "nsA", "mesh-b.local"), "", "", false},
+		{"svc1.nsA", "", "", false},
+		{"svc1..svc.company.com", "", "", false},
+	}
+	for _, tc := range cases {
+		name, namespace, ok := controller.ParseHostname(tc.hostname)
+		if name != tc.name || namespace != tc.namespace || ok != tc.ok {
+			t.Errorf("%s: got %s/%s %v, want %s/%s %v", tc.hostname, namespace, name, ok, tc.namespace, tc.name, tc.ok)
+		}
+	}
+}
+
+func TestGetServiceRef(t *testing.T) {
+	controller, fx := newFakeControllerWithOptions(fakeControllerOptions{
+		clusterID:         "cluster1",
+		domainSuffixes:    map[string]string{"nsA": longSuffix},
+		truncateHostnames: true,
+	})
+	defer controller.Stop()
+
+	pod := generatePod("128.0.0.1", "pod1", "nsA", "", "", map[string]string{"app": "prod-app"}, nil)
+	addPods(t, controller, pod)
+	if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("s", 59) + "-one"
+	createService(controller, long, "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	ev := fx.Wait("service")
+	if ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	hostname := host.Name(ev.ID)
+
+	// Truncated hostnames cannot be parsed, but resolve to their service.
+	if _, _, ok := controller.ParseHostname(hostname); ok {
+		t.Fatalf("expected the truncated hostname %s not to be parsed", hostname)
+	}
+	want := ServiceRef{ClusterID: "cluster1", Namespace: "nsA", Name: long}
+	if ref, f := controller.GetServiceRef(hostname); !f || ref != want {
+		t.Fatalf("got service %v, want %v", ref, want)
+	}
+	// The endpoints of the service are pushed under its hostname.
+	createEndpoints(controller, long, "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+	if ev := fx.Wait("eds"); ev == nil || ev.ID != string(hostname) {
+		t.Fatalf("got event %v, want the endpoints of %s", ev, hostname)
+	}
+
+	if err := controller.client.CoreV1().Services("nsA").Delete(context.TODO(), long, metaV1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout deleting service")
+	}
+	if _, f := controller.GetServiceRef(hostname); f {
+		t.Fatal("expected the hostname to be dropped with its service")
+	}
+}
+
+func TestServiceDeleteAfterConversionChange(t *testing.T) {
+	controller, fx := newFakeControllerWithOptions(fakeControllerOptions{})
+	defer controller.Stop()
+
+	pod := generatePod("128.0.0.1", "pod1", "nsA", "", "", map[string]string{"app": "prod-app"}, nil)
+	addPods(t, controller, pod)
+	if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+		t.Fatal(err)
+	}
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+	if ev := fx.Wait("eds"); ev == nil {
+		t.Fatal("Timeout incremental eds")
+	}
+	hostname := kube.ServiceHostname("svc1", "nsA", domainSuffix)
+
+	// The service now converts to another hostname than the one it was stored with.
+	controller.domainSuffixes = newNamespaceDomainSuffixes("other.local", nil)
+	if err := controller.client.CoreV1().Services("nsA").Delete(context.TODO(), "svc1", metaV1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	ev := fx.Wait("service")
+	if ev == nil {
+		t.Fatal("Timeout deleting service")
+	}
+	if ev.ID != string(hostname) {
+		t.Fatalf("got the delete of %s, want %s", ev.ID, hostname)
+	}
+	if svc, _ := controller.GetService(hostname); svc != nil {
+		t.Fatal("expected the stored service to be deleted")
+	}
+	if svcs, _ := controller.Services(); len(svcs) != 0 {
+		t.Fatalf("expected no service left, got %v", svcs)
+	}
+	// The endpoints pushed under the stored hostname are cleared.
+	controller.pushedEDSMutex.Lock()
+	_, pushed := controller.pushedEDS[hostname]
+	controller.pushedEDSMutex.Unlock()
+	if pushed {
+		t.Fatal("expected the endpoints of the stored hostname to be cleared")
+	}
+}
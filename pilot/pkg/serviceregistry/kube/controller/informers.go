@@ -0,0 +1,191 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+// Informers are informers built outside of the controller, see NewControllerWithInformers. They
+// may come from a shared informer factory, a cache proxy in front of the API server or fakes, and
+// may be shared by several controllers, such as the controllers of several revisions, rather than
+// each of them watching the same objects. Their owner runs them, the controllers only wait for
+// them to sync.
+type Informers struct {
+	// Services is an informer of *v1.Service.
+	Services cache.SharedIndexInformer
+	// Endpoints is an informer of *v1.Endpoints, required in the EndpointsOnly mode.
+	Endpoints cache.SharedIndexInformer
+	// EndpointSlices is an informer of *v1alpha1.EndpointSlice, required in the EndpointSliceOnly
+	// mode. SetEndpointMode fails without the informer of the mode it switches to.
+	EndpointSlices cache.SharedIndexInformer
+	// Pods is an informer of *v1.Pod.
+	Pods cache.SharedIndexInformer
+	// ReplicaSets is an informer of the *metav1.PartialObjectMetadata of the ReplicaSets, which
+	// name the Deployments of the pods.
+	ReplicaSets cache.SharedIndexInformer
+	// Nodes is an informer of *v1.Node.
+	Nodes cache.SharedIndexInformer
+	// Namespaces is an informer of *v1.Namespace, read for the network label of the system
+	// namespace and for the ServiceFilterFunc.
+	Namespaces cache.SharedIndexInformer
+}
+
+// endpointsInformer returns the informer of the source of the endpoints of the mode.
+func (i *Informers) endpointsInformer(mode EndpointMode) cache.SharedIndexInformer {
+	if mode == EndpointSliceOnly {
+		return i.EndpointSlices
+	}
+	return i.Endpoints
+}
+
+// validate reports the informers missing for the endpoint mode.
+func (i *Informers) validate(mode EndpointMode) error {
+	var missing []string
+	for _, informer := range []struct {
+		name     string
+		informer cache.SharedIndexInformer
+	}{
+		{"Services", i.Services},
+		{"Pods", i.Pods},
+		{"ReplicaSets", i.ReplicaSets},
+		{"Nodes", i.Nodes},
+		{"Namespaces", i.Namespaces},
+		{fmt.Sprintf("the endpoints informer of the %s mode", mode), i.endpointsInformer(mode)},
+	} {
+		if informer.informer == nil {
+			missing = append(missing, informer.name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return fmt.Errorf("missing informers: %s", strings.Join(missing, ", "))
+}
+
+// addIndexers adds the indexers the controller reads to the informers, unless they have them
+// already, such as when another controller was built on them. It fails once the informers
+// started.
+func (i *Informers) addIndexers() error {
+	for _, informer := range []struct {
+		informer cache.SharedIndexInformer
+		indexers cache.Indexers
+	}{
+		{i.Services, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}},
+		{i.Pods, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc, podHostnameIndex: podHostnameIndexFunc}},
+		{i.Endpoints, cache.Indexers{
+			cache.NamespaceIndex:          cache.MetaNamespaceIndexFunc,
+			endpointsTargetNamespaceIndex: endpointsTargetNamespaceIndexFunc,
+		}},
+		{i.EndpointSlices, cache.Indexers{
+			cache.NamespaceIndex:          cache.MetaNamespaceIndexFunc,
+			endpointsTargetNamespaceIndex: endpointSliceTargetNamespaceIndexFunc,
+		}},
+	} {
+		if informer.informer == nil {
+			continue
+		}
+		existing := informer.informer.GetIndexer().GetIndexers()
+		missing := cache.Indexers{}
+		for name, f := range informer.indexers {
+			if _, found := existing[name]; !found {
+				missing[name] = f
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		if err := informer.informer.AddIndexers(missing); err != nil {
+			return fmt.Errorf("adding the indexers of the controller: %v", err)
+		}
+	}
+	return nil
+}
+
+// NewControllerWithInformers creates a controller on informers built outside of it, without
+// Kubernetes clients: the informers of several controllers can be shared, or injected from fakes.
+// The informers must not have started, for the indexers of the controller to be added, and are
+// run by their owner rather than by Run. Without clients, the live check of CheckConsistency,
+// the Kubernetes events recorded on services and the ExternalEndpointSliceManagers, which have
+// informers of their own, are not available. The handlers the controller adds to the
+// informers, which cannot be removed, ignore the events once it stopped.
+func NewControllerWithInformers(informers Informers, options Options) (*Controller, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	if len(options.ExternalEndpointSliceManagers) > 0 {
+		return nil, errors.New("ExternalEndpointSliceManagers are not supported with injected informers")
+	}
+	if err := informers.validate(options.EndpointMode); err != nil {
+		return nil, err
+	}
+	if err := informers.addIndexers(); err != nil {
+		return nil, err
+	}
+	return newControllerWithInformers(nil, nil, &informers, options, newQueue(&options)), nil
+}
+
+// ownInformer records an informer created by the controller, for Run to run it.
+func (c *Controller) ownInformer(informer cache.SharedIndexInformer) cache.SharedIndexInformer {
+	c.ownedInformers = append(c.ownedInformers, informer)
+	return informer
+}
+
+// addEventHandler adds the handler to the informer. The handlers added to injected informers,
+// which outlive the controller, are detached once it stopped.
+func (c *Controller) addEventHandler(informer cache.SharedIndexInformer, handler cache.ResourceEventHandler) {
+	if c.injected == nil {
+		informer.AddEventHandler(handler)
+		return
+	}
+	informer.AddEventHandler(detachableEventHandler{handler: handler, detached: c.detached})
+}
+
+// detachableEventHandler passes the events to handler until detached is closed.
+type detachableEventHandler struct {
+	handler  cache.ResourceEventHandler
+	detached <-chan struct{}
+}
+
+func (h detachableEventHandler) active() bool {
+	select {
+	case <-h.detached:
+		return false
+	default:
+		return true
+	}
+}
+
+func (h detachableEventHandler) OnAdd(obj interface{}) {
+	if h.active() {
+		h.handler.OnAdd(obj)
+	}
+}
+
+func (h detachableEventHandler) OnUpdate(old, cur interface{}) {
+	if h.active() {
+		h.handler.OnUpdate(old, cur)
+	}
+}
+
+func (h detachableEventHandler) OnDelete(obj interface{}) {
+	if h.active() {
+		h.handler.OnDelete(obj)
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	metafake "k8s.io/client-go/metadata/fake"
+	"k8s.io/client-go/metadata/metadatainformer"
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+func sharedInformers(client *fake.Clientset) (Informers, func(stop <-chan struct{})) {
+	factory := informers.NewSharedInformerFactory(client, 0)
+	scheme := runtime.NewScheme()
+	metaV1.AddMetaToScheme(scheme)
+	metadataFactory := metadatainformer.NewSharedInformerFactory(metafake.NewSimpleMetadataClient(scheme), 0)
+	replicaSets := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"}
+	shared := Informers{
+		Services:    factory.Core().V1().Services().Informer(),
+		Endpoints:   factory.Core().V1().Endpoints().Informer(),
+		Pods:        factory.Core().V1().Pods().Informer(),
+		ReplicaSets: metadataFactory.ForResource(replicaSets).Informer(),
+		Nodes:       factory.Core().V1().Nodes().Informer(),
+		Namespaces:  factory.Core().V1().Namespaces().Informer(),
+	}
+	return shared, func(stop <-chan struct{}) {
+		factory.Start(stop)
+		metadataFactory.Start(stop)
+	}
+}
+
+func TestNewControllerWithInformers(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	shared, start := sharedInformers(client)
+
+	type revision struct {
+		controller *Controller
+		fx         *FakeXdsUpdater
+		stop       chan struct{}
+	}
+	revisions := make([]revision, 2)
+	for i := range revisions {
+		fx := NewFakeXDS()
+		c, err := NewControllerWithInformers(shared, Options{
+			DomainSuffix: domainSuffix,
+			XDSUpdater:   fx,
+			Metrics:      &model.Environment{},
+			ClusterID:    fmt.Sprintf("cluster%d", i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		revisions[i] = revision{controller: c, fx: fx, stop: make(chan struct{})}
+		go c.Run(revisions[i].stop)
+	}
+	defer func() {
+		for _, r := range revisions {
+			select {
+			case <-r.stop:
+			default:
+				close(r.stop)
+			}
+		}
+	}()
+	stop := make(chan struct{})
+	defer close(stop)
+	start(stop)
+	for _, r := range revisions {
+		select {
+		case <-r.controller.Synced():
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the controller to sync")
+		}
+	}
+
+	createService := func(name string) {
+		t.Helper()
+		svc := &coreV1.Service{
+			ObjectMeta: metaV1.ObjectMeta{Name: name, Namespace: "nsA"},
+			Spec: coreV1.ServiceSpec{
+				ClusterIP: "10.0.0.1",
+				Ports:     []coreV1.ServicePort{{Name: "tcp-port", Port: 8080, Protocol: "http"}},
+			},
+		}
+		if _, err := client.CoreV1().Services("nsA").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hasService := func(c *Controller, name string) bool {
+		svc, _ := c.GetService(kube.ServiceHostname(name, "nsA", domainSuffix))
+		return svc != nil
+	}
+
+	// Both controllers handle the events of the shared informers.
+	createService("svc1")
+	endpoints := &coreV1.Endpoints{
+		ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA"},
+		Subsets: []coreV1.EndpointSubset{{
+			Addresses: []coreV1.EndpointAddress{{IP: "10.10.1.1"}},
+			Ports:     []coreV1.EndpointPort{{Name: "tcp-port", Port: 1001}},
+		}},
+	}
+	if _, err := client.CoreV1().Endpoints("nsA").Create(context.TODO(), endpoints, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range revisions {
+		if ev := r.fx.Wait("eds"); ev == nil {
+			t.Fatalf("timed out waiting for the eds update of controller %d", i)
+		}
+		if !hasService(r.controller, "svc1") {
+			t.Fatalf("controller %d is missing svc1", i)
+		}
+	}
+
+	// Once stopped, a controller ignores the events of the informers, which keep running.
+	close(revisions[0].stop)
+	<-revisions[0].controller.terminated
+	createService("svc2")
+	retry.UntilSuccessOrFail(t, func() error {
+		if !hasService(revisions[1].controller, "svc2") {
+			return fmt.Errorf("svc2 not found")
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+	if hasService(revisions[0].controller, "svc2") {
+		t.Fatal("the stopped controller handled the event of svc2")
+	}
+}
+
+func TestNewControllerWithInformersValidation(t *testing.T) {
+	options := Options{DomainSuffix: domainSuffix, XDSUpdater: NewFakeXDS(), Metrics: &model.Environment{}}
+
+	_, err := NewControllerWithInformers(Informers{}, options)
+	if err == nil || !strings.Contains(err.Error(), "Services") || !strings.Contains(err.Error(), "EndpointsOnly") {
+		t.Fatalf("expected the missing informers, got %v", err)
+	}
+
+	shared, _ := sharedInformers(fake.NewSimpleClientset())
+	sliceOptions := options
+	sliceOptions.EndpointMode = EndpointSliceOnly
+	if _, err := NewControllerWithInformers(shared, sliceOptions); err == nil || !strings.Contains(err.Error(), "EndpointSliceOnly") {
+		t.Fatalf("expected the missing endpoint slice informer, got %v", err)
+	}
+
+	externalOptions := options
+	externalOptions.ExternalEndpointSliceManagers = []string{"external-controller"}
+	if _, err := NewControllerWithInformers(shared, externalOptions); err == nil {
+		t.Fatal("expected ExternalEndpointSliceManagers to be rejected")
+	}
+}
+
+func TestNewControllerWithInformersSystemNamespace(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	shared, start := sharedInformers(client)
+	c, err := NewControllerWithInformers(shared, Options{
+		DomainSuffix: domainSuffix,
+		XDSUpdater:   NewFakeXDS(),
+		Metrics:      &model.Environment{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.Run(stop)
+	start(stop)
+	select {
+	case <-c.Synced():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the controller to sync")
+	}
+
+	// The shared informer delivers every namespace, only the system namespace is handled.
+	added := map[string]string{"type": "Namespaces", "event": "add"}
+	before := sumValue(t, "pilot_k8s_reg_events", added)
+	for _, ns := range []*coreV1.Namespace{networkNamespace("nsa", "nw-other"), networkNamespace("nsb", ""),
+		networkNamespace(IstioNamespace, "nw1")} {
+		if _, err := client.CoreV1().Namespaces().Create(context.TODO(), ns, metaV1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		if got := c.registryNetwork(); got != "nw1" {
+			return fmt.Errorf("got network %q, want nw1", got)
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+	if got := sumValue(t, "pilot_k8s_reg_events", added) - before; got != 1 {
+		t.Fatalf("got %v namespace events, want the one of the system namespace", got)
+	}
+}
+
+// countingInformer counts the handlers added to the informer.
+type countingInformer struct {
+	cache.SharedIndexInformer
+	handlers int32
+}
+
+func (i *countingInformer) AddEventHandler(handler cache.ResourceEventHandler) {
+	atomic.AddInt32(&i.handlers, 1)
+	i.SharedIndexInformer.AddEventHandler(handler)
+}
+
+func TestNewControllerWithInformersSetEndpointMode(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	shared, start := sharedInformers(client)
+	endpoints := &countingInformer{SharedIndexInformer: shared.Endpoints}
+	slices := &countingInformer{
+		SharedIndexInformer: informers.NewSharedInformerFactory(client, 0).Discovery().V1alpha1().EndpointSlices().Informer(),
+	}
+	shared.Endpoints, shared.EndpointSlices = endpoints, slices
+	fx := NewFakeXDS()
+	c, err := NewControllerWithInformers(shared, Options{
+		DomainSuffix: domainSuffix,
+		XDSUpdater:   fx,
+		Metrics:      &model.Environment{},
+		ClusterID:    "cluster-switches",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.Run(stop)
+	start(stop)
+	go slices.Run(stop)
+	select {
+	case <-c.Synced():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the controller to sync")
+	}
+
+	// The sources built again by the switches replace the handlers of the informers rather than
+	// adding more.
+	for _, mode := range []EndpointMode{EndpointSliceOnly, EndpointsOnly, EndpointSliceOnly, EndpointsOnly} {
+		if err := c.SetEndpointMode(mode); err != nil {
+			t.Fatal(err)
+		}
+		retry.UntilSuccessOrFail(t, func() error {
+			if got := c.EndpointMode(); got != mode {
+				return fmt.Errorf("got mode %s, want %s", got, mode)
+			}
+			return nil
+		}, retry.Timeout(5*time.Second))
+	}
+	for name, informer := range map[string]*countingInformer{"Endpoints": endpoints, "EndpointSlices": slices} {
+		if got := atomic.LoadInt32(&informer.handlers); got != 1 {
+			t.Fatalf("got %d handlers on the %s informer, want 1", got, name)
+		}
+	}
+
+	// The events are handled once, by the current source.
+	added := map[string]string{"type": "Endpoints", "event": "add"}
+	before := sumValue(t, "pilot_k8s_reg_events", added)
+	svc := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA"},
+		Spec: coreV1.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+			Ports:     []coreV1.ServicePort{{Name: "tcp-port", Port: 8080, Protocol: "http"}},
+		},
+	}
+	if _, err := client.CoreV1().Services("nsA").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	ep := &coreV1.Endpoints{
+		ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA"},
+		Subsets: []coreV1.EndpointSubset{{
+			Addresses: []coreV1.EndpointAddress{{IP: "10.10.1.1"}},
+			Ports:     []coreV1.EndpointPort{{Name: "tcp-port", Port: 1001}},
+		}},
+	}
+	if _, err := client.CoreV1().Endpoints("nsA").Create(context.TODO(), ep, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		ev := fx.Wait("eds")
+		if ev == nil {
+			t.Fatal("Timeout incremental eds")
+		}
+		if len(ev.Endpoints) == 1 && ev.Endpoints[0].Address == "10.10.1.1" {
+			break
+		}
+	}
+	if got := sumValue(t, "pilot_k8s_reg_events", added) - before; got != 1 {
+		t.Fatalf("got %v endpoints events, want 1", got)
+	}
+}
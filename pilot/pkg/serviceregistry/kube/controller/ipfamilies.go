@@ -0,0 +1,108 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"net"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pkg/config/host"
+)
+
+var (
+	ipFamilyTag = monitoring.MustCreateLabel("family")
+
+	servicesByIPFamily = monitoring.NewGauge(
+		"pilot_k8s_services_ip_family",
+		"Services modeled with a cluster IP, by IP family of the cluster IP.",
+		monitoring.WithLabels(clusterTag, ipFamilyTag),
+	)
+)
+
+func init() {
+	monitoring.MustRegister(servicesByIPFamily)
+}
+
+// serviceIPFamilies counts the services modeled with a cluster IP by its IP family. The Services
+// of k8s.io/api v0.18.3 carry a single cluster IP, dual-stack Services are modeled by their
+// primary cluster IP and counted in its family.
+type serviceIPFamilies struct {
+	clusterID string
+
+	mu       sync.Mutex
+	families map[host.Name]v1.IPFamily
+	counts   map[v1.IPFamily]int
+}
+
+func newServiceIPFamilies(clusterID string) *serviceIPFamilies {
+	return &serviceIPFamilies{
+		clusterID: clusterID,
+		families:  make(map[host.Name]v1.IPFamily),
+		counts:    make(map[v1.IPFamily]int),
+	}
+}
+
+// clusterIPFamily returns the IP family of the cluster IP of the service, or an empty family for
+// headless services and those without a valid cluster IP.
+func clusterIPFamily(svc *v1.Service) v1.IPFamily {
+	ip := net.ParseIP(svc.Spec.ClusterIP)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return v1.IPv4Protocol
+	default:
+		return v1.IPv6Protocol
+	}
+}
+
+// set records the IP family of the cluster IP of the service.
+func (s *serviceIPFamilies) set(hostname host.Name, svc *v1.Service) {
+	s.update(hostname, clusterIPFamily(svc))
+}
+
+// clear drops a deleted service.
+func (s *serviceIPFamilies) clear(hostname host.Name) {
+	s.update(hostname, "")
+}
+
+func (s *serviceIPFamilies) update(hostname host.Name, family v1.IPFamily) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.families[hostname]
+	if prev == family {
+		return
+	}
+	if family == "" {
+		delete(s.families, hostname)
+	} else {
+		s.families[hostname] = family
+		s.counts[family]++
+		s.recordLocked(family)
+	}
+	if prev != "" {
+		s.counts[prev]--
+		s.recordLocked(prev)
+	}
+}
+
+func (s *serviceIPFamilies) recordLocked(family v1.IPFamily) {
+	servicesByIPFamily.With(clusterTag.Value(s.clusterID), ipFamilyTag.Value(string(family))).
+		Record(float64(s.counts[family]))
+}
@@ -0,0 +1,111 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+)
+
+func TestServiceIPFamilies(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			clusterID := "ip-families-" + name
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: mode, clusterID: clusterID})
+			defer controller.Stop()
+			expect := func(ipv4, ipv6 float64) {
+				t.Helper()
+				for family, want := range map[coreV1.IPFamily]float64{coreV1.IPv4Protocol: ipv4, coreV1.IPv6Protocol: ipv6} {
+					labels := map[string]string{"cluster": clusterID, "family": string(family)}
+					if got := gaugeValue(t, "pilot_k8s_services_ip_family", labels); got != want {
+						t.Fatalf("%s services: got %v, want %v", family, got, want)
+					}
+				}
+			}
+
+			createService(controller, "svc4", "nsa", nil, []int32{8080}, map[string]string{"app": "v4"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			ipv6 := coreV1.IPv6Protocol
+			svc6 := &coreV1.Service{
+				ObjectMeta: metaV1.ObjectMeta{Name: "svc6", Namespace: "nsa"},
+				Spec: coreV1.ServiceSpec{
+					ClusterIP: "2001:db8::1",
+					IPFamily:  &ipv6,
+					Ports:     []coreV1.ServicePort{{Name: "tcp-port", Port: 8080, Protocol: "http"}},
+					Selector:  map[string]string{"app": "v6"},
+					Type:      coreV1.ServiceTypeClusterIP,
+				},
+			}
+			if _, err := controller.client.CoreV1().Services("nsa").Create(context.TODO(), svc6, metaV1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			hostname6 := kube.ServiceHostname("svc6", "nsa", domainSuffix)
+			svc, err := controller.GetService(hostname6)
+			if err != nil || svc == nil {
+				t.Fatalf("GetService(%s) => %v, %v", hostname6, svc, err)
+			}
+			if svc.Address != "2001:db8::1" {
+				t.Fatalf("got address %s, want the IPv6 cluster IP", svc.Address)
+			}
+			expect(1, 1)
+
+			// The IPv6 addresses of the endpoints are converted as the IPv4 ones.
+			addPods(t, controller, generatePod("2001:db8::10", "pod6", "nsa", "", "", map[string]string{"app": "v6"}, nil))
+			if err := waitForPod(controller, "2001:db8::10"); err != nil {
+				t.Fatal(err)
+			}
+			createEndpoints(controller, "svc6", "nsa", []string{"tcp-port"}, []string{"2001:db8::10"}, t)
+			for {
+				ev := fx.Wait("eds")
+				if ev == nil {
+					t.Fatal("Timeout waiting for the endpoints")
+				}
+				if ev.ID != string(hostname6) {
+					continue
+				}
+				if len(ev.Endpoints) != 1 || ev.Endpoints[0].Address != "2001:db8::10" || ev.Endpoints[0].EndpointPort != 1001 {
+					t.Fatalf("got endpoints %+v, want 2001:db8::10:1001", ev.Endpoints)
+				}
+				break
+			}
+			instances, err := controller.InstancesByPort(svc, 8080, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(instances) != 1 || instances[0].Endpoint.Address != "2001:db8::10" {
+				t.Fatalf("got instances %v, want 2001:db8::10", instances)
+			}
+
+			if err := controller.client.CoreV1().Services("nsa").Delete(context.TODO(), "svc6", metaV1.DeleteOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout deleting service")
+			}
+			expect(1, 0)
+		})
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// normalizeLocalityLabel returns the region/zone/subzone locality of an istio-locality label.
+// Kubernetes label values cannot hold slashes, so the parts are usually separated by dots, but
+// slashes are accepted too, in which case dots are kept within the parts. ok is false for values
+// with more than the three parts.
+func normalizeLocalityLabel(value string) (locality string, ok bool) {
+	separator := "."
+	if strings.Contains(value, "/") {
+		separator = "/"
+	}
+	parts := strings.Split(value, separator)
+	if len(parts) > 3 {
+		return "", false
+	}
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return strings.Join(parts, "/"), true
+}
+
+// podLocalityLabel returns the locality of the istio-locality label of the pod, which takes
+// precedence over the labels of its node. found is false when the pod has no valid label, invalid
+// ones are reported by the pod cache.
+func podLocalityLabel(pod *v1.Pod) (locality string, found bool) {
+	value := pod.Labels[model.LocalityLabel]
+	if value == "" {
+		return "", false
+	}
+	return normalizeLocalityLabel(value)
+}
+
+// LocalitySource is a source of the locality of pods without an istio-locality label.
+type LocalitySource string
+
+const (
+	// LocalityFromPodLabels reads the topology labels of the pod itself, such as the
+	// topology.kubernetes.io/region and zone labels set on pods by some schedulers and admission
+	// webhooks.
+	LocalityFromPodLabels LocalitySource = "pod"
+	// LocalityFromNode reads the topology labels of the node the pod is scheduled on.
+	LocalityFromNode LocalitySource = "node"
+)
+
+// DefaultLocalityOrder is the order of the locality sources when Options.LocalityOrder is nil.
+var DefaultLocalityOrder = []LocalitySource{LocalityFromPodLabels, LocalityFromNode}
+
+// validateLocalityOrder returns an error for the unknown or repeated sources of order.
+func validateLocalityOrder(order []LocalitySource) error {
+	seen := make(map[LocalitySource]struct{}, len(order))
+	for _, source := range order {
+		switch source {
+		case LocalityFromPodLabels, LocalityFromNode:
+		default:
+			return fmt.Errorf("unknown locality source %q in LocalityOrder", source)
+		}
+		if _, f := seen[source]; f {
+			return fmt.Errorf("locality source %q is repeated in LocalityOrder", source)
+		}
+		seen[source] = struct{}{}
+	}
+	return nil
+}
+
+// topologyLocality returns the region/zone/subzone locality of the topology labels of obj, or ""
+// when it has none.
+func topologyLocality(obj metav1.Object) string {
+	region := getLabelValue(obj, NodeRegionLabel, NodeRegionLabelGA)
+	zone := getLabelValue(obj, NodeZoneLabel, NodeZoneLabelGA)
+	subzone := getLabelValue(obj, IstioSubzoneLabel, "")
+
+	if region == "" && zone == "" && subzone == "" {
+		return ""
+	}
+
+	return region + "/" + zone + "/" + subzone // Format: "%s/%s/%s"
+}
@@ -0,0 +1,151 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+)
+
+func TestNormalizeLocalityLabel(t *testing.T) {
+	cases := []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{"region.zone.subzone", "region/zone/subzone", true},
+		{"region/zone/subzone", "region/zone/subzone", true},
+		{"region.zone", "region/zone", true},
+		{"region", "region", true},
+		// With slashes, dots are kept within the parts.
+		{"us-east.1/zone.a/subzone", "us-east.1/zone.a/subzone", true},
+		{" region . zone ", "region/zone", true},
+		{"region.zone.subzone.extra", "", false},
+		{"region/zone/subzone/extra", "", false},
+	}
+	for _, tc := range cases {
+		got, ok := normalizeLocalityLabel(tc.value)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("normalizeLocalityLabel(%q) = %q, %v, want %q, %v", tc.value, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestEndpointLocalityLabel(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: mode})
+			defer controller.Stop()
+
+			addNodes(t, controller, generateNode("node1", map[string]string{
+				NodeRegionLabel: "node-region", NodeZoneLabel: "node-zone", IstioSubzoneLabel: "node-subzone",
+			}))
+			setLocalityLabel := func(value string) {
+				t.Helper()
+				podLabels := map[string]string{"app": "prod-app"}
+				if value != "" {
+					podLabels[model.LocalityLabel] = value
+				}
+				addPods(t, controller, generatePod("128.0.0.1", "svc1", "nsA", "", "node1", podLabels, nil))
+			}
+			hostname := string(kube.ServiceHostname("svc1", "nsA", domainSuffix))
+			expectLocality := func(locality string) {
+				t.Helper()
+				got := "<none>"
+				for {
+					ev := fx.Wait("eds")
+					if ev == nil {
+						t.Fatalf("Timeout waiting for the endpoints in %q, last got %q", locality, got)
+					}
+					if ev.ID != hostname {
+						continue
+					}
+					if got = ev.Endpoints[0].Locality.Label; got == locality {
+						return
+					}
+				}
+			}
+
+			// The label of the pod takes precedence over the labels of its node.
+			setLocalityLabel("region.zone.subzone")
+			if err := waitForPod(controller, "128.0.0.1"); err != nil {
+				t.Fatal(err)
+			}
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+			createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+			expectLocality("region/zone/subzone")
+
+			// Label changes on the running pod refresh the locality of its endpoints.
+			setLocalityLabel("region2.zone2")
+			expectLocality("region2/zone2")
+			setLocalityLabel("")
+			expectLocality("node-region/node-zone/node-subzone")
+			setLocalityLabel("region3/zone3/subzone3")
+			expectLocality("region3/zone3/subzone3")
+			// Invalid labels are ignored.
+			setLocalityLabel("a.b.c.d")
+			expectLocality("node-region/node-zone/node-subzone")
+		})
+	}
+}
+
+func TestPodTopologyLocality(t *testing.T) {
+	nodeLabels := map[string]string{NodeRegionLabelGA: "node-region", NodeZoneLabelGA: "node-zone"}
+	podLabels := map[string]string{NodeRegionLabelGA: "pod-region", NodeZoneLabelGA: "pod-zone"}
+	cases := []struct {
+		name      string
+		order     []LocalitySource
+		podLabels map[string]string
+		node      string
+		want      string
+	}{
+		{"pod labels only", nil, podLabels, "", "pod-region/pod-zone/"},
+		{"node only", nil, nil, "node1", "node-region/node-zone/"},
+		{"both", nil, podLabels, "node1", "pod-region/pod-zone/"},
+		{"both node first", []LocalitySource{LocalityFromNode, LocalityFromPodLabels}, podLabels, "node1", "node-region/node-zone/"},
+		{"node first without node labels", []LocalitySource{LocalityFromNode, LocalityFromPodLabels}, podLabels, "node2", "pod-region/pod-zone/"},
+		{"node only order", []LocalitySource{LocalityFromNode}, podLabels, "", ""},
+		{"label only order", []LocalitySource{}, podLabels, "node1", ""},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			controller, _ := newFakeControllerWithOptions(fakeControllerOptions{})
+			defer controller.Stop()
+			if tc.order != nil {
+				controller.endpointOptions.localityOrder = tc.order
+			}
+			addNodes(t, controller, generateNode("node1", nodeLabels), generateNode("node2", nil))
+
+			labels := map[string]string{"app": "prod-app"}
+			for k, v := range tc.podLabels {
+				labels[k] = v
+			}
+			pod := generatePod("128.0.0.1", "pod1", "nsA", "", tc.node, labels, nil)
+			if got := controller.getPodLocality(pod); got != tc.want {
+				t.Fatalf("got locality %q, want %q", got, tc.want)
+			}
+
+			// The istio-locality label still takes precedence.
+			labels[model.LocalityLabel] = "region.zone"
+			if got := controller.getPodLocality(pod); got != "region/zone" {
+				t.Fatalf("got locality %q, want the istio-locality label", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+var localityBackfills = monitoring.NewSum(
+	"pilot_k8s_locality_backfills",
+	"Services whose endpoints were built again once the nodes their locality was missing from were known.",
+)
+
+func init() {
+	monitoring.MustRegister(localityBackfills)
+}
+
+// localityBackfill tracks the services whose endpoints were pushed without the locality of their
+// pods, because the node of the pods had not synced yet or could not be found. Their endpoints are
+// built again once the node is known, rather than keeping an empty locality until the endpoints
+// change.
+type localityBackfill struct {
+	clusterID string
+
+	mu sync.Mutex
+	// missingNodes are the nodes the locality of pods could not be read from.
+	missingNodes map[string]struct{}
+	// pending are the missing nodes of the endpoints last pushed for each service.
+	pending map[host.Name]map[string]struct{}
+}
+
+func newLocalityBackfill(clusterID string) *localityBackfill {
+	return &localityBackfill{
+		clusterID:    clusterID,
+		missingNodes: make(map[string]struct{}),
+		pending:      make(map[host.Name]map[string]struct{}),
+	}
+}
+
+// nodeMissing records that the locality of pods could not be read from the node.
+func (b *localityBackfill) nodeMissing(nodeName string) {
+	if nodeName == "" {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.missingNodes[nodeName] = struct{}{}
+}
+
+// isMissing reports whether the locality of pods could not be read from the node.
+func (b *localityBackfill) isMissing(nodeName string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, f := b.missingNodes[nodeName]
+	return f
+}
+
+// record records the endpoints pushed for the service, which is pending while some of its local
+// endpoints run on a missing node.
+func (b *localityBackfill) record(hostname host.Name, endpoints []*model.IstioEndpoint) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.missingNodes) == 0 && len(b.pending) == 0 {
+		return
+	}
+	var nodes map[string]struct{}
+	for _, ep := range endpoints {
+		// Foreign endpoints keep the locality, and node, of their own cluster.
+		if ep.Locality.Label != "" || ep.Locality.ClusterID != b.clusterID || ep.NodeName == "" {
+			continue
+		}
+		if _, f := b.missingNodes[ep.NodeName]; !f {
+			continue
+		}
+		if nodes == nil {
+			nodes = make(map[string]struct{})
+		}
+		nodes[ep.NodeName] = struct{}{}
+	}
+	if nodes == nil {
+		delete(b.pending, hostname)
+	} else {
+		b.pending[hostname] = nodes
+	}
+}
+
+// takeAll returns the pending services and forgets them, along with the missing nodes, once the
+// nodes synced. The nodes still missing are recorded again when the services are built again.
+func (b *localityBackfill) takeAll() []host.Name {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	hostnames := make([]host.Name, 0, len(b.pending))
+	for hostname := range b.pending {
+		hostnames = append(hostnames, hostname)
+	}
+	b.missingNodes = make(map[string]struct{})
+	b.pending = make(map[host.Name]map[string]struct{})
+	return hostnames
+}
+
+// takeNode returns the services pending on the node and forgets the node, once it appeared.
+func (b *localityBackfill) takeNode(nodeName string) []host.Name {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, f := b.missingNodes[nodeName]; !f {
+		return nil
+	}
+	delete(b.missingNodes, nodeName)
+	var hostnames []host.Name
+	for hostname, nodes := range b.pending {
+		if _, f := nodes[nodeName]; !f {
+			continue
+		}
+		hostnames = append(hostnames, hostname)
+		delete(nodes, nodeName)
+		if len(nodes) == 0 {
+			delete(b.pending, hostname)
+		}
+	}
+	return hostnames
+}
+
+// registerLocalityBackfillHandler builds the endpoints of the services pending on a node again
+// when the node appears after the nodes synced, such as a node whose lookup failed. It watches the
+// same node informer used for pod locality.
+func (c *Controller) registerLocalityBackfillHandler() {
+	nodeInformer := c.nodeMetadataInformer
+	if nodeInformer == nil {
+		nodeInformer = c.nodeInformer
+	}
+	c.addEventHandler(nodeInformer, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			// Before, all the pending services are built again once the nodes synced.
+			if !c.nodesSynced() {
+				return
+			}
+			nodeMeta, err := meta.Accessor(obj)
+			if err != nil {
+				return
+			}
+			nodeName := nodeMeta.GetName()
+			if !c.localityBackfill.isMissing(nodeName) {
+				return
+			}
+			c.queue.Push(func() error {
+				c.backfillLocality(c.localityBackfill.takeNode(nodeName))
+				return nil
+			})
+		},
+	})
+}
+
+// backfillLocality builds the endpoints of the services again, now that the nodes their locality
+// was missing from are known. It runs on the queue, like the other handlers updating EDS.
+func (c *Controller) backfillLocality(hostnames []host.Name) {
+	for _, hostname := range hostnames {
+		c.RLock()
+		svc := c.servicesMap[hostname]
+		c.RUnlock()
+		if svc == nil {
+			continue
+		}
+		c.endpointsController().UpdateServiceEDS(c, svc)
+		localityBackfills.Increment()
+	}
+}
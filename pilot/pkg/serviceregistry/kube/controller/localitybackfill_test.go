@@ -0,0 +1,151 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+func TestLocalityBackfillTracking(t *testing.T) {
+	b := newLocalityBackfill("cluster1")
+	local := func(node, locality string) *model.IstioEndpoint {
+		return &model.IstioEndpoint{NodeName: node, Locality: model.Locality{Label: locality, ClusterID: "cluster1"}}
+	}
+
+	b.nodeMissing("node1")
+	b.nodeMissing("node2")
+	b.record("a.com", []*model.IstioEndpoint{local("node1", "")})
+	b.record("b.com", []*model.IstioEndpoint{local("node1", ""), local("node2", "")})
+	// Endpoints with a locality, or from another cluster, are not pending.
+	b.record("c.com", []*model.IstioEndpoint{
+		local("node1", "r/z/"),
+		{NodeName: "node1", Locality: model.Locality{ClusterID: "cluster2"}},
+	})
+
+	if got := b.takeNode("node3"); len(got) != 0 {
+		t.Fatalf("expected no service pending on a node that was not missing, got %v", got)
+	}
+	if got := b.takeNode("node2"); !reflect.DeepEqual(got, []host.Name{"b.com"}) {
+		t.Fatalf("expected b.com to be pending on node2, got %v", got)
+	}
+	// Built again before node1 appeared, b.com is only pending on node1 now.
+	b.record("b.com", []*model.IstioEndpoint{local("node1", ""), local("node2", "r/z/")})
+	got := map[host.Name]bool{}
+	for _, hostname := range b.takeNode("node1") {
+		got[hostname] = true
+	}
+	if want := map[host.Name]bool{"a.com": true, "b.com": true}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v to be pending on node1, got %v", want, got)
+	}
+	if got := b.takeAll(); len(got) != 0 {
+		t.Fatalf("expected no service left pending, got %v", got)
+	}
+}
+
+func TestLocalityBackfillAfterNodesSync(t *testing.T) {
+	c, q, fx := newUnstartedController(t)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go c.serviceInformer.Run(stop)
+	go c.pods.informer.Run(stop)
+	go c.pods.replicaSetInformer.Run(stop)
+	cache.WaitForCacheSync(stop, c.servicesSynced, c.podsSynced)
+
+	// The endpoints of the services are built before the nodes synced.
+	endpoints := c.endpoints.(*endpointsController)
+	pods := []*coreV1.Pod{
+		generatePod("128.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "a"}, nil),
+		generatePod("128.0.0.2", "pod2", "nsA", "", "node1", map[string]string{"app": "b"}, nil),
+		// The locality of pods with the label does not depend on their node.
+		generatePod("128.0.0.3", "pod3", "nsA", "", "node1", map[string]string{"app": "c", model.LocalityLabel: "r.z.s"}, nil),
+	}
+	for i, pod := range pods {
+		name := []string{"svc1", "svc2", "svc3"}[i]
+		if err := c.pods.informer.GetStore().Add(pod); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.pods.onEvent(pod, model.EventAdd); err != nil {
+			t.Fatal(err)
+		}
+		svc := &coreV1.Service{
+			ObjectMeta: metaV1.ObjectMeta{Name: name, Namespace: "nsA"},
+			Spec: coreV1.ServiceSpec{
+				ClusterIP: "10.0.0.1",
+				Ports:     []coreV1.ServicePort{{Name: "tcp-port", Port: 8080}},
+				Selector:  pod.Labels,
+			},
+		}
+		if err := c.onServiceEvent(svc, model.EventAdd); err != nil {
+			t.Fatal(err)
+		}
+		ep := &coreV1.Endpoints{
+			ObjectMeta: metaV1.ObjectMeta{Name: name, Namespace: "nsA"},
+			Subsets: []coreV1.EndpointSubset{{
+				Addresses: []coreV1.EndpointAddress{{IP: pod.Status.PodIP}},
+				Ports:     []coreV1.EndpointPort{{Name: "tcp-port", Port: 8080}},
+			}},
+		}
+		if err := endpoints.informer.GetStore().Add(ep); err != nil {
+			t.Fatal(err)
+		}
+		if err := endpoints.onEvent(ep, model.EventAdd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.flush()
+	fx.Clear()
+
+	before := sumValue(t, "pilot_k8s_locality_backfills", nil)
+	addNodes(t, c, generateNode("node1", map[string]string{NodeRegionLabelGA: "r1", NodeZoneLabelGA: "z1"}))
+	go c.nodeMetadataInformer.Run(stop)
+	go c.filteredNodeInformer.Run(stop)
+	c.reconcileNodeLocality(stop)
+	q.flush()
+
+	pushes := map[string]int{}
+	for done := false; !done; {
+		select {
+		case ev := <-fx.Events:
+			if ev.Type != "eds" {
+				continue
+			}
+			pushes[ev.ID]++
+			if locality := ev.Endpoints[0].Locality.Label; locality != "r1/z1/" {
+				t.Errorf("expected the endpoints of %s to be built with the locality of their node, got %q", ev.ID, locality)
+			}
+		default:
+			done = true
+		}
+	}
+	want := map[string]int{
+		"svc1.nsA.svc.company.com": 1,
+		"svc2.nsA.svc.company.com": 1,
+	}
+	if !reflect.DeepEqual(pushes, want) {
+		t.Fatalf("expected exactly one push of the services built without locality, got %v", pushes)
+	}
+	if got := sumValue(t, "pilot_k8s_locality_backfills", nil) - before; got != 2 {
+		t.Fatalf("expected 2 backfilled services, got %v", got)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	v1 "k8s.io/api/core/v1"
+	discoveryv1alpha1 "k8s.io/api/discovery/v1alpha1"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+)
+
+const (
+	// MCSServiceNameLabel is set by the multi-cluster services (MCS) controllers on the services
+	// they derive from a ServiceImport, and on the endpoint slices of these services.
+	MCSServiceNameLabel = "multicluster.kubernetes.io/service-name"
+	// MCSSourceClusterLabel is set by the MCS controllers on the endpoint slices they import from
+	// another cluster of the cluster set.
+	MCSSourceClusterLabel = "multicluster.kubernetes.io/source-cluster"
+)
+
+// MCSMode decides how the services derived from a ServiceImport of the multi-cluster services
+// API are handled.
+type MCSMode string
+
+const (
+	// MCSModeDisabled handles derived services like any other service.
+	MCSModeDisabled MCSMode = ""
+	// MCSModeTrustSlices models derived services with the endpoints of their slices, which span
+	// the clusters of the cluster set. Their endpoints are cluster-local, so that EDS does not merge
+	// the endpoints of the other registries with them a second time.
+	MCSModeTrustSlices MCSMode = "trust"
+	// MCSModeIgnore skips derived services, leaving the merge of the endpoints of the clusters to
+	// Istio.
+	MCSModeIgnore MCSMode = "ignore"
+)
+
+// isMCSDerivedService reports whether the service was derived from a ServiceImport.
+func isMCSDerivedService(svc *v1.Service) bool {
+	_, f := svc.Labels[MCSServiceNameLabel]
+	return f
+}
+
+// isFilteredOut reports whether the service is skipped, by the service filter, as an ignored
+// derived service or as a service of another proxy.
+func (c *Controller) isFilteredOut(svc *v1.Service) bool {
+	if c.serviceOptions.mcsMode == MCSModeIgnore && isMCSDerivedService(svc) {
+		return true
+	}
+	if c.isOtherProxyService(svc) {
+		return true
+	}
+	return c.serviceOptions.filter != nil && c.serviceOptions.filter(svc)
+}
+
+// convertService converts the service with the attributes that depend on the controller.
+func (c *Controller) convertService(svc *v1.Service) *model.Service {
+	svcConv := kube.ConvertService(*svc, c.domainSuffix(svc.Namespace), c.clusterID)
+	svcConv.Hostname = c.serviceHostname(svc.Name, svc.Namespace)
+	svcConv.Attributes.MCSDerived = c.serviceOptions.mcsMode != MCSModeDisabled && isMCSDerivedService(svc)
+	svcConv.Attributes.ClusterLocal = c.isClusterLocalService(svcConv)
+	return svcConv
+}
+
+// isClusterLocalService is isClusterLocal for a converted service. Derived services are
+// cluster-local when their slices are trusted.
+func (c *Controller) isClusterLocalService(svc *model.Service) bool {
+	return (c.serviceOptions.mcsMode == MCSModeTrustSlices && svc.Attributes.MCSDerived) || c.isClusterLocal(svc.Hostname)
+}
+
+// trustsSlices reports whether the endpoints of the slices of the service are used as is, without
+// requiring a local pod.
+func (c *Controller) trustsSlices(svc *model.Service) bool {
+	return c.serviceOptions.mcsMode == MCSModeTrustSlices && svc.Attributes.MCSDerived
+}
+
+// sliceSourceCluster returns the cluster the endpoints of the slice were imported from, or the
+// cluster of the controller.
+func (c *Controller) sliceSourceCluster(slice *discoveryv1alpha1.EndpointSlice) string {
+	if cluster := slice.Labels[MCSSourceClusterLabel]; cluster != "" {
+		return cluster
+	}
+	return c.clusterID
+}
@@ -0,0 +1,139 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	discoveryv1alpha1 "k8s.io/api/discovery/v1alpha1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+)
+
+// createMCSDerivedService creates a service derived from the ServiceImport of svc1 and its slice,
+// which imports an endpoint of cluster2.
+func createMCSDerivedService(t *testing.T, controller *Controller) {
+	t.Helper()
+	svc := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      "derived-svc1",
+			Namespace: "nsA",
+			Labels:    map[string]string{MCSServiceNameLabel: "svc1"},
+		},
+		Spec: coreV1.ServiceSpec{
+			ClusterIP: "10.0.0.2",
+			Ports:     []coreV1.ServicePort{{Name: "tcp-port", Port: 8080, Protocol: "TCP"}},
+			Type:      coreV1.ServiceTypeClusterIP,
+		},
+	}
+	if _, err := controller.client.CoreV1().Services("nsA").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	portName := "tcp-port"
+	portNum := int32(1001)
+	slice := &discoveryv1alpha1.EndpointSlice{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      "derived-svc1-cluster2",
+			Namespace: "nsA",
+			Labels: map[string]string{
+				discoveryv1alpha1.LabelServiceName: "derived-svc1",
+				MCSServiceNameLabel:                "svc1",
+				MCSSourceClusterLabel:              "cluster2",
+			},
+		},
+		Endpoints: []discoveryv1alpha1.Endpoint{{
+			Addresses: []string{"10.1.0.1"},
+			TargetRef: &coreV1.ObjectReference{Kind: "Pod", Name: "pod1", Namespace: "nsA"},
+		}},
+		Ports: []discoveryv1alpha1.EndpointPort{{Name: &portName, Port: &portNum}},
+	}
+	if _, err := controller.client.DiscoveryV1alpha1().EndpointSlices("nsA").Create(context.TODO(), slice,
+		metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMCSDerivedServices(t *testing.T) {
+	derived := kube.ServiceHostname("derived-svc1", "nsA", domainSuffix)
+
+	t.Run("trust slices", func(t *testing.T) {
+		controller, fx := newFakeControllerWithOptions(fakeControllerOptions{
+			mode:      EndpointSliceOnly,
+			clusterID: "cluster1",
+			mcsMode:   MCSModeTrustSlices,
+		})
+		defer controller.Stop()
+
+		createMCSDerivedService(t, controller)
+		for {
+			ev := fx.Wait("eds")
+			if ev == nil {
+				t.Fatal("Timeout waiting for the endpoints of the derived service")
+			}
+			if ev.ID != string(derived) {
+				continue
+			}
+			if len(ev.Endpoints) != 1 {
+				t.Fatalf("got endpoints %v, want the imported endpoint", ev.Endpoints)
+			}
+			ep := ev.Endpoints[0]
+			if ep.Address != "10.1.0.1" || ep.Locality.ClusterID != "cluster2" || !ep.ClusterLocal {
+				t.Fatalf("got endpoint %+v, want the cluster-local endpoint 10.1.0.1 of cluster2", ep)
+			}
+			break
+		}
+		svc, _ := controller.GetService(derived)
+		if svc == nil || !svc.Attributes.MCSDerived || !svc.Attributes.ClusterLocal {
+			t.Fatalf("got service %v, want a cluster-local derived service", svc)
+		}
+	})
+
+	t.Run("ignore derived services", func(t *testing.T) {
+		controller, fx := newFakeControllerWithOptions(fakeControllerOptions{
+			mode:      EndpointSliceOnly,
+			clusterID: "cluster1",
+			mcsMode:   MCSModeIgnore,
+		})
+		defer controller.Stop()
+
+		createMCSDerivedService(t, controller)
+		// The derived service and its slice are created before svc2 and its endpoints.
+		createService(controller, "svc2", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+		createEndpoints(controller, "svc2", "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+		svc2 := kube.ServiceHostname("svc2", "nsA", domainSuffix)
+		for {
+			ev := fx.Wait("eds")
+			if ev == nil {
+				t.Fatal("Timeout waiting for the endpoints of svc2")
+			}
+			if ev.ID == string(derived) {
+				t.Fatalf("unexpected endpoints of the ignored derived service: %v", ev.Endpoints)
+			}
+			if ev.ID == string(svc2) {
+				break
+			}
+		}
+		if svc, _ := controller.GetService(derived); svc != nil {
+			t.Fatalf("got service %v, want the derived service to be ignored", svc)
+		}
+		if !controller.isSkippedService(derived) {
+			t.Fatal("expected the derived service to be skipped")
+		}
+	})
+}
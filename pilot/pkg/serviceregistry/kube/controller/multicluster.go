@@ -15,6 +15,7 @@
 package controller
 
 import (
+	"fmt"
 	"strings"
 	"sync"
 	"time"
@@ -67,6 +68,10 @@ type Multicluster struct {
 	fetchCaRoot     func() map[string]string
 	caBundlePath    string
 	secretNamespace string
+
+	// remoteOptions are the options of the controllers of the remote clusters, the options set
+	// from the fields of Multicluster and the cluster ID aside.
+	remoteOptions Options
 }
 
 // NewMulticluster initializes data structure to store multicluster information
@@ -77,8 +82,8 @@ func NewMulticluster(kc kubernetes.Interface, secretNamespace string, opts Optio
 	remoteKubeController := make(map[string]*kubeController)
 	if opts.ResyncPeriod == 0 {
 		// make sure a resync time of 0 wasn't passed in.
-		opts.ResyncPeriod = 30 * time.Second
-		log.Info("Resync time was configured to 0, resetting to 30")
+		opts.ResyncPeriod = DefaultResyncPeriod
+		log.Infof("Resync time was configured to 0, resetting to %s", DefaultResyncPeriod)
 	}
 	mc := &Multicluster{
 		WatchedNamespaces:     opts.WatchedNamespaces,
@@ -92,6 +97,7 @@ func NewMulticluster(kc kubernetes.Interface, secretNamespace string, opts Optio
 		fetchCaRoot:           opts.FetchCaRoot,
 		caBundlePath:          opts.CABundlePath,
 		secretNamespace:       secretNamespace,
+		remoteOptions:         remoteOptions(opts),
 	}
 
 	_ = secretcontroller.StartSecretController(
@@ -103,6 +109,17 @@ func NewMulticluster(kc kubernetes.Interface, secretNamespace string, opts Optio
 	return mc, nil
 }
 
+// remoteOptions returns the options of the controllers of the remote clusters. The endpoint mode
+// and the options of the namespace controller and webhooks of the local cluster are left out.
+func remoteOptions(opts Options) Options {
+	opts.EndpointMode = EndpointsOnly
+	opts.FetchCaRoot = nil
+	opts.CABundlePath = ""
+	opts.Clock = nil
+	opts.ResyncPeriods = nil
+	return opts
+}
+
 // AddMemberCluster is passed to the secret controller as a callback to be called
 // when a remote cluster is added.  This function needs to set up all the handlers
 // to watch for resources being added, deleted or changed on remote clusters.
@@ -113,19 +130,21 @@ func (m *Multicluster) AddMemberCluster(clientset kubernetes.Interface, metadata
 	var remoteKubeController kubeController
 	remoteKubeController.stopCh = stopCh
 	m.m.Lock()
-	kubectl := NewController(clientset, metadataClient, Options{
-		WatchedNamespaces: m.WatchedNamespaces,
-		ResyncPeriod:      m.ResyncPeriod,
-		DomainSuffix:      m.DomainSuffix,
-		XDSUpdater:        m.XDSUpdater,
-		ClusterID:         clusterID,
-		NetworksWatcher:   m.networksWatcher,
-		Metrics:           m.metrics,
-	})
+	options := m.remoteOptions
+	options.WatchedNamespaces = m.WatchedNamespaces
+	options.ResyncPeriod = m.ResyncPeriod
+	options.DomainSuffix = m.DomainSuffix
+	options.XDSUpdater = m.XDSUpdater
+	options.ClusterID = clusterID
+	options.NetworksWatcher = m.networksWatcher
+	options.Metrics = m.metrics
+	kubectl, err := NewControllerWithValidation(clientset, metadataClient, options)
+	if err != nil {
+		m.m.Unlock()
+		return fmt.Errorf("cluster %s: %v", clusterID, err)
+	}
 
 	remoteKubeController.Controller = kubectl
-	m.serviceController.AddRegistry(kubectl)
-
 	m.remoteKubeControllers[clusterID] = &remoteKubeController
 	m.m.Unlock()
 
@@ -133,6 +152,7 @@ func (m *Multicluster) AddMemberCluster(clientset kubernetes.Interface, metadata
 	_ = kubectl.AppendInstanceHandler(func(si *model.ServiceInstance, ev model.Event) { m.updateHandler(si.Service) })
 
 	go kubectl.Run(stopCh)
+	go m.addRegistryWhenSynced(clusterID, &remoteKubeController)
 	opts := Options{
 		ResyncPeriod: m.ResyncPeriod,
 		DomainSuffix: m.DomainSuffix,
@@ -151,6 +171,28 @@ func (m *Multicluster) AddMemberCluster(clientset kubernetes.Interface, metadata
 	return nil
 }
 
+// addRegistryWhenSynced merges the remote cluster into the aggregate registry once its controller
+// has synced, so proxies are not pushed a partial view of the cluster. Nothing is merged if the
+// cluster was removed or replaced in the meantime.
+func (m *Multicluster) addRegistryWhenSynced(clusterID string, remoteKubeController *kubeController) {
+	select {
+	case <-remoteKubeController.Synced():
+	case <-remoteKubeController.stopCh:
+		return
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+	if m.remoteKubeControllers[clusterID] != remoteKubeController {
+		return
+	}
+	m.serviceController.AddRegistry(remoteKubeController.Controller)
+	log.Infof("cluster %s synced, added to the service registry", clusterID)
+	if m.XDSUpdater != nil {
+		m.XDSUpdater.ConfigUpdate(&model.PushRequest{Full: true})
+	}
+}
+
 func (m *Multicluster) UpdateMemberCluster(clientset kubernetes.Interface, metadataClient metadata.Interface,
 	dynamicClient dynamic.Interface, clusterID string) error {
 	if err := m.DeleteMemberCluster(clusterID); err != nil {
@@ -165,14 +207,21 @@ func (m *Multicluster) UpdateMemberCluster(clientset kubernetes.Interface, metad
 func (m *Multicluster) DeleteMemberCluster(clusterID string) error {
 
 	m.m.Lock()
-	defer m.m.Unlock()
 	m.serviceController.DeleteRegistry(clusterID)
-	if _, ok := m.remoteKubeControllers[clusterID]; !ok {
+	kc, ok := m.remoteKubeControllers[clusterID]
+	if !ok {
+		m.m.Unlock()
 		log.Infof("cluster %s does not exist, maybe caused by invalid kubeconfig", clusterID)
 		return nil
 	}
-	close(m.remoteKubeControllers[clusterID].stopCh)
+	close(kc.stopCh)
 	delete(m.remoteKubeControllers, clusterID)
+	m.m.Unlock()
+
+	// The endpoints and services of the cluster are cleared once the controller is done handling
+	// events, so that none of them pushes them again.
+	<-kc.terminated
+	kc.Cleanup()
 	if m.XDSUpdater != nil {
 		m.XDSUpdater.ConfigUpdate(&model.PushRequest{Full: true})
 	}
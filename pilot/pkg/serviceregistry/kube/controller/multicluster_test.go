@@ -18,6 +18,8 @@ package controller
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -32,16 +34,20 @@ import (
 	metafake "k8s.io/client-go/metadata/fake"
 	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 
+	meshconfig "istio.io/api/mesh/v1alpha1"
+
 	"istio.io/istio/pilot/pkg/serviceregistry/aggregate"
+	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/kube/secretcontroller"
 	pkgtest "istio.io/istio/pkg/test"
+	"istio.io/istio/pkg/test/util/retry"
 )
 
 const (
 	testSecretName      = "testSecretName"
 	testSecretNameSpace = "istio-system"
 	WatchedNamespaces   = "istio-system"
-	DomainSuffix        = "fake_domain"
+	DomainSuffix        = "fake-domain"
 	ResyncPeriod        = 1 * time.Second
 )
 
@@ -149,3 +155,101 @@ func Test_KubeSecretController(t *testing.T) {
 	verifyControllers(t, mc, 0, "delete remote controller")
 
 }
+
+// countingNetworksWatcher counts how often the registered handlers read the networks.
+type countingNetworksWatcher struct {
+	mu       sync.Mutex
+	reads    int
+	handlers []func()
+}
+
+func (w *countingNetworksWatcher) Networks() *meshconfig.MeshNetworks {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.reads++
+	return nil
+}
+
+func (w *countingNetworksWatcher) AddNetworksHandler(h func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.handlers = append(w.handlers, h)
+}
+
+func (w *countingNetworksWatcher) notify() {
+	w.mu.Lock()
+	handlers := append([]func(){}, w.handlers...)
+	w.mu.Unlock()
+	for _, h := range handlers {
+		h()
+	}
+}
+
+func (w *countingNetworksWatcher) getReads() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.reads
+}
+
+func TestRemoteClusterLifecycle(t *testing.T) {
+	networksWatcher := &countingNetworksWatcher{}
+	mc := &Multicluster{
+		DomainSuffix:          DomainSuffix,
+		ResyncPeriod:          ResyncPeriod,
+		serviceController:     aggregate.NewController(),
+		XDSUpdater:            NewFakeXDS(),
+		networksWatcher:       networksWatcher,
+		remoteKubeControllers: make(map[string]*kubeController),
+	}
+
+	clientset := fake.NewSimpleClientset()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "svc1", Namespace: "nsA"},
+		Spec: v1.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+			Ports:     []v1.ServicePort{{Name: "http", Port: 80, Protocol: v1.ProtocolTCP}},
+		},
+	}
+	if _, err := clientset.CoreV1().Services("nsA").Create(context.TODO(), svc, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	scheme := runtime.NewScheme()
+	metav1.AddMetaToScheme(scheme)
+	if err := mc.AddMemberCluster(clientset, metafake.NewSimpleMetadataClient(scheme), nil, "cluster2"); err != nil {
+		t.Fatal(err)
+	}
+	mc.m.Lock()
+	remote := mc.remoteKubeControllers["cluster2"].Controller
+	mc.m.Unlock()
+
+	// The cluster is only merged once synced, so its services are known as soon as it is.
+	hostname := host.Name("svc1.nsA.svc." + DomainSuffix)
+	retry.UntilSuccessOrFail(t, func() error {
+		if len(mc.serviceController.GetRegistries()) == 0 {
+			return fmt.Errorf("cluster2 not added to the service registry")
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+	if s, _ := mc.serviceController.GetService(hostname); s == nil {
+		t.Fatalf("expected %s to be known once cluster2 is added", hostname)
+	}
+
+	if err := mc.DeleteMemberCluster("cluster2"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-remote.terminated:
+	case <-time.After(5 * time.Second):
+		t.Fatal("remote cluster controller not terminated")
+	}
+	if got := len(mc.serviceController.GetRegistries()); got != 0 {
+		t.Fatalf("expected no registries after removing cluster2, got %d", got)
+	}
+
+	// The networks watcher outlives the remote cluster and must no longer call into its controller.
+	reads := networksWatcher.getReads()
+	networksWatcher.notify()
+	if got := networksWatcher.getReads(); got != reads {
+		t.Fatalf("expected the networks handler of the removed controller to be detached")
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yl2chen/cidranger"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/pkg/log"
+)
+
+// NetworkLabel on the system namespace names the network of the registry. It is only used when
+// the mesh networks configuration does not assign a network to the registry.
+const NetworkLabel = "topology.istio.io/network"
+
+// newSystemNamespaceInformer watches the system namespace alone, for its network label.
+func newSystemNamespaceInformer(client kubernetes.Interface, resync time.Duration, systemNamespace string) cache.SharedIndexInformer {
+	return coreinformers.NewFilteredNamespaceInformer(client, resync, cache.Indexers{},
+		func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", systemNamespace).String()
+		})
+}
+
+// isSystemNamespace reports whether the object, or the tombstone of a deleted object, is the
+// system namespace.
+func (c *Controller) isSystemNamespace(obj interface{}) bool {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	return err == nil && key == c.systemNamespace
+}
+
+// onSystemNamespaceEvent reads the network label of the system namespace. The namespace is read
+// from the store rather than the event, so a deleted namespace or a coalesced event yield its
+// current state.
+func (c *Controller) onSystemNamespaceEvent(_ interface{}, _ model.Event) error {
+	network := ""
+	obj, exists, err := c.systemNamespaceInformer.GetStore().GetByKey(c.systemNamespace)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if ns, ok := obj.(*v1.Namespace); ok {
+			network = ns.Labels[NetworkLabel]
+		}
+	}
+	c.setRegistryNetwork(func() {
+		c.networkSources.labelNetwork = network
+	})
+	return nil
+}
+
+// systemNamespaceUpdateEqual compares the network label of the system namespace.
+func systemNamespaceUpdateEqual(old, cur interface{}) bool {
+	oldNs, ok := old.(*v1.Namespace)
+	if !ok {
+		return false
+	}
+	curNs, ok := cur.(*v1.Namespace)
+	if !ok {
+		return false
+	}
+	return oldNs.Labels[NetworkLabel] == curNs.Labels[NetworkLabel]
+}
+
+// networkSources are the sources of the network lookup, see setRegistryNetwork.
+type networkSources struct {
+	// mu guards the sources and serializes the updates of the lookup.
+	mu sync.Mutex
+	// The network of the registry is meshNetworkForRegistry, as specified by the MeshNetworks
+	// configmap, else labelNetwork, the NetworkLabel of the system namespace. meshNetworkRanger,
+	// a CIDR ranger based on path-compressed prefix trie, holds the CIDRs of the MeshNetworks.
+	meshNetworkForRegistry string
+	meshNetworkRanger      cidranger.Ranger
+	labelNetwork           string
+}
+
+// networkLookup is the state the networks of the endpoints are read from. It is never modified,
+// setRegistryNetwork replaces it whole, so the EDS builds read a consistent one without locking.
+type networkLookup struct {
+	// registry is the network all endpoints of the registry belong to, if any.
+	registry string
+	// ranger maps the CIDRs of the mesh networks to their names, nil without mesh networks.
+	ranger cidranger.Ranger
+}
+
+// endpointNetwork returns the network of the endpoint IP: the network of the registry, else the
+// one of the mesh networks CIDRs containing it, if any.
+func (l *networkLookup) endpointNetwork(endpointIP string) string {
+	// If the network of the registry is set then all endpoints discovered by this registry
+	// belong to the configured network so simply return it
+	if l.registry != "" {
+		return l.registry
+	}
+
+	// Try to determine the network by checking whether the endpoint IP belongs
+	// to any of the configure networks' CIDR ranges
+	if l.ranger == nil {
+		return ""
+	}
+	entries, err := l.ranger.ContainingNetworks(net.ParseIP(endpointIP))
+	if err != nil {
+		log.Errora(err)
+		return ""
+	}
+	if len(entries) == 0 {
+		return ""
+	}
+	if len(entries) > 1 {
+		log.Warnf("Found multiple networks CIDRs matching the endpoint IP: %s. Using the first match.", endpointIP)
+	}
+
+	return (entries[0].(namedRangerEntry)).name
+}
+
+// networkLookup returns the current network lookup, empty before the first update.
+func (c *Controller) networkLookup() *networkLookup {
+	if l, ok := c.network.Load().(*networkLookup); ok {
+		return l
+	}
+	return &networkLookup{}
+}
+
+// setRegistryNetwork applies update to the network sources of the registry and replaces the
+// network lookup: the network of the registry is the one the mesh networks configuration assigns
+// to it, else the network label of the system namespace. The endpoints of all services are built
+// again when it changes, as the network is set on each of them.
+func (c *Controller) setRegistryNetwork(update func()) {
+	c.networkSources.mu.Lock()
+	update()
+	previous := c.networkLookup().registry
+	current := &networkLookup{registry: c.networkSources.meshNetworkForRegistry, ranger: c.networkSources.meshNetworkRanger}
+	if current.registry == "" {
+		current.registry = c.networkSources.labelNetwork
+	}
+	c.network.Store(current)
+	c.networkSources.mu.Unlock()
+
+	if current.registry == previous {
+		return
+	}
+	log.Infof("Network of cluster %s changed from %q to %q", c.clusterID, previous, current.registry)
+	c.queue.Push(c.rebuildAllEDS)
+}
+
+// registryNetwork returns the network all endpoints of the registry belong to, if any.
+func (c *Controller) registryNetwork() string {
+	return c.networkLookup().registry
+}
@@ -0,0 +1,268 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	meshconfig "istio.io/api/mesh/v1alpha1"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/mesh"
+)
+
+func networkNamespace(name, network string) *coreV1.Namespace {
+	ns := &coreV1.Namespace{ObjectMeta: metaV1.ObjectMeta{Name: name}}
+	if network != "" {
+		ns.Labels = map[string]string{NetworkLabel: network}
+	}
+	return ns
+}
+
+// expectEndpointsNetwork waits for the endpoints of svc1 to be pushed on the network.
+func expectEndpointsNetwork(t *testing.T, fx *FakeXdsUpdater, network string) {
+	t.Helper()
+	hostname := string(kube.ServiceHostname("svc1", "nsA", domainSuffix))
+	got := "<none>"
+	for {
+		ev := fx.Wait("eds")
+		if ev == nil {
+			t.Fatalf("Timeout waiting for the endpoints on network %q, last got %q", network, got)
+		}
+		if ev.ID != hostname {
+			continue
+		}
+		if got = ev.Endpoints[0].Network; got == network {
+			return
+		}
+	}
+}
+
+func createNetworkTestEndpoints(t *testing.T, controller *Controller) {
+	t.Helper()
+	pod := generatePod("128.0.0.1", "svc1", "nsA", "", "", map[string]string{"app": "prod-app"}, nil)
+	addPods(t, controller, pod)
+	if err := waitForPod(controller, "128.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+}
+
+func TestRegistryNetworkPrecedence(t *testing.T) {
+	meshNetworks := func(registry string) mesh.NetworksWatcher {
+		return mesh.NewFixedNetworksWatcher(&meshconfig.MeshNetworks{
+			Networks: map[string]*meshconfig.Network{
+				"nw-mesh": {
+					Endpoints: []*meshconfig.Network_NetworkEndpoints{{
+						Ne: &meshconfig.Network_NetworkEndpoints_FromRegistry{FromRegistry: registry},
+					}},
+				},
+			},
+		})
+	}
+	cases := []struct {
+		name            string
+		networksWatcher mesh.NetworksWatcher
+		objects         []runtime.Object
+		want            string
+	}{
+		{
+			name:    "label",
+			objects: []runtime.Object{networkNamespace(IstioNamespace, "nw-label")},
+			want:    "nw-label",
+		},
+		{
+			name:            "mesh networks",
+			networksWatcher: meshNetworks("cluster1"),
+			objects:         []runtime.Object{networkNamespace(IstioNamespace, "nw-label")},
+			want:            "nw-mesh",
+		},
+		{
+			name:            "mesh networks of another registry",
+			networksWatcher: meshNetworks("cluster2"),
+			objects:         []runtime.Object{networkNamespace(IstioNamespace, "nw-label")},
+			want:            "nw-label",
+		},
+		{
+			name:    "label of another namespace",
+			objects: []runtime.Object{networkNamespace("nsA", "nw-other"), networkNamespace(IstioNamespace, "")},
+			want:    "",
+		},
+	}
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{
+				clusterID:       "cluster1",
+				networksWatcher: tc.networksWatcher,
+				objects:         tc.objects,
+			})
+			defer controller.Stop()
+			select {
+			case <-controller.Synced():
+			case <-time.After(5 * time.Second):
+				t.Fatal("Timeout waiting for the controller to sync")
+			}
+			if got := controller.registryNetwork(); got != tc.want {
+				t.Fatalf("got network %q, want %q", got, tc.want)
+			}
+
+			createNetworkTestEndpoints(t, controller)
+			expectEndpointsNetwork(t, fx, tc.want)
+		})
+	}
+}
+
+func TestRegistryNetworkLabelChange(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{
+				mode:    mode,
+				objects: []runtime.Object{networkNamespace(IstioNamespace, "")},
+			})
+			defer controller.Stop()
+
+			createNetworkTestEndpoints(t, controller)
+			expectEndpointsNetwork(t, fx, "")
+
+			// Labeling the system namespace later moves the existing endpoints to its network.
+			for _, network := range []string{"nw1", "nw2", ""} {
+				_, err := controller.client.CoreV1().Namespaces().Update(context.TODO(),
+					networkNamespace(IstioNamespace, network), metaV1.UpdateOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				expectEndpointsNetwork(t, fx, network)
+			}
+		})
+	}
+}
+
+// mutableNetworksWatcher serves mesh networks that can be replaced, notifying the handlers.
+type mutableNetworksWatcher struct {
+	mu       sync.Mutex
+	networks *meshconfig.MeshNetworks
+	handlers []func()
+}
+
+func (w *mutableNetworksWatcher) Networks() *meshconfig.MeshNetworks {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.networks
+}
+
+func (w *mutableNetworksWatcher) AddNetworksHandler(h func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.handlers = append(w.handlers, h)
+}
+
+func (w *mutableNetworksWatcher) set(networks *meshconfig.MeshNetworks) {
+	w.mu.Lock()
+	w.networks = networks
+	handlers := append([]func(){}, w.handlers...)
+	w.mu.Unlock()
+	for _, h := range handlers {
+		h()
+	}
+}
+
+// TestNetworkLookupConcurrentUpdates changes the mesh networks while endpoints are built, for the
+// race detector, and checks each endpoint gets the network of one of the configurations.
+func TestNetworkLookupConcurrentUpdates(t *testing.T) {
+	cidrNetworks := func(network string) *meshconfig.MeshNetworks {
+		return &meshconfig.MeshNetworks{
+			Networks: map[string]*meshconfig.Network{
+				network: {
+					Endpoints: []*meshconfig.Network_NetworkEndpoints{{
+						Ne: &meshconfig.Network_NetworkEndpoints_FromCidr{FromCidr: "10.0.0.0/8"},
+					}},
+				},
+			},
+		}
+	}
+	registryNetworks := &meshconfig.MeshNetworks{
+		Networks: map[string]*meshconfig.Network{
+			"nw-registry": {
+				Endpoints: []*meshconfig.Network_NetworkEndpoints{{
+					Ne: &meshconfig.Network_NetworkEndpoints_FromRegistry{FromRegistry: "cluster1"},
+				}},
+			},
+		},
+	}
+	configs := []*meshconfig.MeshNetworks{cidrNetworks("nw1"), nil, cidrNetworks("nw2"), registryNetworks}
+
+	watcher := &mutableNetworksWatcher{networks: configs[0]}
+	controller, _ := newFakeControllerWithOptions(fakeControllerOptions{
+		clusterID:       "cluster1",
+		networksWatcher: watcher,
+	})
+	defer controller.Stop()
+	select {
+	case <-controller.Synced():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the controller to sync")
+	}
+	if got := controller.endpointNetwork("10.0.0.1"); got != "nw1" {
+		t.Fatalf("got network %q, want nw1", got)
+	}
+
+	const updates = 200
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= updates; i++ {
+			watcher.set(configs[i%len(configs)])
+		}
+	}()
+	errs := make(chan string, 1)
+	go func() {
+		defer wg.Done()
+		builder := NewEndpointBuilder(controller, nil)
+		for i := 0; i < 10*updates; i++ {
+			switch network := builder.buildIstioEndpoint("10.0.0.1", 8080, "tcp-port").Network; network {
+			case "", "nw1", "nw2", "nw-registry":
+			default:
+				select {
+				case errs <- network:
+				default:
+				}
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	if network, f := <-errs; f {
+		t.Fatalf("unexpected network %q", network)
+	}
+	watcher.set(registryNetworks)
+	if got, want := controller.endpointNetwork("10.0.0.1"), controller.endpointNetwork("192.168.0.1"); got != want {
+		t.Fatalf("expected the network of the registry for all endpoints, got %q and %q", got, want)
+	}
+	if got := controller.registryNetwork(); got != "nw-registry" {
+		t.Fatalf("got registry network %q, want nw-registry", got)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/metadata"
+
+	"istio.io/pkg/monitoring"
+)
+
+const (
+	// defaultNodeLookupTimeout bounds a single direct node GET.
+	defaultNodeLookupTimeout = time.Second
+	// defaultNodeLookupRetryInterval is how long a failed node, or a tripped breaker, is skipped for.
+	defaultNodeLookupRetryInterval = 30 * time.Second
+	// defaultNodeLookupMaxFailures is the number of consecutive failures that trips the breaker.
+	defaultNodeLookupMaxFailures = 5
+)
+
+var (
+	errNodeLookupSkipped = errors.New("direct node lookup skipped")
+
+	nodeLookupAttempts = monitoring.NewSum(
+		"pilot_k8s_node_fallback_attempts",
+		"Direct API server node lookups made because the node was not in the informer cache.")
+
+	nodeLookupSuccesses = monitoring.NewSum(
+		"pilot_k8s_node_fallback_successes",
+		"Direct API server node lookups that succeeded.")
+)
+
+func init() {
+	monitoring.MustRegister(nodeLookupAttempts)
+	monitoring.MustRegister(nodeLookupSuccesses)
+}
+
+// nodeLookup fetches node metadata straight from the API server when the node informer misses.
+// Every lookup runs on the controller queue, so it is bounded by a timeout, failed nodes are
+// remembered for a while, and after too many consecutive failures all lookups are skipped until
+// the retry interval has passed.
+type nodeLookup struct {
+	client metadata.Interface
+	clock  Clock
+
+	timeout       time.Duration
+	retryInterval time.Duration
+	maxFailures   int
+
+	mu sync.Mutex
+	// failedNodes maps a node name to the time a lookup for it may be attempted again.
+	failedNodes map[string]time.Time
+	// consecutiveFailures counts failed lookups since the last success.
+	consecutiveFailures int
+	// skipUntil is set when the breaker trips; no lookups are made before it.
+	skipUntil time.Time
+}
+
+func newNodeLookup(client metadata.Interface, clock Clock) *nodeLookup {
+	return &nodeLookup{
+		client:        client,
+		clock:         clock,
+		timeout:       defaultNodeLookupTimeout,
+		retryInterval: defaultNodeLookupRetryInterval,
+		maxFailures:   defaultNodeLookupMaxFailures,
+		failedNodes:   make(map[string]time.Time),
+	}
+}
+
+// get returns the metadata of the named node, or errNodeLookupSkipped if the node recently failed
+// or the breaker is open.
+func (n *nodeLookup) get(name string) (*metav1.PartialObjectMetadata, error) {
+	now := n.clock.Now()
+	n.mu.Lock()
+	if retryAt, f := n.failedNodes[name]; f {
+		if now.Before(retryAt) {
+			n.mu.Unlock()
+			return nil, errNodeLookupSkipped
+		}
+		delete(n.failedNodes, name)
+	}
+	if now.Before(n.skipUntil) {
+		n.mu.Unlock()
+		return nil, errNodeLookupSkipped
+	}
+	n.mu.Unlock()
+
+	nodeLookupAttempts.Increment()
+	node, err := n.getWithTimeout(name)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err != nil {
+		n.failedNodes[name] = now.Add(n.retryInterval)
+		n.consecutiveFailures++
+		if n.consecutiveFailures >= n.maxFailures {
+			n.skipUntil = now.Add(n.retryInterval)
+			n.consecutiveFailures = 0
+		}
+		return nil, err
+	}
+	nodeLookupSuccesses.Increment()
+	delete(n.failedNodes, name)
+	n.consecutiveFailures = 0
+	return node, nil
+}
+
+// getWithTimeout does not rely on the client honouring the context, so a hung request cannot hold
+// up the caller for longer than the timeout.
+func (n *nodeLookup) getWithTimeout(name string) (*metav1.PartialObjectMetadata, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+	defer cancel()
+
+	type result struct {
+		node *metav1.PartialObjectMetadata
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		nodeResource := schema.GroupVersionResource{Group: "", Version: "v1", Resource: "nodes"}
+		node, err := n.client.Resource(nodeResource).Get(ctx, name, metav1.GetOptions{})
+		ch <- result{node, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.node, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
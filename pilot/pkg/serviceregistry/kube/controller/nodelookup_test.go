@@ -0,0 +1,124 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	metafake "k8s.io/client-go/metadata/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newFailingNodeLookup(delay time.Duration) (*nodeLookup, *int32, *FakeClock) {
+	scheme := runtime.NewScheme()
+	metav1.AddMetaToScheme(scheme)
+	client := metafake.NewSimpleMetadataClient(scheme)
+
+	var calls int32
+	client.PrependReactor("get", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(delay)
+		return true, nil, errors.New("apiserver unavailable")
+	})
+	clock := NewFakeClock(time.Unix(0, 0))
+	return newNodeLookup(client, clock), &calls, clock
+}
+
+func TestNodeLookupTimeout(t *testing.T) {
+	lookup, _, _ := newFailingNodeLookup(time.Second)
+	lookup.timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	if _, err := lookup.get("node1"); err == nil {
+		t.Fatal("expected lookup to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("lookup blocked for %v, expected at most the %v timeout", elapsed, lookup.timeout)
+	}
+}
+
+func TestNodeLookupNegativeCache(t *testing.T) {
+	lookup, calls, clock := newFailingNodeLookup(0)
+
+	if _, err := lookup.get("node1"); err == nil || err == errNodeLookupSkipped {
+		t.Fatalf("expected API error, got %v", err)
+	}
+	if _, err := lookup.get("node1"); err != errNodeLookupSkipped {
+		t.Fatalf("expected failed node to be skipped, got %v", err)
+	}
+	if got := atomic.LoadInt32(calls); got != 1 {
+		t.Fatalf("expected 1 API call, got %d", got)
+	}
+
+	// Once the retry interval has passed the node is looked up again.
+	clock.Step(lookup.retryInterval - time.Millisecond)
+	if _, err := lookup.get("node1"); err != errNodeLookupSkipped {
+		t.Fatalf("expected failed node to be skipped within the retry interval, got %v", err)
+	}
+	clock.Step(time.Millisecond)
+	if _, err := lookup.get("node1"); err == errNodeLookupSkipped {
+		t.Fatal("expected node to be retried after the retry interval")
+	}
+	if got := atomic.LoadInt32(calls); got != 2 {
+		t.Fatalf("expected 2 API calls, got %d", got)
+	}
+}
+
+func TestNodeLookupBreaker(t *testing.T) {
+	lookup, calls, clock := newFailingNodeLookup(0)
+	lookup.maxFailures = 3
+
+	for i := 0; i < lookup.maxFailures; i++ {
+		if _, err := lookup.get(fmt.Sprintf("node%d", i)); err == errNodeLookupSkipped {
+			t.Fatalf("lookup %d skipped before the breaker tripped", i)
+		}
+	}
+	// The breaker is open, so even nodes that never failed are skipped.
+	if _, err := lookup.get("other"); err != errNodeLookupSkipped {
+		t.Fatalf("expected lookup to be skipped by the breaker, got %v", err)
+	}
+	if got := atomic.LoadInt32(calls); got != int32(lookup.maxFailures) {
+		t.Fatalf("expected %d API calls, got %d", lookup.maxFailures, got)
+	}
+
+	clock.Step(lookup.retryInterval)
+	if _, err := lookup.get("other"); err == errNodeLookupSkipped {
+		t.Fatal("expected lookups to resume after the retry interval")
+	}
+}
+
+func TestGetPodLocalityNodeLookupTimeout(t *testing.T) {
+	controller, _ := newFakeControllerWithOptions(fakeControllerOptions{})
+	defer controller.Stop()
+
+	lookup, _, _ := newFailingNodeLookup(time.Second)
+	lookup.timeout = 50 * time.Millisecond
+	controller.nodeLookup = lookup
+
+	pod := generatePod("128.0.0.1", "pod1", "nsA", "", "missing-node", map[string]string{}, map[string]string{})
+	start := time.Now()
+	if locality := controller.getPodLocality(pod); locality != "" {
+		t.Fatalf("expected empty locality, got %q", locality)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("getPodLocality blocked for %v", elapsed)
+	}
+}
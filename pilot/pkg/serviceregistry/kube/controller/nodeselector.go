@@ -0,0 +1,143 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	klabels "k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/labels"
+)
+
+// InvalidNodeSelectorReason is the reason of the warning events of services with an invalid
+// NodeSelectorAnnotation.
+const InvalidNodeSelectorReason = "InvalidNodeSelector"
+
+var invalidNodeSelectors = monitoring.NewSum(
+	"pilot_k8s_invalid_node_selectors",
+	"Node port gateway services found with an invalid node selector annotation.",
+	monitoring.WithLabels(namespaceTag),
+)
+
+func init() {
+	monitoring.MustRegister(invalidNodeSelectors)
+}
+
+// nodeSelector is the node selector of a node port gateway service or of a node handler, along
+// with the selector compiled from it once, rather than on every node it is matched against.
+type nodeSelector struct {
+	labels labels.Instance
+	// matcher is nil when a label of the selector has an empty value: labels.Instance.SubsetOf
+	// matches it with the nodes without the label, which the compiled selector does not, and the
+	// selectors keep matching the nodes they always did.
+	matcher klabels.Selector
+}
+
+func newNodeSelector(selector labels.Instance) nodeSelector {
+	for _, value := range selector {
+		if value == "" {
+			return nodeSelector{labels: selector}
+		}
+	}
+	return nodeSelector{labels: selector, matcher: klabels.Set(selector).AsSelectorPreValidated()}
+}
+
+// matches reports whether the labels of a node match the selector. A nil or empty selector
+// matches every node.
+func (s nodeSelector) matches(nodeLabels labels.Instance) bool {
+	if s.matcher == nil {
+		return s.labels.SubsetOf(nodeLabels)
+	}
+	return s.matcher.Matches(klabels.Set(nodeLabels))
+}
+
+// nodeSelectorForService returns the node selector of a node port gateway service. When the
+// annotation is invalid, the error says why and the selector is nil.
+func (c *Controller) nodeSelectorForService(svc *v1.Service) (labels.Instance, error) {
+	selector, state, err := kube.ParseNodeSelector(svc.Annotations[kube.NodeSelectorAnnotation])
+	if state == kube.NodeSelectorInvalid {
+		return nil, err
+	}
+	return selector, nil
+}
+
+// reportInvalidNodeSelector reports the invalid node selector annotation of a service with a log,
+// a metric and a warning event on the service.
+func (c *Controller) reportInvalidNodeSelector(svc *v1.Service, err error) {
+	effect := "it selects no node"
+	if c.gateways.legacyNodeSelectors {
+		effect = "it selects every node"
+	}
+	message := fmt.Sprintf("invalid %s annotation, %s: %v", kube.NodeSelectorAnnotation, effect, err)
+	log.Warnf("service %s/%s: %s", svc.Namespace, svc.Name, message)
+	invalidNodeSelectors.With(namespaceTag.Value(svc.Namespace)).Increment()
+	c.recordServiceWarning(svc, InvalidNodeSelectorReason, message)
+}
+
+// newServiceEventRecorder returns the recorder of the warning events on services, and the
+// broadcaster sending them to the API server while the controller runs. Both are nil without client.
+// The broadcaster lives as long as the controller and is never shut down: the recorder hands each
+// event to it from a goroutine of its own, which could still be sending once the broadcaster is
+// closed. Run only stops the watcher recording to the sink.
+func newServiceEventRecorder(client kubernetes.Interface) (record.EventBroadcaster, record.EventRecorder) {
+	if client == nil {
+		// Built on injected informers, without a client to record the events with.
+		return nil, nil
+	}
+	broadcaster := record.NewBroadcaster()
+	return broadcaster, broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "istiod"})
+}
+
+// namespacedEventSink sends each event to the events of its own namespace, which the fake
+// clients require, where the API server accepts them from the events of every namespace.
+type namespacedEventSink struct {
+	client kubernetes.Interface
+}
+
+func (s namespacedEventSink) sink(event *v1.Event) *typedcorev1.EventSinkImpl {
+	return &typedcorev1.EventSinkImpl{Interface: s.client.CoreV1().Events(event.Namespace)}
+}
+
+func (s namespacedEventSink) Create(event *v1.Event) (*v1.Event, error) {
+	return s.sink(event).Create(event)
+}
+
+func (s namespacedEventSink) Update(event *v1.Event) (*v1.Event, error) {
+	return s.sink(event).Update(event)
+}
+
+func (s namespacedEventSink) Patch(event *v1.Event, data []byte) (*v1.Event, error) {
+	return s.sink(event).Patch(event, data)
+}
+
+// recordServiceWarning records a warning event on the service. The events are sent by the
+// broadcaster in the background, rather than on the queue, and failures are only logged by it:
+// events are best effort.
+func (c *Controller) recordServiceWarning(svc *v1.Service, reason, message string) {
+	if c.eventRecorder == nil {
+		return
+	}
+	c.eventRecorder.Event(svc, v1.EventTypeWarning, reason, message)
+}
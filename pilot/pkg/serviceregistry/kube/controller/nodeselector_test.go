@@ -0,0 +1,143 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+func TestInvalidNodeSelector(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		legacy := legacy
+		t.Run(fmt.Sprintf("legacy=%v", legacy), func(t *testing.T) {
+			const clusterID = "cluster1"
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{
+				clusterID:           clusterID,
+				legacyNodeSelectors: legacy,
+			})
+			defer controller.Stop()
+
+			node := &coreV1.Node{
+				ObjectMeta: metaV1.ObjectMeta{Name: "node1", Labels: map[string]string{"pool": "gateway"}},
+				Status: coreV1.NodeStatus{
+					Addresses: []coreV1.NodeAddress{{Type: coreV1.NodeExternalIP, Address: "1.2.3.4"}},
+				},
+			}
+			if _, err := controller.client.CoreV1().Nodes().Create(context.TODO(), node, metaV1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			svc := &coreV1.Service{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name:        "gateway",
+					Namespace:   "nsA",
+					Annotations: map[string]string{kube.NodeSelectorAnnotation: `{"pool": 1}`},
+				},
+				Spec: coreV1.ServiceSpec{
+					Type:      coreV1.ServiceTypeNodePort,
+					ClusterIP: "10.0.0.1",
+					Ports:     []coreV1.ServicePort{{Name: "tcp-port", Port: 8080, NodePort: 30080}},
+				},
+			}
+			services := controller.client.CoreV1().Services("nsA")
+			if _, err := services.Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+
+			hostname := kube.ServiceHostname("gateway", "nsA", domainSuffix)
+			assertExternalAddresses := func(want []string) {
+				t.Helper()
+				retry.UntilSuccessOrFail(t, func() error {
+					converted, _ := controller.GetService(hostname)
+					if converted == nil {
+						return fmt.Errorf("service not found")
+					}
+					converted.Mutex.RLock()
+					defer converted.Mutex.RUnlock()
+					if got := converted.Attributes.ClusterExternalAddresses[clusterID]; !reflect.DeepEqual(got, want) {
+						return fmt.Errorf("got external addresses %v, want %v", got, want)
+					}
+					return nil
+				}, retry.Timeout(5*time.Second))
+			}
+			// The events are recorded in the background.
+			assertWarnings := func(want int) {
+				t.Helper()
+				retry.UntilSuccessOrFail(t, func() error {
+					events, err := controller.client.CoreV1().Events("nsA").List(context.TODO(), metaV1.ListOptions{})
+					if err != nil {
+						return err
+					}
+					got := 0
+					for _, e := range events.Items {
+						if e.Reason == InvalidNodeSelectorReason && e.Type == coreV1.EventTypeWarning &&
+							e.InvolvedObject.Kind == "Service" && e.InvolvedObject.Name == "gateway" {
+							got++
+						}
+					}
+					if got != want {
+						return fmt.Errorf("got %d warning events, want %d", got, want)
+					}
+					return nil
+				}, retry.Timeout(5*time.Second))
+			}
+
+			if legacy {
+				assertExternalAddresses([]string{"1.2.3.4"})
+			} else {
+				// An invalid selector fails safe and selects no node.
+				assertExternalAddresses(nil)
+			}
+			assertWarnings(1)
+
+			// Updates keeping the same invalid value are not reported again.
+			svc.Labels = map[string]string{"app": "gateway"}
+			if _, err := services.Update(context.TODO(), svc, metaV1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout updating service")
+			}
+			assertWarnings(1)
+
+			svc.Annotations[kube.NodeSelectorAnnotation] = `{"pool": "gateway"}`
+			if _, err := services.Update(context.TODO(), svc, metaV1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout updating service")
+			}
+			assertExternalAddresses([]string{"1.2.3.4"})
+			controller.RLock()
+			_, invalid := controller.gateways.invalidNodeSelectors[hostname]
+			controller.RUnlock()
+			if invalid {
+				t.Fatal("expected the fixed selector to no longer be invalid")
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+var onDemandConversions = monitoring.NewSum(
+	"pilot_k8s_on_demand_service_conversions",
+	"Services converted while building the instances of a proxy, because their event was not handled yet.",
+)
+
+func init() {
+	monitoring.MustRegister(onDemandConversions)
+}
+
+// convertServiceOnDemand converts a service selecting a proxy that is missing from servicesMap,
+// so that the instances of the proxy can be built before the service event is handled. The
+// service is queued for handling, which adds it to servicesMap. Services that are filtered out or
+// rejected are not converted.
+func (c *Controller) convertServiceOnDemand(service *v1.Service, hostname host.Name) *model.Service {
+	c.RLock()
+	_, skipped := c.skippedServices[hostname]
+	_, rejected := c.rejectedServices[hostname]
+	c.RUnlock()
+	if skipped || rejected || c.isFilteredOut(service) {
+		return nil
+	}
+
+	svc := c.convertService(service)
+	if validateConvertedService(svc) != nil {
+		return nil
+	}
+	onDemandConversions.Increment()
+
+	c.Lock()
+	_, pending := c.pendingConversions[hostname]
+	c.pendingConversions[hostname] = struct{}{}
+	c.Unlock()
+	if pending {
+		return svc
+	}
+	log.Debugf("Converted service %s/%s on demand for proxy instances", service.Namespace, service.Name)
+	c.queue.Push(func() error {
+		c.Lock()
+		delete(c.pendingConversions, hostname)
+		_, handled := c.servicesMap[hostname]
+		c.Unlock()
+		if handled {
+			return nil
+		}
+		current, err := c.serviceLister.Services(service.Namespace).Get(service.Name)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		return c.onServiceEvent(current, model.EventAdd)
+	})
+	return svc
+}
@@ -0,0 +1,81 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+func TestConvertServiceOnDemand(t *testing.T) {
+	controller, fx := newFakeControllerWithOptions(fakeControllerOptions{})
+	defer controller.Stop()
+
+	pod := generatePod("128.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "prod-app"}, map[string]string{})
+	addPods(t, controller, pod)
+	if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+		t.Fatalf("wait for pod err: %v", err)
+	}
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	k8sSvc, err := controller.client.CoreV1().Services("nsA").Get(context.TODO(), "svc1", metaV1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostname := kube.ServiceHostname("svc1", "nsA", domainSuffix)
+	proxy := &model.Proxy{
+		IPAddresses: []string{"128.0.0.1"},
+		Metadata:    &model.NodeMetadata{Namespace: "nsA", ClusterID: controller.clusterID},
+	}
+
+	// Simulate the window before the service event is handled.
+	forget := func() {
+		controller.Lock()
+		delete(controller.servicesMap, hostname)
+		controller.Unlock()
+	}
+	forget()
+	instances := controller.getProxyServiceInstancesByPod(pod, k8sSvc, proxy)
+	if len(instances) != 1 || instances[0].Service.Hostname != hostname || instances[0].ServicePort.Port != 8080 {
+		t.Fatalf("got instances %v, want one instance of %s", instances, hostname)
+	}
+
+	// The service is queued for handling.
+	retry.UntilSuccessOrFail(t, func() error {
+		if svc, _ := controller.GetService(hostname); svc == nil {
+			return fmt.Errorf("service %s not handled", hostname)
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+
+	// Services filtered out are not converted.
+	forget()
+	controller.Lock()
+	controller.skippedServices[hostname] = struct{}{}
+	controller.Unlock()
+	if instances := controller.getProxyServiceInstancesByPod(pod, k8sSvc, proxy); len(instances) != 0 {
+		t.Fatalf("got instances %v of a skipped service, want none", instances)
+	}
+}
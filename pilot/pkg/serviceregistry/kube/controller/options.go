@@ -0,0 +1,176 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+
+	"istio.io/pkg/log"
+)
+
+// DefaultResyncPeriod is the resync period of the informers when Options.ResyncPeriod is 0.
+const DefaultResyncPeriod = 30 * time.Second
+
+// Validate checks the options, setting the defaulted ones to their effective value:
+//   - an empty DomainSuffix is an error, as the hostnames of the services would not resolve;
+//   - a 0 ResyncPeriod, which would never resync the informers, is set to DefaultResyncPeriod,
+//     while a negative one is an error;
+//   - a ResyncJitter of 1 or more, which would make resync periods non-positive, is an error;
+//   - an empty ClusterID is an error when the options tell the clusters apart, with
+//     UIDIncludesClusterID, DropForeignPodOverlaps or an MCSMode other than MCSModeDisabled;
+//   - an unknown or repeated LocalityOrder source is an error;
+//   - ExternalEndpointSliceManagers that are not valid label values are an error;
+//   - an unknown EndpointMode is set to EndpointsOnly with a warning.
+func (o *Options) Validate() error {
+	var errs []string
+	if o.DomainSuffix == "" {
+		errs = append(errs, "DomainSuffix must be set")
+	}
+	switch {
+	case o.ResyncPeriod < 0:
+		errs = append(errs, fmt.Sprintf("ResyncPeriod must not be negative, got %s", o.ResyncPeriod))
+	case o.ResyncPeriod == 0:
+		log.Infof("Resync period was configured to 0, resetting to %s", DefaultResyncPeriod)
+		o.ResyncPeriod = DefaultResyncPeriod
+	}
+	if o.ResyncJitter >= 1 {
+		errs = append(errs, fmt.Sprintf("ResyncJitter must be less than 1, got %v", o.ResyncJitter))
+	}
+	if o.ClusterID == "" {
+		if o.UIDIncludesClusterID {
+			errs = append(errs, "ClusterID must be set with UIDIncludesClusterID")
+		}
+		if o.DropForeignPodOverlaps {
+			errs = append(errs, "ClusterID must be set with DropForeignPodOverlaps")
+		}
+		if o.MCSMode != MCSModeDisabled {
+			errs = append(errs, fmt.Sprintf("ClusterID must be set with MCSMode %q", o.MCSMode))
+		}
+	}
+	if _, cidrErrs := newEndpointCIDRs(o.AllowedEndpointCIDRs, o.DeniedEndpointCIDRs); len(cidrErrs) > 0 {
+		for _, err := range cidrErrs {
+			errs = append(errs, err.Error())
+		}
+	}
+	if err := validateLocalityOrder(o.LocalityOrder); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(o.ExternalEndpointSliceManagers) > 0 {
+		if _, err := externalEndpointSliceSelector(o.ExternalEndpointSliceManagers); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if _, f := EndpointModeNames[o.EndpointMode]; !f {
+		log.Warnf("Unknown endpoint mode %d, defaulting to %s", o.EndpointMode, EndpointsOnly)
+		o.EndpointMode = EndpointsOnly
+	}
+	if len(errs) > 0 {
+		return errors.New("invalid Kubernetes service registry options: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// NewControllerE is like NewController, but first validates the options, see Options.Validate.
+func NewControllerE(client kubernetes.Interface, metadataClient metadata.Interface, options Options) (*Controller, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	return NewController(client, metadataClient, options), nil
+}
+
+// sanitized returns a copy of the options without the callbacks, watchers and updaters, which may
+// carry secrets such as the CA root and cannot be dumped.
+func (o Options) sanitized() Options {
+	o.FetchCaRoot = nil
+	o.Metrics = nil
+	o.XDSUpdater = nil
+	o.NetworksWatcher = nil
+	o.MeshWatcher = nil
+	o.ServiceFilterFunc = nil
+	o.Clock = nil
+	o.ResyncPeriods = nil
+	if o.NamespaceDomainSuffixes != nil {
+		suffixes := make(map[string]string, len(o.NamespaceDomainSuffixes))
+		for namespace, suffix := range o.NamespaceDomainSuffixes {
+			suffixes[namespace] = suffix
+		}
+		o.NamespaceDomainSuffixes = suffixes
+	}
+	o.ClusterLocalHostnames = copyStrings(o.ClusterLocalHostnames)
+	o.NodeLabelsToCopy = copyStrings(o.NodeLabelsToCopy)
+	o.ControlPlaneServices = copyStrings(o.ControlPlaneServices)
+	o.ServiceProxyNames = copyStrings(o.ServiceProxyNames)
+	o.AllowedEndpointCIDRs = copyStrings(o.AllowedEndpointCIDRs)
+	o.DeniedEndpointCIDRs = copyStrings(o.DeniedEndpointCIDRs)
+	o.ExternalEndpointSliceManagers = copyStrings(o.ExternalEndpointSliceManagers)
+	o.CrossNamespaceEndpointNamespaces = copyStrings(o.CrossNamespaceEndpointNamespaces)
+	if o.ReservedProxyPorts != nil {
+		o.ReservedProxyPorts = append([]int32{}, o.ReservedProxyPorts...)
+	}
+	if o.LocalityOrder != nil {
+		o.LocalityOrder = append([]LocalitySource{}, o.LocalityOrder...)
+	}
+	return o
+}
+
+// copyStrings copies s, keeping a nil s nil, as some options tell nil and empty apart.
+func copyStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+// Options returns the options the controller was built with, for diagnostics. Defaulted options
+// are set to their effective value, and ResyncPeriods to the jittered resync periods. FetchCaRoot,
+// Metrics, XDSUpdater, NetworksWatcher, MeshWatcher and ServiceFilterFunc are left out.
+func (c *Controller) Options() Options {
+	o := c.options.sanitized()
+	o.EndpointMode = c.EndpointMode()
+	o.NodeLabelPrefix = c.endpointOptions.nodeLabelPrefix
+	o.ProxyContainerName = c.endpointOptions.proxyContainerName
+	o.SystemNamespace = c.systemNamespace
+	if o.ControlPlaneServices == nil {
+		o.ControlPlaneServices = copyStrings(DefaultControlPlaneServices)
+	}
+	if o.ReservedProxyPorts == nil {
+		o.ReservedProxyPorts = append([]int32{}, DefaultReservedProxyPorts...)
+	}
+	if o.LocalityOrder == nil {
+		o.LocalityOrder = append([]LocalitySource{}, DefaultLocalityOrder...)
+	}
+	o.ResyncPeriods = make(map[string]time.Duration, len(c.resyncPeriods))
+	for resource, period := range c.resyncPeriods {
+		o.ResyncPeriods[resource] = period
+	}
+	return o
+}
+
+// WatchedNamespaces returns the namespaces the controller watches, comma separated, or "" for
+// all namespaces.
+func (c *Controller) WatchedNamespaces() string {
+	return c.options.WatchedNamespaces
+}
+
+// DomainSuffix returns the default domain suffix of the hostnames of the services.
+func (c *Controller) DomainSuffix() string {
+	return c.options.DomainSuffix
+}
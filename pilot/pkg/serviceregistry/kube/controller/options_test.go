@@ -0,0 +1,256 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	metafake "k8s.io/client-go/metadata/fake"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestOptionsSanitized(t *testing.T) {
+	options := Options{
+		ClusterID:               "cluster1",
+		EndpointMode:            EndpointSliceOnly,
+		FetchCaRoot:             func() map[string]string { return map[string]string{"root-cert.pem": "secret"} },
+		Metrics:                 &model.Environment{},
+		XDSUpdater:              NewFakeXDS(),
+		NamespaceDomainSuffixes: map[string]string{"tenant-*": "tenant.local"},
+		ControlPlaneServices:    []string{},
+	}
+	sanitized := options.sanitized()
+	if sanitized.FetchCaRoot != nil || sanitized.Metrics != nil || sanitized.XDSUpdater != nil {
+		t.Fatalf("expected the callbacks and updaters to be left out, got %+v", sanitized)
+	}
+	if options.FetchCaRoot == nil || options.XDSUpdater == nil {
+		t.Fatal("expected the original options to be unchanged")
+	}
+	if sanitized.ControlPlaneServices == nil {
+		t.Fatal("expected an empty ControlPlaneServices to stay empty rather than nil")
+	}
+
+	// The copy does not share the maps of the options.
+	sanitized.NamespaceDomainSuffixes["tenant-*"] = "other.local"
+	if options.NamespaceDomainSuffixes["tenant-*"] != "tenant.local" {
+		t.Fatal("expected NamespaceDomainSuffixes to be copied")
+	}
+
+	// The options can be dumped even with the callbacks set, and the secrets are not.
+	out, err := json.Marshal(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "secret") || strings.Contains(string(out), "FetchCaRoot") {
+		t.Fatalf("expected FetchCaRoot to be left out of %s", out)
+	}
+	if !strings.Contains(string(out), `"EndpointMode":"EndpointSliceOnly"`) {
+		t.Fatalf("expected the endpoint mode by name in %s", out)
+	}
+}
+
+func TestControllerOptions(t *testing.T) {
+	controller, _ := newFakeControllerWithOptions(fakeControllerOptions{
+		mode:              EndpointSliceOnly,
+		clusterID:         "cluster1",
+		watchedNamespaces: "nsA, nsB",
+	})
+	defer controller.Stop()
+
+	if controller.EndpointMode() != EndpointSliceOnly {
+		t.Fatalf("got endpoint mode %v", controller.EndpointMode())
+	}
+	if controller.WatchedNamespaces() != "nsA,nsB" {
+		t.Fatalf("expected the normalized watched namespaces, got %q", controller.WatchedNamespaces())
+	}
+	if controller.DomainSuffix() != domainSuffix {
+		t.Fatalf("got domain suffix %q", controller.DomainSuffix())
+	}
+
+	options := controller.Options()
+	if options.XDSUpdater != nil || options.Metrics != nil {
+		t.Fatal("expected the updaters to be left out")
+	}
+	if options.ClusterID != "cluster1" || options.EndpointMode != EndpointSliceOnly {
+		t.Fatalf("got options %+v", options)
+	}
+	// Defaulted options are reported with their effective value.
+	if options.SystemNamespace != IstioNamespace || options.ProxyContainerName != DefaultProxyContainerName ||
+		options.NodeLabelPrefix != DefaultNodeLabelPrefix {
+		t.Fatalf("expected the defaults, got %+v", options)
+	}
+	if !reflect.DeepEqual(options.ControlPlaneServices, DefaultControlPlaneServices) {
+		t.Fatalf("got control plane services %v", options.ControlPlaneServices)
+	}
+	if !reflect.DeepEqual(options.LocalityOrder, DefaultLocalityOrder) {
+		t.Fatalf("got locality order %v", options.LocalityOrder)
+	}
+
+	// Changes to the returned options do not reach the controller.
+	options.ControlPlaneServices[0] = "other"
+	if controller.Options().ControlPlaneServices[0] != DefaultControlPlaneServices[0] {
+		t.Fatal("expected a copy of the options")
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	cases := []struct {
+		name    string
+		options Options
+		err     string
+	}{
+		{
+			name:    "valid",
+			options: Options{DomainSuffix: domainSuffix, ResyncPeriod: time.Minute},
+		},
+		{
+			name:    "empty domain suffix",
+			options: Options{ResyncPeriod: time.Minute},
+			err:     "DomainSuffix must be set",
+		},
+		{
+			name:    "negative resync period",
+			options: Options{DomainSuffix: domainSuffix, ResyncPeriod: -time.Second},
+			err:     "ResyncPeriod must not be negative",
+		},
+		{
+			name:    "uid without cluster ID",
+			options: Options{DomainSuffix: domainSuffix, UIDIncludesClusterID: true},
+			err:     "ClusterID must be set with UIDIncludesClusterID",
+		},
+		{
+			name:    "dropped pod overlaps without cluster ID",
+			options: Options{DomainSuffix: domainSuffix, DropForeignPodOverlaps: true},
+			err:     "ClusterID must be set with DropForeignPodOverlaps",
+		},
+		{
+			name:    "mcs without cluster ID",
+			options: Options{DomainSuffix: domainSuffix, MCSMode: MCSModeTrustSlices},
+			err:     `ClusterID must be set with MCSMode "trust"`,
+		},
+		{
+			name:    "invalid endpoint CIDR",
+			options: Options{DomainSuffix: domainSuffix, DeniedEndpointCIDRs: []string{"10.0.0.0/33"}},
+			err:     `invalid endpoint CIDR "10.0.0.0/33"`,
+		},
+		{
+			name:    "unknown locality source",
+			options: Options{DomainSuffix: domainSuffix, LocalityOrder: []LocalitySource{LocalityFromNode, "zone"}},
+			err:     `unknown locality source "zone"`,
+		},
+		{
+			name:    "repeated locality source",
+			options: Options{DomainSuffix: domainSuffix, LocalityOrder: []LocalitySource{LocalityFromNode, LocalityFromNode}},
+			err:     `locality source "node" is repeated`,
+		},
+		{
+			name:    "invalid external endpoint slice manager",
+			options: Options{DomainSuffix: domainSuffix, ExternalEndpointSliceManagers: []string{"a", "not valid!"}},
+			err:     "invalid ExternalEndpointSliceManagers",
+		},
+		{
+			name:    "cluster options with cluster ID",
+			options: Options{DomainSuffix: domainSuffix, ClusterID: "cluster1", UIDIncludesClusterID: true, MCSMode: MCSModeIgnore},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.options.Validate()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+
+	// All the problems are reported at once.
+	options := Options{ResyncPeriod: -time.Second, UIDIncludesClusterID: true}
+	err := options.Validate()
+	if err == nil || !strings.Contains(err.Error(), "DomainSuffix") || !strings.Contains(err.Error(), "ResyncPeriod") ||
+		!strings.Contains(err.Error(), "ClusterID") {
+		t.Fatalf("expected all the problems to be reported, got %v", err)
+	}
+}
+
+func TestOptionsValidateDefaults(t *testing.T) {
+	options := Options{DomainSuffix: domainSuffix, EndpointMode: EndpointMode(42)}
+	if err := options.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if options.ResyncPeriod != DefaultResyncPeriod {
+		t.Fatalf("expected the default resync period, got %s", options.ResyncPeriod)
+	}
+	if options.EndpointMode != EndpointsOnly {
+		t.Fatalf("expected an unknown endpoint mode to default to EndpointsOnly, got %d", options.EndpointMode)
+	}
+}
+
+func TestNewControllerE(t *testing.T) {
+	scheme := runtime.NewScheme()
+	metaV1.AddMetaToScheme(scheme)
+	client := fake.NewSimpleClientset()
+	metadataClient := metafake.NewSimpleMetadataClient(scheme)
+
+	if _, err := NewControllerE(client, metadataClient, Options{XDSUpdater: NewFakeXDS()}); err == nil {
+		t.Fatal("expected an error for options without a domain suffix")
+	}
+	if _, err := NewControllerWithValidation(client, metadataClient, Options{XDSUpdater: NewFakeXDS()}); err == nil {
+		t.Fatal("expected NewControllerWithValidation to validate the options")
+	}
+
+	c, err := NewControllerE(client, metadataClient, Options{
+		DomainSuffix: domainSuffix,
+		XDSUpdater:   NewFakeXDS(),
+		EndpointMode: EndpointMode(42),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.EndpointMode() != EndpointsOnly || c.endpoints == nil {
+		t.Fatalf("expected the endpoints controller of EndpointsOnly, got mode %d", c.EndpointMode())
+	}
+}
+
+func TestNewControllerUnknownEndpointMode(t *testing.T) {
+	// Without validation, an unknown endpoint mode still gets an endpoints controller.
+	scheme := runtime.NewScheme()
+	metaV1.AddMetaToScheme(scheme)
+	client := fake.NewSimpleClientset()
+	metadataClient := metafake.NewSimpleMetadataClient(scheme)
+	c := NewController(client, metadataClient, Options{
+		DomainSuffix: domainSuffix,
+		XDSUpdater:   NewFakeXDS(),
+		EndpointMode: EndpointMode(42),
+	})
+	if _, ok := c.endpoints.(*endpointsController); !ok {
+		t.Fatalf("expected an endpoints controller, got %T", c.endpoints)
+	}
+	if c.EndpointMode() != EndpointsOnly {
+		t.Fatalf("got endpoint mode %d", c.EndpointMode())
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/metadata"
+)
+
+// ResourceAccess is a verb on a resource the controller needs to be allowed.
+type ResourceAccess struct {
+	Verb     string
+	Group    string
+	Resource string
+	// Namespace is empty for cluster scoped resources and for all namespaces.
+	Namespace string
+	// Reason is the reason the access was denied, if the authorizer gave one.
+	Reason string
+}
+
+func (a ResourceAccess) String() string {
+	resource := a.Resource
+	if a.Group != "" {
+		resource += "." + a.Group
+	}
+	out := a.Verb + " " + resource
+	if a.Namespace != "" {
+		out += " in namespace " + a.Namespace
+	}
+	if a.Reason != "" {
+		out += " (" + a.Reason + ")"
+	}
+	return out
+}
+
+// MissingPermissionsError lists the accesses the informers of the controller need but are denied.
+type MissingPermissionsError struct {
+	Missing []ResourceAccess
+}
+
+func (e *MissingPermissionsError) Error() string {
+	missing := make([]string, 0, len(e.Missing))
+	for _, a := range e.Missing {
+		missing = append(missing, a.String())
+	}
+	return fmt.Sprintf("missing permissions for the Kubernetes service registry: %s", strings.Join(missing, ", "))
+}
+
+// NewControllerWithValidation is like NewControllerE, but with Options.StrictPermissionCheck it
+// also checks that the informers are allowed to list and watch their resources. Without the
+// check, missing permissions only show as informers retrying and never syncing.
+func NewControllerWithValidation(client kubernetes.Interface, metadataClient metadata.Interface,
+	options Options) (*Controller, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	if options.StrictPermissionCheck {
+		if err := checkPermissions(client, options); err != nil {
+			return nil, err
+		}
+	}
+	return NewController(client, metadataClient, options), nil
+}
+
+// requiredAccesses returns the accesses of the informers of a controller created with the options.
+func requiredAccesses(options Options) []ResourceAccess {
+	namespaced := []ResourceAccess{
+		{Resource: "services"},
+		{Resource: "pods"},
+		{Group: "apps", Resource: "replicasets"},
+	}
+	if options.EndpointMode == EndpointSliceOnly {
+		namespaced = append(namespaced, ResourceAccess{Group: "discovery.k8s.io", Resource: "endpointslices"})
+	} else {
+		namespaced = append(namespaced, ResourceAccess{Resource: "endpoints"})
+		// The EndpointSlices of the external managers are consumed in addition to the Endpoints.
+		if len(options.ExternalEndpointSliceManagers) > 0 {
+			namespaced = append(namespaced, ResourceAccess{Group: "discovery.k8s.io", Resource: "endpointslices"})
+		}
+	}
+
+	var out []ResourceAccess
+	for _, verb := range []string{"list", "watch"} {
+		for _, namespace := range strings.Split(normalizeWatchedNamespaces(options.WatchedNamespaces), ",") {
+			for _, a := range namespaced {
+				a.Verb, a.Namespace = verb, namespace
+				out = append(out, a)
+			}
+		}
+		// Namespaces are watched for the network label of the system namespace, and all of them
+		// with a service filter.
+		out = append(out, ResourceAccess{Verb: verb, Resource: "nodes"}, ResourceAccess{Verb: verb, Resource: "namespaces"})
+	}
+	return out
+}
+
+// checkPermissions reviews the accesses of the controller, returning a MissingPermissionsError
+// listing those denied.
+func checkPermissions(client kubernetes.Interface, options Options) error {
+	var missing []ResourceAccess
+	for _, a := range requiredAccesses(options) {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Verb:      a.Verb,
+					Group:     a.Group,
+					Resource:  a.Resource,
+					Namespace: a.Namespace,
+				},
+			},
+		}
+		resp, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(context.TODO(), review, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to review access to %s: %v", a, err)
+		}
+		if !resp.Status.Allowed {
+			a.Reason = resp.Status.Reason
+			missing = append(missing, a)
+		}
+	}
+	if len(missing) > 0 {
+		return &MissingPermissionsError{Missing: missing}
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	metafake "k8s.io/client-go/metadata/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// denyingClient returns a fake client whose access reviews deny the listed verb/resource pairs.
+func denyingClient(denied map[string]bool) (*fake.Clientset, *int) {
+	client := fake.NewSimpleClientset()
+	reviews := 0
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		reviews++
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attributes := review.Spec.ResourceAttributes
+		review.Status.Allowed = !denied[attributes.Verb+" "+attributes.Resource]
+		if !review.Status.Allowed {
+			review.Status.Reason = "denied by test"
+		}
+		return true, review, nil
+	})
+	return client, &reviews
+}
+
+func TestStrictPermissionCheck(t *testing.T) {
+	scheme := runtime.NewScheme()
+	metaV1.AddMetaToScheme(scheme)
+	metadataClient := metafake.NewSimpleMetadataClient(scheme)
+
+	cases := []struct {
+		name    string
+		mode    EndpointMode
+		denied  map[string]bool
+		missing []ResourceAccess
+	}{
+		{
+			name: "allowed",
+			mode: EndpointsOnly,
+		},
+		{
+			name:   "endpoints",
+			mode:   EndpointsOnly,
+			denied: map[string]bool{"watch pods": true, "list nodes": true, "list endpointslices": true},
+			missing: []ResourceAccess{
+				{Verb: "list", Resource: "nodes", Reason: "denied by test"},
+				{Verb: "watch", Resource: "pods", Namespace: "nsA", Reason: "denied by test"},
+				{Verb: "watch", Resource: "pods", Namespace: "nsB", Reason: "denied by test"},
+			},
+		},
+		{
+			name:   "endpoint slices",
+			mode:   EndpointSliceOnly,
+			denied: map[string]bool{"list endpointslices": true, "watch endpoints": true},
+			missing: []ResourceAccess{
+				{Verb: "list", Group: "discovery.k8s.io", Resource: "endpointslices", Namespace: "nsA", Reason: "denied by test"},
+				{Verb: "list", Group: "discovery.k8s.io", Resource: "endpointslices", Namespace: "nsB", Reason: "denied by test"},
+			},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := denyingClient(tt.denied)
+			c, err := NewControllerWithValidation(client, metadataClient, Options{
+				WatchedNamespaces:     "nsA,nsB",
+				DomainSuffix:          domainSuffix,
+				XDSUpdater:            NewFakeXDS(),
+				EndpointMode:          tt.mode,
+				StrictPermissionCheck: true,
+			})
+			if tt.missing == nil {
+				if err != nil || c == nil {
+					t.Fatalf("expected a controller, got error %v", err)
+				}
+				return
+			}
+			perr, ok := err.(*MissingPermissionsError)
+			if !ok {
+				t.Fatalf("expected missing permissions, got %v", err)
+			}
+			got := append([]ResourceAccess{}, perr.Missing...)
+			sortAccesses(got)
+			sortAccesses(tt.missing)
+			if !reflect.DeepEqual(got, tt.missing) {
+				t.Fatalf("got missing permissions %+v, want %+v", got, tt.missing)
+			}
+		})
+	}
+
+	// Without the strict check nothing is reviewed.
+	client, reviews := denyingClient(map[string]bool{"list pods": true})
+	c, err := NewControllerWithValidation(client, metadataClient, Options{
+		DomainSuffix: domainSuffix,
+		XDSUpdater:   NewFakeXDS(),
+	})
+	if err != nil || c == nil {
+		t.Fatalf("expected a controller, got error %v", err)
+	}
+	if *reviews != 0 {
+		t.Fatalf("expected no access reviews, got %d", *reviews)
+	}
+}
+
+func sortAccesses(accesses []ResourceAccess) {
+	key := func(a ResourceAccess) string {
+		return a.Verb + "/" + a.Group + "/" + a.Resource + "/" + a.Namespace
+	}
+	sort.Slice(accesses, func(i, j int) bool { return key(accesses[i]) < key(accesses[j]) })
+}
+
+func TestRequiredAccessesNamespaces(t *testing.T) {
+	cases := map[string]map[string]bool{
+		// Trailing commas are dropped.
+		"a,b,": {"a": true, "b": true},
+		// An empty entry anywhere else stands for all namespaces.
+		"a,,b": {"": true},
+	}
+	for watched, want := range cases {
+		namespaces := map[string]bool{}
+		for _, a := range requiredAccesses(Options{WatchedNamespaces: watched}) {
+			if a.Resource == "pods" {
+				namespaces[a.Namespace] = true
+			}
+		}
+		if !reflect.DeepEqual(namespaces, want) {
+			t.Fatalf("%q: got the pods checked in the namespaces %v, want %v", watched, namespaces, want)
+		}
+	}
+}
+
+func TestRequiredAccessesExternalEndpointSlices(t *testing.T) {
+	endpointSlices := func(options Options) []string {
+		var verbs []string
+		for _, a := range requiredAccesses(options) {
+			if a.Group == "discovery.k8s.io" && a.Resource == "endpointslices" {
+				verbs = append(verbs, a.Verb)
+			}
+		}
+		return verbs
+	}
+	if got := endpointSlices(Options{}); len(got) != 0 {
+		t.Fatalf("expected no EndpointSlice access without external managers, got %v", got)
+	}
+	// The slices of the external managers are watched next to the Endpoints.
+	want := []string{"list", "watch"}
+	if got := endpointSlices(Options{ExternalEndpointSliceManagers: []string{"external-controller"}}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got EndpointSlice accesses %v with external managers, want %v", got, want)
+	}
+	// Checked once in EndpointSlice mode.
+	options := Options{EndpointMode: EndpointSliceOnly, ExternalEndpointSliceManagers: []string{"external-controller"}}
+	if got := endpointSlices(options); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got EndpointSlice accesses %v in EndpointSlice mode, want %v", got, want)
+	}
+}
@@ -17,22 +17,52 @@ package controller
 import (
 	"context"
 	"fmt"
+	"reflect"
 	"strings"
 	"sync"
 
+	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/tools/cache"
 
 	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
 
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/serviceregistry/kube"
 	"istio.io/istio/pkg/listwatch"
 )
 
+var (
+	namespaceTag = monitoring.MustCreateLabel("namespace")
+
+	podsProxyUnready = monitoring.NewGauge(
+		"pilot_k8s_pods_proxy_unready",
+		"Cached pods whose proxy container is not ready.",
+		monitoring.WithLabels(namespaceTag),
+	)
+)
+
+func init() {
+	monitoring.MustRegister(podsProxyUnready)
+}
+
+// podHostnameIndex indexes pods that set spec.hostname, such as StatefulSet pods, by
+// "<namespace>/<hostname>".
+const podHostnameIndex = "hostname"
+
+func podHostnameIndexFunc(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok || pod.Spec.Hostname == "" {
+		return nil, nil
+	}
+	return []string{kube.KeyFunc(pod.Spec.Hostname, pod.Namespace)}, nil
+}
+
 // PodCache is an eventually consistent pod cache
 type PodCache struct {
 	informer cache.SharedIndexInformer
@@ -45,11 +75,69 @@ type PodCache struct {
 	// IPByPods is a reverse map of podsByIP. This exists to allow us to prune stale entries in the
 	// pod cache if a pod changes IP.
 	IPByPods map[string]string
+	// tlsModeByPod maps a cached pod key to the TLS mode its endpoints were built with, so that
+	// a change to the pod's TLS mode label or sidecar status annotation can trigger an EDS rebuild.
+	tlsModeByPod map[string]string
+	// localityLabelByPod maps a cached pod key to its istio-locality label, so that a change to
+	// the label can trigger an EDS rebuild with the new locality.
+	localityLabelByPod map[string]string
+	// proxyUnreadyByPod maps the key of a cached pod whose proxy container is not ready to its
+	// namespace, and proxyUnreadyCount counts these pods per namespace.
+	proxyUnreadyByPod map[string]string
+	proxyUnreadyCount map[string]int
+	// pendingIP maps the key of the pending or running pods not assigned an IP yet to their
+	// state, see PendingPods.
+	pendingIP map[string]PendingPod
+
+	// replicaSetInformer watches ReplicaSet metadata, used to find the Deployment owning a pod.
+	replicaSetInformer cache.SharedIndexInformer
+	// deploymentsByReplicaSet caches the ReplicaSet key => owning Deployment name, "" if the
+	// ReplicaSet is not owned by a Deployment.
+	deploymentsByReplicaSet map[string]string
+	// guessedReplicaSets are the keys of the ReplicaSets not observed yet once the ReplicaSets
+	// synced, whose pods got a workload name guessed by deploymentNameHeuristic.
+	guessedReplicaSets map[string]struct{}
 
 	c *Controller
 }
 
 func newPodCache(c *Controller, options Options) *PodCache {
+	var informer, replicaSetInformer cache.SharedIndexInformer
+	if c.injected != nil {
+		informer, replicaSetInformer = c.injected.Pods, c.injected.ReplicaSets
+	} else {
+		informer, replicaSetInformer = newPodInformers(c, options)
+	}
+
+	out := &PodCache{
+		informer:                informer,
+		c:                       c,
+		podsByIP:                make(map[string]string),
+		IPByPods:                make(map[string]string),
+		tlsModeByPod:            make(map[string]string),
+		localityLabelByPod:      make(map[string]string),
+		proxyUnreadyByPod:       make(map[string]string),
+		proxyUnreadyCount:       make(map[string]int),
+		pendingIP:               make(map[string]PendingPod),
+		replicaSetInformer:      replicaSetInformer,
+		deploymentsByReplicaSet: make(map[string]string),
+		guessedReplicaSets:      make(map[string]struct{}),
+	}
+	c.addEventHandler(out.replicaSetInformer, cache.ResourceEventHandlerFuncs{
+		AddFunc: out.onReplicaSetAdd,
+		// The owner of a ReplicaSet may change, so drop the cached mapping on any change.
+		UpdateFunc: func(_, cur interface{}) {
+			out.invalidateReplicaSet(cur)
+		},
+		DeleteFunc: out.invalidateReplicaSet,
+	})
+
+	return out
+}
+
+// newPodInformers creates the informers of the pods and of the metadata of the ReplicaSets of the
+// watched namespaces.
+func newPodInformers(c *Controller, options Options) (cache.SharedIndexInformer, cache.SharedIndexInformer) {
 	namespaces := strings.Split(options.WatchedNamespaces, ",")
 
 	mlw := listwatch.MultiNamespaceListerWatcher(namespaces, func(namespace string) cache.ListerWatcher {
@@ -63,17 +151,69 @@ func newPodCache(c *Controller, options Options) *PodCache {
 		}
 	})
 
-	informer := cache.NewSharedIndexInformer(mlw, &v1.Pod{}, options.ResyncPeriod,
-		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	informer := cache.NewSharedIndexInformer(mlw, &v1.Pod{}, c.informerResyncPeriod(resyncPods),
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc, podHostnameIndex: podHostnameIndexFunc})
 
-	out := &PodCache{
-		informer: informer,
-		c:        c,
-		podsByIP: make(map[string]string),
-		IPByPods: make(map[string]string),
+	replicaSetResource := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"}
+	rsMlw := listwatch.MultiNamespaceListerWatcher(namespaces, func(namespace string) cache.ListerWatcher {
+		return &cache.ListWatch{
+			ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+				return c.metadataClient.Resource(replicaSetResource).Namespace(namespace).List(context.TODO(), opts)
+			},
+			WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+				return c.metadataClient.Resource(replicaSetResource).Namespace(namespace).Watch(context.TODO(), opts)
+			},
+		}
+	})
+	replicaSetInformer := cache.NewSharedIndexInformer(rsMlw, &metav1.PartialObjectMetadata{},
+		c.informerResyncPeriod(resyncReplicaSets), cache.Indexers{})
+
+	return c.ownInformer(informer), c.ownInformer(replicaSetInformer)
+}
+
+// podUpdateEqual compares the pod fields onEvent and the endpoint builder react to. Readiness and
+// other status conditions are reported through Endpoints, so they are ignored here.
+func podUpdateEqual(old, cur interface{}) bool {
+	oldPod, ok := old.(*v1.Pod)
+	if !ok {
+		return false
 	}
+	curPod, ok := cur.(*v1.Pod)
+	if !ok {
+		return false
+	}
+	return reflect.DeepEqual(oldPod.Labels, curPod.Labels) &&
+		reflect.DeepEqual(oldPod.Annotations, curPod.Annotations) &&
+		reflect.DeepEqual(oldPod.DeletionTimestamp, curPod.DeletionTimestamp) &&
+		oldPod.Spec.NodeName == curPod.Spec.NodeName &&
+		oldPod.Status.Phase == curPod.Status.Phase &&
+		oldPod.Status.PodIP == curPod.Status.PodIP &&
+		reflect.DeepEqual(oldPod.Status.PodIPs, curPod.Status.PodIPs)
+}
 
-	return out
+// updateEqual extends podUpdateEqual with the readiness of the proxy container, which Endpoints
+// do not report when the application container alone decides the pod readiness, and with the
+// readiness of the pod while Local gateways pick their nodes by it.
+func (pc *PodCache) updateEqual(old, cur interface{}) bool {
+	if !podUpdateEqual(old, cur) {
+		return false
+	}
+	if pc.c.hasLocalGateways() && isPodReady(old.(*v1.Pod)) != isPodReady(cur.(*v1.Pod)) {
+		return false
+	}
+	name := pc.proxyContainerName()
+	return isProxyUnready(old.(*v1.Pod), name) == isProxyUnready(cur.(*v1.Pod), name)
+}
+
+// isProxyUnready reports whether the pod runs a proxy container that is not ready. Pods without
+// the container are not part of the mesh and never reported.
+func isProxyUnready(pod *v1.Pod, containerName string) bool {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == containerName {
+			return !status.Ready
+		}
+	}
+	return false
 }
 
 // onEvent updates the IP-based index (pc.podsByIP).
@@ -94,13 +234,17 @@ func (pc *PodCache) onEvent(curr interface{}, ev model.Event) error {
 		}
 	}
 
+	pc.localGatewayUpdate(pod)
+
 	ip := pod.Status.PodIP
+	key := kube.KeyFunc(pod.Name, pod.Namespace)
 	// PodIP will be empty when pod is just created, but before the IP is assigned
 	// via UpdateStatus.
+	pc.setPendingIP(key, pod, ev)
+	defer pc.recordStats()
 
 	if len(ip) > 0 {
 		log.Debugf("Handling event %s for pod %s (%v) in namespace %s -> %v", ev, pod.Name, pod.Status.Phase, pod.Namespace, ip)
-		key := kube.KeyFunc(pod.Name, pod.Namespace)
 		switch ev {
 		case model.EventAdd:
 			switch pod.Status.Phase {
@@ -108,6 +252,9 @@ func (pc *PodCache) onEvent(curr interface{}, ev model.Event) error {
 				if key != pc.podsByIP[ip] {
 					// add to cache if the pod is running or pending
 					pc.update(ip, key)
+					pc.tlsModeByPod[key] = kube.PodTLSMode(pod)
+					pc.setLocalityLabel(key, pod)
+					pc.setProxyReadiness(key, pod)
 				}
 			}
 		case model.EventUpdate:
@@ -123,6 +270,24 @@ func (pc *PodCache) onEvent(curr interface{}, ev model.Event) error {
 				if key != pc.podsByIP[ip] {
 					// add to cache if the pod is running or pending
 					pc.update(ip, key)
+					pc.tlsModeByPod[key] = kube.PodTLSMode(pod)
+					pc.setLocalityLabel(key, pod)
+					pc.setProxyReadiness(key, pod)
+				} else {
+					rebuild := false
+					if tlsMode := kube.PodTLSMode(pod); tlsMode != pc.tlsModeByPod[key] {
+						pc.tlsModeByPod[key] = tlsMode
+						rebuild = true
+					}
+					if pc.setLocalityLabel(key, pod) {
+						rebuild = true
+					}
+					if pc.setProxyReadiness(key, pod) && pc.c != nil && pc.c.endpointOptions.excludeProxyUnready {
+						rebuild = true
+					}
+					if rebuild {
+						pc.endpointsUpdate(pod)
+					}
 				}
 
 			default:
@@ -145,6 +310,67 @@ func (pc *PodCache) deleteIP(ip string) {
 	pod := pc.podsByIP[ip]
 	delete(pc.podsByIP, ip)
 	delete(pc.IPByPods, pod)
+	delete(pc.tlsModeByPod, pod)
+	delete(pc.localityLabelByPod, pod)
+	pc.clearProxyReadiness(pod)
+	if pc.c != nil {
+		pc.c.forgetRejectedIdentity(pod)
+	}
+}
+
+func (pc *PodCache) proxyContainerName() string {
+	if pc.c != nil && pc.c.endpointOptions.proxyContainerName != "" {
+		return pc.c.endpointOptions.proxyContainerName
+	}
+	return DefaultProxyContainerName
+}
+
+// setLocalityLabel records the istio-locality label of the cached pod, and reports whether it
+// changed. Invalid labels are reported once per change, the locality of the node applies instead.
+func (pc *PodCache) setLocalityLabel(key string, pod *v1.Pod) bool {
+	value := pod.Labels[model.LocalityLabel]
+	if pc.localityLabelByPod[key] == value {
+		return false
+	}
+	if value == "" {
+		delete(pc.localityLabelByPod, key)
+		return true
+	}
+	pc.localityLabelByPod[key] = value
+	if _, ok := normalizeLocalityLabel(value); !ok {
+		log.Warnf("Ignoring the %s label %q of pod %s: want region.zone.subzone", model.LocalityLabel, value, key)
+	}
+	return true
+}
+
+// setProxyReadiness records whether the proxy container of the cached pod is ready, and reports
+// whether that changed.
+func (pc *PodCache) setProxyReadiness(key string, pod *v1.Pod) bool {
+	unready := isProxyUnready(pod, pc.proxyContainerName())
+	if _, wasUnready := pc.proxyUnreadyByPod[key]; unready == wasUnready {
+		return false
+	}
+	if !unready {
+		pc.clearProxyReadiness(key)
+		return true
+	}
+	pc.proxyUnreadyByPod[key] = pod.Namespace
+	pc.proxyUnreadyCount[pod.Namespace]++
+	podsProxyUnready.With(namespaceTag.Value(pod.Namespace)).Record(float64(pc.proxyUnreadyCount[pod.Namespace]))
+	return true
+}
+
+func (pc *PodCache) clearProxyReadiness(key string) {
+	namespace, f := pc.proxyUnreadyByPod[key]
+	if !f {
+		return
+	}
+	delete(pc.proxyUnreadyByPod, key)
+	pc.proxyUnreadyCount[namespace]--
+	podsProxyUnready.With(namespaceTag.Value(namespace)).Record(float64(pc.proxyUnreadyCount[namespace]))
+	if pc.proxyUnreadyCount[namespace] == 0 {
+		delete(pc.proxyUnreadyCount, namespace)
+	}
 }
 
 func (pc *PodCache) update(ip, key string) {
@@ -154,6 +380,9 @@ func (pc *PodCache) update(ip, key string) {
 	}
 	pc.podsByIP[ip] = key
 	pc.IPByPods[key] = ip
+	if pc.c != nil && pc.c.proxyNegativeCache != nil {
+		pc.c.proxyNegativeCache.invalidate(ip)
+	}
 
 	pc.proxyUpdates(ip)
 }
@@ -164,6 +393,16 @@ func (pc *PodCache) proxyUpdates(ip string) {
 	}
 }
 
+// endpointsUpdate queues an EDS rebuild for the services selecting the pod. It is queued rather
+// than run inline because building endpoints looks pods up in this cache, and the lock is held.
+func (pc *PodCache) endpointsUpdate(pod *v1.Pod) {
+	if pc.c != nil && pc.c.queue != nil {
+		pc.c.queue.Push(func() error {
+			return pc.c.updatePodEndpoints(pod)
+		})
+	}
+}
+
 // nolint: unparam
 func (pc *PodCache) getPodKey(addr string) (string, bool) {
 	pc.RLock()
@@ -185,8 +424,61 @@ func (pc *PodCache) getPodByIP(addr string) *v1.Pod {
 	return item.(*v1.Pod)
 }
 
+// getPodByProxy returns the pod of the first proxy IP found in the cache, along with that IP.
+func (pc *PodCache) getPodByProxy(proxy *model.Proxy) (*v1.Pod, string) {
+	for _, ip := range proxy.IPAddresses {
+		if pod := pc.getPodByIP(ip); pod != nil {
+			return pod, ip
+		}
+	}
+	return nil, ""
+}
+
+// getPodByProxyID resolves a proxy ID of the form "<pod name>.<namespace>" to a cached pod. Pods
+// with a custom hostname may present "<hostname>.<namespace>" or "<hostname>.<subdomain>.<namespace>"
+// instead, so the hostname index is consulted when no pod has the name.
+func (pc *PodCache) getPodByProxyID(proxyID, defaultNamespace string) *v1.Pod {
+	name, namespace := proxyID, defaultNamespace
+	if i := strings.LastIndex(proxyID, "."); i >= 0 {
+		name, namespace = proxyID[:i], proxyID[i+1:]
+	}
+	if name == "" || namespace == "" {
+		return nil
+	}
+
+	if item, exists, err := pc.informer.GetStore().GetByKey(kube.KeyFunc(name, namespace)); err == nil && exists {
+		return item.(*v1.Pod)
+	}
+
+	hostname, subdomain := name, ""
+	if i := strings.Index(name, "."); i >= 0 {
+		hostname, subdomain = name[:i], name[i+1:]
+	}
+	items, err := pc.informer.GetIndexer().ByIndex(podHostnameIndex, kube.KeyFunc(hostname, namespace))
+	if err != nil {
+		return nil
+	}
+	var match *v1.Pod
+	for _, item := range items {
+		pod := item.(*v1.Pod)
+		if subdomain != "" && pod.Spec.Subdomain != subdomain {
+			continue
+		}
+		if match != nil {
+			// Hostnames are only unique within a subdomain, so an ambiguous match is ignored.
+			return nil
+		}
+		match = pod
+	}
+	return match
+}
+
 // getPod loads the pod from k8s.
 func (pc *PodCache) getPod(name string, namespace string) *v1.Pod {
+	if pc.c.client == nil {
+		// Built on injected informers.
+		return nil
+	}
 	pod, err := pc.c.client.CoreV1().Pods(namespace).Get(context.TODO(), name, metav1.GetOptions{})
 	if err != nil {
 		log.Warnf("failed to get pod %s/%s from kube-apiserver: %v", namespace, name, err)
@@ -194,3 +486,118 @@ func (pc *PodCache) getPod(name string, namespace string) *v1.Pod {
 	}
 	return pod
 }
+
+func (pc *PodCache) invalidateReplicaSet(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return
+	}
+	pc.Lock()
+	delete(pc.deploymentsByReplicaSet, key)
+	pc.Unlock()
+}
+
+// onReplicaSetAdd builds the endpoints of the pods of a ReplicaSet again when their workload name
+// was guessed before it was observed, and the guess was wrong: pod events may be delivered before
+// the event of their ReplicaSet.
+func (pc *PodCache) onReplicaSetAdd(obj interface{}) {
+	rs, ok := obj.(*metav1.PartialObjectMetadata)
+	if !ok {
+		return
+	}
+	key := kube.KeyFunc(rs.Name, rs.Namespace)
+	pc.Lock()
+	_, guessed := pc.guessedReplicaSets[key]
+	delete(pc.guessedReplicaSets, key)
+	pc.Unlock()
+	if !guessed {
+		return
+	}
+	deployment := rs.Name
+	if ref := metav1.GetControllerOf(rs); ref != nil && ref.Kind == "Deployment" {
+		deployment = ref.Name
+	}
+	pods, err := pc.informer.GetIndexer().ByIndex(cache.NamespaceIndex, rs.Namespace)
+	if err != nil {
+		return
+	}
+	for _, item := range pods {
+		pod := item.(*v1.Pod)
+		if ref := metav1.GetControllerOf(pod); ref == nil || ref.Kind != "ReplicaSet" || ref.Name != rs.Name {
+			continue
+		}
+		if deploymentNameHeuristic(rs.Name, pod) == deployment {
+			return
+		}
+		// The pods of a ReplicaSet share their labels, and so the services selecting them.
+		pc.endpointsUpdate(pod)
+		return
+	}
+}
+
+// getWorkloadName returns the name of the workload controlling the pod: the Deployment for pods
+// created through a ReplicaSet, the controller (StatefulSet, DaemonSet, Job...) for other
+// controlled pods, and the pod name itself for bare pods.
+//
+// The ReplicaSets are optional: until they synced, which is never when istiod may not list them,
+// and for the ReplicaSets not observed yet, the Deployment is guessed from the name of the
+// ReplicaSet, see deploymentNameHeuristic.
+func (pc *PodCache) getWorkloadName(pod *v1.Pod) string {
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil {
+		return pod.Name
+	}
+	if ref.Kind == "ReplicaSet" {
+		if !pc.replicaSetInformer.HasSynced() {
+			return deploymentNameHeuristic(ref.Name, pod)
+		}
+		deployment, found := pc.getDeploymentForReplicaSet(ref.Name, pod.Namespace)
+		if !found {
+			// The ReplicaSet was not observed yet, onReplicaSetAdd fixes the guess.
+			return deploymentNameHeuristic(ref.Name, pod)
+		}
+		if deployment != "" {
+			return deployment
+		}
+	}
+	return ref.Name
+}
+
+// deploymentNameHeuristic returns the name of the Deployment of a pod created through the
+// ReplicaSet, guessed the way the sidecar injector does: the ReplicaSets of Deployments are named
+// after them with the pod template hash the pods are labeled with as a suffix. Other ReplicaSets
+// are their own workload.
+func deploymentNameHeuristic(replicaSet string, pod *v1.Pod) string {
+	hash := pod.Labels[appsv1.DefaultDeploymentUniqueLabelKey]
+	if hash == "" || !strings.HasSuffix(replicaSet, "-"+hash) {
+		return replicaSet
+	}
+	return strings.TrimSuffix(replicaSet, "-"+hash)
+}
+
+// getDeploymentForReplicaSet returns the name of the Deployment owning the ReplicaSet, or "" if there is none,
+// and whether the ReplicaSet was observed. The ReplicaSets not observed are recorded in guessedReplicaSets.
+func (pc *PodCache) getDeploymentForReplicaSet(name, namespace string) (string, bool) {
+	key := kube.KeyFunc(name, namespace)
+	pc.RLock()
+	deployment, f := pc.deploymentsByReplicaSet[key]
+	pc.RUnlock()
+	if f {
+		return deployment, true
+	}
+
+	pc.Lock()
+	defer pc.Unlock()
+	item, exists, err := pc.replicaSetInformer.GetStore().GetByKey(key)
+	if !exists || err != nil {
+		// Not cached, as the ReplicaSet may just not have been observed yet. The guess is recorded
+		// with the lock held, for onReplicaSetAdd not to miss it.
+		pc.guessedReplicaSets[key] = struct{}{}
+		return "", false
+	}
+	if ref := metav1.GetControllerOf(item.(*metav1.PartialObjectMetadata)); ref != nil && ref.Kind == "Deployment" {
+		deployment = ref.Name
+	}
+	pc.deploymentsByReplicaSet[key] = deployment
+	return deployment, true
+}
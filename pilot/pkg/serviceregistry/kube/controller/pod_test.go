@@ -21,9 +21,15 @@ import (
 	"time"
 
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	metafake "k8s.io/client-go/metadata/fake"
+	k8stesting "k8s.io/client-go/testing"
 	"k8s.io/client-go/tools/cache"
 
 	"istio.io/istio/pilot/pkg/model"
@@ -113,7 +119,7 @@ func TestIPReuse(t *testing.T) {
 	defer c.Stop()
 	initTestEnv(t, c.client, fx)
 
-	cache.WaitForCacheSync(c.stop, c.nodeMetadataInformer.HasSynced, c.pods.informer.HasSynced,
+	cache.WaitForCacheSync(c.stop, c.nodesSynced, c.pods.informer.HasSynced,
 		c.serviceInformer.HasSynced, c.endpoints.HasSynced)
 
 	createPod(t, c, "128.0.0.1", "pod")
@@ -192,7 +198,7 @@ func testPodCache(t *testing.T) {
 		// Pods in namespaces not watched by the controller.
 		generatePod("128.0.0.4", "cpod4", "nsc", "", "", map[string]string{"app": "prod-app-3"}, map[string]string{}),
 	}
-	cache.WaitForCacheSync(c.stop, c.nodeMetadataInformer.HasSynced, c.pods.informer.HasSynced,
+	cache.WaitForCacheSync(c.stop, c.nodesSynced, c.pods.informer.HasSynced,
 		c.serviceInformer.HasSynced, c.endpoints.HasSynced)
 
 	for _, pod := range pods {
@@ -290,3 +296,234 @@ func TestPodCacheEvents(t *testing.T) {
 		t.Errorf("getPodKey => got %s, want none", pod)
 	}
 }
+
+func TestPodWorkloadName(t *testing.T) {
+	c, _ := newFakeControllerWithOptions(fakeControllerOptions{mode: EndpointsOnly})
+	defer c.Stop()
+
+	controllerRef := func(kind, name string) []metav1.OwnerReference {
+		controller := true
+		return []metav1.OwnerReference{{Kind: kind, Name: name, Controller: &controller}}
+	}
+	podWithOwner := func(name string, owners []metav1.OwnerReference) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "nsa", OwnerReferences: owners}}
+	}
+
+	replicaSetResource := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"}
+	rsClient := c.metadataClient.(*metafake.FakeMetadataClient).Resource(replicaSetResource).Namespace("nsa")
+	rs := &metav1.PartialObjectMetadata{
+		TypeMeta: metav1.TypeMeta{Kind: "ReplicaSet", APIVersion: "apps/v1"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "reviews-v1-5b8f4d9c7",
+			Namespace:       "nsa",
+			OwnerReferences: controllerRef("Deployment", "reviews-v1"),
+		},
+	}
+	if _, err := rsClient.(metafake.MetadataClient).CreateFake(rs, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		_, exists, err := c.pods.replicaSetInformer.GetStore().GetByKey("nsa/reviews-v1-5b8f4d9c7")
+		return exists, err
+	}); err != nil {
+		t.Fatalf("replicaset not synced: %v", err)
+	}
+
+	cases := []struct {
+		name string
+		pod  *v1.Pod
+		want string
+	}{
+		{"deployment", podWithOwner("reviews-v1-5b8f4d9c7-abcde", controllerRef("ReplicaSet", "reviews-v1-5b8f4d9c7")), "reviews-v1"},
+		{"bare replicaset", podWithOwner("standalone-xyz", controllerRef("ReplicaSet", "standalone")), "standalone"},
+		{"statefulset", podWithOwner("db-0", controllerRef("StatefulSet", "db")), "db"},
+		{"job", podWithOwner("migrate-x7k2p", controllerRef("Job", "migrate")), "migrate"},
+		{"bare pod", podWithOwner("debug", nil), "debug"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.pods.getWorkloadName(tt.pod); got != tt.want {
+				t.Fatalf("got workload name %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Deleting the ReplicaSet drops the cached Deployment mapping.
+	if err := rsClient.Delete(context.TODO(), rs.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		c.pods.RLock()
+		defer c.pods.RUnlock()
+		_, f := c.pods.deploymentsByReplicaSet["nsa/reviews-v1-5b8f4d9c7"]
+		return !f, nil
+	}); err != nil {
+		t.Fatalf("cached deployment not invalidated: %v", err)
+	}
+	if got := c.pods.getWorkloadName(cases[0].pod); got != "reviews-v1-5b8f4d9c7" {
+		t.Fatalf("got workload name %q after replicaset deletion, want the replicaset name", got)
+	}
+}
+
+func TestPodWorkloadNameBeforeReplicaSet(t *testing.T) {
+	c, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: EndpointsOnly})
+	defer c.Stop()
+
+	// The pod is observed before its ReplicaSet, without the pod template hash label the name of
+	// the Deployment is guessed from.
+	controller := true
+	pod := generatePod("128.0.0.1", "reviews-v1-5b8f4d9c7-abcde", "nsa", "", "", map[string]string{"app": "reviews"}, nil)
+	pod.OwnerReferences = []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "reviews-v1-5b8f4d9c7", Controller: &controller}}
+	addPods(t, c, pod)
+	if err := waitForPod(c, "128.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	createService(c, "reviews", "nsa", nil, []int32{8080}, map[string]string{"app": "reviews"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	createEndpoints(c, "reviews", "nsa", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+	expectWorkloadName := func(want string) {
+		t.Helper()
+		for {
+			ev := fx.Wait("eds")
+			if ev == nil {
+				t.Fatalf("Timeout waiting for the endpoints of workload %s", want)
+			}
+			if len(ev.Endpoints) == 1 && ev.Endpoints[0].WorkloadName == want {
+				return
+			}
+		}
+	}
+	expectWorkloadName("reviews-v1-5b8f4d9c7")
+
+	// The endpoints are built again once the ReplicaSet is observed.
+	replicaSetResource := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"}
+	rsClient := c.metadataClient.(*metafake.FakeMetadataClient).Resource(replicaSetResource).Namespace("nsa")
+	rs := &metav1.PartialObjectMetadata{
+		TypeMeta: metav1.TypeMeta{Kind: "ReplicaSet", APIVersion: "apps/v1"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "reviews-v1-5b8f4d9c7",
+			Namespace:       "nsa",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "Deployment", Name: "reviews-v1", Controller: &controller}},
+		},
+	}
+	if _, err := rsClient.(metafake.MetadataClient).CreateFake(rs, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	expectWorkloadName("reviews-v1")
+}
+
+func TestPodWorkloadNameBeforeReplicaSetsSync(t *testing.T) {
+	// The informer of the ReplicaSets is not run, it never syncs.
+	pc := &PodCache{
+		replicaSetInformer:      cache.NewSharedIndexInformer(&cache.ListWatch{}, &metav1.PartialObjectMetadata{}, 0, cache.Indexers{}),
+		deploymentsByReplicaSet: make(map[string]string),
+	}
+	controller := true
+	podOf := func(replicaSet, hash string) *v1.Pod {
+		pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:            replicaSet + "-abcde",
+			Namespace:       "nsa",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: replicaSet, Controller: &controller}},
+		}}
+		if hash != "" {
+			pod.Labels = map[string]string{"pod-template-hash": hash}
+		}
+		return pod
+	}
+	cases := []struct {
+		name string
+		pod  *v1.Pod
+		want string
+	}{
+		{"deployment", podOf("reviews-v1-5b8f4d9c7", "5b8f4d9c7"), "reviews-v1"},
+		{"no hash", podOf("standalone", ""), "standalone"},
+		{"other hash", podOf("standalone", "5b8f4d9c7"), "standalone"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pc.getWorkloadName(tt.pod); got != tt.want {
+				t.Fatalf("got workload name %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncedWithForbiddenReplicaSets(t *testing.T) {
+	scheme := runtime.NewScheme()
+	metav1.AddMetaToScheme(scheme)
+	metadataClient := metafake.NewSimpleMetadataClient(scheme)
+	metadataClient.PrependReactor("list", "replicasets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Group: "apps", Resource: "replicasets"}, "", nil)
+	})
+	c := NewController(fake.NewSimpleClientset(), metadataClient, Options{
+		DomainSuffix: domainSuffix,
+		XDSUpdater:   NewFakeXDS(),
+		Metrics:      &model.Environment{},
+	})
+	c.stop = make(chan struct{})
+	go c.Run(c.stop)
+	defer c.Stop()
+
+	select {
+	case <-c.Synced():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the controller did not sync without the ReplicaSets")
+	}
+	if c.pods.replicaSetInformer.HasSynced() {
+		t.Fatal("the ReplicaSets synced despite the forbidden list")
+	}
+}
+
+func TestPodByProxyID(t *testing.T) {
+	c, _ := newFakeControllerWithOptions(fakeControllerOptions{mode: EndpointsOnly})
+	defer c.Stop()
+
+	statefulPod := func(ip, name, hostname, subdomain string) *v1.Pod {
+		pod := generatePod(ip, name, "nsa", "", "node1", map[string]string{"app": name}, map[string]string{})
+		pod.Spec.Hostname = hostname
+		pod.Spec.Subdomain = subdomain
+		return pod
+	}
+	pods := []*v1.Pod{
+		statefulPod("128.0.0.1", "web-0", "", ""),
+		statefulPod("128.0.0.2", "db-0", "primary", "db"),
+		statefulPod("128.0.0.3", "cache-0", "shared", "cache"),
+		statefulPod("128.0.0.4", "queue-0", "shared", "queue"),
+	}
+	addPods(t, c, pods...)
+	for _, pod := range pods {
+		if err := waitForPod(c, pod.Status.PodIP); err != nil {
+			t.Fatalf("wait for pod err: %v", err)
+		}
+	}
+
+	cases := []struct {
+		id        string
+		namespace string
+		want      string
+	}{
+		{"web-0.nsa", "", "web-0"},
+		{"web-0", "nsa", "web-0"},
+		{"primary.nsa", "", "db-0"},
+		{"primary.db.nsa", "", "db-0"},
+		{"shared.cache.nsa", "", "cache-0"},
+		{"shared.queue.nsa", "", "queue-0"},
+		// Ambiguous without the subdomain.
+		{"shared.nsa", "", ""},
+		{"primary.other", "", ""},
+		{"unknown.nsa", "", ""},
+	}
+	for _, tt := range cases {
+		t.Run(tt.id, func(t *testing.T) {
+			got := ""
+			if pod := c.pods.getPodByProxyID(tt.id, tt.namespace); pod != nil {
+				got = pod.Name
+			}
+			if got != tt.want {
+				t.Fatalf("got pod %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sort"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+)
+
+const (
+	// podStateCached is the state of the pods indexed by IP.
+	podStateCached = "cached"
+	// podStatePendingIP is the state of the pending or running pods not assigned an IP yet.
+	podStatePendingIP = "pendingIP"
+	// podStateStale is the state of the IP entries whose pod is no longer in the informer store.
+	podStateStale = "stale"
+)
+
+var (
+	stateTag = monitoring.MustCreateLabel("state")
+
+	podCachePods = monitoring.NewGauge(
+		"pilot_k8s_pod_cache_pods",
+		"Pods of the pod cache by state. Stale entries are only counted when the stats are read.",
+		monitoring.WithLabels(clusterTag, stateTag),
+	)
+)
+
+func init() {
+	monitoring.MustRegister(podCachePods)
+}
+
+// PodCacheStats counts the pods of a PodCache by state.
+type PodCacheStats struct {
+	// Cached is the number of pods indexed by IP, including the stale ones.
+	Cached int `json:"cached"`
+	// PendingIP is the number of pending or running pods not assigned an IP yet.
+	PendingIP int `json:"pendingIP"`
+	// Stale is the number of IP entries whose pod object is no longer in the informer store.
+	Stale int `json:"stale"`
+	// ProxyUnready is the number of cached pods whose proxy container is not ready.
+	ProxyUnready int `json:"proxyUnready"`
+}
+
+// PendingPod is a pod waiting for its IP, which has no endpoints nor proxy lookups yet.
+type PendingPod struct {
+	Name      string      `json:"name"`
+	Namespace string      `json:"namespace"`
+	Phase     v1.PodPhase `json:"phase"`
+	// Since is when the pod was first seen without an IP.
+	Since time.Time `json:"since"`
+}
+
+// PodCacheStatus is the state of the pod cache of a cluster, for the debug dumps.
+type PodCacheStatus struct {
+	Cluster string        `json:"cluster"`
+	Stats   PodCacheStats `json:"stats"`
+	Pending []PendingPod  `json:"pending"`
+}
+
+// setPendingIP tracks whether the pod waits for its IP. It must be called with the lock held.
+func (pc *PodCache) setPendingIP(key string, pod *v1.Pod, ev model.Event) {
+	pending := ev != model.EventDelete && pod.DeletionTimestamp == nil && pod.Status.PodIP == "" &&
+		(pod.Status.Phase == v1.PodPending || pod.Status.Phase == v1.PodRunning)
+	if !pending {
+		delete(pc.pendingIP, key)
+		return
+	}
+	if current, f := pc.pendingIP[key]; f {
+		current.Phase = pod.Status.Phase
+		pc.pendingIP[key] = current
+		return
+	}
+	since := time.Now()
+	if pc.c != nil && pc.c.clock != nil {
+		since = pc.c.clock.Now()
+	}
+	pc.pendingIP[key] = PendingPod{Name: pod.Name, Namespace: pod.Namespace, Phase: pod.Status.Phase, Since: since}
+}
+
+// recordStats records the gauges of the states tracked on events. It must be called with the
+// lock held.
+func (pc *PodCache) recordStats() {
+	cluster := pc.cluster()
+	podCachePods.With(clusterTag.Value(cluster), stateTag.Value(podStateCached)).Record(float64(len(pc.podsByIP)))
+	podCachePods.With(clusterTag.Value(cluster), stateTag.Value(podStatePendingIP)).Record(float64(len(pc.pendingIP)))
+}
+
+func (pc *PodCache) cluster() string {
+	if pc.c == nil {
+		return ""
+	}
+	return pc.c.clusterID
+}
+
+// Stats counts the pods of the cache by state. Stale entries are found by looking up the pod of
+// every IP entry in the informer store.
+func (pc *PodCache) Stats() PodCacheStats {
+	pc.RLock()
+	stats := PodCacheStats{
+		Cached:       len(pc.podsByIP),
+		PendingIP:    len(pc.pendingIP),
+		ProxyUnready: len(pc.proxyUnreadyByPod),
+	}
+	pc.RUnlock()
+	stats.Stale = len(pc.staleIPs())
+	podCachePods.With(clusterTag.Value(pc.cluster()), stateTag.Value(podStateStale)).Record(float64(stats.Stale))
+	return stats
+}
+
+// staleIPs returns the IP entries, by IP, whose pod is no longer in the informer store.
+func (pc *PodCache) staleIPs() map[string]string {
+	pc.RLock()
+	byIP := make(map[string]string, len(pc.podsByIP))
+	for ip, key := range pc.podsByIP {
+		byIP[ip] = key
+	}
+	pc.RUnlock()
+
+	stale := make(map[string]string)
+	store := pc.informer.GetStore()
+	for ip, key := range byIP {
+		if _, exists, err := store.GetByKey(key); !exists || err != nil {
+			stale[ip] = key
+		}
+	}
+	return stale
+}
+
+// PendingPods returns the pods waiting for their IP, sorted by namespace and name.
+func (pc *PodCache) PendingPods() []PendingPod {
+	pc.RLock()
+	out := make([]PendingPod, 0, len(pc.pendingIP))
+	for _, pending := range pc.pendingIP {
+		out = append(out, pending)
+	}
+	pc.RUnlock()
+	sort.Slice(out, func(i, j int) bool {
+		return kube.KeyFunc(out[i].Name, out[i].Namespace) < kube.KeyFunc(out[j].Name, out[j].Namespace)
+	})
+	return out
+}
+
+// PodCacheStatus returns the stats of the pod cache and its pods waiting for their IP.
+func (c *Controller) PodCacheStatus() PodCacheStatus {
+	return PodCacheStatus{
+		Cluster: c.clusterID,
+		Stats:   c.pods.Stats(),
+		Pending: c.pods.PendingPods(),
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPodCacheStats(t *testing.T) {
+	controller, _ := newFakeHarness(t, Options{ClusterID: "cluster1"})
+	defer controller.Stop()
+
+	assertStats := func(step string, want PodCacheStats) {
+		t.Helper()
+		if got := controller.pods.Stats(); got != want {
+			t.Fatalf("%s: got stats %+v, want %+v", step, got, want)
+		}
+	}
+	pods := controller.Client.CoreV1().Pods("nsA")
+
+	// The pod is created before its IP is assigned.
+	pod := generatePod("", "pod1", "nsA", "", "", map[string]string{"app": "prod-app"}, nil)
+	pod.Status.Phase = coreV1.PodPending
+	do(t, controller, func() {
+		if _, err := pods.Create(context.TODO(), pod, metaV1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assertStats("created", PodCacheStats{PendingIP: 1})
+	want := []PendingPod{{Name: "pod1", Namespace: "nsA", Phase: coreV1.PodPending, Since: time.Unix(0, 0)}}
+	if got := controller.pods.PendingPods(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got pending pods %+v, want %+v", got, want)
+	}
+
+	pod.Status.PodIP = "128.0.0.1"
+	pod.Status.Phase = coreV1.PodRunning
+	do(t, controller, func() {
+		if _, err := pods.UpdateStatus(context.TODO(), pod, metaV1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assertStats("IP assigned", PodCacheStats{Cached: 1})
+	if got := controller.pods.PendingPods(); len(got) != 0 {
+		t.Fatalf("got pending pods %+v, want none", got)
+	}
+
+	// An IP entry whose pod left the informer store is stale.
+	store := controller.pods.informer.GetStore()
+	cached, _, _ := store.GetByKey("nsA/pod1")
+	if err := store.Delete(cached); err != nil {
+		t.Fatal(err)
+	}
+	assertStats("pod missing from the store", PodCacheStats{Cached: 1, Stale: 1})
+	if err := store.Add(cached); err != nil {
+		t.Fatal(err)
+	}
+
+	do(t, controller, func() {
+		if err := pods.Delete(context.TODO(), "pod1", metaV1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assertStats("deleted", PodCacheStats{})
+
+	status := controller.PodCacheStatus()
+	if status.Cluster != "cluster1" || status.Stats != (PodCacheStats{}) || len(status.Pending) != 0 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/host"
+)
+
+// InvalidPortConfigReason is the reason of the warning events of services with an invalid
+// PortConfigAnnotation.
+const InvalidPortConfigReason = "InvalidPortConfig"
+
+var invalidPortConfigs = monitoring.NewSum(
+	"pilot_k8s_invalid_port_configs",
+	"Services found with an invalid port config annotation.",
+	monitoring.WithLabels(namespaceTag),
+)
+
+func init() {
+	monitoring.MustRegister(invalidPortConfigs)
+}
+
+// checkPortConfig reports an invalid PortConfigAnnotation of the service with a log, a metric and
+// a warning event on the service, once per value of the annotation. The valid entries were
+// attached to the service by its conversion.
+func (c *Controller) checkPortConfig(svc *v1.Service, hostname host.Name) {
+	configs, err := kube.ParsePortConfig(svc)
+	value := svc.Annotations[kube.PortConfigAnnotation]
+	c.Lock()
+	prev, wasInvalid := c.invalidPortConfigs[hostname]
+	if err != nil {
+		c.invalidPortConfigs[hostname] = value
+	} else {
+		delete(c.invalidPortConfigs, hostname)
+	}
+	c.Unlock()
+	if err == nil || (wasInvalid && prev == value) {
+		return
+	}
+
+	effect := "its invalid entries are ignored"
+	if configs == nil {
+		effect = "it is ignored"
+	}
+	message := fmt.Sprintf("invalid %s annotation, %s: %v", kube.PortConfigAnnotation, effect, err)
+	log.Warnf("service %s/%s: %s", svc.Namespace, svc.Name, message)
+	invalidPortConfigs.With(namespaceTag.Value(svc.Namespace)).Increment()
+	c.recordServiceWarning(svc, InvalidPortConfigReason, message)
+}
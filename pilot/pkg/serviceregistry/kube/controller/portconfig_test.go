@@ -0,0 +1,129 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+func TestPortConfigAnnotation(t *testing.T) {
+	controller, fx := newFakeHarness(t, Options{})
+	defer controller.Stop()
+
+	hostname := kube.ServiceHostname("svc1", "nsA", domainSuffix)
+	svc := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      "svc1",
+			Namespace: "nsA",
+			// The entry of port 9090 is invalid, the service does not declare it.
+			Annotations: map[string]string{kube.PortConfigAnnotation: `{"8443": {"appTLS": true}, "9090": {"appTLS": true}}`},
+		},
+		Spec: coreV1.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+			Ports:     []coreV1.ServicePort{{Name: "https", Port: 8443}},
+		},
+	}
+	services := controller.Client.CoreV1().Services("nsA")
+	write := func(create bool) {
+		t.Helper()
+		do(t, controller, func() {
+			var err error
+			if create {
+				_, err = services.Create(context.TODO(), svc, metaV1.CreateOptions{})
+			} else {
+				_, err = services.Update(context.TODO(), svc, metaV1.UpdateOptions{})
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+	assertPortConfigs := func(want map[int]model.PortConfig) {
+		t.Helper()
+		converted, _ := controller.GetService(hostname)
+		if converted == nil {
+			t.Fatal("service not found")
+		}
+		if got := converted.Attributes.PortConfigs; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got port configs %v, want %v", got, want)
+		}
+	}
+	// The events are recorded in the background.
+	assertWarnings := func(want int) {
+		t.Helper()
+		retry.UntilSuccessOrFail(t, func() error {
+			events, err := controller.Client.CoreV1().Events("nsA").List(context.TODO(), metaV1.ListOptions{})
+			if err != nil {
+				return err
+			}
+			got := 0
+			for _, e := range events.Items {
+				if e.Reason == InvalidPortConfigReason && e.Type == coreV1.EventTypeWarning && e.InvolvedObject.Name == "svc1" {
+					got++
+				}
+			}
+			if got != want {
+				return fmt.Errorf("got %d warning events, want %d", got, want)
+			}
+			return nil
+		}, retry.Timeout(5*time.Second))
+	}
+
+	write(true)
+	// The valid entries apply.
+	assertPortConfigs(map[int]model.PortConfig{8443: {AppTLS: true}})
+	assertWarnings(1)
+
+	// Updates keeping the same invalid value are not reported again.
+	svc.Labels = map[string]string{"app": "a"}
+	write(false)
+	assertWarnings(1)
+
+	// Changing the annotation pushes the service.
+	fx.Clear()
+	svc.Annotations[kube.PortConfigAnnotation] = `{"8443": {"appTLS": true, "minTLSVersion": "TLSv1_3"}}`
+	write(false)
+	assertPortConfigs(map[int]model.PortConfig{8443: {AppTLS: true, MinTLSVersion: "TLSv1_3"}})
+	ev := fx.Wait("xds")
+	if ev == nil {
+		t.Fatal("expected a push of the service")
+	}
+	if _, f := ev.ConfigsUpdated[model.ConfigKey{Kind: model.ServiceEntryKind, Name: string(hostname), Namespace: "nsA"}]; !f {
+		t.Fatalf("expected a push of %s, got %v", hostname, ev.ConfigsUpdated)
+	}
+	controller.RLock()
+	_, invalid := controller.invalidPortConfigs[hostname]
+	controller.RUnlock()
+	if invalid {
+		t.Fatal("expected the fixed annotation to no longer be invalid")
+	}
+
+	// An annotation that is not JSON is ignored as a whole.
+	svc.Annotations[kube.PortConfigAnnotation] = `{"8443": `
+	write(false)
+	assertPortConfigs(nil)
+	assertWarnings(2)
+}
@@ -0,0 +1,90 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+)
+
+var targetPortConflicts = monitoring.NewSum(
+	"pilot_k8s_target_port_protocol_conflicts",
+	"Services declaring another protocol for the target port of a proxy than the service taking precedence. "+
+		"Counted once per pair of services and port.",
+	monitoring.WithLabels(clusterTag),
+)
+
+func init() {
+	monitoring.MustRegister(targetPortConflicts)
+}
+
+// sortServicesByPrecedence sorts the services selecting the same pods by precedence: the oldest
+// first, then by namespace and name. It decides which service sets the protocol of a target port
+// the services declare different protocols for, see resolveTargetPortConflicts.
+func sortServicesByPrecedence(services []*v1.Service) {
+	sort.SliceStable(services, func(i, j int) bool {
+		ti, tj := services[i].CreationTimestamp, services[j].CreationTimestamp
+		if !ti.Equal(&tj) {
+			return ti.Before(&tj)
+		}
+		return kube.KeyFunc(services[i].Name, services[i].Namespace) < kube.KeyFunc(services[j].Name, services[j].Namespace)
+	})
+}
+
+// resolveTargetPortConflicts drops the instances of a proxy whose protocol differs from the one of
+// the first instance on the same target port, as the proxy has a single inbound listener per port.
+// The instances are in service precedence order, so the oldest service wins. The ports of the
+// winning service sharing the target port are all kept, as they were before the services conflicted.
+func (c *Controller) resolveTargetPortConflicts(instances []*model.ServiceInstance) []*model.ServiceInstance {
+	winners := make(map[uint32]*model.ServiceInstance)
+	out := make([]*model.ServiceInstance, 0, len(instances))
+	for _, si := range instances {
+		port := si.Endpoint.EndpointPort
+		winner, f := winners[port]
+		if !f {
+			winners[port] = si
+		} else if winner.Service.Hostname != si.Service.Hostname && winner.ServicePort.Protocol != si.ServicePort.Protocol {
+			c.reportTargetPortConflict(winner, si)
+			continue
+		}
+		out = append(out, si)
+	}
+	return out
+}
+
+// reportTargetPortConflict logs and counts a conflict once per pair of services and port, as the
+// instances of proxies are resolved again on every push.
+func (c *Controller) reportTargetPortConflict(winner, loser *model.ServiceInstance) {
+	key := fmt.Sprintf("%s/%s/%d", loser.Service.Hostname, winner.Service.Hostname, loser.Endpoint.EndpointPort)
+	c.targetPortConflictsMutex.Lock()
+	_, reported := c.targetPortConflicts[key]
+	c.targetPortConflicts[key] = struct{}{}
+	c.targetPortConflictsMutex.Unlock()
+	if reported {
+		return
+	}
+	log.Warnf("Service %s declares the protocol %s for target port %d, %s of service %s is used instead",
+		loser.Service.Hostname, loser.ServicePort.Protocol, loser.Endpoint.EndpointPort,
+		winner.ServicePort.Protocol, winner.Service.Hostname)
+	targetPortConflicts.With(clusterTag.Value(c.clusterID)).Increment()
+}
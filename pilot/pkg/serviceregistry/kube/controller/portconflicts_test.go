@@ -0,0 +1,109 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/protocol"
+)
+
+func TestTargetPortProtocolConflict(t *testing.T) {
+	older := metaV1.NewTime(time.Unix(1000, 0))
+	newer := metaV1.NewTime(time.Unix(2000, 0))
+	cases := []struct {
+		name        string
+		httpCreated metaV1.Time
+		tcpCreated  metaV1.Time
+		want        string
+		protocol    protocol.Instance
+	}{
+		{"older http service wins", older, newer, "svc-http", protocol.HTTP},
+		{"older tcp service wins", newer, older, "svc-tcp", protocol.TCP},
+		{"first by name wins", older, older, "svc-http", protocol.HTTP},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			controller, _ := newFakeHarness(t, Options{ClusterID: "cluster1"})
+			defer controller.Stop()
+
+			selector := map[string]string{"app": "a"}
+			addPodsSync(t, controller, generatePod("128.0.0.1", "pod1", "nsA", "", "", selector, nil))
+			for _, svc := range []struct {
+				name     string
+				portName string
+				created  metaV1.Time
+			}{{"svc-http", "http-web", tt.httpCreated}, {"svc-tcp", "tcp-web", tt.tcpCreated}} {
+				service := &coreV1.Service{
+					ObjectMeta: metaV1.ObjectMeta{Name: svc.name, Namespace: "nsA", CreationTimestamp: svc.created},
+					Spec: coreV1.ServiceSpec{
+						ClusterIP: "10.0.0.1",
+						Selector:  selector,
+						Ports:     []coreV1.ServicePort{{Name: svc.portName, Port: 80, TargetPort: intstr.FromInt(8080)}},
+					},
+				}
+				do(t, controller, func() {
+					if _, err := controller.Client.CoreV1().Services("nsA").Create(context.TODO(), service, metaV1.CreateOptions{}); err != nil {
+						t.Fatal(err)
+					}
+				})
+			}
+
+			proxies := map[ProxyInstancesPath]*model.Proxy{
+				ProxyInstancesPod: {
+					IPAddresses: []string{"128.0.0.1"},
+					Metadata:    &model.NodeMetadata{Namespace: "nsA", ClusterID: "cluster1"},
+				},
+				ProxyInstancesMetadata: {
+					IPAddresses:     []string{"128.0.0.9"},
+					ConfigNamespace: "nsA",
+					Metadata:        &model.NodeMetadata{ClusterID: "cluster1", Labels: selector},
+				},
+			}
+			conflicts := sumValue(t, "pilot_k8s_target_port_protocol_conflicts", map[string]string{"cluster": "cluster1"})
+			for path, proxy := range proxies {
+				// The same service wins every time.
+				for i := 0; i < 10; i++ {
+					result := controller.ResolveProxyServiceInstances(proxy)
+					if result.Path != path {
+						t.Fatalf("got path %q, want %q", result.Path, path)
+					}
+					if len(result.Instances) != 1 {
+						t.Fatalf("got %d instances, want 1", len(result.Instances))
+					}
+					si := result.Instances[0]
+					if si.Service.Hostname != kube.ServiceHostname(tt.want, "nsA", domainSuffix) || si.ServicePort.Protocol != tt.protocol {
+						t.Fatalf("got instance of %s with protocol %s, want %s with %s", si.Service.Hostname, si.ServicePort.Protocol, tt.want, tt.protocol)
+					}
+					if si.Endpoint.EndpointPort != 8080 {
+						t.Fatalf("got endpoint port %d, want 8080", si.Endpoint.EndpointPort)
+					}
+				}
+			}
+			// The conflict is only counted once, whatever the proxy and the number of resolutions.
+			if got := sumValue(t, "pilot_k8s_target_port_protocol_conflicts", map[string]string{"cluster": "cluster1"}) - conflicts; got != 1 {
+				t.Fatalf("got %v conflicts, want 1", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/host"
+	configKube "istio.io/istio/pkg/config/kube"
+)
+
+const (
+	// UnknownAppProtocolReason is the reason of the warnings for ports whose appProtocol is not a
+	// protocol Istio knows, they are treated as opaque TCP.
+	UnknownAppProtocolReason = "UnknownAppProtocol"
+	// PortNameProtocolReason is the reason of the warnings for ports whose protocol is derived from
+	// their name, as they do not set appProtocol.
+	PortNameProtocolReason = "PortNameProtocol"
+)
+
+// Warning is an issue found by PreviewService that does not keep the service out of the registry.
+type Warning struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// PreviewService returns the service the controller would add to the registry for svc, along with
+// the warnings the Service raises, without changing the controller. The conversion and validation
+// are those of the service events, the error is returned for services that would be filtered out
+// or rejected. The external addresses of node port gateways are computed from the current nodes.
+func (c *Controller) PreviewService(svc *v1.Service) (*model.Service, []Warning, error) {
+	if c.isFilteredOut(svc) {
+		return nil, nil, fmt.Errorf("service %s/%s is filtered out", svc.Namespace, svc.Name)
+	}
+	svcConv := c.convertService(svc)
+	warnings := portProtocolWarnings(svc)
+
+	if isNodePortGatewayService(svc) {
+		selector, err := c.nodeSelectorForService(svc)
+		if err != nil {
+			warnings = append(warnings, Warning{
+				Reason:  InvalidNodeSelectorReason,
+				Message: fmt.Sprintf("invalid %s annotation: %v", kube.NodeSelectorAnnotation, err),
+			})
+		}
+		addresses := getExternalAddressesForService(*svc)
+		if len(addresses) == 0 && (err == nil || c.gateways.legacyNodeSelectors) {
+			addresses = c.NodeAddressesForSelector(selector)
+		}
+		svcConv.Attributes.ClusterExternalAddresses = map[string][]string{c.clusterID: addresses}
+	}
+
+	if svc.Spec.Type == v1.ServiceTypeExternalName && svc.Spec.ExternalName != "" && c.isAliasTarget(normalizeExternalName(svc)) {
+		svcConv.Resolution = model.ClientSideLB
+		svcConv.MeshExternal = false
+	}
+
+	if rejection := validateConvertedService(svcConv); rejection != nil {
+		return nil, warnings, rejection
+	}
+	return svcConv, warnings, nil
+}
+
+// isAliasTarget reports whether an ExternalName service of the external name would be an alias,
+// that is whether the name is a service of the registry or an alias of one.
+func (c *Controller) isAliasTarget(name host.Name) bool {
+	c.RLock()
+	defer c.RUnlock()
+	if _, f := c.externalNameTargets[name]; f {
+		target, _, err := c.resolveExternalNameAliasLocked(name)
+		return target != nil && err == nil
+	}
+	_, f := c.servicesMap[name]
+	return f
+}
+
+// portProtocolWarnings returns the warnings for the ports of the service whose protocol is either
+// not understood or only known from their name.
+func portProtocolWarnings(svc *v1.Service) []Warning {
+	var warnings []Warning
+	for _, port := range svc.Spec.Ports {
+		if port.Protocol == v1.ProtocolUDP {
+			continue
+		}
+		if port.AppProtocol != nil {
+			if configKube.ConvertProtocol(port.Port, port.Name, port.Protocol, port.AppProtocol).IsUnsupported() {
+				warnings = append(warnings, Warning{
+					Reason:  UnknownAppProtocolReason,
+					Message: fmt.Sprintf("appProtocol %q of port %d is not a known protocol", *port.AppProtocol, port.Port),
+				})
+			}
+			continue
+		}
+		// Port 0 is not a well known port, so the protocol can only come from the name.
+		if p := configKube.ConvertProtocol(0, port.Name, port.Protocol, nil); !p.IsUnsupported() {
+			warnings = append(warnings, Warning{
+				Reason:  PortNameProtocolReason,
+				Message: fmt.Sprintf("protocol %s of port %d is derived from its name %q, appProtocol is not set", p, port.Port, port.Name),
+			})
+		}
+	}
+	return warnings
+}
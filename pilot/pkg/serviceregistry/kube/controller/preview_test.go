@@ -0,0 +1,182 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+func TestPreviewService(t *testing.T) {
+	controller, _ := newFakeControllerWithOptions(fakeControllerOptions{
+		clusterID:     "cluster1",
+		serviceFilter: func(svc *coreV1.Service) bool { return svc.Namespace == "filtered" },
+	})
+	defer controller.Stop()
+
+	appProtocol := func(p string) *string { return &p }
+	newService := func(name, namespace string, spec coreV1.ServiceSpec, annotations map[string]string) *coreV1.Service {
+		return &coreV1.Service{
+			ObjectMeta: metaV1.ObjectMeta{Name: name, Namespace: namespace, Annotations: annotations},
+			Spec:       spec,
+		}
+	}
+	cases := []struct {
+		name string
+		svc  *coreV1.Service
+		// warnings are the reasons of the expected warnings.
+		warnings []string
+		// rejected is the reason of the rejection of the service, if any.
+		rejected string
+		filtered bool
+	}{
+		{
+			name: "port name protocol",
+			svc: newService("named", "nsA", coreV1.ServiceSpec{
+				ClusterIP: "10.0.0.1",
+				Ports:     []coreV1.ServicePort{{Name: "http-web", Port: 80, Protocol: coreV1.ProtocolTCP}},
+			}, nil),
+			warnings: []string{PortNameProtocolReason},
+		},
+		{
+			name: "app protocol",
+			svc: newService("headless", "nsA", coreV1.ServiceSpec{
+				ClusterIP: coreV1.ClusterIPNone,
+				Ports: []coreV1.ServicePort{
+					{Name: "web", Port: 80, Protocol: coreV1.ProtocolTCP, AppProtocol: appProtocol("http")},
+					{Name: "dns", Port: 53, Protocol: coreV1.ProtocolUDP},
+				},
+			}, nil),
+		},
+		{
+			name: "unknown app protocol",
+			svc: newService("unknown", "nsA", coreV1.ServiceSpec{
+				ClusterIP: "10.0.0.2",
+				Ports: []coreV1.ServicePort{
+					{Name: "grpc", Port: 8080, Protocol: coreV1.ProtocolTCP, AppProtocol: appProtocol("bogus")},
+				},
+			}, nil),
+			warnings: []string{UnknownAppProtocolReason},
+		},
+		{
+			name: "gateway with invalid node selector",
+			svc: newService("gateway", "nsA", coreV1.ServiceSpec{
+				ClusterIP: "10.0.0.3",
+				Type:      coreV1.ServiceTypeNodePort,
+				Ports:     []coreV1.ServicePort{{Name: "gw", Port: 15443, NodePort: 32443, Protocol: coreV1.ProtocolTCP}},
+			}, map[string]string{kube.NodeSelectorAnnotation: "{"}),
+			warnings: []string{InvalidNodeSelectorReason},
+		},
+		{
+			name: "external name",
+			svc: newService("external", "nsA", coreV1.ServiceSpec{
+				Type:         coreV1.ServiceTypeExternalName,
+				ExternalName: "example.com",
+				Ports:        []coreV1.ServicePort{{Name: "port", Port: 443, Protocol: coreV1.ProtocolTCP}},
+			}, nil),
+		},
+		{
+			name: "alias",
+			svc: newService("alias", "nsA", coreV1.ServiceSpec{
+				Type:         coreV1.ServiceTypeExternalName,
+				ExternalName: "named.nsA.svc." + domainSuffix,
+				Ports:        []coreV1.ServicePort{{Name: "port", Port: 80, Protocol: coreV1.ProtocolTCP}},
+			}, nil),
+		},
+		{
+			name: "rejected",
+			svc: newService("udp", "nsA", coreV1.ServiceSpec{
+				ClusterIP: "10.0.0.4",
+				Ports:     []coreV1.ServicePort{{Name: "dns", Port: 53, Protocol: coreV1.ProtocolUDP}},
+			}, nil),
+			rejected: RejectedNoUsablePorts,
+		},
+		{
+			name: "filtered",
+			svc: newService("svc1", "filtered", coreV1.ServiceSpec{
+				ClusterIP: "10.0.0.5",
+				Ports:     []coreV1.ServicePort{{Name: "tcp", Port: 8080, Protocol: coreV1.ProtocolTCP}},
+			}, nil),
+			filtered: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			svc, err := controller.client.CoreV1().Services(tc.svc.Namespace).Create(context.TODO(), tc.svc, metaV1.CreateOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			hostname := kube.ServiceHostname(svc.Name, svc.Namespace, domainSuffix)
+
+			// The registry is updated asynchronously.
+			var actual *model.Service
+			retry.UntilSuccessOrFail(t, func() error {
+				switch {
+				case tc.filtered:
+					if !controller.isSkippedService(hostname) {
+						return fmt.Errorf("service %s not filtered out yet", hostname)
+					}
+				case tc.rejected != "":
+					if len(controller.RejectedServices()) == 0 {
+						return fmt.Errorf("service %s not rejected yet", hostname)
+					}
+				default:
+					if actual, _ = controller.GetService(hostname); actual == nil {
+						return fmt.Errorf("service %s not found", hostname)
+					}
+				}
+				return nil
+			}, retry.Timeout(5*time.Second))
+
+			preview, warnings, err := controller.PreviewService(svc)
+			var reasons []string
+			for _, w := range warnings {
+				reasons = append(reasons, w.Reason)
+			}
+			if !reflect.DeepEqual(reasons, tc.warnings) {
+				t.Errorf("got warnings %v, want reasons %v", warnings, tc.warnings)
+			}
+			switch {
+			case tc.filtered:
+				if err == nil || preview != nil {
+					t.Fatalf("got preview %v, error %v, want the service filtered out", preview, err)
+				}
+			case tc.rejected != "":
+				var rejection *ServiceRejectedError
+				if !errors.As(err, &rejection) || rejection.Reason != tc.rejected || preview != nil {
+					t.Fatalf("got preview %v, error %v, want a rejection for %s", preview, err, tc.rejected)
+				}
+			default:
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(preview, actual) {
+					t.Fatalf("got preview %+v, want the service of the registry %+v", preview, actual)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	v1 "k8s.io/api/core/v1"
+
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+)
+
+// prometheusScrape holds the Prometheus scrape settings of a workload, read from the
+// PrometheusScrape, PrometheusPort and PrometheusPath annotations.
+type prometheusScrape struct {
+	port string
+	path string
+}
+
+// prometheusScrapeFromAnnotations returns the scrape settings of the annotations, nil when scraping
+// is not enabled. set reports whether the annotations configure scraping at all, in which case they
+// take precedence over those of the service even when scraping is disabled.
+func prometheusScrapeFromAnnotations(annotations map[string]string) (scrape *prometheusScrape, set bool) {
+	enabled, set := annotations[PrometheusScrape]
+	if !set || enabled != "true" {
+		return nil, set
+	}
+	scrape = &prometheusScrape{port: annotations[PrometheusPort], path: annotations[PrometheusPath]}
+	if scrape.path == "" {
+		scrape.path = PrometheusPathDefault
+	}
+	return scrape, true
+}
+
+// servicePrometheusScrape returns the scrape settings of the service, which apply to the pods of the
+// service without their own.
+func servicePrometheusScrape(svc *v1.Service) *prometheusScrape {
+	scrape, _ := prometheusScrapeFromAnnotations(svc.Annotations)
+	return scrape
+}
+
+// getServicePrometheusScrape returns the scrape settings of the service with the hostname.
+func (c *Controller) getServicePrometheusScrape(hostname host.Name) *prometheusScrape {
+	c.RLock()
+	defer c.RUnlock()
+	return c.prometheusScrapes[hostname]
+}
+
+// effectivePrometheusScrape returns the scrape settings of the pod, or those of its service when the
+// pod has no scrape annotations.
+func effectivePrometheusScrape(pod *v1.Pod, svcScrape *prometheusScrape) *prometheusScrape {
+	if pod != nil {
+		if scrape, set := prometheusScrapeFromAnnotations(pod.Annotations); set {
+			return scrape
+		}
+	}
+	return svcScrape
+}
+
+// withPrometheusScrape labels the endpoints built from now on with the effective scrape settings of
+// the pod, so that metrics merging can be configured for workloads only annotated through their
+// service. The labels are keyed by the annotation names.
+func (b *EndpointBuilder) withPrometheusScrape(pod *v1.Pod, svcScrape *prometheusScrape) *EndpointBuilder {
+	scrape := effectivePrometheusScrape(pod, svcScrape)
+	if scrape == nil {
+		return b
+	}
+	// Copy so the labels of the pod are not modified.
+	out := make(labels.Instance, len(b.labels)+3)
+	for k, v := range b.labels {
+		out[k] = v
+	}
+	out[PrometheusScrape] = "true"
+	out[PrometheusPath] = scrape.path
+	if scrape.port != "" {
+		out[PrometheusPort] = scrape.port
+	}
+	b.labels = out
+	return b
+}
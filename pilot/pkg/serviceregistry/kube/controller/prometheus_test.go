@@ -0,0 +1,143 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+)
+
+func TestEffectivePrometheusScrape(t *testing.T) {
+	svcScrape := &prometheusScrape{port: "15020", path: "/stats/prometheus"}
+	cases := []struct {
+		name           string
+		podAnnotations map[string]string
+		svcScrape      *prometheusScrape
+		want           *prometheusScrape
+	}{
+		{"no annotations", nil, nil, nil},
+		{"service only", nil, svcScrape, svcScrape},
+		{
+			"pod overrides service",
+			map[string]string{PrometheusScrape: "true", PrometheusPort: "9090"},
+			svcScrape,
+			&prometheusScrape{port: "9090", path: PrometheusPathDefault},
+		},
+		{"pod disables scraping", map[string]string{PrometheusScrape: "false"}, svcScrape, nil},
+		{"pod without scrape annotation", map[string]string{PrometheusPort: "9090"}, svcScrape, svcScrape},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := generatePod("128.0.0.1", "pod1", "nsA", "", "", nil, tc.podAnnotations)
+			if got := effectivePrometheusScrape(pod, tc.svcScrape); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPrometheusScrapeEndpointLabels(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: mode})
+			defer controller.Stop()
+
+			podLabels := map[string]string{"app": "prod-app"}
+			pods := []*coreV1.Pod{
+				generatePod("128.0.0.1", "pod1", "nsA", "", "", podLabels, nil),
+				generatePod("128.0.0.2", "pod2", "nsA", "", "", podLabels,
+					map[string]string{PrometheusScrape: "true", PrometheusPort: "9090", PrometheusPath: "/custom"}),
+			}
+			addPods(t, controller, pods...)
+			for _, pod := range pods {
+				if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			createService(controller, "svc1", "nsA",
+				map[string]string{PrometheusScrape: "true", PrometheusPort: "15020"},
+				[]int32{8080}, podLabels, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1", "128.0.0.2"}, t)
+
+			hostname := string(kube.ServiceHostname("svc1", "nsA", domainSuffix))
+			expectLabels := func(want map[string]map[string]string) {
+				t.Helper()
+				var got map[string]map[string]string
+				for {
+					ev := fx.Wait("eds")
+					if ev == nil {
+						t.Fatalf("Timeout waiting for endpoints labeled %v, last got %v", want, got)
+					}
+					if ev.ID != hostname {
+						continue
+					}
+					got = make(map[string]map[string]string, len(ev.Endpoints))
+					for _, ep := range ev.Endpoints {
+						got[ep.Address] = scrapeLabels(ep)
+					}
+					if reflect.DeepEqual(got, want) {
+						return
+					}
+				}
+			}
+			podScrape := map[string]string{PrometheusScrape: "true", PrometheusPort: "9090", PrometheusPath: "/custom"}
+			expectLabels(map[string]map[string]string{
+				"128.0.0.1": {PrometheusScrape: "true", PrometheusPort: "15020", PrometheusPath: PrometheusPathDefault},
+				"128.0.0.2": podScrape,
+			})
+			if pods[0].Labels[PrometheusScrape] != "" {
+				t.Fatal("the labels of the pod were modified")
+			}
+
+			// Removing the annotations of the service refreshes its endpoints.
+			svc, err := controller.client.CoreV1().Services("nsA").Get(context.TODO(), "svc1", metaV1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			svc = svc.DeepCopy()
+			svc.Annotations = nil
+			if _, err := controller.client.CoreV1().Services("nsA").Update(context.TODO(), svc, metaV1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			expectLabels(map[string]map[string]string{
+				"128.0.0.1": {},
+				"128.0.0.2": podScrape,
+			})
+		})
+	}
+}
+
+// scrapeLabels returns the Prometheus scrape labels of the endpoint.
+func scrapeLabels(ep *model.IstioEndpoint) map[string]string {
+	out := map[string]string{}
+	for _, key := range []string{PrometheusScrape, PrometheusPort, PrometheusPath} {
+		if v, f := ep.Labels[key]; f {
+			out[key] = v
+		}
+	}
+	return out
+}
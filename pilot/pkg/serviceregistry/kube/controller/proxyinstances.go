@@ -0,0 +1,184 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+// ProxyInstancesPath is the way the service instances of a proxy were resolved.
+type ProxyInstancesPath string
+
+const (
+	// ProxyInstancesNone is reported for proxies without IP addresses, which cannot be resolved.
+	ProxyInstancesNone ProxyInstancesPath = "none"
+	// ProxyInstancesForeign is reported for proxies of foreign instances, such as workload entries.
+	ProxyInstancesForeign ProxyInstancesPath = "foreign"
+	// ProxyInstancesPod is reported for proxies of known pods, including pods of another network
+	// and pods only backing services without selector.
+	ProxyInstancesPod ProxyInstancesPath = "pod"
+	// ProxyInstancesMetadata is reported for proxies whose pod is not known yet, resolved from
+	// their metadata.
+	ProxyInstancesMetadata ProxyInstancesPath = "metadata"
+)
+
+// ProxyInstancesResult is the outcome of the lookup of the service instances of a proxy.
+type ProxyInstancesResult struct {
+	Instances []*model.ServiceInstance
+	Path      ProxyInstancesPath
+	// Err is why the lookup failed as a whole, such as missing proxy metadata.
+	Err error
+	// ServiceErrors is why some services of the proxy could not be resolved, by hostname. The
+	// instances of the other services are still returned.
+	ServiceErrors map[host.Name]error
+	// NoInstancesReason is why no instances were found, such as ProxyNetworkMismatch. It is empty
+	// when some were.
+	NoInstancesReason string
+}
+
+// Degraded reports whether some services of the proxy may be missing from the instances, rather
+// than the proxy having no other service.
+func (r ProxyInstancesResult) Degraded() bool {
+	return r.Err != nil || len(r.ServiceErrors) > 0
+}
+
+// Error describes the errors of a degraded lookup.
+func (r ProxyInstancesResult) Error() string {
+	var msgs []string
+	if r.Err != nil {
+		msgs = append(msgs, r.Err.Error())
+	}
+	hostnames := make([]string, 0, len(r.ServiceErrors))
+	for hostname := range r.ServiceErrors {
+		hostnames = append(hostnames, string(hostname))
+	}
+	sort.Strings(hostnames)
+	for _, hostname := range hostnames {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", hostname, r.ServiceErrors[host.Name(hostname)]))
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// classify sets the reason no instances were found, unless some were.
+func (r *ProxyInstancesResult) classify(reason string) {
+	if len(r.Instances) == 0 {
+		r.NoInstancesReason = reason
+	}
+}
+
+func addServiceError(errs map[host.Name]error, hostname host.Name, err error) map[host.Name]error {
+	if errs == nil {
+		errs = make(map[host.Name]error)
+	}
+	errs[hostname] = err
+	return errs
+}
+
+// ResolveProxyServiceInstances looks up the service instances of a proxy like
+// GetProxyServiceInstances, also reporting how they were resolved and what failed.
+func (c *Controller) ResolveProxyServiceInstances(proxy *model.Proxy) ProxyInstancesResult {
+	result := ProxyInstancesResult{Instances: make([]*model.ServiceInstance, 0), Path: ProxyInstancesNone}
+	if len(proxy.IPAddresses) == 0 {
+		result.classify(ProxyNoAddress)
+		return result
+	}
+	if !c.allowsAnyProxyIP(proxy) {
+		result.classify(ProxyAddressRejected)
+		return result
+	}
+
+	// Multiple IPs belong to the same workload, but only one of them may be known to the registry,
+	// so look for the first IP that matches a workload entry, then resolve the pod.
+	pod, proxyIP := c.getProxyPod(proxy)
+	if foreign := c.getForeignServiceInstanceByProxy(proxy); foreign != nil {
+		result.Path = ProxyInstancesForeign
+		instances, err := c.hydrateForeignServiceInstance(foreign)
+		if err != nil {
+			result.Err = fmt.Errorf("hydrateForeignServiceInstance: %v", err)
+		} else {
+			result.Instances = instances
+		}
+		result.classify(ProxyForeignNotSelected)
+		return result
+	}
+
+	if pod != nil {
+		result.Path = ProxyInstancesPod
+		// for split horizon EDS k8s multi cluster, in case there are pods of the same ip across clusters,
+		// which can happen when multi clusters using same pod cidr.
+		// As we have proxy Network meta, compare it with the network which endpoint belongs to,
+		// if they are not same, ignore the pod, because the pod is in another cluster.
+		if proxy.Metadata.Network != c.endpointNetwork(proxyIP) {
+			result.classify(ProxyNetworkMismatch)
+			return result
+		}
+		// 1. find proxy service by label selector, if not any, there may exist headless service without selector
+		// failover to 2
+		if services, err := c.getPodServices(pod); err == nil && len(services) > 0 {
+			for _, svc := range services {
+				result.Instances = append(result.Instances, c.getProxyServiceInstancesByPod(pod, svc, proxy)...)
+			}
+			result.Instances = c.resolveTargetPortConflicts(result.Instances)
+			result.classify(ProxyNoServicePort)
+			return result
+		}
+		// 2. Headless service without selector
+		result.Instances = c.endpointsController().GetProxyServiceInstances(c, proxy)
+		result.classify(ProxyNotSelected)
+		return result
+	}
+
+	// 3. The pod is not present when this is called
+	// due to eventual consistency issues. However, we have a lot of information about the pod from the proxy
+	// metadata already. Because of this, we can still get most of the information we need.
+	// The services that cannot be accurately constructed from just the metadata are reported as errors.
+	// Proxies that never get a pod, such as stale ones, keep retrying: their lookups that found
+	// nothing are cached for a while, as the services have to be scanned to resolve them.
+	result.Path = ProxyInstancesMetadata
+	c.RLock()
+	servicesVersion := c.servicesVersion
+	c.RUnlock()
+	if cached, f := c.proxyNegativeCache.get(proxy.IPAddresses[0], proxy.ID, servicesVersion); f {
+		return cached
+	}
+	instances, serviceErrors, err := c.getProxyServiceInstancesFromMetadata(proxy)
+	if err != nil {
+		result.Err = fmt.Errorf("getProxyServiceInstancesFromMetadata: %v", err)
+	} else {
+		result.Instances = instances
+		result.ServiceErrors = serviceErrors
+	}
+	result.classify(ProxyPodNotFound)
+	if len(result.Instances) == 0 {
+		c.proxyNegativeCache.add(proxy.IPAddresses[0], proxy.ID, servicesVersion, result)
+	}
+	return result
+}
+
+// allowsAnyProxyIP reports whether an address of the proxy is allowed by the endpoint CIDRs: the
+// proxies at rejected addresses get no instances, like their endpoints are dropped.
+func (c *Controller) allowsAnyProxyIP(proxy *model.Proxy) bool {
+	for _, ip := range proxy.IPAddresses {
+		if c.endpointCIDRs.allows(ip) {
+			return true
+		}
+	}
+	return false
+}
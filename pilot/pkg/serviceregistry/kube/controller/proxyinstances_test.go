@@ -0,0 +1,145 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/labels"
+)
+
+func TestResolveProxyServiceInstances(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: mode})
+			defer controller.Stop()
+
+			pod := generatePod("128.0.0.1", "pod1", "nsA", "", "node1", map[string]string{"app": "prod-app"}, map[string]string{})
+			addPods(t, controller, pod)
+			if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+				t.Fatalf("wait for pod err: %v", err)
+			}
+			for _, svc := range []string{"svc1", "svc2"} {
+				createService(controller, svc, "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+				if ev := fx.Wait("service"); ev == nil {
+					t.Fatalf("Timeout creating service %s", svc)
+				}
+			}
+			createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+			if ev := fx.Wait("eds"); ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+
+			expect := func(proxy *model.Proxy, path ProxyInstancesPath, degraded bool, instances int) ProxyInstancesResult {
+				t.Helper()
+				result := controller.ResolveProxyServiceInstances(proxy)
+				if result.Path != path {
+					t.Fatalf("got path %q, want %q", result.Path, path)
+				}
+				if result.Degraded() != degraded {
+					t.Fatalf("got degraded %v (%s), want %v", result.Degraded(), result.Error(), degraded)
+				}
+				if result.Instances == nil || len(result.Instances) != instances {
+					t.Fatalf("got instances %v, want %d", result.Instances, instances)
+				}
+				return result
+			}
+
+			expect(&model.Proxy{Metadata: &model.NodeMetadata{}}, ProxyInstancesNone, false, 0)
+			expect(&model.Proxy{
+				IPAddresses: []string{"128.0.0.1"},
+				Metadata:    &model.NodeMetadata{Namespace: "nsA", ClusterID: controller.clusterID},
+			}, ProxyInstancesPod, false, 2)
+
+			metadataProxy := &model.Proxy{
+				IPAddresses:     []string{"128.0.0.9"},
+				ConfigNamespace: "nsA",
+				Metadata: &model.NodeMetadata{
+					ClusterID: controller.clusterID,
+					Labels:    map[string]string{"app": "prod-app"},
+				},
+			}
+			expect(metadataProxy, ProxyInstancesMetadata, false, 2)
+
+			// A service known to the informer but not converted yet only fails its own lookup.
+			svc2 := kube.ServiceHostname("svc2", "nsA", domainSuffix)
+			controller.Lock()
+			delete(controller.servicesMap, svc2)
+			controller.Unlock()
+			result := expect(metadataProxy, ProxyInstancesMetadata, true, 1)
+			if result.Err != nil || len(result.ServiceErrors) != 1 || result.ServiceErrors[svc2] == nil {
+				t.Fatalf("got errors %v %v, want an error for %s only", result.Err, result.ServiceErrors, svc2)
+			}
+			if got := result.Instances[0].Service.Hostname; got != kube.ServiceHostname("svc1", "nsA", domainSuffix) {
+				t.Fatalf("got instance of %s, want svc1", got)
+			}
+
+			// Proxies without workload labels cannot be resolved from their metadata.
+			result = expect(&model.Proxy{
+				IPAddresses: []string{"128.0.0.9"},
+				Metadata:    &model.NodeMetadata{ClusterID: controller.clusterID},
+			}, ProxyInstancesMetadata, true, 0)
+			if result.Err == nil {
+				t.Fatal("expected the lookup to fail")
+			}
+
+			controller.ForeignServiceInstanceHandler(&model.ServiceInstance{
+				Service: &model.Service{
+					Attributes: model.ServiceAttributes{Namespace: "nsA"},
+				},
+				Endpoint: &model.IstioEndpoint{
+					Labels:       labels.Instance{"app": "prod-app"},
+					Address:      "2.2.2.2",
+					EndpointPort: 8080,
+				},
+			}, model.EventAdd)
+			if ev := fx.Wait("eds"); ev == nil {
+				t.Fatal("Timeout incremental eds")
+			}
+			result = controller.ResolveProxyServiceInstances(&model.Proxy{
+				IPAddresses: []string{"2.2.2.2"},
+				Metadata:    &model.NodeMetadata{Namespace: "nsA"},
+			})
+			if result.Path != ProxyInstancesForeign || result.Degraded() {
+				t.Fatalf("got path %q degraded %v, want an undegraded foreign lookup", result.Path, result.Degraded())
+			}
+		})
+	}
+}
+
+func TestProxyInstancesResultError(t *testing.T) {
+	result := ProxyInstancesResult{
+		Err: fmt.Errorf("lookup failed"),
+		ServiceErrors: map[host.Name]error{
+			"b.ns.svc.cluster.local": fmt.Errorf("no port"),
+			"a.ns.svc.cluster.local": fmt.Errorf("no service"),
+		},
+	}
+	want := "lookup failed; a.ns.svc.cluster.local: no service; b.ns.svc.cluster.local: no port"
+	if got := result.Error(); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if !result.Degraded() {
+		t.Fatal("expected a degraded result")
+	}
+	if (ProxyInstancesResult{}).Degraded() {
+		t.Fatal("expected an empty result not to be degraded")
+	}
+}
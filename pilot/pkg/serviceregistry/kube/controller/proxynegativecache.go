@@ -0,0 +1,115 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"istio.io/pkg/monitoring"
+)
+
+const (
+	// proxyNegativeCacheTTL is how long the lookup of a proxy without pod nor service instances
+	// is served from the negative cache.
+	proxyNegativeCacheTTL = 5 * time.Second
+	// maxProxyNegativeCacheEntries bounds the proxies kept in the negative cache.
+	maxProxyNegativeCacheEntries = 10000
+)
+
+var proxyNegativeCacheHits = monitoring.NewSum(
+	"pilot_k8s_proxy_negative_cache_hits",
+	"Lookups of the service instances of proxies served from the cache of lookups that found none.")
+
+func init() {
+	monitoring.MustRegister(proxyNegativeCacheHits)
+}
+
+// proxyNegativeCache remembers for a while the proxies whose pod is unknown and whose metadata
+// resolved to no service instance, such as stale proxies of deleted pods, so that their retries
+// do not scan the services again. Entries are keyed by the first IP of the proxy, and are only
+// served to the same proxy while the services are unchanged.
+type proxyNegativeCache struct {
+	ttl   time.Duration
+	max   int
+	clock Clock
+
+	mu      sync.Mutex
+	entries map[string]proxyNegativeEntry
+}
+
+type proxyNegativeEntry struct {
+	proxyID string
+	// servicesVersion is the version of the services the result was computed from.
+	servicesVersion uint64
+	expires         time.Time
+	result          ProxyInstancesResult
+}
+
+func newProxyNegativeCache(ttl time.Duration, max int, clock Clock) *proxyNegativeCache {
+	return &proxyNegativeCache{
+		ttl:     ttl,
+		max:     max,
+		clock:   clock,
+		entries: make(map[string]proxyNegativeEntry),
+	}
+}
+
+// get returns the cached result of the proxy, if it is still valid for the services version.
+func (n *proxyNegativeCache) get(ip, proxyID string, servicesVersion uint64) (ProxyInstancesResult, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	entry, f := n.entries[ip]
+	if !f {
+		return ProxyInstancesResult{}, false
+	}
+	if entry.proxyID != proxyID || entry.servicesVersion != servicesVersion || !n.clock.Now().Before(entry.expires) {
+		delete(n.entries, ip)
+		return ProxyInstancesResult{}, false
+	}
+	proxyNegativeCacheHits.Increment()
+	return entry.result, true
+}
+
+// add caches the result of a lookup that found no instance. When the cache is full, expired
+// entries are dropped first, and the result is not cached if none was.
+func (n *proxyNegativeCache) add(ip, proxyID string, servicesVersion uint64, result ProxyInstancesResult) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := n.clock.Now()
+	if _, f := n.entries[ip]; !f && len(n.entries) >= n.max {
+		for key, entry := range n.entries {
+			if !now.Before(entry.expires) {
+				delete(n.entries, key)
+			}
+		}
+		if len(n.entries) >= n.max {
+			return
+		}
+	}
+	n.entries[ip] = proxyNegativeEntry{
+		proxyID:         proxyID,
+		servicesVersion: servicesVersion,
+		expires:         now.Add(n.ttl),
+		result:          result,
+	}
+}
+
+// invalidate drops the entry of the IP, once a pod with that IP is known.
+func (n *proxyNegativeCache) invalidate(ip string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.entries, ip)
+}
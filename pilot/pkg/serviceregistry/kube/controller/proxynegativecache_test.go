@@ -0,0 +1,112 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestProxyNegativeCache(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	n := newProxyNegativeCache(time.Second, 2, clock)
+	result := ProxyInstancesResult{Path: ProxyInstancesMetadata, NoInstancesReason: ProxyPodNotFound}
+
+	n.add("1.1.1.1", "proxy1", 1, result)
+	if got, f := n.get("1.1.1.1", "proxy1", 1); !f || got.NoInstancesReason != ProxyPodNotFound {
+		t.Fatalf("expected the cached result, got %+v", got)
+	}
+	// Another proxy with the IP, or a change to the services, is resolved again.
+	if _, f := n.get("1.1.1.1", "proxy2", 1); f {
+		t.Fatal("expected no result for another proxy")
+	}
+	n.add("1.1.1.1", "proxy1", 1, result)
+	if _, f := n.get("1.1.1.1", "proxy1", 2); f {
+		t.Fatal("expected no result once the services changed")
+	}
+
+	n.add("1.1.1.1", "proxy1", 1, result)
+	clock.Step(time.Second)
+	if _, f := n.get("1.1.1.1", "proxy1", 1); f {
+		t.Fatal("expected the result to expire")
+	}
+
+	n.add("1.1.1.1", "proxy1", 1, result)
+	n.invalidate("1.1.1.1")
+	if _, f := n.get("1.1.1.1", "proxy1", 1); f {
+		t.Fatal("expected the result to be invalidated")
+	}
+
+	// Beyond the maximum, results are only cached once others expired.
+	n.add("1.1.1.1", "proxy1", 1, result)
+	n.add("2.2.2.2", "proxy2", 1, result)
+	n.add("3.3.3.3", "proxy3", 1, result)
+	if _, f := n.get("3.3.3.3", "proxy3", 1); f {
+		t.Fatal("expected no result beyond the maximum")
+	}
+	clock.Step(time.Second)
+	n.add("3.3.3.3", "proxy3", 1, result)
+	if _, f := n.get("3.3.3.3", "proxy3", 1); !f || len(n.entries) != 1 {
+		t.Fatalf("expected the expired results to be replaced, got %d entries", len(n.entries))
+	}
+}
+
+func TestProxyNegativeCacheLookups(t *testing.T) {
+	controller, fx := newFakeControllerWithOptions(fakeControllerOptions{})
+	defer controller.Stop()
+
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	proxy := &model.Proxy{
+		ID:              "stale.nsA",
+		ConfigNamespace: "nsA",
+		IPAddresses:     []string{"128.0.0.9"},
+		Metadata:        &model.NodeMetadata{Namespace: "nsA", ClusterID: controller.clusterID},
+	}
+
+	// Retries of a proxy that never gets a pod are served from the cache.
+	before := sumValue(t, "pilot_k8s_proxy_negative_cache_hits", nil)
+	for i := 0; i < 3; i++ {
+		if instances, _ := controller.GetProxyServiceInstances(proxy); len(instances) != 0 {
+			t.Fatalf("got instances %v, want none", instances)
+		}
+	}
+	if got := sumValue(t, "pilot_k8s_proxy_negative_cache_hits", nil); got != before+2 {
+		t.Fatalf("got %v cache hits, want %v", got, before+2)
+	}
+
+	// The entry is dropped once a pod with the IP is known, and the pod is used.
+	pod := generatePod("128.0.0.9", "pod1", "nsA", "", "", map[string]string{"app": "prod-app"}, nil)
+	addPods(t, controller, pod)
+	if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+		t.Fatal(err)
+	}
+	controller.proxyNegativeCache.mu.Lock()
+	_, cached := controller.proxyNegativeCache.entries["128.0.0.9"]
+	controller.proxyNegativeCache.mu.Unlock()
+	if cached {
+		t.Fatal("expected the entry to be invalidated by the pod")
+	}
+	if instances, _ := controller.GetProxyServiceInstances(proxy); len(instances) == 0 {
+		t.Fatal("expected the instances of svc1")
+	}
+	if got := sumValue(t, "pilot_k8s_proxy_negative_cache_hits", nil); got != before+2 {
+		t.Fatalf("got %v cache hits, want %v", got, before+2)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"istio.io/pkg/monitoring"
+)
+
+const (
+	// ProxyNoAddress is the reason for proxies without IP addresses.
+	ProxyNoAddress = "NoAddress"
+	// ProxyAddressRejected is the reason for proxies whose addresses are all outside the allowed
+	// endpoint CIDRs or in a denied one.
+	ProxyAddressRejected = "AddressRejected"
+	// ProxyForeignNotSelected is the reason for proxies of foreign instances, such as workload
+	// entries, that no service selects.
+	ProxyForeignNotSelected = "ForeignNotSelected"
+	// ProxyNetworkMismatch is the reason for proxies whose pod is on another network than the
+	// proxy, taken for a pod of another cluster with the same IP.
+	ProxyNetworkMismatch = "NetworkMismatch"
+	// ProxyNotSelected is the reason for proxies of pods no service selects, nor the Endpoints of
+	// a service without selector reference.
+	ProxyNotSelected = "NotSelected"
+	// ProxyNoServicePort is the reason for proxies of pods selected by services of which no port
+	// could be resolved, such as services not converted yet or named target ports the pod lacks.
+	ProxyNoServicePort = "NoServicePort"
+	// ProxyPodNotFound is the reason for proxies whose pod is not known yet and whose services
+	// could not be resolved from their metadata.
+	ProxyPodNotFound = "PodNotFound"
+
+	// maxRecentProxyNoInstances bounds the proxies kept in the recent list.
+	maxRecentProxyNoInstances = 100
+)
+
+var proxyNoInstances = monitoring.NewSum(
+	"pilot_k8s_proxy_no_instances",
+	"Lookups of the service instances of proxies that found none, by reason.",
+	monitoring.WithLabels(reasonTag),
+)
+
+func init() {
+	monitoring.MustRegister(proxyNoInstances)
+}
+
+// ProxyNoInstances records a lookup of the service instances of a proxy that found none.
+type ProxyNoInstances struct {
+	ProxyID string             `json:"proxyID"`
+	Cluster string             `json:"cluster"`
+	Reason  string             `json:"reason"`
+	Path    ProxyInstancesPath `json:"path"`
+	// Error is why the lookup failed, if it did.
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// recentProxyNoInstances keeps the latest lookups that found no instances, one per proxy, up to
+// a maximum, evicting the oldest.
+type recentProxyNoInstances struct {
+	max int
+
+	mu      sync.Mutex
+	records []ProxyNoInstances
+}
+
+func newRecentProxyNoInstances(max int) *recentProxyNoInstances {
+	return &recentProxyNoInstances{max: max}
+}
+
+func (r *recentProxyNoInstances) add(record ProxyNoInstances) {
+	proxyNoInstances.With(reasonTag.Value(record.Reason)).Increment()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.records {
+		if r.records[i].ProxyID == record.ProxyID {
+			r.records = append(r.records[:i], r.records[i+1:]...)
+			break
+		}
+	}
+	if len(r.records) >= r.max {
+		r.records = r.records[1:]
+	}
+	r.records = append(r.records, record)
+}
+
+// list returns the records, the most recent first.
+func (r *recentProxyNoInstances) list() []ProxyNoInstances {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]ProxyNoInstances, 0, len(r.records))
+	for i := len(r.records) - 1; i >= 0; i-- {
+		out = append(out, r.records[i])
+	}
+	return out
+}
+
+// recordProxyNoInstances counts a lookup that found no instances by reason and keeps it in the
+// recent list.
+func (c *Controller) recordProxyNoInstances(proxyID string, result ProxyInstancesResult) {
+	record := ProxyNoInstances{
+		ProxyID: proxyID,
+		Cluster: c.clusterID,
+		Reason:  result.NoInstancesReason,
+		Path:    result.Path,
+		Time:    c.clock.Now(),
+	}
+	if result.Degraded() {
+		record.Error = result.Error()
+	}
+	c.recentProxyNoInstances.add(record)
+}
+
+// ProxyNoInstances returns the latest proxies whose service instances lookup found none, the
+// most recent first.
+func (c *Controller) ProxyNoInstances() []ProxyNoInstances {
+	return c.recentProxyNoInstances.list()
+}
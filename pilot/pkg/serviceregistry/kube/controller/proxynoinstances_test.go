@@ -0,0 +1,152 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"go.opencensus.io/stats/view"
+	coreV1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/labels"
+)
+
+// sumValue returns the value of the sum with the given labels, zero if it has none.
+func sumValue(t *testing.T, name string, labels map[string]string) float64 {
+	t.Helper()
+	rows, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatalf("failed to get sum %s: %v", name, err)
+	}
+	for _, row := range rows {
+		matched := 0
+		for _, tag := range row.Tags {
+			if v, f := labels[tag.Key.Name()]; f && v == tag.Value {
+				matched++
+			}
+		}
+		if matched == len(labels) {
+			return row.Data.(*view.SumData).Value
+		}
+	}
+	return 0
+}
+
+func TestRecentProxyNoInstances(t *testing.T) {
+	r := newRecentProxyNoInstances(2)
+	for _, id := range []string{"a", "b", "a", "c"} {
+		r.add(ProxyNoInstances{ProxyID: id, Reason: ProxyNotSelected})
+	}
+	var got []string
+	for _, record := range r.list() {
+		got = append(got, record.ProxyID)
+	}
+	// A proxy is only kept once, and the oldest is evicted beyond the maximum.
+	if want := []string{"c", "a"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got proxies %v, want %v", got, want)
+	}
+}
+
+func TestProxyNoInstancesReasons(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{mode: mode})
+			defer controller.Stop()
+
+			pods := []*coreV1.Pod{
+				generatePod("128.0.0.1", "selected", "nsA", "", "", map[string]string{"app": "prod-app"}, nil),
+				generatePod("128.0.0.2", "noport", "nsA", "", "", map[string]string{"app": "noport-app"}, nil),
+				generatePod("128.0.0.3", "lonely", "nsA", "", "", map[string]string{"app": "lonely-app"}, nil),
+			}
+			for _, pod := range pods {
+				addPods(t, controller, pod)
+				if err := waitForPod(controller, pod.Status.PodIP); err != nil {
+					t.Fatal(err)
+				}
+			}
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			// The pod has no container port of the name.
+			createServiceWithTargetPorts(controller, "svc2", "nsA", nil, []coreV1.ServicePort{{
+				Name:       "tcp-port",
+				Port:       8080,
+				Protocol:   "TCP",
+				TargetPort: intstr.FromString("missing"),
+			}}, map[string]string{"app": "noport-app"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			controller.ForeignServiceInstanceHandler(&model.ServiceInstance{
+				Service: &model.Service{
+					Attributes: model.ServiceAttributes{Namespace: "nsA"},
+				},
+				Endpoint: &model.IstioEndpoint{
+					Labels:       labels.Instance{"app": "foreign-app"},
+					Address:      "2.2.2.2",
+					EndpointPort: 8080,
+				},
+			}, model.EventAdd)
+
+			proxy := func(ip string, metadata model.NodeMetadata) *model.Proxy {
+				metadata.Namespace = "nsA"
+				metadata.ClusterID = controller.clusterID
+				p := &model.Proxy{ID: "proxy-" + ip, ConfigNamespace: "nsA", Metadata: &metadata}
+				if ip != "" {
+					p.IPAddresses = []string{ip}
+				}
+				return p
+			}
+			cases := []struct {
+				proxy  *model.Proxy
+				reason string
+			}{
+				{proxy("", model.NodeMetadata{}), ProxyNoAddress},
+				{proxy("2.2.2.2", model.NodeMetadata{}), ProxyForeignNotSelected},
+				{proxy("128.0.0.1", model.NodeMetadata{Network: "nw-other"}), ProxyNetworkMismatch},
+				{proxy("128.0.0.2", model.NodeMetadata{}), ProxyNoServicePort},
+				{proxy("128.0.0.3", model.NodeMetadata{}), ProxyNotSelected},
+				{proxy("128.0.0.9", model.NodeMetadata{Labels: map[string]string{"app": "lonely-app"}}), ProxyPodNotFound},
+			}
+			for _, tc := range cases {
+				before := sumValue(t, "pilot_k8s_proxy_no_instances", map[string]string{"reason": tc.reason})
+				instances, err := controller.GetProxyServiceInstances(tc.proxy)
+				if err != nil || len(instances) != 0 {
+					t.Fatalf("%s: got instances %v (error %v), want none", tc.proxy.ID, instances, err)
+				}
+				if got := sumValue(t, "pilot_k8s_proxy_no_instances", map[string]string{"reason": tc.reason}); got != before+1 {
+					t.Fatalf("%s: got %v lookups with reason %s, want %v", tc.proxy.ID, got, tc.reason, before+1)
+				}
+				if recent := controller.ProxyNoInstances(); recent[0].ProxyID != tc.proxy.ID || recent[0].Reason != tc.reason {
+					t.Fatalf("%s: got latest record %+v, want reason %s", tc.proxy.ID, recent[0], tc.reason)
+				}
+			}
+
+			// Resolved proxies are not recorded.
+			instances, _ := controller.GetProxyServiceInstances(proxy("128.0.0.1", model.NodeMetadata{}))
+			if len(instances) == 0 {
+				t.Fatal("expected the instances of svc1")
+			}
+			if got, want := len(controller.ProxyNoInstances()), len(cases); got != want {
+				t.Fatalf("got %d records, want %d", got, want)
+			}
+		})
+	}
+}
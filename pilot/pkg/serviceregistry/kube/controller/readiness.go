@@ -0,0 +1,112 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/pkg/log"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// The handlers only wait for the informers they read, rather than for the whole controller to
+// sync: listing the nodes of a large cluster can take long, and the endpoints only need them for
+// the locality, which is filled in once they synced, see reconcileNodeLocality. The initial EDS
+// update does not wait for the nodes, see BenchmarkStartupWithSlowNodes.
+
+// servicesSynced reports whether the informers the service handler reads synced: the services,
+// and the namespaces the service filter may select them by.
+func (c *Controller) servicesSynced() bool {
+	return c.serviceInformer.HasSynced() && (c.namespaceInformer == nil || c.namespaceInformer.HasSynced())
+}
+
+// podsSynced reports whether the pods synced. The ReplicaSets naming their workload are not waited
+// for, see getWorkloadName.
+func (c *Controller) podsSynced() bool {
+	return c.pods.informer.HasSynced()
+}
+
+// endpointsSynced reports whether the informers the endpoints are built from synced: the services,
+// the pods and the source of the endpoints of the mode. The initial EDS batch waits for them, see
+// waitForInitialEndpoints.
+func (c *Controller) endpointsSynced() bool {
+	return c.servicesSynced() && c.podsSynced() && c.endpointsController().HasSynced()
+}
+
+// nodesSynced reports whether the node informers synced.
+func (c *Controller) nodesSynced() bool {
+	nodeInformer := c.nodeMetadataInformer
+	if nodeInformer == nil {
+		nodeInformer = c.nodeInformer
+	}
+	return nodeInformer.HasSynced() && c.filteredNodeInformer.HasSynced()
+}
+
+// checkSynced returns an error, for the event to be retried, until the informers read by the
+// handler of the kind synced.
+func checkSynced(kind string, synced ...func() bool) error {
+	for _, s := range synced {
+		if !s() {
+			return fmt.Errorf("waiting for the informers %s events depend on to sync", kind)
+		}
+	}
+	return nil
+}
+
+func (c *Controller) checkServicesReady() error {
+	return checkSynced("service", c.servicesSynced)
+}
+
+func (c *Controller) checkEndpointsReady() error {
+	return checkSynced("endpoints", c.servicesSynced, c.podsSynced)
+}
+
+func (c *Controller) checkNodesReady() error {
+	return checkSynced("node", c.nodesSynced)
+}
+
+// reconcileNodeLocality waits for the nodes to sync, then builds the endpoints of the services
+// built without their locality again.
+func (c *Controller) reconcileNodeLocality(stop <-chan struct{}) {
+	if !cache.WaitForCacheSync(stop, c.nodesSynced) {
+		return
+	}
+	c.queue.Push(func() error {
+		hostnames := c.localityBackfill.takeAll()
+		if len(hostnames) > 0 {
+			log.Infof("Nodes of cluster %s synced, building the endpoints of %d services again with their locality",
+				c.clusterID, len(hostnames))
+		}
+		c.backfillLocality(hostnames)
+		return nil
+	})
+}
+
+// rebuildAllEDS builds the endpoints of all services again, and pushes them.
+func (c *Controller) rebuildAllEDS() error {
+	c.RLock()
+	services := make([]*model.Service, 0, len(c.servicesMap))
+	for _, svc := range c.servicesMap {
+		services = append(services, svc)
+	}
+	c.RUnlock()
+	for _, svc := range services {
+		c.endpointsController().UpdateServiceEDS(c, svc)
+	}
+	return nil
+}
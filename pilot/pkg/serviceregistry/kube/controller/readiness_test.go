@@ -0,0 +1,158 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	metafake "k8s.io/client-go/metadata/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+)
+
+// newUnstartedController returns a controller whose informers are not running, for the tests to
+// sync them one by one.
+func newUnstartedController(t *testing.T) (*Controller, *syncQueue, *FakeXdsUpdater) {
+	t.Helper()
+	clock := NewFakeClock(time.Unix(0, 0))
+	scheme := runtime.NewScheme()
+	if err := metaV1.AddMetaToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	q := newSyncQueue(time.Second, clock)
+	fx := NewFakeXDS()
+	c := newController(fake.NewSimpleClientset(), metafake.NewSimpleMetadataClient(scheme), Options{
+		DomainSuffix: domainSuffix,
+		XDSUpdater:   fx,
+		Metrics:      &model.Environment{},
+		Clock:        clock,
+	}, q)
+	return c, q, fx
+}
+
+func TestHandlersWaitForTheirInformers(t *testing.T) {
+	c, _, _ := newUnstartedController(t)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	svc := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA"},
+		Spec: coreV1.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+			Ports:     []coreV1.ServicePort{{Name: "tcp-port", Port: 8080}},
+		},
+	}
+	ep := &coreV1.Endpoints{ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA"}}
+	node := &coreV1.Node{ObjectMeta: metaV1.ObjectMeta{Name: "node1"}}
+	endpoints := c.endpoints.(*endpointsController)
+
+	if err := c.onServiceEvent(svc, model.EventAdd); err == nil {
+		t.Fatal("expected the service event to wait for the services to sync")
+	}
+
+	// The services sync first.
+	go c.serviceInformer.Run(stop)
+	cache.WaitForCacheSync(stop, c.servicesSynced)
+	if err := c.onServiceEvent(svc, model.EventAdd); err != nil {
+		t.Fatalf("expected the service event to be handled before the pods and nodes synced, got %v", err)
+	}
+	if err := endpoints.onEvent(ep, model.EventAdd); err == nil {
+		t.Fatal("expected the endpoints event to wait for the pods to sync")
+	}
+
+	// The endpoints are handled before the nodes sync.
+	go c.pods.informer.Run(stop)
+	go c.pods.replicaSetInformer.Run(stop)
+	cache.WaitForCacheSync(stop, c.podsSynced)
+	if err := endpoints.onEvent(ep, model.EventAdd); err != nil {
+		t.Fatalf("expected the endpoints event to be handled before the nodes synced, got %v", err)
+	}
+	if err := c.onNodeEvent(node, model.EventAdd); err == nil {
+		t.Fatal("expected the node event to wait for the nodes to sync")
+	}
+
+	go c.nodeMetadataInformer.Run(stop)
+	go c.filteredNodeInformer.Run(stop)
+	cache.WaitForCacheSync(stop, c.nodesSynced)
+	if err := c.onNodeEvent(node, model.EventAdd); err != nil {
+		t.Fatalf("expected the node event to be handled once the nodes synced, got %v", err)
+	}
+}
+
+func TestEndpointsPushedBeforeNodesSync(t *testing.T) {
+	fx := NewFakeXDS()
+	controller := newControllerForbidding(t, Options{XDSUpdater: fx}, initialSyncObjects(), "nodes")
+	defer controller.Stop()
+	hostname := string(kube.ServiceHostname("svc1", "nsA", domainSuffix))
+
+	if ev := fx.Wait("eds"); ev == nil || ev.ID != hostname {
+		t.Fatalf("expected the initial update of %s, got %+v", hostname, ev)
+	}
+	// The later updates are pushed as they come, the nodes still not synced.
+	updateEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.2"}, t)
+	ev := fx.Wait("eds")
+	if ev == nil || ev.ID != hostname || ev.Batched || len(ev.Endpoints) != 1 || ev.Endpoints[0].Address != "128.0.0.2" {
+		t.Fatalf("expected a direct update of %s with 128.0.0.2, got %+v", hostname, ev)
+	}
+	if controller.nodesSynced() {
+		t.Fatal("the nodes synced despite the forbidden list")
+	}
+}
+
+// BenchmarkStartupWithSlowNodes measures the time from the start of the controller to the initial
+// EDS update, and to the sync of the controller, when the nodes cannot be listed for a while. The
+// endpoints do not wait for the nodes: the time to the initial EDS update stays the same whatever
+// the delay, while the sync follows the nodes.
+func BenchmarkStartupWithSlowNodes(b *testing.B) {
+	for _, delay := range []time.Duration{0, 2 * time.Second} {
+		b.Run(fmt.Sprintf("nodes after %v", delay), func(b *testing.B) {
+			var toEDS, toSynced time.Duration
+			for i := 0; i < b.N; i++ {
+				fx := NewFakeXDS()
+				start := time.Now()
+				slowNodes := func(resource string) k8stesting.ReactionFunc {
+					return func(k8stesting.Action) (bool, runtime.Object, error) {
+						if time.Since(start) < delay {
+							return true, nil, apierrors.NewServiceUnavailable(fmt.Sprintf("%s not listed yet", resource))
+						}
+						return false, nil, nil
+					}
+				}
+				controller := newControllerWithListReactor(b, Options{XDSUpdater: fx}, initialSyncObjects(), slowNodes, "nodes")
+				if ev := fx.Wait("eds"); ev == nil {
+					b.Fatal("timed out waiting for the initial EDS update")
+				}
+				toEDS += time.Since(start)
+				if !cache.WaitForCacheSync(controller.stop, controller.HasSynced) {
+					b.Fatal("the controller did not sync")
+				}
+				toSynced += time.Since(start)
+				controller.Stop()
+			}
+			b.ReportMetric(float64(toEDS.Milliseconds())/float64(b.N), "ms-to-eds/op")
+			b.ReportMetric(float64(toSynced.Milliseconds())/float64(b.N), "ms-to-synced/op")
+		})
+	}
+}
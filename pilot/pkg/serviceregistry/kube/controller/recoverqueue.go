@@ -0,0 +1,110 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pkg/queue"
+)
+
+// maxTaskPanics is the number of panics after which a task is dropped. Unlike a failure, a panic
+// is a bug that retrying rarely fixes, and a task retried forever would keep logging its stack.
+const maxTaskPanics = 5
+
+var (
+	queueTaskPanics = monitoring.NewSum(
+		"pilot_k8s_queue_task_panics",
+		"Panics recovered in the tasks of the controller queue, which are retried like failed tasks.")
+
+	queueTaskDrops = monitoring.NewSum(
+		"pilot_k8s_queue_task_drops",
+		"Tasks of the controller queue dropped after panicking too many times.")
+)
+
+func init() {
+	monitoring.MustRegister(queueTaskPanics, queueTaskDrops)
+}
+
+// recoveringQueue recovers the panics of the tasks pushed to the queue. A panic would otherwise
+// stop the goroutine running the queue, and with it the service discovery of the whole cluster.
+// The panic is turned into an error, so that the task is retried like any failed task, until it
+// has panicked maxTaskPanics times and is dropped.
+type recoveringQueue struct {
+	queue.Instance
+}
+
+// recoveringNamespacedQueue is a recoveringQueue of a namespacedQueue.
+type recoveringNamespacedQueue struct {
+	recoveringQueue
+	namespaced namespacedQueue
+}
+
+var (
+	_ eventObserver   = recoveringQueue{}
+	_ namespacedQueue = recoveringNamespacedQueue{}
+)
+
+func newRecoveringQueue(q queue.Instance) queue.Instance {
+	if nq, ok := q.(namespacedQueue); ok {
+		return recoveringNamespacedQueue{recoveringQueue: recoveringQueue{q}, namespaced: nq}
+	}
+	return recoveringQueue{q}
+}
+
+func (q recoveringQueue) Push(task queue.Task) {
+	q.Instance.Push(recoverTask(task))
+}
+
+// eventDelivered forwards the delivered events to the queue, if it observes them.
+func (q recoveringQueue) eventDelivered() {
+	if observer, ok := q.Instance.(eventObserver); ok {
+		observer.eventDelivered()
+	}
+}
+
+func (q recoveringNamespacedQueue) PushNamespaced(namespace string, task queue.Task) {
+	q.namespaced.PushNamespaced(namespace, recoverTask(task))
+}
+
+func (q recoveringNamespacedQueue) PushBarrier(task queue.Task) {
+	q.namespaced.PushBarrier(recoverTask(task))
+}
+
+func recoverTask(task queue.Task) queue.Task {
+	panics := 0
+	return func() (err error) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			log.Errorf("Controller queue task panicked: %v\n%s", r, debug.Stack())
+			queueTaskPanics.Increment()
+			if panics++; panics >= maxTaskPanics {
+				log.Errorf("Dropping controller queue task after %d panics", panics)
+				queueTaskDrops.Increment()
+				err = nil
+				return
+			}
+			err = fmt.Errorf("task panicked: %v", r)
+		}()
+		return task()
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+)
+
+func TestRecoveringQueueTaskPanic(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	sq := newSyncQueue(time.Second, clock)
+	q := newRecoveringQueue(sq)
+
+	panics := sumValue(t, "pilot_k8s_queue_task_panics", nil)
+	attempts, ran := 0, false
+	q.Push(func() error {
+		attempts++
+		if attempts == 1 {
+			panic("task bug")
+		}
+		return nil
+	})
+	q.Push(func() error {
+		ran = true
+		return nil
+	})
+
+	sq.flush()
+	if !ran {
+		t.Fatal("expected the task after the panicking one to run")
+	}
+	if v := sumValue(t, "pilot_k8s_queue_task_panics", nil); v != panics+1 {
+		t.Fatalf("got %v panics, want %v", v, panics+1)
+	}
+	// The panicking task is retried like a failed one.
+	clock.Step(time.Second)
+	sq.flush()
+	if attempts != 2 {
+		t.Fatalf("got %d attempts, want 2", attempts)
+	}
+}
+
+func TestRecoveringQueueDropsPanickingTask(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	sq := newSyncQueue(time.Second, clock)
+	q := newRecoveringQueue(sq)
+
+	drops := sumValue(t, "pilot_k8s_queue_task_drops", nil)
+	attempts := 0
+	q.Push(func() error {
+		attempts++
+		panic("task bug")
+	})
+	for i := 0; i < 2*maxTaskPanics; i++ {
+		sq.flush()
+		clock.Step(time.Second)
+	}
+	if attempts != maxTaskPanics {
+		t.Fatalf("got %d attempts, want %d", attempts, maxTaskPanics)
+	}
+	if v := sumValue(t, "pilot_k8s_queue_task_drops", nil); v != drops+1 {
+		t.Fatalf("got %v dropped tasks, want %v", v, drops+1)
+	}
+}
+
+func TestPanickingEndpointsHandler(t *testing.T) {
+	controller, fx := newFakeHarness(t, Options{})
+	defer controller.Stop()
+
+	// Instance handlers are called by the Endpoints handler.
+	_ = controller.AppendInstanceHandler(func(*model.ServiceInstance, model.Event) {
+		panic("instance handler bug")
+	})
+	panics := sumValue(t, "pilot_k8s_reg_handler_panics", map[string]string{"type": "Endpoints"})
+
+	addPodsSync(t, controller, generatePod("128.0.0.1", "pod1", "nsA", "", "", map[string]string{"app": "prod-app"}, nil))
+	do(t, controller, func() {
+		createService(controller.Controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+	})
+	do(t, controller, func() {
+		createEndpoints(controller.Controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+	})
+	if v := sumValue(t, "pilot_k8s_reg_handler_panics", map[string]string{"type": "Endpoints"}); v != panics+1 {
+		t.Fatalf("got %v Endpoints handler panics, want %v", v, panics+1)
+	}
+
+	// The Service events that follow are still handled.
+	fx.Clear()
+	do(t, controller, func() {
+		createService(controller.Controller, "svc2", "nsA", nil, []int32{8080}, nil, t)
+	})
+	hostname := kube.ServiceHostname("svc2", "nsA", domainSuffix)
+	if ev := fx.Wait("service"); ev == nil || ev.ID != string(hostname) {
+		t.Fatalf("expected the update of svc2, got %v", ev)
+	}
+	if svc, _ := controller.GetService(hostname); svc == nil {
+		t.Fatalf("expected svc2 to be registered")
+	}
+}
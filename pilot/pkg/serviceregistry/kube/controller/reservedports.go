@@ -0,0 +1,85 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	v1 "k8s.io/api/core/v1"
+
+	"istio.io/api/annotation"
+	"istio.io/pkg/monitoring"
+)
+
+// ReservedProxyPort is the reason for the ports of endpoints that collide with a port the sidecar
+// of their pod listens on, such as its Prometheus port. The application cannot get the traffic of
+// the port: scrapes and requests reach the proxy instead.
+const ReservedProxyPort = "ReservedProxyPort"
+
+// DefaultReservedProxyPorts are the ports the sidecar listens on: the outbound and inbound capture
+// ports, the merged Prometheus port of the agent, the health check port and the Envoy Prometheus
+// port.
+var DefaultReservedProxyPorts = []int32{15001, 15006, 15020, 15021, 15090}
+
+var reservedProxyPortEndpoints = monitoring.NewSum(
+	"pilot_k8s_reserved_proxy_port_endpoints",
+	"Ports of the endpoints of services colliding with a port reserved by the sidecar of their pods.",
+)
+
+func init() {
+	monitoring.MustRegister(reservedProxyPortEndpoints)
+}
+
+// newReservedProxyPorts returns the set of the reserved ports, DefaultReservedProxyPorts when nil.
+func newReservedProxyPorts(ports []int32) map[int32]struct{} {
+	if ports == nil {
+		ports = DefaultReservedProxyPorts
+	}
+	out := make(map[int32]struct{}, len(ports))
+	for _, port := range ports {
+		out[port] = struct{}{}
+	}
+	return out
+}
+
+// hasSidecar reports whether the pod runs an injected sidecar. Gateways run the proxy as their
+// workload, their ports, such as the health check port, are meant to reach it.
+func hasSidecar(pod *v1.Pod) bool {
+	if pod == nil {
+		return false
+	}
+	_, f := pod.Annotations[annotation.SidecarStatus.Name]
+	return f
+}
+
+// acceptReserved reports whether endpoints are built for the port of the pod, a port of the service.
+// Ports colliding with a port reserved by the sidecar of the pod are recorded once, and left out
+// with Options.ExcludeReservedProxyPorts.
+func (pc *endpointPortChecker) acceptReserved(pod *v1.Pod, name string, port int32) bool {
+	if _, f := pc.reserved[port]; !f || !hasSidecar(pod) {
+		return true
+	}
+	for _, diag := range pc.diags {
+		if diag.Reason == ReservedProxyPort && diag.PortName == name {
+			return !pc.excludeReserved
+		}
+	}
+	pc.diags = append(pc.diags, EndpointPortDiagnostic{
+		Hostname: pc.svc.Hostname,
+		Source:   pc.source,
+		Reason:   ReservedProxyPort,
+		PortName: name,
+		Port:     port,
+	})
+	return !pc.excludeReserved
+}
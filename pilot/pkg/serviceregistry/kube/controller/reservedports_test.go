@@ -0,0 +1,120 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	"istio.io/api/annotation"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+)
+
+func TestReservedProxyPorts(t *testing.T) {
+	hostname := kube.ServiceHostname("svc1", "nsA", domainSuffix)
+	sidecar := map[string]string{annotation.SidecarStatus.Name: "{}"}
+	cases := []struct {
+		name        string
+		options     Options
+		annotations map[string]string
+		want        []string
+		reported    bool
+	}{
+		{"reported", Options{}, sidecar, []string{"http", "http-metrics"}, true},
+		{"excluded", Options{ExcludeReservedProxyPorts: true}, sidecar, []string{"http"}, true},
+		{"gateway", Options{ExcludeReservedProxyPorts: true}, nil, []string{"http", "http-metrics"}, false},
+		{"disabled", Options{ReservedProxyPorts: []int32{}, ExcludeReservedProxyPorts: true}, sidecar,
+			[]string{"http", "http-metrics"}, false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			controller, fx := newFakeHarness(t, tt.options)
+			defer controller.Stop()
+
+			selector := map[string]string{"app": "a"}
+			addPodsSync(t, controller, generatePod("128.0.0.1", "pod1", "nsA", "", "", selector, tt.annotations))
+			do(t, controller, func() {
+				svc := &coreV1.Service{
+					ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA"},
+					Spec: coreV1.ServiceSpec{
+						ClusterIP: "10.0.0.1",
+						Selector:  selector,
+						Ports: []coreV1.ServicePort{
+							{Name: "http", Port: 80, TargetPort: intstr.FromInt(8080)},
+							{Name: "http-metrics", Port: 9090, TargetPort: intstr.FromInt(15090)},
+						},
+					},
+				}
+				if _, err := controller.Client.CoreV1().Services("nsA").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			})
+			reported := sumValue(t, "pilot_k8s_reserved_proxy_port_endpoints", nil)
+			do(t, controller, func() {
+				ep := &coreV1.Endpoints{
+					ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA"},
+					Subsets: []coreV1.EndpointSubset{{
+						Addresses: []coreV1.EndpointAddress{{IP: "128.0.0.1"}},
+						Ports: []coreV1.EndpointPort{
+							{Name: "http", Port: 8080},
+							{Name: "http-metrics", Port: 15090},
+						},
+					}},
+				}
+				if _, err := controller.Client.CoreV1().Endpoints("nsA").Create(context.TODO(), ep, metaV1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			})
+			waitForEndpointPorts(t, fx, string(hostname), tt.want...)
+
+			var want []EndpointPortDiagnostic
+			if tt.reported {
+				want = []EndpointPortDiagnostic{{
+					Hostname: hostname,
+					Source:   "svc1",
+					Reason:   ReservedProxyPort,
+					PortName: "http-metrics",
+					Port:     15090,
+				}}
+			}
+			if got := controller.EndpointPortDiagnostics(); len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+				t.Fatalf("got diagnostics %+v, want %+v", got, want)
+			}
+			wantReported := 0.0
+			if tt.reported {
+				wantReported = 1
+			}
+			if got := sumValue(t, "pilot_k8s_reserved_proxy_port_endpoints", nil) - reported; got != wantReported {
+				t.Fatalf("got %v reported ports, want %v", got, wantReported)
+			}
+
+			// Building the endpoints again reports the port once.
+			svc, _ := controller.GetService(hostname)
+			if svc == nil {
+				t.Fatal("expected the service")
+			}
+			controller.endpoints.UpdateServiceEDS(controller.Controller, svc)
+			if got := sumValue(t, "pilot_k8s_reserved_proxy_port_endpoints", nil) - reported; got != wantReported {
+				t.Fatalf("got %v reported ports after a rebuild, want %v", got, wantReported)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+var serviceResolutionChanges = monitoring.NewSum(
+	"pilot_k8s_service_resolution_changes",
+	"Services switching between headless and ClusterIP resolution.")
+
+func init() {
+	monitoring.MustRegister(serviceResolutionChanges)
+}
+
+// onResolutionChange handles a service switching between headless and ClusterIP resolution,
+// once the new service is in servicesMap. The pending EDS update of the service was built for
+// the previous resolution, so it is dropped and the endpoints are rebuilt and pushed right
+// away, before the full push rebuilding the clusters and listeners of the service.
+func (c *Controller) onResolutionChange(prev, svc *model.Service, updateEDS bool) {
+	log.Infof("Service %s in namespace %s changed resolution from %v to %v",
+		svc.Attributes.Name, svc.Attributes.Namespace, prev.Resolution, svc.Resolution)
+	serviceResolutionChanges.Increment()
+	if updateEDS {
+		c.edsDebouncer.reset(string(svc.Hostname))
+		c.endpointsController().UpdateServiceEDS(c, svc)
+	}
+	c.xdsUpdater.ConfigUpdate(&model.PushRequest{
+		Full: true,
+		ConfigsUpdated: map[model.ConfigKey]struct{}{{
+			Kind:      model.ServiceEntryKind,
+			Name:      string(svc.Hostname),
+			Namespace: svc.Attributes.Namespace,
+		}: {}},
+		Reason: []model.TriggerReason{model.ServiceUpdate},
+	})
+}
@@ -0,0 +1,117 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+)
+
+// pendingEvents returns the events sent to the XDS updater and not read yet, in order.
+func pendingEvents(fx *FakeXdsUpdater) []XdsEvent {
+	var events []XdsEvent
+	for {
+		select {
+		case ev := <-fx.Events:
+			events = append(events, ev)
+		default:
+			return events
+		}
+	}
+}
+
+func TestServiceResolutionTransition(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeHarness(t, Options{EndpointMode: mode, EDSUpdateMinInterval: time.Second})
+			defer controller.Stop()
+
+			addPodsSync(t, controller,
+				generatePod("128.0.0.1", "pod1", "nsA", "", "", map[string]string{"app": "prod-app"}, nil),
+				generatePod("128.0.0.2", "pod2", "nsA", "", "", map[string]string{"app": "prod-app"}, nil))
+			do(t, controller, func() {
+				createService(controller.Controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+			})
+			do(t, controller, func() {
+				createEndpoints(controller.Controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+			})
+			if ev := fx.Wait("eds"); ev == nil || len(ev.Endpoints) != 1 {
+				t.Fatalf("expected the first update to be pushed right away, got %v", ev)
+			}
+			// This update is held back by the debouncer.
+			fx.Clear()
+			do(t, controller, func() {
+				updateEndpoints(controller.Controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1", "128.0.0.2"}, t)
+			})
+
+			hostname := kube.ServiceHostname("svc1", "nsA", domainSuffix)
+			key := model.ConfigKey{Kind: model.ServiceEntryKind, Name: string(hostname), Namespace: "nsA"}
+			setClusterIP := func(clusterIP string, want model.Resolution) {
+				t.Helper()
+				do(t, controller, func() {
+					svc, err := controller.Client.CoreV1().Services("nsA").Get(context.TODO(), "svc1", metaV1.GetOptions{})
+					if err != nil {
+						t.Fatal(err)
+					}
+					svc.Spec.ClusterIP = clusterIP
+					if _, err := controller.Client.CoreV1().Services("nsA").Update(context.TODO(), svc, metaV1.UpdateOptions{}); err != nil {
+						t.Fatal(err)
+					}
+				})
+				if svc, _ := controller.GetService(hostname); svc == nil || svc.Resolution != want {
+					t.Fatalf("got service %v, want resolution %v", svc, want)
+				}
+
+				// The endpoints are pushed right away, ahead of the push of the new clusters and listeners.
+				var eds, full int
+				for i, ev := range pendingEvents(fx) {
+					switch ev.Type {
+					case "eds":
+						if len(ev.Endpoints) != 2 {
+							t.Fatalf("got %d endpoints, want 2", len(ev.Endpoints))
+						}
+						eds = i + 1
+					case "xds":
+						if _, f := ev.ConfigsUpdated[key]; f && len(ev.ConfigsUpdated) == 1 {
+							full = i + 1
+						}
+					}
+				}
+				if eds == 0 || full == 0 || eds > full {
+					t.Fatalf("expected the endpoints to be pushed before the scoped full push, got eds at %d and push at %d", eds, full)
+				}
+
+				// The update built for the previous resolution was dropped.
+				controller.Step(time.Second)
+				for _, ev := range pendingEvents(fx) {
+					if ev.Type == "eds" {
+						t.Fatalf("unexpected stale EDS update %v", ev)
+					}
+				}
+			}
+
+			setClusterIP(coreV1.ClusterIPNone, model.Passthrough)
+			setClusterIP("10.0.0.1", model.ClientSideLB)
+		})
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"time"
+
+	"istio.io/pkg/log"
+)
+
+// DefaultResyncJitter is the jitter of the resync periods when Options.ResyncJitter is 0.
+const DefaultResyncJitter = 0.1
+
+// The resource types whose informers resync, keys of Options.ResyncPeriods.
+const (
+	resyncServices    = "services"
+	resyncEndpoints   = "endpoints"
+	resyncPods        = "pods"
+	resyncReplicaSets = "replicasets"
+	resyncNodes       = "nodes"
+	resyncNamespaces  = "namespaces"
+)
+
+// resyncResources are the resource types in the order of their slots.
+var resyncResources = []string{resyncServices, resyncEndpoints, resyncPods, resyncReplicaSets, resyncNodes, resyncNamespaces}
+
+// newResyncPeriods returns the resync period of each resource type. The informers start their
+// resync timers when they start, all at once, so the types are given distinct periods rather than
+// phase offsets: the range of ±jitter around the period is split in one slot per type, and each
+// period is drawn from the middle half of its slot, so that two types are always at least
+// jitter/len(resyncResources) of the period apart and their resyncs drift apart at each period.
+// A negative jitter disables it, a 0 jitter is DefaultResyncJitter.
+func newResyncPeriods(period time.Duration, jitter float64, random func() float64) map[string]time.Duration {
+	switch {
+	case jitter == 0:
+		jitter = DefaultResyncJitter
+	case jitter >= 1:
+		log.Warnf("Resync jitter %v would make resync periods non-positive, defaulting to %v", jitter, DefaultResyncJitter)
+		jitter = DefaultResyncJitter
+	}
+	periods := make(map[string]time.Duration, len(resyncResources))
+	for i, resource := range resyncResources {
+		if period <= 0 || jitter < 0 {
+			periods[resource] = period
+			continue
+		}
+		slot := 2 * jitter / float64(len(resyncResources))
+		factor := 1 - jitter + slot*(float64(i)+0.25+random()/2)
+		periods[resource] = time.Duration(float64(period) * factor)
+	}
+	return periods
+}
+
+// informerResyncPeriod returns the resync period of the informers of the resource type.
+func (c *Controller) informerResyncPeriod(resource string) time.Duration {
+	if period, f := c.resyncPeriods[resource]; f {
+		return period
+	}
+	return c.options.ResyncPeriod
+}
@@ -0,0 +1,153 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	metafake "k8s.io/client-go/metadata/fake"
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestNewResyncPeriods(t *testing.T) {
+	period := 30 * time.Second
+	for _, random := range []float64{0, 0.5, 0.999} {
+		periods := newResyncPeriods(period, 0, func() float64 { return random })
+		sorted := make([]time.Duration, 0, len(resyncResources))
+		for _, resource := range resyncResources {
+			p := periods[resource]
+			if p < period*9/10 || p > period*11/10 {
+				t.Fatalf("%s resync period %s out of the default jitter of %s", resource, p, period)
+			}
+			sorted = append(sorted, p)
+		}
+		// The slots follow the order of the resources.
+		if !sort.SliceIsSorted(sorted, func(i, j int) bool { return sorted[i] < sorted[j] }) {
+			t.Fatalf("expected the periods in the order of their slots, got %v", sorted)
+		}
+		minGap := time.Duration(float64(period) * DefaultResyncJitter / float64(len(resyncResources)))
+		for i := 1; i < len(sorted); i++ {
+			if gap := sorted[i] - sorted[i-1]; gap < minGap {
+				t.Fatalf("periods %s and %s are %s apart, want at least %s", sorted[i-1], sorted[i], gap, minGap)
+			}
+		}
+	}
+
+	for name, periods := range map[string]map[string]time.Duration{
+		"disabled":  newResyncPeriods(period, -1, func() float64 { return 0.5 }),
+		"no resync": newResyncPeriods(0, 0.1, func() float64 { return 0.5 }),
+	} {
+		for _, resource := range resyncResources {
+			want := period
+			if name == "no resync" {
+				want = 0
+			}
+			if periods[resource] != want {
+				t.Fatalf("%s: got %s resync period %s, want %s", name, resource, periods[resource], want)
+			}
+		}
+	}
+	if p := newResyncPeriods(period, 1, func() float64 { return 0 })[resyncServices]; p <= 0 {
+		t.Fatalf("expected an invalid jitter to be defaulted, got %s", p)
+	}
+}
+
+func TestInformerResyncsSpread(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := metaV1.AddMetaToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	client := fake.NewSimpleClientset(
+		&coreV1.Service{ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA"}},
+		generatePod("128.0.0.1", "pod1", "nsA", "", "node1", nil, nil),
+		generateNode("node1", nil))
+	// The informers resync at most once a second.
+	c := newController(client, metafake.NewSimpleMetadataClient(scheme), Options{
+		DomainSuffix: domainSuffix,
+		XDSUpdater:   NewFakeXDS(),
+		Metrics:      &model.Environment{},
+		ResyncPeriod: 2 * time.Second,
+		ResyncJitter: 0.4,
+	}, newSyncQueue(time.Second, NewFakeClock(time.Unix(0, 0))))
+
+	informers := map[string]cache.SharedIndexInformer{
+		resyncServices: c.serviceInformer,
+		resyncPods:     c.pods.informer,
+		resyncNodes:    c.filteredNodeInformer,
+	}
+	var mu sync.Mutex
+	resyncs := make(map[string]time.Time)
+	done := make(chan struct{})
+	for resource, informer := range informers {
+		resource := resource
+		// Nothing is written, every update is a resync.
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(_, _ interface{}) {
+				mu.Lock()
+				defer mu.Unlock()
+				if _, f := resyncs[resource]; f {
+					return
+				}
+				resyncs[resource] = time.Now()
+				if len(resyncs) == len(informers) {
+					close(done)
+				}
+			},
+		})
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	for _, informer := range informers {
+		go informer.Run(stop)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for the resyncs, got %v", resyncs)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	options := c.Options()
+	resources := []string{resyncServices, resyncPods, resyncNodes}
+	for i, a := range resources {
+		for _, b := range resources[i+1:] {
+			gap := resyncs[a].Sub(resyncs[b])
+			if gap < 0 {
+				gap = -gap
+			}
+			if gap < 50*time.Millisecond {
+				t.Fatalf("%s and %s resynced %s apart, with periods %s and %s", a, b, gap,
+					options.ResyncPeriods[a], options.ResyncPeriods[b])
+			}
+			if (resyncs[a].Before(resyncs[b])) != (options.ResyncPeriods[a] < options.ResyncPeriods[b]) {
+				t.Fatalf("expected %s and %s to resync in the order of their periods %s and %s", a, b,
+					options.ResyncPeriods[a], options.ResyncPeriods[b])
+			}
+		}
+	}
+	if len(options.ResyncPeriods) != len(resyncResources) {
+		t.Fatalf("expected the periods of all resources in the options, got %v", options.ResyncPeriods)
+	}
+}
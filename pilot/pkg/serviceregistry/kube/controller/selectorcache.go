@@ -0,0 +1,89 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	klabels "k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+// cachedSelector is the selector compiled from a version of a service.
+type cachedSelector struct {
+	resourceVersion string
+	// service is the converted service the selector was compiled with.
+	service  *model.Service
+	selector klabels.Selector
+}
+
+// selectorCache keeps the compiled label selectors of the services, so that matching pods and
+// foreign instances against all the services of a namespace does not compile them every time.
+// Only the services accepted by the registry are cached, when they are handled, so that skipped
+// and rejected services leave no entry behind. Entries are checked against the version of the
+// service they are looked up with, so a stale entry is never used.
+type selectorCache struct {
+	mu        sync.RWMutex
+	selectors map[types.NamespacedName]cachedSelector
+}
+
+func newSelectorCache() *selectorCache {
+	return &selectorCache{selectors: make(map[types.NamespacedName]cachedSelector)}
+}
+
+// forService returns the compiled selector of the service, compiling it without caching it when
+// the service was not handled at this version. Services with a nil selector must be skipped by
+// the caller, as they match nothing.
+func (s *selectorCache) forService(svc *v1.Service) klabels.Selector {
+	s.mu.RLock()
+	cached, f := s.selectors[types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}]
+	s.mu.RUnlock()
+	if f && cached.resourceVersion == svc.ResourceVersion {
+		return cached.selector
+	}
+	return klabels.Set(svc.Spec.Selector).AsSelectorPreValidated()
+}
+
+// forConvertedService returns the compiled label selector of a converted service.
+func (s *selectorCache) forConvertedService(svc *model.Service) klabels.Selector {
+	key := types.NamespacedName{Namespace: svc.Attributes.Namespace, Name: svc.Attributes.Name}
+	s.mu.RLock()
+	cached, f := s.selectors[key]
+	s.mu.RUnlock()
+	if f && cached.service == svc {
+		return cached.selector
+	}
+	// The service is not the one last handled, do not replace the entry of the latter.
+	return klabels.Set(svc.Attributes.LabelSelectors).AsSelectorPreValidated()
+}
+
+// update compiles the selector of a service being handled, along with its conversion.
+func (s *selectorCache) update(svc *v1.Service, converted *model.Service) {
+	key := types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name}
+	selector := klabels.Set(svc.Spec.Selector).AsSelectorPreValidated()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.selectors[key] = cachedSelector{resourceVersion: svc.ResourceVersion, service: converted, selector: selector}
+}
+
+// delete drops the selector of a deleted service.
+func (s *selectorCache) delete(svc *v1.Service) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.selectors, types.NamespacedName{Namespace: svc.Namespace, Name: svc.Name})
+}
@@ -0,0 +1,201 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	klabels "k8s.io/apimachinery/pkg/labels"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+func TestSelectorCacheInvalidation(t *testing.T) {
+	controller, fx := newFakeControllerWithOptions(fakeControllerOptions{})
+	defer controller.Stop()
+
+	podServices := func(labels map[string]string) []string {
+		t.Helper()
+		services, err := controller.getPodServices(&coreV1.Pod{
+			ObjectMeta: metaV1.ObjectMeta{Namespace: "nsA", Labels: labels},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, svc := range services {
+			names = append(names, svc.Name)
+		}
+		return names
+	}
+	convertedMatches := func(labels map[string]string) bool {
+		t.Helper()
+		svc, err := controller.GetService(kube.ServiceHostname("svc1", "nsA", domainSuffix))
+		if err != nil || svc == nil {
+			t.Fatalf("service not found: %v", err)
+		}
+		return controller.selectors.forConvertedService(svc).Matches(klabels.Set(labels))
+	}
+
+	createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	if got := podServices(map[string]string{"app": "a"}); len(got) != 1 {
+		t.Fatalf("expected the pod to be selected, got %v", got)
+	}
+	if !convertedMatches(map[string]string{"app": "a"}) {
+		t.Fatal("expected the converted service to select app=a")
+	}
+
+	svc, err := controller.client.CoreV1().Services("nsA").Get(context.TODO(), "svc1", metaV1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc.Spec.Selector = map[string]string{"app": "b"}
+	if _, err := controller.client.CoreV1().Services("nsA").Update(context.TODO(), svc, metaV1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout updating service")
+	}
+	if got := podServices(map[string]string{"app": "a"}); len(got) != 0 {
+		t.Fatalf("expected the old selector to be dropped, got %v", got)
+	}
+	if got := podServices(map[string]string{"app": "b"}); len(got) != 1 {
+		t.Fatalf("expected the pod to be selected by the new selector, got %v", got)
+	}
+	if convertedMatches(map[string]string{"app": "a"}) || !convertedMatches(map[string]string{"app": "b"}) {
+		t.Fatal("expected the converted service to select app=b only")
+	}
+
+	if err := controller.client.CoreV1().Services("nsA").Delete(context.TODO(), "svc1", metaV1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout deleting service")
+	}
+	controller.selectors.mu.RLock()
+	cached := len(controller.selectors.selectors)
+	controller.selectors.mu.RUnlock()
+	if cached != 0 {
+		t.Fatalf("expected the selector of the deleted service to be dropped, %d left", cached)
+	}
+}
+
+func TestSelectorCacheFilteredService(t *testing.T) {
+	controller, _ := newFakeControllerWithOptions(fakeControllerOptions{
+		serviceFilter: func(svc *coreV1.Service) bool { return svc.Namespace == "nsB" },
+	})
+	defer controller.Stop()
+	hostname := kube.ServiceHostname("svc1", "nsB", domainSuffix)
+	cached := func() int {
+		controller.selectors.mu.RLock()
+		defer controller.selectors.mu.RUnlock()
+		return len(controller.selectors.selectors)
+	}
+
+	createService(controller, "svc1", "nsB", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+	retry.UntilSuccessOrFail(t, func() error {
+		if !controller.isSkippedService(hostname) {
+			return fmt.Errorf("svc1 not skipped yet")
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+
+	// The pods are still matched against the filtered service, without caching its selector.
+	services, err := controller.getPodServices(&coreV1.Pod{
+		ObjectMeta: metaV1.ObjectMeta{Namespace: "nsB", Labels: map[string]string{"app": "a"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 {
+		t.Fatalf("expected the pod to be selected, got %v", services)
+	}
+	if n := cached(); n != 0 {
+		t.Fatalf("expected no selector cached for the filtered service, got %d", n)
+	}
+
+	if err := controller.client.CoreV1().Services("nsB").Delete(context.TODO(), "svc1", metaV1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		if controller.isSkippedService(hostname) {
+			return fmt.Errorf("svc1 delete not handled yet")
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+	if n := cached(); n != 0 {
+		t.Fatalf("expected no selector cached after the filtered service was deleted, got %d", n)
+	}
+}
+
+func BenchmarkGetPodServices(b *testing.B) {
+	controller, _ := newFakeControllerWithOptions(fakeControllerOptions{})
+	defer controller.Stop()
+
+	for i := 0; i < 2000; i++ {
+		svc := &coreV1.Service{
+			ObjectMeta: metaV1.ObjectMeta{
+				Name:            fmt.Sprintf("svc%d", i),
+				Namespace:       "nsA",
+				ResourceVersion: "1",
+			},
+			Spec: coreV1.ServiceSpec{
+				Selector: map[string]string{"app": fmt.Sprintf("app%d", i), "version": "v1"},
+			},
+		}
+		if err := controller.serviceInformer.GetIndexer().Add(svc); err != nil {
+			b.Fatal(err)
+		}
+		// Cached as if the service had been handled.
+		controller.selectors.update(svc, nil)
+	}
+	pod := &coreV1.Pod{
+		ObjectMeta: metaV1.ObjectMeta{Namespace: "nsA", Labels: map[string]string{"app": "app42", "version": "v1"}},
+	}
+
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if services, _ := controller.getPodServices(pod); len(services) != 1 {
+				b.Fatalf("expected one service, got %d", len(services))
+			}
+		}
+	})
+	// uncached compiles the selectors on every call, as getPodServices did before the cache.
+	b.Run("uncached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			services, _ := controller.serviceLister.Services(pod.Namespace).List(klabels.Everything())
+			matched := 0
+			for _, svc := range services {
+				if klabels.Set(svc.Spec.Selector).AsSelectorPreValidated().Matches(klabels.Set(pod.Labels)) {
+					matched++
+				}
+			}
+			if matched != 1 {
+				b.Fatalf("expected one service, got %d", matched)
+			}
+		}
+	})
+}
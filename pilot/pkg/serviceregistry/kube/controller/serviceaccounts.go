@@ -0,0 +1,120 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sort"
+	"sync"
+
+	"istio.io/pkg/log"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/util/sets"
+	"istio.io/istio/pkg/config/host"
+)
+
+// serviceAccounts maintains the distinct service accounts of the endpoints of each service, by
+// service port name, as collected when its endpoints are built. The endpoints of a service are
+// rebuilt whenever its pods change, such as during the rollout of a new service account, so the
+// accounts never have to be collected from the instances of the service.
+type serviceAccounts struct {
+	mu        sync.RWMutex
+	byService map[host.Name]map[string]sets.Set
+}
+
+func newServiceAccounts() *serviceAccounts {
+	return &serviceAccounts{byService: make(map[host.Name]map[string]sets.Set)}
+}
+
+// record sets the accounts of the service from its endpoints, and reports whether they changed.
+func (s *serviceAccounts) record(hostname host.Name, endpoints []*model.IstioEndpoint) bool {
+	byPort := make(map[string]sets.Set)
+	for _, ep := range endpoints {
+		if ep.ServiceAccount == "" {
+			continue
+		}
+		accounts, f := byPort[ep.ServicePortName]
+		if !f {
+			accounts = sets.NewSet()
+			byPort[ep.ServicePortName] = accounts
+		}
+		accounts.Insert(ep.ServiceAccount)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.byService[hostname]
+	if len(byPort) == 0 {
+		delete(s.byService, hostname)
+	} else {
+		s.byService[hostname] = byPort
+	}
+	if len(prev) != len(byPort) {
+		return true
+	}
+	for port, accounts := range byPort {
+		if !accounts.Equals(prev[port]) {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the accounts of the endpoints of the ports of the service, along with the accounts
+// of the service itself.
+func (s *serviceAccounts) get(svc *model.Service, ports []int) []string {
+	out := sets.NewSet(svc.ServiceAccounts...)
+	s.mu.RLock()
+	byPort := s.byService[svc.Hostname]
+	for _, port := range ports {
+		if svcPort, f := svc.Ports.GetByPort(port); f {
+			for account := range byPort[svcPort.Name] {
+				out.Insert(account)
+			}
+		}
+	}
+	s.mu.RUnlock()
+	accounts := out.UnsortedList()
+	sort.Strings(accounts)
+	return accounts
+}
+
+// clear drops the accounts of a deleted service.
+func (s *serviceAccounts) clear(hostname host.Name) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.byService, hostname)
+}
+
+// onServiceAccountsChange pushes the service after the accounts of its endpoints changed, as the
+// certificates its clients accept are validated against them. The accounts collected during the
+// initial sync are picked up by the first push.
+func (c *Controller) onServiceAccountsChange(hostname host.Name, namespace string) {
+	select {
+	case <-c.synced:
+	default:
+		return
+	}
+	log.Debugf("Service accounts of service %s changed", hostname)
+	c.xdsUpdater.ConfigUpdate(&model.PushRequest{
+		Full: true,
+		ConfigsUpdated: map[model.ConfigKey]struct{}{{
+			Kind:      model.ServiceEntryKind,
+			Name:      string(hostname),
+			Namespace: namespace,
+		}: {}},
+		Reason: []model.TriggerReason{model.ServiceUpdate},
+	})
+}
@@ -0,0 +1,140 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/protocol"
+	"istio.io/istio/pkg/spiffe"
+)
+
+func TestServiceAccounts(t *testing.T) {
+	s := newServiceAccounts()
+	svc := &model.Service{
+		Hostname:        "svc1.nsA.svc.company.com",
+		Ports:           model.PortList{{Name: "http", Port: 80, Protocol: protocol.HTTP}, {Name: "grpc", Port: 90, Protocol: protocol.GRPC}},
+		ServiceAccounts: []string{"vm@company.com"},
+	}
+	endpoints := []*model.IstioEndpoint{
+		{ServicePortName: "http", ServiceAccount: "sa-b"},
+		{ServicePortName: "http", ServiceAccount: "sa-a"},
+		{ServicePortName: "grpc", ServiceAccount: "sa-c"},
+		{ServicePortName: "grpc"},
+	}
+	if !s.record(svc.Hostname, endpoints) {
+		t.Fatal("expected the first accounts to be a change")
+	}
+	if !s.record(svc.Hostname, endpoints[1:2]) {
+		t.Fatal("expected fewer accounts to be a change")
+	}
+	if s.record(svc.Hostname, endpoints[1:2]) {
+		t.Fatal("expected the same accounts not to be a change")
+	}
+	s.record(svc.Hostname, endpoints)
+
+	// Only the accounts of the requested ports are returned, with those of the service.
+	if got, want := s.get(svc, []int{80}), []string{"sa-a", "sa-b", "vm@company.com"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got accounts %v, want %v", got, want)
+	}
+	if got, want := s.get(svc, []int{80, 90}), []string{"sa-a", "sa-b", "sa-c", "vm@company.com"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got accounts %v, want %v", got, want)
+	}
+	if got, want := s.get(svc, nil), []string{"vm@company.com"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got accounts %v, want %v", got, want)
+	}
+
+	if !s.record(svc.Hostname, nil) {
+		t.Fatal("expected losing all the endpoints to be a change")
+	}
+	s.record(svc.Hostname, endpoints)
+	s.clear(svc.Hostname)
+	if got, want := s.get(svc, []int{80, 90}), []string{"vm@company.com"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got accounts %v after the service was deleted, want %v", got, want)
+	}
+}
+
+func TestServiceAccountsRollout(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeHarness(t, Options{EndpointMode: mode})
+			defer controller.Stop()
+
+			// Two Deployments with their own service account behind one service.
+			addPodsSync(t, controller,
+				generatePod("128.0.0.1", "frontend-1", "nsA", "frontend", "", map[string]string{"app": "prod-app"}, nil),
+				generatePod("128.0.0.2", "backend-1", "nsA", "backend", "", map[string]string{"app": "prod-app"}, nil))
+			do(t, controller, func() {
+				createService(controller.Controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "prod-app"}, t)
+			})
+			hostname := kube.ServiceHostname("svc1", "nsA", domainSuffix)
+			assertAccounts := func(accounts ...string) {
+				t.Helper()
+				svc, _ := controller.GetService(hostname)
+				if svc == nil {
+					t.Fatal("service not found")
+				}
+				var want []string
+				for _, account := range accounts {
+					want = append(want, spiffe.MustGenSpiffeURI("nsA", account))
+				}
+				if got := controller.GetIstioServiceAccounts(svc, []int{8080}); !reflect.DeepEqual(got, want) {
+					t.Fatalf("got accounts %v, want %v", got, want)
+				}
+			}
+			assertPush := func() {
+				t.Helper()
+				want := map[model.ConfigKey]struct{}{{Kind: model.ServiceEntryKind, Name: string(hostname), Namespace: "nsA"}: {}}
+				if ev := fx.Wait("xds"); ev == nil || !reflect.DeepEqual(ev.ConfigsUpdated, want) {
+					t.Fatalf("expected a push of the service, got %v", ev)
+				}
+			}
+
+			fx.Clear()
+			do(t, controller, func() {
+				createEndpoints(controller.Controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1", "128.0.0.2"}, t)
+			})
+			assertPush()
+			assertAccounts("backend", "frontend")
+
+			// The backend Deployment rolls out with a new service account.
+			addPodsSync(t, controller,
+				generatePod("128.0.0.3", "backend-2", "nsA", "backend-v2", "", map[string]string{"app": "prod-app"}, nil))
+			fx.Clear()
+			do(t, controller, func() {
+				updateEndpoints(controller.Controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1", "128.0.0.3"}, t)
+			})
+			assertPush()
+			assertAccounts("backend-v2", "frontend")
+
+			// Endpoints changes keeping the accounts do not push.
+			addPodsSync(t, controller,
+				generatePod("128.0.0.4", "frontend-2", "nsA", "frontend", "", map[string]string{"app": "prod-app"}, nil))
+			fx.Clear()
+			do(t, controller, func() {
+				updateEndpoints(controller.Controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1", "128.0.0.3", "128.0.0.4"}, t)
+			})
+			for _, ev := range pendingEvents(fx) {
+				if ev.Type == "xds" {
+					t.Fatalf("unexpected push %v", ev)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+// EndpointsForService returns the endpoints the controller attributes to the service of the
+// hostname, for debugging: the endpoints of its last EDS update, local and foreign, as passed to
+// the XDS updater, followed by the endpoints of the instances of an ExternalName service, which
+// are never pushed. The endpoints are recorded by the EDS updates, so the lookup builds nothing
+// and sees what was pushed, including the truncation of Options.MaxEndpointsPerService. The
+// endpoints are shared with the XDS updater and must not be modified. It returns an error for
+// hostnames that are not in the registry.
+func (c *Controller) EndpointsForService(hostname host.Name) ([]*model.IstioEndpoint, error) {
+	c.RLock()
+	_, f := c.servicesMap[hostname]
+	externalNameInstances := c.externalNameSvcInstanceMap[hostname]
+	c.RUnlock()
+	if !f {
+		return nil, fmt.Errorf("service %s is not in the registry of cluster %s", hostname, c.clusterID)
+	}
+
+	c.pushedEDSMutex.Lock()
+	pushed := c.pushedEndpoints[hostname]
+	c.pushedEDSMutex.Unlock()
+
+	out := make([]*model.IstioEndpoint, 0, len(pushed)+len(externalNameInstances))
+	out = append(out, pushed...)
+	for _, instance := range externalNameInstances {
+		out = append(out, instance.Endpoint)
+	}
+	return out, nil
+}
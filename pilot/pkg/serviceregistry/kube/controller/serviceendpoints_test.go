@@ -0,0 +1,112 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/config/labels"
+)
+
+func TestEndpointsForService(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeHarness(t, Options{ClusterID: "cluster1", EndpointMode: mode})
+			defer controller.Stop()
+
+			hostname := kube.ServiceHostname("svc1", "nsA", domainSuffix)
+			if _, err := controller.EndpointsForService(hostname); err == nil {
+				t.Fatal("expected an error for a service not in the registry")
+			}
+
+			selector := map[string]string{"app": "a"}
+			addPodsSync(t, controller,
+				generatePod("128.0.0.1", "pod1", "nsA", "", "", selector, nil),
+				generatePod("128.0.0.2", "pod2", "nsA", "", "", selector, nil))
+			do(t, controller, func() {
+				createService(controller.Controller, "svc1", "nsA", nil, []int32{8080}, selector, t)
+			})
+			got, err := controller.EndpointsForService(hostname)
+			if err != nil || len(got) != 0 {
+				t.Fatalf("expected no endpoints before the endpoints objects exist, got %v, %v", got, err)
+			}
+
+			fx.Clear()
+			do(t, controller, func() {
+				createEndpoints(controller.Controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1", "128.0.0.2"}, t)
+			})
+			expectLastEDS := func(want int) {
+				t.Helper()
+				ev := fx.Wait("eds")
+				if ev == nil || ev.ID != string(hostname) || len(ev.Endpoints) != want {
+					t.Fatalf("expected an EDS update of %s with %d endpoints, got %+v", hostname, want, ev)
+				}
+				got, err := controller.EndpointsForService(hostname)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, ev.Endpoints) {
+					t.Fatalf("got endpoints %v, want the endpoints of the last EDS update %v", got, ev.Endpoints)
+				}
+			}
+			expectLastEDS(2)
+
+			// Foreign instances selected by the service are included.
+			controller.ForeignServiceInstanceHandler(&model.ServiceInstance{
+				Service: &model.Service{
+					Hostname:   "se.example.com",
+					Attributes: model.ServiceAttributes{Name: "se", Namespace: "nsA"},
+				},
+				Endpoint: &model.IstioEndpoint{
+					Labels:       labels.Instance{"app": "a"},
+					Address:      "192.168.0.1",
+					EndpointPort: 8080,
+				},
+			}, model.EventAdd)
+			expectLastEDS(3)
+
+			// The instances of ExternalName services, which are not pushed, are included too.
+			externalName := kube.ServiceHostname("svc2", "nsA", domainSuffix)
+			do(t, controller, func() {
+				svc := &coreV1.Service{
+					ObjectMeta: metaV1.ObjectMeta{Name: "svc2", Namespace: "nsA"},
+					Spec: coreV1.ServiceSpec{
+						Type:         coreV1.ServiceTypeExternalName,
+						ExternalName: "foo.co",
+						Ports:        []coreV1.ServicePort{{Name: "tcp-port", Port: 80}, {Name: "http", Port: 81}},
+					},
+				}
+				if _, err := controller.Client.CoreV1().Services("nsA").Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			})
+			got, err = controller.EndpointsForService(externalName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 2 || got[0].Address != "foo.co" || got[1].Address != "foo.co" {
+				t.Fatalf("expected the endpoints of the 2 ports of the ExternalName service, got %v", got)
+			}
+		})
+	}
+}
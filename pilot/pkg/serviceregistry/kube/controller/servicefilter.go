@@ -0,0 +1,167 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"reflect"
+
+	v1 "k8s.io/api/core/v1"
+	klabels "k8s.io/apimachinery/pkg/labels"
+
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+)
+
+var filteredServices = monitoring.NewSum(
+	"pilot_k8s_filtered_services",
+	"Services skipped because Options.ServiceFilterFunc filtered them out.",
+	monitoring.WithLabels(namespaceTag),
+)
+
+func init() {
+	monitoring.MustRegister(filteredServices)
+}
+
+// serviceOptions are the options deciding which services are modeled, and how, with their
+// defaults applied. They are read from Options once, by newServiceOptions.
+type serviceOptions struct {
+	// filter is Options.ServiceFilterFunc, proxyNames the values of ServiceProxyNameLabel of
+	// Options.ServiceProxyNames: both skip services, see isFilteredOut.
+	filter     func(*v1.Service) bool
+	proxyNames map[string]struct{}
+	mcsMode    MCSMode
+	// truncateHostnames shortens the hostnames longer than maxHostnameLength instead of rejecting
+	// their services.
+	truncateHostnames bool
+	// controlPlaneServices are the names of the services of the system namespace that are the
+	// control plane, see isControlPlaneService.
+	controlPlaneServices map[string]struct{}
+}
+
+func newServiceOptions(options Options) serviceOptions {
+	out := serviceOptions{
+		filter:               options.ServiceFilterFunc,
+		proxyNames:           make(map[string]struct{}, len(options.ServiceProxyNames)),
+		mcsMode:              options.MCSMode,
+		truncateHostnames:    options.TruncateLongHostnames,
+		controlPlaneServices: make(map[string]struct{}),
+	}
+	for _, name := range options.ServiceProxyNames {
+		out.proxyNames[name] = struct{}{}
+	}
+	controlPlaneServices := options.ControlPlaneServices
+	if controlPlaneServices == nil {
+		controlPlaneServices = DefaultControlPlaneServices
+	}
+	for _, name := range controlPlaneServices {
+		out.controlPlaneServices[name] = struct{}{}
+	}
+	return out
+}
+
+// updateSkippedService evaluates the service filter for an event of the service, returning
+// whether the service is skipped.
+func (c *Controller) updateSkippedService(svc *v1.Service, event model.Event) bool {
+	skipped := event != model.EventDelete && c.isFilteredOut(svc)
+	hostname := c.serviceHostname(svc.Name, svc.Namespace)
+	c.Lock()
+	_, wasSkipped := c.skippedServices[hostname]
+	if skipped {
+		c.skippedServices[hostname] = struct{}{}
+	} else {
+		delete(c.skippedServices, hostname)
+	}
+	c.Unlock()
+	if skipped && !wasSkipped {
+		if c.isOtherProxyService(svc) {
+			log.Debugf("Service %s/%s skipped, handled by the %q proxy", svc.Namespace, svc.Name, svc.Labels[ServiceProxyNameLabel])
+			otherProxyServices.With(namespaceTag.Value(svc.Namespace)).Increment()
+		} else {
+			log.Debugf("Service %s/%s filtered out", svc.Namespace, svc.Name)
+			filteredServices.With(namespaceTag.Value(svc.Namespace)).Increment()
+		}
+	}
+	return skipped
+}
+
+// isSkippedService reports whether the service of the hostname is filtered out.
+func (c *Controller) isSkippedService(hostname host.Name) bool {
+	c.RLock()
+	defer c.RUnlock()
+	_, f := c.skippedServices[hostname]
+	return f
+}
+
+// isKnownService reports whether the service is in the registry.
+func (c *Controller) isKnownService(svc *v1.Service) bool {
+	hostname := c.serviceHostname(svc.Name, svc.Namespace)
+	c.RLock()
+	defer c.RUnlock()
+	_, f := c.servicesMap[hostname]
+	return f
+}
+
+// clearPushedEndpoints pushes an empty EDS update for the service if its endpoints were pushed.
+func (c *Controller) clearPushedEndpoints(hostname host.Name) {
+	c.pushedEDSMutex.Lock()
+	namespace, f := c.pushedEDS[hostname]
+	c.pushedEDSMutex.Unlock()
+	if !f {
+		return
+	}
+	c.trackLocalEndpoints(hostname, "", "", false)
+	c.edsUpdate(hostname, namespace, nil)
+}
+
+// onNamespaceEvent evaluates the service filter again for the services of a namespace, as it may
+// depend on the namespace labels.
+func (c *Controller) onNamespaceEvent(curr interface{}, event model.Event) error {
+	if event == model.EventDelete {
+		// The services of the namespace are deleted with it.
+		return nil
+	}
+	ns, ok := curr.(*v1.Namespace)
+	if !ok {
+		log.Errorf("Unexpected object in namespace event %#v", curr)
+		return nil
+	}
+	services, err := c.serviceLister.Services(ns.Name).List(klabels.Everything())
+	if err != nil {
+		return err
+	}
+	for _, svc := range services {
+		if err := c.onServiceEvent(svc, model.EventUpdate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// namespaceUpdateEqual compares the fields of namespaces a service filter may read.
+func namespaceUpdateEqual(old, cur interface{}) bool {
+	oldNs, ok := old.(*v1.Namespace)
+	if !ok {
+		return false
+	}
+	curNs, ok := cur.(*v1.Namespace)
+	if !ok {
+		return false
+	}
+	return reflect.DeepEqual(oldNs.Labels, curNs.Labels) &&
+		reflect.DeepEqual(oldNs.Annotations, curNs.Annotations)
+}
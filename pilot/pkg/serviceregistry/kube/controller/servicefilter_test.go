@@ -0,0 +1,132 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+func TestServiceFilter(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			var controller *Controller
+			// Services of namespaces labeled istio-discovery=disabled are skipped.
+			filter := func(svc *coreV1.Service) bool {
+				ns, err := controller.client.CoreV1().Namespaces().Get(context.TODO(), svc.Namespace, metaV1.GetOptions{})
+				return err == nil && ns.Labels["istio-discovery"] == "disabled"
+			}
+			ns := &coreV1.Namespace{ObjectMeta: metaV1.ObjectMeta{Name: "nsA"}}
+			controller, fx := newFakeControllerWithOptions(fakeControllerOptions{
+				mode:          mode,
+				serviceFilter: filter,
+				objects:       []runtime.Object{ns},
+			})
+			defer controller.Stop()
+			hostname := kube.ServiceHostname("svc1", "nsA", domainSuffix)
+
+			waitForEDS := func() *XdsEvent {
+				t.Helper()
+				for {
+					ev := fx.Wait("eds")
+					if ev == nil {
+						t.Fatalf("Timeout waiting for the endpoints of %s", hostname)
+					}
+					if ev.ID == string(hostname) {
+						return ev
+					}
+				}
+			}
+			setDiscovery := func(value string) {
+				t.Helper()
+				ns.Labels = map[string]string{"istio-discovery": value}
+				if _, err := controller.client.CoreV1().Namespaces().Update(context.TODO(), ns, metaV1.UpdateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expectService := func(present bool) {
+				t.Helper()
+				retry.UntilSuccessOrFail(t, func() error {
+					if svc, _ := controller.GetService(hostname); (svc != nil) != present {
+						return fmt.Errorf("expected service present=%v, got %v", present, svc)
+					}
+					return nil
+				}, retry.Timeout(5*time.Second))
+			}
+
+			for i, ip := range []string{"128.0.0.1", "128.0.0.2"} {
+				pod := generatePod(ip, fmt.Sprintf("pod%d", i+1), "nsA", "", "", map[string]string{"app": "a"}, nil)
+				addPods(t, controller, pod)
+				if err := waitForPod(controller, ip); err != nil {
+					t.Fatal(err)
+				}
+			}
+			createService(controller, "svc1", "nsA", nil, []int32{8080}, map[string]string{"app": "a"}, t)
+			if ev := fx.Wait("service"); ev == nil {
+				t.Fatal("Timeout creating service")
+			}
+			createEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+			waitForEDS()
+
+			// Labeling the namespace removes its services and their endpoints.
+			setDiscovery("disabled")
+			expectService(false)
+			if !controller.isSkippedService(hostname) {
+				t.Fatal("expected the service to be skipped")
+			}
+			controller.pushedEDSMutex.Lock()
+			_, pushed := controller.pushedEDS[hostname]
+			controller.pushedEDSMutex.Unlock()
+			if pushed {
+				t.Fatal("expected the endpoints of the skipped service to be cleared")
+			}
+
+			// The endpoints of a skipped service are ignored.
+			updateEndpoints(controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.2"}, t)
+			createService(controller, "svc2", "nsA", nil, []int32{8080}, map[string]string{"app": "b"}, t)
+			retry.UntilSuccessOrFail(t, func() error {
+				if !controller.isSkippedService(kube.ServiceHostname("svc2", "nsA", domainSuffix)) {
+					return fmt.Errorf("svc2 not skipped yet")
+				}
+				return nil
+			}, retry.Timeout(5*time.Second))
+			if svc, _ := controller.GetService(hostname); svc != nil {
+				t.Fatalf("expected no service, got %v", svc)
+			}
+
+			// The services are back with their latest endpoints once the namespace is enabled.
+			fx.Clear()
+			setDiscovery("enabled")
+			expectService(true)
+			ev := waitForEDS()
+			if len(ev.Endpoints) != 1 || ev.Endpoints[0].Address != "128.0.0.2" {
+				t.Fatalf("expected the latest endpoints, got %v", ev.Endpoints)
+			}
+			if controller.isSkippedService(hostname) {
+				t.Fatal("expected the service to no longer be skipped")
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	v1 "k8s.io/api/core/v1"
+
+	"istio.io/pkg/monitoring"
+)
+
+// ServiceProxyNameLabel names the proxy implementation handling the service, such as kube-router
+// or the load balancer of a CNI, instead of kube-proxy. kube-proxy ignores the services with the
+// label, whatever its value.
+const ServiceProxyNameLabel = "service.kubernetes.io/service-proxy-name"
+
+var otherProxyServices = monitoring.NewSum(
+	"pilot_k8s_other_proxy_services",
+	"Services skipped because their "+ServiceProxyNameLabel+" label names a proxy not in Options.ServiceProxyNames.",
+	monitoring.WithLabels(namespaceTag),
+)
+
+func init() {
+	monitoring.MustRegister(otherProxyServices)
+}
+
+// isOtherProxyService reports whether the service is handled by another proxy, which is not one of
+// Options.ServiceProxyNames.
+func (c *Controller) isOtherProxyService(svc *v1.Service) bool {
+	name, f := svc.Labels[ServiceProxyNameLabel]
+	if !f {
+		return false
+	}
+	_, modeled := c.serviceOptions.proxyNames[name]
+	return !modeled
+}
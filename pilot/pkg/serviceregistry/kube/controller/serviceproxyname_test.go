@@ -0,0 +1,108 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+)
+
+func TestServiceProxyName(t *testing.T) {
+	for mode, name := range EndpointModeNames {
+		mode := mode
+		t.Run(name, func(t *testing.T) {
+			controller, fx := newFakeHarness(t, Options{EndpointMode: mode, ServiceProxyNames: []string{"istio"}})
+			defer controller.Stop()
+			hostname := kube.ServiceHostname("svc1", "nsA", domainSuffix)
+
+			setProxyName := func(value string, set bool) {
+				t.Helper()
+				do(t, controller, func() {
+					svc, err := controller.Client.CoreV1().Services("nsA").Get(context.TODO(), "svc1", metaV1.GetOptions{})
+					if err != nil {
+						t.Fatal(err)
+					}
+					svc.Labels = nil
+					if set {
+						svc.Labels = map[string]string{ServiceProxyNameLabel: value}
+					}
+					if _, err := controller.Client.CoreV1().Services("nsA").Update(context.TODO(), svc, metaV1.UpdateOptions{}); err != nil {
+						t.Fatal(err)
+					}
+				})
+			}
+			expectModeled := func(modeled bool) {
+				t.Helper()
+				if svc, _ := controller.GetService(hostname); (svc != nil) != modeled {
+					t.Fatalf("expected service modeled=%v, got %v", modeled, svc)
+				}
+				if controller.isSkippedService(hostname) == modeled {
+					t.Fatalf("expected service skipped=%v", !modeled)
+				}
+				controller.pushedEDSMutex.Lock()
+				_, pushed := controller.pushedEDS[hostname]
+				controller.pushedEDSMutex.Unlock()
+				if pushed != modeled {
+					t.Fatalf("expected the endpoints of the service pushed=%v", modeled)
+				}
+			}
+			expectEndpoints := func() {
+				t.Helper()
+				ev := fx.Wait("eds")
+				if ev == nil || ev.ID != string(hostname) || len(ev.Endpoints) != 1 || ev.Endpoints[0].Address != "128.0.0.1" {
+					t.Fatalf("expected the endpoints of the service, got %v", ev)
+				}
+			}
+
+			selector := map[string]string{"app": "a"}
+			addPodsSync(t, controller, generatePod("128.0.0.1", "pod1", "nsA", "", "", selector, nil))
+			do(t, controller, func() {
+				createService(controller.Controller, "svc1", "nsA", nil, []int32{8080}, selector, t)
+			})
+			do(t, controller, func() {
+				createEndpoints(controller.Controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1"}, t)
+			})
+			expectModeled(true)
+
+			// The service is removed, with its endpoints, once handled by another proxy.
+			exclusions := sumValue(t, "pilot_k8s_other_proxy_services", map[string]string{"namespace": "nsA"})
+			setProxyName("kube-router", true)
+			expectModeled(false)
+			if got := sumValue(t, "pilot_k8s_other_proxy_services", map[string]string{"namespace": "nsA"}); got != exclusions+1 {
+				t.Fatalf("expected 1 more excluded service, got %v", got-exclusions)
+			}
+
+			// Back with its endpoints once the label is removed.
+			fx.Clear()
+			setProxyName("", false)
+			expectModeled(true)
+			expectEndpoints()
+
+			// Services of the listed proxies are modeled, unlike those of any other, even unnamed, proxy.
+			setProxyName("istio", true)
+			expectModeled(true)
+			setProxyName("", true)
+			expectModeled(false)
+			fx.Clear()
+			setProxyName("istio", true)
+			expectModeled(true)
+			expectEndpoints()
+		})
+	}
+}
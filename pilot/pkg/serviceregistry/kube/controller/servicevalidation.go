@@ -0,0 +1,106 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"sort"
+
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/protocol"
+)
+
+const (
+	// RejectedInvalidHostname is the reason for services whose hostname is not a valid DNS name.
+	RejectedInvalidHostname = "InvalidHostname"
+	// RejectedNoUsablePorts is the reason for services whose every port uses a protocol the proxy
+	// does not support.
+	RejectedNoUsablePorts = "NoUsablePorts"
+)
+
+var (
+	reasonTag = monitoring.MustCreateLabel("reason")
+
+	rejectedServices = monitoring.NewSum(
+		"pilot_k8s_rejected_services",
+		"Services that could not be converted to a usable service, by reason.",
+		monitoring.WithLabels(reasonTag),
+	)
+)
+
+func init() {
+	monitoring.MustRegister(rejectedServices)
+}
+
+// ServiceRejectedError describes a Kubernetes service left out of the registry because its
+// converted service would break the generated configuration.
+type ServiceRejectedError struct {
+	Hostname  host.Name `json:"hostname"`
+	Name      string    `json:"name"`
+	Namespace string    `json:"namespace"`
+	Reason    string    `json:"reason"`
+	Message   string    `json:"message"`
+}
+
+func (e *ServiceRejectedError) Error() string {
+	return fmt.Sprintf("service %s/%s rejected (%s): %s", e.Namespace, e.Name, e.Reason, e.Message)
+}
+
+// validateConvertedService checks that the converted service can be used to generate configuration.
+func validateConvertedService(svc *model.Service) *ServiceRejectedError {
+	reject := func(reason, format string, args ...interface{}) *ServiceRejectedError {
+		return &ServiceRejectedError{
+			Hostname:  svc.Hostname,
+			Name:      svc.Attributes.Name,
+			Namespace: svc.Attributes.Namespace,
+			Reason:    reason,
+			Message:   fmt.Sprintf(format, args...),
+		}
+	}
+	if err := validateHostname(svc.Hostname); err != nil {
+		return reject(RejectedInvalidHostname, "%v", err)
+	}
+	// Services without ports, such as headless services used only for DNS, are valid. Services
+	// whose every port is unusable produce clusters and listeners that are silently dropped.
+	if len(svc.Ports) == 0 {
+		return nil
+	}
+	for _, port := range svc.Ports {
+		if port.Protocol != protocol.UDP {
+			return nil
+		}
+	}
+	return reject(RejectedNoUsablePorts, "all %d ports use protocols the proxy does not support", len(svc.Ports))
+}
+
+// isValidDNSName reports whether name is a valid DNS name of RFC 1123 labels.
+func isValidDNSName(name string) bool {
+	return validateHostname(host.Name(name)) == nil
+}
+
+// RejectedServices returns the services currently left out of the registry, sorted by hostname.
+func (c *Controller) RejectedServices() []ServiceRejectedError {
+	c.RLock()
+	out := make([]ServiceRejectedError, 0, len(c.rejectedServices))
+	for _, err := range c.rejectedServices {
+		out = append(out, *err)
+	}
+	c.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Hostname < out[j].Hostname })
+	return out
+}
@@ -0,0 +1,89 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"sort"
+	"time"
+
+	"istio.io/istio/pkg/config/host"
+)
+
+// ServiceVersion identifies the Kubernetes objects a converted service and its endpoints were last
+// built from, to tell whether the registry is behind the cluster.
+type ServiceVersion struct {
+	Hostname  host.Name `json:"hostname"`
+	ClusterID string    `json:"clusterID"`
+	// ResourceVersion and Generation are those of the Service last converted, at ConvertedAt.
+	ResourceVersion string    `json:"resourceVersion,omitempty"`
+	Generation      int64     `json:"generation,omitempty"`
+	ConvertedAt     time.Time `json:"convertedAt,omitempty"`
+	// EndpointsResourceVersion is that of the Endpoints or EndpointSlice last applied to the
+	// service, at EndpointsAppliedAt.
+	EndpointsResourceVersion string    `json:"endpointsResourceVersion,omitempty"`
+	EndpointsAppliedAt       time.Time `json:"endpointsAppliedAt,omitempty"`
+}
+
+// objectVersion is the resource version of an object handled at a given time.
+type objectVersion struct {
+	resourceVersion string
+	generation      int64
+	handledAt       time.Time
+}
+
+// recordEndpointsVersion records the resource version of the endpoints last applied to the service.
+func (c *Controller) recordEndpointsVersion(hostname host.Name, resourceVersion string) {
+	c.Lock()
+	defer c.Unlock()
+	c.endpointsVersions[hostname] = objectVersion{resourceVersion: resourceVersion, handledAt: c.clock.Now()}
+}
+
+// GetServiceVersion returns the versions of the objects the service was last built from, and false
+// if the service is not known.
+func (c *Controller) GetServiceVersion(hostname host.Name) (ServiceVersion, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.serviceVersionLocked(hostname)
+}
+
+// ServiceVersions returns the versions of all known services, sorted by hostname.
+func (c *Controller) ServiceVersions() []ServiceVersion {
+	c.RLock()
+	out := make([]ServiceVersion, 0, len(c.serviceVersions))
+	for hostname := range c.serviceVersions {
+		v, _ := c.serviceVersionLocked(hostname)
+		out = append(out, v)
+	}
+	c.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Hostname < out[j].Hostname })
+	return out
+}
+
+func (c *Controller) serviceVersionLocked(hostname host.Name) (ServiceVersion, bool) {
+	svc, f := c.serviceVersions[hostname]
+	if !f {
+		return ServiceVersion{}, false
+	}
+	eps := c.endpointsVersions[hostname]
+	return ServiceVersion{
+		Hostname:                 hostname,
+		ClusterID:                c.clusterID,
+		ResourceVersion:          svc.resourceVersion,
+		Generation:               svc.generation,
+		ConvertedAt:              svc.handledAt,
+		EndpointsResourceVersion: eps.resourceVersion,
+		EndpointsAppliedAt:       eps.handledAt,
+	}, true
+}
@@ -0,0 +1,123 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	coreV1 "k8s.io/api/core/v1"
+	metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+func TestServiceVersion(t *testing.T) {
+	controller, fx := newFakeControllerWithOptions(fakeControllerOptions{clusterID: "cluster1"})
+	defer controller.Stop()
+
+	hostname := kube.ServiceHostname("svc1", "nsA", domainSuffix)
+	if _, f := controller.GetServiceVersion(hostname); f {
+		t.Fatal("expected no version for an unknown service")
+	}
+	assertVersion := func(resourceVersion, endpointsResourceVersion string) ServiceVersion {
+		t.Helper()
+		var got ServiceVersion
+		retry.UntilSuccessOrFail(t, func() error {
+			var f bool
+			if got, f = controller.GetServiceVersion(hostname); !f {
+				return fmt.Errorf("no version for %s", hostname)
+			}
+			if got.ResourceVersion != resourceVersion || got.EndpointsResourceVersion != endpointsResourceVersion {
+				return fmt.Errorf("got versions %s and %s, want %s and %s",
+					got.ResourceVersion, got.EndpointsResourceVersion, resourceVersion, endpointsResourceVersion)
+			}
+			return nil
+		}, retry.Timeout(5*time.Second))
+		return got
+	}
+
+	svc := &coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA", ResourceVersion: "1"},
+		Spec: coreV1.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+			Ports:     []coreV1.ServicePort{{Name: "tcp-port", Port: 8080}},
+		},
+	}
+	services := controller.client.CoreV1().Services("nsA")
+	if _, err := services.Create(context.TODO(), svc, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ev := fx.Wait("service"); ev == nil {
+		t.Fatal("Timeout creating service")
+	}
+	created := assertVersion("1", "")
+	if created.ClusterID != "cluster1" || created.ConvertedAt.IsZero() {
+		t.Fatalf("unexpected version %+v", created)
+	}
+
+	ep := &coreV1.Endpoints{
+		ObjectMeta: metaV1.ObjectMeta{Name: "svc1", Namespace: "nsA", ResourceVersion: "2"},
+		Subsets: []coreV1.EndpointSubset{{
+			Addresses: []coreV1.EndpointAddress{{IP: "10.10.0.1"}},
+			Ports:     []coreV1.EndpointPort{{Name: "tcp-port", Port: 8080}},
+		}},
+	}
+	endpoints := controller.client.CoreV1().Endpoints("nsA")
+	if _, err := endpoints.Create(context.TODO(), ep, metaV1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	assertVersion("1", "2")
+
+	// Updates advance the recorded versions.
+	svc.ResourceVersion = "3"
+	svc.Spec.Ports = append(svc.Spec.Ports, coreV1.ServicePort{Name: "http-port", Port: 8081})
+	if _, err := services.Update(context.TODO(), svc, metaV1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	ep.ResourceVersion = "4"
+	ep.Subsets[0].Addresses = append(ep.Subsets[0].Addresses, coreV1.EndpointAddress{IP: "10.10.0.2"})
+	if _, err := endpoints.Update(context.TODO(), ep, metaV1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	updated := assertVersion("3", "4")
+	if !updated.ConvertedAt.After(created.ConvertedAt) {
+		t.Fatalf("expected the conversion time to advance, got %v then %v", created.ConvertedAt, updated.ConvertedAt)
+	}
+
+	// A resync handles the same objects again and keeps their versions.
+	if err := controller.onServiceEvent(svc, model.EventUpdate); err != nil {
+		t.Fatal(err)
+	}
+	controller.updateEDS(ep, model.EventUpdate)
+	assertVersion("3", "4")
+	if got := controller.ServiceVersions(); len(got) != 1 || got[0].Hostname != hostname {
+		t.Fatalf("unexpected service versions %+v", got)
+	}
+
+	if err := services.Delete(context.TODO(), "svc1", metaV1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	retry.UntilSuccessOrFail(t, func() error {
+		if _, f := controller.GetServiceVersion(hostname); f {
+			return fmt.Errorf("version of %s not dropped", hostname)
+		}
+		return nil
+	}, retry.Timeout(5*time.Second))
+}
@@ -0,0 +1,111 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+)
+
+var (
+	writeLockHoldTime = monitoring.NewDistribution(
+		"pilot_k8s_write_lock_hold_time",
+		"Time in seconds the write lock of the Kubernetes registry is held, when instrumented.",
+		[]float64{.0001, .001, .01, .1, 1},
+	)
+	slowWriteLockHolds = monitoring.NewSum(
+		"pilot_k8s_slow_write_lock_holds",
+		"Holds of the write lock of the Kubernetes registry longer than Options.WriteLockHoldThreshold.",
+	)
+)
+
+func init() {
+	monitoring.MustRegister(writeLockHoldTime, slowWriteLockHolds)
+}
+
+// timedRWMutex is a sync.RWMutex that records how long its write lock is held once instrumented.
+// Holds longer than the threshold are logged with the function releasing the lock. The zero value
+// is an uninstrumented mutex, which only costs a branch per write lock.
+type timedRWMutex struct {
+	sync.RWMutex
+	threshold time.Duration
+	// lockedAt is when the write lock was taken, it is only accessed under the write lock.
+	lockedAt time.Time
+	now      func() time.Time
+	// onSlowHold is called, with the write lock released, for the holds longer than threshold.
+	onSlowHold func(held time.Duration, caller string)
+}
+
+// instrument records the write lock holds from now on, reporting those longer than threshold.
+// It must be called before the mutex is shared.
+func (m *timedRWMutex) instrument(threshold time.Duration) {
+	m.threshold = threshold
+	if m.now == nil {
+		m.now = time.Now
+	}
+	if m.onSlowHold == nil {
+		m.onSlowHold = func(held time.Duration, caller string) {
+			log.Warnf("Kubernetes registry write lock held for %v by %s, more than %v", held, caller, threshold)
+			slowWriteLockHolds.Increment()
+		}
+	}
+}
+
+func (m *timedRWMutex) Lock() {
+	m.RWMutex.Lock()
+	if m.threshold > 0 {
+		m.lockedAt = m.now()
+	}
+}
+
+func (m *timedRWMutex) Unlock() {
+	if m.threshold <= 0 {
+		m.RWMutex.Unlock()
+		return
+	}
+	held := m.now().Sub(m.lockedAt)
+	m.RWMutex.Unlock()
+	writeLockHoldTime.Record(held.Seconds())
+	if held > m.threshold {
+		m.onSlowHold(held, callerName())
+	}
+}
+
+// callerName returns the function that called Unlock, directly or through a deferred call.
+func callerName() string {
+	pc := make([]uintptr, 8)
+	// Skip runtime.Callers, callerName and Unlock.
+	n := runtime.Callers(3, pc)
+	frames := runtime.CallersFrames(pc[:n])
+	for {
+		frame, more := frames.Next()
+		// Deferred unlocks are called from the runtime.
+		if frame.Function != "" && !isRuntimeFunction(frame.Function) {
+			return frame.Function
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
+
+func isRuntimeFunction(name string) bool {
+	return strings.HasPrefix(name, "runtime.")
+}
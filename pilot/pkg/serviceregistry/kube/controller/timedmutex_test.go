@@ -0,0 +1,90 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type slowHold struct {
+	held   time.Duration
+	caller string
+}
+
+// holdWriteLock holds the write lock of m for d according to the fake clock at now.
+func holdWriteLock(m *timedRWMutex, now *time.Time, d time.Duration) {
+	m.Lock()
+	*now = now.Add(d)
+	m.Unlock()
+}
+
+// holdWriteLockDeferred is holdWriteLock with a deferred unlock.
+func holdWriteLockDeferred(m *timedRWMutex, now *time.Time, d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	*now = now.Add(d)
+}
+
+func TestTimedRWMutex(t *testing.T) {
+	now := time.Unix(0, 0)
+	var holds []slowHold
+	m := &timedRWMutex{
+		now: func() time.Time { return now },
+		onSlowHold: func(held time.Duration, caller string) {
+			holds = append(holds, slowHold{held, caller})
+		},
+	}
+	m.instrument(100 * time.Millisecond)
+
+	holdWriteLock(m, &now, 50*time.Millisecond)
+	holdWriteLock(m, &now, 100*time.Millisecond)
+	if len(holds) != 0 {
+		t.Fatalf("holds up to the threshold must not be reported, got %v", holds)
+	}
+
+	holdWriteLock(m, &now, 150*time.Millisecond)
+	holdWriteLockDeferred(m, &now, time.Second)
+	if len(holds) != 2 {
+		t.Fatalf("expected 2 slow holds, got %v", holds)
+	}
+	for i, want := range []slowHold{
+		{150 * time.Millisecond, ".holdWriteLock"},
+		{time.Second, ".holdWriteLockDeferred"},
+	} {
+		if holds[i].held != want.held || !strings.HasSuffix(holds[i].caller, want.caller) {
+			t.Errorf("slow hold %d: got %v held by %q, want %v held by *%s", i, holds[i].held, holds[i].caller, want.held, want.caller)
+		}
+	}
+
+	// Read locks are not timed.
+	m.RLock()
+	now = now.Add(time.Hour)
+	m.RUnlock()
+	if len(holds) != 2 {
+		t.Fatalf("read locks must not be reported, got %v", holds)
+	}
+}
+
+func TestTimedRWMutexUninstrumented(t *testing.T) {
+	var m timedRWMutex
+	m.now = func() time.Time {
+		t.Fatal("the clock of an uninstrumented mutex must not be read")
+		return time.Time{}
+	}
+	m.Lock()
+	m.Unlock()
+}
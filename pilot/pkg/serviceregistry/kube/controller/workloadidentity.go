@@ -0,0 +1,101 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+
+	"istio.io/pkg/log"
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+	"istio.io/istio/pkg/spiffe"
+)
+
+// WorkloadIdentityAnnotation is the pod annotation carrying the SPIFFE ID of the workload, for
+// platforms that do not derive it from the service account of the pod, such as for pods running
+// with automountServiceAccountToken=false. It is only honored with
+// Options.HonorWorkloadIdentityAnnotation, and only for IDs of the trust domain.
+const WorkloadIdentityAnnotation = "security.istio.io/workload-identity"
+
+var rejectedWorkloadIdentities = monitoring.NewSum(
+	"pilot_k8s_rejected_workload_identities",
+	"Pods whose "+WorkloadIdentityAnnotation+" annotation was ignored, as it is not a SPIFFE ID of the trust domain.",
+	monitoring.WithLabels(namespaceTag),
+)
+
+func init() {
+	monitoring.MustRegister(rejectedWorkloadIdentities)
+}
+
+// workloadIdentity returns the SPIFFE ID of the endpoints of the pod: the WorkloadIdentityAnnotation
+// when honored and valid, or the identity derived from the pod otherwise.
+func (c *Controller) workloadIdentity(pod *v1.Pod) string {
+	if c.endpointOptions.honorWorkloadIdentity {
+		if id, f := pod.Annotations[WorkloadIdentityAnnotation]; f {
+			err := c.validateWorkloadIdentity(id)
+			if err == nil {
+				return id
+			}
+			c.reportRejectedIdentity(pod, id, err)
+		}
+	}
+	return kube.SecureNamingSAN(pod)
+}
+
+// validateWorkloadIdentity checks that the identity is a SPIFFE ID of the trust domain of the
+// controller, Options.TrustDomain or the trust domain of the mesh.
+func (c *Controller) validateWorkloadIdentity(id string) error {
+	if !strings.HasPrefix(id, spiffe.URIPrefix) {
+		return fmt.Errorf("%q is not a SPIFFE ID", id)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(id, spiffe.URIPrefix), "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return fmt.Errorf("SPIFFE ID %q has no workload path", id)
+	}
+	trustDomain := c.endpointOptions.trustDomain
+	if trustDomain == "" {
+		trustDomain = spiffe.GetTrustDomain()
+	}
+	if !strings.EqualFold(parts[0], trustDomain) {
+		return fmt.Errorf("SPIFFE ID %q is outside of the trust domain %q", id, trustDomain)
+	}
+	return nil
+}
+
+// reportRejectedIdentity logs and counts a rejected identity once per pod and value, as the
+// identity is validated every time the endpoints of the pod are built.
+func (c *Controller) reportRejectedIdentity(pod *v1.Pod, id string, err error) {
+	key := kube.KeyFunc(pod.Name, pod.Namespace)
+	c.rejectedIdentitiesMutex.Lock()
+	reported, f := c.rejectedIdentities[key]
+	c.rejectedIdentities[key] = id
+	c.rejectedIdentitiesMutex.Unlock()
+	if f && reported == id {
+		return
+	}
+	log.Warnf("Ignoring the %s annotation of pod %s: %v", WorkloadIdentityAnnotation, key, err)
+	rejectedWorkloadIdentities.With(namespaceTag.Value(pod.Namespace)).Increment()
+}
+
+// forgetRejectedIdentity forgets the identity rejected for the pod, once it is deleted.
+func (c *Controller) forgetRejectedIdentity(key string) {
+	c.rejectedIdentitiesMutex.Lock()
+	defer c.rejectedIdentitiesMutex.Unlock()
+	delete(c.rejectedIdentities, key)
+}
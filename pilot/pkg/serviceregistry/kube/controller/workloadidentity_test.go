@@ -0,0 +1,94 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"istio.io/api/annotation"
+
+	"istio.io/istio/pilot/pkg/serviceregistry/kube"
+)
+
+func TestWorkloadIdentityAnnotation(t *testing.T) {
+	const (
+		derived  = "spiffe://cluster.local/ns/nsA/sa/sa1"
+		alpha    = "spiffe://cluster.local/alpha-id"
+		platform = "spiffe://cluster.local/platform/workload1"
+	)
+	cases := []struct {
+		name        string
+		honor       bool
+		annotations map[string]string
+		want        string
+		rejected    float64
+	}{
+		{"not honored", false, map[string]string{WorkloadIdentityAnnotation: platform}, derived, 0},
+		{"service account", true, nil, derived, 0},
+		{"annotation", true, map[string]string{WorkloadIdentityAnnotation: platform}, platform, 0},
+		{"annotation over alpha identity", true,
+			map[string]string{WorkloadIdentityAnnotation: platform, annotation.AlphaIdentity.Name: "alpha-id"}, platform, 0},
+		{"other trust domain", true, map[string]string{WorkloadIdentityAnnotation: "spiffe://other.domain/platform/workload1"}, derived, 1},
+		{"other trust domain with alpha identity", true,
+			map[string]string{WorkloadIdentityAnnotation: "spiffe://other.domain/w", annotation.AlphaIdentity.Name: "alpha-id"}, alpha, 1},
+		{"not spiffe", true, map[string]string{WorkloadIdentityAnnotation: "cluster.local/platform/workload1"}, derived, 1},
+		{"no path", true, map[string]string{WorkloadIdentityAnnotation: "spiffe://cluster.local/"}, derived, 1},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			controller, _ := newFakeHarness(t, Options{TrustDomain: "cluster.local", HonorWorkloadIdentityAnnotation: tt.honor})
+			defer controller.Stop()
+
+			pod := generatePod("128.0.0.1", "pod1", "nsA", "sa1", "", nil, tt.annotations)
+			rejected := sumValue(t, "pilot_k8s_rejected_workload_identities", map[string]string{"namespace": "nsA"})
+			// Rejections are only counted once, however often the endpoints are built.
+			for i := 0; i < 2; i++ {
+				if got := NewEndpointBuilder(controller.Controller, pod).buildIstioEndpoint("128.0.0.1", 8080, "tcp-port").ServiceAccount; got != tt.want {
+					t.Fatalf("got identity %q, want %q", got, tt.want)
+				}
+			}
+			if got := sumValue(t, "pilot_k8s_rejected_workload_identities", map[string]string{"namespace": "nsA"}) - rejected; got != tt.rejected {
+				t.Fatalf("got %v rejected identities, want %v", got, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestWorkloadIdentityServiceAccounts(t *testing.T) {
+	const platform = "spiffe://cluster.local/platform/workload1"
+	controller, _ := newFakeHarness(t, Options{TrustDomain: "cluster.local", HonorWorkloadIdentityAnnotation: true})
+	defer controller.Stop()
+
+	selector := map[string]string{"app": "a"}
+	addPodsSync(t, controller,
+		generatePod("128.0.0.1", "pod1", "nsA", "sa1", "", selector, map[string]string{WorkloadIdentityAnnotation: platform}),
+		generatePod("128.0.0.2", "pod2", "nsA", "sa2", "", selector, nil))
+	do(t, controller, func() {
+		createService(controller.Controller, "svc1", "nsA", nil, []int32{8080}, selector, t)
+	})
+	do(t, controller, func() {
+		createEndpoints(controller.Controller, "svc1", "nsA", []string{"tcp-port"}, []string{"128.0.0.1", "128.0.0.2"}, t)
+	})
+
+	svc, _ := controller.GetService(kube.ServiceHostname("svc1", "nsA", domainSuffix))
+	if svc == nil {
+		t.Fatal("expected the service")
+	}
+	want := []string{"spiffe://cluster.local/ns/nsA/sa/sa2", platform}
+	if got := controller.GetIstioServiceAccounts(svc, []int{8080}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got service accounts %v, want %v", got, want)
+	}
+}
@@ -15,6 +15,8 @@
 package kube
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"sort"
 	"strconv"
@@ -24,12 +26,14 @@ import (
 	"k8s.io/apimachinery/pkg/util/intstr"
 
 	"istio.io/api/annotation"
+	"istio.io/api/label"
 
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/serviceregistry"
 	"istio.io/istio/pkg/config/constants"
 	"istio.io/istio/pkg/config/host"
 	"istio.io/istio/pkg/config/kube"
+	"istio.io/istio/pkg/config/labels"
 	"istio.io/istio/pkg/config/protocol"
 	"istio.io/istio/pkg/config/visibility"
 	"istio.io/istio/pkg/spiffe"
@@ -46,9 +50,123 @@ const (
 	// It is used for multi-cluster scenario, and with nodePort type gateway service.
 	NodeSelectorAnnotation = "traffic.istio.io/nodeSelector"
 
+	// ExternalAddressesAnnotation is a comma separated list of IPs or hostnames that pins the
+	// externally reachable addresses of a nodePort type gateway service, for clusters where the
+	// node addresses are not reachable from outside, e.g. behind a NAT.
+	ExternalAddressesAnnotation = "traffic.istio.io/external-addresses"
+
+	// ResolutionAnnotation overrides the resolution derived from the cluster IP of the service.
+	// "ClientSideLB" load balances a headless service over its endpoints: like the aliases of
+	// services and the service entries without address, it has the unspecified address, and is
+	// reached by its hostname on the wildcard listeners of its ports. "Passthrough" forwards the
+	// traffic of a service with a cluster IP to the original destination. Other values, and the
+	// annotation on ExternalName services, are ignored.
+	ResolutionAnnotation = "networking.istio.io/resolution"
+
+	// PortConfigAnnotation declares settings of the ports of a service, for the consumers reading
+	// the services of the registry without a sidecar. Its value is a JSON object keyed by service
+	// port number, whose values are model.PortConfig objects:
+	//
+	//   {"8443": {"appTLS": true, "minTLSVersion": "TLSv1_2"}}
+	//
+	// declares that the application terminates TLS on port 8443, accepting TLS 1.2 and above.
+	// Entries for ports the service does not declare, with unknown fields or with an unknown TLS
+	// version are ignored, the others apply.
+	PortConfigAnnotation = "networking.istio.io/port-config"
+
 	managementPortPrefix = "mgmt-"
 )
 
+// NodeSelectorState tells apart the values of the NodeSelectorAnnotation.
+type NodeSelectorState int
+
+const (
+	// NodeSelectorAll is an empty value or an empty object, selecting every node.
+	NodeSelectorAll NodeSelectorState = iota
+	// NodeSelectorLabels is an object of node labels, selecting the nodes with all of them.
+	NodeSelectorLabels
+	// NodeSelectorInvalid is a value that is not a JSON object with string values.
+	NodeSelectorInvalid
+)
+
+// ParseNodeSelector parses the value of the NodeSelectorAnnotation. The error tells why an
+// invalid value, reported as NodeSelectorInvalid, could not be parsed.
+func ParseNodeSelector(value string) (labels.Instance, NodeSelectorState, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, NodeSelectorAll, nil
+	}
+	var selector map[string]string
+	if err := json.Unmarshal([]byte(value), &selector); err != nil {
+		return nil, NodeSelectorInvalid, err
+	}
+	if selector == nil {
+		return nil, NodeSelectorInvalid, fmt.Errorf("%q is not a JSON object", value)
+	}
+	if len(selector) == 0 {
+		return labels.Instance{}, NodeSelectorAll, nil
+	}
+	return selector, NodeSelectorLabels, nil
+}
+
+// portConfigTLSVersions are the values of PortConfig.MinTLSVersion.
+var portConfigTLSVersions = map[string]struct{}{"TLSv1_0": {}, "TLSv1_1": {}, "TLSv1_2": {}, "TLSv1_3": {}}
+
+// ParsePortConfig parses the PortConfigAnnotation of the service, returning the settings of its
+// valid entries, or nil if there are none. The error lists the invalid entries, or tells why the
+// whole value could not be parsed.
+func ParsePortConfig(svc *coreV1.Service) (map[int]model.PortConfig, error) {
+	value, f := svc.Annotations[PortConfigAnnotation]
+	if !f {
+		return nil, nil
+	}
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(value), &entries); err != nil {
+		return nil, err
+	}
+	if entries == nil {
+		return nil, fmt.Errorf("%q is not a JSON object", value)
+	}
+	ports := make(map[int]struct{}, len(svc.Spec.Ports))
+	for _, port := range svc.Spec.Ports {
+		ports[int(port.Port)] = struct{}{}
+	}
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var out map[int]model.PortConfig
+	var errs []string
+	for _, key := range keys {
+		port, err := strconv.Atoi(key)
+		if _, f := ports[port]; err != nil || !f {
+			errs = append(errs, fmt.Sprintf("%q is not a port of the service", key))
+			continue
+		}
+		var config model.PortConfig
+		decoder := json.NewDecoder(bytes.NewReader(entries[key]))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&config); err != nil {
+			errs = append(errs, fmt.Sprintf("port %d: %v", port, err))
+			continue
+		}
+		if _, f := portConfigTLSVersions[config.MinTLSVersion]; config.MinTLSVersion != "" && !f {
+			errs = append(errs, fmt.Sprintf("port %d: unknown minTLSVersion %q", port, config.MinTLSVersion))
+			continue
+		}
+		if out == nil {
+			out = make(map[int]model.PortConfig)
+		}
+		out[port] = config
+	}
+	if len(errs) > 0 {
+		return out, fmt.Errorf("invalid entries: %s", strings.Join(errs, "; "))
+	}
+	return out, nil
+}
+
 func convertPort(port coreV1.ServicePort) *model.Port {
 	return &model.Port{
 		Name:     port.Name,
@@ -57,27 +175,38 @@ func convertPort(port coreV1.ServicePort) *model.Port {
 	}
 }
 
+// ServiceResolution returns the resolution of the service: DNSLB for ExternalName services,
+// Passthrough for headless services and ClientSideLB otherwise, unless the latter two are
+// overridden by the ResolutionAnnotation.
+func ServiceResolution(svc *coreV1.Service) model.Resolution {
+	if svc.Spec.Type == coreV1.ServiceTypeExternalName && svc.Spec.ExternalName != "" {
+		return model.DNSLB
+	}
+	switch value := svc.Annotations[ResolutionAnnotation]; {
+	case strings.EqualFold(value, "ClientSideLB"):
+		return model.ClientSideLB
+	case strings.EqualFold(value, "Passthrough"):
+		return model.Passthrough
+	}
+	if svc.Spec.ClusterIP == "" || svc.Spec.ClusterIP == coreV1.ClusterIPNone {
+		// headless services should not be load balanced
+		return model.Passthrough
+	}
+	return model.ClientSideLB
+}
+
 func ConvertService(svc coreV1.Service, domainSuffix string, clusterID string) *model.Service {
-	addr, external := constants.UnspecifiedIP, ""
+	addr := constants.UnspecifiedIP
 	if svc.Spec.ClusterIP != "" && svc.Spec.ClusterIP != coreV1.ClusterIPNone {
 		addr = svc.Spec.ClusterIP
 	}
 
-	resolution := model.ClientSideLB
-	meshExternal := false
-
-	if svc.Spec.Type == coreV1.ServiceTypeExternalName && svc.Spec.ExternalName != "" {
-		external = svc.Spec.ExternalName
-		resolution = model.DNSLB
-		meshExternal = true
-	}
-
-	if addr == constants.UnspecifiedIP && external == "" { // headless services should not be load balanced
-		resolution = model.Passthrough
-	}
+	resolution := ServiceResolution(&svc)
+	meshExternal := resolution == model.DNSLB
 
 	var labelSelectors map[string]string
-	if svc.Spec.ClusterIP != coreV1.ClusterIPNone && svc.Spec.Type != coreV1.ServiceTypeExternalName {
+	if (svc.Spec.ClusterIP != coreV1.ClusterIPNone && svc.Spec.Type != coreV1.ServiceTypeExternalName) ||
+		resolution == model.ClientSideLB {
 		labelSelectors = svc.Spec.Selector
 	}
 
@@ -119,8 +248,20 @@ func ConvertService(svc coreV1.Service, domainSuffix string, clusterID string) *
 			UID:             formatUID(svc.Namespace, svc.Name),
 			ExportTo:        exportTo,
 			LabelSelectors:  labelSelectors,
+			Labels:          svc.Labels,
+
+			SessionAffinityClientIP:    svc.Spec.SessionAffinity == coreV1.ServiceAffinityClientIP,
+			ExternalTrafficPolicyLocal: svc.Spec.ExternalTrafficPolicy == coreV1.ServiceExternalTrafficPolicyTypeLocal,
 		},
 	}
+	// The invalid entries are reported by the registry.
+	istioService.Attributes.PortConfigs, _ = ParsePortConfig(&svc)
+
+	if len(svc.Spec.ExternalIPs) > 0 {
+		externalIPs := make([]string, len(svc.Spec.ExternalIPs))
+		copy(externalIPs, svc.Spec.ExternalIPs)
+		istioService.Attributes.ClusterExternalIPs = map[string][]string{clusterID: externalIPs}
+	}
 
 	switch svc.Spec.Type {
 	case coreV1.ServiceTypeNodePort:
@@ -159,7 +300,7 @@ func ConvertService(svc coreV1.Service, domainSuffix string, clusterID string) *
 	return istioService
 }
 
-func ExternalNameServiceInstances(k8sSvc coreV1.Service, svc *model.Service) []*model.ServiceInstance {
+func ExternalNameServiceInstances(k8sSvc coreV1.Service, svc *model.Service, clusterID string) []*model.ServiceInstance {
 	if k8sSvc.Spec.Type != coreV1.ServiceTypeExternalName || k8sSvc.Spec.ExternalName == "" {
 		return nil
 	}
@@ -173,6 +314,7 @@ func ExternalNameServiceInstances(k8sSvc coreV1.Service, svc *model.Service) []*
 				EndpointPort:    uint32(portEntry.Port),
 				ServicePortName: portEntry.Name,
 				Labels:          k8sSvc.Labels,
+				Locality:        model.Locality{ClusterID: clusterID},
 			},
 		})
 	}
@@ -200,12 +342,20 @@ func SecureNamingSAN(pod *coreV1.Pod) string {
 	return spiffe.MustGenSpiffeURI(pod.Namespace, pod.Spec.ServiceAccountName)
 }
 
-// PodTLSMode returns the tls mode associated with the pod if pod has been injected with sidecar
+// PodTLSMode returns the tls mode associated with the pod if pod has been injected with sidecar.
+// The security.istio.io/tlsMode label takes precedence; without it, a pod carrying the sidecar
+// injection status annotation is assumed to accept Istio mTLS.
 func PodTLSMode(pod *coreV1.Pod) string {
 	if pod == nil {
 		return model.DisabledTLSModeLabel
 	}
-	return model.GetTLSModeFromEndpointLabels(pod.Labels)
+	if _, f := pod.Labels[label.TLSMode]; f {
+		return model.GetTLSModeFromEndpointLabels(pod.Labels)
+	}
+	if _, f := pod.Annotations[annotation.SidecarStatus.Name]; f {
+		return model.IstioMutualTLSModeLabel
+	}
+	return model.DisabledTLSModeLabel
 }
 
 // KeyFunc is the internal API key function that returns "namespace"/"name" or
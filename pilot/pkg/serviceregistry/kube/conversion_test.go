@@ -23,7 +23,9 @@ import (
 
 	"istio.io/api/annotation"
 
+	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pkg/config/kube"
+	"istio.io/istio/pkg/config/labels"
 	"istio.io/istio/pkg/config/protocol"
 	"istio.io/istio/pkg/spiffe"
 
@@ -152,6 +154,7 @@ func TestServiceConversion(t *testing.T) {
 				"other/annotation": "test",
 			},
 			CreationTimestamp: metaV1.Time{Time: tnow},
+			Labels:            map[string]string{"istio.io/rev": "canary"},
 		},
 		Spec: coreV1.ServiceSpec{
 			ClusterIP: ip,
@@ -203,6 +206,10 @@ func TestServiceConversion(t *testing.T) {
 			localSvc.Spec.Selector)
 	}
 
+	if !reflect.DeepEqual(service.Attributes.Labels, localSvc.Labels) {
+		t.Fatalf("service labels incorrect => %q, want %q", service.Attributes.Labels, localSvc.Labels)
+	}
+
 	sa := service.ServiceAccounts
 	if sa == nil || len(sa) != 4 {
 		t.Fatalf("number of service accounts is incorrect")
@@ -407,6 +414,231 @@ func TestLBServiceConversion(t *testing.T) {
 	}
 }
 
+func TestExternalIPsServiceConversion(t *testing.T) {
+	externalIPs := []string{"203.0.113.10", "203.0.113.11"}
+	svc := coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      "service1",
+			Namespace: "default",
+		},
+		Spec: coreV1.ServiceSpec{
+			ClusterIP: "10.0.0.1",
+			Ports: []coreV1.ServicePort{
+				{
+					Name:     "http",
+					Port:     80,
+					Protocol: coreV1.ProtocolTCP,
+				},
+			},
+			ExternalIPs: externalIPs,
+		},
+	}
+
+	service := ConvertService(svc, domainSuffix, clusterID)
+	if got := service.Attributes.ClusterExternalIPs[clusterID]; !reflect.DeepEqual(got, externalIPs) {
+		t.Fatalf("got external IPs %v, want %v", got, externalIPs)
+	}
+	if service.Attributes.ClusterExternalAddresses != nil {
+		t.Fatalf("external IPs must not be used as gateway addresses, got %v", service.Attributes.ClusterExternalAddresses)
+	}
+
+	svc.Spec.ExternalIPs = nil
+	if service := ConvertService(svc, domainSuffix, clusterID); service.Attributes.ClusterExternalIPs != nil {
+		t.Fatalf("expected no external IPs, got %v", service.Attributes.ClusterExternalIPs)
+	}
+}
+
+func TestTrafficPolicyServiceConversion(t *testing.T) {
+	svc := coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:      "service1",
+			Namespace: "default",
+		},
+		Spec: coreV1.ServiceSpec{
+			Type:      coreV1.ServiceTypeNodePort,
+			ClusterIP: "10.0.0.1",
+			Ports: []coreV1.ServicePort{
+				{
+					Name:     "http",
+					Port:     80,
+					Protocol: coreV1.ProtocolTCP,
+				},
+			},
+		},
+	}
+
+	service := ConvertService(svc, domainSuffix, clusterID)
+	if service.Attributes.SessionAffinityClientIP || service.Attributes.ExternalTrafficPolicyLocal {
+		t.Fatalf("expected the default policies, got %+v", service.Attributes)
+	}
+
+	svc.Spec.SessionAffinity = coreV1.ServiceAffinityClientIP
+	svc.Spec.ExternalTrafficPolicy = coreV1.ServiceExternalTrafficPolicyTypeLocal
+	service = ConvertService(svc, domainSuffix, clusterID)
+	if !service.Attributes.SessionAffinityClientIP {
+		t.Fatal("expected the client IP session affinity")
+	}
+	if !service.Attributes.ExternalTrafficPolicyLocal {
+		t.Fatal("expected the Local external traffic policy")
+	}
+}
+
+func TestParsePortConfig(t *testing.T) {
+	cases := []struct {
+		name  string
+		value string
+		want  map[int]model.PortConfig
+		err   string
+	}{
+		{name: "no annotation"},
+		{
+			name:  "valid",
+			value: `{"8443": {"appTLS": true, "minTLSVersion": "TLSv1_2"}, "80": {}}`,
+			want:  map[int]model.PortConfig{8443: {AppTLS: true, MinTLSVersion: "TLSv1_2"}, 80: {}},
+		},
+		{
+			name: "partial",
+			value: `{"8443": {"appTLS": true}, "9090": {"appTLS": true}, "http": {}, ` +
+				`"80": {"tls": true}, "8080": {"minTLSVersion": "TLSv1_4"}}`,
+			want: map[int]model.PortConfig{8443: {AppTLS: true}},
+			err:  `"9090" is not a port of the service`,
+		},
+		{
+			name:  "invalid JSON",
+			value: `{"8443": {"appTLS": true}`,
+			err:   "unexpected end of JSON input",
+		},
+		{
+			name:  "not an object",
+			value: `null`,
+			err:   "is not a JSON object",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &coreV1.Service{
+				ObjectMeta: metaV1.ObjectMeta{Name: "service1", Namespace: "default"},
+				Spec: coreV1.ServiceSpec{
+					ClusterIP: "10.0.0.1",
+					Ports: []coreV1.ServicePort{
+						{Name: "http", Port: 80},
+						{Name: "http-alt", Port: 8080},
+						{Name: "https", Port: 8443},
+					},
+				},
+			}
+			if tt.value != "" {
+				svc.Annotations = map[string]string{PortConfigAnnotation: tt.value}
+			}
+			got, err := ParsePortConfig(svc)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got port configs %v, want %v", got, tt.want)
+			}
+			if tt.err == "" && err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+			if converted := ConvertService(*svc, domainSuffix, clusterID); !reflect.DeepEqual(converted.Attributes.PortConfigs, tt.want) {
+				t.Fatalf("got converted port configs %v, want %v", converted.Attributes.PortConfigs, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolutionAnnotation(t *testing.T) {
+	cases := []struct {
+		name       string
+		clusterIP  string
+		annotation string
+		want       model.Resolution
+		selector   bool
+	}{
+		{"cluster IP", "10.0.0.1", "", model.ClientSideLB, true},
+		{"headless", coreV1.ClusterIPNone, "", model.Passthrough, false},
+		{"cluster IP to passthrough", "10.0.0.1", "Passthrough", model.Passthrough, true},
+		{"cluster IP to client side", "10.0.0.1", "ClientSideLB", model.ClientSideLB, true},
+		{"headless to client side", coreV1.ClusterIPNone, "clientsidelb", model.ClientSideLB, true},
+		{"no cluster IP to client side", "", "ClientSideLB", model.ClientSideLB, true},
+		{"invalid value", coreV1.ClusterIPNone, "DNS", model.Passthrough, false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := coreV1.Service{
+				ObjectMeta: metaV1.ObjectMeta{
+					Name:        "service1",
+					Namespace:   "default",
+					Annotations: map[string]string{},
+				},
+				Spec: coreV1.ServiceSpec{
+					ClusterIP: tt.clusterIP,
+					Selector:  map[string]string{"app": "a"},
+					Ports:     []coreV1.ServicePort{{Name: "tcp", Port: 80, Protocol: coreV1.ProtocolTCP}},
+				},
+			}
+			if tt.annotation != "" {
+				svc.Annotations[ResolutionAnnotation] = tt.annotation
+			}
+			service := ConvertService(svc, domainSuffix, clusterID)
+			if service.Resolution != tt.want {
+				t.Fatalf("got resolution %v, want %v", service.Resolution, tt.want)
+			}
+			if got := service.Attributes.LabelSelectors != nil; got != tt.selector {
+				t.Fatalf("got label selectors %v, want selector %v", service.Attributes.LabelSelectors, tt.selector)
+			}
+		})
+	}
+
+	// ExternalName services keep resolving through DNS.
+	svc := coreV1.Service{
+		ObjectMeta: metaV1.ObjectMeta{
+			Name:        "service1",
+			Namespace:   "default",
+			Annotations: map[string]string{ResolutionAnnotation: "ClientSideLB"},
+		},
+		Spec: coreV1.ServiceSpec{
+			Type:         coreV1.ServiceTypeExternalName,
+			ExternalName: "example.com",
+		},
+	}
+	if service := ConvertService(svc, domainSuffix, clusterID); service.Resolution != model.DNSLB || !service.MeshExternal {
+		t.Fatalf("expected a mesh external DNS service, got %v", service)
+	}
+}
+
+func TestParseNodeSelector(t *testing.T) {
+	cases := []struct {
+		name      string
+		value     string
+		want      labels.Instance
+		wantState NodeSelectorState
+	}{
+		{"empty", "", nil, NodeSelectorAll},
+		{"blank", "  ", nil, NodeSelectorAll},
+		{"empty object", "{}", labels.Instance{}, NodeSelectorAll},
+		{"labels", `{"pool": "gateway"}`, labels.Instance{"pool": "gateway"}, NodeSelectorLabels},
+		{"invalid JSON", `{"pool": "gateway"`, nil, NodeSelectorInvalid},
+		{"not a string map", `{"pool": 1}`, nil, NodeSelectorInvalid},
+		{"array", `["pool"]`, nil, NodeSelectorInvalid},
+		{"null", "null", nil, NodeSelectorInvalid},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, state, err := ParseNodeSelector(c.value)
+			if state != c.wantState {
+				t.Fatalf("got state %v, want %v", state, c.wantState)
+			}
+			if (err != nil) != (c.wantState == NodeSelectorInvalid) {
+				t.Fatalf("unexpected error %v for state %v", err, state)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("got selector %#v, want %#v", got, c.want)
+			}
+		})
+	}
+}
+
 func TestSecureNamingSANCustomIdentity(t *testing.T) {
 
 	pod := &coreV1.Pod{}